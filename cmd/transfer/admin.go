@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"socket-file-transfer/internal/admin"
+	"socket-file-transfer/internal/config"
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/transfers"
+	"socket-file-transfer/internal/wire"
+)
+
+// How long transfer admin waits for the server by default
+const DefaultAdminTimeout = time.Minute
+
+// adminServer serves the admin socket of serve -admin-socket on addr,
+// reporting on the transfers in registry and sweeping the stores
+// following policy.
+func adminServer(addr, token string, registry *transfers.Registry, settings *config.Config, policy *store.Live) func(context.Context) error {
+	srv := &admin.Server{
+		Addr:      addr,
+		Token:     token,
+		Transfers: registry,
+		Config: func(w io.Writer) error {
+			settingsMu.Lock()
+			defer settingsMu.Unlock()
+			return settings.Print(w)
+		},
+		Sweep: func() error {
+			if !policy.Policy().Retention.Enabled() {
+				return errors.New("no retention policy, see -retain-days and -retain-max-bytes")
+			}
+			return policy.Sweep()
+		},
+	}
+	return srv.ListenAndServe
+}
+
+// runAdmin is transfer admin: it asks the server on -socket for its
+// transfers, to kill one, for its settings or to sweep its upload
+// directory now.
+func runAdmin(args []string) {
+	if len(args) == 0 {
+		fmt.Println(i18n.T("admin.usage"))
+		os.Exit(1)
+	}
+	op := args[0]
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	var socket = fs.String("socket", "", "The server's -admin-socket: a unix socket path, or host:port")
+	var token = fs.String("token", "", "The server's -admin-token")
+	var timeout = fs.Duration("timeout", DefaultAdminTimeout, "Give up on the server after this long")
+	parseFlags(fs, args[1:])
+
+	req := admin.Request{Op: op}
+	switch op {
+	case admin.OP_KILL:
+		if fs.NArg() != 1 {
+			fmt.Println(i18n.T("admin.usage"))
+			os.Exit(1)
+		}
+		id, err := strconv.ParseUint(fs.Arg(0), 10, 64)
+		if err != nil {
+			fmt.Println(i18n.T("admin.invalid_id", fs.Arg(0)))
+			os.Exit(1)
+		}
+		req.ID = id
+	case admin.OP_STATUS, admin.OP_CONFIG, admin.OP_SWEEP:
+		if fs.NArg() != 0 {
+			fmt.Println(i18n.T("admin.usage"))
+			os.Exit(1)
+		}
+	default:
+		fmt.Println(i18n.T("admin.usage"))
+		os.Exit(1)
+	}
+	if *socket == "" {
+		fmt.Println(i18n.T("admin.requires_socket"))
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	resp, err := admin.Do(ctx, *socket, *token, req)
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+
+	switch op {
+	case admin.OP_STATUS:
+		printTransfers(resp.Transfers)
+	case admin.OP_KILL:
+		fmt.Println(i18n.T("admin.killed", req.ID))
+	case admin.OP_CONFIG:
+		fmt.Print(resp.Config)
+	case admin.OP_SWEEP:
+		fmt.Println(i18n.T("admin.swept"))
+	}
+}
+
+func printTransfers(list []transfers.Transfer) {
+	if len(list) == 0 {
+		fmt.Println(i18n.T("admin.no_transfers"))
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, i18n.T("admin.header"))
+	for _, t := range list {
+		progress := wire.FormatBytes(t.Bytes)
+		if t.Total > 0 {
+			progress += fmt.Sprintf(" (%.0f%%)", float64(t.Bytes)/float64(t.Total)*100)
+		}
+		state := t.State
+		if t.Status != "" {
+			state += ", " + t.Status
+		}
+		elapsed := time.Since(t.Started).Truncate(time.Second)
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Remote, t.Name, progress, wire.FormatRate(t.Rate, time.Second), state, elapsed)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"socket-file-transfer/internal/checksum"
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/quicft"
+	"socket-file-transfer/tcpft"
+	"socket-file-transfer/udpft"
+)
+
+// benchResult is one row of the bench report.
+type benchResult struct {
+	Proto       string  `json:"proto"`
+	Bytes       int64   `json:"bytes"`
+	Seconds     float64 `json:"seconds"`
+	Throughput  float64 `json:"throughput_mb_s"`
+	Packets     uint32  `json:"packets,omitempty"`
+	PacketRate  float64 `json:"packets_per_second,omitempty"`
+	Retransmits int     `json:"retransmits"`
+	CPUSeconds  float64 `json:"cpu_seconds"`
+	Setting     string  `json:"setting,omitempty"` // Buffer or window cap, if pinned by -sweep or tuned
+
+	// Packet counters of the UDP client
+	UDP *udpft.Stats `json:"udp,omitempty"`
+}
+
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var proto = fs.String("proto", "all", "Protocol: 'tcp', 'udp', 'quic', 'both' (TCP and UDP) or 'all'")
+	var sizeFlag = fs.String("size", "100M", "Payload size in bytes, with an optional K, M or G suffix")
+	var addr = fs.String("addr", "", "Host running 'transfer serve' (default a local server on loopback); its QUIC certificate isn't verified")
+	var seed = fs.Int64("seed", 1, "Seed of the pseudo-random payload")
+	var packetSize = fs.Int("packet-size", udpft.DefaultPacketSize, "UDP payload bytes per packet")
+	var window = fs.Int("window", 0, "Fixed number of UDP packets in flight (0 adapts it to congestion)")
+	var maxWindow = fs.Int("max-window", udpft.RECEIVE_WINDOW, "Cap of the adaptive UDP window")
+	var bufferFlag = fs.String("buffer", "256K", "TCP read and write buffer size, with an optional K, M or G suffix")
+	var batchIO = fs.Bool("batch-io", false, "Have the loopback UDP server read and acknowledge packets in batches (Linux)")
+	var hashFlag = fs.String("hash", "sha256", "Hash TCP and QUIC transfers are checked with: sha256, blake3, xxh3 or crc32c")
+	var asJSON = fs.Bool("json", false, "Print the results as JSON")
+	var noAutotune = fs.Bool("no-autotune", false, "Use the default -buffer and -max-window instead of tuning them to the transfer's throughput")
+	var sweep = fs.Bool("sweep", false, "Send once with each TCP buffer or UDP window cap autotuning tries, then autotuned, and compare")
+	parseFlags(fs, args)
+
+	bufferSize := mustParseBuffer(*bufferFlag)
+	tuneBuffer := !*noAutotune && !flagSet(fs, "buffer")
+	tuneWindow := !*noAutotune && !flagSet(fs, "max-window")
+
+	size, err := parseSize(*sizeFlag)
+	if err != nil {
+		fmt.Println(i18n.T("bench.invalid_size", err))
+		os.Exit(1)
+	}
+	hash, err := checksum.Parse(*hashFlag)
+	if err != nil {
+		fmt.Println(i18n.T("invalid_hash", err))
+		os.Exit(1)
+	}
+
+	var protos []string
+	switch *proto {
+	case "tcp", "udp", "quic":
+		protos = []string{*proto}
+	case "both":
+		protos = []string{"tcp", "udp"}
+	case "all":
+		protos = []string{"tcp", "udp", "quic"}
+	default:
+		fmt.Println(i18n.T("unknown_protocol", *proto))
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var servers benchServers
+	cleanup := func() {}
+	if *addr != "" {
+		servers.tcp = net.JoinHostPort(*addr, wire.TCP_PORT[1:])
+		servers.udp = net.JoinHostPort(*addr, wire.UDP_PORT[1:])
+		servers.quic = net.JoinHostPort(*addr, wire.QUIC_PORT[1:])
+		// The payload is random, so an unverified server costs nothing
+		servers.quicTLS = &tls.Config{InsecureSkipVerify: true}
+	} else {
+		servers, cleanup, err = startBenchServers(ctx, bufferSize, *batchIO)
+		if err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(1)
+		}
+	}
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	name := fmt.Sprintf("bench-%d.bin", *seed)
+	var results []benchResult
+
+	// run sends the payload once over p, with the TCP buffer or UDP
+	// window cap in setting unless tuning
+	run := func(p string, setting int, tune bool) benchResult {
+		payload := rand.New(rand.NewSource(*seed))
+		res := benchResult{Proto: p, Bytes: size}
+		countRetransmits := func(ev wire.Event) {
+			if ev.Kind == wire.EventRetransmit {
+				res.Retransmits++
+			}
+		}
+
+		if !*asJSON {
+			fmt.Println(i18n.T("bench.sending_over", wire.FormatBytes(size), strings.ToUpper(p)))
+		}
+		tcpOpts := tcpft.Options{BufferSize: setting, Autotune: tune, Hash: hash, Logger: quiet, Progress: countRetransmits}
+		var tcpRes *tcpft.Result
+		cpuBefore := cpuTime()
+		start := time.Now()
+		switch p {
+		case "tcp":
+			var client tcpft.Client
+			tcpRes, err = client.Send(ctx, servers.tcp, name, payload, size, tcpOpts)
+		case "quic":
+			dialer := &quicft.Dialer{TLSConfig: servers.quicTLS}
+			client := tcpft.Client{Dial: dialer.Dial}
+			tcpRes, err = client.Send(ctx, servers.quic, name, payload, size, tcpOpts)
+			dialer.Close()
+		case "udp":
+			var client udpft.Client
+			var r *udpft.Result
+			r, err = client.Send(ctx, servers.udp, name, payload, size, udpft.Options{PacketSize: *packetSize, Window: *window, MaxWindow: setting, Autotune: tune, Logger: quiet, Progress: countRetransmits})
+			if err == nil {
+				res.Packets, res.UDP = r.Packets, &r.Stats
+				if r.MaxWindow > 0 {
+					res.Setting = i18n.T("bench.tuned", fmt.Sprintf("-max-window=%d", r.MaxWindow))
+				} else if *sweep {
+					res.Setting = fmt.Sprintf("-max-window=%d", setting)
+				}
+			}
+		}
+		if err != nil {
+			cleanup()
+			fmt.Println(i18n.T("bench.failed", strings.ToUpper(p), err))
+			os.Exit(exitCode(err))
+		}
+		wall := time.Since(start)
+		if tcpRes != nil && tcpRes.Buffer > 0 {
+			res.Setting = i18n.T("bench.tuned", "-buffer="+formatSize(int64(tcpRes.Buffer)))
+		} else if tcpRes != nil && *sweep {
+			res.Setting = "-buffer=" + formatSize(int64(setting))
+		}
+
+		res.Seconds = wall.Seconds()
+		res.Throughput = float64(size) / (1 << 20) / res.Seconds
+		res.PacketRate = float64(res.Packets) / res.Seconds
+		res.CPUSeconds = (cpuTime() - cpuBefore).Seconds()
+		return res
+	}
+
+	var compared []string
+	for _, p := range protos {
+		setting, tune := bufferSize, tuneBuffer
+		tuner := wire.NewTuner(tcpft.MIN_TUNED_BUFFER, tcpft.MAX_TUNED_BUFFER)
+		if p == "udp" {
+			setting, tune = *maxWindow, tuneWindow && *window == 0
+			tuner = wire.NewTuner(min(udpft.MIN_TUNED_WINDOW, *maxWindow), *maxWindow)
+		}
+		if !*sweep {
+			results = append(results, run(p, setting, tune))
+			continue
+		}
+
+		// Each setting the tuner may settle on, pinned, against the tuner
+		var best benchResult
+		for _, v := range tuner.Steps() {
+			res := run(p, v, false)
+			if res.Throughput > best.Throughput {
+				best = res
+			}
+			results = append(results, res)
+		}
+		tuned := run(p, setting, true)
+		results = append(results, tuned)
+		compared = append(compared, i18n.T("bench.compared", strings.ToUpper(p), tuned.Throughput/best.Throughput*100, best.Setting))
+	}
+	cleanup()
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, i18n.T("bench.header"))
+	for _, r := range results {
+		rate, loss := "-", "-"
+		if r.Packets > 0 {
+			rate = fmt.Sprintf("%.0f", r.PacketRate)
+			loss = fmt.Sprintf("%.2f%%", float64(r.Retransmits)/float64(int(r.Packets)+r.Retransmits)*100)
+		}
+		proto := strings.ToUpper(r.Proto)
+		if r.Setting != "" {
+			proto += " " + r.Setting
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.2fs\t%.2f MB/s\t%s\t%d\t%s\t%.2fs\t\n",
+			proto, wire.FormatBytes(r.Bytes), r.Seconds, r.Throughput, rate, r.Retransmits, loss, r.CPUSeconds)
+	}
+	tw.Flush()
+	for _, line := range compared {
+		fmt.Println(line)
+	}
+	if *addr == "" {
+		fmt.Println(i18n.T("bench.cpu_note"))
+	}
+}
+
+// benchServers are the addresses of the servers bench sends to.
+type benchServers struct {
+	tcp, udp, quic string
+	quicTLS        *tls.Config // Trusts the QUIC server
+}
+
+// startBenchServers runs a TCP, a UDP and a QUIC server on loopback ports
+// until ctx ends. Files are stored in a temporary directory that cleanup
+// removes.
+func startBenchServers(ctx context.Context, bufferSize int, batchIO bool) (servers benchServers, cleanup func(), err error) {
+	dir, err := os.MkdirTemp("", "transfer-bench")
+	if err != nil {
+		return servers, nil, fmt.Errorf("error creating upload directory: %w", err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		cleanup()
+		return servers, nil, fmt.Errorf("error starting TCP server: %w", err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		listener.Close()
+		cleanup()
+		return servers, nil, fmt.Errorf("error starting UDP server: %w", err)
+	}
+	cert, _, err := quicft.SelfSigned("127.0.0.1")
+	var quicListener *quicft.Listener
+	if err == nil {
+		quicListener, err = quicft.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	if err != nil {
+		listener.Close()
+		conn.Close()
+		cleanup()
+		return servers, nil, fmt.Errorf("error starting QUIC server: %w", err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	discard := func(wire.Event) {}
+	tcpServer := &tcpft.Server{UploadDir: dir}
+	tcpServer.Logger, tcpServer.Progress = quiet, discard
+	tcpServer.BufferSize = bufferSize
+	quicServer := *tcpServer
+	udpServer := &udpft.Server{UploadDir: dir}
+	udpServer.Logger, udpServer.Progress = quiet, discard
+	udpServer.BatchIO = batchIO
+
+	go tcpServer.Serve(ctx, listener)
+	go udpServer.Serve(ctx, conn)
+	go quicServer.Serve(ctx, quicListener)
+	servers = benchServers{
+		tcp:     listener.Addr().String(),
+		udp:     conn.LocalAddr().String(),
+		quic:    quicListener.Addr().String(),
+		quicTLS: &tls.Config{RootCAs: roots},
+	}
+	return servers, cleanup, nil
+}
+
+// parseSize parses a byte count such as 1G, 512M, 64K or 1000.
+func parseSize(s string) (int64, error) {
+	shift := 0
+	switch strings.ToUpper(s[len(s)-min(len(s), 1):]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 || n > (1<<62)>>shift {
+		return 0, errors.New("size out of range")
+	}
+	return n << shift, nil
+}
+
+// formatSize renders n as parseSize reads it, in the largest unit that
+// divides it.
+func formatSize(n int64) string {
+	for _, u := range []struct {
+		shift  int
+		suffix string
+	}{{30, "G"}, {20, "M"}, {10, "K"}} {
+		if n >= 1<<u.shift && n%(1<<u.shift) == 0 {
+			return strconv.FormatInt(n>>u.shift, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// parseLimit is parseSize that also accepts 0, for flags where it means
+// no limit.
+func parseLimit(s string) (int64, error) {
+	if s == "0" {
+		return 0, nil
+	}
+	return parseSize(s)
+}
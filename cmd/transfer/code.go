@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/quicft"
+	"socket-file-transfer/tcpft"
+)
+
+// sendCode stages the file at source, sent as name, on the server at addr
+// and returns the code that fetches it.
+func sendCode(ctx context.Context, client tcpft.Client, addr, source, name string, opts tcpft.Options) (string, *tcpft.Result, error) {
+	sess, err := client.OpenSession(ctx, addr, opts)
+	if err != nil {
+		return "", nil, err
+	}
+	defer sess.Close()
+	return sess.Stage(ctx, source, name)
+}
+
+// runReceive is transfer receive: it fetches the file a sender staged
+// with send -code, given the code they read out.
+func runReceive(args []string) {
+	fs := flag.NewFlagSet("receive", flag.ExitOnError)
+	var proto = fs.String("proto", "tcp", "Protocol: 'tcp' or 'quic'")
+	var addr = fs.String("addr", "", "Server address (default localhost:8080 for TCP, localhost:8082 for QUIC)")
+	var unixSocket = fs.String("unix", "", "Connect to the TCP server's unix socket at this path instead of -addr")
+	var wsURL = fs.String("ws", "", "Tunnel to the TCP server over WebSocket at this URL, e.g. wss://host/ws, instead of -addr")
+	var proxyFlag = fs.String("proxy", "", "Reach the TCP server through this proxy, socks5://[user:pass@]host:port or http://[user:pass@]host:port (default ALL_PROXY unless NO_PROXY exempts the server; 'direct' ignores them)")
+	var tlsCA = fs.String("tls-ca", "", "PEM certificates to trust for QUIC instead of the system roots")
+	var tlsInsecure = fs.Bool("tls-insecure", false, "Accept any QUIC server certificate, such as a self-signed one")
+	var out = fs.String("out", "", "Path or directory to write the file to (default its name, in the current directory)")
+	var force = fs.Bool("force", false, "Overwrite the output file if it exists")
+	var bufferFlag = fs.String("buffer", "256K", "TCP read and write buffer size, with an optional K, M or G suffix")
+	var timeout = fs.Duration("timeout", 0, "Abort the transfer if it takes longer than this (0 means no limit)")
+
+	// The code comes first, as in 'transfer receive 7-frog-apple', but
+	// may follow the flags too
+	var code string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		code, args = args[0], args[1:]
+	}
+	parseFlags(fs, args)
+	if code == "" && fs.NArg() > 0 {
+		code = strings.Join(fs.Args(), " ")
+	}
+	if code == "" {
+		fmt.Println(i18n.T("receive.requires_code"))
+		fmt.Println(i18n.T("receive.usage"))
+		os.Exit(1)
+	}
+
+	client := tcpft.Client{UnixSocket: *unixSocket, WebSocket: *wsURL}
+	*addr = tunnelAddr(*proto, *addr, *unixSocket, *wsURL)
+	switch *proto {
+	case "tcp":
+		if *unixSocket == "" && *wsURL == "" {
+			client.Proxy = proxyFor(*proxyFlag, *addr)
+		}
+		if *addr == "" {
+			*addr = "localhost" + wire.TCP_PORT
+		}
+	case "quic":
+		tlsConfig, err := clientTLS(*tlsCA, *tlsInsecure, "", "")
+		if err != nil {
+			fmt.Println(i18n.T("invalid_tls_ca", err))
+			os.Exit(1)
+		}
+		dialer := &quicft.Dialer{TLSConfig: tlsConfig}
+		defer dialer.Close()
+		client.Dial = dialer.Dial
+		if *addr == "" {
+			*addr = "localhost" + wire.QUIC_PORT
+		}
+	default:
+		fmt.Println(i18n.T("unknown_protocol", *proto))
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	// The file goes where -out says, under the name it was sent as if
+	// that is a directory
+	dest := func(name string) (string, error) {
+		path := filepath.Base(name)
+		if *out != "" {
+			path = *out
+			if info, err := os.Stat(*out); err == nil && info.IsDir() {
+				path = filepath.Join(*out, filepath.Base(name))
+			}
+		}
+		if _, err := os.Lstat(path); err == nil && !*force {
+			return "", fmt.Errorf("%s already exists, pass -force to overwrite it", path)
+		}
+		return path, nil
+	}
+
+	sess, err := client.OpenSession(ctx, *addr, tcpft.Options{BufferSize: mustParseBuffer(*bufferFlag)})
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(exitCode(err))
+	}
+	defer sess.Close()
+	path, res, err := sess.Claim(ctx, code, dest)
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(exitCode(err))
+	}
+	fmt.Println(i18n.T("receive.received", path))
+	wire.PrintSummary(res.Bytes, res.Duration)
+	fmt.Println(i18n.T("sha256_verified", res.Checksum))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/codes"
+	"socket-file-transfer/tcpft"
+)
+
+// send -code prints a code that receive fetches the file with, once.
+func TestSendCodeReceive(t *testing.T) {
+	s := &tcpft.Server{}
+	s.UploadDir = t.TempDir()
+	cs, err := codes.Open(s.UploadDir, time.Hour, 1, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Codes = cs
+	addr := serveTCP(t, s)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.txt")
+	os.WriteFile(path, []byte("read this code out"), 0644)
+
+	out, code := run(t, "", nil, "send", "-code", "-file="+path, "-addr="+addr)
+	if code != 0 {
+		t.Fatalf("send exit code %d:\n%s", code, out)
+	}
+	m := regexp.MustCompile(`Code: (\S+)`).FindStringSubmatch(out)
+	if m == nil {
+		t.Fatalf("no code in the output:\n%s", out)
+	}
+
+	// Typed back in upper case, with spaces
+	typed := strings.ToUpper(strings.ReplaceAll(m[1], "-", " "))
+	into := t.TempDir()
+	out, code = run(t, "", nil, "receive", typed, "-addr="+addr, "-out="+into)
+	if code != 0 {
+		t.Fatalf("receive exit code %d:\n%s", code, out)
+	}
+	if got, _ := os.ReadFile(filepath.Join(into, "notes.txt")); string(got) != "read this code out" {
+		t.Errorf("received %q", got)
+	}
+	if !strings.Contains(out, "SHA-256") {
+		t.Errorf("output doesn't report the checksum verified:\n%s", out)
+	}
+
+	out, code = run(t, "", nil, "receive", m[1], "-addr="+addr, "-out="+t.TempDir())
+	if code == 0 {
+		t.Errorf("code used twice:\n%s", out)
+	}
+}
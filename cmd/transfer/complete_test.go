@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// Settings that remember where a file was stored before -completed-dir
+// moves it are refused with it, before anything is written.
+func TestServeCompletedRefused(t *testing.T) {
+	dir, wd := t.TempDir(), t.TempDir()
+	for _, args := range [][]string{
+		{"-issue-tokens", "-http-addr=127.0.0.1:0"},
+		{"-codes"},
+		{"-dedupe"},
+	} {
+		out, code := runIn(t, wd, "", nil, append([]string{"serve", "-completed-dir=" + dir}, args...)...)
+		if code != 1 || !strings.Contains(out, "-completed-dir") {
+			t.Errorf("serve -completed-dir %s: exit code %d, want 1 and why:\n%s", strings.Join(args, " "), code, out)
+		}
+	}
+	if names, _ := os.ReadDir(wd); len(names) != 0 {
+		t.Errorf("refused serve left %v behind", names)
+	}
+}
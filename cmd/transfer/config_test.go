@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/tcpft"
+)
+
+// startServe runs transfer serve over TCP in a temporary directory until
+// the test ends, adding env to its environment, and returns its address
+// and process.
+func startServe(t *testing.T, env []string, args ...string) (string, *os.Process) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cmd := exec.Command(os.Args[0], append([]string{"serve", "-tcp-addr=" + addr}, args...)...)
+	cmd.Dir = t.TempDir()
+	cmd.Env = append([]string{"TRANSFER_TEST_MAIN=1", "LANG=en_US.UTF-8", "HOME=" + t.TempDir(), "PATH=" + os.Getenv("PATH")}, env...)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr, cmd.Process
+		}
+	}
+	t.Fatalf("serve not listening on %s:\n%s", addr, out.String())
+	return "", nil
+}
+
+// TRANSFER_MAX_SIZE takes the unit suffixes -max-size does.
+func TestEnvMaxSize(t *testing.T) {
+	tests := []struct {
+		env   string
+		limit int
+	}{
+		{"1K", 1 << 10},
+		{"2k", 2 << 10},
+		{"1M", 1 << 20},
+		{"1500", 1500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			addr, _ := startServe(t, []string{"TRANSFER_MAX_SIZE=" + tt.env})
+			opts := tcpft.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), Progress: func(tcpft.Event) {}}
+			dir := t.TempDir()
+
+			fits := filepath.Join(dir, "fits")
+			os.WriteFile(fits, make([]byte, tt.limit), 0644)
+			if _, err := (&tcpft.Client{}).SendFile(context.Background(), addr, fits, opts); err != nil {
+				t.Errorf("file of %d bytes: %v", tt.limit, err)
+			}
+			over := filepath.Join(dir, "over")
+			os.WriteFile(over, make([]byte, tt.limit+1), 0644)
+			if _, err := (&tcpft.Client{}).SendFile(context.Background(), addr, over, opts); !errors.Is(err, wire.ErrTooLarge) {
+				t.Errorf("file of %d bytes: got %v, want ErrTooLarge", tt.limit+1, err)
+			}
+		})
+	}
+
+	out, code := run(t, "", []string{"TRANSFER_MAX_SIZE=lots"}, "serve", "-tcp-addr=127.0.0.1:0")
+	if code != 1 || !strings.Contains(out, "invalid -max-size") {
+		t.Errorf("serve with TRANSFER_MAX_SIZE=lots exited %d:\n%s", code, out)
+	}
+}
+
+// Every setting config print prints for a subcommand reads back from a
+// config file to the same settings.
+func TestConfigPrintRoundTrip(t *testing.T) {
+	comment := regexp.MustCompile(` # .*`)
+	for _, cmd := range []string{"serve", "send", "sync"} {
+		t.Run(cmd, func(t *testing.T) {
+			out, code := run(t, "", []string{"TRANSFER_MAX_SIZE=1G"}, "config", "print", cmd, "-proto=udp")
+			if code != 0 {
+				t.Fatalf("config print %s exited %d:\n%s", cmd, code, out)
+			}
+			if cmd == "serve" && !strings.Contains(out, `max-size = "1G" # TRANSFER_MAX_SIZE`) {
+				t.Errorf("max-size not taken from the environment:\n%s", out)
+			}
+			path := filepath.Join(t.TempDir(), "transfer.toml")
+			os.WriteFile(path, []byte(out), 0644)
+
+			back, code := run(t, "", nil, "config", "print", cmd, "-config="+path)
+			if code != 0 {
+				t.Fatalf("printed config unreadable, exit %d:\n%s", code, back)
+			}
+			strip := func(s string) string {
+				var lines []string
+				for _, line := range strings.Split(s, "\n") {
+					if !strings.HasPrefix(line, "#") {
+						lines = append(lines, comment.ReplaceAllString(line, ""))
+					}
+				}
+				return strings.Join(lines, "\n")
+			}
+			if strip(back) != strip(out) {
+				t.Errorf("settings changed in the round trip:\n%s\nread back as\n%s", out, back)
+			}
+		})
+	}
+}
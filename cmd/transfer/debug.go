@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"socket-file-transfer/internal/fsck"
+	"socket-file-transfer/internal/httpfiles"
+	"socket-file-transfer/internal/transfers"
+	"socket-file-transfer/internal/wire"
+)
+
+// How often an idle /events stream gets a comment, so proxies keep it open
+const EVENTS_KEEPALIVE = 15 * time.Second
+
+// The page of /dashboard, which renders /events
+//
+//go:embed dashboard.html
+var dashboard []byte
+
+// debugServer serves the runtime profiles of net/http/pprof under
+// /debug/pprof/, the transfers in registry as JSON at /debug/transfers,
+// their events as Server-Sent Events at /events and a page rendering them
+// at /dashboard, the goroutine count at /debug/goroutines and, with a
+// verifier, the report of its last pass at /debug/verify, on addr until
+// ctx ends. An addr without a host listens on localhost only; one
+// reachable from other hosts is served with a warning, as nothing is
+// authenticated.
+func debugServer(addr string, registry *transfers.Registry, verifier *fsck.Verifier) func(context.Context) error {
+	return func(ctx context.Context) error {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid -debug-addr: %w", err)
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		if !loopback(host) {
+			wire.DefaultLogger.Warn("Debug endpoint reachable from other hosts, it exposes profiles and transfer details to anyone", "addr", addr)
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return fmt.Errorf("error starting debug server: %w", err)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.HandleFunc("/debug/transfers", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, registry.List())
+		})
+		mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+			serveEvents(w, r, registry)
+		})
+		mux.HandleFunc("/dashboard", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(dashboard)
+		})
+		mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]int{"goroutines": runtime.NumGoroutine()})
+		})
+		if verifier != nil {
+			mux.HandleFunc("/debug/verify", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, verifier.Last())
+			})
+		}
+
+		srv := &http.Server{Handler: mux, ReadHeaderTimeout: httpfiles.READ_HEADER_TIMEOUT}
+		stop := context.AfterFunc(ctx, func() { srv.Close() })
+		defer stop()
+
+		wire.DefaultLogger.Info("Debug server listening", "addr", listener.Addr())
+		err = srv.Serve(listener)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+}
+
+// serveEvents streams the events of the transfers in registry, see
+// transfers.Subscribe, until the client goes away: each is named after its
+// kind, with its JSON as data.
+func serveEvents(w http.ResponseWriter, r *http.Request, registry *transfers.Registry) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sub := registry.Subscribe()
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(EVENTS_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev := <-sub.Events():
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Kind, data)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// loopback reports whether host only names loopback addresses.
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/transfers"
+	"socket-file-transfer/tcpft"
+)
+
+// throttled is a client connection that sleeps before each write, so an
+// upload stays under way while the test looks at it.
+type throttled struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c *throttled) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(b)
+}
+
+// debugGet fetches path from the debug server at addr, retrying until it
+// listens, and decodes the JSON it returns into v unless nil.
+func debugGet(t *testing.T, addr, path string, v any) *http.Response {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s", path, resp.Status)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+		} else {
+			io.Copy(io.Discard, resp.Body)
+		}
+		return resp
+	}
+}
+
+// The debug endpoints list a slow upload while it is under way, with the
+// goroutine count and the profiles alongside.
+func TestDebugServer(t *testing.T) {
+	registry := transfers.New()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := &tcpft.Server{UploadDir: t.TempDir()}
+	s.Logger = quiet
+	s.Progress = registry.Progress
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx, ln)
+
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	debugAddr := probe.Addr().String()
+	probe.Close()
+	served := make(chan error, 1)
+	go func() { served <- debugServer(debugAddr, registry, nil)(ctx) }()
+
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), "slow.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := &tcpft.Client{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &throttled{Conn: conn, delay: 10 * time.Millisecond}, nil
+	}}
+	sending, stopSending := context.WithCancel(ctx)
+	sent := make(chan error, 1)
+	go func() {
+		_, err := client.SendFile(sending, ln.Addr().String(), path, tcpft.Options{Logger: quiet, Progress: func(tcpft.Event) {}, BufferSize: 4 << 10})
+		sent <- err
+	}()
+
+	t.Run("transfers", func(t *testing.T) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var list []transfers.Transfer
+			debugGet(t, debugAddr, "/debug/transfers", &list)
+			if len(list) == 1 && list[0].Bytes > 0 {
+				got := list[0]
+				if got.Name != "slow.bin" || got.Total != int64(len(data)) || got.State != transfers.STATE_TRANSFERRING || got.Remote == "" {
+					t.Errorf("listed %+v, want slow.bin transferring %d bytes", got, len(data))
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("listed %+v, want the upload under way", list)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	t.Run("goroutines", func(t *testing.T) {
+		var count struct{ Goroutines int }
+		debugGet(t, debugAddr, "/debug/goroutines", &count)
+		if count.Goroutines < 2 {
+			t.Errorf("%d goroutines, want the server's and the upload's among them", count.Goroutines)
+		}
+	})
+
+	t.Run("pprof", func(t *testing.T) {
+		for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/heap"} {
+			debugGet(t, debugAddr, path, nil)
+		}
+	})
+
+	stopSending()
+	if err := <-sent; err == nil {
+		t.Error("upload finished before the test stopped it")
+	}
+	cancel()
+	if err := <-served; err != context.Canceled {
+		t.Errorf("debug server returned %v, want context.Canceled", err)
+	}
+}
+
+// sseEvent is a message of an /events stream.
+type sseEvent struct {
+	name string
+	transfers.Event
+}
+
+// subscribe opens the /events stream of the debug server at addr, retrying
+// until it listens, and returns its messages until the test ends.
+func subscribe(t *testing.T, addr string) <-chan sseEvent {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	var resp *http.Response
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/events", nil)
+		var err error
+		if resp, err = http.DefaultClient.Do(req); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET /events: %v", err)
+		}
+	}
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("GET /events: %s, %s", resp.Status, ct)
+	}
+
+	events := make(chan sseEvent, 100)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		var ev sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				ev.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.Event)
+			case line == "" && ev.name != "":
+				events <- ev
+				ev = sseEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+// Two subscribers to /events, one from before a slow upload and one
+// joining while it is under way, see its events in order, and /dashboard
+// serves the page that renders them.
+func TestEvents(t *testing.T) {
+	registry := transfers.New()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := &tcpft.Server{UploadDir: t.TempDir()}
+	s.Logger = quiet
+	s.Progress = registry.Progress
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx, ln)
+
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	debugAddr := probe.Addr().String()
+	probe.Close()
+	go debugServer(debugAddr, registry, nil)(ctx)
+
+	early := subscribe(t, debugAddr)
+	// About 2.5 seconds, for progress events a second apart
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	client := &tcpft.Client{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &throttled{Conn: conn, delay: 10 * time.Millisecond}, nil
+	}}
+	sent := make(chan error, 1)
+	go func() {
+		_, err := client.Send(ctx, ln.Addr().String(), "slow.bin", bytes.NewReader(data), int64(len(data)), tcpft.Options{Logger: quiet, Progress: func(tcpft.Event) {}, BufferSize: 4 << 10})
+		sent <- err
+	}()
+
+	// next returns the next event of a stream, failing the test if none
+	// comes
+	next := func(t *testing.T, events <-chan sseEvent) sseEvent {
+		t.Helper()
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatal("stream ended")
+			}
+			return ev
+		case <-time.After(10 * time.Second):
+			t.Fatal("no event for 10 seconds")
+		}
+		return sseEvent{}
+	}
+	started := next(t, early)
+	if started.name != "started" || started.Kind != "started" || started.Name != "slow.bin" || started.Total != int64(len(data)) || started.Remote == "" {
+		t.Fatalf("first event %+v, want slow.bin started", started)
+	}
+	late := subscribe(t, debugAddr)
+
+	if err := <-sent; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	for _, sub := range []struct {
+		name   string
+		events <-chan sseEvent
+		first  string
+	}{
+		{"early", early, "progress"},
+		{"late", late, "started"},
+	} {
+		t.Run(sub.name, func(t *testing.T) {
+			var kinds []string
+			var last sseEvent
+			progress := 0
+			for last.name != "completed" {
+				last = next(t, sub.events)
+				if last.ID != started.ID || last.name != last.Kind {
+					t.Fatalf("event %+v, want one of transfer %d named after its kind", last, started.ID)
+				}
+				if len(kinds) > 0 && last.name == "progress" {
+					progress++
+				}
+				kinds = append(kinds, last.name)
+			}
+			if kinds[0] != sub.first || progress == 0 {
+				t.Errorf("events %v, want %s first, then progress", kinds, sub.first)
+			}
+			if last.Bytes != int64(len(data)) || last.Rate == 0 {
+				t.Errorf("completed event %+v, want all %d bytes with a rate", last.Event, len(data))
+			}
+		})
+	}
+
+	resp := debugGet(t, debugAddr, "/dashboard", nil)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") || !bytes.Contains(dashboard, []byte("/events")) {
+		t.Errorf("/dashboard served as %s, want the page reading /events", ct)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"localhost", true},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"0.0.0.0", false},
+		{"192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		if got := loopback(tt.host); got != tt.want {
+			t.Errorf("loopback(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"socket-file-transfer/internal/discover"
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/prealloc"
+	"socket-file-transfer/internal/wire"
+)
+
+// runDiscover is transfer discover: it lists the servers on the LAN that
+// answer a broadcast probe, and over mDNS with -mdns.
+func runDiscover(args []string) {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	var wait = fs.Duration("wait", discover.DefaultWait, "How long to wait for answers")
+	var mdns = fs.Bool("mdns", false, "Also look for servers advertised over mDNS")
+	parseFlags(fs, args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	found, err := findServers(ctx, *wait, *mdns)
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	if len(found) == 0 {
+		fmt.Println(i18n.T("discover.none"))
+		os.Exit(1)
+	}
+	printServers(found)
+}
+
+// findServers probes the LAN for servers, and asks over mDNS too with
+// mdns, for wait.
+func findServers(ctx context.Context, wait time.Duration, mdns bool) ([]discover.Found, error) {
+	found, err := discover.Probe(ctx, portOf(wire.DISCOVER_PORT), wait)
+	if err != nil || !mdns {
+		return found, err
+	}
+	advertised, err := discover.Query(ctx, wait)
+	if err != nil {
+		return nil, err
+	}
+	return discover.Merge(found, advertised), nil
+}
+
+func printServers(found []discover.Found) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, i18n.T("discover.header"))
+	for i, f := range found {
+		free := "?"
+		if f.Free >= 0 {
+			free = wire.FormatBytes(f.Free)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", i+1, f.Name, f.Host, strings.Join(f.Protocols(), ","), free)
+	}
+	tw.Flush()
+}
+
+// discoverAddr finds the servers on the LAN and returns the address of the
+// first serving proto, or of the one the user picks if several do and
+// stdin is a terminal.
+func discoverAddr(ctx context.Context, proto string) (string, error) {
+	found, err := findServers(ctx, discover.DefaultWait, false)
+	if err != nil {
+		return "", fmt.Errorf("error discovering servers: %w", err)
+	}
+	var candidates []discover.Found
+	for _, f := range found {
+		if f.Port(proto) != 0 {
+			candidates = append(candidates, f)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no server on the LAN serves %s", strings.ToUpper(proto))
+	}
+	if len(candidates) == 1 || !isTerminal(os.Stdin) {
+		f := candidates[0]
+		fmt.Println(i18n.T("discover.using", f.Name, f.Addr(proto)))
+		return f.Addr(proto), nil
+	}
+
+	printServers(candidates)
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print(i18n.T("discover.which", len(candidates)))
+		if !in.Scan() {
+			return "", errors.New("no server chosen")
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(in.Text()))
+		if err == nil && n >= 1 && n <= len(candidates) {
+			return candidates[n-1].Addr(proto), nil
+		}
+	}
+}
+
+// isTerminal tells whether f is a character device other than the null
+// device, as a terminal is.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(fi, null)
+}
+
+// portOf returns the port of a listen address such as ":8080", 0 if it
+// has none.
+func portOf(addr string) int {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// announcer returns what serve tells discover probes: the ports of the
+// protocols addrOf returns a listen address for, and the free space in
+// dir, unknown if files are stored elsewhere.
+func announcer(name string, addrOf func(proto string) string, dir string, remote bool) func() discover.Announcement {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	return func() discover.Announcement {
+		a := discover.Announcement{
+			ID:   id,
+			Name: name,
+			TCP:  portOf(addrOf("tcp")),
+			UDP:  portOf(addrOf("udp")),
+			QUIC: portOf(addrOf("quic")),
+			TFTP: portOf(addrOf("tftp")),
+			Free: -1,
+		}
+		if !remote {
+			if free, err := prealloc.Free(dir); err == nil {
+				a.Free = int64(free)
+			}
+		}
+		return a
+	}
+}
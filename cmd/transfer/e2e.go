@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"socket-file-transfer/internal/e2e"
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/wire"
+)
+
+// encryptFile encrypts the file at path, to be stored as name.enc, to a
+// temporary file and returns the encrypted file's path. The caller
+// removes it.
+func encryptFile(path, name string, secret e2e.Secret) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error opening file: %w", err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", fmt.Errorf("error opening file: %w", err)
+	}
+	dst, err := os.CreateTemp("", ".transfer-e2e-*")
+	if err != nil {
+		return "", fmt.Errorf("error encrypting file: %w", err)
+	}
+	err = func() error {
+		enc, err := e2e.NewWriter(dst, secret, e2e.Metadata{Name: name, Size: info.Size()}, 0)
+		if err != nil {
+			return err
+		}
+		// Copy no more than the size announced, in case the file grew
+		if _, err := io.Copy(enc, io.LimitReader(src, info.Size())); err != nil {
+			return err
+		}
+		return enc.Close()
+	}()
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", fmt.Errorf("error encrypting file: %w", err)
+	}
+	return dst.Name(), nil
+}
+
+// runDecrypt is transfer decrypt: it decrypts a file sent with send -e2e,
+// restoring it under its original name.
+func runDecrypt(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	var in = fs.String("in", "", "Encrypted file to decrypt, as sent with send -e2e")
+	var key = fs.String("key", "", "Secret the file was encrypted with, as given to send -e2e: pass:<passphrase>, env:<variable holding it> or file:<key file>")
+	var out = fs.String("out", "", "Path to write the decrypted file to (default its original name, in the current directory)")
+	var force = fs.Bool("force", false, "Overwrite the output file if it exists")
+	parseFlags(fs, args)
+
+	if *in == "" || *key == "" {
+		fmt.Println(i18n.T("decrypt.requires_in_key"))
+		fmt.Println(i18n.T("decrypt.usage"))
+		os.Exit(1)
+	}
+	secret, err := e2e.ParseSecret(*key)
+	if err != nil {
+		fmt.Println(i18n.T("decrypt.invalid_key", err))
+		os.Exit(1)
+	}
+
+	src, err := os.Open(*in)
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	defer src.Close()
+	dec, err := e2e.NewReader(src, secret)
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(decryptExitCode(err))
+	}
+
+	dest := *out
+	if dest == "" {
+		// The name comes from whoever encrypted the file, so it mustn't
+		// reach outside the current directory
+		if err := wire.CheckName(dec.Name); err != nil {
+			fmt.Println(i18n.T("decrypt.bad_name", dec.Name, err))
+			os.Exit(1)
+		}
+		dest = filepath.Base(dec.Name)
+	}
+	if _, err := os.Lstat(dest); err == nil && !*force {
+		fmt.Println(i18n.T("exists_pass_force", dest))
+		os.Exit(1)
+	}
+
+	// Nothing is written under dest until the whole file authenticated
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".transfer-decrypt-*")
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	_, err = io.Copy(tmp, dec)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Println(i18n.T("error", err))
+		os.Exit(decryptExitCode(err))
+	}
+	fmt.Println(i18n.T("decrypt.decrypted", *in, dest, wire.FormatBytes(dec.Size)))
+}
+
+// decryptExitCode is the exit status of a failed decryption: a file that
+// doesn't authenticate is reported like a checksum mismatch.
+func decryptExitCode(err error) int {
+	if errors.Is(err, e2e.ErrAuth) {
+		return EXIT_CHECKSUM_MISMATCH
+	}
+	return EXIT_FAILURE
+}
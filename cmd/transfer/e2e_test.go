@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"socket-file-transfer/tcpft"
+)
+
+// A file sent with -e2e reaches the server only encrypted, and decrypt
+// restores it with the same secret alone.
+func TestSendE2E(t *testing.T) {
+	s := &tcpft.Server{}
+	addr := serveTCP(t, s)
+	dir := t.TempDir()
+	plain := []byte(strings.Repeat("for your eyes only\n", 5000))
+	path := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(path, plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"TRANSFER_TEST_E2E=hunter2"}
+
+	out, code := run(t, "", env, "send", "-e2e=env:TRANSFER_TEST_E2E", "-file="+path, "-addr="+addr)
+	if code != 0 {
+		t.Fatalf("send exit code %d:\n%s", code, out)
+	}
+	stored := filepath.Join(s.UploadDir, "secret.txt.enc")
+	sealed, err := os.ReadFile(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("for your eyes only")) || bytes.Contains(sealed, []byte("secret.txt")) {
+		t.Error("server stored the content or name in the clear")
+	}
+
+	restored := filepath.Join(dir, "restored.txt")
+	out, code = run(t, "", nil, "decrypt", "-in="+stored, "-key=pass:hunter2", "-out="+restored)
+	if code != 0 {
+		t.Fatalf("decrypt exit code %d:\n%s", code, out)
+	}
+	if got, _ := os.ReadFile(restored); !bytes.Equal(got, plain) {
+		t.Errorf("decrypted %d bytes, want the %d sent", len(got), len(plain))
+	}
+
+	wrong := filepath.Join(dir, "wrong.txt")
+	out, code = run(t, "", nil, "decrypt", "-in="+stored, "-key=pass:hunter3", "-out="+wrong)
+	if code != EXIT_CHECKSUM_MISMATCH {
+		t.Errorf("wrong key: exit code %d, want %d:\n%s", code, EXIT_CHECKSUM_MISMATCH, out)
+	}
+	if _, err := os.Lstat(wrong); err == nil {
+		t.Error("wrong key left output behind")
+	}
+}
+
+// A secret without its kind is refused, not taken for a passphrase.
+func TestSendE2EUnprefixed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f.txt")
+	os.WriteFile(path, []byte("f"), 0644)
+	out, code := run(t, "", nil, "send", "-e2e="+path, "-file="+path, "-addr=127.0.0.1:1")
+	if code != 1 || !strings.Contains(out, "pass:") {
+		t.Errorf("exit code %d, want 1 naming the prefixes:\n%s", code, out)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"socket-file-transfer/internal/fsck"
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/wire"
+)
+
+// runFsck is transfer fsck: it rehashes the files a server stored and
+// compares them with the digests recorded when they were received, to
+// find those that rotted on disk since.
+func runFsck(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	var dir = fs.String("dir", "uploads", "Upload directory to check")
+	var rateFlag = fs.String("rate", "0", "Bytes per second to read at most, with an optional K, M or G suffix (0 means no limit)")
+	var seed = fs.Bool("seed", false, "Hash the files without a recorded checksum, recording it so later checks can verify them")
+	var quarantine = fs.Bool("quarantine", false, "Move corrupt files to the .quarantine directory of -dir")
+	var verbose = fs.Bool("v", false, "List every file checked, not just those that fail")
+	parseFlags(fs, args)
+
+	rate, err := parseLimit(*rateFlag)
+	if err != nil {
+		fmt.Println(i18n.T("invalid_rate", err))
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c := fsck.Config{Root: *dir, Rate: rate, Seed: *seed, Quarantine: *quarantine}
+	rep, err := fsck.Check(ctx, c, func(f *fsck.File) {
+		name, _ := filepath.Rel(*dir, f.Path)
+		switch {
+		case f.Status == fsck.StatusCorrupt && f.Quarantined != "":
+			fmt.Println(i18n.T("fsck.corrupt_moved_to", name, f.Err, f.Quarantined))
+		case f.Status == fsck.StatusCorrupt:
+			fmt.Println(i18n.T("fsck.corrupt", name, f.Err))
+		case f.Status == fsck.StatusError:
+			fmt.Println(i18n.T("fsck.error", name, f.Err))
+		case f.Status == fsck.StatusUnverifiable:
+			fmt.Println(i18n.T("fsck.unverifiable", name, f.Err))
+		case *verbose:
+			fmt.Printf("%s: %s (%s)\n", name, f.Status, f.Hash)
+		}
+	})
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(exitCode(err))
+	}
+
+	fmt.Print(i18n.T("fsck.summary", rep.Files, wire.FormatBytes(rep.Bytes), rep.Duration.Round(time.Millisecond), rep.OK, rep.Corrupt, rep.Unverifiable, rep.Seeded, rep.Errors))
+	if rep.Skipped > 0 {
+		fmt.Print(i18n.T("fsck.skipped", rep.Skipped))
+	}
+	fmt.Println()
+	switch {
+	case rep.Corrupt > 0:
+		os.Exit(EXIT_CHECKSUM_MISMATCH)
+	case rep.Errors > 0:
+		os.Exit(EXIT_FAILURE)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"socket-file-transfer/internal/i18n"
+)
+
+// Subcommands that print their flags with -h, with the arguments that
+// come before the flags
+var subcommands = [][]string{
+	{"serve"}, {"send"}, {"sync"}, {"verify"}, {"fsck"}, {"decrypt"}, {"receive"}, {"shell"},
+	{"bench"}, {"discover"}, {"punch"}, {"selftest"}, {"admin", "status"}, {"trace-replay"},
+}
+
+// helpFlags returns the description -h prints for each flag of a
+// subcommand, by name.
+func helpFlags(help string) map[string]string {
+	flags := make(map[string]string)
+	var name string
+	for _, line := range strings.Split(help, "\n") {
+		switch {
+		case strings.HasPrefix(line, "  -"):
+			// A one-letter boolean has its description on the same line
+			var usage string
+			name, usage, _ = strings.Cut(strings.TrimPrefix(line, "  -"), "\t")
+			name, _, _ = strings.Cut(name, " ")
+			flags[name] = usage
+		case strings.HasPrefix(line, "    \t") && name != "":
+			flags[name] += line + "\n"
+		}
+	}
+	return flags
+}
+
+// Every flag description of every subcommand is translated, and every
+// translation is of a description some subcommand still has.
+func TestFlagsTranslated(t *testing.T) {
+	var english strings.Builder
+	for _, args := range subcommands {
+		cmd := args[:len(args):len(args)]
+		en, code := run(t, "", nil, append(cmd, "-lang=en", "-h")...)
+		if code != 0 {
+			t.Fatalf("%q -h exit code %d:\n%s", cmd, code, en)
+		}
+		english.WriteString(en)
+		for _, lang := range i18n.Languages() {
+			if lang == i18n.DEFAULT {
+				continue
+			}
+			translated, _ := run(t, "", nil, append(cmd, "-lang="+lang, "-h")...)
+			enFlags, flags := helpFlags(en), helpFlags(translated)
+			if len(enFlags) == 0 || len(flags) != len(enFlags) {
+				t.Fatalf("%q -h lists %d flags in %s, %d in English", cmd, len(flags), lang, len(enFlags))
+			}
+			for name, usage := range enFlags {
+				if flags[name] == usage {
+					t.Errorf("%q -%s has no %s translation:\n%s", cmd, name, lang, usage)
+				}
+			}
+		}
+	}
+
+	for lang, c := range i18n.Catalogs() {
+		for usage := range c.Flags {
+			if !strings.Contains(english.String(), "\t"+strings.ReplaceAll(usage, "\n", "\n    \t")) {
+				t.Errorf("%s.json translates the flag description %q, which no subcommand has", lang, usage)
+			}
+		}
+	}
+}
@@ -0,0 +1,1456 @@
+// Command transfer sends files to, and receives files on, a TCP or UDP
+// server.
+//
+//	transfer serve -proto=tcp|udp|both
+//	transfer send -proto=tcp|udp -file=path/to/file
+//	transfer send -proto=tcp|udp -watch=path/to/dir
+//	transfer sync -proto=tcp|udp -dir=path/to/dir
+//	transfer fsck -dir=uploads
+//	transfer shell -addr=host:8080
+//	transfer bench -proto=tcp|udp|both -size=1G
+//	transfer discover
+//	transfer admin status|kill|config|sweep -socket=path
+//	transfer trace-replay path/to/trace
+//	transfer config print serve|send|... [flags]
+//
+// Every subcommand also takes its flags from TRANSFER_* environment
+// variables and a -config file, see internal/config, and prints in the
+// language -lang or LANG picks, see internal/i18n.
+//
+// send exits with a status that tells failures apart, see exitCode.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"socket-file-transfer/internal/archive"
+	"socket-file-transfer/internal/checksum"
+	"socket-file-transfer/internal/codes"
+	"socket-file-transfer/internal/config"
+	"socket-file-transfer/internal/discover"
+	"socket-file-transfer/internal/e2e"
+	"socket-file-transfer/internal/fsck"
+	"socket-file-transfer/internal/httpfiles"
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/layout"
+	"socket-file-transfer/internal/pathfilter"
+	"socket-file-transfer/internal/ports"
+	"socket-file-transfer/internal/punch"
+	"socket-file-transfer/internal/retention"
+	"socket-file-transfer/internal/scan"
+	"socket-file-transfer/internal/schedule"
+	"socket-file-transfer/internal/sdnotify"
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/tenant"
+	"socket-file-transfer/internal/tlscert"
+	"socket-file-transfer/internal/tokens"
+	"socket-file-transfer/internal/trace"
+	"socket-file-transfer/internal/transfers"
+	"socket-file-transfer/internal/watch"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/quicft"
+	"socket-file-transfer/tcpft"
+	"socket-file-transfer/udpft"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	args := os.Args[1:]
+	if args[0] == "config" {
+		if len(args) < 3 || args[1] != "print" {
+			usage()
+			os.Exit(1)
+		}
+		printConfig = true
+		args = args[2:]
+	}
+
+	switch args[0] {
+	case "serve":
+		runServe(args[1:])
+	case "send":
+		runSend(args[1:])
+	case "sync":
+		runSync(args[1:])
+	case "verify":
+		runVerify(args[1:])
+	case "fsck":
+		runFsck(args[1:])
+	case "decrypt":
+		runDecrypt(args[1:])
+	case "receive":
+		runReceive(args[1:])
+	case "shell":
+		runShell(args[1:])
+	case "bench":
+		runBench(args[1:])
+	case "discover":
+		runDiscover(args[1:])
+	case "punch":
+		runPunch(args[1:])
+	case "selftest":
+		runSelftest(args[1:])
+	case "admin":
+		runAdmin(args[1:])
+	case "trace-replay":
+		runTraceReplay(args[1:])
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Println(i18n.T("usage"))
+}
+
+// Set by 'transfer config print', which runs a subcommand only as far as
+// its flags
+var printConfig bool
+
+// parseFlags parses a subcommand's args into fs, taking the flags they
+// don't set from the environment and -config, see internal/config. It adds
+// -lang, and prints -h in that language. Under 'transfer config print' it
+// prints the resulting settings and exits.
+func parseFlags(fs *flag.FlagSet, args []string) *config.Config {
+	fs.Var(new(langFlag), "lang", "Language of messages: en or pt (default from LC_ALL, LC_MESSAGES or LANG)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), i18n.T("usage.flags", fs.Name()))
+		fs.VisitAll(func(f *flag.Flag) {
+			f.Usage = i18n.Flag(f.Usage)
+		})
+		fs.PrintDefaults()
+	}
+	c, err := config.Parse(fs, args)
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(2)
+	}
+	if printConfig {
+		if err := c.Print(os.Stdout); err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	return c
+}
+
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var proto = fs.String("proto", "tcp", "Protocol: 'tcp', 'udp', 'quic', 'both' (TCP and UDP) or 'all'")
+	var tcpAddrs listFlag
+	fs.Var(&tcpAddrs, "tcp-addr", "TCP listen address; repeat to listen on several at once, e.g. -tcp-addr=127.0.0.1:8080 -tcp-addr=[::1]:8080 (default :8080)")
+	var bestEffort = fs.Bool("listen-best-effort", false, "Serve the -tcp-addr addresses that can be bound instead of failing if one can't")
+	var unixSocket = fs.String("unix", "", "Serve TCP clients on this unix socket path instead of -tcp-addr")
+	var unixMode = fs.String("unix-mode", "0660", "Permissions of the -unix socket, in octal")
+	var udpAddr = fs.String("udp-addr", wire.UDP_PORT, "UDP listen address")
+	var quicAddr = fs.String("quic-addr", wire.QUIC_PORT, "QUIC listen address (UDP)")
+	var port = fs.String("port", "", "Listen on this port instead of those of -tcp-addr, -udp-addr and -quic-addr; 0 picks a free one for each")
+	var portRetry = fs.Int("port-retry", 0, "If a TCP, UDP or QUIC listen port is in use, try this many ports above it before giving up")
+	var tftp = fs.Bool("tftp", false, "Also accept TFTP uploads (octet mode) on -tftp-addr, for devices that speak nothing else")
+	var tftpAddr = fs.String("tftp-addr", wire.TFTP_PORT, "TFTP listen address (UDP)")
+	var multicastGroup = fs.String("multicast", "", "Also receive the files multicast to this group, e.g. 239.255.0.1:9000")
+	var multicastIf = fs.String("multicast-if", "", "Network interface to join -multicast on (default the system's choice)")
+	var relay = fs.Bool("relay", false, "Also pair 'transfer punch' peers on -relay-addr and relay their packets when they can't reach each other")
+	var relayAddr = fs.String("relay-addr", wire.RELAY_PORT, "Relay listen address (UDP)")
+	var announce = fs.Bool("announce", false, "Answer 'transfer discover' probes broadcast on the LAN")
+	var announceName = fs.String("announce-name", "", "Name to announce (default the host name)")
+	var mdns = fs.Bool("mdns", false, "Also advertise the server over mDNS as "+discover.MDNS_SERVICE)
+	var tlsCert = fs.String("tls-cert", "", "PEM certificate for QUIC, with -tls-key (default a self-signed one)")
+	var tlsKey = fs.String("tls-key", "", "PEM private key of -tls-cert")
+	var tlsClientCA = fs.String("tls-client-ca", "", "PEM certificates to verify the certificates QUIC clients present against, so -tenants can name tenants by cn")
+	var maxSizeFlag = fs.String("max-size", "0", "Refuse files larger than this, with an optional K, M or G suffix (0 means no limit)")
+	var layoutFlag = fs.String("layout", "", "Where to store files under uploads, e.g. {year}/{month}/{day}/{name}; tokens {date} {year} {month} {day} {time} {client} {name} {hash8}")
+	var perClientDirs = fs.Bool("per-client-dirs", false, "Store each client's files in a subdirectory named after its IP address")
+	var retainDays = fs.Int("retain-days", 0, "Delete stored files older than this many days (0 keeps them)")
+	var retainMaxFlag = fs.String("retain-max-bytes", "0", "Delete the oldest stored files while they total more than this, with an optional K, M or G suffix (0 means no budget)")
+	var retainDryRun = fs.Bool("retain-dry-run", false, "Only log which files -retain-days and -retain-max-bytes would delete")
+	var acceptExt = fs.String("accept-ext", "", "Comma-separated extensions of the only files to accept, e.g. .tar.gz,.zip")
+	var rejectExt = fs.String("reject-ext", "", "Comma-separated extensions of files to refuse")
+	var sniff = fs.String("sniff", "", "Comma-separated content types to accept, checked against the first 512 bytes of each file, e.g. application/zip,application/x-gzip")
+	var httpAddr = fs.String("http-addr", "", "Also serve the stored files read-only over HTTP on this address, e.g. :8000")
+	var httpUser = fs.String("http-user", "", "Require this user name from HTTP clients")
+	var httpPass = fs.String("http-pass", "", "Require this password from HTTP clients, with -http-user")
+	var httpWS = fs.Bool("ws", false, "Also accept TCP clients tunnelled over WebSocket at /ws on -http-addr")
+	var httpUpload = fs.Bool("http-upload", false, "Also accept uploads on -http-addr, by PUT /files/<name> or multipart POST /files")
+	var issueTokens = fs.Bool("issue-tokens", false, "Give TCP, QUIC and HTTP clients a retrieval token for each file stored, which fetches it from -http-addr at /t/<token> without -http-user")
+	var tokenTTL = fs.Duration("token-ttl", tokens.DefaultTTL, "How long an -issue-tokens token lasts")
+	var tokenUses = fs.Int("token-uses", 1, "How many times an -issue-tokens token fetches its file")
+	var codesFlag = fs.Bool("codes", false, "Stage the files 'send -code' sends under short codes, which 'transfer receive' fetches (TCP and QUIC only)")
+	var codeTTL = fs.Duration("code-ttl", codes.DefaultTTL, "How long a -codes code lasts before its file is removed")
+	var codeUses = fs.Int("code-uses", 1, "How many times a -codes code fetches its file before it is removed")
+	var autoExtract = fs.Bool("auto-extract", false, "Unpack uploaded .tar, .tar.gz and .tgz archives into a directory of their name next to them, as 'send -archive' sends")
+	var extractSize = fs.String("max-extract-size", "0", "Refuse an -auto-extract archive whose files total more than this once unpacked, with an optional K, M or G suffix (0 means -max-size, which also bounds each file, or 1G without one)")
+	var extractCount = fs.Int("max-extract-entries", archive.DefaultMaxEntries, "Refuse an -auto-extract archive with more entries than this")
+	var scanCmd = fs.String("scan-cmd", "", "Shell command to check each received file with before storing it, given TRANSFER_PATH (the temporary file) and the other TRANSFER_* variables; a non-zero exit quarantines the file with the command's output")
+	var scanTimeout = fs.Duration("scan-timeout", scan.DefaultTimeout, "Longest -scan-cmd may take on one file")
+	var scanOnTimeout = fs.String("scan-timeout-action", "quarantine", "What to do with a file whose scan timed out: quarantine or promote")
+	var dedupe = fs.Bool("dedupe", false, "Store uploads whose content is already stored as hard links to it, keeping one copy (local storage only)")
+	var storageFlag = fs.String("storage", "", "Store files in s3://bucket/prefix instead of uploads, with credentials from the AWS_* environment variables")
+	var stagingDir = fs.String("staging-dir", "", "Receive uploads into this directory, e.g. on a faster disk, moving them into uploads once complete (local storage only)")
+	var completionMarker = fs.Bool("completion-marker", false, "Write .<name>.done, a hidden JSON record of its hash, size and time, next to each file as the last step of storing it, after hooks (local storage only)")
+	var completedDir = fs.String("completed-dir", "", "Move each file into this directory, outside uploads, as the last step of storing it, after hooks (local storage only)")
+	var allowDelete = fs.Bool("allow-delete", false, "Let shell clients delete stored files (TCP only)")
+	var tenantsFile = fs.String("tenants", "", "TOML, YAML or JSON file of the tenants to split the server among, a table each with its token or cn, dir, max-size, quota and rate; other clients are refused (TCP, QUIC and HTTP)")
+	var legacy = fs.Bool("legacy", false, "Accept clients that predate protocol version negotiation")
+	simFlags := addSimFlags(fs)
+	traceFlags := addTraceFlags(fs)
+	var bufferFlag = fs.String("buffer", "256K", "TCP read and write buffer size, with an optional K, M or G suffix")
+	var reserveFlag = fs.String("reserve-space", "0", "Refuse files that would leave less free disk space than this, with an optional K, M or G suffix")
+	var noPrealloc = fs.Bool("no-preallocate", false, "Don't reserve disk space for incoming files before receiving them")
+	var hookCmd = fs.String("hook-cmd", "", "Shell command to run after each file is stored, given TRANSFER_PATH, TRANSFER_NAME, TRANSFER_CLIENT, TRANSFER_SIZE and TRANSFER_SHA256")
+	var hookURL = fs.String("hook-url", "", "URL to POST a JSON description of each stored file to")
+	var hookStrict = fs.Bool("hook-strict", false, "Fail transfers whose hook fails and move their file to uploads/.quarantine")
+	var batchIO = fs.Bool("batch-io", false, "Read and acknowledge UDP packets in batches (Linux)")
+	var ackEvery = fs.Int("ack-every", udpft.DefaultAckEvery, "Acknowledge this many in-order UDP packets at once (1 acknowledges each)")
+	var ackDelay = fs.Duration("ack-delay", udpft.DefaultAckDelay, "Longest to hold back a UDP ACK waiting for -ack-every packets")
+	var stallTimeout = fs.Duration("stall-timeout", DefaultStallTimeout, "Abort a TCP or QUIC upload when no data arrives for this long (0 never does); UDP sessions give up after their own packet timeouts")
+	var maxPause = fs.Duration("max-pause", wire.DefaultMaxPause, "Abort an upload whose client paused it for longer than this")
+	var statusInterval = fs.Duration("status-interval", DefaultStatusInterval, "Log the bytes, progress and rate of each upload this often, instead of drawing a progress line (0 draws the line)")
+	var verifyInterval = fs.Duration("verify-interval", 0, "Check the stored files against their recorded checksums this often in the background, as 'transfer fsck' does (0 never does; local storage only)")
+	var verifyRateFlag = fs.String("verify-rate", "50M", "Bytes per second -verify-interval reads at most, with an optional K, M or G suffix (0 means no limit)")
+	var verifyQuarantine = fs.Bool("verify-quarantine", false, "Move stored files that fail -verify-interval to uploads/.quarantine")
+	var verifySeed = fs.Bool("verify-seed", false, "Have -verify-interval hash stored files without a recorded checksum, so later passes can check them")
+	var adminSocket = fs.String("admin-socket", "", "Serve the admin interface 'transfer admin' talks to on this unix socket path, or on a loopback host:port with -admin-token (off if empty)")
+	var adminToken = fs.String("admin-token", "", "Token requests to -admin-socket must carry; required when it is a host:port")
+	var debugAddr = fs.String("debug-addr", "", "Serve pprof profiles, /debug/transfers, /debug/goroutines and the transfer events at /events and /dashboard on this address, e.g. :6060 (localhost unless a host is given)")
+	service := addServiceFlags(fs)
+	settings := parseFlags(fs, args)
+
+	if *service.action != "" {
+		done, err := service.control(args, settings.Path())
+		if err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(1)
+		}
+		fmt.Println(done)
+		return
+	}
+	// Started by the Windows service manager, serve logs to -service-log
+	// and shuts down gracefully when the service is stopped
+	serviceCtx, serviceStopped, err := service.startAsService(context.Background())
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	defer serviceStopped()
+
+	bufferSize := mustParseBuffer(*bufferFlag)
+	if err := layout.Check(*layoutFlag); err != nil {
+		fmt.Println(i18n.T("serve.invalid_layout", err))
+		os.Exit(1)
+	}
+	simConfig, err := simFlags.config()
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	if *traceFlags.path != "" && *proto != "udp" && *proto != "both" && *proto != "all" {
+		fmt.Println(i18n.T("serve.trace_udp"))
+		os.Exit(1)
+	}
+	// The policy flags, which a SIGHUP reloads from -config
+	servePolicy := func() (store.Policy, error) {
+		maxSize, err := parseLimit(*maxSizeFlag)
+		if err != nil {
+			return store.Policy{}, fmt.Errorf("invalid -max-size: %w", err)
+		}
+		retainMax, err := parseLimit(*retainMaxFlag)
+		if err != nil {
+			return store.Policy{}, fmt.Errorf("invalid -retain-max-bytes: %w", err)
+		}
+		reserve, err := parseLimit(*reserveFlag)
+		if err != nil {
+			return store.Policy{}, fmt.Errorf("invalid -reserve-space: %w", err)
+		}
+		return store.Policy{
+			MaxFileSize:  maxSize,
+			ReserveSpace: reserve,
+			AcceptExt:    splitList(*acceptExt),
+			RejectExt:    splitList(*rejectExt),
+			SniffTypes:   splitList(*sniff),
+			Retention:    retention.Policy{MaxAge: time.Duration(*retainDays) * 24 * time.Hour, MaxBytes: retainMax, DryRun: *retainDryRun},
+		}, nil
+	}
+	initial, err := servePolicy()
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	policy := store.NewLive(initial)
+	if *scanOnTimeout != "quarantine" && *scanOnTimeout != "promote" {
+		fmt.Println(i18n.T("serve.invalid_scan_timeout_action", *scanOnTimeout))
+		os.Exit(1)
+	}
+	scanPromote := *scanOnTimeout == "promote"
+	maxExtract, err := parseLimit(*extractSize)
+	if err != nil {
+		fmt.Println(i18n.T("serve.invalid_max_extract_size", err))
+		os.Exit(1)
+	}
+	if *httpPass != "" && *httpUser == "" {
+		fmt.Println(i18n.T("serve.http_pass_requires_user"))
+		os.Exit(1)
+	}
+	socketMode, err := strconv.ParseUint(*unixMode, 8, 32)
+	if err != nil || socketMode > 0777 {
+		fmt.Println(i18n.T("serve.invalid_unix_mode", *unixMode))
+		os.Exit(1)
+	}
+	if *httpWS && *httpAddr == "" {
+		fmt.Println(i18n.T("serve.ws_requires_http_addr"))
+		os.Exit(1)
+	}
+	if *issueTokens {
+		switch {
+		case *httpAddr == "":
+			fmt.Println(i18n.T("serve.issue_tokens_requires_http_addr"))
+			os.Exit(1)
+		case *storageFlag != "":
+			fmt.Println(i18n.T("serve.issue_tokens_local_only"))
+			os.Exit(1)
+		case *tokenTTL <= 0 || *tokenUses <= 0:
+			fmt.Println(i18n.T("serve.token_limits"))
+			os.Exit(1)
+		}
+	}
+	if *codesFlag && (*codeTTL <= 0 || *codeUses <= 0) {
+		fmt.Println(i18n.T("serve.code_limits"))
+		os.Exit(1)
+	}
+	if *unixSocket != "" && (*proto == "udp" || *proto == "quic") {
+		fmt.Println(i18n.T("serve.unix_tcp_only"))
+		os.Exit(1)
+	}
+	if len(tcpAddrs) == 0 {
+		tcpAddrs = listFlag{wire.TCP_PORT}
+	}
+	if *port != "" {
+		if n, err := strconv.Atoi(*port); err != nil || n < 0 || n > math.MaxUint16 {
+			fmt.Println(i18n.T("serve.invalid_port", *port))
+			os.Exit(1)
+		}
+		for i := range tcpAddrs {
+			tcpAddrs[i] = mustWithPort("-tcp-addr", tcpAddrs[i], *port)
+		}
+		*udpAddr = mustWithPort("-udp-addr", *udpAddr, *port)
+		*quicAddr = mustWithPort("-quic-addr", *quicAddr, *port)
+	}
+	if *portRetry < 0 {
+		fmt.Println(i18n.T("serve.invalid_port_retry"))
+		os.Exit(1)
+	}
+	if *completedDir != "" && (*issueTokens || *codesFlag || *dedupe) {
+		fmt.Println(i18n.T("serve.completed_conflict"))
+		os.Exit(1)
+	}
+	var tenants *tenant.Set
+	if *tenantsFile != "" {
+		switch {
+		case *proto == "udp" || *proto == "both" || *proto == "all" || *tftp || *multicastGroup != "":
+			fmt.Println(i18n.T("serve.tenants_udp"))
+			os.Exit(1)
+		case *storageFlag != "" || *codesFlag || *issueTokens || *httpUser != "":
+			fmt.Println(i18n.T("serve.tenants_conflict"))
+			os.Exit(1)
+		}
+		if tenants, err = loadTenants(*tenantsFile); err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(1)
+		}
+	}
+	var verifier *fsck.Verifier
+	if *verifyInterval > 0 {
+		if *storageFlag != "" {
+			fmt.Println(i18n.T("serve.verify_interval_local_only"))
+			os.Exit(1)
+		}
+		rate, err := parseLimit(*verifyRateFlag)
+		if err != nil {
+			fmt.Println(i18n.T("serve.invalid_verify_rate", err))
+			os.Exit(1)
+		}
+		verifier = &fsck.Verifier{Interval: *verifyInterval, Log: wire.DefaultLogger}
+		verifier.Config = fsck.Config{Root: "uploads", Rate: rate, Seed: *verifySeed, Quarantine: *verifyQuarantine}
+	}
+
+	// Only once every flag checks out, so a refused command line leaves
+	// nothing behind
+	var tokenStore *tokens.Store
+	if *issueTokens {
+		if tokenStore, err = tokens.Open("uploads", *tokenTTL, *tokenUses, wire.DefaultLogger); err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(1)
+		}
+	}
+	var codeStore *codes.Store
+	if *codesFlag {
+		if codeStore, err = codes.Open("uploads", *codeTTL, *codeUses, wire.DefaultLogger); err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(1)
+		}
+	}
+	tracer, err := traceFlags.create(trace.SERVER)
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	if tracer != nil {
+		defer tracer.Close()
+	}
+
+	// Shut down gracefully on Ctrl-C or SIGTERM, aborting in-flight transfers
+	ctx, stop := signal.NotifyContext(serviceCtx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Loaded up front, so a SIGHUP can reload the certificate too
+	var tlsConfig *tls.Config
+	var certs *tlscert.Loader
+	if *proto == "quic" || *proto == "all" {
+		if tlsConfig, certs, err = serverTLS(*tlsCert, *tlsKey); err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(1)
+		}
+	}
+	if *tlsClientCA != "" {
+		if tlsConfig == nil {
+			fmt.Println(i18n.T("serve.tls_client_ca_quic"))
+			os.Exit(1)
+		}
+		if err := requireClientCerts(tlsConfig, *tlsClientCA); err != nil {
+			fmt.Println(i18n.T("serve.invalid_tls_client_ca", err))
+			os.Exit(1)
+		}
+	}
+	go reloadOnHangup(ctx, settings, policy, servePolicy, certs)
+
+	tcpServer := &tcpft.Server{Addrs: tcpAddrs, BestEffort: *bestEffort, PerClientDirs: *perClientDirs, Layout: *layoutFlag, AllowDelete: *allowDelete}
+	tcpServer.UnixSocket, tcpServer.SocketMode = *unixSocket, os.FileMode(socketMode)
+	tcpServer.Legacy = *legacy
+	tcpServer.BufferSize = bufferSize
+	tcpServer.NoPreallocate = *noPrealloc
+	tcpServer.LivePolicy = policy
+	tcpServer.Storage = *storageFlag
+	tcpServer.HookCommand, tcpServer.HookURL, tcpServer.HookStrict = *hookCmd, *hookURL, *hookStrict
+	tcpServer.StallTimeout, tcpServer.MaxPause = *stallTimeout, *maxPause
+	tcpServer.AutoExtract = *autoExtract
+	tcpServer.ExtractSize, tcpServer.ExtractCount = maxExtract, *extractCount
+	tcpServer.Dedupe = *dedupe
+	tcpServer.StagingDir = *stagingDir
+	tcpServer.Marker, tcpServer.CompletedDir = *completionMarker, *completedDir
+	tcpServer.ScanCommand, tcpServer.ScanTimeout, tcpServer.ScanPromote = *scanCmd, *scanTimeout, scanPromote
+	tcpServer.Tokens = tokenStore
+	tcpServer.Codes = codeStore
+	tcpServer.Tenants = tenants
+	udpServer := &udpft.Server{Addr: *udpAddr, TFTPAddr: *tftpAddr, PerClientDirs: *perClientDirs, Layout: *layoutFlag}
+	udpServer.Legacy = *legacy
+	udpServer.NoPreallocate = *noPrealloc
+	udpServer.LivePolicy = policy
+	udpServer.Storage = *storageFlag
+	udpServer.HookCommand, udpServer.HookURL, udpServer.HookStrict = *hookCmd, *hookURL, *hookStrict
+	udpServer.BatchIO = *batchIO
+	udpServer.AutoExtract = *autoExtract
+	udpServer.ExtractSize, udpServer.ExtractCount = maxExtract, *extractCount
+	udpServer.Dedupe = *dedupe
+	udpServer.StagingDir = *stagingDir
+	udpServer.Marker, udpServer.CompletedDir = *completionMarker, *completedDir
+	udpServer.ScanCommand, udpServer.ScanTimeout, udpServer.ScanPromote = *scanCmd, *scanTimeout, scanPromote
+	udpServer.AckEvery, udpServer.AckDelay = *ackEvery, *ackDelay
+	udpServer.MaxPause = *maxPause
+
+	// Under systemd socket activation the servers take over the sockets it
+	// passed instead of listening themselves
+	listeners, conns, err := sdnotify.Sockets()
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	if len(conns) > 1 {
+		fmt.Println(i18n.T("serve.systemd_datagram_sockets", len(conns)))
+		os.Exit(1)
+	}
+	tcpServer.Listeners = listeners
+	tcpServer.PortRetry, udpServer.PortRetry = *portRetry, *portRetry
+	if len(conns) == 1 {
+		udpServer.Conn = conns[0]
+	}
+
+	var wg sync.WaitGroup
+	run := func(serve func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serve(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				fmt.Println(i18n.T("error", err))
+			}
+		}()
+	}
+
+	// Status lines replace the progress line of every server, including
+	// the copies made below; they, the debug server and the admin socket
+	// report on the transfers in registry
+	if *statusInterval > 0 || *debugAddr != "" || *adminSocket != "" {
+		registry := transfers.New()
+		tcpServer.Progress, udpServer.Progress = registry.Progress, registry.Progress
+		if *statusInterval > 0 {
+			status := newTransferStatus(registry)
+			run(func(ctx context.Context) error { return status.run(ctx, *statusInterval) })
+		} else {
+			progress := func(ev wire.Event) {
+				registry.Progress(ev)
+				wire.ConsoleProgress(ev)
+			}
+			tcpServer.Progress, udpServer.Progress = progress, progress
+		}
+		if *debugAddr != "" {
+			run(debugServer(*debugAddr, registry, verifier))
+		}
+		if *adminSocket != "" {
+			run(adminServer(*adminSocket, *adminToken, registry, settings, policy))
+		}
+	}
+	if verifier != nil {
+		run(verifier.Run)
+	}
+	if tokenStore != nil {
+		run(tokenStore.Run)
+	}
+	if codeStore != nil {
+		run(codeStore.Run)
+	}
+
+	// The -sim flags impair what the TCP and UDP servers send, not their
+	// QUIC and WebSocket copies, and -trace records the UDP server's
+	// packets, as sent before the -sim flags impair them
+	var wrapUDP []func(net.PacketConn) net.PacketConn
+	if simConfig.Enabled() {
+		simulate := &simulator{cfg: simConfig}
+		wire.DefaultLogger.Warn("Simulating a bad network on what TCP and UDP send", "loss", simConfig.Loss, "dup", simConfig.Duplicate, "reorder", simConfig.Reorder, "delay", simConfig.Latency, "seed", simConfig.Seed)
+		tcpServer.WrapConn = simulate.stream
+		wrapUDP = append(wrapUDP, simulate.packetConn)
+	}
+	if tracer != nil {
+		wire.DefaultLogger.Warn("Recording the UDP server's packets", "trace", *traceFlags.path)
+		wrapUDP = append(wrapUDP, tracer.packetConn)
+	}
+	serveUDP := udpServer.ListenAndServe
+	if len(wrapUDP) > 0 {
+		serveUDP = func(ctx context.Context) error {
+			conn := udpServer.Conn
+			if conn == nil {
+				var err error
+				conn, err = ports.Listen(*udpAddr, *portRetry, func(addr string) (net.PacketConn, error) {
+					return net.ListenPacket("udp", addr)
+				})
+				if err != nil {
+					return fmt.Errorf("error starting UDP server: %w", err)
+				}
+			}
+			for _, wrap := range wrapUDP {
+				conn = wrap(conn)
+			}
+			return udpServer.Serve(ctx, conn)
+		}
+	}
+
+	if *httpAddr != "" {
+		httpServer := &httpfiles.Server{Addr: *httpAddr, Root: "uploads", User: *httpUser, Password: *httpPass, Tokens: tokenStore, Tenants: tenants}
+		if *httpUpload {
+			httpServer.Upload = &store.Config{
+				Root:          "uploads",
+				PerClientDirs: *perClientDirs,
+				Layout:        *layoutFlag,
+				Live:          policy,
+				NoPreallocate: *noPrealloc,
+				HookCommand:   *hookCmd,
+				HookURL:       *hookURL,
+				HookStrict:    *hookStrict,
+				Storage:       *storageFlag,
+				AutoExtract:   *autoExtract,
+				Dedupe:        *dedupe,
+				StagingDir:    *stagingDir,
+
+				MaxExtractSize:    maxExtract,
+				MaxExtractEntries: *extractCount,
+
+				CompletionMarker: *completionMarker,
+				CompletedDir:     *completedDir,
+
+				ScanCommand:          *scanCmd,
+				ScanTimeout:          *scanTimeout,
+				ScanPromoteOnTimeout: scanPromote,
+
+				Tokens: tokenStore,
+			}
+		}
+		if *httpWS {
+			// A copy of the TCP server, as each Serve keeps its own store
+			wsServer := *tcpServer
+			wsServer.WrapConn = nil
+			wsListener := tcpft.NewWebSocketListener()
+			httpServer.WebSocket = wsListener
+			run(func(ctx context.Context) error { return wsServer.Serve(ctx, wsListener) })
+		}
+		run(httpServer.ListenAndServe)
+	}
+
+	// QUIC streams carry the TCP protocol, served by a copy of the TCP
+	// server as each Serve keeps its own store
+	var quicListening func(net.Addr)
+	serveQUIC := func(ctx context.Context) error {
+		listener, err := ports.Listen(*quicAddr, *portRetry, func(addr string) (*quicft.Listener, error) {
+			return quicft.ListenAddr(addr, tlsConfig)
+		})
+		if err != nil {
+			return fmt.Errorf("error starting QUIC server: %w", err)
+		}
+		quicServer := *tcpServer
+		quicServer.Listening, quicServer.WrapConn = quicListening, nil
+		return quicServer.Serve(ctx, listener)
+	}
+
+	// TFTP comes in through a copy of the UDP server, as each Serve keeps
+	// its own store
+	if *tftp {
+		tftpServer := *udpServer
+		run(tftpServer.ListenAndServeTFTP)
+	}
+
+	// So do multicast distributions
+	if *multicastGroup != "" {
+		mcastServer := *udpServer
+		mcastServer.MulticastGroup, mcastServer.MulticastInterface = *multicastGroup, *multicastIf
+		run(mcastServer.ListenAndServeMulticast)
+	}
+
+	if *relay {
+		run((&punch.Relay{Addr: *relayAddr}).ListenAndServe)
+	}
+
+	// Each server -proto names prints the address it listens on, which
+	// -port=0 and -port-retry leave to chance, as a LISTENING line for
+	// scripts to read, and announces it. systemd learns the server is
+	// ready once they all listen, see internal/sdnotify
+	var listening sync.WaitGroup
+	var boundMu sync.Mutex
+	bound := make(map[string]string)
+	ready := func(proto string) func(net.Addr) {
+		listening.Add(1)
+		done := sync.OnceFunc(listening.Done)
+		return func(addr net.Addr) {
+			network := proto
+			if addr.Network() == "unix" {
+				network = "unix"
+			}
+			// A TCP server on several addresses lists them all
+			addrs := strings.Split(addr.String(), ",")
+			for _, a := range addrs {
+				fmt.Println("LISTENING", network, a)
+			}
+			boundMu.Lock()
+			bound[proto] = addrs[0]
+			boundMu.Unlock()
+			done()
+		}
+	}
+
+	if *announce || *mdns {
+		name := *announceName
+		if name == "" {
+			name, _ = os.Hostname()
+		}
+		protos := make(map[string]string)
+		if *proto == "tcp" || *proto == "both" || *proto == "all" {
+			if *unixSocket == "" {
+				protos["tcp"] = tcpAddrs[0]
+			}
+		}
+		if *proto == "udp" || *proto == "both" || *proto == "all" {
+			protos["udp"] = *udpAddr
+		}
+		if *proto == "quic" || *proto == "all" {
+			protos["quic"] = *quicAddr
+		}
+		if *tftp {
+			protos["tftp"] = *tftpAddr
+		}
+		// The ports the servers got, once they listen
+		addrOf := func(proto string) string {
+			boundMu.Lock()
+			defer boundMu.Unlock()
+			if addr, ok := bound[proto]; ok && protos[proto] != "" {
+				return addr
+			}
+			return protos[proto]
+		}
+		info := announcer(name, addrOf, "uploads", *storageFlag != "")
+		if *announce {
+			run((&discover.Responder{Info: info}).ListenAndServe)
+		}
+		if *mdns {
+			run((&discover.MDNS{Info: info}).ListenAndServe)
+		}
+	}
+
+	switch *proto {
+	case "tcp":
+		tcpServer.Listening = ready("tcp")
+		run(tcpServer.ListenAndServe)
+	case "udp":
+		udpServer.Listening = ready("udp")
+		run(serveUDP)
+	case "quic":
+		quicListening = ready("quic")
+		run(serveQUIC)
+	case "both":
+		tcpServer.Listening, udpServer.Listening = ready("tcp"), ready("udp")
+		run(tcpServer.ListenAndServe)
+		run(serveUDP)
+	case "all":
+		tcpServer.Listening, udpServer.Listening, quicListening = ready("tcp"), ready("udp"), ready("quic")
+		run(tcpServer.ListenAndServe)
+		run(serveUDP)
+		run(serveQUIC)
+	default:
+		fmt.Println(i18n.T("unknown_protocol", *proto))
+		os.Exit(1)
+	}
+	notified := func(err error) {
+		if err != nil {
+			fmt.Println(i18n.T("error", err))
+		}
+	}
+	go func() {
+		listening.Wait()
+		if ctx.Err() == nil {
+			notified(sdnotify.Ready())
+		}
+	}()
+	// Told as shutdown starts, and before the process exits
+	stopping := make(chan struct{})
+	stopNotify := context.AfterFunc(ctx, func() {
+		defer close(stopping)
+		notified(sdnotify.Stopping())
+	})
+	run(sdnotify.Watchdog)
+
+	wg.Wait()
+	if !stopNotify() {
+		<-stopping
+	}
+}
+
+func runSend(args []string) {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	var proto = fs.String("proto", "tcp", "Protocol: 'tcp', 'udp' or 'quic'")
+	var addr = fs.String("addr", "", "Server address (default localhost:8080 for TCP, localhost:8081 for UDP, localhost:8082 for QUIC)")
+	var unixSocket = fs.String("unix", "", "Connect to the TCP server's unix socket at this path instead of -addr")
+	var wsURL = fs.String("ws", "", "Tunnel to the TCP server over WebSocket at this URL, e.g. wss://host/ws, instead of -addr")
+	var proxyFlag = fs.String("proxy", "", "Reach the TCP server through this proxy, socks5://[user:pass@]host:port or http://[user:pass@]host:port (default ALL_PROXY unless NO_PROXY exempts the server; 'direct' ignores them)")
+	var discoverFlag = fs.Bool("discover", false, "Send to a server found on the LAN instead of -addr, asking which if several answer")
+	var multicastGroup = fs.String("multicast", "", "Send the file to every receiver on this multicast group at once, e.g. 239.255.0.1:9000, instead of -addr")
+	var rateFlag = fs.String("rate", "10M", "Bytes per second to multicast, with an optional K, M or G suffix")
+	var receivers = fs.Int("receivers", 0, "Start multicasting as soon as this many receivers registered (0 waits the whole -register)")
+	var register = fs.Duration("register", udpft.DefaultMulticastRegister, "How long to wait for multicast receivers to register")
+	var deadline = fs.Duration("deadline", 0, "Give up on multicast receivers still missing data after this (0 means no limit)")
+	var multicastIf = fs.String("multicast-if", "", "Network interface to multicast on (default the system's choice)")
+	var tlsCA = fs.String("tls-ca", "", "PEM certificates to trust for QUIC instead of the system roots")
+	var tlsInsecure = fs.Bool("tls-insecure", false, "Accept any QUIC server certificate, such as a self-signed one")
+	var tlsCert = fs.String("tls-cert", "", "PEM client certificate to present over QUIC, with -tls-key, to a server that knows its tenants by cn")
+	var tlsKey = fs.String("tls-key", "", "PEM private key of -tls-cert")
+	var authToken = fs.String("auth-token", "", "Token telling a server split among tenants which one this is (TCP and QUIC only)")
+	var file = fs.String("file", "", "File to send")
+	var name = fs.String("name", "", "Name to store the file as on the server (default the file's base name)")
+	var skipIdentical = fs.Bool("skip-identical", false, "Don't send the file if the server already has an identical copy")
+	var useDelta = fs.Bool("delta", false, "Only send the blocks that differ from the server's copy (TCP and QUIC only)")
+	var hashFlag = fs.String("hash", "sha256", "Hash the server checks the file with: sha256, blake3, xxh3 or crc32c, falling back to sha256 if it lacks it (TCP and QUIC only)")
+	var streams = fs.Int("streams", 1, "Send the file in this many ranges over parallel connections, for high-latency links (TCP and QUIC only)")
+	var archiveFlag = fs.Bool("archive", false, "Send -file, a directory, as one tar archive named after it, which 'serve -auto-extract' unpacks")
+	var gzipFlag = fs.Bool("gzip", false, "Compress the -archive with gzip")
+	var snapshot = fs.Bool("snapshot", false, "Send a copy of -file taken first, for a file that is still being written")
+	var codeFlag = fs.Bool("code", false, "Stage the file on a 'serve -codes' server under a short code to read out to the receiver, who fetches it with 'transfer receive' (TCP and QUIC only)")
+	var e2eFlag = fs.String("e2e", "", "Encrypt -file before sending it as <name>.enc, which only 'transfer decrypt' reads, with pass:<passphrase>, env:<variable holding it> or file:<key file>")
+	var timeout = fs.Duration("timeout", 0, "Abort the transfer if it takes longer than this (0 means no limit)")
+	var legacy = fs.Bool("legacy", false, "Talk to a server that predates protocol version negotiation")
+	var fallbackTCP = fs.Bool("fallback-tcp", false, "Resend over TCP if the UDP transfer times out (UDP only)")
+	var tcpAddr = fs.String("tcp-addr", "", "TCP server address for -fallback-tcp (default the -addr host on port 8080)")
+	simFlags := addSimFlags(fs)
+	traceFlags := addTraceFlags(fs)
+	var bufferFlag = fs.String("buffer", "256K", "TCP read and write buffer size, with an optional K, M or G suffix")
+	var packetSize = fs.Int("packet-size", udpft.DefaultPacketSize, fmt.Sprintf("UDP payload bytes per packet, %d to %d", udpft.MIN_PACKET_SIZE, udpft.MAX_PACKET_SIZE))
+	var window = fs.Int("window", 0, fmt.Sprintf("Fixed number of UDP packets in flight, at most %d (0 adapts it to congestion, 1 is stop-and-wait)", udpft.RECEIVE_WINDOW))
+	var maxWindow = fs.Int("max-window", udpft.RECEIVE_WINDOW, "Cap of the adaptive UDP window")
+	var fecFlag = fs.String("fec", "", "Send UDP parity packets: k/n groups k data packets with n-k parity packets, e.g. 10/12")
+	var ccTrace = fs.String("cc-trace", "", "Write the adaptive UDP window over time to this CSV file")
+	var paceBurst = fs.Int("pace-burst", udpft.DefaultPaceBurst, "UDP packets sent back-to-back before pacing spreads the rest over the round trip")
+	var noAutotune = fs.Bool("no-autotune", false, "Use the default -buffer and -max-window instead of tuning them to the transfer's throughput")
+	var watchDir = fs.String("watch", "", "Keep sending the files that appear in this directory instead of a single -file")
+	var settle = fs.Duration("settle", watch.DefaultSettle, "How long a watched file must stay unchanged before it is sent")
+	var afterSend = fs.String("after-send", "keep", "What to do with a watched file once sent: 'keep', 'delete' or 'move' to its sent subdirectory")
+	var failFast = fs.Bool("fail-fast", false, "Stop watching once the server is out of disk space instead of waiting for room")
+	var filterFlag = filterFlags(fs)
+	var queueFlag = queueFlags(fs)
+	parseFlags(fs, args)
+	filter := filterFlag()
+
+	bufferSize := mustParseBuffer(*bufferFlag)
+	fecData, fecParity := mustParseFEC(*fecFlag)
+	// Sizes given on the command line are kept as they are
+	tuneBuffer := !*noAutotune && !flagSet(fs, "buffer")
+	tuneWindow := !*noAutotune && !flagSet(fs, "window") && !flagSet(fs, "max-window")
+	hash, err := checksum.Parse(*hashFlag)
+	if err != nil {
+		fmt.Println(i18n.T("invalid_hash", err))
+		os.Exit(1)
+	}
+	*addr = tunnelAddr(*proto, *addr, *unixSocket, *wsURL)
+	if *discoverFlag {
+		if *addr != "" {
+			fmt.Println(i18n.T("send.discover_conflict"))
+			os.Exit(1)
+		}
+		found, err := discoverAddr(context.Background(), *proto)
+		if err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(1)
+		}
+		*addr = found
+	}
+
+	// QUIC carries the TCP protocol, each transfer on a stream of one
+	// connection
+	tcpClient := tcpft.Client{UnixSocket: *unixSocket, WebSocket: *wsURL}
+	if *proto == "tcp" && *unixSocket == "" && *wsURL == "" {
+		tcpClient.Proxy = proxyFor(*proxyFlag, *addr)
+	} else if *proxyFlag != "" {
+		fmt.Println(i18n.T("send.proxy_tcp_only"))
+		os.Exit(1)
+	}
+	// The -sim flags impair what is sent over TCP or UDP, counting what
+	// they did for the summary
+	simConfig, err := simFlags.config()
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	var simulate *simulator
+	if simConfig.Enabled() {
+		if *proto == "quic" {
+			fmt.Println(i18n.T("send.sim_quic"))
+			os.Exit(1)
+		}
+		simulate = &simulator{cfg: simConfig, track: true}
+	}
+	// -trace records the UDP packets, as sent before the -sim flags impair
+	// them
+	if *traceFlags.path != "" && *proto != "udp" {
+		fmt.Println(i18n.T("send.trace_udp"))
+		os.Exit(1)
+	}
+	tracer, err := traceFlags.create(trace.CLIENT)
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	if tracer != nil {
+		defer tracer.Close()
+	}
+	if simulate != nil && *proto == "tcp" {
+		tcpClient.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := net.Dialer{KeepAlive: tcpft.TCP_KEEPALIVE}
+			conn, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return simulate.stream(conn), nil
+		}
+	}
+	if *proto == "quic" {
+		tlsConfig, err := clientTLS(*tlsCA, *tlsInsecure, *tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Println(i18n.T("send.invalid_tls", err))
+			os.Exit(1)
+		}
+		dialer := &quicft.Dialer{TLSConfig: tlsConfig}
+		defer dialer.Close()
+		tcpClient.Dial = dialer.Dial
+		if *addr == "" {
+			*addr = "localhost" + wire.QUIC_PORT
+		}
+	}
+
+	if *watchDir != "" {
+		if *file != "" || *name != "" || *e2eFlag != "" || *codeFlag {
+			fmt.Println(i18n.T("send.watch_conflict"))
+			os.Exit(1)
+		}
+		tcpOpts := tcpft.Options{BufferSize: bufferSize, Autotune: tuneBuffer, SkipIdentical: *skipIdentical, Delta: *useDelta, Hash: hash, Legacy: *legacy, AuthToken: *authToken}
+		udpOpts := udpft.Options{PacketSize: *packetSize, Window: *window, MaxWindow: *maxWindow, Autotune: tuneWindow, PaceBurst: *paceBurst, FECData: fecData, FECParity: fecParity, SkipIdentical: *skipIdentical, Legacy: *legacy}
+		runWatch(*watchDir, *settle, *afterSend, filter, queueFlag(), *failFast, *timeout, *proto, *addr, tcpClient, tcpOpts, udpOpts)
+		return
+	}
+	if filter != nil && !*archiveFlag {
+		fmt.Println(i18n.T("send.filters_need_archive"))
+		os.Exit(1)
+	}
+
+	if *file == "" {
+		fmt.Println(i18n.T("send.requires_file"))
+		fmt.Println(i18n.T("send.usage"))
+		os.Exit(1)
+	}
+	if *archiveFlag && (*snapshot || *useDelta) {
+		fmt.Println(i18n.T("send.archive_conflict"))
+		os.Exit(1)
+	}
+	remoteName := *name
+	if remoteName == "" && *archiveFlag {
+		remoteName = archive.Name(*file, *gzipFlag)
+	} else if remoteName == "" {
+		remoteName = filepath.Base(*file)
+	}
+	if err := wire.CheckName(remoteName); err != nil {
+		fmt.Println(i18n.T("invalid_name", err))
+		os.Exit(1)
+	}
+	// The server only sees the encrypted file, its name and size sealed
+	// inside it
+	var secret e2e.Secret
+	plainName := remoteName
+	if *e2eFlag != "" {
+		if *useDelta {
+			fmt.Println(i18n.T("send.e2e_conflict"))
+			os.Exit(1)
+		}
+		secret, err = e2e.ParseSecret(*e2eFlag)
+		if err != nil {
+			fmt.Println(i18n.T("send.invalid_e2e", err))
+			os.Exit(1)
+		}
+		remoteName += e2e.SUFFIX
+		if err := wire.CheckName(remoteName); err != nil {
+			fmt.Println(i18n.T("invalid_name", err))
+			os.Exit(1)
+		}
+	}
+
+	// The file is read from source, a copy of it with -snapshot
+	source := *file
+	if *snapshot {
+		copyPath, err := snapshotFile(*file)
+		if err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(1)
+		}
+		source = copyPath
+	}
+	if *archiveFlag {
+		archivePath, files, err := archiveDir(*file, *gzipFlag, filter)
+		if err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(1)
+		}
+		fmt.Println(i18n.T("send.archived", files, *file))
+		source = archivePath
+	}
+	if *e2eFlag != "" {
+		encrypted, err := encryptFile(source, plainName, secret)
+		if source != *file {
+			os.Remove(source)
+		}
+		if err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(1)
+		}
+		source = encrypted
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	if *codeFlag {
+		switch {
+		case *proto == "udp" || *multicastGroup != "":
+			fmt.Println(i18n.T("send.code_tcp_quic_only"))
+			os.Exit(1)
+		case *skipIdentical || *useDelta || *streams > 1:
+			fmt.Println(i18n.T("send.code_conflict"))
+			os.Exit(1)
+		}
+		if *addr == "" {
+			*addr = "localhost" + wire.TCP_PORT
+		}
+		code, res, err := sendCode(ctx, tcpClient, *addr, source, remoteName, tcpft.Options{BufferSize: bufferSize})
+		if source != *file {
+			os.Remove(source)
+		}
+		if err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(exitCode(err))
+		}
+		fmt.Println(i18n.T("send.staged", *file, remoteName))
+		wire.PrintSummary(res.Bytes, res.Duration)
+		fmt.Println(i18n.T("send.code", code))
+		switch {
+		case *proto == "quic":
+			fmt.Println(i18n.T("send.receive_hint_quic", code, *addr))
+		case *unixSocket == "" && *wsURL == "":
+			fmt.Println(i18n.T("send.receive_hint", code, *addr))
+		}
+		return
+	}
+
+	if *multicastGroup != "" {
+		if *addr != "" || *discoverFlag {
+			fmt.Println(i18n.T("send.multicast_conflict"))
+			os.Exit(1)
+		}
+		rate, err := parseSize(*rateFlag)
+		if err != nil {
+			fmt.Println(i18n.T("invalid_rate", err))
+			os.Exit(1)
+		}
+		opts := udpft.MulticastOptions{Rate: rate, Receivers: *receivers, Register: *register, Deadline: *deadline, Interface: *multicastIf}
+		opts.PacketSize, opts.Name = *packetSize, remoteName
+		sendMulticast(ctx, *multicastGroup, *file, source, opts)
+		return
+	}
+
+	// Ctrl-Z or p on the terminal pauses the transfer
+	pause := new(wire.Pause)
+	stopPause := watchPause(pause)
+	defer stopPause()
+
+	var bytes int64
+	var duration time.Duration
+	var skipped, deduped, fellBack bool
+	var storedAs, token string
+	var udpRes *udpft.Result
+	var streamStats []tcpft.StreamStats
+	var tunedBuffer int
+
+	sendTCP := func(addr string) {
+		var res *tcpft.Result
+		res, err = tcpClient.SendFile(ctx, addr, source, tcpft.Options{BufferSize: bufferSize, Autotune: tuneBuffer, SkipIdentical: *skipIdentical, Delta: *useDelta, Hash: hash, Streams: *streams, Pause: pause, Legacy: *legacy, Name: remoteName, AuthToken: *authToken})
+		if err == nil {
+			bytes, duration, skipped, deduped = res.Bytes, res.Duration, res.Skipped, res.Deduped
+			storedAs, token, streamStats = res.StoredAs, res.Token, res.Streams
+			tunedBuffer = res.Buffer
+		}
+	}
+
+	switch *proto {
+	case "tcp", "quic":
+		if *addr == "" {
+			*addr = "localhost" + wire.TCP_PORT
+		}
+		sendTCP(*addr)
+	case "udp":
+		if *useDelta || *streams > 1 || hash != checksum.SHA256 {
+			fmt.Println(i18n.T("send.tcp_quic_options"))
+			os.Exit(1)
+		}
+		if *addr == "" {
+			*addr = "localhost" + wire.UDP_PORT
+		}
+		var client udpft.Client
+		if simulate != nil || tracer != nil {
+			client.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				conn, err := d.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				if simulate != nil {
+					conn = simulate.datagram(conn)
+				}
+				if tracer != nil {
+					conn = tracer.datagram(conn)
+				}
+				return conn, nil
+			}
+		}
+		opts := udpft.Options{PacketSize: *packetSize, Window: *window, MaxWindow: *maxWindow, Autotune: tuneWindow, PaceBurst: *paceBurst, FECData: fecData, FECParity: fecParity, SkipIdentical: *skipIdentical, Pause: pause, Legacy: *legacy, Name: remoteName}
+		var trace *os.File
+		if *ccTrace != "" {
+			trace, err = os.Create(*ccTrace)
+			if err != nil {
+				fmt.Println(i18n.T("error", err))
+				os.Exit(1)
+			}
+			fmt.Fprintln(trace, "seconds,window,rtt_ms,loss")
+			opts.WindowTrace = func(s udpft.WindowSample) {
+				fmt.Fprintf(trace, "%.6f,%d,%.3f,%t\n", s.Elapsed.Seconds(), s.Window, float64(s.RTT)/float64(time.Millisecond), s.Loss)
+			}
+		}
+		var res *udpft.Result
+		res, err = client.SendFile(ctx, *addr, source, opts)
+		if err == nil {
+			bytes, duration, skipped = res.Bytes, res.Duration, res.Skipped
+			udpRes = res
+		}
+		if trace != nil {
+			trace.Close()
+		}
+		if err != nil && *fallbackTCP && ctx.Err() == nil && udpUnusable(err) {
+			if *tcpAddr == "" {
+				*tcpAddr = fallbackAddr(*addr)
+			}
+			fmt.Println(i18n.T("send.udp_transfer_failed", err))
+			fmt.Println(i18n.T("send.falling_back", *tcpAddr))
+			fellBack = true
+			sendTCP(*tcpAddr)
+		}
+	default:
+		fmt.Println(i18n.T("unknown_protocol", *proto))
+		os.Exit(1)
+	}
+	if source != *file {
+		os.Remove(source)
+	}
+
+	// Figures taken on a simulated network are labelled so
+	simulated := func() {
+		if simulate == nil {
+			return
+		}
+		key := "send.simulated_stream"
+		if *proto == "udp" {
+			key = "send.simulated_packets"
+		}
+		printSimulated(key, simConfig, simulate.Stats())
+	}
+	if err != nil {
+		simulated()
+		fmt.Println(i18n.T("error", err))
+		os.Exit(exitCode(err))
+	}
+
+	if skipped {
+		fmt.Println(i18n.T("send.skipped_identical", *file, remoteName))
+		return
+	}
+	fmt.Println(i18n.T("sent", *file, remoteName))
+	if storedAs != "" && storedAs != remoteName {
+		fmt.Println(i18n.T("send.stored_as", storedAs))
+	}
+	if token != "" {
+		fmt.Println(i18n.T("send.token", token, token))
+	}
+	if deduped {
+		fmt.Println(i18n.T("send.deduplicated"))
+	}
+	printStreams(streamStats)
+	wire.PrintSummary(bytes, duration)
+	if udpRes != nil && udpRes.PeakWindow > 1 {
+		fmt.Println(i18n.T("send.pacing", udpRes.SendRate, udpRes.PeakWindow))
+	}
+	if tunedBuffer > 0 {
+		size := formatSize(int64(tunedBuffer))
+		fmt.Println(i18n.T("send.tuned_buffer", size, size))
+	}
+	if udpRes != nil && udpRes.MaxWindow > 0 {
+		fmt.Println(i18n.T("send.tuned_window", udpRes.MaxWindow, udpRes.MaxWindow))
+	}
+	if udpRes != nil {
+		printUDPStats(udpRes, fecData > 0)
+	}
+	if fellBack {
+		fmt.Println(i18n.T("send.fell_back"))
+	}
+	simulated()
+	fmt.Println(i18n.T("transfer_successful"))
+}
+
+// printStreams prints what each connection of a file sent over several
+// carried, before the summary of the whole file.
+func printStreams(stats []tcpft.StreamStats) {
+	for i, st := range stats {
+		line := i18n.T("send.stream", i+1, wire.FormatBytes(st.Bytes), wire.FormatDuration(st.Duration))
+		if rate := wire.FormatRate(st.Bytes, st.Duration); rate != "" {
+			line += ", " + rate
+		}
+		if st.Retries > 0 {
+			line += i18n.T("send.stream_retries", st.Retries)
+		}
+		fmt.Println(line)
+	}
+}
+
+// printUDPStats prints the packet counters of a UDP send as a table, with
+// the FEC repairs if fec is on.
+func printUDPStats(res *udpft.Result, fec bool) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, i18n.T("udp.packets_sent", res.PacketsSent))
+	fmt.Fprintln(tw, i18n.T("udp.retransmissions", res.Retransmits, res.RetransmitRate()*100))
+	if fec {
+		fmt.Fprintln(tw, i18n.T("udp.repaired", res.Repaired))
+	}
+	fmt.Fprintln(tw, i18n.T("udp.ack_timeouts", res.Timeouts))
+	fmt.Fprintln(tw, i18n.T("udp.duplicate_acks", res.DuplicateAcks))
+	fmt.Fprintln(tw, i18n.T("udp.strays", res.Strays))
+	if goodput := wire.FormatRate(res.Bytes, res.Duration); goodput != "" {
+		fmt.Fprintln(tw, i18n.T("udp.goodput", goodput, wire.FormatRate(res.WireBytes, res.Duration)))
+	}
+	if res.RTTMax > 0 {
+		fmt.Fprintln(tw, i18n.T("udp.rtt", res.RTTMin.Round(time.Microsecond), res.RTTAvg.Round(time.Microsecond), res.RTTMax.Round(time.Microsecond)))
+	}
+	tw.Flush()
+}
+
+// mustParseFEC parses the -fec flag, k/n, into data and parity packets per
+// group, exiting if it is invalid.
+func mustParseFEC(s string) (data, parity int) {
+	if s == "" {
+		return 0, 0
+	}
+	k, n, ok := strings.Cut(s, "/")
+	data, err1 := strconv.Atoi(k)
+	total, err2 := strconv.Atoi(n)
+	if !ok || err1 != nil || err2 != nil || data < 1 || total <= data || total > udpft.MAX_FEC_GROUP {
+		fmt.Println(i18n.T("invalid_fec", s, udpft.MAX_FEC_GROUP))
+		os.Exit(1)
+	}
+	return data, total - data
+}
+
+// mustParseBuffer parses the -buffer flag, exiting if it is invalid.
+func mustParseBuffer(s string) int {
+	n, err := parseSize(s)
+	if err != nil || n > math.MaxInt32 {
+		fmt.Println(i18n.T("invalid_buffer", s))
+		os.Exit(1)
+	}
+	return int(n)
+}
+
+// flagSet reports whether the flag name was given on the command line
+// fs parsed.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// udpUnusable reports whether err means UDP doesn't get through, either
+// because packets go unanswered or because nothing listens on the port.
+func udpUnusable(err error) bool {
+	return errors.Is(err, wire.ErrTimeout) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// mustWithPort returns addr, the value of flag, with port instead of its
+// own.
+func mustWithPort(flag, addr, port string) string {
+	addr, err := ports.WithPort(addr, port)
+	if err != nil {
+		fmt.Println(i18n.T("serve.invalid_addr", flag, err))
+		os.Exit(1)
+	}
+	return addr
+}
+
+// listFlag is a flag that may be repeated, collecting every value.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func (l *listFlag) List() []string { return *l }
+
+// langFlag is -lang. Setting it switches languages at once, so a -h that
+// follows it already prints in the new one.
+type langFlag string
+
+func (l *langFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return string(*l)
+}
+
+func (l *langFlag) Set(s string) error {
+	if err := i18n.SetLanguage(s); err != nil {
+		return err
+	}
+	*l = langFlag(s)
+	return nil
+}
+
+// filterFlags adds -include, -exclude and -exclude-from to fs. The function
+// it returns, called once fs is parsed, returns the Filter they make, nil
+// without patterns.
+func filterFlags(fs *flag.FlagSet) func() *pathfilter.Filter {
+	var include, exclude listFlag
+	fs.Var(&include, "include", "Only send files matching this gitignore-style pattern, e.g. '*.go' or 'src/**'; repeat for more")
+	fs.Var(&exclude, "exclude", "Don't send files matching this gitignore-style pattern, e.g. '*.o' or 'node_modules/', even if included; repeat for more")
+	var excludeFrom = fs.String("exclude-from", "", "Read more -exclude patterns from this file, one per line as in a .gitignore")
+	return func() *pathfilter.Filter {
+		patterns := exclude.List()
+		if *excludeFrom != "" {
+			more, err := pathfilter.ReadPatterns(*excludeFrom)
+			if err != nil {
+				fmt.Println(i18n.T("invalid_exclude_from", err))
+				os.Exit(1)
+			}
+			patterns = append(patterns, more...)
+		}
+		filter, err := pathfilter.New(include.List(), patterns)
+		if err != nil {
+			fmt.Println(i18n.T("invalid_filter", err))
+			os.Exit(1)
+		}
+		return filter
+	}
+}
+
+// queueFlags adds -order and -priority-glob to fs. The function it
+// returns, called once fs is parsed, returns an empty Queue that orders
+// files as they say.
+func queueFlags(fs *flag.FlagSet) func() *schedule.Queue {
+	var order = fs.String("order", "name", "Order to send files in: 'name', 'size-asc', 'size-desc' or 'mtime', oldest first")
+	var priority listFlag
+	fs.Var(&priority, "priority-glob", "Send files matching this pattern, as -include takes them, ahead of the others; repeat for more")
+	return func() *schedule.Queue {
+		o, err := schedule.ParseOrder(*order)
+		if err != nil {
+			fmt.Println(i18n.T("invalid_order", err))
+			os.Exit(1)
+		}
+		queue, err := schedule.New(o, priority.List())
+		if err != nil {
+			fmt.Println(i18n.T("invalid_priority_glob", err))
+			os.Exit(1)
+		}
+		return queue
+	}
+}
+
+// proxyFor returns the proxy a TCP client reaches addr through: flag, or
+// the one the environment names if flag is empty, none if it is "direct".
+func proxyFor(flag, addr string) string {
+	switch flag {
+	case "":
+		if addr == "" {
+			addr = "localhost" + wire.TCP_PORT
+		}
+		return tcpft.ProxyFromEnvironment(addr)
+	case "direct":
+		return ""
+	}
+	return flag
+}
+
+// tunnelAddr checks the -unix and -ws flags of a TCP client and returns
+// the address to name the server by: addr, or else the socket or URL.
+func tunnelAddr(proto, addr, unixSocket, wsURL string) string {
+	tunnel := unixSocket
+	switch {
+	case unixSocket != "" && wsURL != "":
+		fmt.Println(i18n.T("unix_ws_conflict"))
+		os.Exit(1)
+	case wsURL != "":
+		tunnel = wsURL
+		if u, err := url.Parse(wsURL); err == nil {
+			tunnel = u.Redacted() // Keep passwords out of the output
+		}
+	case unixSocket == "":
+		return addr
+	}
+	if proto != "tcp" {
+		fmt.Println(i18n.T("unix_ws_tcp_only"))
+		os.Exit(1)
+	}
+	if addr == "" {
+		return tunnel
+	}
+	return addr
+}
+
+// fallbackAddr returns the default TCP port on the host of the UDP server
+// address udpAddr.
+func fallbackAddr(udpAddr string) string {
+	host, _, err := net.SplitHostPort(udpAddr)
+	if err != nil {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, wire.TCP_PORT[1:])
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Exit statuses of send
+const (
+	EXIT_FAILURE           = 1 // Any failure not listed below
+	EXIT_REJECTED          = 3
+	EXIT_TOO_LARGE         = 4
+	EXIT_CHECKSUM_MISMATCH = 5
+	EXIT_TIMEOUT           = 6
+	EXIT_PROTOCOL          = 7
+	EXIT_NO_SPACE          = 8
+	EXIT_POLICY            = 9
+	EXIT_INTERRUPTED       = 130
+)
+
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return EXIT_INTERRUPTED
+	case errors.Is(err, wire.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return EXIT_TIMEOUT
+	case errors.Is(err, wire.ErrNoSpace):
+		return EXIT_NO_SPACE
+	case errors.Is(err, wire.ErrPolicy):
+		return EXIT_POLICY
+	case errors.Is(err, wire.ErrRejected):
+		return EXIT_REJECTED
+	case errors.Is(err, wire.ErrTooLarge), errors.Is(err, wire.ErrExpansion):
+		return EXIT_TOO_LARGE
+	case errors.Is(err, wire.ErrChecksumMismatch):
+		return EXIT_CHECKSUM_MISMATCH
+	case errors.Is(err, wire.ErrProtocol):
+		return EXIT_PROTOCOL
+	}
+	return EXIT_FAILURE
+}
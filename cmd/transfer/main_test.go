@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"socket-file-transfer/tcpft"
+)
+
+// Tests run the command by executing the test binary again with
+// TRANSFER_TEST_MAIN set, which makes TestMain call main instead of the
+// tests, so os.Exit and the output can be checked.
+
+func TestMain(m *testing.M) {
+	if os.Getenv("TRANSFER_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs transfer with args, feeding it stdin and adding env to a clean
+// environment in English, and returns its output and exit status.
+func run(t *testing.T, stdin string, env []string, args ...string) (string, int) {
+	t.Helper()
+	return runIn(t, "", stdin, env, args...)
+}
+
+// runIn is run in the working directory dir, this one if "".
+func runIn(t *testing.T, dir, stdin string, env []string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append([]string{"TRANSFER_TEST_MAIN=1", "LANG=en_US.UTF-8", "HOME=" + t.TempDir(), "PATH=" + os.Getenv("PATH")}, env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return out.String(), exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), 0
+}
+
+// serveTCP runs s on a loopback port, storing under a temporary directory
+// unless s.UploadDir is set, until the test ends. It returns the address.
+func serveTCP(t *testing.T, s *tcpft.Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.UploadDir == "" {
+		s.UploadDir = t.TempDir()
+	}
+	s.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	s.Progress = func(tcpft.Event) {}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(ctx, ln)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ln.Addr().String()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"socket-file-transfer/internal/manifest"
+	"socket-file-transfer/tcpft"
+)
+
+// sync -manifest leaves a SHA256SUMS next to the files, which verify
+// checks them against until one is tampered with.
+func TestSyncManifest(t *testing.T) {
+	s := &tcpft.Server{}
+	addr := serveTCP(t, s)
+	dir := syncDir(t, map[string]string{"a.txt": "a", "b.txt": "bb"})
+
+	out, code := run(t, "", nil, "sync", "-manifest", "-dir="+dir, "-addr="+addr)
+	if code != 0 || !strings.Contains(out, "2 uploaded, 0 skipped, 0 failed") {
+		t.Fatalf("sync -manifest exited %d:\n%s", code, out)
+	}
+	entries, err := manifest.Load(s.UploadDir)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("stored manifest lists %v, %v, want the 2 files", entries, err)
+	}
+
+	out, code = run(t, "", nil, "verify", "-dir="+s.UploadDir)
+	if code != 0 || !strings.Contains(out, "2 OK, 0 failed") {
+		t.Fatalf("verify exited %d:\n%s", code, out)
+	}
+
+	os.WriteFile(filepath.Join(s.UploadDir, "b.txt"), []byte("rot"), 0644)
+	out, code = run(t, "", nil, "verify", "-dir="+s.UploadDir)
+	if code != EXIT_CHECKSUM_MISMATCH || !strings.Contains(out, "b.txt: FAILED") || !strings.Contains(out, "1 OK, 1 failed") {
+		t.Fatalf("verify after tampering exited %d, want %d:\n%s", code, EXIT_CHECKSUM_MISMATCH, out)
+	}
+}
+
+// A manifest in the synced directory is replaced by the one sync writes,
+// not sent as a file.
+func TestSyncManifestReplaced(t *testing.T) {
+	s := &tcpft.Server{}
+	addr := serveTCP(t, s)
+	dir := syncDir(t, map[string]string{"a.txt": "a", manifest.NAME: "stale"})
+
+	out, code := run(t, "", nil, "sync", "-manifest", "-dir="+dir, "-addr="+addr)
+	if code != 0 || !strings.Contains(out, "1 uploaded, 0 skipped, 0 failed") {
+		t.Fatalf("sync -manifest exited %d:\n%s", code, out)
+	}
+	if entries, err := manifest.Load(s.UploadDir); err != nil || len(entries) != 1 || entries[0].Path != "a.txt" {
+		t.Errorf("stored manifest lists %v, %v, want a.txt", entries, err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/udpft"
+)
+
+// sendMulticast is transfer send -multicast: it sends file to every
+// receiver on group and lists which stored it, exiting with the status of
+// the first failure. The content is read from source, which is removed
+// once sent if it is a snapshot of file.
+func sendMulticast(ctx context.Context, group, file, source string, opts udpft.MulticastOptions) {
+	var client udpft.Client
+	res, err := client.Multicast(ctx, group, source, opts)
+	if source != file {
+		os.Remove(source)
+	}
+	if res == nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(exitCode(err))
+	}
+
+	fmt.Println(i18n.T("multicast.sent", file, group, len(res.Complete)+len(res.Failed)))
+	wire.PrintSummary(res.Bytes, res.Duration)
+	fmt.Println(i18n.T("multicast.repairs", res.Rounds, res.Retransmits))
+	for _, addr := range res.Complete {
+		fmt.Println(i18n.T("multicast.stored", addr))
+	}
+	failed := make([]string, 0, len(res.Failed))
+	for addr := range res.Failed {
+		failed = append(failed, addr)
+	}
+	sort.Strings(failed)
+	for _, addr := range failed {
+		fmt.Println(i18n.T("multicast.failed", addr, res.Failed[addr]))
+	}
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(exitCode(res.Failed[failed[0]]))
+	}
+	fmt.Println(i18n.T("transfer_successful"))
+}
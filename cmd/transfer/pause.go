@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/signal"
+	"strings"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// watchPause pauses p on Ctrl-Z (SIGTSTP), which then no longer stops the
+// process, and resumes it on SIGCONT. Typing p and Enter on the terminal
+// toggles it. Call stop once the transfer is over.
+func watchPause(p *wire.Pause) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	pause, resume := pauseSignals()
+	if pause != nil {
+		signal.Notify(sigs, pause, resume)
+	}
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				if sig == pause {
+					p.Pause()
+				} else {
+					p.Resume()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// The reader is left blocked once the transfer is over; the process
+	// exits soon after
+	if isTerminal(os.Stdin) {
+		go func() {
+			in := bufio.NewScanner(os.Stdin)
+			for in.Scan() {
+				if strings.TrimSpace(in.Text()) == "p" {
+					p.Toggle()
+				}
+			}
+		}()
+	}
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// pauseSignals returns nil: sends are only paused from the terminal here.
+func pauseSignals() (pause, resume os.Signal) {
+	return nil, nil
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// pauseSignals returns the signals that pause and resume a send.
+func pauseSignals() (pause, resume os.Signal) {
+	return syscall.SIGTSTP, syscall.SIGCONT
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveListening runs serve with args until the test ends, returning the
+// directory it runs in and the addresses of the want LISTENING lines it
+// prints, by protocol.
+func serveListening(t *testing.T, want int, args ...string) (string, map[string]string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"serve"}, args...)...)
+	cmd.Dir = t.TempDir()
+	cmd.Env = []string{"TRANSFER_TEST_MAIN=1", "LANG=en_US.UTF-8", "HOME=" + t.TempDir(), "PATH=" + os.Getenv("PATH")}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	addrs := make(map[string]string)
+	var out []string
+	timeout := time.After(5 * time.Second)
+	for len(addrs) < want {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("serve exited before listening:\n%s", strings.Join(out, "\n"))
+			}
+			out = append(out, line)
+			if f := strings.Fields(line); len(f) == 3 && f[0] == "LISTENING" {
+				addrs[f[1]] = f[2]
+			}
+		case <-timeout:
+			t.Fatalf("%d LISTENING lines after 5 seconds, want %d:\n%s", len(addrs), want, strings.Join(out, "\n"))
+		}
+	}
+	// Keep reading, so serve never blocks on a full pipe
+	go func() {
+		for range lines {
+		}
+	}()
+	return cmd.Dir, addrs
+}
+
+// -port=0 gives each server a free port, which it prints and clients take
+// as is.
+func TestServePortZero(t *testing.T) {
+	dir, addrs := serveListening(t, 2, "-proto=both", "-port=0")
+	for _, proto := range []string{"tcp", "udp"} {
+		_, port, err := net.SplitHostPort(addrs[proto])
+		if err != nil || port == "0" {
+			t.Fatalf("%s listening on %q, want a port picked", proto, addrs[proto])
+		}
+		path := filepath.Join(t.TempDir(), proto+".txt")
+		os.WriteFile(path, []byte("sent over "+proto), 0644)
+		if out, code := run(t, "", nil, "send", "-proto="+proto, "-addr="+addrs[proto], "-file="+path); code != 0 {
+			t.Fatalf("send to %s exit code %d:\n%s", addrs[proto], code, out)
+		}
+		if got, _ := os.ReadFile(filepath.Join(dir, "uploads", proto+".txt")); string(got) != "sent over "+proto {
+			t.Errorf("stored %q over %s", got, proto)
+		}
+	}
+}
+
+// -port-retry moves a server whose port is taken to the next free one.
+func TestServePortRetry(t *testing.T) {
+	blocker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+	port := blocker.Addr().(*net.TCPAddr).Port
+	next := net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1))
+	if probe, err := net.Listen("tcp", next); err != nil {
+		t.Skipf("port above the blocker taken too: %v", err)
+	} else {
+		probe.Close()
+	}
+
+	_, addrs := serveListening(t, 1, "-tcp-addr="+blocker.Addr().String(), "-port-retry=3")
+	if addrs["tcp"] != next {
+		t.Errorf("listening on %s, want %s", addrs["tcp"], next)
+	}
+}
+
+// Discovery announces the ports the servers got, not those configured.
+func TestAnnouncerBoundPorts(t *testing.T) {
+	bound := map[string]string{"tcp": "[::]:49213", "udp": "[::]:49214", "quic": ":8082"}
+	a := announcer("box", func(proto string) string { return bound[proto] }, t.TempDir(), false)()
+	if a.Name != "box" || a.TCP != 49213 || a.UDP != 49214 || a.QUIC != 8082 || a.TFTP != 0 {
+		t.Errorf("announced %+v", a)
+	}
+	if a.Free < 0 {
+		t.Errorf("free space %d, want it known for a local directory", a.Free)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/punch"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/udpft"
+)
+
+// runPunch is transfer punch: it meets the peer with the same code at a
+// relay and sends it -file over UDP, or receives a file from it without
+// -file, directly through both NATs if possible and relayed otherwise.
+func runPunch(args []string) {
+	fs := flag.NewFlagSet("punch", flag.ExitOnError)
+	var relay = fs.String("relay", "", "Relay both peers register with, host:port (a server run with serve -relay)")
+	var code = fs.String("peer", "", "Code both peers pass to find each other")
+	var file = fs.String("file", "", "File to send; without it, receive one into uploads")
+	var name = fs.String("name", "", "Name to store the file as on the peer (default the file's base name)")
+	var punchTimeout = fs.Duration("punch-timeout", punch.DefaultTimeout, "How long to try reaching the peer directly before relaying")
+	var packetSize = fs.Int("packet-size", udpft.DefaultPacketSize, fmt.Sprintf("UDP payload bytes per packet, %d to %d", udpft.MIN_PACKET_SIZE, udpft.MAX_PACKET_SIZE))
+	parseFlags(fs, args)
+
+	if *relay == "" || *code == "" {
+		fmt.Println(i18n.T("punch.requires_relay_peer"))
+		fmt.Println(i18n.T("punch.usage"))
+		os.Exit(1)
+	}
+	if err := punch.CheckCode(*code); err != nil {
+		fmt.Println(i18n.T("punch.invalid_peer", err))
+		os.Exit(1)
+	}
+	remoteName := *name
+	if *file != "" && remoteName == "" {
+		remoteName = filepath.Base(*file)
+	}
+	if *file != "" {
+		if err := wire.CheckName(remoteName); err != nil {
+			fmt.Println(i18n.T("invalid_name", err))
+			os.Exit(1)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	conn, err := punch.Connect(ctx, *relay, *code, punch.Options{Timeout: *punchTimeout})
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(exitCode(err))
+	}
+	if conn.Relayed() {
+		fmt.Println(i18n.T("punch.relaying", *relay))
+	} else {
+		fmt.Println(i18n.T("punch.direct", conn.RemoteAddr()))
+	}
+
+	if *file == "" {
+		receivePunched(ctx, conn)
+		return
+	}
+
+	// The client closes the connection, which tells the peer we are done
+	client := udpft.Client{Dial: func(context.Context, string, string) (net.Conn, error) { return conn, nil }}
+	res, err := client.SendFile(ctx, conn.RemoteAddr().String(), *file, udpft.Options{PacketSize: *packetSize, Name: remoteName})
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(exitCode(err))
+	}
+	fmt.Println(i18n.T("sent", *file, remoteName))
+	wire.PrintSummary(res.Bytes, res.Duration)
+	fmt.Println(i18n.T("transfer_successful"))
+}
+
+// receivePunched stores the file the peer sends on conn, returning once
+// the peer hangs up.
+func receivePunched(ctx context.Context, conn *punch.Conn) {
+	var mu sync.Mutex
+	var completed bool
+	var failure error
+	server := &udpft.Server{}
+	server.Progress = func(ev udpft.Event) {
+		wire.ConsoleProgress(ev)
+		mu.Lock()
+		defer mu.Unlock()
+		switch ev.Kind {
+		case udpft.EventCompleted:
+			completed = true
+		case udpft.EventFailed:
+			failure = ev.Err
+		}
+	}
+	err := server.Serve(ctx, conn)
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(exitCode(err))
+	}
+	if !completed {
+		if failure == nil {
+			failure = errors.New("the peer hung up before sending a file")
+		}
+		fmt.Println(i18n.T("error", failure))
+		os.Exit(exitCode(failure))
+	}
+	fmt.Println(i18n.T("transfer_successful"))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"socket-file-transfer/internal/config"
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/tlscert"
+	"socket-file-transfer/internal/wire"
+)
+
+// The serve flags a SIGHUP reloads from -config; the others, such as the
+// addresses, storage and the TLS file paths, only take effect at startup
+var liveFlags = []string{"max-size", "reserve-space", "accept-ext", "reject-ext", "sniff", "retain-days", "retain-max-bytes", "retain-dry-run"}
+
+// Held while the serve flags are reloaded, or read by the admin socket
+var settingsMu sync.Mutex
+
+// reloadOnHangup reloads liveFlags from the config file on each SIGHUP
+// until ctx ends, putting the policy servePolicy makes of them in force,
+// and certs, if not nil, from its files. Transfers under way keep the
+// policy they started with. A config file that fails to load, or a policy
+// that fails to build, keeps the old one.
+func reloadOnHangup(ctx context.Context, settings *config.Config, policy *store.Live, servePolicy func() (store.Policy, error), certs *tlscert.Loader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	log := wire.DefaultLogger
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		// Failures are logged by the Loader
+		if certs != nil {
+			certs.Reload()
+		}
+		if settings.Path() == "" {
+			continue
+		}
+
+		var next store.Policy
+		settingsMu.Lock()
+		changed, ignored, err := settings.Reload(liveFlags, func() (err error) {
+			next, err = servePolicy()
+			return err
+		})
+		settingsMu.Unlock()
+		if err != nil {
+			log.Error("Config not reloaded, keeping the current one", "err", err)
+			continue
+		}
+		for _, c := range ignored {
+			log.Warn("Setting can't change without a restart, ignoring it", "flag", c.Name, "old", c.Old, "new", c.New)
+		}
+		for _, c := range changed {
+			log.Info("Setting changed", "flag", c.Name, "old", c.Old, "new", c.New)
+		}
+		policy.Set(next)
+		log.Info("Config reloaded", "changed", len(changed), "ignored", len(ignored))
+	}
+}
@@ -0,0 +1,62 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/tcpft"
+)
+
+// A SIGHUP puts the policy in the config file in force, keeping the old
+// one if the file no longer parses.
+func TestReloadOnHangup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transfer.toml")
+	os.WriteFile(path, []byte("[serve]\nmax-size = \"1K\"\n"), 0644)
+	addr, proc := startServe(t, nil, "-config="+path)
+
+	file := filepath.Join(t.TempDir(), "f.bin")
+	os.WriteFile(file, make([]byte, 2<<10), 0644)
+	send := func() error {
+		opts := tcpft.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), Progress: func(tcpft.Event) {}}
+		_, err := (&tcpft.Client{}).SendFile(context.Background(), addr, file, opts)
+		return err
+	}
+	// reload rewrites the config file and signals the server, waiting
+	// until the upload gets the error want
+	reload := func(config string, want error) {
+		t.Helper()
+		os.WriteFile(path, []byte(config), 0644)
+		proc.Signal(syscall.SIGHUP)
+		var err error
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if err = send(); errors.Is(err, want) {
+				return
+			}
+		}
+		t.Fatalf("after reloading %q: got %v, want %v", config, err, want)
+	}
+
+	if err := send(); !errors.Is(err, wire.ErrTooLarge) {
+		t.Fatalf("got %v, want ErrTooLarge", err)
+	}
+	reload("[serve]\nmax-size = \"4K\"\n", nil)
+	reload("[serve]\nmax-size = \"1K\"\n", wire.ErrTooLarge)
+
+	// Unparsable, so the 1K limit stays
+	os.WriteFile(path, []byte("[serve]\nmax-size = \"lots\"\n"), 0644)
+	proc.Signal(syscall.SIGHUP)
+	time.Sleep(200 * time.Millisecond)
+	if err := send(); !errors.Is(err, wire.ErrTooLarge) {
+		t.Errorf("after a bad reload: got %v, want ErrTooLarge", err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// openFileLimit is not known on this platform.
+func openFileLimit() (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/netsim"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/tcpft"
+	"socket-file-transfer/udpft"
+)
+
+// selftestFile is a file selftest sends.
+type selftestFile struct {
+	name string
+	size int64
+}
+
+// The files selftest sends over each protocol
+var selftestFiles = []selftestFile{
+	{"empty.bin", 0},
+	{"one-byte.bin", 1},
+	{"one-kb.bin", 1 << 10},
+	{"ten-mb.bin", 10 << 20},
+	{"ünïcødé-ñåmé.txt", 4 << 10},
+}
+
+// Sent over UDP with packets lost both ways
+const SELFTEST_LOSSY_SIZE = 1 << 20
+
+// selftestResult is one row of the selftest report.
+type selftestResult struct {
+	test, proto string
+	size        int64
+	duration    time.Duration
+	err         error
+	detail      string
+}
+
+func runSelftest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	var loss = fs.Float64("loss", 0.05, "Fraction of UDP packets the lossy run drops in each direction")
+	var keep = fs.Bool("keep", false, "Keep the temporary directory of sent and received files, and print its path")
+	parseFlags(fs, args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	printEnvironment()
+
+	dir, err := os.MkdirTemp("", "transfer-selftest")
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	if *keep {
+		fmt.Println(i18n.T("selftest.files_in", dir))
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	fmt.Println()
+
+	results := selftest(ctx, dir, *loss)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, i18n.T("selftest.header"))
+	failed := 0
+	for _, r := range results {
+		result := "PASS"
+		if r.err != nil {
+			result = "FAIL: " + r.err.Error()
+			failed++
+		} else if r.detail != "" {
+			result += " (" + r.detail + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t\n", r.test, r.proto, wire.FormatBytes(r.size), wire.FormatDuration(r.duration), result)
+	}
+	tw.Flush()
+
+	fmt.Println()
+	if failed > 0 {
+		fmt.Println(i18n.T("selftest.failed", failed, len(results)))
+		os.Exit(1)
+	}
+	fmt.Println(i18n.T("selftest.passed", len(results)))
+}
+
+// printEnvironment prints what a bug report about the network needs.
+func printEnvironment() {
+	fmt.Println(i18n.T("selftest.os", runtime.GOOS, runtime.GOARCH, runtime.Version()))
+	if name, mtu, err := defaultInterface(); err != nil {
+		fmt.Println(i18n.T("selftest.interface_unknown", err))
+	} else {
+		fmt.Println(i18n.T("selftest.interface", name, mtu))
+	}
+	if limit, ok := openFileLimit(); ok {
+		fmt.Println(i18n.T("selftest.file_limit", limit))
+	} else {
+		fmt.Println(i18n.T("selftest.file_limit_unknown"))
+	}
+}
+
+// defaultInterface returns the name and MTU of the interface the default
+// route goes out of.
+func defaultInterface() (string, int, error) {
+	// Connecting a UDP socket only picks a route, it sends nothing
+	conn, err := net.Dial("udp", "192.0.2.1:9")
+	if err != nil {
+		return "", 0, err
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", 0, err
+	}
+	for _, ifi := range ifaces {
+		addrs, _ := ifi.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(local) {
+				return ifi.Name, ifi.MTU, nil
+			}
+		}
+	}
+	return "", 0, fmt.Errorf("no interface has address %s", local)
+}
+
+// selftest runs servers on loopback ports, sends them each of
+// selftestFiles over TCP and UDP and a file over a lossy UDP path, and
+// checks what they stored.
+func selftest(ctx context.Context, dir string, loss float64) []selftestResult {
+	src := filepath.Join(dir, "send")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		return []selftestResult{{test: "create files", err: err}}
+	}
+	random := rand.New(rand.NewSource(1))
+	for _, f := range append(selftestFiles, selftestFile{"lossy.bin", SELFTEST_LOSSY_SIZE}) {
+		data := make([]byte, f.size)
+		random.Read(data)
+		if err := os.WriteFile(filepath.Join(src, f.name), data, 0644); err != nil {
+			return []selftestResult{{test: "create files", err: err}}
+		}
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	discard := func(wire.Event) {}
+	var results []selftestResult
+
+	// Each protocol stores into a directory of its own, so the same name
+	// sent over another can't pass for it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return append(results, selftestResult{test: "start server", proto: "TCP", err: err})
+	}
+	tcpServer := &tcpft.Server{UploadDir: filepath.Join(dir, "tcp")}
+	tcpServer.Logger, tcpServer.Progress = quiet, discard
+	go tcpServer.Serve(ctx, listener)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return append(results, selftestResult{test: "start server", proto: "UDP", err: err})
+	}
+	udpServer := &udpft.Server{UploadDir: filepath.Join(dir, "udp")}
+	udpServer.Logger, udpServer.Progress = quiet, discard
+	go udpServer.Serve(ctx, conn)
+
+	lossyConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return append(results, selftestResult{test: "start server", proto: "UDP", err: err})
+	}
+	lossyServer := &udpft.Server{UploadDir: filepath.Join(dir, "udp-lossy")}
+	lossyServer.Logger, lossyServer.Progress = quiet, discard
+	go lossyServer.Serve(ctx, netsim.WrapPacketConn(lossyConn, netsim.Config{Loss: loss, Seed: 1}))
+
+	for _, proto := range []string{"TCP", "UDP"} {
+		for _, f := range selftestFiles {
+			path := filepath.Join(src, f.name)
+			start := time.Now()
+			var err error
+			var root string
+			switch proto {
+			case "TCP":
+				var client tcpft.Client
+				_, err = client.SendFile(ctx, listener.Addr().String(), path, tcpft.Options{Logger: quiet, Progress: discard})
+				root = tcpServer.UploadDir
+			case "UDP":
+				var client udpft.Client
+				_, err = client.SendFile(ctx, conn.LocalAddr().String(), path, udpft.Options{Logger: quiet, Progress: discard})
+				root = udpServer.UploadDir
+			}
+			if err == nil {
+				err = sameContent(path, filepath.Join(root, wire.LocalName(root, f.name)))
+			}
+			results = append(results, selftestResult{test: f.name, proto: proto, size: f.size, duration: time.Since(start), err: err})
+		}
+	}
+
+	// Packets are dropped on the way there and back
+	path := filepath.Join(src, "lossy.bin")
+	client := udpft.Client{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return netsim.WrapConn(conn, netsim.Config{Loss: loss, Seed: 2}), nil
+	}}
+	start := time.Now()
+	res, err := client.SendFile(ctx, lossyConn.LocalAddr().String(), path, udpft.Options{Logger: quiet, Progress: discard})
+	r := selftestResult{test: fmt.Sprintf("%.0f%% loss", loss*100), proto: "UDP", size: SELFTEST_LOSSY_SIZE, err: err}
+	r.duration = time.Since(start)
+	if err == nil {
+		r.err = sameContent(path, filepath.Join(lossyServer.UploadDir, "lossy.bin"))
+		r.detail = fmt.Sprintf("%d retransmits", res.Retransmits)
+	}
+	return append(results, r)
+}
+
+// sameContent checks that the file stored at path matches the one sent
+// from sent.
+func sameContent(sent, stored string) error {
+	want, err := fileSum(sent)
+	if err != nil {
+		return err
+	}
+	got, err := fileSum(stored)
+	if err != nil {
+		return fmt.Errorf("stored file: %w", err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("stored file differs, SHA-256 %x instead of %x", got[:8], want[:8])
+	}
+	return nil
+}
+
+func fileSum(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Every file goes through both protocols, and the lossy run through UDP
+// with retransmits.
+func TestSelftest(t *testing.T) {
+	results := selftest(context.Background(), t.TempDir(), 0.05)
+	if want := 2*len(selftestFiles) + 1; len(results) != want {
+		t.Fatalf("%d results, want %d", len(results), want)
+	}
+	for _, r := range results {
+		if r.err != nil {
+			t.Errorf("%s over %s: %v", r.test, r.proto, r.err)
+		}
+	}
+	if lossy := results[len(results)-1]; lossy.detail == "" || lossy.detail == "0 retransmits" {
+		t.Errorf("lossy run reports %q, want its retransmits", lossy.detail)
+	}
+}
+
+// The subcommand prints the environment and a table, exiting 0 when
+// everything passes.
+func TestSelftestCommand(t *testing.T) {
+	out, code := run(t, "", nil, "selftest")
+	if code != 0 {
+		t.Fatalf("exit code %d, want 0:\n%s", code, out)
+	}
+	for _, want := range []string{"ten-mb.bin", "ünïcødé-ñåmé.txt", "5% loss", "PASS"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "FAIL") {
+		t.Errorf("output reports failures:\n%s", out)
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	sent := write("sent", "hello")
+	if err := sameContent(sent, write("same", "hello")); err != nil {
+		t.Errorf("same content: %v", err)
+	}
+	if err := sameContent(sent, write("other", "hellO")); err == nil {
+		t.Error("different content passed")
+	}
+	if err := sameContent(sent, filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file passed")
+	}
+}
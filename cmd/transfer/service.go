@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"socket-file-transfer/internal/i18n"
+)
+
+// serviceFlags are the serve flags that run it as a Windows service.
+type serviceFlags struct {
+	action *string
+	name   *string
+	dir    *string
+	log    *string
+}
+
+func addServiceFlags(fs *flag.FlagSet) *serviceFlags {
+	return &serviceFlags{
+		action: fs.String("service", "", "Manage the Windows service running serve with the other flags given: install, start, stop or uninstall"),
+		name:   fs.String("service-name", "transfer", "Name of the Windows service"),
+		dir:    fs.String("service-dir", "", "Directory the Windows service runs in, storing uploads there (default the directory -service=install ran in)"),
+		log:    fs.String("service-log", "transfer.log", "File the Windows service logs to, relative to -service-dir"),
+	}
+}
+
+// serviceArgs returns the serve arguments the service is installed with:
+// args without the flags that manage it, run in -service-dir and, as it
+// can't see TRANSFER_CONFIG, reading configPath.
+func (f *serviceFlags) serviceArgs(args []string, configPath string) ([]string, error) {
+	dir := *f.dir
+	if dir == "" {
+		dir = "."
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := []string{"serve", "-service-dir=" + dir, "-service-name=" + *f.name}
+	if configPath != "" {
+		if configPath, err = filepath.Abs(configPath); err != nil {
+			return nil, err
+		}
+		out = append(out, "-config="+configPath)
+	}
+	return append(out, withoutFlags(args, "service", "service-dir", "service-name", "config")...), nil
+}
+
+// withoutFlags returns args without the flags named, given as -name=value,
+// -name value or with two dashes. The flags must not be boolean.
+func withoutFlags(args []string, names ...string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			return append(out, args[i:]...)
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		drop := false
+		for _, n := range names {
+			drop = drop || name == n
+		}
+		switch {
+		case !drop:
+			out = append(out, arg)
+		case !hasValue:
+			i++ // Skip the value too
+		}
+	}
+	return out
+}
+
+// control carries out -service, returning what to print once done.
+func (f *serviceFlags) control(args []string, configPath string) (string, error) {
+	switch *f.action {
+	case "install":
+		serveArgs, err := f.serviceArgs(args, configPath)
+		if err != nil {
+			return "", err
+		}
+		if err := installService(*f.name, serveArgs); err != nil {
+			return "", err
+		}
+		return i18n.T("service.installed", *f.name), nil
+	case "start":
+		return i18n.T("service.started", *f.name), startService(*f.name)
+	case "stop":
+		return i18n.T("service.stopped", *f.name), stopService(*f.name)
+	case "uninstall":
+		return i18n.T("service.uninstalled", *f.name), uninstallService(*f.name)
+	}
+	return "", fmt.Errorf("unknown -service action %q, want install, start, stop or uninstall", *f.action)
+}
+
+// openServiceLog opens the file a service logs to, in place of the
+// console it doesn't have.
+func (f *serviceFlags) openServiceLog() (*os.File, error) {
+	return os.OpenFile(*f.log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
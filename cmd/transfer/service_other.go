@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errNoService = errors.New("-service is only supported on Windows; use systemd or another service manager here")
+
+func installService(name string, args []string) error { return errNoService }
+func startService(name string) error                  { return errNoService }
+func stopService(name string) error                   { return errNoService }
+func uninstallService(name string) error              { return errNoService }
+
+// startAsService returns ctx and a no-op, as only Windows has services
+// to run as.
+func (f *serviceFlags) startAsService(ctx context.Context) (context.Context, func(), error) {
+	return ctx, func() {}, nil
+}
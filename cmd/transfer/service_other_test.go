@@ -0,0 +1,46 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// -service tells what to use instead where there are no Windows services.
+func TestServiceNotSupported(t *testing.T) {
+	for _, action := range []string{"install", "start", "stop", "uninstall"} {
+		t.Run(action, func(t *testing.T) {
+			out, code := run(t, "", nil, "serve", "-service="+action)
+			if code != 1 {
+				t.Errorf("exit code %d, want 1", code)
+			}
+			if !strings.Contains(out, "only supported on Windows") {
+				t.Errorf("output %q lacks the reason", out)
+			}
+		})
+	}
+}
+
+// Run from a console, serve shuts down on SIGTERM along the path a service
+// stop takes, and exits cleanly.
+func TestServeShutdown(t *testing.T) {
+	_, proc := startServe(t, nil)
+	proc.Signal(syscall.SIGTERM)
+	exited := make(chan *os.ProcessState, 1)
+	go func() {
+		state, _ := proc.Wait()
+		exited <- state
+	}()
+	select {
+	case state := <-exited:
+		if state == nil || !state.Success() {
+			t.Errorf("serve exited with %v, want success", state)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve still running 5 seconds after SIGTERM")
+	}
+}
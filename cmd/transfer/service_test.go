@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWithoutFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"none given", []string{"-proto=udp", "-max-size", "1G"}, []string{"-proto=udp", "-max-size", "1G"}},
+		{"with equals", []string{"-service=install", "-proto=udp"}, []string{"-proto=udp"}},
+		{"value apart", []string{"-service", "install", "-proto", "udp"}, []string{"-proto", "udp"}},
+		{"two dashes", []string{"--service-dir=C:\\data", "--proto=tcp"}, []string{"--proto=tcp"}},
+		{"after the flags", []string{"-service=install", "--", "-service"}, []string{"--", "-service"}},
+		{"positional", []string{"-proto=tcp", "file", "-service=x"}, []string{"-proto=tcp", "file", "-service=x"}},
+		{"same prefix", []string{"-service-log=a.log", "-service-name=s"}, []string{"-service-log=a.log"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withoutFlags(tt.args, "service", "service-dir", "service-name")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// The service is installed with the flags given but those managing it, in
+// an absolute -service-dir and reading an absolute -config.
+func TestServiceArgs(t *testing.T) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	f := addServiceFlags(fs)
+	args := []string{"-service=install", "-service-name=files", "-config", "serve.conf", "-proto=both", "-max-size=1G"}
+	if err := fs.Parse(args[:2]); err != nil {
+		t.Fatal(err)
+	}
+	got, err := f.serviceArgs(args, "serve.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, _ := filepath.Abs(".")
+	config, _ := filepath.Abs("serve.conf")
+	want := []string{"serve", "-service-dir=" + dir, "-service-name=files", "-config=" + config, "-proto=both", "-max-size=1G"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// An unknown action is refused before anything is installed.
+func TestServiceUnknownAction(t *testing.T) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	f := addServiceFlags(fs)
+	if err := fs.Parse([]string{"-service=restart"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.control(nil, ""); err == nil {
+		t.Error("unknown action accepted")
+	}
+}
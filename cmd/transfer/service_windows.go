@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/wire"
+)
+
+// How long stopService waits for the service to stop
+const SERVICE_STOP_TIMEOUT = time.Minute
+
+// How long the service manager waits before restarting a crashed service
+const SERVICE_RESTART_DELAY = 5 * time.Second
+
+// installService installs the service name, running serve with args when
+// Windows starts and restarted by the service manager if it crashes.
+func installService(name string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("error connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "File transfer server (" + name + ")",
+		Description: "Receives files over TCP, UDP and QUIC",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("error installing the %s service: %w", name, err)
+	}
+	defer s.Close()
+
+	// Restart it after a crash, and start counting crashes afresh after a day
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: SERVICE_RESTART_DELAY}
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, uint32((24 * time.Hour).Seconds())); err != nil {
+		s.Delete()
+		return fmt.Errorf("error setting up the restart of the %s service: %w", name, err)
+	}
+	return nil
+}
+
+func startService(name string) error {
+	return withService(name, func(s *mgr.Service) error {
+		return s.Start()
+	})
+}
+
+// stopService asks the service to stop and waits until it did.
+func stopService(name string) error {
+	return withService(name, func(s *mgr.Service) error {
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return err
+		}
+		deadline := time.Now().Add(SERVICE_STOP_TIMEOUT)
+		for status.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return errors.New("timed out waiting for it to stop")
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func uninstallService(name string) error {
+	return withService(name, func(s *mgr.Service) error {
+		return s.Delete()
+	})
+}
+
+// withService calls do with the service name.
+func withService(name string, do func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("error connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("error opening the %s service: %w", name, err)
+	}
+	defer s.Close()
+	if err := do(s); err != nil {
+		return fmt.Errorf("%s service: %w", name, err)
+	}
+	return nil
+}
+
+// startAsService, if the service manager started the process, moves to
+// -service-dir, sends the output to -service-log, and returns a context
+// that ends when the service manager stops the service. The function it
+// returns reports the service stopped once serve shut down. Run from a
+// console, it returns ctx and a no-op.
+func (f *serviceFlags) startAsService(ctx context.Context) (context.Context, func(), error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return ctx, func() {}, err
+	}
+	if *f.dir != "" {
+		if err := os.Chdir(*f.dir); err != nil {
+			return nil, nil, err
+		}
+	}
+	log, err := f.openServiceLog()
+	if err != nil {
+		return nil, nil, err
+	}
+	os.Stdout, os.Stderr = log, log
+	wire.DefaultLogger = wire.NewConsoleLogger(log)
+
+	ctx, cancel := context.WithCancel(ctx)
+	h := &serviceHandler{stop: cancel, done: make(chan struct{})}
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		if err := svc.Run(*f.name, h); err != nil {
+			fmt.Println(i18n.T("error", err))
+		}
+		cancel()
+	}()
+	return ctx, func() {
+		close(h.done)
+		<-exited
+	}, nil
+}
+
+// serviceHandler answers the service manager.
+type serviceHandler struct {
+	stop func()        // Shuts serve down
+	done chan struct{} // Closed once it did
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				h.stop()
+			}
+		case <-h.done:
+			return false, 0
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// A stop from the service manager shuts serve down as Ctrl-C does, and
+// the service is reported stopped only once serve has.
+func TestServiceHandler(t *testing.T) {
+	stopped := make(chan struct{})
+	h := &serviceHandler{stop: func() { close(stopped) }, done: make(chan struct{})}
+	requests := make(chan svc.ChangeRequest)
+	status := make(chan svc.Status, 4)
+	returned := make(chan uint32, 1)
+	go func() {
+		_, code := h.Execute(nil, requests, status)
+		returned <- code
+	}()
+
+	if s := <-status; s.State != svc.Running || s.Accepts&svc.AcceptStop == 0 {
+		t.Errorf("first status %+v, want running and accepting stop", s)
+	}
+	requests <- svc.ChangeRequest{Cmd: svc.Stop}
+	if s := <-status; s.State != svc.StopPending {
+		t.Errorf("status %+v after a stop, want stop pending", s.State)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("serve not told to stop")
+	}
+	select {
+	case <-returned:
+		t.Fatal("reported stopped before serve shut down")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(h.done)
+	if code := <-returned; code != 0 {
+		t.Errorf("exit code %d, want 0", code)
+	}
+}
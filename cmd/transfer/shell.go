@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/tcpft"
+)
+
+// A command line the shell doesn't understand
+var errUsage = errors.New("see help")
+
+// runShell is transfer shell: it reads commands from stdin and runs them
+// over one TCP session, which reconnects by itself when it drops.
+// Ctrl-C aborts the command under way, or leaves the shell at the prompt.
+func runShell(args []string) {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	var addr = fs.String("addr", "localhost"+wire.TCP_PORT, "TCP server address")
+	var unixSocket = fs.String("unix", "", "Connect to the server's unix socket at this path instead of -addr")
+	var wsURL = fs.String("ws", "", "Tunnel to the server over WebSocket at this URL, e.g. wss://host/ws, instead of -addr")
+	var proxyFlag = fs.String("proxy", "", "Reach the server through this proxy, socks5://[user:pass@]host:port or http://[user:pass@]host:port (default ALL_PROXY unless NO_PROXY exempts the server; 'direct' ignores them)")
+	var bufferFlag = fs.String("buffer", "256K", "TCP read and write buffer size, with an optional K, M or G suffix")
+	var authToken = fs.String("auth-token", "", "Token telling a server split among tenants which one this is")
+	parseFlags(fs, args)
+
+	// Errors are printed as commands fail, so the log would only repeat them
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	opts := tcpft.Options{BufferSize: mustParseBuffer(*bufferFlag), Logger: quiet, AuthToken: *authToken}
+
+	client := tcpft.Client{UnixSocket: *unixSocket, WebSocket: *wsURL}
+	if tunnel := tunnelAddr("tcp", "", *unixSocket, *wsURL); tunnel != "" {
+		*addr = tunnel
+	} else {
+		client.Proxy = proxyFor(*proxyFlag, *addr)
+	}
+	sess, err := client.OpenSession(context.Background(), *addr, opts)
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(exitCode(err))
+	}
+	defer sess.Close()
+
+	fmt.Println(i18n.T("shell.connected", *addr))
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("> ")
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		words, err := splitArgs(in.Text())
+		if err != nil {
+			fmt.Println(i18n.T("error", err))
+			continue
+		}
+		if len(words) == 0 {
+			continue
+		}
+		cmd, args := words[0], words[1:]
+		switch cmd {
+		case "help":
+			fmt.Println(i18n.T("shell.help"))
+			continue
+		case "quit", "exit":
+			return
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err = runShellCommand(ctx, sess, cmd, args)
+		stop()
+		if err != nil {
+			fmt.Println(i18n.T("error", err))
+		}
+	}
+}
+
+func runShellCommand(ctx context.Context, sess *tcpft.Session, cmd string, args []string) error {
+	switch {
+	case cmd == "ls" && len(args) == 0:
+		infos, err := sess.List(ctx)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			fmt.Printf("%12d  %s  %s\n", info.Size, info.ModTime.Format(time.DateTime), info.Name)
+		}
+		fmt.Println(i18n.T("shell.files", len(infos)))
+	case cmd == "stat" && len(args) == 1:
+		info, err := sess.Stat(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(i18n.T("shell.stat", info.Name, info.Size, wire.FormatBytes(info.Size), info.ModTime.Format(time.DateTime)))
+	case cmd == "put" && (len(args) == 1 || len(args) == 2):
+		name := ""
+		if len(args) == 2 {
+			name = args[1]
+		}
+		res, err := sess.Put(ctx, args[0], name)
+		if err != nil {
+			return err
+		}
+		wire.PrintSummary(res.Bytes, res.Duration)
+	case cmd == "get" && (len(args) == 1 || len(args) == 2):
+		local := args[0]
+		if len(args) == 2 {
+			local = args[1]
+		}
+		res, err := sess.Get(ctx, args[0], local)
+		if err != nil {
+			return err
+		}
+		wire.PrintSummary(res.Bytes, res.Duration)
+	case cmd == "rm" && len(args) == 1:
+		return sess.Remove(ctx, args[0])
+	case cmd == "ls", cmd == "stat", cmd == "put", cmd == "get", cmd == "rm":
+		return fmt.Errorf("wrong arguments to %s, %w", cmd, errUsage)
+	default:
+		return fmt.Errorf("unknown command %q, %w", cmd, errUsage)
+	}
+	return nil
+}
+
+// splitArgs splits a command line at spaces outside double quotes.
+func splitArgs(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord, quoted := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inWord = true
+		case r == ' ' || r == '\t':
+			if quoted {
+				word.WriteRune(r)
+			} else if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unclosed quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
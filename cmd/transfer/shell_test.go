@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"socket-file-transfer/tcpft"
+)
+
+// TestShell runs each command of a script through the shell.
+func TestShell(t *testing.T) {
+	s := &tcpft.Server{AllowDelete: true}
+	addr := serveTCP(t, s)
+	dir := t.TempDir()
+	local := filepath.Join(dir, "my file.txt")
+	os.WriteFile(local, []byte("hello shell"), 0644)
+	fetched := filepath.Join(dir, "fetched.txt")
+
+	script := strings.Join([]string{
+		`put "` + local + `"`,
+		`put "` + local + `" copy.txt`,
+		`ls`,
+		`stat copy.txt`,
+		`get copy.txt "` + fetched + `"`,
+		`rm copy.txt`,
+		`stat copy.txt`,
+		`stat ../x`,
+		`frobnicate`,
+		`rm`,
+		`quit`,
+	}, "\n")
+	out, code := run(t, script, nil, "shell", "-addr="+addr)
+	if code != 0 {
+		t.Fatalf("shell exited %d:\n%s", code, out)
+	}
+	for _, want := range []string{
+		"Connected to " + addr,
+		"my file.txt",
+		"2 files",
+		"copy.txt: 11 bytes",
+		"file not found",
+		"invalid filename",
+		`unknown command "frobnicate"`,
+		"wrong arguments to rm",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if got, _ := os.ReadFile(fetched); string(got) != "hello shell" {
+		t.Errorf("get fetched %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(s.UploadDir, "copy.txt")); err == nil {
+		t.Error("rm left copy.txt stored")
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"  ls  ", []string{"ls"}},
+		{"put a b", []string{"put", "a", "b"}},
+		{"put\t\"my file\" b", []string{"put", "my file", "b"}},
+		{`get "" x`, []string{"get", "", "x"}},
+		{`rm a"b c"d`, []string{"rm", "ab cd"}},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.line)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q, %v, want %q", tt.line, got, err, tt.want)
+		}
+	}
+	if _, err := splitArgs(`put "open`); err == nil {
+		t.Error("unclosed quote accepted")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/netsim"
+)
+
+// simFlags are the -sim flags of serve and send, which impair what they
+// send through internal/netsim, to watch the protocols cope with a bad
+// network.
+type simFlags struct {
+	loss    float64
+	dup     *float64
+	reorder *float64
+	delay   *time.Duration
+	seed    *int64
+}
+
+func addSimFlags(fs *flag.FlagSet) *simFlags {
+	f := &simFlags{
+		dup:     fs.Float64("sim-dup", 0, "Simulate a bad network: send this fraction of outgoing packets twice"),
+		reorder: fs.Float64("sim-reorder", 0, "Simulate a bad network: hold this fraction of outgoing packets back 10ms, out of order"),
+		delay:   fs.Duration("sim-delay", 0, "Simulate a bad network: add this much latency to outgoing packets"),
+		seed:    fs.Int64("sim-seed", 1, "Seed of the -sim flags' random choices, so a run can be repeated"),
+	}
+	fs.Float64Var(&f.loss, "sim-loss", 0, "Simulate a bad network: drop this fraction of outgoing packets")
+	fs.Float64Var(&f.loss, "simulate-loss", 0, "Old name of -sim-loss")
+	return f
+}
+
+// config returns the impairments the flags ask for.
+func (f *simFlags) config() (netsim.Config, error) {
+	c := netsim.Config{Loss: f.loss, Duplicate: *f.dup, Reorder: *f.reorder, Latency: *f.delay, Seed: *f.seed}
+	for _, p := range []struct {
+		name string
+		v    float64
+	}{{"-sim-loss", c.Loss}, {"-sim-dup", c.Duplicate}, {"-sim-reorder", c.Reorder}} {
+		if p.v < 0 || p.v >= 1 {
+			return c, fmt.Errorf("%s must be at least 0 and below 1, not %g", p.name, p.v)
+		}
+	}
+	if c.Latency < 0 {
+		return c, fmt.Errorf("-sim-delay must not be negative, not %s", c.Latency)
+	}
+	return c, nil
+}
+
+// simulator impairs connections per cfg, each with a seed of its own
+// drawn in turn from cfg's, summing up what it did to those it tracks.
+type simulator struct {
+	cfg   netsim.Config
+	track bool // Keep the connections for Stats, as a client does
+
+	mu      sync.Mutex
+	conns   int64
+	tracked []interface{ Stats() netsim.Stats }
+}
+
+// keep tracks conn if s tracks connections. Must hold s.mu.
+func (s *simulator) keep(conn interface{ Stats() netsim.Stats }) {
+	if s.track {
+		s.tracked = append(s.tracked, conn)
+	}
+}
+
+// seeded returns the config for the next connection. Must hold s.mu.
+func (s *simulator) seeded() netsim.Config {
+	c := s.cfg
+	c.Seed += s.conns
+	s.conns++
+	return c
+}
+
+// stream impairs a stream connection, such as TCP, see netsim.Stream.
+func (s *simulator) stream(conn net.Conn) net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := netsim.WrapStream(conn, s.seeded())
+	s.keep(w)
+	return w
+}
+
+// datagram impairs a connected datagram socket.
+func (s *simulator) datagram(conn net.Conn) net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := netsim.WrapConn(conn, s.seeded())
+	s.keep(w)
+	return w
+}
+
+// packetConn impairs an unconnected datagram socket.
+func (s *simulator) packetConn(conn net.PacketConn) net.PacketConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := netsim.WrapPacketConn(conn, s.seeded())
+	s.keep(w)
+	return w
+}
+
+// Stats returns what was done to the tracked connections, together.
+func (s *simulator) Stats() netsim.Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total netsim.Stats
+	for _, conn := range s.tracked {
+		total = total.Add(conn.Stats())
+	}
+	return total
+}
+
+// printSimulated prints the summary key of what was done to a transfer's
+// packets, or segments, under cfg, so its figures aren't taken for a real
+// network's.
+func printSimulated(key string, cfg netsim.Config, stats netsim.Stats) {
+	fmt.Println(i18n.T(key, stats.Dropped, stats.Sent, stats.Duplicated, stats.Reordered, cfg.Latency, cfg.Seed))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSimFlagsInvalid(t *testing.T) {
+	for _, flag := range []string{"-sim-loss=1", "-sim-dup=-0.1", "-sim-reorder=1.5", "-sim-delay=-1s"} {
+		out, code := run(t, "", nil, "send", flag, "-addr=127.0.0.1:1", "-file="+os.Args[0])
+		if code != 1 || !strings.Contains(out, strings.SplitN(flag, "=", 2)[0]) {
+			t.Errorf("send %s: exit code %d, want 1 and the flag named:\n%s", flag, code, out)
+		}
+	}
+	if out, code := run(t, "", nil, "send", "-proto=quic", "-sim-loss=0.1", "-addr=127.0.0.1:1", "-file="+os.Args[0]); code != 1 || !strings.Contains(out, "not QUIC") {
+		t.Errorf("send -proto=quic -sim-loss: exit code %d, want 1:\n%s", code, out)
+	}
+}
+
+// Sends over an impaired network on either side still store the file
+// intact, and say that the network was simulated, the same way for the
+// same seed.
+func TestSendSimulated(t *testing.T) {
+	dir, addrs := serveListening(t, 2, "-proto=both", "-port=0", "-sim-loss=0.05", "-sim-seed=3")
+	data := make([]byte, 256<<10)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), "data.bin")
+	os.WriteFile(path, data, 0644)
+
+	tests := []struct {
+		proto   string
+		args    []string
+		summary *regexp.Regexp
+	}{
+		{"udp", []string{"-sim-loss=0.1", "-sim-dup=0.05", "-sim-reorder=0.05", "-sim-delay=2ms"}, regexp.MustCompile(`Simulated network: dropped \d+ of \d+ packets, duplicated \d+, reordered \d+, latency 2ms \(seed 7\)`)},
+		{"tcp", []string{"-sim-loss=0.1", "-sim-delay=1ms"}, regexp.MustCompile(`Simulated network: lost (\d+) of (\d+) segments, duplicated 0, reordered 0, latency 1ms \(seed 7\)`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proto, func(t *testing.T) {
+			var summaries []string
+			for i := 0; i < 2; i++ {
+				name := fmt.Sprint(tt.proto, i, ".bin")
+				args := append([]string{"send", "-proto=" + tt.proto, "-addr=" + addrs[tt.proto], "-file=" + path, "-name=" + name, "-sim-seed=7"}, tt.args...)
+				out, code := run(t, "", nil, args...)
+				if code != 0 {
+					t.Fatalf("exit code %d:\n%s", code, out)
+				}
+				summary := tt.summary.FindString(out)
+				if summary == "" {
+					t.Fatalf("output lacks the simulated network's summary:\n%s", out)
+				}
+				summaries = append(summaries, summary)
+				if got, _ := os.ReadFile(filepath.Join(dir, "uploads", name)); !bytes.Equal(got, data) {
+					t.Errorf("stored %d bytes, want the %d sent", len(got), len(data))
+				}
+			}
+			// A stream's segments don't depend on timing, so its
+			// summary repeats exactly
+			if tt.proto == "tcp" && summaries[0] != summaries[1] {
+				t.Errorf("same seed, summaries %q and %q", summaries[0], summaries[1])
+			}
+		})
+	}
+}
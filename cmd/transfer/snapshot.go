@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"socket-file-transfer/internal/archive"
+	"socket-file-transfer/internal/pathfilter"
+)
+
+// snapshotFile copies the file at path to a temporary file and returns the
+// copy's path, so a file still being written can be sent as it was when
+// copied. The caller removes the copy.
+func snapshotFile(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error opening file: %w", err)
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp("", ".transfer-snapshot-*")
+	if err != nil {
+		return "", fmt.Errorf("error creating snapshot: %w", err)
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", fmt.Errorf("error creating snapshot: %w", err)
+	}
+	return dst.Name(), nil
+}
+
+// archiveDir writes the directory at path to a temporary tar archive,
+// gzipped if gz, and returns its path and how many files it holds. The
+// archive is spooled to disk as the file header announces its size up
+// front. The caller removes it.
+func archiveDir(path string, gz bool, filter *pathfilter.Filter) (string, int, error) {
+	dst, err := os.CreateTemp("", ".transfer-archive-*")
+	if err != nil {
+		return "", 0, fmt.Errorf("error creating archive: %w", err)
+	}
+	files, err := archive.Write(dst, path, gz, filter)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", 0, err
+	}
+	return dst.Name(), files, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A snapshot keeps the content the file had, whatever happens to it next.
+func TestSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	if err := os.WriteFile(path, []byte("first lines\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := snapshotFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(snap)
+	if err := os.WriteFile(path, []byte("rotated\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(snap)
+	if err != nil || string(got) != "first lines\n" {
+		t.Errorf("snapshot holds %q (%v), want the original content", got, err)
+	}
+
+	if _, err := snapshotFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("snapshot of a missing file succeeded")
+	}
+}
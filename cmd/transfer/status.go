@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"socket-file-transfer/internal/transfers"
+	"socket-file-transfer/internal/wire"
+)
+
+const (
+	// How often serve logs the status of each upload by default
+	DefaultStatusInterval = 10 * time.Second
+
+	// How long serve waits for data before aborting an upload by default
+	DefaultStallTimeout = 30 * time.Second
+)
+
+// transferStatus logs a line for each transfer in registry every
+// interval, in place of the console progress line, which concurrent
+// transfers garble.
+type transferStatus struct {
+	registry *transfers.Registry
+	logged   map[uint64]int64 // Bytes at the last status line, by transfer ID
+}
+
+func newTransferStatus(registry *transfers.Registry) *transferStatus {
+	return &transferStatus{registry: registry, logged: make(map[uint64]int64)}
+}
+
+// run logs the status lines every interval until ctx ends.
+func (t *transferStatus) run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		logged := make(map[uint64]int64)
+		for _, tr := range t.registry.List() {
+			percent := 100.0
+			if tr.Total > 0 {
+				percent = float64(tr.Bytes) / float64(tr.Total) * 100
+			}
+			rate := wire.FormatRate(tr.Bytes-t.logged[tr.ID], interval)
+			wire.DefaultLogger.Info("Transfer status", "remote", tr.Remote, "name", tr.Name, "bytes", tr.Bytes, "total", tr.Total, "percent", int(percent), "rate", rate)
+			logged[tr.ID] = tr.Bytes
+		}
+		t.logged = logged
+	}
+}
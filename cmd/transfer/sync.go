@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/manifest"
+	"socket-file-transfer/internal/schedule"
+	"socket-file-transfer/internal/watch"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/tcpft"
+	"socket-file-transfer/udpft"
+)
+
+// runSync is transfer sync: it offers every file in a directory to the
+// server, which takes only those it doesn't hold an identical copy of.
+// Stored names can't contain a slash, so subdirectories are not synced.
+// Symlinks are skipped unless -follow-symlinks, which sends the file a
+// link points to under the link's name; the link's target is never sent.
+// With -manifest a SHA256SUMS of the files sent follows them, which the
+// server checks its copies against. -include, -exclude and -exclude-from
+// pick the files by name, see filterFlags. A server out of disk space
+// holds the sync up until it has room, as it does -watch, unless
+// -fail-fast, which stops it. Files are offered in the order -order and
+// -priority-glob give, see queueFlags.
+func runSync(args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	var proto = fs.String("proto", "tcp", "Protocol: 'tcp' or 'udp'")
+	var addr = fs.String("addr", "", "Server address (default localhost:8080 for TCP, localhost:8081 for UDP)")
+	var unixSocket = fs.String("unix", "", "Connect to the TCP server's unix socket at this path instead of -addr")
+	var wsURL = fs.String("ws", "", "Tunnel to the TCP server over WebSocket at this URL, e.g. wss://host/ws, instead of -addr")
+	var proxyFlag = fs.String("proxy", "", "Reach the TCP server through this proxy, socks5://[user:pass@]host:port or http://[user:pass@]host:port (default ALL_PROXY unless NO_PROXY exempts the server; 'direct' ignores them)")
+	var dir = fs.String("dir", "", "Directory whose files to sync")
+	var followSymlinks = fs.Bool("follow-symlinks", false, "Sync the files symlinks point to instead of skipping the symlinks")
+	var withManifest = fs.Bool("manifest", false, "Finish by sending a "+manifest.NAME+" of the files sent, which the server checks its copies against and keeps")
+	var dryRun = fs.Bool("n", false, "Print the files that would be offered without connecting")
+	var legacy = fs.Bool("legacy", false, "Talk to a server that predates protocol version negotiation")
+	var bufferFlag = fs.String("buffer", "256K", "TCP read and write buffer size, with an optional K, M or G suffix")
+	var failFast = fs.Bool("fail-fast", false, "Stop once the server is out of disk space instead of waiting for room")
+	var authToken = fs.String("auth-token", "", "Token telling a server split among tenants which one this is (TCP only)")
+	var filterFlag = filterFlags(fs)
+	var queueFlag = queueFlags(fs)
+	parseFlags(fs, args)
+	filter := filterFlag()
+	queue := queueFlag()
+
+	if *dir == "" {
+		fmt.Println(i18n.T("sync.requires_dir"))
+		fmt.Println(i18n.T("sync.usage"))
+		os.Exit(1)
+	}
+	bufferSize := mustParseBuffer(*bufferFlag)
+	*addr = tunnelAddr(*proto, *addr, *unixSocket, *wsURL)
+
+	var send func(ctx context.Context, path string) (skipped bool, sum []byte, err error)
+	var upload func(ctx context.Context, name string, data []byte) error
+	switch *proto {
+	case "tcp":
+		if *addr == "" {
+			*addr = "localhost" + wire.TCP_PORT
+		}
+		client := tcpft.Client{UnixSocket: *unixSocket, WebSocket: *wsURL}
+		if *unixSocket == "" && *wsURL == "" {
+			client.Proxy = proxyFor(*proxyFlag, *addr)
+		}
+		opts := tcpft.Options{BufferSize: bufferSize, SkipIdentical: true, Legacy: *legacy, AuthToken: *authToken}
+		send = func(ctx context.Context, path string) (bool, []byte, error) {
+			res, err := client.SendFile(ctx, *addr, path, opts)
+			if err != nil {
+				return false, nil, err
+			}
+			return res.Skipped, res.Checksum, nil
+		}
+		upload = func(ctx context.Context, name string, data []byte) error {
+			_, err := client.Send(ctx, *addr, name, bytes.NewReader(data), int64(len(data)), opts)
+			return err
+		}
+	case "udp":
+		if *proxyFlag != "" {
+			fmt.Println(i18n.T("sync.proxy_tcp_only"))
+			os.Exit(1)
+		}
+		if *addr == "" {
+			*addr = "localhost" + wire.UDP_PORT
+		}
+		var client udpft.Client
+		opts := udpft.Options{SkipIdentical: true, Legacy: *legacy}
+		send = func(ctx context.Context, path string) (bool, []byte, error) {
+			res, err := client.SendFile(ctx, *addr, path, opts)
+			if err != nil {
+				return false, nil, err
+			}
+			return res.Skipped, res.Checksum, nil
+		}
+		upload = func(ctx context.Context, name string, data []byte) error {
+			_, err := client.Send(ctx, *addr, name, bytes.NewReader(data), int64(len(data)), opts)
+			return err
+		}
+	default:
+		fmt.Println(i18n.T("unknown_protocol", *proto))
+		os.Exit(1)
+	}
+
+	entries, err := os.ReadDir(*dir)
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var offered, uploaded, skipped, failed int
+	var sent []manifest.Entry
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || *withManifest && name == manifest.NAME {
+			continue
+		}
+		if keep, reason := filter.Keep(name, e.IsDir()); !keep {
+			if e.IsDir() {
+				name += "/"
+			}
+			fmt.Println(i18n.T("sync.skipped", name, reason))
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // Removed since ReadDir
+		}
+		mode := info.Mode()
+		if mode&os.ModeSymlink != 0 {
+			if !*followSymlinks {
+				fmt.Println(i18n.T("sync.skipped_symlink", name))
+				continue
+			}
+			// Stat fails with "too many levels of symbolic links" on a loop
+			info, err = os.Stat(filepath.Join(*dir, name))
+			if err != nil {
+				fmt.Printf("%s: %v\n", name, err)
+				failed++
+				continue
+			}
+			mode = info.Mode()
+		}
+		if mode.IsDir() {
+			fmt.Println(i18n.T("sync.skipped_subdirectory", name))
+			continue
+		}
+		if !mode.IsRegular() {
+			continue
+		}
+		if err := wire.CheckName(name); err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			failed++
+			continue
+		}
+		queue.Push(schedule.Item{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+	}
+
+	// Files go in the order -order and -priority-glob ask for
+	for {
+		it, ok := queue.Pop()
+		if !ok {
+			break
+		}
+		name := it.Name
+		if *dryRun {
+			fmt.Println(i18n.T("sync.would_offer", name, wire.FormatBytes(it.Size)))
+			offered++
+			continue
+		}
+
+		path := filepath.Join(*dir, name)
+		start := time.Now()
+		wasSkipped, sum, err := send(ctx, path)
+		if errors.Is(err, wire.ErrNoSpace) && !*failFast {
+			// The file probes the server until it has room again
+			since, delay := time.Now(), watch.FULL_DELAY
+			fmt.Println(i18n.T("sync.destination_full", name, err))
+			for errors.Is(err, wire.ErrNoSpace) {
+				fmt.Println(i18n.T("sync.retrying", name, delay))
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					os.Exit(EXIT_INTERRUPTED)
+				}
+				wasSkipped, sum, err = send(ctx, path)
+				delay = min(delay*2, watch.MAX_FULL_DELAY)
+			}
+			if err == nil {
+				fmt.Println(i18n.T("sync.room_again", wire.FormatDuration(time.Since(since))))
+			}
+		}
+		if err == nil {
+			sent = append(sent, manifest.Entry{Path: name, Sum: sum})
+		}
+		switch {
+		case err != nil:
+			fmt.Println(i18n.T("sync.failed", name, err))
+			failed++
+			if ctx.Err() != nil {
+				os.Exit(EXIT_INTERRUPTED)
+			}
+			if errors.Is(err, wire.ErrNoSpace) {
+				fmt.Println(i18n.T("sync.stopped_full", uploaded, skipped))
+				os.Exit(EXIT_NO_SPACE)
+			}
+		case wasSkipped:
+			fmt.Println(i18n.T("sync.skipped_identical", name))
+			skipped++
+		default:
+			fmt.Println(i18n.T("sync.uploaded", name, wire.FormatBytes(it.Size), wire.FormatDuration(time.Since(start))))
+			uploaded++
+		}
+	}
+
+	// Files that failed are left out, the server may hold an older copy
+	if *withManifest && !*dryRun {
+		var buf bytes.Buffer
+		manifest.Write(&buf, sent)
+		if err := upload(ctx, manifest.NAME, buf.Bytes()); err != nil {
+			fmt.Println(i18n.T("sync.failed", manifest.NAME, err))
+			failed++
+			if ctx.Err() != nil {
+				os.Exit(EXIT_INTERRUPTED)
+			}
+		} else {
+			fmt.Println(i18n.T("sync.verified", manifest.NAME, len(sent)))
+		}
+	}
+
+	if *dryRun {
+		fmt.Println(i18n.T("sync.dry_run_summary", offered, failed))
+	} else {
+		fmt.Println(i18n.T("sync.summary", uploaded, skipped, failed))
+	}
+	if failed > 0 {
+		os.Exit(EXIT_FAILURE)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"socket-file-transfer/tcpft"
+)
+
+// syncDir returns a directory holding files, with a subdirectory and a
+// dot-file sync leaves alone.
+func syncDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, ".hidden"), []byte("h"), 0644)
+	return dir
+}
+
+func TestSync(t *testing.T) {
+	s := &tcpft.Server{}
+	addr := serveTCP(t, s)
+	dir := syncDir(t, map[string]string{"a.txt": "a", "b.txt": "bb"})
+
+	out, code := run(t, "", nil, "sync", "-dir="+dir, "-addr="+addr)
+	if code != 0 || !strings.Contains(out, "2 uploaded, 0 skipped, 0 failed") {
+		t.Fatalf("first sync exited %d:\n%s", code, out)
+	}
+	if !strings.Contains(out, "sub/: skipped") || strings.Contains(out, ".hidden") {
+		t.Errorf("subdirectory or dot-file not skipped:\n%s", out)
+	}
+	for name, want := range map[string]string{"a.txt": "a", "b.txt": "bb"} {
+		if got, err := os.ReadFile(filepath.Join(s.UploadDir, name)); string(got) != want {
+			t.Errorf("stored %s = %q, %v, want %q", name, got, err, want)
+		}
+	}
+
+	// Only the changed file goes again
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("changed"), 0644)
+	out, code = run(t, "", nil, "sync", "-dir="+dir, "-addr="+addr)
+	if code != 0 || !strings.Contains(out, "1 uploaded, 1 skipped, 0 failed") || !strings.Contains(out, "a.txt: skipped (identical)") {
+		t.Fatalf("second sync exited %d:\n%s", code, out)
+	}
+	if got, _ := os.ReadFile(filepath.Join(s.UploadDir, "b.txt")); string(got) != "changed" {
+		t.Errorf("stored b.txt = %q after the change", got)
+	}
+}
+
+// -n prints the plan without connecting.
+func TestSyncDryRun(t *testing.T) {
+	dir := syncDir(t, map[string]string{"a.txt": "a", "b.txt": "bb"})
+	out, code := run(t, "", nil, "sync", "-n", "-dir="+dir, "-addr=127.0.0.1:1")
+	if code != 0 || !strings.Contains(out, "a.txt: would offer") || !strings.Contains(out, "2 to offer, 0 invalid") {
+		t.Fatalf("dry run exited %d:\n%s", code, out)
+	}
+}
+
+// A file that fails makes the run exit non-zero after the others.
+func TestSyncFailure(t *testing.T) {
+	s := &tcpft.Server{MaxFileSize: 4}
+	addr := serveTCP(t, s)
+	dir := syncDir(t, map[string]string{"small": "ok", "large": "too large"})
+
+	out, code := run(t, "", nil, "sync", "-dir="+dir, "-addr="+addr)
+	if code != EXIT_FAILURE || !strings.Contains(out, "large: failed") || !strings.Contains(out, "1 uploaded, 0 skipped, 1 failed") {
+		t.Fatalf("sync exited %d, want %d:\n%s", code, EXIT_FAILURE, out)
+	}
+}
+
+// Symlinks are skipped unless followed, when the file a link points to is
+// sent under the link's name and a link loop fails alone.
+func TestSyncSymlinks(t *testing.T) {
+	dir := syncDir(t, map[string]string{"real.txt": "real"})
+	os.Symlink(filepath.Join(dir, "real.txt"), filepath.Join(dir, "link.txt"))
+	os.Symlink(filepath.Join(dir, "loop-b"), filepath.Join(dir, "loop-a"))
+	os.Symlink(filepath.Join(dir, "loop-a"), filepath.Join(dir, "loop-b"))
+
+	s := &tcpft.Server{}
+	addr := serveTCP(t, s)
+	out, code := run(t, "", nil, "sync", "-dir="+dir, "-addr="+addr)
+	if code != 0 || !strings.Contains(out, "1 uploaded, 0 skipped, 0 failed") {
+		t.Fatalf("sync exited %d:\n%s", code, out)
+	}
+	for _, name := range []string{"link.txt", "loop-a", "loop-b"} {
+		if !strings.Contains(out, name+": skipped (symlink)") {
+			t.Errorf("%s not skipped:\n%s", name, out)
+		}
+	}
+
+	s = &tcpft.Server{}
+	addr = serveTCP(t, s)
+	out, code = run(t, "", nil, "sync", "-follow-symlinks", "-dir="+dir, "-addr="+addr)
+	if code != EXIT_FAILURE || !strings.Contains(out, "2 uploaded, 0 skipped, 2 failed") {
+		t.Fatalf("sync -follow-symlinks exited %d, want %d:\n%s", code, EXIT_FAILURE, out)
+	}
+	if got, _ := os.ReadFile(filepath.Join(s.UploadDir, "link.txt")); string(got) != "real" {
+		t.Errorf("stored link.txt = %q, want the content it points to", got)
+	}
+	if info, err := os.Lstat(filepath.Join(s.UploadDir, "link.txt")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("link.txt stored as %v, %v, want a regular file", info, err)
+	}
+}
+
+// The dry run shows which files the filters leave out, and why.
+func TestSyncFilters(t *testing.T) {
+	dir := syncDir(t, map[string]string{"a.txt": "a", "b.o": "obj", "c.log": "log", "d.md": "doc"})
+	from := filepath.Join(t.TempDir(), "exclude")
+	os.WriteFile(from, []byte("# logs\n*.log\n"), 0644)
+
+	out, code := run(t, "", nil, "sync", "-n", "-dir="+dir, "-addr=127.0.0.1:1", "-exclude=*.o", "-exclude-from="+from, "-include=*.txt", "-include=*.o", "-include=*.log")
+	if code != 0 {
+		t.Fatalf("dry run exited %d:\n%s", code, out)
+	}
+	for _, want := range []string{
+		"a.txt: would offer",
+		`b.o: skipped (excluded by "*.o")`,
+		`c.log: skipped (excluded by "*.log")`,
+		"d.md: skipped (not included)",
+		"1 to offer",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+// -fail-fast stops at a full server rather than waiting for room.
+func TestSyncFailFast(t *testing.T) {
+	s := &tcpft.Server{ReserveSpace: 1 << 62}
+	addr := serveTCP(t, s)
+	dir := syncDir(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+
+	out, code := run(t, "", nil, "sync", "-fail-fast", "-dir="+dir, "-addr="+addr)
+	if code != EXIT_NO_SPACE || !strings.Contains(out, "stopped as the server is full") {
+		t.Fatalf("sync exited %d, want %d:\n%s", code, EXIT_NO_SPACE, out)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"socket-file-transfer/internal/config"
+	"socket-file-transfer/internal/tenant"
+)
+
+// loadTenants reads the -tenants file, a table per tenant named after it:
+//
+//	[alice]
+//	token = "..."
+//	quota = "10G"
+//
+//	[bob]
+//	cn = "bob.example.com"
+//	dir = "b"
+//	max-size = "1G"
+//	rate = "5M"
+//
+// Sizes and rates take an optional K, M or G suffix.
+func loadTenants(path string) (*tenant.Set, error) {
+	tables, err := config.ReadTables(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(tables[""]) > 0 {
+		return nil, fmt.Errorf("tenants file %s: keys outside a tenant's table", path)
+	}
+	var tenants []tenant.Tenant
+	for name, keys := range tables {
+		if name == "" {
+			continue
+		}
+		t := tenant.Tenant{Name: name}
+		for key, values := range keys {
+			if len(values) != 1 {
+				return nil, fmt.Errorf("tenants file %s: tenant %s: %s takes a single value", path, name, key)
+			}
+			value := values[0]
+			switch key {
+			case "token":
+				t.Token = value
+			case "cn":
+				t.CN = value
+			case "dir":
+				t.Dir = value
+			case "max-size", "quota", "rate":
+				n, err := parseLimit(value)
+				if err != nil {
+					return nil, fmt.Errorf("tenants file %s: tenant %s: invalid %s: %w", path, name, key, err)
+				}
+				switch key {
+				case "max-size":
+					t.MaxFileSize = n
+				case "quota":
+					t.Quota = n
+				default:
+					t.Rate = n
+				}
+			default:
+				return nil, fmt.Errorf("tenants file %s: tenant %s: unknown key %s, want %s", path, name, key, strings.Join(tenantKeys, ", "))
+			}
+		}
+		tenants = append(tenants, t)
+	}
+	// So errors name the same tenant every time
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	set, err := tenant.New(tenants)
+	if err != nil {
+		return nil, fmt.Errorf("tenants file %s: %w", path, err)
+	}
+	return set, nil
+}
+
+// Keys of a tenant's table
+var tenantKeys = []string{"token", "cn", "dir", "max-size", "quota", "rate"}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTenants writes a tenants file with content, returning its path.
+func writeTenants(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tenants.toml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTenants(t *testing.T) {
+	set, err := loadTenants(writeTenants(t, `
+[alice]
+token = "alice-secret"
+quota = "10K"
+
+[bob]
+cn = "bob.example.com"
+dir = "b"
+max-size = "1M"
+rate = "5K"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, ok := set.ByToken("alice-secret")
+	if !ok || alice.Name != "alice" || alice.Quota != 10<<10 || alice.Directory() != "alice" {
+		t.Errorf("alice = %+v, %v", alice, ok)
+	}
+	bob, ok := set.ByCN("bob.example.com")
+	if !ok || bob.Name != "bob" || bob.MaxFileSize != 1<<20 || bob.Rate != 5<<10 || bob.Directory() != "b" {
+		t.Errorf("bob = %+v, %v", bob, ok)
+	}
+}
+
+func TestLoadTenantsErrors(t *testing.T) {
+	tests := []struct {
+		name, content, err string
+	}{
+		{"key outside a table", "token = \"x\"\n[a]\ntoken = \"y\"\n", "keys outside a tenant's table"},
+		{"unknown key", "[a]\ntoken = \"x\"\nsize = \"1K\"\n", "unknown key size"},
+		{"invalid limit", "[a]\ntoken = \"x\"\nquota = \"lots\"\n", "invalid quota"},
+		{"no credential", "[a]\ndir = \"a\"\n", "neither a token nor a cn"},
+		{"shared token", "[a]\ntoken = \"x\"\n[b]\ntoken = \"x\"\n", "share a token"},
+		{"no tenants", "", "no tenants"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadTenants(writeTenants(t, tt.content)); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want an error about %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// Protocols whose clients can't send a token, and settings tenants replace,
+// are refused with -tenants, before anything is written.
+func TestServeTenantsRefused(t *testing.T) {
+	path := writeTenants(t, "[a]\ntoken = \"x\"\n")
+	wd := t.TempDir()
+	for _, args := range [][]string{
+		{"-proto=udp"},
+		{"-proto=both"},
+		{"-codes"},
+		{"-http-user=u", "-http-pass=p"},
+	} {
+		out, code := runIn(t, wd, "", nil, append([]string{"serve", "-tenants=" + path}, args...)...)
+		if code != 1 || !strings.Contains(out, "-tenants") {
+			t.Errorf("serve -tenants %s: exit code %d, want 1 and why:\n%s", strings.Join(args, " "), code, out)
+		}
+	}
+	if names, _ := os.ReadDir(wd); len(names) != 0 {
+		t.Errorf("refused serve left %v behind", names)
+	}
+}
+
+// Two tenants of a server each store into their own directory until their
+// own quota, and unknown tokens are refused.
+func TestServeTenants(t *testing.T) {
+	path := writeTenants(t, `
+[a]
+token = "token-a"
+quota = "100"
+
+[b]
+token = "token-b"
+quota = "250"
+`)
+	addr, _ := startServe(t, nil, "-tenants="+path)
+	file := filepath.Join(t.TempDir(), "f.bin")
+	if err := os.WriteFile(file, make([]byte, 60), 0644); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		token string
+		code  int
+	}{
+		{"token-a", 0},
+		{"token-b", 0},
+		{"token-a", EXIT_NO_SPACE},
+		{"token-b", 0},
+		{"token-b", 0},
+		{"token-b", 0},
+		{"token-b", EXIT_NO_SPACE},
+		{"token-c", EXIT_REJECTED},
+	}
+	for i, st := range steps {
+		if out, code := run(t, "", nil, "send", "-auth-token="+st.token, "-addr="+addr, "-file="+file, fmt.Sprint("-name=f", i)); code != st.code {
+			t.Fatalf("send %d with %s: exit code %d, want %d:\n%s", i, st.token, code, st.code, out)
+		}
+	}
+}
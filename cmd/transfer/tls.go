@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/tlscert"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/quicft"
+)
+
+// serverTLS serves the -tls-cert and -tls-key pair, through a Loader that
+// picks up a renewed pair, or, if neither is set, makes a self-signed
+// certificate that clients must be told to accept, with a nil Loader.
+func serverTLS(certFile, keyFile string) (*tls.Config, *tlscert.Loader, error) {
+	if certFile == "" && keyFile == "" {
+		cert, fingerprint, err := quicft.SelfSigned("localhost", "127.0.0.1", "::1")
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Println(i18n.T("serve.self_signed", fingerprint))
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, nil, errors.New("-tls-cert and -tls-key go together")
+	}
+	certs, err := tlscert.Load(certFile, keyFile, wire.DefaultLogger)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs.Config(), certs, nil
+}
+
+// clientTLS trusts the system roots, or the certificates in the PEM file
+// caFile if set, or, with insecure, any certificate. With certFile and
+// keyFile it presents that certificate, for servers that tell their
+// tenants apart by it.
+func clientTLS(caFile string, insecure bool, certFile, keyFile string) (*tls.Config, error) {
+	var c *tls.Config
+	switch {
+	case insecure:
+		c = &tls.Config{InsecureSkipVerify: true}
+	case caFile != "":
+		pool, err := certPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		c = &tls.Config{RootCAs: pool}
+	}
+	if certFile == "" && keyFile == "" {
+		return c, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key go together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		c = &tls.Config{}
+	}
+	c.Certificates = []tls.Certificate{cert}
+	return c, nil
+}
+
+// requireClientCerts has the server of c verify the certificates clients
+// present, if any, against those in the PEM file caFile.
+func requireClientCerts(c *tls.Config, caFile string) error {
+	pool, err := certPool(caFile)
+	if err != nil {
+		return err
+	}
+	c.ClientCAs = pool
+	c.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// certPool returns the certificates in the PEM file path.
+func certPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/trace"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/udpft"
+)
+
+// Size a -trace file is kept below by default
+const DefaultTraceLimit = "64M"
+
+// traceFlags are the -trace flags of serve and send, which record the UDP
+// packets of their transfers for 'transfer trace-replay'.
+type traceFlags struct {
+	path  *string
+	limit *string
+}
+
+func addTraceFlags(fs *flag.FlagSet) *traceFlags {
+	return &traceFlags{
+		path:  fs.String("trace", "", "Record every UDP packet sent and received to this file, for 'transfer trace-replay'"),
+		limit: fs.String("trace-limit", DefaultTraceLimit, "Keep the -trace file below this size by moving it to file.1 when full, with an optional K, M or G suffix (0 means no limit)"),
+	}
+}
+
+// create starts the trace the flags ask for, nil if none.
+func (f *traceFlags) create(side trace.Side) (*recorder, error) {
+	if *f.path == "" {
+		return nil, nil
+	}
+	limit, err := parseLimit(*f.limit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -trace-limit: %w", err)
+	}
+	w, err := trace.Create(*f.path, side, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{w}, nil
+}
+
+// recorder records the packets of the connections it wraps to -trace, as
+// they are sent, before the -sim flags impair them.
+type recorder struct {
+	w *trace.Writer
+}
+
+// datagram records a connected datagram socket.
+func (r *recorder) datagram(conn net.Conn) net.Conn {
+	return trace.WrapConn(conn, r.w)
+}
+
+// packetConn records an unconnected datagram socket.
+func (r *recorder) packetConn(conn net.PacketConn) net.PacketConn {
+	return trace.WrapPacketConn(conn, r.w)
+}
+
+func (r *recorder) Close() error {
+	return r.w.Close()
+}
+
+// runTraceReplay is transfer trace-replay: it feeds what a UDP server
+// received, as serve -trace recorded it, to a server receiving into a
+// scratch directory, and reports the first packet it sent differently.
+// A trace moved aside by -trace-limit goes first.
+func runTraceReplay(args []string) {
+	fs := flag.NewFlagSet("trace-replay", flag.ExitOnError)
+	var fast = fs.Bool("fast", false, "Replay the packets without waiting for the time they arrived; timers may then act differently")
+	var ackEvery = fs.Int("ack-every", udpft.DefaultAckEvery, "Acknowledge this many in-order UDP packets at once (1 acknowledges each)")
+	var ackDelay = fs.Duration("ack-delay", udpft.DefaultAckDelay, "Longest to hold back a UDP ACK waiting for -ack-every packets")
+	var maxPause = fs.Duration("max-pause", wire.DefaultMaxPause, "Abort an upload whose client paused it for longer than this")
+	var legacy = fs.Bool("legacy", false, "Accept clients that predate protocol version negotiation")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		fmt.Println(i18n.T("trace_replay.usage"))
+		os.Exit(1)
+	}
+
+	var t trace.Trace
+	for i, path := range fs.Args() {
+		part, err := trace.ReadFile(path)
+		if err != nil {
+			fmt.Println(i18n.T("error", err))
+			os.Exit(1)
+		}
+		if i > 0 && part.Side != t.Side {
+			fmt.Println(i18n.T("trace_replay.sides", path))
+			os.Exit(1)
+		}
+		t.Side = part.Side
+		t.Records = append(t.Records, part.Records...)
+	}
+
+	dir, err := os.MkdirTemp("", "trace-replay")
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+	fail := func() {
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	srv := &udpft.Server{UploadDir: dir}
+	srv.Progress = func(udpft.Event) {}
+	srv.Legacy = *legacy
+	srv.AckEvery, srv.AckDelay = *ackEvery, *ackDelay
+	srv.MaxPause = *maxPause
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	res, err := udpft.Replay(ctx, srv, &t, *fast)
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		fail()
+	}
+
+	fmt.Println(i18n.T("trace_replay.summary", res.Received, res.Replayed, res.Recorded))
+	d := res.Divergence
+	if d == nil {
+		fmt.Println(i18n.T("trace_replay.same"))
+		return
+	}
+	nothing := func(s string) string {
+		if s == "" {
+			return i18n.T("trace_replay.nothing")
+		}
+		return s
+	}
+	fmt.Println(i18n.T("trace_replay.diverged", d.Index+1, d.At.Round(time.Millisecond), nothing(d.Recorded), nothing(d.Replayed)))
+	fail()
+}
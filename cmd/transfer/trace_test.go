@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var fixture = filepath.Join("..", "..", "internal", "trace", "testdata", "upload.trace")
+
+// The fixture replays, reporting where the delayed ACK it recorded came
+// out differently, and exits 1 for it.
+func TestTraceReplayFixture(t *testing.T) {
+	out, code := run(t, "", nil, "trace-replay", "-fast", fixture)
+	if code != 1 || !strings.Contains(out, "Replayed 30 received packets") || !strings.Contains(out, "Diverged at packet 9") {
+		t.Errorf("exit code %d, want 1 and the divergence at packet 9:\n%s", code, out)
+	}
+}
+
+// A trace serve -trace recorded replays without divergence, also when
+// -trace-limit moved its start to file.1.
+func TestTraceRecordReplay(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit string
+		parts []string
+	}{
+		{"whole", "0", []string{"udp.trace"}},
+		{"rotated", "40K", []string{"udp.trace.1", "udp.trace"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, addrs := serveListening(t, 1, "-proto=udp", "-port=0", "-ack-every=1", "-trace=udp.trace", "-trace-limit="+tt.limit)
+			file := filepath.Join(t.TempDir(), "f.bin")
+			os.WriteFile(file, make([]byte, 64<<10), 0644)
+			if out, code := run(t, "", nil, "send", "-proto=udp", "-addr="+addrs["udp"], "-file="+file); code != 0 {
+				t.Fatalf("send: exit code %d:\n%s", code, out)
+			}
+			var parts []string
+			for _, name := range tt.parts {
+				parts = append(parts, filepath.Join(dir, name))
+			}
+			out, code := run(t, "", nil, append([]string{"trace-replay", "-ack-every=1"}, parts...)...)
+			if code != 0 || !strings.Contains(out, "No divergence") {
+				t.Errorf("trace-replay: exit code %d, want 0 and no divergence:\n%s", code, out)
+			}
+		})
+	}
+}
+
+// Client traces, files that aren't traces and -trace with TCP are refused.
+func TestTraceRefused(t *testing.T) {
+	dir := t.TempDir()
+	notTrace := filepath.Join(dir, "notes.txt")
+	os.WriteFile(notTrace, []byte("not a trace"), 0644)
+	clientTrace := filepath.Join(dir, "client.trace")
+	os.WriteFile(clientTrace, []byte("SFTTRACE\x01c"), 0644)
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"no trace", []string{"trace-replay"}, "Usage"},
+		{"not a trace", []string{"trace-replay", notTrace}, "not a trace file"},
+		{"client's", []string{"trace-replay", clientTrace}, "only a server's"},
+		{"mixed sides", []string{"trace-replay", fixture, clientTrace}, "other side"},
+		{"TCP", []string{"send", "-proto=tcp", "-trace=" + filepath.Join(dir, "t"), "-addr=127.0.0.1:1", "-file=" + notTrace}, "-trace"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out, code := run(t, "", nil, tt.args...); code != 1 || !strings.Contains(out, tt.want) {
+				t.Errorf("exit code %d, want 1 and %q:\n%s", code, tt.want, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/manifest"
+)
+
+// runVerify is transfer verify: it rehashes the files a directory's
+// SHA256SUMS lists, as sha256sum -c would, e.g. on a server to check
+// synced files haven't rotted since.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var dir = fs.String("dir", "", "Directory holding the "+manifest.NAME+" to check")
+	parseFlags(fs, args)
+
+	if *dir == "" {
+		fmt.Println(i18n.T("verify.requires_dir"))
+		fmt.Println(i18n.T("verify.usage"))
+		os.Exit(1)
+	}
+
+	entries, err := manifest.Load(*dir)
+	if err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(1)
+	}
+	// Sidecars vouch for what was received, not for what is on disk now
+	failed := make(map[string]error)
+	for _, m := range manifest.Check(*dir, entries, hashcache.File) {
+		failed[m.Path] = m.Err
+	}
+	for _, e := range entries {
+		if err := failed[e.Path]; err != nil {
+			fmt.Println(i18n.T("verify.failed", e.Path, err))
+		} else {
+			fmt.Println(i18n.T("verify.ok", e.Path))
+		}
+	}
+
+	fmt.Println(i18n.T("verify.summary", len(entries)-len(failed), len(failed), filepath.Join(*dir, manifest.NAME)))
+	if len(failed) > 0 {
+		os.Exit(EXIT_CHECKSUM_MISMATCH)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"socket-file-transfer/internal/i18n"
+	"socket-file-transfer/internal/pathfilter"
+	"socket-file-transfer/internal/schedule"
+	"socket-file-transfer/internal/watch"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/tcpft"
+	"socket-file-transfer/udpft"
+)
+
+// runWatch is send -watch: it sends the files that settle in dir until
+// interrupted, then finishes the sends under way. A second interrupt
+// aborts them. With failFast a server out of disk space ends it too.
+func runWatch(dir string, settle time.Duration, afterSend string, filter *pathfilter.Filter, queue *schedule.Queue, failFast bool, timeout time.Duration, proto, addr string, tcpClient tcpft.Client, tcpOpts tcpft.Options, udpOpts udpft.Options) {
+	after, err := watch.ParseAfter(afterSend)
+	if err != nil {
+		fmt.Println(i18n.T("watch.invalid_after_send", err))
+		os.Exit(1)
+	}
+
+	// Concurrent sends would garble the console progress line
+	quiet := func(wire.Event) {}
+	tcpOpts.Progress, udpOpts.Progress = quiet, quiet
+
+	var send watch.SendFunc
+	switch proto {
+	case "tcp", "quic":
+		if addr == "" {
+			addr = "localhost" + wire.TCP_PORT
+		}
+		send = func(ctx context.Context, path, name string) error {
+			opts := tcpOpts
+			opts.Name = name
+			_, err := tcpClient.SendFile(ctx, addr, path, opts)
+			return err
+		}
+	case "udp":
+		if tcpOpts.Delta {
+			fmt.Println(i18n.T("watch.delta_tcp_quic_only"))
+			os.Exit(1)
+		}
+		if addr == "" {
+			addr = "localhost" + wire.UDP_PORT
+		}
+		send = func(ctx context.Context, path, name string) error {
+			var client udpft.Client
+			opts := udpOpts
+			opts.Name = name
+			_, err := client.SendFile(ctx, addr, path, opts)
+			return err
+		}
+	default:
+		fmt.Println(i18n.T("unknown_protocol", proto))
+		os.Exit(1)
+	}
+	if timeout > 0 {
+		untimed := send
+		send = func(ctx context.Context, path, name string) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return untimed(ctx, path, name)
+		}
+	}
+
+	// The first interrupt stops watching, the second aborts the sends
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	abort, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		stop()
+		aborted := make(chan os.Signal, 1)
+		signal.Notify(aborted, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-aborted:
+			cancel()
+		case <-abort.Done():
+		}
+	}()
+	abortable := send
+	send = func(_ context.Context, path, name string) error {
+		return abortable(abort, path, name)
+	}
+
+	fmt.Println(i18n.T("watch.watching", dir, addr, proto))
+	w := &watch.Watcher{Dir: dir, Send: send, After: after, Settle: settle, Filter: filter, Queue: queue, FailFast: failFast}
+	if err := w.Run(ctx); err != nil {
+		fmt.Println(i18n.T("error", err))
+		os.Exit(exitCode(err))
+	}
+}
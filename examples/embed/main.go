@@ -0,0 +1,71 @@
+// Command embed shows how a host application drives tcpft and udpft
+// directly: it starts both servers in-process, sends a file over each with
+// console output silenced, and prints progress events and results itself.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"socket-file-transfer/tcpft"
+	"socket-file-transfer/udpft"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Println("Usage: go run ./examples/embed path/to/file")
+		os.Exit(1)
+	}
+	path := os.Args[1]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	noProgress := func(tcpft.Event) {}
+
+	// Report only the start and end of each client transfer
+	events := func(ev tcpft.Event) {
+		if ev.Kind != tcpft.EventProgress {
+			fmt.Printf("  %s %s -> %s (%d/%d bytes)\n", ev.Kind, ev.Name, ev.Remote, ev.Bytes, ev.Total)
+		}
+	}
+
+	uploads, err := os.MkdirTemp("", "embed-uploads")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(uploads)
+
+	tcpServer := &tcpft.Server{Addr: "127.0.0.1:9080", UploadDir: uploads}
+	tcpServer.Logger, tcpServer.Progress = quiet, noProgress
+	go tcpServer.ListenAndServe(ctx)
+
+	udpServer := &udpft.Server{Addr: "127.0.0.1:9081", UploadDir: uploads}
+	udpServer.Logger, udpServer.Progress = quiet, noProgress
+	go udpServer.ListenAndServe(ctx)
+
+	time.Sleep(100 * time.Millisecond) // Let the listeners come up
+
+	var tcpClient tcpft.Client
+	tres, err := tcpClient.SendFile(ctx, "127.0.0.1:9080", path, tcpft.Options{Logger: quiet, Progress: events})
+	if err != nil {
+		fmt.Println("TCP:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("TCP: %d bytes in %v, sha256 %s\n", tres.Bytes, tres.Duration, hex.EncodeToString(tres.Checksum))
+
+	var udpClient udpft.Client
+	ures, err := udpClient.SendFile(ctx, "127.0.0.1:9081", path, udpft.Options{Logger: quiet, Progress: events})
+	if err != nil {
+		fmt.Println("UDP:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("UDP: %d bytes in %v (%d packets), sha256 %s\n", ures.Bytes, ures.Duration, ures.Packets, hex.EncodeToString(ures.Checksum))
+}
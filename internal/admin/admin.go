@@ -0,0 +1,207 @@
+// Package admin is the control interface of a running server, which
+// 'transfer admin' talks to: it lists the transfers under way, kills one,
+// shows the server's settings and runs a retention sweep on demand.
+//
+// It listens on a unix socket, only its owner may connect to, or on a TCP
+// port of a loopback address, where every request must carry the token
+// the server was given. Each connection carries one request and its
+// response, JSON objects of a line each:
+//
+//	{"op":"kill","id":12,"token":"..."}
+//	{"error":"no such transfer under way"}
+package admin
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"socket-file-transfer/internal/transfers"
+	"socket-file-transfer/internal/unixsock"
+	"socket-file-transfer/internal/wire"
+)
+
+// Operations of a Request
+const (
+	OP_STATUS = "status" // List the transfers under way
+	OP_KILL   = "kill"   // End transfer ID with wire.ErrKilled
+	OP_CONFIG = "config" // Show the settings, secrets redacted
+	OP_SWEEP  = "sweep"  // Enforce the retention policy now
+)
+
+// Longest request a server reads
+const MAX_REQUEST_LEN = 4096
+
+// Permissions of a unix socket: its owner's only
+const SOCKET_MODE = 0600
+
+// How long a client has to send its request
+const REQUEST_TIMEOUT = 5 * time.Second
+
+// Request asks a server to do Op.
+type Request struct {
+	Op    string `json:"op"`
+	ID    uint64 `json:"id,omitempty"` // Transfer to kill
+	Token string `json:"token,omitempty"`
+}
+
+// Response is what a server answered to a Request.
+type Response struct {
+	Error     string               `json:"error,omitempty"` // Why it failed
+	Transfers []transfers.Transfer `json:"transfers,omitempty"`
+	Config    string               `json:"config,omitempty"` // A config file, see internal/config
+}
+
+// Server answers requests on Addr.
+type Server struct {
+	Addr  string // Path of a unix socket, or host:port on a loopback address
+	Token string // Requests must carry it if set; required over TCP
+
+	Transfers *transfers.Registry
+	Config    func(io.Writer) error // Writes the settings
+	Sweep     func() error          // Enforces the retention policy
+
+	Log *slog.Logger
+}
+
+// Network returns "tcp" if addr is a host:port, "unix" if it is a path.
+func Network(addr string) string {
+	if strings.ContainsAny(addr, `/\`) {
+		return "unix"
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return "tcp"
+	}
+	return "unix"
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Log != nil {
+		return s.Log
+	}
+	return wire.DefaultLogger
+}
+
+// ListenAndServe listens on s.Addr and serves requests until ctx ends.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	listener, err := s.listen()
+	if err != nil {
+		return fmt.Errorf("error starting admin socket: %w", err)
+	}
+	return s.Serve(ctx, listener)
+}
+
+func (s *Server) listen() (net.Listener, error) {
+	if Network(s.Addr) == "tcp" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("%s is not a loopback address", s.Addr)
+		}
+		if s.Token == "" {
+			return nil, errors.New("a TCP admin socket requires a token")
+		}
+		return net.Listen("tcp", s.Addr)
+	}
+	return unixsock.Listen(s.Addr, SOCKET_MODE)
+}
+
+// Serve answers the requests of the connections accepted on listener until
+// ctx ends.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	defer listener.Close()
+
+	s.logger().Info("Admin socket listening", "addr", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("error accepting admin connection: %w", err)
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(REQUEST_TIMEOUT))
+	line, err := bufio.NewReader(io.LimitReader(conn, MAX_REQUEST_LEN)).ReadBytes('\n')
+	if err != nil {
+		s.logger().Debug("Error reading admin request", "err", err)
+		return
+	}
+	var req Request
+	var resp Response
+	if err := json.Unmarshal(line, &req); err != nil {
+		resp.Error = fmt.Sprintf("invalid request: %v", err)
+	} else if s.Token != "" && subtle.ConstantTimeCompare([]byte(req.Token), []byte(s.Token)) != 1 {
+		s.logger().Warn("Admin request with a wrong token", "remote", conn.RemoteAddr())
+		resp.Error = "wrong token"
+	} else if err := s.do(req, &resp); err != nil {
+		resp.Error = err.Error()
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// do carries out req, filling in resp.
+func (s *Server) do(req Request, resp *Response) error {
+	log := s.logger()
+	switch req.Op {
+	case OP_STATUS:
+		resp.Transfers = s.Transfers.List()
+	case OP_KILL:
+		if err := s.Transfers.Kill(req.ID); err != nil {
+			return fmt.Errorf("transfer %d: %w", req.ID, err)
+		}
+		log.Warn("Transfer killed by admin", "id", req.ID)
+	case OP_CONFIG:
+		var b strings.Builder
+		if err := s.Config(&b); err != nil {
+			return err
+		}
+		resp.Config = b.String()
+	case OP_SWEEP:
+		log.Info("Retention sweep requested by admin")
+		return s.Sweep()
+	default:
+		return fmt.Errorf("unknown operation %q", req.Op)
+	}
+	return nil
+}
+
+// Do sends req, with token, to the server on addr and returns its
+// response, failing with its error if it has one.
+func Do(ctx context.Context, addr, token string, req Request) (*Response, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, Network(addr), addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to admin socket: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	req.Token = token
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, wire.ContextError(ctx, fmt.Errorf("error sending admin request: %w", err))
+	}
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, wire.ContextError(ctx, fmt.Errorf("error reading admin response: %w", err))
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,318 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/transfers"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/tcpft"
+	"socket-file-transfer/udpft"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// serve runs s until the test ends, on a unix socket in a temporary
+// directory unless s.Addr is set, and returns the address it listens on.
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+	if s.Addr == "" {
+		s.Addr = filepath.Join(t.TempDir(), "admin.sock")
+	}
+	if s.Transfers == nil {
+		s.Transfers = transfers.New()
+	}
+	s.Log = quiet
+	listener, err := s.listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(ctx, listener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return listener.Addr().String()
+}
+
+// do sends req to the server on addr, with token.
+func do(addr, token string, req Request) (*Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return Do(ctx, addr, token, req)
+}
+
+// slowReader yields zeros in small pieces, slowly enough that a transfer
+// of it is still under way when the test kills it.
+type slowReader struct{}
+
+func (slowReader) Read(p []byte) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	n := min(len(p), 1024)
+	clear(p[:n])
+	return n, nil
+}
+
+// waitTransfer waits for a transfer to be under way on the server at
+// addr, returning it.
+func waitTransfer(t *testing.T, addr string) transfers.Transfer {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := do(addr, "", Request{Op: OP_STATUS})
+		if err != nil {
+			t.Fatalf("status: %v", err)
+		}
+		if len(resp.Transfers) > 0 {
+			return resp.Transfers[0]
+		}
+	}
+	t.Fatal("no transfer under way")
+	return transfers.Transfer{}
+}
+
+// partial reports whether dir holds a file other than the server's own
+// hidden ones, or a partial upload.
+func partial(t *testing.T, dir string) bool {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") || strings.HasSuffix(e.Name(), ".part") {
+			return true
+		}
+	}
+	return false
+}
+
+// A transfer listed by status and killed takes the path of a client
+// abort: its partial file is removed and it leaves the list. A TCP client
+// sees its connection closed, a UDP one is told why.
+func TestKill(t *testing.T) {
+	tests := []struct {
+		proto string
+		serve func(t *testing.T, registry *transfers.Registry, dir string) string
+		send  func(ctx context.Context, addr string) error
+		told  bool // The client's error says it was killed
+	}{
+		{
+			proto: "tcp",
+			serve: func(t *testing.T, registry *transfers.Registry, dir string) string {
+				s := &tcpft.Server{Options: tcpft.Options{Logger: quiet, Progress: registry.Progress}}
+				s.UploadDir = dir
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					s.Serve(ctx, ln)
+				}()
+				t.Cleanup(func() {
+					cancel()
+					<-done
+				})
+				return ln.Addr().String()
+			},
+			send: func(ctx context.Context, addr string) error {
+				_, err := (&tcpft.Client{}).Send(ctx, addr, "slow.bin", slowReader{}, 1<<30, tcpft.Options{Logger: quiet, Progress: func(tcpft.Event) {}})
+				return err
+			},
+		},
+		{
+			proto: "udp",
+			told:  true,
+			serve: func(t *testing.T, registry *transfers.Registry, dir string) string {
+				s := &udpft.Server{Options: udpft.Options{Logger: quiet, Progress: registry.Progress}}
+				s.UploadDir = dir
+				// Not to drain for long once killed
+				s.Timeout = 200 * time.Millisecond
+				conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					s.Serve(ctx, conn)
+				}()
+				t.Cleanup(func() {
+					cancel()
+					<-done
+				})
+				return conn.LocalAddr().String()
+			},
+			send: func(ctx context.Context, addr string) error {
+				_, err := (&udpft.Client{}).Send(ctx, addr, "slow.bin", slowReader{}, 1<<30, udpft.Options{Logger: quiet, Progress: func(udpft.Event) {}})
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proto, func(t *testing.T) {
+			registry := transfers.New()
+			dir := t.TempDir()
+			addr := tt.serve(t, registry, dir)
+			socket := serve(t, &Server{Transfers: registry})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			sent := make(chan error, 1)
+			go func() { sent <- tt.send(ctx, addr) }()
+
+			tr := waitTransfer(t, socket)
+			if tr.Name != "slow.bin" || tr.Total != 1<<30 {
+				t.Errorf("status lists %+v, want slow.bin of 1 GiB", tr)
+			}
+			if _, err := do(socket, "", Request{Op: OP_KILL, ID: tr.ID}); err != nil {
+				t.Fatalf("kill: %v", err)
+			}
+			select {
+			case err := <-sent:
+				if err == nil || tt.told && !strings.Contains(err.Error(), wire.ErrKilled.Error()) {
+					t.Errorf("send: got %v, want %q", err, wire.ErrKilled)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("send still under way 5s after the kill")
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) && (partial(t, dir) || len(registry.List()) > 0) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if partial(t, dir) {
+				t.Error("killed upload left a file behind")
+			}
+			if list := registry.List(); len(list) > 0 {
+				t.Errorf("killed transfer still listed: %+v", list)
+			}
+			if _, err := do(socket, "", Request{Op: OP_KILL, ID: tr.ID}); err == nil || !strings.Contains(err.Error(), transfers.ErrUnknown.Error()) {
+				t.Errorf("second kill: got %v, want %q", err, transfers.ErrUnknown)
+			}
+		})
+	}
+}
+
+// Config answers with what the server writes, and sweep runs it once,
+// passing on its error.
+func TestConfigSweep(t *testing.T) {
+	sweeps := 0
+	sweepErr := errors.New("no retention policy")
+	addr := serve(t, &Server{
+		Config: func(w io.Writer) error {
+			_, err := io.WriteString(w, "max-size = \"10M\"\n")
+			return err
+		},
+		Sweep: func() error {
+			sweeps++
+			if sweeps > 1 {
+				return sweepErr
+			}
+			return nil
+		},
+	})
+
+	resp, err := do(addr, "", Request{Op: OP_CONFIG})
+	if err != nil || resp.Config != "max-size = \"10M\"\n" {
+		t.Errorf("config = %+v, %v", resp, err)
+	}
+	if _, err := do(addr, "", Request{Op: OP_SWEEP}); err != nil {
+		t.Errorf("sweep: %v", err)
+	}
+	if _, err := do(addr, "", Request{Op: OP_SWEEP}); err == nil || err.Error() != sweepErr.Error() {
+		t.Errorf("failing sweep: got %v, want %v", err, sweepErr)
+	}
+	if sweeps != 2 {
+		t.Errorf("swept %d times, want 2", sweeps)
+	}
+	if _, err := do(addr, "", Request{Op: "reboot"}); err == nil || !strings.Contains(err.Error(), "unknown operation") {
+		t.Errorf("unknown operation: got %v", err)
+	}
+}
+
+// The unix socket is its owner's only.
+func TestSocketMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no permission bits on Windows")
+	}
+	addr := serve(t, &Server{})
+	info, err := os.Stat(addr)
+	if err != nil || info.Mode().Perm() != SOCKET_MODE {
+		t.Fatalf("socket mode %v, %v, want %v", info.Mode().Perm(), err, os.FileMode(SOCKET_MODE))
+	}
+}
+
+// Requests must carry the token when there is one, and a TCP socket needs
+// one and a loopback address.
+func TestToken(t *testing.T) {
+	addr := serve(t, &Server{Addr: "127.0.0.1:0", Token: "s3cret"})
+	for _, token := range []string{"", "wrong", "s3cre"} {
+		if _, err := do(addr, token, Request{Op: OP_STATUS}); err == nil || err.Error() != "wrong token" {
+			t.Errorf("token %q: got %v, want wrong token", token, err)
+		}
+	}
+	if _, err := do(addr, "s3cret", Request{Op: OP_STATUS}); err != nil {
+		t.Errorf("right token: %v", err)
+	}
+
+	for _, s := range []*Server{
+		{Addr: "127.0.0.1:0"},
+		{Addr: "0.0.0.0:0", Token: "t"},
+		{Addr: "example.com:0", Token: "t"},
+	} {
+		if l, err := s.listen(); err == nil {
+			l.Close()
+			t.Errorf("listened on %s with token %q", s.Addr, s.Token)
+		}
+	}
+}
+
+// Requests that aren't JSON are answered with an error.
+func TestInvalidRequest(t *testing.T) {
+	addr := serve(t, &Server{})
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("status please\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.Contains(line, "invalid request") {
+		t.Errorf("answered %q, %v, want an invalid request error", line, err)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	for addr, want := range map[string]string{
+		"127.0.0.1:7000":       "tcp",
+		"localhost:7000":       "tcp",
+		"[::1]:7000":           "tcp",
+		"/run/transfer.sock":   "unix",
+		"admin.sock":           "unix",
+		`C:\run\transfer.sock`: "unix",
+		"./host:1":             "unix",
+	} {
+		if got := Network(addr); got != want {
+			t.Errorf("Network(%q) = %s, want %s", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+// Package archive packs a directory into a tar stream, gzipped or not, so
+// a tree of small files travels as one transfer, and unpacks one without
+// letting its entries reach outside the directory it goes to.
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"socket-file-transfer/internal/pathfilter"
+	"socket-file-transfer/internal/prealloc"
+	"socket-file-transfer/internal/wire"
+)
+
+// Entries an archive may hold unless Limits says otherwise
+const DefaultMaxEntries = 100000
+
+// Bytes the files of an archive may total unless Limits says otherwise
+const DefaultMaxTotal = 1 << 30
+
+// Tar headers and padding allowed per entry on top of Limits.MaxTotal in
+// the decompressed stream, enough for a PAX header with a long name
+const FRAMING_PER_ENTRY = 4096
+
+// Limits bound what Extract unpacks, so a small archive can't fill the
+// disk with what it decompresses to. A zero MaxEntry means no limit on
+// each file, while a zero MaxTotal or MaxEntries means DefaultMaxTotal or
+// DefaultMaxEntries, so there always is one on the whole. Going over one,
+// or an entry holding more or less than its header says, fails the
+// archive with wire.ErrExpansion.
+type Limits struct {
+	MaxEntry   int64 // Bytes of any one file, as its header says and as read
+	MaxTotal   int64 // Bytes of all the files; the decompressed stream may hold FRAMING_PER_ENTRY more per entry
+	MaxEntries int   // Entries of any type
+}
+
+// Extensions of archives, longest first so ".tar.gz" wins over ".tar"
+var extensions = []struct {
+	ext string
+	gz  bool
+}{
+	{".tar.gz", true},
+	{".tgz", true},
+	{".tar", false},
+}
+
+// Name returns the name to send an archive of dir as: its base name with
+// ".tar", or ".tar.gz" if gz.
+func Name(dir string, gz bool) string {
+	name := filepath.Base(filepath.Clean(dir))
+	if gz {
+		return name + ".tar.gz"
+	}
+	return name + ".tar"
+}
+
+// Split returns the directory an archive named name unpacks into, its name
+// without the extension, and whether it is gzipped. ok is false if name
+// isn't a .tar, .tar.gz or .tgz archive.
+func Split(name string) (dir string, gz, ok bool) {
+	lower := strings.ToLower(name)
+	for _, e := range extensions {
+		if strings.HasSuffix(lower, e.ext) && len(name) > len(e.ext) {
+			return name[:len(name)-len(e.ext)], e.gz, true
+		}
+	}
+	return "", false, false
+}
+
+// Write writes the directories and regular files under dir that filter
+// keeps to w as a tar stream, gzipped if gz, with paths relative to dir.
+// Symlinks and special files are skipped, as sync skips them. It returns
+// how many files it wrote.
+func Write(w io.Writer, dir string, gz bool, filter *pathfilter.Filter) (int, error) {
+	var gzw *gzip.Writer
+	if gz {
+		gzw = gzip.NewWriter(w)
+		w = gzw
+	}
+	tw := tar.NewWriter(w)
+
+	files := 0
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if !d.Type().IsRegular() && !d.IsDir() {
+			return nil
+		}
+		if keep, _ := filter.Keep(filepath.ToSlash(rel), d.IsDir()); !keep {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		// Owners mean nothing on the server
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := io.CopyN(tw, file, hdr.Size); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = fmt.Errorf("%s shrank while being archived", p)
+			}
+			return err
+		}
+		files++
+		return nil
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil && gzw != nil {
+		err = gzw.Close()
+	}
+	if err != nil {
+		return files, fmt.Errorf("error archiving %s: %w", dir, err)
+	}
+	return files, nil
+}
+
+// Extract unpacks the archive at src into the directory dest, replacing
+// it if it exists. Entries are unpacked into a temporary directory next to
+// dest, renamed into place only once all of them are, so a failure leaves
+// nothing behind. Entries with absolute paths or "..", links leading
+// outside dest and device nodes fail the whole archive; each file must
+// leave reserve bytes free on the disk. It returns how many files it
+// unpacked. Files are unpacked within limits, and reading stops as soon
+// as the decompressed stream goes past them.
+func Extract(src, dest string, reserve int64, limits Limits) (int, error) {
+	_, gz, _ := Split(filepath.Base(src))
+	file, r, err := open(src, gz, &limits)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	tmp, err := os.MkdirTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*.extract")
+	if err != nil {
+		return 0, fmt.Errorf("error extracting archive: %w", err)
+	}
+	files, err := unpack(r, tmp, reserve, limits)
+	if err == nil {
+		err = os.Chmod(tmp, 0755)
+	}
+	if err == nil {
+		err = replace(tmp, dest)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return 0, err
+	}
+	return files, nil
+}
+
+// Check reads the archive at src, gzipped if gz, as Extract would unpack
+// it but without writing anything, failing with wire.ErrExpansion if it
+// goes past limits or an entry holds other than its header says. A server
+// runs it before storing an archive, so none it would refuse to unpack is
+// ever seen.
+func Check(src string, gz bool, limits Limits) error {
+	file, r, err := open(src, gz, &limits)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	tr := tar.NewReader(r)
+	t := tally{limits: limits}
+	for {
+		hdr, err := t.next(tr)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if err := t.file(io.Discard, tr, hdr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// open opens the archive at src for reading its tar stream, gunzipping it
+// if gz, with the defaults of limits filled in and the stream cut off past
+// them.
+func open(src string, gz bool, limits *Limits) (*os.File, io.Reader, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	var r io.Reader = file
+	if gz {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("error reading archive: %w", err)
+		}
+		r = zr
+	}
+	if limits.MaxEntries <= 0 {
+		limits.MaxEntries = DefaultMaxEntries
+	}
+	if limits.MaxTotal <= 0 {
+		limits.MaxTotal = DefaultMaxTotal
+	}
+	return file, &budgetReader{r: r, left: limits.MaxTotal + int64(limits.MaxEntries)*FRAMING_PER_ENTRY}, nil
+}
+
+// tally holds an archive being read to its limits.
+type tally struct {
+	limits  Limits
+	entries int
+	total   int64
+	last    *tar.Header // The regular file entry read last, if the last was one
+}
+
+// next reads the next entry's header from tr, checking that the archive
+// stays within the limits as far as the headers tell. It returns io.EOF
+// at the end of the archive.
+func (t *tally) next(tr *tar.Reader) (*tar.Header, error) {
+	hdr, err := tr.Next()
+	if errors.Is(err, io.EOF) || errors.Is(err, wire.ErrExpansion) {
+		return nil, err
+	}
+	if err != nil {
+		// What follows a file holding more than its header says is read
+		// as the next header
+		if t.last != nil && errors.Is(err, tar.ErrHeader) {
+			return nil, fmt.Errorf("%w: entry %q holds more than the %d bytes its header says", wire.ErrExpansion, t.last.Name, t.last.Size)
+		}
+		return nil, fmt.Errorf("error reading archive: %w", err)
+	}
+	t.last = nil
+	if t.entries++; t.entries > t.limits.MaxEntries {
+		return nil, fmt.Errorf("%w: more than %d entries", wire.ErrExpansion, t.limits.MaxEntries)
+	}
+	// Checked before anything is written, as the header is what the entry
+	// must then hold
+	if hdr.Typeflag == tar.TypeReg {
+		if t.limits.MaxEntry > 0 && hdr.Size > t.limits.MaxEntry {
+			return nil, fmt.Errorf("%w: entry %q is %d bytes, the limit is %d", wire.ErrExpansion, hdr.Name, hdr.Size, t.limits.MaxEntry)
+		}
+		if t.total += hdr.Size; t.total > t.limits.MaxTotal {
+			return nil, fmt.Errorf("%w: entries up to %q total %d bytes, the limit is %d", wire.ErrExpansion, hdr.Name, t.total, t.limits.MaxTotal)
+		}
+	}
+	return hdr, nil
+}
+
+// file copies the contents of the regular file entry hdr from r to w. The
+// tar reader stops at the size its header says, and a stream ending before
+// it fails with wire.ErrExpansion.
+func (t *tally) file(w io.Writer, r io.Reader, hdr *tar.Header) error {
+	n, err := io.Copy(w, io.LimitReader(r, hdr.Size+1))
+	if errors.Is(err, io.ErrUnexpectedEOF) || err == nil && n != hdr.Size {
+		return fmt.Errorf("%w: entry %q holds %d bytes, its header says %d", wire.ErrExpansion, hdr.Name, n, hdr.Size)
+	}
+	if err == nil {
+		t.last = hdr
+	}
+	return err
+}
+
+// unpack writes the entries of the tar stream r under root, within limits.
+func unpack(r io.Reader, root string, reserve int64, limits Limits) (int, error) {
+	tr := tar.NewReader(r)
+	t := tally{limits: limits}
+	files := 0
+	for {
+		hdr, err := t.next(tr)
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return files, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name, err := entryPath(hdr.Name)
+		if err != nil {
+			return files, err
+		}
+		if name == "." {
+			continue
+		}
+		target := filepath.Join(root, filepath.FromSlash(name))
+		if err := wire.CheckNoSymlinks(root, target); err != nil {
+			return files, fmt.Errorf("archive entry %q: %w", hdr.Name, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return files, fmt.Errorf("error extracting archive: %w", err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = prealloc.Check(root, hdr.Size, reserve)
+			if err == nil {
+				err = t.writeFile(target, tr, hdr)
+			}
+			if errors.Is(err, wire.ErrExpansion) {
+				return files, err
+			}
+			files++
+		case tar.TypeSymlink:
+			if !linkInside(path.Dir(name), hdr.Linkname) {
+				return files, fmt.Errorf("archive entry %q links outside the archive to %q", hdr.Name, hdr.Linkname)
+			}
+			os.Remove(target)
+			err = os.Symlink(hdr.Linkname, target)
+		case tar.TypeLink:
+			// Hard links name an entry unpacked before them
+			var old string
+			old, err = entryPath(hdr.Linkname)
+			if err != nil {
+				return files, err
+			}
+			src := filepath.Join(root, filepath.FromSlash(old))
+			if err := wire.CheckNoSymlinks(root, src); err != nil {
+				return files, fmt.Errorf("archive entry %q: %w", hdr.Name, err)
+			}
+			if info, serr := os.Lstat(src); serr != nil || !info.Mode().IsRegular() {
+				return files, fmt.Errorf("archive entry %q links to %q, which isn't a file in the archive", hdr.Name, hdr.Linkname)
+			}
+			os.Remove(target)
+			err = os.Link(src, target)
+			files++
+		default:
+			return files, fmt.Errorf("archive entry %q is a device or other special file, which isn't unpacked", hdr.Name)
+		}
+		if err != nil {
+			return files, prealloc.NoSpace(fmt.Errorf("error extracting %q: %w", hdr.Name, err))
+		}
+	}
+}
+
+// entryPath cleans the slash-separated path of an archive entry, refusing
+// one that is absolute, has a ".." component or one the server wouldn't
+// accept as a file name.
+func entryPath(name string) (string, error) {
+	if path.IsAbs(name) || strings.Contains("/"+name+"/", "/../") {
+		return "", fmt.Errorf("archive entry %q leads outside the archive", name)
+	}
+	clean := path.Clean(name)
+	if clean == "." {
+		return clean, nil
+	}
+	for _, part := range strings.Split(clean, "/") {
+		if err := wire.CheckName(part); err != nil {
+			return "", fmt.Errorf("archive entry %q: %w", name, err)
+		}
+	}
+	return clean, nil
+}
+
+// linkInside reports whether the symlink target, resolved from dir, the
+// directory of the link, stays under the root. ".." may only lead the
+// target: after another component it could climb out of a directory that
+// is itself a symlink.
+func linkInside(dir, target string) bool {
+	if target == "" || path.IsAbs(target) {
+		return false
+	}
+	up, down := 0, false
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if down {
+				return false
+			}
+			up++
+		default:
+			down = true
+		}
+	}
+	depth := 0
+	if dir != "." {
+		depth = strings.Count(dir, "/") + 1
+	}
+	return up <= depth
+}
+
+// writeFile writes the contents of a regular file entry to target, which
+// must hold exactly the size its header says, see file.
+func (t *tally) writeFile(target string, r io.Reader, hdr *tar.Header) error {
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = t.file(file, r, hdr)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// replace renames the directory tmp to dest, moving a directory already at
+// dest aside first and removing it once tmp is in place.
+func replace(tmp, dest string) error {
+	info, err := os.Lstat(dest)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.Rename(tmp, dest)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("can't extract archive: %s exists and isn't a directory", dest)
+	}
+	old := tmp + ".old"
+	if err := os.Rename(dest, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Rename(old, dest)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// budgetReader reads from r until left bytes are read, then fails with
+// wire.ErrExpansion rather than decompress any further.
+type budgetReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, fmt.Errorf("%w: the decompressed archive is larger than its limits allow", wire.ErrExpansion)
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.r.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,276 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// entry is a tar entry writeTar writes: a file holding body unless typ
+// says otherwise.
+type entry struct {
+	name, body, link string
+	typ              byte
+}
+
+// writeTar writes entries as an archive called name, gzipped for a .tar.gz
+// or .tgz, and returns its path.
+func writeTar(t *testing.T, name string, entries []entry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	_, gz, _ := Split(name)
+	var zw *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if gz {
+		zw = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(zw)
+	}
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Linkname: e.link, Mode: 0644}
+		if e.typ == 0 {
+			hdr.Typeflag, hdr.Size = tar.TypeReg, int64(len(e.body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.body))
+	}
+	tw.Close()
+	if zw != nil {
+		zw.Close()
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkFiles fails the test unless each file under dir holds what want
+// says.
+func checkFiles(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	for name, body := range want {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil || string(got) != body {
+			t.Errorf("%s = %q, %v, want %q", name, got, err, body)
+		}
+	}
+}
+
+// What Write packs, Check passes and Extract unpacks, gzipped or not.
+func TestWriteExtract(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{"a.txt": "a", "sub/b.txt": "bb", "sub/deeper/c.txt": "ccc"}
+	for name, body := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(body), 0644)
+	}
+	os.Symlink("a.txt", filepath.Join(src, "link"))
+
+	for _, gz := range []bool{false, true} {
+		t.Run(Name("tree", gz), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), Name(src, gz))
+			file, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := Write(file, src, gz, nil)
+			file.Close()
+			if err != nil || n != len(files) {
+				t.Fatalf("Write: %d files, %v, want %d", n, err, len(files))
+			}
+
+			if err := Check(path, gz, Limits{}); err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			dest := filepath.Join(t.TempDir(), "tree")
+			if n, err := Extract(path, dest, 0, Limits{}); err != nil || n != len(files) {
+				t.Fatalf("Extract: %d files, %v, want %d", n, err, len(files))
+			}
+			checkFiles(t, dest, files)
+			if _, err := os.Lstat(filepath.Join(dest, "link")); err == nil {
+				t.Error("symlink archived")
+			}
+		})
+	}
+}
+
+// Links inside the archive are unpacked, and extracting again replaces
+// what the directory held.
+func TestExtractLinks(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "site")
+	os.MkdirAll(dest, 0755)
+	os.WriteFile(filepath.Join(dest, "stale"), []byte("old"), 0644)
+
+	path := writeTar(t, "site.tgz", []entry{
+		{name: "dir/", typ: tar.TypeDir},
+		{name: "dir/f", body: "f"},
+		{name: "dir/sym", typ: tar.TypeSymlink, link: "f"},
+		{name: "up", typ: tar.TypeSymlink, link: "dir/f"},
+		{name: "hard", typ: tar.TypeLink, link: "dir/f"},
+	})
+	if _, err := Extract(path, dest, 0, Limits{}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dest, map[string]string{"dir/sym": "f", "up": "f", "hard": "f"})
+	if _, err := os.Stat(filepath.Join(dest, "stale")); err == nil {
+		t.Error("file from before the extraction left in place")
+	}
+}
+
+// An archive with any entry reaching outside its directory, or a device
+// node, fails as a whole, leaving nothing unpacked.
+func TestExtractMalicious(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []entry
+	}{
+		{"dot dot", []entry{{name: "ok", body: "ok"}, {name: "../evil", body: "evil"}}},
+		{"nested dot dot", []entry{{name: "a/../../evil", body: "evil"}}},
+		{"absolute path", []entry{{name: "/tmp/evil", body: "evil"}}},
+		{"absolute symlink", []entry{{name: "etc", typ: tar.TypeSymlink, link: "/etc"}}},
+		{"symlink climbing out", []entry{{name: "a/up", typ: tar.TypeSymlink, link: "../../evil"}}},
+		{"write through symlink", []entry{
+			{name: "dir/", typ: tar.TypeDir},
+			{name: "link", typ: tar.TypeSymlink, link: "dir"},
+			{name: "link/evil", body: "evil"},
+		}},
+		{"hard link outside", []entry{{name: "hard", typ: tar.TypeLink, link: "../evil"}}},
+		{"hard link to nothing", []entry{{name: "hard", typ: tar.TypeLink, link: "missing"}}},
+		{"character device", []entry{{name: "null", typ: tar.TypeChar}}},
+		{"fifo", []entry{{name: "fifo", typ: tar.TypeFifo}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTar(t, "bad.tar", tt.entries)
+			parent := t.TempDir()
+			os.WriteFile(filepath.Join(parent, "evil"), []byte("untouched"), 0644)
+
+			if _, err := Extract(path, filepath.Join(parent, "bad"), 0, Limits{}); err == nil {
+				t.Fatal("malicious archive extracted")
+			}
+			names, _ := os.ReadDir(parent)
+			if len(names) != 1 || names[0].Name() != "evil" {
+				t.Errorf("left %v next to the archive, want just evil", names)
+			}
+			checkFiles(t, parent, map[string]string{"evil": "untouched"})
+		})
+	}
+}
+
+// rawTar writes an archive called name holding the tar stream of write,
+// which it doesn't close, and returns its path.
+func rawTar(t *testing.T, name string, write func(tw *tar.Writer)) string {
+	t.Helper()
+	var buf bytes.Buffer
+	write(tar.NewWriter(&buf))
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Archives expanding past the limits, or whose headers misstate what
+// their entries hold, fail Check and Extract with ErrExpansion, leaving
+// nothing unpacked.
+// testdata/bomb.tar.gz is 64 KiB gzipping a 64 MiB file of zeros, and
+// testdata/lying-size.tar a 16-byte file by its header followed by 8 KiB.
+func TestExtractExpansion(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   func(t *testing.T) string
+		limits Limits
+	}{
+		{"bomb past the entry limit", func(*testing.T) string { return filepath.Join("testdata", "bomb.tar.gz") }, Limits{MaxEntry: 1 << 20}},
+		{"bomb past the total", func(*testing.T) string { return filepath.Join("testdata", "bomb.tar.gz") }, Limits{MaxTotal: 1 << 20}},
+		{"header past the default total", func(t *testing.T) string {
+			return rawTar(t, "huge.tar", func(tw *tar.Writer) {
+				tw.WriteHeader(&tar.Header{Name: "huge", Typeflag: tar.TypeReg, Mode: 0644, Size: DefaultMaxTotal + 1})
+			})
+		}, Limits{}},
+		{"size understated", func(*testing.T) string { return filepath.Join("testdata", "lying-size.tar") }, Limits{}},
+		{"size overstated", func(t *testing.T) string {
+			return rawTar(t, "short.tar", func(tw *tar.Writer) {
+				tw.WriteHeader(&tar.Header{Name: "short", Typeflag: tar.TypeReg, Mode: 0644, Size: 1000})
+				tw.Write([]byte("ten bytes."))
+			})
+		}, Limits{}},
+		{"too many entries", func(t *testing.T) string {
+			return writeTar(t, "many.tar", []entry{{name: "a", body: "a"}, {name: "b", body: "b"}, {name: "c", body: "c"}})
+		}, Limits{MaxEntries: 2}},
+		{"headers past the stream budget", func(t *testing.T) string {
+			return rawTar(t, "pax.tar", func(tw *tar.Writer) {
+				tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0644, PAXRecords: map[string]string{"comment": strings.Repeat("x", 64<<10)}, Format: tar.FormatPAX})
+				tw.Close()
+			})
+		}, Limits{MaxTotal: 1024, MaxEntries: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path(t)
+			_, gz, _ := Split(filepath.Base(path))
+			if err := Check(path, gz, tt.limits); !errors.Is(err, wire.ErrExpansion) {
+				t.Errorf("Check: got %v, want ErrExpansion", err)
+			}
+			parent := t.TempDir()
+			_, err := Extract(path, filepath.Join(parent, "bomb"), 0, tt.limits)
+			if !errors.Is(err, wire.ErrExpansion) {
+				t.Fatalf("got %v, want ErrExpansion", err)
+			}
+			if names, _ := os.ReadDir(parent); len(names) != 0 {
+				t.Errorf("left %v behind", names)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name, dir string
+		gz, ok    bool
+	}{
+		{"site.tar", "site", false, true},
+		{"site.tar.gz", "site", true, true},
+		{"site.TGZ", "site", true, true},
+		{"site.gz", "", false, false},
+		{".tar", "", false, false},
+		{"notes.txt", "", false, false},
+	}
+	for _, tt := range tests {
+		dir, gz, ok := Split(tt.name)
+		if dir != tt.dir || gz != tt.gz || ok != tt.ok {
+			t.Errorf("Split(%q) = %q, %v, %v, want %q, %v, %v", tt.name, dir, gz, ok, tt.dir, tt.gz, tt.ok)
+		}
+	}
+}
+
+func TestLinkInside(t *testing.T) {
+	tests := []struct {
+		dir, target string
+		want        bool
+	}{
+		{".", "f", true},
+		{".", "../f", false},
+		{"a", "../f", true},
+		{"a", "../../f", false},
+		{"a/b", "../../f", true},
+		{".", "a/../f", false},
+		{".", "/etc", false},
+		{".", "", false},
+	}
+	for _, tt := range tests {
+		if got := linkInside(tt.dir, tt.target); got != tt.want {
+			t.Errorf("linkInside(%q, %q) = %v, want %v", tt.dir, tt.target, got, tt.want)
+		}
+	}
+}
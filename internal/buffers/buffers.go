@@ -0,0 +1,29 @@
+// Package buffers pools the large buffers transfers are read into and
+// written from, so a busy server reuses them across transfers rather than
+// allocating them anew for each: the TCP server's, those of
+// checksum.Pipe and the UDP server's disk writes. Each size has a pool of
+// its own, so users of different sizes don't drop each other's buffers.
+package buffers
+
+import "sync"
+
+// Pools by buffer size
+var pools sync.Map // int -> *sync.Pool
+
+// Get returns a pooled buffer of size bytes.
+func Get(size int) *[]byte {
+	if p, ok := pools.Load(size); ok {
+		if b, ok := p.(*sync.Pool).Get().(*[]byte); ok {
+			return b
+		}
+	}
+	b := make([]byte, size)
+	return &b
+}
+
+// Put returns b, from Get and of the length it had, to its pool. It must
+// not be used afterwards.
+func Put(b *[]byte) {
+	p, _ := pools.LoadOrStore(len(*b), new(sync.Pool))
+	p.(*sync.Pool).Put(b)
+}
@@ -0,0 +1,38 @@
+package buffers
+
+import "testing"
+
+// Buffers come in the size asked for, and one returned to the pool is only
+// handed out again for its own size.
+func TestGetPut(t *testing.T) {
+	for _, size := range []int{1000, 64 << 10, 1 << 20} {
+		b := Get(size)
+		if len(*b) != size {
+			t.Fatalf("asked for %d bytes, got %d", size, len(*b))
+		}
+		Put(b)
+	}
+
+	small := Get(1000)
+	Put(small)
+	for i := 0; i < 10; i++ {
+		if b := Get(2000); len(*b) != 2000 {
+			t.Fatalf("asked for 2000 bytes, got %d", len(*b))
+		}
+	}
+}
+
+// A buffer put back is handed out again, rather than a new one allocated.
+func TestReuse(t *testing.T) {
+	const size = 12345
+	reused := false
+	// The race detector drops some of what is put back
+	for i := 0; i < 20 && !reused; i++ {
+		b := Get(size)
+		Put(b)
+		reused = Get(size) == b
+	}
+	if !reused {
+		t.Error("buffers put back never handed out again")
+	}
+}
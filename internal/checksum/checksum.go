@@ -0,0 +1,119 @@
+// Package checksum provides the hashes a TCP client and server may check a
+// transfer with, negotiated through hello features. SHA-256 is the default
+// and what the server's own bookkeeping, such as skip-identical sidecars,
+// dedupe, layouts and hooks, is built on. BLAKE3 is as strong and cheaper
+// on large files; XXH3 and CRC-32C are cheaper still but only catch
+// corruption, not tampering. CRC-32C uses the Castagnoli table, which
+// hash/crc32 computes with SSE4.2 or ARM64 CRC instructions where present.
+package checksum
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+
+	"github.com/zeebo/xxh3"
+	"lukechampine.com/blake3"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// Algorithm identifies a hash.
+type Algorithm byte
+
+const (
+	SHA256 Algorithm = iota
+	BLAKE3
+	XXH3
+	CRC32C
+)
+
+// All algorithms, strongest first
+var Algorithms = []Algorithm{SHA256, BLAKE3, XXH3, CRC32C}
+
+// The hello features of all algorithms
+const FEATURES = wire.FEATURE_HASH_SHA256 | wire.FEATURE_HASH_BLAKE3 | wire.FEATURE_HASH_XXH3 | wire.FEATURE_HASH_CRC32C
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Parse parses an algorithm's name as String returns it.
+func Parse(s string) (Algorithm, error) {
+	for _, a := range Algorithms {
+		if s == a.String() {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash %q, want sha256, blake3, xxh3 or crc32c", s)
+}
+
+func (a Algorithm) String() string {
+	switch a {
+	case SHA256:
+		return "sha256"
+	case BLAKE3:
+		return "blake3"
+	case XXH3:
+		return "xxh3"
+	case CRC32C:
+		return "crc32c"
+	}
+	return fmt.Sprintf("Algorithm(%d)", int(a))
+}
+
+// New returns a new hash of the algorithm.
+func (a Algorithm) New() hash.Hash {
+	switch a {
+	case BLAKE3:
+		return blake3.New(32, nil)
+	case XXH3:
+		return xxh3.New()
+	case CRC32C:
+		return crc32.New(castagnoli)
+	}
+	return sha256.New()
+}
+
+// Size returns the length in bytes of the algorithm's digests.
+func (a Algorithm) Size() int {
+	switch a {
+	case XXH3:
+		return 8
+	case CRC32C:
+		return crc32.Size
+	}
+	return 32
+}
+
+// Feature returns the hello feature that offers the algorithm.
+func (a Algorithm) Feature() uint32 {
+	switch a {
+	case BLAKE3:
+		return wire.FEATURE_HASH_BLAKE3
+	case XXH3:
+		return wire.FEATURE_HASH_XXH3
+	case CRC32C:
+		return wire.FEATURE_HASH_CRC32C
+	}
+	return wire.FEATURE_HASH_SHA256
+}
+
+// Offer returns the hello features a client that wants a transfer checked
+// with a offers: a's and SHA-256's, so a server without a falls back to
+// SHA-256, the strongest hash every peer has.
+func Offer(a Algorithm) uint32 {
+	return a.Feature() | wire.FEATURE_HASH_SHA256
+}
+
+// Negotiated returns the algorithm a transfer is checked with given the
+// features both peers support: the one other than SHA-256 if there is
+// one, since only the client's choice can be, else SHA-256. ok is false
+// if the peers share none, and the transfer goes unchecked.
+func Negotiated(features uint32) (a Algorithm, ok bool) {
+	for _, a := range Algorithms[1:] {
+		if features&a.Feature() != 0 {
+			return a, true
+		}
+	}
+	return SHA256, features&wire.FEATURE_HASH_SHA256 != 0
+}
@@ -0,0 +1,123 @@
+package checksum
+
+import (
+	"io"
+	"runtime"
+
+	"socket-file-transfer/internal/buffers"
+)
+
+// Buffers of a Pipe: one being filled, one being sent or stored, the rest
+// queued for the hash
+const PIPE_DEPTH = 4
+
+// Pipe feeds a hash from a goroutine of its own, so hashing a chunk
+// overlaps with sending or storing it and reading the next one. Chunks
+// are read into the Pipe's buffers, see Next, which are reused once
+// hashed and come from the pool of package buffers. With a single CPU
+// there is nothing to overlap, and a Pipe hashes each chunk as it is
+// written. A Pipe is not safe for concurrent use.
+type Pipe struct {
+	w      io.Writer // The hash
+	chunks chan pipeChunk
+	free   chan []byte // Buffers hashed
+	done   chan struct{}
+	last   []byte // Returned by Next, not yet written
+	closed bool
+	pooled []*[]byte // Its buffers, until Close returns them
+}
+
+// pipeChunk is a chunk to hash, or with flushed set a request to signal
+// once the chunks before it are hashed.
+type pipeChunk struct {
+	data    []byte
+	buf     []byte // data belongs to, to free once hashed
+	flushed chan struct{}
+}
+
+// NewPipe returns a Pipe to w, usually a hash.Hash, with PIPE_DEPTH
+// buffers of size bytes.
+func NewPipe(w io.Writer, size int) *Pipe {
+	p := &Pipe{
+		w:      w,
+		chunks: make(chan pipeChunk, PIPE_DEPTH),
+		free:   make(chan []byte, PIPE_DEPTH),
+		done:   make(chan struct{}),
+	}
+	if runtime.GOMAXPROCS(0) == 1 {
+		p.pooled = []*[]byte{buffers.Get(size)}
+		p.last, p.closed = *p.pooled[0], true
+		return p
+	}
+	for i := 0; i < PIPE_DEPTH; i++ {
+		b := buffers.Get(size)
+		p.pooled = append(p.pooled, b)
+		p.free <- *b
+	}
+	go p.run()
+	return p
+}
+
+func (p *Pipe) run() {
+	defer close(p.done)
+	for c := range p.chunks {
+		if c.flushed != nil {
+			close(c.flushed)
+			continue
+		}
+		p.w.Write(c.data)
+		p.free <- c.buf
+	}
+}
+
+// Next returns a buffer to read the next chunk into, waiting for one the
+// hash is done with.
+func (p *Pipe) Next() []byte {
+	if p.last != nil {
+		// Never written, so still ours
+		return p.last
+	}
+	p.last = <-p.free
+	return p.last
+}
+
+// Write queues b for the hash if it starts the buffer Next returned last,
+// which the caller must then leave alone until Next returns it again; any
+// other b is hashed before Write returns, after the chunks queued.
+func (p *Pipe) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if !p.closed && p.last != nil && &b[0] == &p.last[0] {
+		p.chunks <- pipeChunk{data: b, buf: p.last}
+		p.last = nil
+		return len(b), nil
+	}
+	p.Flush()
+	return p.w.Write(b)
+}
+
+// Flush waits until every chunk written is hashed.
+func (p *Pipe) Flush() {
+	if p.closed {
+		return
+	}
+	flushed := make(chan struct{})
+	p.chunks <- pipeChunk{flushed: flushed}
+	<-flushed
+}
+
+// Close flushes p, stops its goroutine and returns its buffers to the
+// pool, so Next must not be called afterwards. It may be called more than
+// once; p then hashes whatever is written to it before Write returns.
+func (p *Pipe) Close() {
+	if !p.closed {
+		close(p.chunks)
+		<-p.done
+		p.closed = true
+	}
+	for _, b := range p.pooled {
+		buffers.Put(b)
+	}
+	p.pooled, p.last = nil, nil
+}
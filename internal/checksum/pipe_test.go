@@ -0,0 +1,161 @@
+package checksum
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/buffers"
+)
+
+// Chunks read into the Pipe's buffers, and slices of other memory, are
+// hashed in the order written, with one CPU or several.
+func TestPipe(t *testing.T) {
+	data := make([]byte, 1<<20+77)
+	rand.Read(data)
+	want := sha256.Sum256(data)
+	for _, procs := range []int{1, 4} {
+		t.Run(fmt.Sprint("GOMAXPROCS=", procs), func(t *testing.T) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			h := sha256.New()
+			p := NewPipe(h, 64<<10)
+			r := bytes.NewReader(data)
+			for i := 0; r.Len() > 0; i++ {
+				if i%5 == 4 {
+					// Not the Pipe's, so hashed in line
+					other := make([]byte, 1000)
+					n, _ := r.Read(other)
+					p.Write(other[:n])
+					continue
+				}
+				buf := p.Next()
+				n, _ := r.Read(buf)
+				p.Write(buf[:n])
+			}
+			p.Flush()
+			if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+				t.Errorf("digest %x, want %x", got, want)
+			}
+			p.Close()
+			p.Close()
+			p.Write([]byte("after Close"))
+			if got := h.Sum(nil); bytes.Equal(got, want[:]) {
+				t.Error("write after Close not hashed")
+			}
+		})
+	}
+}
+
+// sendLoopback sends size bytes over conn in chunks of len(src), as the
+// TCP client's send loop does, hashing them through a Pipe to h unless h
+// is nil, and returns how long it took.
+func sendLoopback(b *testing.B, conn net.Conn, src []byte, size int64, h hash.Hash) time.Duration {
+	start := time.Now()
+	var p *Pipe
+	if h != nil {
+		p = NewPipe(h, len(src))
+		defer p.Close()
+	}
+	buf := src
+	for sent := int64(0); sent < size; sent += int64(len(src)) {
+		if p != nil {
+			buf = p.Next()
+		}
+		// Standing in for reading the file
+		copy(buf, src)
+		if p != nil {
+			p.Write(buf)
+		}
+		if _, err := conn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if p != nil {
+		p.Flush()
+		h.Sum(nil)
+	}
+	return time.Since(start)
+}
+
+// What hashing adds to sending 1 GiB over loopback, with each algorithm:
+// each op sends it once without a hash and once with, and overhead-% is
+// the difference. The hash runs alongside sending with more than one CPU.
+func BenchmarkPipeOverhead(b *testing.B) {
+	const size = 1 << 30
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	src := make([]byte, 256<<10)
+	rand.Read(src)
+
+	for _, algo := range Algorithms {
+		b.Run(algo.String(), func(b *testing.B) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			b.SetBytes(2 * size)
+			var plain, hashed time.Duration
+			for i := 0; i < b.N; i++ {
+				plain += sendLoopback(b, conn, src, size, nil)
+				hashed += sendLoopback(b, conn, src, size, algo.New())
+			}
+			b.ReportMetric(100*(hashed.Seconds()/plain.Seconds()-1), "overhead-%")
+		})
+	}
+}
+
+// Transfers of 1 MiB hashed through a Pipe, whose buffers come from the
+// pool, against the same with the pool emptied after each, so each Pipe
+// allocates its buffers anew as it did before there was one. CRC-32C is
+// fast enough to leave what the buffers cost in view.
+func BenchmarkPipeBuffers(b *testing.B) {
+	const size, chunk = 1 << 20, 256 << 10
+	src := make([]byte, chunk)
+	rand.Read(src)
+	for _, pooled := range []bool{true, false} {
+		b.Run(map[bool]string{true: "pooled", false: "unpooled"}[pooled], func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p := NewPipe(CRC32C.New(), chunk)
+				for sent := 0; sent < size; sent += chunk {
+					buf := p.Next()
+					copy(buf, src)
+					p.Write(buf)
+				}
+				p.Flush()
+				used := len(p.pooled)
+				p.Close()
+				if !pooled {
+					// Taking back what Close returned
+					for j := 0; j < used; j++ {
+						buffers.Get(chunk)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+// Package codes stages files under short codes such as 7-frog-apple,
+// which a sender reads out and a receiver types to fetch the file, see
+// 'transfer send -code' and 'transfer receive'.
+//
+// A code is a number up to MAX_NUMBER and WORDS words from a list of 256,
+// drawn at random until it differs from those pending. Staged files are
+// kept in DIR in the upload directory, out of listings and retention,
+// with the codes in its INDEX file, rewritten on every change, so they
+// survive a restart. A code fetches its file Uses times, once by default,
+// before its file is removed; codes that expire are swept every
+// retention.INTERVAL along with their files. Each client gets
+// MAX_FAILURES wrong codes per FAILURE_WINDOW, which keeps guessing codes
+// slow.
+package codes
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/retention"
+	"socket-file-transfer/internal/wire"
+)
+
+// Directory in the upload directory that holds the staged files
+const DIR = ".pending"
+
+// Name of the code file in DIR
+const INDEX = "codes.json"
+
+// How long a code lasts by default
+const DefaultTTL = time.Hour
+
+// Shape of a code: a number from 1 to MAX_NUMBER, then WORDS words
+const (
+	MAX_NUMBER = 999
+	WORDS      = 2
+)
+
+// Wrong codes a client may try per FAILURE_WINDOW
+const (
+	MAX_FAILURES   = 10
+	FAILURE_WINDOW = time.Minute
+)
+
+// ErrUnknown is returned for a code that was never issued, expired or was
+// used up.
+var ErrUnknown = fmt.Errorf("%w: unknown, expired or used code", wire.ErrNotFound)
+
+// ErrTooManyFailures is returned to a client that tried too many wrong
+// codes, until FAILURE_WINDOW passed.
+var ErrTooManyFailures = fmt.Errorf("%w: too many wrong codes, try again later", wire.ErrRejected)
+
+// Pending is a staged file.
+type Pending struct {
+	Name    string    `json:"name"` // As the sender named it
+	Size    int64     `json:"size"`
+	File    string    `json:"file"` // Under Dir
+	Expires time.Time `json:"expires"`
+	Uses    int       `json:"uses"` // Fetches left
+}
+
+// Store holds the files staged under Dir.
+type Store struct {
+	Dir  string
+	TTL  time.Duration // How long a code lasts
+	Uses int           // How many fetches it allows
+	Log  *slog.Logger
+
+	mu       sync.Mutex
+	pending  map[string]Pending
+	claimed  map[string]int // Fetches under way, by code
+	failures map[string]*failures
+}
+
+// failures counts a client's wrong codes.
+type failures struct {
+	count int
+	since time.Time
+}
+
+// Open returns the store of the files staged in root's DIR, loading those
+// a previous run left.
+func Open(root string, ttl time.Duration, uses int, log *slog.Logger) (*Store, error) {
+	s := &Store{
+		Dir:      filepath.Join(root, DIR),
+		TTL:      ttl,
+		Uses:     uses,
+		Log:      log,
+		pending:  make(map[string]Pending),
+		claimed:  make(map[string]int),
+		failures: make(map[string]*failures),
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", root, err)
+	}
+	if err := os.Mkdir(s.Dir, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("error creating %s: %w", s.Dir, err)
+	}
+	data, err := os.ReadFile(s.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading codes: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.pending); err != nil {
+		return nil, fmt.Errorf("error reading codes %s: %w", s.path(), err)
+	}
+	if s.pending == nil {
+		s.pending = make(map[string]Pending)
+	}
+	return s, nil
+}
+
+func (s *Store) path() string {
+	return filepath.Join(s.Dir, INDEX)
+}
+
+// Normalize returns code as issued, ignoring case and accepting spaces
+// between its parts.
+func Normalize(code string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(strings.ToLower(code), "-", " ")), "-")
+}
+
+// generate returns a random code.
+func generate() (string, error) {
+	b := make([]byte, 2+WORDS)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	parts := []string{fmt.Sprint(1 + int(binary.BigEndian.Uint16(b))%MAX_NUMBER)}
+	for _, w := range b[2:] {
+		parts = append(parts, words[w])
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// Create returns a new file in Dir to receive a file into before Add
+// stages it. The caller closes it, and removes it unless added.
+func (s *Store) Create() (*os.File, error) {
+	return os.CreateTemp(s.Dir, ".incoming-*")
+}
+
+// Add stages the file at tmp, from Create, as name of size bytes, and
+// returns its new code, lasting TTL for Uses fetches.
+func (s *Store) Add(tmp, name string, size int64) (string, Pending, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", Pending{}, err
+	}
+	p := Pending{Name: name, Size: size, File: hex.EncodeToString(b), Expires: time.Now().Add(s.TTL), Uses: s.Uses}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var code string
+	for {
+		var err error
+		if code, err = generate(); err != nil {
+			return "", Pending{}, err
+		}
+		if _, taken := s.pending[code]; !taken {
+			break
+		}
+	}
+	if err := os.Rename(tmp, filepath.Join(s.Dir, p.File)); err != nil {
+		return "", Pending{}, fmt.Errorf("error staging file: %w", err)
+	}
+	s.pending[code] = p
+	if err := s.save(); err != nil {
+		delete(s.pending, code)
+		os.Remove(filepath.Join(s.Dir, p.File))
+		return "", Pending{}, err
+	}
+	return code, p, nil
+}
+
+// Claim uses up one fetch of code for client, returning its file and the
+// path it is staged at. The caller then calls Done once the file was
+// fetched, or Release if it wasn't. A client that tried too many wrong
+// codes fails with ErrTooManyFailures, even for a right one.
+func (s *Store) Claim(code, client string) (Pending, string, error) {
+	code = Normalize(code)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.failures[client]
+	if f != nil && time.Since(f.since) > FAILURE_WINDOW {
+		delete(s.failures, client)
+		f = nil
+	}
+	if f != nil && f.count >= MAX_FAILURES {
+		return Pending{}, "", ErrTooManyFailures
+	}
+	p, ok := s.pending[code]
+	if !ok || time.Now().After(p.Expires) || p.Uses <= 0 {
+		if f == nil {
+			f = &failures{since: time.Now()}
+			s.failures[client] = f
+		}
+		f.count++
+		return Pending{}, "", ErrUnknown
+	}
+
+	p.Uses--
+	s.pending[code] = p
+	// A fetch that can't be recorded isn't served, or a restart would
+	// allow it again
+	if err := s.save(); err != nil {
+		p.Uses++
+		s.pending[code] = p
+		return Pending{}, "", err
+	}
+	s.claimed[code]++
+	return p, filepath.Join(s.Dir, p.File), nil
+}
+
+// Release gives back the fetch a failed Claim of code used up.
+func (s *Store) Release(code string) {
+	code = Normalize(code)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unclaim(code)
+	p, ok := s.pending[code]
+	if !ok {
+		return
+	}
+	p.Uses++
+	s.pending[code] = p
+	if err := s.save(); err != nil {
+		s.Log.Error("Error releasing code", "err", err)
+	}
+}
+
+// Done ends a Claim of code whose file was fetched, removing the file if
+// that was its last fetch.
+func (s *Store) Done(code string) {
+	code = Normalize(code)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unclaim(code)
+	if p, ok := s.pending[code]; ok && p.Uses <= 0 && s.claimed[code] == 0 {
+		s.remove(code, p)
+		if err := s.save(); err != nil {
+			s.Log.Error("Error saving codes", "err", err)
+		}
+	}
+}
+
+func (s *Store) unclaim(code string) {
+	if s.claimed[code]--; s.claimed[code] <= 0 {
+		delete(s.claimed, code)
+	}
+}
+
+// remove forgets code and removes its file.
+func (s *Store) remove(code string, p Pending) {
+	delete(s.pending, code)
+	if err := os.Remove(filepath.Join(s.Dir, p.File)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.Log.Warn("Error removing staged file", "name", p.Name, "err", err)
+	}
+}
+
+// Sweep removes the files whose code expired or was used up, forgets the
+// codes whose file is gone, and removes files left in Dir by uploads that
+// never finished.
+func (s *Store) Sweep() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	swept := 0
+	known := map[string]bool{INDEX: true, INDEX + ".tmp": true}
+	for code, p := range s.pending {
+		known[p.File] = true
+		if s.claimed[code] > 0 {
+			continue
+		}
+		_, err := os.Lstat(filepath.Join(s.Dir, p.File))
+		if now.After(p.Expires) || p.Uses <= 0 || errors.Is(err, os.ErrNotExist) {
+			s.Log.Info("Removing unclaimed file", "name", p.Name, "expired", p.Expires.Format(time.RFC3339))
+			s.remove(code, p)
+			swept++
+		}
+	}
+	for client, f := range s.failures {
+		if now.Sub(f.since) > FAILURE_WINDOW {
+			delete(s.failures, client)
+		}
+	}
+
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return fmt.Errorf("error listing %s: %w", s.Dir, err)
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		// Uploads under way keep their file modified
+		if err != nil || known[e.Name()] || now.Sub(info.ModTime()) < s.TTL {
+			continue
+		}
+		os.Remove(filepath.Join(s.Dir, e.Name()))
+	}
+
+	if swept == 0 {
+		return nil
+	}
+	return s.save()
+}
+
+// Run sweeps the staged files every retention.INTERVAL until ctx ends.
+func (s *Store) Run(ctx context.Context) error {
+	ticker := time.NewTicker(retention.INTERVAL)
+	defer ticker.Stop()
+	for {
+		if err := s.Sweep(); err != nil {
+			s.Log.Error("Error sweeping staged files", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// save writes the codes, replacing the previous file in a single rename
+// so a crash leaves either version intact. Only the server may read it.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("error saving codes: %w", err)
+	}
+	if err := os.Rename(tmp, s.path()); err != nil {
+		return fmt.Errorf("error saving codes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package codes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// open returns a store in a temporary upload directory.
+func open(t *testing.T, ttl time.Duration, uses int) *Store {
+	t.Helper()
+	s, err := Open(t.TempDir(), ttl, uses, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// stage stages data as name, returning its code and staged path.
+func stage(t *testing.T, s *Store, name, data string) (string, string) {
+	t.Helper()
+	f, err := s.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(data)
+	f.Close()
+	code, p, err := s.Add(f.Name(), name, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, filepath.Join(s.Dir, p.File)
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"7-frog-apple", "7-frog-apple"},
+		{"7-FROG-Apple", "7-frog-apple"},
+		{"7 frog apple", "7-frog-apple"},
+		{"  7  frog - apple ", "7-frog-apple"},
+		{"7--frog-apple", "7-frog-apple"},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.in); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// Codes are a number and WORDS distinct-looking words, and what Normalize
+// leaves alone.
+func TestGenerate(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, w := range words {
+		if seen[w] || w != strings.ToLower(strings.TrimSpace(w)) || strings.Contains(w, "-") {
+			t.Errorf("word %q repeated or not a plain lower case word", w)
+		}
+		seen[w] = true
+	}
+	shape := regexp.MustCompile(fmt.Sprintf(`^[1-9][0-9]{0,2}(-[a-z]+){%d}$`, WORDS))
+	for i := 0; i < 1000; i++ {
+		code, err := generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !shape.MatchString(code) || Normalize(code) != code {
+			t.Fatalf("code %q not of the expected shape", code)
+		}
+	}
+}
+
+// Codes of the staged files differ from each other.
+func TestAddUnique(t *testing.T) {
+	s := open(t, time.Hour, 1)
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		code, _ := stage(t, s, "f", "x")
+		if seen[code] {
+			t.Fatalf("code %s issued twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+// By default a code fetches its file once, which is then removed.
+func TestSingleUse(t *testing.T) {
+	s := open(t, time.Hour, 1)
+	code, path := stage(t, s, "report.pdf", "content")
+	p, got, err := s.Claim(strings.ToUpper(code), "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "report.pdf" || p.Size != 7 || got != path {
+		t.Errorf("claimed %+v at %s, want report.pdf of 7 bytes at %s", p, got, path)
+	}
+	if _, _, err := s.Claim(code, "other"); !errors.Is(err, ErrUnknown) {
+		t.Errorf("second claim while the first is under way: got %v, want ErrUnknown", err)
+	}
+	s.Done(code)
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("staged file still there after its last fetch: %v", err)
+	}
+	if _, _, err := s.Claim(code, "client"); !errors.Is(err, ErrUnknown) {
+		t.Errorf("used code: got %v, want ErrUnknown", err)
+	}
+}
+
+// A code allowing more fetches keeps its file until the last.
+func TestUses(t *testing.T) {
+	s := open(t, time.Hour, 2)
+	code, path := stage(t, s, "f", "x")
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.Claim(code, "client"); err != nil {
+			t.Fatalf("fetch %d: %v", i+1, err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("fetch %d: file gone before it was done", i+1)
+		}
+		s.Done(code)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file still there after the last fetch: %v", err)
+	}
+}
+
+// A fetch that failed gives its use back, so the receiver can retry.
+func TestRelease(t *testing.T) {
+	s := open(t, time.Hour, 1)
+	code, path := stage(t, s, "f", "x")
+	if _, _, err := s.Claim(code, "client"); err != nil {
+		t.Fatal(err)
+	}
+	s.Release(code)
+	if _, _, err := s.Claim(code, "client"); err != nil {
+		t.Fatalf("retry after a failed fetch: %v", err)
+	}
+	s.Done(code)
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file still there after the retry: %v", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := open(t, 50*time.Millisecond, 1)
+	code, path := stage(t, s, "f", "x")
+	time.Sleep(100 * time.Millisecond)
+	if _, _, err := s.Claim(code, "client"); !errors.Is(err, ErrUnknown) {
+		t.Errorf("expired code: got %v, want ErrUnknown", err)
+	}
+	if err := s.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expired file not swept: %v", err)
+	}
+}
+
+// Staged files and the fetches their codes have left survive a restart.
+func TestPersistence(t *testing.T) {
+	s := open(t, time.Hour, 2)
+	code, path := stage(t, s, "f", "x")
+	s.Claim(code, "client")
+	s.Done(code)
+
+	again, err := Open(filepath.Dir(s.Dir), time.Hour, 2, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := again.Claim(code, "client"); err != nil || got != path {
+		t.Fatalf("after a restart got %s, %v, want the last fetch", got, err)
+	}
+	again.Done(code)
+	if _, _, err := again.Claim(code, "client"); !errors.Is(err, ErrUnknown) {
+		t.Errorf("fetch past the uses allowed after a restart: %v", err)
+	}
+}
+
+// A client guessing codes is stopped, even with a right one, while others
+// are not.
+func TestTooManyFailures(t *testing.T) {
+	s := open(t, time.Hour, 1)
+	code, _ := stage(t, s, "f", "x")
+	for i := 0; i < MAX_FAILURES; i++ {
+		if _, _, err := s.Claim("1-wrong-code", "guesser"); !errors.Is(err, ErrUnknown) {
+			t.Fatalf("guess %d: got %v, want ErrUnknown", i+1, err)
+		}
+	}
+	if _, _, err := s.Claim(code, "guesser"); !errors.Is(err, ErrTooManyFailures) {
+		t.Errorf("right code after too many guesses: got %v, want ErrTooManyFailures", err)
+	}
+	if _, _, err := s.Claim(code, "other"); err != nil {
+		t.Errorf("another client: %v", err)
+	}
+
+	// Once the window passed, the guesser is heard again
+	s.failures["guesser"].since = time.Now().Add(-FAILURE_WINDOW - time.Second)
+	if _, _, err := s.Claim("1-wrong-code", "guesser"); !errors.Is(err, ErrUnknown) {
+		t.Errorf("after the window: got %v, want ErrUnknown", err)
+	}
+}
+
+// Sweeping leaves codes being fetched and fresh uploads alone, and removes
+// uploads that never finished.
+func TestSweep(t *testing.T) {
+	s := open(t, time.Hour, 1)
+	code, path := stage(t, s, "f", "x")
+	fresh, err := s.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh.Close()
+	stale, err := s.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(stale.Name(), old, old)
+
+	s.Claim(code, "client")
+	if err := s.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	for _, keep := range []string{path, fresh.Name()} {
+		if _, err := os.Stat(keep); err != nil {
+			t.Errorf("%s swept: %v", filepath.Base(keep), err)
+		}
+	}
+	if _, err := os.Stat(stale.Name()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stale upload not swept: %v", err)
+	}
+}
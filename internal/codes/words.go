@@ -0,0 +1,38 @@
+package codes
+
+// Words of a code, one per byte. Short, common and unlike each other, so
+// they are easy to read out and type.
+var words = [256]string{
+	"acorn", "actor", "adobe", "agent", "alarm", "album", "alien", "alpha",
+	"amber", "anchor", "angel", "ankle", "apple", "apron", "arena", "arrow",
+	"aspen", "atlas", "attic", "bacon", "badge", "bagel", "baker", "bamboo",
+	"banjo", "barn", "basil", "beach", "beard", "beaver", "bell", "berry",
+	"bike", "birch", "bison", "blade", "blimp", "bloom", "board", "boat",
+	"bonus", "book", "boot", "bottle", "bread", "brick", "bridge", "broom",
+	"bubble", "bucket", "bugle", "butter", "cabin", "cactus", "camel", "candle",
+	"canoe", "canyon", "carbon", "carpet", "carrot", "castle", "cedar", "cello",
+	"chalk", "cheese", "cherry", "chess", "chili", "cider", "circus", "clam",
+	"cliff", "clock", "cloud", "clover", "cobra", "cocoa", "comet", "copper",
+	"coral", "cotton", "cougar", "crab", "crane", "crayon", "crown", "cube",
+	"daisy", "dart", "delta", "denim", "desert", "dingo", "dock", "donkey",
+	"door", "dragon", "drum", "eagle", "echo", "elbow", "elm", "ember",
+	"emu", "engine", "falcon", "fern", "ferry", "fiddle", "finch", "flame",
+	"flute", "foam", "forest", "fossil", "fox", "frog", "galaxy", "garden",
+	"garlic", "gecko", "ginger", "glove", "goat", "grape", "gravel", "guitar",
+	"hammer", "harbor", "hawk", "hazel", "helmet", "heron", "hippo", "honey",
+	"hornet", "igloo", "iguana", "indigo", "iron", "island", "ivory", "jacket",
+	"jaguar", "jam", "jelly", "jet", "jewel", "juice", "jungle", "kayak",
+	"kettle", "kiwi", "koala", "ladder", "lagoon", "lamp", "lemon", "lentil",
+	"lily", "lime", "lion", "llama", "locket", "lotus", "lunar", "magnet",
+	"mango", "maple", "marble", "meadow", "melon", "mint", "mirror", "mole",
+	"moose", "moth", "muffin", "nectar", "needle", "nickel", "noodle", "nutmeg",
+	"oak", "oasis", "ocean", "olive", "onion", "orbit", "orchid", "otter",
+	"owl", "oyster", "paddle", "panda", "papaya", "parrot", "peach", "peanut",
+	"pebble", "pepper", "piano", "pickle", "pigeon", "pilot", "pine", "pizza",
+	"planet", "plum", "polar", "pony", "poppy", "potato", "prism", "puffin",
+	"pumpkin", "quartz", "quill", "rabbit", "radar", "radish", "raven", "reef",
+	"rhino", "ribbon", "river", "robin", "rocket", "rose", "ruby", "saddle",
+	"salmon", "sandal", "scarf", "shark", "shell", "silver", "skate", "sloth",
+	"snail", "spider", "spruce", "squid", "stone", "sugar", "summit", "swan",
+	"tiger", "toast", "tomato", "topaz", "tulip", "turtle", "velvet", "violin",
+}
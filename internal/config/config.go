@@ -0,0 +1,371 @@
+// Package config fills in a command's flags from the environment and a
+// config file, so a long command line, such as a service's, can live
+// elsewhere.
+//
+// Each flag is taken, in order of precedence, from the command line, from
+// the environment variable named after it, TRANSFER_ then the flag name in
+// upper case with dashes as underscores (TRANSFER_MAX_SIZE for
+// -max-size), from the file -config names, or else its default. The
+// variables hooks get, see internal/hook, are never read as flags, so a
+// hook can run the command itself.
+//
+// A config file holds the flag names as keys, in TOML, YAML or JSON by its
+// extension (.toml, .yaml or .yml, .json):
+//
+//	proto = "both"
+//	max-size = 1073741824
+//	tcp-addr = ["127.0.0.1:8080", "[::1]:8080"]
+//
+// Keys at the top apply to the subcommand reading the file. A file shared
+// by several subcommands puts each one's keys in a table named after it:
+//
+//	[serve]
+//	proto = "both"
+//
+//	[send]
+//	addr = "files.example.com:8080"
+//
+// A key the subcommand has no flag for is an error, catching typos, as is
+// a value its flag refuses; tables of other subcommands are left alone.
+// Only this flat subset of each format is understood: strings, numbers,
+// booleans and arrays of them, and one level of tables.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"socket-file-transfer/internal/hook"
+)
+
+// Prefix of the environment variables naming flags
+const ENV_PREFIX = "TRANSFER_"
+
+// Shown by Print in place of secrets
+const REDACTED = "REDACTED"
+
+// Lister is implemented by a flag.Value that may be set several times,
+// collecting a value each time. Config files give it an array and its
+// environment variable a comma-separated list.
+type Lister interface {
+	List() []string
+}
+
+// Config records where each flag of a parsed flag.FlagSet came from.
+type Config struct {
+	fs      *flag.FlagSet
+	path    string
+	sources map[string]string
+}
+
+// Parse parses args into fs as fs.Parse does, after adding the -config
+// flag to it, then sets each flag args didn't from the environment or the
+// config file. fs.Parse handles its own errors as fs says; those of the
+// environment or the file are returned.
+func Parse(fs *flag.FlagSet, args []string) (*Config, error) {
+	path := fs.String("config", "", "Read flags not given on the command line from this TOML, YAML or JSON file, see 'transfer config print'")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c := &Config{fs: fs, sources: make(map[string]string)}
+	fs.Visit(func(f *flag.Flag) {
+		c.sources[f.Name] = "flag"
+	})
+
+	// -config may come from the environment too
+	if _, ok := c.sources["config"]; !ok {
+		if v, ok := lookupEnv("config"); ok {
+			*path = v
+			c.sources["config"] = EnvName("config")
+		}
+	}
+	c.path = *path
+
+	var file map[string][]string
+	if c.path != "" {
+		var err error
+		if file, err = load(c.path, fs); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := c.sources[f.Name]; ok || err != nil {
+			return
+		}
+		if v, ok := lookupEnv(f.Name); ok {
+			values := []string{v}
+			if _, ok := f.Value.(Lister); ok {
+				values = strings.Split(v, ",")
+			}
+			if err = set(f, values); err != nil {
+				err = fmt.Errorf("%s: %w", EnvName(f.Name), err)
+				return
+			}
+			c.sources[f.Name] = EnvName(f.Name)
+		} else if values, ok := file[f.Name]; ok {
+			if err = set(f, values); err != nil {
+				err = fmt.Errorf("config file %s: %w", c.path, err)
+				return
+			}
+			c.sources[f.Name] = "config file"
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// EnvName returns the environment variable that sets the flag name.
+func EnvName(name string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Variables hooks get, which aren't flags
+var hookVariables = func() map[string]bool {
+	names := make(map[string]bool)
+	for _, kv := range (hook.Upload{}).Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		names[name] = true
+	}
+	return names
+}()
+
+func lookupEnv(name string) (string, bool) {
+	if hookVariables[EnvName(name)] {
+		return "", false
+	}
+	return os.LookupEnv(EnvName(name))
+}
+
+func set(f *flag.Flag, values []string) error {
+	if _, ok := f.Value.(Lister); !ok && len(values) != 1 {
+		return fmt.Errorf("-%s takes one value, not %d", f.Name, len(values))
+	}
+	for _, v := range values {
+		if err := f.Value.Set(v); err != nil {
+			return fmt.Errorf("invalid value %q for -%s: %w", v, f.Name, err)
+		}
+	}
+	return nil
+}
+
+// load reads the keys of the config file at path that apply to fs,
+// checking that fs has a flag for each.
+func load(path string, fs *flag.FlagSet) (map[string][]string, error) {
+	tables, err := ReadTables(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]string)
+	var unknown []string
+	for _, table := range []string{"", fs.Name()} {
+		for key, values := range tables[table] {
+			if fs.Lookup(key) == nil || key == "config" {
+				unknown = append(unknown, key)
+				continue
+			}
+			keys[key] = values
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("config file %s: %s has no flag %s", path, fs.Name(), strings.Join(unknown, ", "))
+	}
+	return keys, nil
+}
+
+// ReadTables reads the file at path in the format its extension names,
+// as a config file is read, returning the keys of each of its tables, ""
+// for those at the top, with their values as a flag would be given them.
+// Files of other settings, such as serve -tenants, share the format.
+func ReadTables(path string) (map[string]map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	var tables map[string]map[string][]string
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".toml":
+		tables, err = parseTOML(data)
+	case ".yaml", ".yml":
+		tables, err = parseYAML(data)
+	case ".json":
+		tables, err = parseJSON(data)
+	default:
+		return nil, fmt.Errorf("config file %s: unknown format %q, use .toml, .yaml or .json", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return tables, nil
+}
+
+// Secrets are the values of flags whose name ends in one of these words,
+// so -auth-token is one but -token-ttl isn't
+var secret = regexp.MustCompile(`(^|-)(pass|password|secret|token|psk)$`)
+
+// Print writes the settings of every flag to w as a config file Parse
+// reads, noting where those not left at their default came from. Secrets
+// are replaced by REDACTED: the values of flags named like passwords or
+// tokens, and the passwords of URLs.
+func (c *Config) Print(w io.Writer) error {
+	var err error
+	fmt.Fprintf(w, "# transfer %s\n", c.fs.Name())
+	if c.path != "" {
+		fmt.Fprintf(w, "# config file %s\n", c.path)
+	}
+	c.fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || err != nil {
+			return
+		}
+		line := f.Name + " = " + value(f)
+		if source, ok := c.sources[f.Name]; ok {
+			line += " # " + source
+		}
+		_, err = fmt.Fprintln(w, line)
+	})
+	return err
+}
+
+var number = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// value formats f's value for Print.
+func value(f *flag.Flag) string {
+	if l, ok := f.Value.(Lister); ok {
+		var items []string
+		for _, v := range l.List() {
+			items = append(items, quote(f.Name, v))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	v := f.Value.String()
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return v
+	}
+	if number.MatchString(v) {
+		return v
+	}
+	return quote(f.Name, v)
+}
+
+func quote(name, v string) string {
+	return strconv.Quote(Redact(name, v))
+}
+
+// Redact returns v, the value of the flag name, with secrets replaced as
+// Print replaces them.
+func Redact(name, v string) string {
+	if v != "" && secret.MatchString(name) {
+		return REDACTED
+	}
+	if u, err := url.Parse(v); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+	}
+	return v
+}
+
+// Change is a flag whose value Reload found changed in the config file.
+type Change struct {
+	Name     string
+	Old, New string // Redacted
+}
+
+// Path returns the config file's path, "" if there is none.
+func (c *Config) Path() string {
+	return c.path
+}
+
+// Reload reads the config file again and sets the flags named in live to
+// what it now says, unless the command line or the environment set them;
+// one the file no longer sets returns to its default. check, if not nil,
+// then validates the new settings. If the file or check fails, every flag
+// keeps its value and the error is returned. Changes to flags not in live
+// are returned as ignored without being made, as they only take effect at
+// startup. Flags implementing Lister are never live.
+func (c *Config) Reload(live []string, check func() error) (changed, ignored []Change, err error) {
+	if c.path == "" {
+		return nil, nil, errors.New("no config file to reload, see -config")
+	}
+	file, err := load(c.path, c.fs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type update struct {
+		f      *flag.Flag
+		old    string
+		values []string
+	}
+	var updates []update
+	sources := make(map[string]string)
+	c.fs.VisitAll(func(f *flag.Flag) {
+		if source, ok := c.sources[f.Name]; f.Name == "config" || ok && source != "config file" {
+			return
+		}
+		values, ok := file[f.Name]
+		switch {
+		case ok:
+			sources[f.Name] = "config file"
+		case c.sources[f.Name] == "config file":
+			values = []string{f.DefValue}
+		default:
+			return // Left at its default, or as the command made it since
+		}
+		_, list := f.Value.(Lister)
+		old, now := f.Value.String(), strings.Join(values, ",")
+		if old == now {
+			return
+		}
+		change := Change{Name: f.Name, Old: Redact(f.Name, old), New: Redact(f.Name, now)}
+		if list || !slices.Contains(live, f.Name) {
+			ignored = append(ignored, change)
+			delete(sources, f.Name)
+			return
+		}
+		changed = append(changed, change)
+		updates = append(updates, update{f, old, values})
+	})
+
+	// Put everything back if anything fails
+	rollback := func() {
+		for _, u := range updates {
+			u.f.Value.Set(u.old)
+		}
+	}
+	for _, u := range updates {
+		if err := set(u.f, u.values); err != nil {
+			rollback()
+			return nil, nil, fmt.Errorf("config file %s: %w", c.path, err)
+		}
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			rollback()
+			return nil, nil, err
+		}
+	}
+	for _, u := range updates {
+		if source, ok := sources[u.f.Name]; ok {
+			c.sources[u.f.Name] = source
+		} else {
+			delete(c.sources, u.f.Name)
+		}
+	}
+	return changed, ignored, nil
+}
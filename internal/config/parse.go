@@ -0,0 +1,254 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The parsers return the keys of each table, "" for those at the top,
+// with their values as a flag would be given them.
+
+func parseTOML(data []byte) (map[string]map[string][]string, error) {
+	tables := map[string]map[string][]string{"": {}}
+	table := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := tables[table]; ok || table == "" {
+				return nil, fmt.Errorf("line %d: duplicate table [%s]", i+1, table)
+			}
+			tables[table] = make(map[string][]string)
+			continue
+		}
+		key, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		if err := add(tables[table], unquoteKey(key), v); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	return tables, nil
+}
+
+func parseYAML(data []byte) (map[string]map[string][]string, error) {
+	tables := map[string]map[string][]string{"": {}}
+	table := ""
+	list := ""    // Key of the table whose "- item" lines follow
+	pending := "" // Key at the top without a value, a table or a list
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(stripComment(line), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		if !indented {
+			if pending != "" {
+				tables[""][pending] = []string{}
+			}
+			table, list, pending = "", "", ""
+		}
+
+		if item, ok := strings.CutPrefix(trimmed, "-"); ok && (item == "" || item[0] == ' ') {
+			if pending != "" {
+				tables[""][pending] = []string{}
+				list, pending = pending, ""
+			}
+			if list == "" {
+				return nil, fmt.Errorf("line %d: list item outside a list", i+1)
+			}
+			tables[table][list] = append(tables[table][list], scalar(strings.TrimSpace(item)))
+			continue
+		}
+		key, v, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", i+1)
+		}
+		key, v = unquoteKey(key), strings.TrimSpace(v)
+		list = ""
+		if indented && pending != "" {
+			if _, ok := tables[pending]; ok {
+				return nil, fmt.Errorf("line %d: duplicate table %s", i+1, pending)
+			}
+			tables[pending] = make(map[string][]string)
+			table, pending = pending, ""
+		}
+		if indented && table == "" {
+			return nil, fmt.Errorf("line %d: unexpected indentation", i+1)
+		}
+		if v == "" {
+			if !indented {
+				pending = key
+			} else if err := add(tables[table], key, "[]"); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			} else {
+				list = key
+			}
+			continue
+		}
+		if err := add(tables[table], key, v); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	if pending != "" {
+		tables[""][pending] = []string{}
+	}
+	return tables, nil
+}
+
+func parseJSON(data []byte) (map[string]map[string][]string, error) {
+	var doc map[string]any
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	tables := map[string]map[string][]string{"": {}}
+	for key, v := range doc {
+		if keys, ok := v.(map[string]any); ok {
+			table := make(map[string][]string)
+			for k, v := range keys {
+				values, err := jsonValues(v)
+				if err != nil {
+					return nil, fmt.Errorf("%s.%s: %w", key, k, err)
+				}
+				table[k] = values
+			}
+			tables[key] = table
+			continue
+		}
+		values, err := jsonValues(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		tables[""][key] = values
+	}
+	return tables, nil
+}
+
+func jsonValues(v any) ([]string, error) {
+	if items, ok := v.([]any); ok {
+		values := make([]string, 0, len(items))
+		for _, item := range items {
+			s, err := jsonScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	}
+	s, err := jsonScalar(v)
+	if err != nil {
+		return nil, err
+	}
+	return []string{s}, nil
+}
+
+func jsonScalar(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// add sets key in keys to v, a scalar or a one-line array.
+func add(keys map[string][]string, key, v string) error {
+	if key == "" {
+		return fmt.Errorf("missing key")
+	}
+	if _, ok := keys[key]; ok {
+		return fmt.Errorf("duplicate key %s", key)
+	}
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "[") {
+		keys[key] = []string{scalar(v)}
+		return nil
+	}
+	if !strings.HasSuffix(v, "]") {
+		return fmt.Errorf("%s: arrays must fit on one line", key)
+	}
+	values := []string{}
+	for _, item := range splitItems(v[1 : len(v)-1]) {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, scalar(item))
+		}
+	}
+	keys[key] = values
+	return nil
+}
+
+// scalar returns the value a possibly quoted string stands for.
+func scalar(s string) string {
+	if len(s) >= 2 {
+		switch {
+		case s[0] == '"' && s[len(s)-1] == '"':
+			if u, err := strconv.Unquote(s); err == nil {
+				return u
+			}
+		case s[0] == '\'' && s[len(s)-1] == '\'':
+			return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+		}
+	}
+	return s
+}
+
+func unquoteKey(key string) string {
+	return scalar(strings.TrimSpace(key))
+}
+
+// stripComment drops a # comment from line, unless quoted.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitItems splits an array's items at the commas outside quotes.
+func splitItems(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
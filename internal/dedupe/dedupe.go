@@ -0,0 +1,227 @@
+// Package dedupe keeps one copy of content uploaded under several names: a
+// file just stored whose content the server already holds becomes a hard
+// link to the stored copy.
+//
+// The index, a JSON map from each SHA-256 to the path of a stored file
+// with that content relative to the upload directory, is kept in INDEX_NAME
+// there and rewritten atomically after each change. A missing or unreadable
+// index is rebuilt by hashing the stored files, skipping names starting
+// with a dot as internal/retention does; the uploads index, if given,
+// lists them instead, with the checksums it knows. Entries are checked
+// against the file before use, so a file removed or changed since is
+// simply replaced by the next upload of its content.
+//
+// Stored files are never modified in place, only replaced or removed, so
+// the names sharing a copy can't affect each other.
+package dedupe
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/index"
+)
+
+// Name of the index file in the upload directory
+const INDEX_NAME = ".dedupe.json"
+
+// Index finds stored files by content. It is safe for concurrent use.
+type Index struct {
+	root string
+	mu   sync.Mutex
+	sums map[string]string // Hex SHA-256 to slash-separated path under root
+}
+
+// Servers of one process storing under the same directory share an Index
+var (
+	mu      sync.Mutex
+	indexes = make(map[string]*Index)
+)
+
+// Open returns the Index of the upload directory root, loading it from
+// INDEX_NAME or rebuilding it if that is missing or unreadable, from
+// files if not nil.
+func Open(root string, files *index.Index, log *slog.Logger) (*Index, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if ix, ok := indexes[abs]; ok {
+		return ix, nil
+	}
+
+	ix := &Index{root: abs}
+	data, err := os.ReadFile(filepath.Join(abs, INDEX_NAME))
+	if err == nil {
+		err = json.Unmarshal(data, &ix.sums)
+	}
+	if err != nil || ix.sums == nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn("Dedupe index unreadable, rebuilding it", "path", filepath.Join(abs, INDEX_NAME), "err", err)
+		}
+		if err := ix.rebuild(files); err != nil {
+			return nil, fmt.Errorf("error rebuilding dedupe index: %w", err)
+		}
+		if err := ix.save(); err != nil {
+			return nil, err
+		}
+		log.Info("Dedupe index rebuilt", "files", len(ix.sums))
+	}
+	indexes[abs] = ix
+	return ix, nil
+}
+
+// rebuild indexes the stored files, the first of each content found,
+// walking root unless files lists them.
+func (ix *Index) rebuild(files *index.Index) error {
+	ix.sums = make(map[string]string)
+	if files != nil {
+		for _, f := range files.Files() {
+			key := f.SHA256
+			if key == "" {
+				sum, err := hashcache.Sum(filepath.Join(ix.root, filepath.FromSlash(f.Name)))
+				if err != nil {
+					continue // Removed or unreadable, it can't be linked to either
+				}
+				key = hex.EncodeToString(sum)
+			}
+			if _, ok := ix.sums[key]; !ok {
+				ix.sums[key] = f.Name
+			}
+		}
+		return nil
+	}
+	return filepath.WalkDir(ix.root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == ix.root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		sum, err := hashcache.Sum(path)
+		if err != nil {
+			return nil // Removed or unreadable, it can't be linked to either
+		}
+		key := hex.EncodeToString(sum)
+		if _, ok := ix.sums[key]; !ok {
+			ix.sums[key] = ix.rel(path)
+		}
+		return nil
+	})
+}
+
+// save writes the index to a temporary file renamed over INDEX_NAME, so
+// it is never seen half written.
+func (ix *Index) save() error {
+	data, err := json.Marshal(ix.sums)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(ix.root, INDEX_NAME+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error saving dedupe index: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(ix.root, INDEX_NAME))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error saving dedupe index: %w", err)
+	}
+	return nil
+}
+
+func (ix *Index) rel(path string) string {
+	rel, err := filepath.Rel(ix.root, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Link replaces path, a file just stored under root with size bytes
+// hashing to sum, by a hard link to a stored file with the same content,
+// returning that file's path. It returns "" if there is none, indexing
+// path instead, or if path already is that file. A file system without
+// hard links fails it, leaving path as it was.
+func (ix *Index) Link(path string, size int64, sum []byte) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(sum)
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if rel, ok := ix.sums[key]; ok {
+		original := filepath.Join(ix.root, filepath.FromSlash(rel))
+		if original != abs && hashcache.Matches(original, size, sum) {
+			if err := link(original, abs); err != nil {
+				return "", err
+			}
+			return original, nil
+		}
+		if original == abs {
+			return "", nil
+		}
+	}
+	ix.sums[key] = ix.rel(abs)
+	return "", ix.save()
+}
+
+// link replaces path by a hard link to original, through a temporary
+// name, so path always holds the content.
+func link(original, path string) error {
+	dir, name := filepath.Split(path)
+	tmp := filepath.Join(dir, "."+name+".link")
+	os.Remove(tmp)
+	if err := os.Link(original, tmp); err != nil {
+		return fmt.Errorf("error linking to identical file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error linking to identical file: %w", err)
+	}
+	return nil
+}
+
+// Forget drops path, a stored file hashing to sum that is being removed,
+// from the index, so no file stored later is linked to it.
+func (ix *Index) Forget(path string, sum []byte) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	key := hex.EncodeToString(sum)
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.sums[key] != ix.rel(abs) {
+		return nil
+	}
+	delete(ix.sums, key)
+	return ix.save()
+}
@@ -0,0 +1,157 @@
+package dedupe
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// store writes data to name under dir, as a server stores an upload, and
+// returns its path and SHA-256.
+func store(t *testing.T, dir, name, data string) (string, []byte) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(data))
+	return path, sum[:]
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	ia, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ib, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(ia, ib)
+}
+
+// The same content stored under three names ends up as one file.
+func TestLink(t *testing.T) {
+	dir := t.TempDir()
+	ix, err := Open(dir, nil, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		path, sum := store(t, dir, name, "identical")
+		original, err := ix.Link(path, int64(len("identical")), sum)
+		if err != nil {
+			t.Fatalf("Link %s: %v", name, err)
+		}
+		if want := filepath.Join(dir, "a.bin"); name != "a.bin" && original != want {
+			t.Errorf("%s linked to %q, want %q", name, original, want)
+		}
+		paths = append(paths, path)
+	}
+	for _, path := range paths[1:] {
+		if !sameFile(t, paths[0], path) {
+			t.Errorf("%s is a copy of its own", path)
+		}
+	}
+
+	// Other content is kept apart, and a file is no duplicate of itself
+	path, sum := store(t, dir, "other.bin", "different")
+	if original, err := ix.Link(path, int64(len("different")), sum); original != "" || err != nil {
+		t.Errorf("Link of new content = %q, %v", original, err)
+	}
+	if original, err := ix.Link(path, int64(len("different")), sum); original != "" || err != nil {
+		t.Errorf("Link of an indexed file = %q, %v", original, err)
+	}
+	if sameFile(t, paths[0], path) {
+		t.Error("different content linked")
+	}
+}
+
+// An indexed file changed since isn't linked to, the next upload of the
+// content taking its place in the index.
+func TestLinkChangedOriginal(t *testing.T) {
+	dir := t.TempDir()
+	ix, err := Open(dir, nil, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, sum := store(t, dir, "a.bin", "content")
+	ix.Link(path, 7, sum)
+	os.WriteFile(path, []byte("changed"), 0644)
+
+	b, _ := store(t, dir, "b.bin", "content")
+	if original, err := ix.Link(b, 7, sum); original != "" || err != nil {
+		t.Fatalf("linked to a changed file: %q, %v", original, err)
+	}
+	c, _ := store(t, dir, "c.bin", "content")
+	if original, err := ix.Link(c, 7, sum); original != b || err != nil {
+		t.Errorf("Link = %q, %v, want %q", original, err, b)
+	}
+}
+
+// A file forgotten is no longer linked to, while forgetting another path
+// of the same content leaves the index alone.
+func TestForget(t *testing.T) {
+	dir := t.TempDir()
+	ix, err := Open(dir, nil, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, sum := store(t, dir, "a.bin", "content")
+	ix.Link(a, 7, sum)
+	if err := ix.Forget(filepath.Join(dir, "other.bin"), sum); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := store(t, dir, "b.bin", "content")
+	if original, _ := ix.Link(b, 7, sum); original != a {
+		t.Fatalf("Link = %q, want %q", original, a)
+	}
+
+	if err := ix.Forget(a, sum); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := store(t, dir, "c.bin", "content")
+	if original, err := ix.Link(c, 7, sum); original != "" || err != nil {
+		t.Errorf("linked to a forgotten file: %q, %v", original, err)
+	}
+}
+
+// A missing or unreadable index is rebuilt from the stored files, leaving
+// hidden ones out, and saved.
+func TestOpenRebuilds(t *testing.T) {
+	for _, index := range []string{"", "not json"} {
+		dir := t.TempDir()
+		store(t, dir, "a.bin", "shown")
+		_, hiddenSum := store(t, dir, ".hidden", "hidden")
+		if index != "" {
+			os.WriteFile(filepath.Join(dir, INDEX_NAME), []byte(index), 0644)
+		}
+		ix, err := Open(dir, nil, quiet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, sum := store(t, dir, "b.bin", "shown")
+		if original, err := ix.Link(b, 5, sum); original != filepath.Join(dir, "a.bin") || err != nil {
+			t.Errorf("index %q: Link = %q, %v, want a.bin", index, original, err)
+		}
+		c, _ := store(t, dir, "c.bin", "hidden")
+		if original, _ := ix.Link(c, 6, hiddenSum); original != "" {
+			t.Errorf("index %q: linked to hidden %q", index, original)
+		}
+
+		var saved map[string]string
+		data, _ := os.ReadFile(filepath.Join(dir, INDEX_NAME))
+		if err := json.Unmarshal(data, &saved); err != nil || len(saved) != 2 {
+			t.Errorf("index %q: saved %s, %v, want 2 entries", index, data, err)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+// Package delta implements rsync-style block delta encoding.
+//
+// The receiver of a file signs the copy it already holds (Sign), the sender
+// matches its local file against that signature using a rolling checksum
+// (Diff) and emits a stream of copy and literal operations, and the receiver
+// rebuilds the new file from its old copy plus those operations (Patcher).
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	MinBlockSize = 2 << 10
+	MaxBlockSize = 1 << 20
+
+	// MaxLiteral bounds the size of a single literal operation
+	MaxLiteral = 256 << 10
+
+	// maxBlocks bounds the number of blocks accepted in a signature
+	maxBlocks = 1 << 24
+)
+
+var ErrMalformed = errors.New("delta: malformed stream")
+
+// BlockSizeFor picks a block size for a file of the given length, roughly
+// its square root so signature size and match granularity grow together.
+func BlockSizeFor(size int64) int {
+	bs := MinBlockSize
+	for bs < MaxBlockSize && int64(bs)*int64(bs) < size {
+		bs <<= 1
+	}
+	return bs
+}
+
+// Block is the signature of one fixed-size block of the base file.
+type Block struct {
+	Weak   uint32
+	Strong [sha256.Size]byte
+}
+
+// Signature describes the base file the receiver already holds. The last
+// block may be shorter than BlockSize.
+type Signature struct {
+	BlockSize int
+	Size      int64
+	Blocks    []Block
+}
+
+// Sign computes the signature of r using blocks of blockSize bytes.
+func Sign(r io.Reader, blockSize int) (*Signature, error) {
+	sig := &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, Block{
+				Weak:   weakSum(buf[:n]),
+				Strong: sha256.Sum256(buf[:n]),
+			})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// blockLen returns the length of block i, accounting for a short last block.
+func (s *Signature) blockLen(i int) int {
+	if i == len(s.Blocks)-1 {
+		if rem := int(s.Size % int64(s.BlockSize)); rem != 0 {
+			return rem
+		}
+	}
+	return s.BlockSize
+}
+
+// WriteTo encodes the signature: block size (4), base size (8), block count
+// (4), then weak (4) and strong (32) sums per block.
+func (s *Signature) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	hdr := make([]byte, 16)
+	binary.BigEndian.PutUint32(hdr[0:], uint32(s.BlockSize))
+	binary.BigEndian.PutUint64(hdr[4:], uint64(s.Size))
+	binary.BigEndian.PutUint32(hdr[12:], uint32(len(s.Blocks)))
+	bw.Write(hdr)
+
+	var weak [4]byte
+	for _, b := range s.Blocks {
+		binary.BigEndian.PutUint32(weak[:], b.Weak)
+		bw.Write(weak[:])
+		bw.Write(b.Strong[:])
+	}
+
+	n := int64(len(hdr) + len(s.Blocks)*(4+sha256.Size))
+	return n, bw.Flush()
+}
+
+// ReadSignature decodes a signature written by WriteTo.
+func ReadSignature(r io.Reader) (*Signature, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	sig := &Signature{
+		BlockSize: int(binary.BigEndian.Uint32(hdr[0:])),
+		Size:      int64(binary.BigEndian.Uint64(hdr[4:])),
+	}
+	count := binary.BigEndian.Uint32(hdr[12:])
+
+	if sig.BlockSize < MinBlockSize || sig.BlockSize > MaxBlockSize || count > maxBlocks || sig.Size < 0 {
+		return nil, ErrMalformed
+	}
+	if want := (sig.Size + int64(sig.BlockSize) - 1) / int64(sig.BlockSize); int64(count) != want {
+		return nil, ErrMalformed
+	}
+
+	// Grow with the entries actually received rather than trusting count
+	sig.Blocks = make([]Block, 0, min(count, 4096))
+	entry := make([]byte, 4+sha256.Size)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return nil, err
+		}
+		var b Block
+		b.Weak = binary.BigEndian.Uint32(entry)
+		copy(b.Strong[:], entry[4:])
+		sig.Blocks = append(sig.Blocks, b)
+	}
+	return sig, nil
+}
+
+// weakSum is the rsync rolling checksum of a block.
+func weakSum(p []byte) uint32 {
+	var a, b uint32
+	l := uint32(len(p))
+	for i, c := range p {
+		a += uint32(c)
+		b += (l - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+// rollSum updates a weak checksum of a window of length l by removing out
+// from its front and appending in at its end.
+func rollSum(sum uint32, l int, out, in byte) uint32 {
+	a := sum & 0xffff
+	b := sum >> 16
+	a = (a - uint32(out) + uint32(in)) & 0xffff
+	b = (b - uint32(l)*uint32(out) + a) & 0xffff
+	return a | b<<16
+}
+
+// Diff reads the new file from r and calls emit with the operations that
+// rebuild it from the base described by sig, ending with an OpEnd carrying
+// the SHA-256 of everything read. Literal data passed to emit is only valid
+// for the duration of the call.
+func Diff(sig *Signature, r io.Reader, emit func(Op) error) error {
+	bs := sig.BlockSize
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, b := range sig.Blocks {
+		index[b.Weak] = append(index[b.Weak], i)
+	}
+
+	hasher := sha256.New()
+	r = io.TeeReader(r, hasher)
+
+	// Nothing can match an empty base, so skip the rolling search
+	if len(sig.Blocks) == 0 {
+		chunk := make([]byte, MaxLiteral)
+		for {
+			n, err := io.ReadFull(r, chunk)
+			if n > 0 {
+				if err := emit(Op{Kind: OpLiteral, Data: chunk[:n]}); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return emit(Op{Kind: OpEnd, Data: hasher.Sum(nil)})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var (
+		buf     []byte // pending literal bytes followed by the current window
+		pos     int    // start of the window within buf
+		eof     bool
+		sum     uint32
+		rolling bool // sum is valid for buf[pos:pos+bs]
+		chunk   = make([]byte, 64<<10)
+	)
+
+	flush := func() error {
+		if pos == 0 {
+			return nil
+		}
+		if err := emit(Op{Kind: OpLiteral, Data: buf[:pos]}); err != nil {
+			return err
+		}
+		buf = buf[pos:]
+		pos = 0
+		return nil
+	}
+
+	match := func(window []byte, weak uint32) (int, bool) {
+		candidates, ok := index[weak]
+		if !ok {
+			return 0, false
+		}
+		strong := sha256.Sum256(window)
+		for _, i := range candidates {
+			if sig.blockLen(i) == len(window) && sig.Blocks[i].Strong == strong {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	for {
+		for !eof && len(buf)-pos < bs {
+			n, err := r.Read(chunk)
+			buf = append(buf, chunk[:n]...)
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if len(buf)-pos < bs {
+			break
+		}
+
+		window := buf[pos : pos+bs]
+		if !rolling {
+			sum = weakSum(window)
+			rolling = true
+		}
+
+		if i, ok := match(window, sum); ok {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := emit(Op{Kind: OpCopy, Block: uint64(i)}); err != nil {
+				return err
+			}
+			buf = buf[bs:]
+			rolling = false
+			continue
+		}
+
+		if pos+bs < len(buf) {
+			sum = rollSum(sum, bs, buf[pos], buf[pos+bs])
+		} else {
+			rolling = false
+		}
+		pos++
+
+		if pos >= MaxLiteral {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The tail may still match the base's short last block
+	if tail := buf[pos:]; len(tail) > 0 {
+		if i, ok := match(tail, weakSum(tail)); ok {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := emit(Op{Kind: OpCopy, Block: uint64(i)}); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		} else {
+			pos = len(buf)
+		}
+	}
+
+	for pos > 0 {
+		n := pos
+		if n > MaxLiteral {
+			n = MaxLiteral
+		}
+		if err := emit(Op{Kind: OpLiteral, Data: buf[:n]}); err != nil {
+			return err
+		}
+		buf = buf[n:]
+		pos -= n
+	}
+
+	return emit(Op{Kind: OpEnd, Data: hasher.Sum(nil)})
+}
@@ -0,0 +1,177 @@
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+)
+
+// random returns n reproducible bytes that no block of another seed matches.
+func random(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// roundTrip signs base, diffs next against it through the wire encoding and
+// rebuilds next from base, returning the rebuilt file and its Patcher.
+func roundTrip(t *testing.T, base, next []byte, blockSize int) ([]byte, *Patcher) {
+	t.Helper()
+	sig, err := Sign(bytes.NewReader(base), blockSize)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	var encoded bytes.Buffer
+	if _, err := sig.WriteTo(&encoded); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	sig, err = ReadSignature(&encoded)
+	if err != nil {
+		t.Fatalf("ReadSignature: %v", err)
+	}
+
+	var stream bytes.Buffer
+	err = Diff(sig, bytes.NewReader(next), func(op Op) error {
+		return WriteOp(&stream, op)
+	})
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+
+	var out bytes.Buffer
+	p := NewPatcher(bytes.NewReader(base), sig, &out)
+	buf := make([]byte, MaxLiteral)
+	for {
+		op, err := ReadOp(&stream, buf)
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+		if op.Kind == OpEnd {
+			if sum := sha256.Sum256(next); !bytes.Equal(op.Data, sum[:]) {
+				t.Fatalf("OpEnd carries %x, want the SHA-256 of the new file %x", op.Data, sum)
+			}
+			break
+		}
+		if err := p.Apply(op); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+	}
+	if stream.Len() != 0 {
+		t.Fatalf("%d bytes left in the stream after OpEnd", stream.Len())
+	}
+	return out.Bytes(), p
+}
+
+func TestDiffEdits(t *testing.T) {
+	const bs = MinBlockSize
+	base := random(1, 64*bs+100) // Short last block
+	edit := random(2, 300)
+
+	tests := []struct {
+		name       string
+		next       []byte
+		maxLiteral int64 // Most bytes that may travel as literals
+	}{
+		{"identical", base, 0},
+		{"prepend", append(append([]byte{}, edit...), base...), int64(len(edit))},
+		{"append", append(append([]byte{}, base...), edit...), int64(len(edit)) + bs},
+		{"middle insert", append(append(append([]byte{}, base[:20*bs+7]...), edit...), base[20*bs+7:]...), int64(len(edit)) + 2*bs},
+		{"middle overwrite", append(append(append([]byte{}, base[:30*bs]...), edit...), base[30*bs+len(edit):]...), 2 * bs},
+		{"middle delete", append(append([]byte{}, base[:10*bs+1]...), base[12*bs:]...), 2 * bs},
+		{"truncate", base[:40*bs], 0},
+		{"empty", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, p := roundTrip(t, base, tt.next, bs)
+			if !bytes.Equal(got, tt.next) {
+				t.Fatalf("rebuilt %d bytes that differ from the %d byte new file", len(got), len(tt.next))
+			}
+			if p.Literal > tt.maxLiteral {
+				t.Errorf("sent %d literal bytes, want at most %d", p.Literal, tt.maxLiteral)
+			}
+			if p.Copied+p.Literal != int64(len(tt.next)) {
+				t.Errorf("copied %d + literal %d bytes, want %d", p.Copied, p.Literal, len(tt.next))
+			}
+		})
+	}
+}
+
+// A file sharing nothing with the base falls back to a full send, all of
+// it as literals.
+func TestDiffCompletelyDifferent(t *testing.T) {
+	base := random(3, 50*MinBlockSize)
+	next := random(4, 70*MinBlockSize+13)
+	got, p := roundTrip(t, base, next, MinBlockSize)
+	if !bytes.Equal(got, next) {
+		t.Fatal("rebuilt file differs from the new file")
+	}
+	if p.Copied != 0 || p.Literal != int64(len(next)) {
+		t.Errorf("copied %d and sent %d literal bytes, want 0 and %d", p.Copied, p.Literal, len(next))
+	}
+}
+
+// Without a base, as when the server holds no copy, everything is sent in
+// literals no larger than MaxLiteral.
+func TestDiffEmptyBase(t *testing.T) {
+	next := random(5, 3*MaxLiteral+1)
+	sig := &Signature{BlockSize: MinBlockSize}
+	var literals int
+	var rebuilt []byte
+	err := Diff(sig, bytes.NewReader(next), func(op Op) error {
+		switch op.Kind {
+		case OpCopy:
+			t.Error("copy op with an empty base")
+		case OpLiteral:
+			if len(op.Data) > MaxLiteral {
+				t.Errorf("%d byte literal, over MaxLiteral", len(op.Data))
+			}
+			literals++
+			rebuilt = append(rebuilt, op.Data...)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rebuilt, next) || literals != 4 {
+		t.Errorf("got %d literals rebuilding %d bytes, want 4 rebuilding %d", literals, len(rebuilt), len(next))
+	}
+}
+
+func TestReadSignatureMalformed(t *testing.T) {
+	sig, err := Sign(bytes.NewReader(random(6, 5*MinBlockSize)), MinBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var good bytes.Buffer
+	sig.WriteTo(&good)
+
+	tests := []struct {
+		name   string
+		mangle func(b []byte) []byte
+	}{
+		{"block size too small", func(b []byte) []byte { b[2], b[3] = 0, 1; return b }},
+		{"block count off", func(b []byte) []byte { b[15]++; return b }},
+		{"negative size", func(b []byte) []byte { b[4] = 0x80; return b }},
+		{"huge count", func(b []byte) []byte { b[12] = 0xff; return b }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.mangle(append([]byte{}, good.Bytes()...))
+			if _, err := ReadSignature(bytes.NewReader(b)); err != ErrMalformed {
+				t.Errorf("got %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+func TestApplyOutOfRangeBlock(t *testing.T) {
+	base := random(7, 2*MinBlockSize)
+	sig, _ := Sign(bytes.NewReader(base), MinBlockSize)
+	p := NewPatcher(bytes.NewReader(base), sig, &bytes.Buffer{})
+	if err := p.Apply(Op{Kind: OpCopy, Block: 2}); err != ErrMalformed {
+		t.Errorf("got %v, want ErrMalformed", err)
+	}
+}
@@ -0,0 +1,135 @@
+package delta
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// OpKind identifies a delta operation on the wire.
+type OpKind byte
+
+const (
+	OpCopy    OpKind = 'C' // Copy a block of the base file
+	OpLiteral OpKind = 'L' // Insert literal bytes
+	OpEnd     OpKind = 'E' // End of stream, carries the new file's SHA-256
+)
+
+// Op is a single delta operation.
+type Op struct {
+	Kind  OpKind
+	Block uint64 // OpCopy
+	Data  []byte // OpLiteral data or OpEnd checksum
+}
+
+// WriteOp encodes op to w.
+func WriteOp(w io.Writer, op Op) error {
+	switch op.Kind {
+	case OpCopy:
+		var b [9]byte
+		b[0] = byte(OpCopy)
+		binary.BigEndian.PutUint64(b[1:], op.Block)
+		_, err := w.Write(b[:])
+		return err
+	case OpLiteral:
+		var b [5]byte
+		b[0] = byte(OpLiteral)
+		binary.BigEndian.PutUint32(b[1:], uint32(len(op.Data)))
+		if _, err := w.Write(b[:]); err != nil {
+			return err
+		}
+		_, err := w.Write(op.Data)
+		return err
+	case OpEnd:
+		if _, err := w.Write([]byte{byte(OpEnd)}); err != nil {
+			return err
+		}
+		_, err := w.Write(op.Data)
+		return err
+	}
+	return fmt.Errorf("delta: unknown op %q", op.Kind)
+}
+
+// ReadOp decodes the next operation from r. Literal data is read into buf,
+// which must hold MaxLiteral bytes, and is only valid until the next call.
+func ReadOp(r io.Reader, buf []byte) (Op, error) {
+	var kind [1]byte
+	if _, err := io.ReadFull(r, kind[:]); err != nil {
+		return Op{}, err
+	}
+
+	switch op := (Op{Kind: OpKind(kind[0])}); op.Kind {
+	case OpCopy:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return Op{}, err
+		}
+		op.Block = binary.BigEndian.Uint64(b[:])
+		return op, nil
+	case OpLiteral:
+		var b [4]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return Op{}, err
+		}
+		n := binary.BigEndian.Uint32(b[:])
+		if n > MaxLiteral || int(n) > len(buf) {
+			return Op{}, ErrMalformed
+		}
+		op.Data = buf[:n]
+		if _, err := io.ReadFull(r, op.Data); err != nil {
+			return Op{}, err
+		}
+		return op, nil
+	case OpEnd:
+		op.Data = make([]byte, sha256.Size)
+		if _, err := io.ReadFull(r, op.Data); err != nil {
+			return Op{}, err
+		}
+		return op, nil
+	}
+	return Op{}, ErrMalformed
+}
+
+// Patcher rebuilds a file from its base and a stream of operations.
+type Patcher struct {
+	base io.ReaderAt
+	sig  *Signature
+	out  io.Writer
+	buf  []byte
+
+	Copied  int64 // Bytes taken from the base
+	Literal int64 // Bytes received as literals
+}
+
+// NewPatcher returns a Patcher writing to out. sig must describe base.
+func NewPatcher(base io.ReaderAt, sig *Signature, out io.Writer) *Patcher {
+	return &Patcher{base: base, sig: sig, out: out, buf: make([]byte, sig.BlockSize)}
+}
+
+// Apply performs a copy or literal operation.
+func (p *Patcher) Apply(op Op) error {
+	switch op.Kind {
+	case OpCopy:
+		if op.Block >= uint64(len(p.sig.Blocks)) {
+			return ErrMalformed
+		}
+		i := int(op.Block)
+		block := p.buf[:p.sig.blockLen(i)]
+		if _, err := p.base.ReadAt(block, int64(i)*int64(p.sig.BlockSize)); err != nil {
+			return err
+		}
+		if _, err := p.out.Write(block); err != nil {
+			return err
+		}
+		p.Copied += int64(len(block))
+		return nil
+	case OpLiteral:
+		if _, err := p.out.Write(op.Data); err != nil {
+			return err
+		}
+		p.Literal += int64(len(op.Data))
+		return nil
+	}
+	return ErrMalformed
+}
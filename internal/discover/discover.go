@@ -0,0 +1,303 @@
+// Package discover lets clients find servers on the local network without
+// knowing their address. A client broadcasts a probe to DISCOVER_PORT and
+// every server running a Responder answers with an Announcement of what it
+// serves; servers may also advertise themselves over mDNS, see MDNS.
+//
+// Probes and answers start with MAGIC and VERSION, so stray traffic on the
+// port is ignored rather than misread:
+//
+//	probe:  MAGIC | VERSION | KIND_PROBE | nonce (8 bytes)
+//	answer: MAGIC | VERSION | KIND_ANSWER | nonce | Announcement as JSON
+package discover
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+const (
+	MAGIC   = "\xC7SFD"
+	VERSION = 1
+
+	KIND_PROBE  = 1
+	KIND_ANSWER = 2
+
+	NONCE_LEN  = 8
+	HEADER_LEN = len(MAGIC) + 2 + NONCE_LEN
+
+	// Largest answer a prober reads
+	MAX_ANSWER = 1400
+
+	// How long Probe waits for answers by default
+	DefaultWait = time.Second
+)
+
+// Announcement describes a server: the ports it serves each protocol on,
+// 0 for those it doesn't, and the free space for uploads, -1 if unknown.
+// A server reachable at several addresses answers from each with the same
+// ID.
+type Announcement struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+	TCP  int    `json:"tcp,omitempty"`
+	UDP  int    `json:"udp,omitempty"`
+	QUIC int    `json:"quic,omitempty"`
+	TFTP int    `json:"tftp,omitempty"`
+	Free int64  `json:"free"`
+}
+
+// Port returns the port a serves proto on, 0 if it doesn't.
+func (a *Announcement) Port(proto string) int {
+	switch proto {
+	case "tcp":
+		return a.TCP
+	case "udp":
+		return a.UDP
+	case "quic":
+		return a.QUIC
+	case "tftp":
+		return a.TFTP
+	}
+	return 0
+}
+
+// Protocols lists the protocols a serves.
+func (a *Announcement) Protocols() []string {
+	var protos []string
+	for _, p := range []string{"tcp", "udp", "quic", "tftp"} {
+		if a.Port(p) != 0 {
+			protos = append(protos, p)
+		}
+	}
+	return protos
+}
+
+// Found is a server that answered.
+type Found struct {
+	Host string // IP address the answer came from
+	Announcement
+}
+
+// Addr returns the address to reach f's server over proto, "" if it
+// doesn't serve it.
+func (f *Found) Addr(proto string) string {
+	port := f.Port(proto)
+	if port == 0 {
+		return ""
+	}
+	return net.JoinHostPort(f.Host, strconv.Itoa(port))
+}
+
+func header(kind byte, nonce []byte) []byte {
+	b := append([]byte(MAGIC), VERSION, kind)
+	return append(b, nonce...)
+}
+
+// parse returns the kind, nonce and body of a packet, or an error if it
+// isn't one of ours.
+func parse(b []byte) (kind byte, nonce, body []byte, err error) {
+	if len(b) < HEADER_LEN || !bytes.HasPrefix(b, []byte(MAGIC)) {
+		return 0, nil, nil, wire.ErrMalformed
+	}
+	if v := b[len(MAGIC)]; v != VERSION {
+		return 0, nil, nil, fmt.Errorf("%w: discovery version %d", wire.ErrProtocol, v)
+	}
+	nonceStart := len(MAGIC) + 2
+	return b[len(MAGIC)+1], b[nonceStart:HEADER_LEN], b[HEADER_LEN:], nil
+}
+
+// Responder answers probes with the Announcement Info returns at the
+// time.
+type Responder struct {
+	Addr   string              // Listen address, wire.DISCOVER_PORT if empty
+	Info   func() Announcement // What to announce
+	Logger *slog.Logger        // wire.DefaultLogger if nil
+}
+
+func (r *Responder) logger() *slog.Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return wire.DefaultLogger
+}
+
+// ListenAndServe listens on r.Addr and answers probes until ctx ends.
+func (r *Responder) ListenAndServe(ctx context.Context) error {
+	addr := r.Addr
+	if addr == "" {
+		addr = wire.DISCOVER_PORT
+	}
+	lc := net.ListenConfig{Control: reuseAddr}
+	conn, err := lc.ListenPacket(ctx, "udp4", addr)
+	if err != nil {
+		return fmt.Errorf("error starting discovery responder: %w", err)
+	}
+	return r.Serve(ctx, conn)
+}
+
+// Serve answers the probes arriving on conn until ctx ends. The
+// connection is closed on return.
+func (r *Responder) Serve(ctx context.Context, conn net.PacketConn) error {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	log := r.logger()
+	log.Info("Answering discovery probes", "addr", conn.LocalAddr())
+
+	buffer := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		kind, nonce, _, err := parse(buffer[:n])
+		if err != nil || kind != KIND_PROBE {
+			log.Debug("Ignoring packet on the discovery port", "remote", addr, "err", err)
+			continue
+		}
+		body, err := json.Marshal(r.Info())
+		if err != nil {
+			return err
+		}
+		log.Debug("Answering discovery probe", "remote", addr)
+		conn.WriteTo(append(header(KIND_ANSWER, nonce), body...), addr)
+	}
+}
+
+// Probe broadcasts a probe to port on every IPv4 network this host is on
+// and returns the servers that answer within wait, DefaultWait if 0,
+// sorted by name and address.
+func Probe(ctx context.Context, port int, wait time.Duration) ([]Found, error) {
+	if wait <= 0 {
+		wait = DefaultWait
+	}
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	nonce := make([]byte, NONCE_LEN)
+	rand.Read(nonce)
+	probe := header(KIND_PROBE, nonce)
+	var sent int
+	var sendErr error
+	for _, ip := range broadcastAddrs() {
+		if _, err := conn.WriteTo(probe, &net.UDPAddr{IP: ip, Port: port}); err != nil {
+			sendErr = err
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return nil, fmt.Errorf("error sending discovery probe: %w", sendErr)
+	}
+
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var found []Found
+	buffer := make([]byte, MAX_ANSWER)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		kind, answerNonce, body, err := parse(buffer[:n])
+		if err != nil || kind != KIND_ANSWER || !bytes.Equal(answerNonce, nonce) {
+			continue
+		}
+		f := Found{Host: addr.(*net.UDPAddr).IP.String()}
+		if json.Unmarshal(body, &f.Announcement) != nil {
+			continue
+		}
+		found = append(found, f)
+	}
+	return Merge(found), nil
+}
+
+// Merge returns the servers in lists, each listed once, at a non-loopback
+// address if it answered from one, sorted by name and address.
+func Merge(lists ...[]Found) []Found {
+	seen := make(map[string]Found)
+	for _, list := range lists {
+		for _, f := range list {
+			key := f.ID
+			if key == "" {
+				key = f.Host + " " + f.Name
+			}
+			if prev, ok := seen[key]; ok && !net.ParseIP(prev.Host).IsLoopback() {
+				continue
+			}
+			seen[key] = f
+		}
+	}
+	found := make([]Found, 0, len(seen))
+	for _, f := range seen {
+		found = append(found, f)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Name != found[j].Name {
+			return found[i].Name < found[j].Name
+		}
+		return found[i].Host < found[j].Host
+	})
+	return found
+}
+
+// broadcastAddrs returns the limited broadcast address, the broadcast
+// address of each IPv4 network of the interfaces that are up, and the
+// loopback network's, for servers on this host.
+func broadcastAddrs() []net.IP {
+	addrs := []net.IP{net.IPv4bcast, net.IPv4(127, 255, 255, 255)}
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		ifAddrs, _ := iface.Addrs()
+		for _, a := range ifAddrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			ip, mask := ipNet.IP.To4(), ipNet.Mask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			bcast := make(net.IP, 4)
+			for i := range bcast {
+				bcast[i] = ip[i] | ^mask[i]
+			}
+			addrs = append(addrs, bcast)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,185 @@
+package discover
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"socket-file-transfer/internal/wire"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// respond runs a Responder announcing a on a loopback port until the test
+// ends and returns the port.
+func respond(t *testing.T, a Announcement) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Responder{Info: func() Announcement { return a }, Logger: quiet}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Serve(ctx, conn)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestProbe(t *testing.T) {
+	a := Announcement{ID: "1", Name: "box", TCP: 9000, UDP: 9001, Free: 1 << 30}
+	port := respond(t, a)
+
+	found, err := Probe(context.Background(), port, 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 {
+		t.Fatalf("found %+v, want one server", found)
+	}
+	if !reflect.DeepEqual(found[0].Announcement, a) {
+		t.Errorf("got %+v, want %+v", found[0].Announcement, a)
+	}
+	if got, want := found[0].Addr("tcp"), net.JoinHostPort(found[0].Host, "9000"); got != want {
+		t.Errorf("TCP address %q, want %q", got, want)
+	}
+	if got := found[0].Addr("quic"); got != "" {
+		t.Errorf("QUIC address %q for a server without it", got)
+	}
+}
+
+// Stray traffic on the discovery port gets no answer, and the responder
+// keeps answering probes after it.
+func TestResponderIgnoresStray(t *testing.T) {
+	port := respond(t, Announcement{Name: "box", TCP: 1})
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+
+	nonce := make([]byte, NONCE_LEN)
+	for _, b := range [][]byte{
+		[]byte("hello"),
+		append([]byte("XXXX"), VERSION, KIND_PROBE, 0, 0, 0, 0, 0, 0, 0, 0),
+		header(KIND_ANSWER, nonce),
+		append([]byte(MAGIC), VERSION+1, KIND_PROBE, 0, 0, 0, 0, 0, 0, 0, 0),
+	} {
+		conn.WriteTo(b, to)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := conn.ReadFrom(make([]byte, MAX_ANSWER)); err == nil {
+		t.Fatalf("answered stray traffic with %d bytes", n)
+	}
+
+	conn.WriteTo(header(KIND_PROBE, nonce), to)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadFrom(make([]byte, MAX_ANSWER)); err != nil {
+		t.Fatalf("no answer to a probe after stray traffic: %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	nonce := []byte("12345678")
+	kind, got, body, err := parse(append(header(KIND_ANSWER, nonce), "{}"...))
+	if err != nil || kind != KIND_ANSWER || string(got) != string(nonce) || string(body) != "{}" {
+		t.Errorf("got %d %q %q %v", kind, got, body, err)
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"short", []byte(MAGIC), wire.ErrMalformed},
+		{"wrong magic", append([]byte("ABCD"), header(KIND_PROBE, nonce)[len(MAGIC):]...), wire.ErrMalformed},
+		{"other version", append(append([]byte(MAGIC), VERSION+1, KIND_PROBE), nonce...), wire.ErrProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, _, err := parse(tt.b); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// A server answering from several addresses is listed once, at the
+// address other hosts can reach.
+func TestMerge(t *testing.T) {
+	got := Merge(
+		[]Found{{Host: "127.0.0.1", Announcement: Announcement{ID: "a", Name: "zeta"}}},
+		[]Found{
+			{Host: "192.168.1.5", Announcement: Announcement{ID: "a", Name: "zeta"}},
+			{Host: "192.168.1.9", Announcement: Announcement{Name: "alpha"}},
+			{Host: "192.168.1.7", Announcement: Announcement{Name: "alpha"}},
+		},
+		[]Found{{Host: "127.0.0.1", Announcement: Announcement{ID: "a", Name: "zeta"}}},
+	)
+	var hosts []string
+	for _, f := range got {
+		hosts = append(hosts, f.Name+"@"+f.Host)
+	}
+	want := []string{"alpha@192.168.1.7", "alpha@192.168.1.9", "zeta@192.168.1.5"}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("got %v, want %v", hosts, want)
+	}
+}
+
+// An mDNS query for the service is answered with records a browsing
+// client reads back as the announcement; other queries get nothing.
+func TestMDNSAnswer(t *testing.T) {
+	a := Announcement{ID: "x1", Name: "my.box", TCP: 9000, TFTP: 69, Free: 42}
+	m := &MDNS{Info: func() Announcement { return a }, Host: "host.example"}
+
+	query := func(name string, typ dnsmessage.Type) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET})
+		msg, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	reply, err := m.answer(query(MDNS_SERVICE, dnsmessage.TypePTR), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h dnsmessage.Header
+	var p dnsmessage.Parser
+	if h, err = p.Start(reply); err != nil || h.ID != 7 || !h.Response {
+		t.Fatalf("header %+v, %v", h, err)
+	}
+	found := parseAnswer(reply)
+	if len(found) != 1 {
+		t.Fatalf("parsed %+v, want one instance", found)
+	}
+	want := a
+	want.Name = "my-box"
+	if !reflect.DeepEqual(found[0].Announcement, want) {
+		t.Errorf("got %+v, want %+v", found[0].Announcement, want)
+	}
+
+	if reply, err := m.answer(query("_http._tcp.local.", dnsmessage.TypePTR), false); err != nil || reply != nil {
+		t.Errorf("answered another service: %x, %v", reply, err)
+	}
+	if _, err := m.answer([]byte("junk"), false); err == nil {
+		t.Error("junk parsed as a query")
+	}
+}
@@ -0,0 +1,336 @@
+package discover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"socket-file-transfer/internal/wire"
+)
+
+const (
+	// DNS-SD service type servers advertise over mDNS
+	MDNS_SERVICE = "_filetransfer._tcp.local."
+
+	MDNS_PORT = 5353
+
+	// Seconds clients may cache the records
+	MDNS_TTL = 120
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: MDNS_PORT}
+
+// MDNS advertises a server over multicast DNS as an instance of
+// MDNS_SERVICE named after its Announcement, for clients that browse
+// services (avahi-browse, dns-sd, Query). It only answers questions about
+// the service; the TXT record carries the Announcement's ports and free
+// space.
+type MDNS struct {
+	Info   func() Announcement // What to announce
+	Host   string              // Host name under .local, the system's if empty
+	Logger *slog.Logger        // wire.DefaultLogger if nil
+}
+
+// ListenAndServe joins the mDNS group and answers until ctx ends.
+func (m *MDNS) ListenAndServe(ctx context.Context) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("error starting mDNS responder: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	log := m.logger()
+	log.Info("Advertising over mDNS", "service", MDNS_SERVICE)
+
+	buffer := make([]byte, 9000)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		reply, err := m.answer(buffer[:n], addr.Port != MDNS_PORT)
+		if err != nil {
+			log.Debug("Ignoring mDNS packet", "remote", addr, "err", err)
+			continue
+		}
+		if reply == nil {
+			continue
+		}
+		// Queries from other ports are one-shot and get a unicast answer
+		// (RFC 6762, section 6.7)
+		to := mdnsGroup
+		if addr.Port != MDNS_PORT {
+			to = addr
+		}
+		conn.WriteToUDP(reply, to)
+	}
+}
+
+func (m *MDNS) logger() *slog.Logger {
+	if m.Logger != nil {
+		return m.Logger
+	}
+	return wire.DefaultLogger
+}
+
+func (m *MDNS) host() string {
+	host := m.Host
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	host, _, _ = strings.Cut(host, ".")
+	if host == "" {
+		host = "transfer"
+	}
+	return host + ".local."
+}
+
+// instance returns the service instance name of a, whose dots would
+// split the label.
+func instance(a Announcement) string {
+	return strings.ReplaceAll(a.Name, ".", "-") + "." + MDNS_SERVICE
+}
+
+// answer returns the reply to the query b, or nil if it asks nothing about
+// our service. A unicast reply repeats the query's ID and questions.
+func (m *MDNS) answer(b []byte, unicast bool) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return nil, err
+	}
+	if h.Response {
+		return nil, nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+
+	a := m.Info()
+	inst := instance(a)
+	var asked []dnsmessage.Question
+	for _, q := range questions {
+		name := strings.ToLower(q.Name.String())
+		switch {
+		case name == MDNS_SERVICE && (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL):
+		case name == strings.ToLower(inst) && (q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT || q.Type == dnsmessage.TypeALL):
+		default:
+			continue
+		}
+		asked = append(asked, q)
+	}
+	if len(asked) == 0 {
+		return nil, nil
+	}
+
+	reply := dnsmessage.Header{Response: true, Authoritative: true}
+	if unicast {
+		reply.ID = h.ID
+	}
+	builder := dnsmessage.NewBuilder(nil, reply)
+	builder.EnableCompression()
+	if unicast {
+		builder.StartQuestions()
+		for _, q := range asked {
+			builder.Question(q)
+		}
+	}
+	if err := m.records(&builder, a, inst); err != nil {
+		return nil, err
+	}
+	return builder.Finish()
+}
+
+// records adds the PTR, SRV, TXT and A records describing a, all as
+// answers so one-shot queriers need no follow-up.
+func (m *MDNS) records(b *dnsmessage.Builder, a Announcement, inst string) error {
+	service := dnsmessage.MustNewName(MDNS_SERVICE)
+	instName, err := dnsmessage.NewName(inst)
+	if err != nil {
+		return err
+	}
+	host, err := dnsmessage.NewName(m.host())
+	if err != nil {
+		return err
+	}
+	port := a.TCP
+	if protos := a.Protocols(); port == 0 && len(protos) > 0 {
+		port = a.Port(protos[0])
+	}
+	var txt []string
+	for _, p := range a.Protocols() {
+		txt = append(txt, p+"="+strconv.Itoa(a.Port(p)))
+	}
+	txt = append(txt, "free="+strconv.FormatInt(a.Free, 10), "v="+strconv.Itoa(VERSION))
+	if a.ID != "" {
+		txt = append(txt, "id="+a.ID)
+	}
+
+	hdr := func(name dnsmessage.Name, t dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: t, Class: dnsmessage.ClassINET, TTL: MDNS_TTL}
+	}
+	b.StartAnswers()
+	if err := b.PTRResource(hdr(service, dnsmessage.TypePTR), dnsmessage.PTRResource{PTR: instName}); err != nil {
+		return err
+	}
+	if err := b.SRVResource(hdr(instName, dnsmessage.TypeSRV), dnsmessage.SRVResource{Port: uint16(port), Target: host}); err != nil {
+		return err
+	}
+	if err := b.TXTResource(hdr(instName, dnsmessage.TypeTXT), dnsmessage.TXTResource{TXT: txt}); err != nil {
+		return err
+	}
+	for _, ip := range localIPv4() {
+		var a4 [4]byte
+		copy(a4[:], ip)
+		if err := b.AResource(hdr(host, dnsmessage.TypeA), dnsmessage.AResource{A: a4}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localIPv4 returns the IPv4 addresses of the interfaces that are up,
+// loopback only if there is nothing else.
+func localIPv4() []net.IP {
+	var ips, loopback []net.IP
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				if ipNet.IP.IsLoopback() {
+					loopback = append(loopback, ipNet.IP.To4())
+				} else {
+					ips = append(ips, ipNet.IP.To4())
+				}
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return loopback
+	}
+	return ips
+}
+
+// Query asks over mDNS for instances of MDNS_SERVICE and returns those
+// that answer within wait, DefaultWait if 0, merged like Probe's.
+func Query(ctx context.Context, wait time.Duration) ([]Found, error) {
+	if wait <= 0 {
+		wait = DefaultWait
+	}
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(MDNS_SERVICE), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET})
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(query, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("error sending mDNS query: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var found []Found
+	buffer := make([]byte, 9000)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		for _, f := range parseAnswer(buffer[:n]) {
+			f.Host = addr.(*net.UDPAddr).IP.String()
+			found = append(found, f)
+		}
+	}
+	return Merge(found), nil
+}
+
+// parseAnswer returns the instances of our service an mDNS response
+// describes with a TXT record.
+func parseAnswer(b []byte) []Found {
+	var p dnsmessage.Parser
+	if h, err := p.Start(b); err != nil || !h.Response {
+		return nil
+	}
+	p.SkipAllQuestions()
+	var found []Found
+	for {
+		rh, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		name := rh.Name.String()
+		label, service, ok := strings.Cut(name, ".")
+		if rh.Type != dnsmessage.TypeTXT || !ok || !strings.EqualFold(service, MDNS_SERVICE) {
+			p.SkipAnswer()
+			continue
+		}
+		txt, err := p.TXTResource()
+		if err != nil {
+			break
+		}
+		a := Announcement{Name: label, Free: -1}
+		for _, kv := range txt.TXT {
+			k, v, _ := strings.Cut(kv, "=")
+			if k == "id" {
+				a.ID = v
+				continue
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch k {
+			case "tcp":
+				a.TCP = int(n)
+			case "udp":
+				a.UDP = int(n)
+			case "quic":
+				a.QUIC = int(n)
+			case "tftp":
+				a.TFTP = int(n)
+			case "free":
+				a.Free = n
+			}
+		}
+		found = append(found, Found{Announcement: a})
+	}
+	return found
+}
@@ -0,0 +1,13 @@
+package discover
+
+import "syscall"
+
+// reuseAddr lets several servers on one host listen on the discovery
+// port; each gets a copy of every broadcast probe.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var err error
+	c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	return err
+}
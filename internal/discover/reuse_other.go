@@ -0,0 +1,10 @@
+//go:build !linux
+
+package discover
+
+import "syscall"
+
+// reuseAddr is a no-op: only one server per host can answer probes.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	return nil
+}
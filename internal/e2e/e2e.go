@@ -0,0 +1,445 @@
+// Package e2e encrypts files on the client so the server stores them
+// without ever seeing their content or name, see 'transfer send -e2e' and
+// 'transfer decrypt'.
+//
+// The key is derived from a passphrase with Argon2id, or read from a key
+// file of 32 bytes, raw or in hex, see ParseSecret. An encrypted file is
+// a cleartext header, the sealed metadata (the file's name and size),
+// then the file in ChunkSize chunks, each sealed with ChaCha20-Poly1305
+// under the STREAM construction: the nonce is a random prefix, the
+// chunk's counter and a flag set on the last chunk only, so chunks can't
+// be reordered, dropped or the file cut short without decryption failing
+// with ErrAuth:
+//
+//	4   magic "SFTE"
+//	1   format version, 1
+//	1   key derivation: 0 key file, 1 Argon2id
+//	16  salt
+//	4   Argon2id passes, 0 with a key file
+//	4   Argon2id memory in KiB, 0 with a key file
+//	1   Argon2id threads, 0 with a key file
+//	4   chunk size
+//	7   nonce prefix
+//	2   length of the sealed metadata
+//	n   sealed metadata, chunk 0, the header above as additional data:
+//	    64-bit size, 16-bit name length and the name
+//	... chunks 1 and up, ChunkSize bytes plus a 16-byte tag each but the
+//	    last, which holds the rest of the file, possibly nothing
+//
+// Integers are big-endian. The key the chunks are sealed with is derived
+// from the Argon2id output or the key file with HKDF-SHA256, the salt and
+// INFO, so it differs for every file.
+package e2e
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Start of every encrypted file
+const MAGIC = "SFTE"
+
+// Format version this package writes and reads
+const VERSION = 1
+
+// Suffix of the names encrypted files are stored under
+const SUFFIX = ".enc"
+
+// HKDF info of the key chunks are sealed with
+const INFO = "socket-file-transfer e2e v1"
+
+const (
+	KDF_KEY_FILE = 0
+	KDF_ARGON2ID = 1
+)
+
+// Argon2id parameters for passphrases, as RFC 9106 recommends for
+// memory-constrained settings
+const (
+	ARGON2_TIME    = 3
+	ARGON2_MEMORY  = 64 * 1024 // KiB
+	ARGON2_THREADS = 4
+)
+
+// Largest Argon2id parameters a file may ask for, so a crafted one can't
+// exhaust the machine decrypting it
+const (
+	MAX_ARGON2_TIME   = 16
+	MAX_ARGON2_MEMORY = 1024 * 1024 // KiB
+)
+
+// Plaintext bytes per chunk
+const (
+	DEFAULT_CHUNK_SIZE = 64 * 1024
+	MIN_CHUNK_SIZE     = 1024
+	MAX_CHUNK_SIZE     = 16 * 1024 * 1024
+)
+
+const (
+	KEY_SIZE    = 32
+	SALT_SIZE   = 16
+	PREFIX_SIZE = 7
+	HEADER_LEN  = len(MAGIC) + 1 + 1 + SALT_SIZE + 4 + 4 + 1 + 4 + PREFIX_SIZE
+)
+
+// ErrAuth is returned when a file doesn't decrypt: the key is wrong, or
+// the file was altered or cut short. Nothing of it should be trusted.
+var ErrAuth = errors.New("decryption failed: wrong key, or the file was altered or truncated")
+
+// Where salts and nonce prefixes come from
+var random io.Reader = rand.Reader
+
+// Secret is what a key is derived from: a passphrase or a key file.
+type Secret struct {
+	passphrase []byte
+	key        []byte // From a key file, nil for a passphrase
+}
+
+// ParseSecret returns the secret s names, by its prefix:
+//
+//	pass:<passphrase>  the passphrase itself
+//	env:<name>         the passphrase in the environment variable name
+//	file:<path>        the key in the file at path, 32 bytes, raw or in hex
+//
+// A value without one is refused rather than guessed at, so a mistyped
+// key file path can't become the passphrase.
+func ParseSecret(s string) (Secret, error) {
+	kind, value, _ := strings.Cut(s, ":")
+	switch kind {
+	case "pass":
+		if value == "" {
+			return Secret{}, errors.New("empty passphrase")
+		}
+		return Secret{passphrase: []byte(value)}, nil
+	case "env":
+		passphrase := os.Getenv(value)
+		if passphrase == "" {
+			return Secret{}, fmt.Errorf("no passphrase in $%s", value)
+		}
+		return Secret{passphrase: []byte(passphrase)}, nil
+	case "file":
+		return readKeyFile(value)
+	}
+	return Secret{}, errors.New("want pass:<passphrase>, env:<variable> or file:<key file>")
+}
+
+// readKeyFile returns the key in the file at path.
+func readKeyFile(path string) (Secret, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Secret{}, fmt.Errorf("error reading key file: %w", err)
+	}
+	if len(data) == KEY_SIZE {
+		return Secret{key: data}, nil
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != KEY_SIZE {
+		return Secret{}, fmt.Errorf("key file %s holds neither %d bytes nor %d hex digits", path, KEY_SIZE, 2*KEY_SIZE)
+	}
+	return Secret{key: key}, nil
+}
+
+// Metadata is what the server doesn't get to see about a file.
+type Metadata struct {
+	Name string
+	Size int64
+}
+
+// header is the cleartext start of an encrypted file.
+type header struct {
+	kdf       byte
+	salt      [SALT_SIZE]byte
+	time      uint32
+	memory    uint32
+	threads   uint8
+	chunkSize uint32
+	prefix    [PREFIX_SIZE]byte
+}
+
+func (h *header) marshal() []byte {
+	b := make([]byte, 0, HEADER_LEN)
+	b = append(b, MAGIC...)
+	b = append(b, VERSION, h.kdf)
+	b = append(b, h.salt[:]...)
+	b = binary.BigEndian.AppendUint32(b, h.time)
+	b = binary.BigEndian.AppendUint32(b, h.memory)
+	b = append(b, h.threads)
+	b = binary.BigEndian.AppendUint32(b, h.chunkSize)
+	return append(b, h.prefix[:]...)
+}
+
+func parseHeader(b []byte) (*header, error) {
+	if string(b[:len(MAGIC)]) != MAGIC {
+		return nil, errors.New("not an encrypted file")
+	}
+	b = b[len(MAGIC):]
+	if b[0] != VERSION {
+		return nil, fmt.Errorf("encrypted with format version %d, this version reads %d", b[0], VERSION)
+	}
+	h := &header{kdf: b[1]}
+	b = b[2:]
+	b = b[copy(h.salt[:], b):]
+	h.time = binary.BigEndian.Uint32(b)
+	h.memory = binary.BigEndian.Uint32(b[4:])
+	h.threads = b[8]
+	h.chunkSize = binary.BigEndian.Uint32(b[9:])
+	copy(h.prefix[:], b[13:])
+
+	switch {
+	case h.kdf != KDF_KEY_FILE && h.kdf != KDF_ARGON2ID:
+		return nil, fmt.Errorf("unknown key derivation %d", h.kdf)
+	case h.kdf == KDF_ARGON2ID && (h.time == 0 || h.time > MAX_ARGON2_TIME || h.memory == 0 || h.memory > MAX_ARGON2_MEMORY || h.threads == 0):
+		return nil, fmt.Errorf("Argon2id parameters out of range: %d passes, %d KiB, %d threads", h.time, h.memory, h.threads)
+	case h.chunkSize < MIN_CHUNK_SIZE || h.chunkSize > MAX_CHUNK_SIZE:
+		return nil, fmt.Errorf("chunk size %d out of range", h.chunkSize)
+	}
+	return h, nil
+}
+
+// aead derives the key of a file with header h from secret.
+func (h *header) aead(secret Secret) (cipher.AEAD, error) {
+	var master []byte
+	switch {
+	case h.kdf == KDF_ARGON2ID && secret.key == nil:
+		master = argon2.IDKey(secret.passphrase, h.salt[:], h.time, h.memory, h.threads, KEY_SIZE)
+	case h.kdf == KDF_KEY_FILE && secret.key != nil:
+		master = secret.key
+	case h.kdf == KDF_ARGON2ID:
+		return nil, errors.New("encrypted with a passphrase, not a key file")
+	default:
+		return nil, errors.New("encrypted with a key file, not a passphrase")
+	}
+	key := make([]byte, KEY_SIZE)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, h.salt[:], []byte(INFO)), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// nonce returns the nonce of chunk counter, the last one if last.
+func (h *header) nonce(counter uint32, last bool) []byte {
+	n := make([]byte, 0, chacha20poly1305.NonceSize)
+	n = append(n, h.prefix[:]...)
+	n = binary.BigEndian.AppendUint32(n, counter)
+	if last {
+		return append(n, 1)
+	}
+	return append(n, 0)
+}
+
+// Writer encrypts a file as it is written, see NewWriter.
+type Writer struct {
+	w       io.Writer
+	h       *header
+	aead    cipher.AEAD
+	size    int64 // Left to write
+	counter uint32
+	buffer  []byte
+}
+
+// NewWriter writes the header and sealed metadata of meta.Size bytes of
+// plaintext named meta.Name to w, encrypted with a key derived from
+// secret, then returns the Writer that encrypts them to w in chunkSize
+// chunks, DEFAULT_CHUNK_SIZE if 0. Close writes the last chunk.
+func NewWriter(w io.Writer, secret Secret, meta Metadata, chunkSize int) (*Writer, error) {
+	if chunkSize == 0 {
+		chunkSize = DEFAULT_CHUNK_SIZE
+	}
+	if chunkSize < MIN_CHUNK_SIZE || chunkSize > MAX_CHUNK_SIZE {
+		return nil, fmt.Errorf("chunk size %d out of range", chunkSize)
+	}
+	if int64(len(meta.Name)) > math.MaxUint16 || meta.Size < 0 {
+		return nil, errors.New("invalid metadata")
+	}
+	if meta.Size/int64(chunkSize) >= math.MaxUint32-1 {
+		return nil, errors.New("file too large to encrypt in chunks this size")
+	}
+
+	h := &header{kdf: KDF_KEY_FILE, chunkSize: uint32(chunkSize)}
+	if secret.key == nil {
+		h.kdf, h.time, h.memory, h.threads = KDF_ARGON2ID, ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS
+	}
+	if _, err := io.ReadFull(random, h.salt[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(random, h.prefix[:]); err != nil {
+		return nil, err
+	}
+	aead, err := h.aead(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	hb := h.marshal()
+	plain := binary.BigEndian.AppendUint64(nil, uint64(meta.Size))
+	plain = binary.BigEndian.AppendUint16(plain, uint16(len(meta.Name)))
+	plain = append(plain, meta.Name...)
+	sealed := aead.Seal(nil, h.nonce(0, false), plain, hb)
+	out := binary.BigEndian.AppendUint16(hb, uint16(len(sealed)))
+	if _, err := w.Write(append(out, sealed...)); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, h: h, aead: aead, size: meta.Size, counter: 1, buffer: make([]byte, 0, chunkSize+aead.Overhead())}, nil
+}
+
+// Write encrypts p, failing if that is more than the size NewWriter was
+// given.
+func (e *Writer) Write(p []byte) (int, error) {
+	if int64(len(p)) > e.size {
+		return 0, errors.New("more plaintext than announced")
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), int(e.h.chunkSize)-len(e.buffer))
+		e.buffer = append(e.buffer, p[:n]...)
+		p, written, e.size = p[n:], written+n, e.size-int64(n)
+		// The last chunk waits for Close, even if full
+		if len(e.buffer) == int(e.h.chunkSize) && e.size > 0 {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close writes the last chunk, failing if less than the size NewWriter
+// was given was written. It doesn't close the underlying writer.
+func (e *Writer) Close() error {
+	if e.size > 0 {
+		return errors.New("less plaintext than announced")
+	}
+	if len(e.buffer) == int(e.h.chunkSize) {
+		if err := e.seal(false); err != nil {
+			return err
+		}
+	}
+	return e.seal(true)
+}
+
+func (e *Writer) seal(last bool) error {
+	sealed := e.aead.Seal(e.buffer[:0], e.h.nonce(e.counter, last), e.buffer, nil)
+	e.counter++
+	e.buffer = e.buffer[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// Reader decrypts a file as it is read, see NewReader.
+type Reader struct {
+	Metadata
+
+	r       io.Reader
+	h       *header
+	aead    cipher.AEAD
+	left    int64 // Plaintext bytes still to decrypt
+	counter uint32
+	chunk   []byte // Decrypted, not yet read
+	buffer  []byte
+	done    bool
+}
+
+// NewReader reads the header and metadata of the encrypted file r,
+// deriving its key from secret. A wrong secret fails with ErrAuth.
+func NewReader(r io.Reader, secret Secret) (*Reader, error) {
+	hb := make([]byte, HEADER_LEN+2)
+	if _, err := io.ReadFull(r, hb); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errors.New("not an encrypted file")
+		}
+		return nil, err
+	}
+	h, err := parseHeader(hb[:HEADER_LEN])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := h.aead(secret)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, binary.BigEndian.Uint16(hb[HEADER_LEN:]))
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, ErrAuth
+	}
+	plain, err := aead.Open(nil, h.nonce(0, false), sealed, hb[:HEADER_LEN])
+	if err != nil || len(plain) < 10 || len(plain) != 10+int(binary.BigEndian.Uint16(plain[8:])) {
+		return nil, ErrAuth
+	}
+	size := int64(binary.BigEndian.Uint64(plain))
+	if size < 0 {
+		return nil, ErrAuth
+	}
+	return &Reader{
+		Metadata: Metadata{Name: string(plain[10:]), Size: size},
+		r:        r,
+		h:        h,
+		aead:     aead,
+		left:     size,
+		counter:  1,
+		buffer:   make([]byte, int(h.chunkSize)+aead.Overhead()),
+	}, nil
+}
+
+// Read decrypts the file into p. Once all of it was read it returns
+// io.EOF, unless more data follows the last chunk, which fails with
+// ErrAuth like any chunk that doesn't decrypt.
+func (d *Reader) Read(p []byte) (int, error) {
+	for len(d.chunk) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.chunk)
+	d.chunk = d.chunk[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk.
+func (d *Reader) open() error {
+	// Every chunk is full but the last, which is flagged, so a file of a
+	// multiple of the chunk size ends with an empty one
+	n := int(d.h.chunkSize)
+	last := d.left < int64(n)
+	if last {
+		n = int(d.left)
+	}
+	sealed := d.buffer[:n+d.aead.Overhead()]
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrAuth
+		}
+		return err
+	}
+	plain, err := d.aead.Open(sealed[:0], d.h.nonce(d.counter, last), sealed, nil)
+	if err != nil {
+		return ErrAuth
+	}
+	d.counter++
+	d.left -= int64(len(plain))
+	d.chunk = plain
+	if last {
+		var b [1]byte
+		if n, _ := io.ReadFull(d.r, b[:]); n > 0 {
+			return ErrAuth
+		}
+		d.done = true
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The key of the key file vectors: bytes 0 to 31
+var testKey = func() Secret {
+	key := make([]byte, KEY_SIZE)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return Secret{key: key}
+}()
+
+const testPassphrase = "correct horse battery staple"
+
+// fixedRandom makes the salt 0x40 to 0x4f and the nonce prefix 0x50 to
+// 0x56 of the files written until the test ends.
+func fixedRandom(t *testing.T) {
+	seed := make([]byte, SALT_SIZE+PREFIX_SIZE)
+	for i := range seed {
+		seed[i] = byte(0x40 + i)
+	}
+	saved := random
+	random = bytes.NewReader(seed)
+	t.Cleanup(func() { random = saved })
+}
+
+// encrypt returns plain encrypted in chunkSize chunks.
+func encrypt(t *testing.T, secret Secret, meta Metadata, plain []byte, chunkSize int) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := NewWriter(&out, secret, meta, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// decrypt returns the metadata and content of the encrypted file b.
+func decrypt(b []byte, secret Secret) (Metadata, []byte, error) {
+	r, err := NewReader(bytes.NewReader(b), secret)
+	if err != nil {
+		return Metadata{}, nil, err
+	}
+	plain, err := io.ReadAll(r)
+	return r.Metadata, plain, err
+}
+
+// chunksPlain is the content of testdata/chunks.enc: 2500 bytes counting
+// up modulo 251.
+func chunksPlain() []byte {
+	b := make([]byte, 2500)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// Files written with fixed keys, salts and nonce prefixes. Whatever
+// version of this package comes next must still decrypt them, and this
+// one writes them exactly.
+var vectors = []struct {
+	name       string
+	secret     Secret
+	meta       Metadata
+	plain      []byte
+	ciphertext string // Hex
+}{
+	{
+		name:       "key file",
+		secret:     testKey,
+		meta:       Metadata{Name: "hello.txt", Size: 13},
+		plain:      []byte("hello, world\n"),
+		ciphertext: "534654450100404142434445464748494a4b4c4d4e4f000000000000000000000004005051525354555600235efef2f09bf48d65521ba8fa417299b1530d3f786379c918a9400e0aee0d96b86a22cfb45c28106833849faf27f45d3da1f039fb534f51964c97f4f2a89518cb",
+	},
+	{
+		name:       "empty file",
+		secret:     testKey,
+		meta:       Metadata{Name: "empty"},
+		ciphertext: "534654450100404142434445464748494a4b4c4d4e4f0000000000000000000000040050515253545556001f5efef2f09bf48d685217a5f25d6a8f1e754bdfb0ccc8be64a30181df12266694b7f1230e572f1e7ab2e386168010c3",
+	},
+	{
+		name:       "passphrase",
+		secret:     Secret{passphrase: []byte(testPassphrase)},
+		meta:       Metadata{Name: "hello.txt", Size: 13},
+		plain:      []byte("hello, world\n"),
+		ciphertext: "534654450101404142434445464748494a4b4c4d4e4f00000003000100000400000400505152535455560023f75619cd234f3c6c6742e1fe9035221fb365152694cfa268787b04977b5ad819311928a4e6282ddabe3a6b7c868344de876e193346c0fd0e6d0f167e1ea25aad",
+	},
+}
+
+func TestVectors(t *testing.T) {
+	chunks, err := os.ReadFile(filepath.Join("testdata", "chunks.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := vectors
+	tests = append(tests, struct {
+		name       string
+		secret     Secret
+		meta       Metadata
+		plain      []byte
+		ciphertext string
+	}{"several chunks", testKey, Metadata{Name: "chunks.bin", Size: 2500}, chunksPlain(), hex.EncodeToString(chunks)})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := hex.DecodeString(tt.ciphertext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta, plain, err := decrypt(want, tt.secret)
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if meta != tt.meta || !bytes.Equal(plain, tt.plain) {
+				t.Errorf("decrypted %+v %q, want %+v %q", meta, plain, tt.meta, tt.plain)
+			}
+
+			fixedRandom(t)
+			if got := encrypt(t, tt.secret, tt.meta, tt.plain, MIN_CHUNK_SIZE); !bytes.Equal(got, want) {
+				t.Errorf("encrypted\n%x\nwant\n%x", got, want)
+			}
+		})
+	}
+}
+
+// Files of every size around the chunk boundaries decrypt to what was
+// encrypted.
+func TestRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, MIN_CHUNK_SIZE - 1, MIN_CHUNK_SIZE, MIN_CHUNK_SIZE + 1, 3 * MIN_CHUNK_SIZE, 3*MIN_CHUNK_SIZE + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		meta := Metadata{Name: "relatório 📄.pdf", Size: int64(size)}
+		b := encrypt(t, testKey, meta, plain, MIN_CHUNK_SIZE)
+		got, out, err := decrypt(b, testKey)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if got != meta || !bytes.Equal(out, plain) {
+			t.Errorf("%d bytes: decrypted %+v and %d bytes", size, got, len(out))
+		}
+	}
+}
+
+// Every way of altering a file, or using the wrong key, fails to
+// authenticate instead of giving garbage.
+func TestTamper(t *testing.T) {
+	chunks, err := os.ReadFile(filepath.Join("testdata", "chunks.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Where the sealed metadata ends and each chunk starts
+	data := HEADER_LEN + 2 + 8 + 2 + len("chunks.bin") + 16
+	chunk := MIN_CHUNK_SIZE + 16
+	flip := func(i int) []byte {
+		b := bytes.Clone(chunks)
+		b[i] ^= 1
+		return b
+	}
+	wrongKey := bytes.Clone(testKey.key)
+	wrongKey[0] ^= 1
+
+	tests := []struct {
+		name   string
+		b      []byte
+		secret Secret
+	}{
+		{"wrong key", chunks, Secret{key: wrongKey}},
+		{"salt", flip(len(MAGIC) + 2), testKey},
+		{"chunk size", flip(len(MAGIC) + 2 + SALT_SIZE + 9 + 3), testKey},
+		{"nonce prefix", flip(HEADER_LEN - 1), testKey},
+		{"metadata length", flip(HEADER_LEN + 1), testKey},
+		{"metadata", flip(HEADER_LEN + 4), testKey},
+		{"first chunk", flip(data + 10), testKey},
+		{"first chunk tag", flip(data + chunk - 1), testKey},
+		{"last chunk", flip(len(chunks) - 20), testKey},
+		{"cut in the metadata", chunks[:data-1], testKey},
+		{"cut after the metadata", chunks[:data], testKey},
+		{"cut in a chunk", chunks[:data+100], testKey},
+		{"cut between chunks", chunks[:data+2*chunk], testKey},
+		{"last chunk cut short", chunks[:len(chunks)-1], testKey},
+		{"chunk dropped", append(bytes.Clone(chunks[:data+chunk]), chunks[data+2*chunk:]...), testKey},
+		{"chunks swapped", bytes.Join([][]byte{chunks[:data], chunks[data+chunk : data+2*chunk], chunks[data : data+chunk], chunks[data+2*chunk:]}, nil), testKey},
+		{"chunk repeated", bytes.Join([][]byte{chunks[:data+chunk], chunks[data:]}, nil), testKey},
+		{"byte appended", append(bytes.Clone(chunks), 0), testKey},
+		{"chunk appended", append(bytes.Clone(chunks), chunks[data:data+chunk]...), testKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, plain, err := decrypt(tt.b, tt.secret)
+			if !errors.Is(err, ErrAuth) {
+				t.Errorf("got %v with %d bytes, want ErrAuth", err, len(plain))
+			}
+		})
+	}
+}
+
+// A file that isn't one this package wrote, or asks for more than it
+// allows, is refused before any key is derived.
+func TestHeaderErrors(t *testing.T) {
+	chunks, err := os.ReadFile(filepath.Join("testdata", "chunks.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := func(i int, v ...byte) []byte {
+		b := bytes.Clone(chunks)
+		copy(b[i:], v)
+		return b
+	}
+	tests := []struct {
+		name   string
+		b      []byte
+		secret Secret
+	}{
+		{"empty", nil, testKey},
+		{"cut in the header", chunks[:HEADER_LEN+1], testKey},
+		{"magic", set(0, 'X'), testKey},
+		{"newer version", set(len(MAGIC), VERSION+1), testKey},
+		{"unknown key derivation", set(len(MAGIC)+1, 7), testKey},
+		{"chunk size too small", set(len(MAGIC)+2+SALT_SIZE+9, 0, 0, 0, 1), testKey},
+		{"chunk size too large", set(len(MAGIC)+2+SALT_SIZE+9, 0xff, 0, 0, 0), testKey},
+		{"Argon2id memory too large", set(len(MAGIC)+1, KDF_ARGON2ID, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 1), Secret{passphrase: []byte("p")}},
+		{"passphrase for a key file", chunks, Secret{passphrase: []byte(testPassphrase)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := decrypt(tt.b, tt.secret); err == nil || errors.Is(err, ErrAuth) {
+				t.Errorf("got %v, want an error other than ErrAuth", err)
+			}
+		})
+	}
+}
+
+func TestWriterSize(t *testing.T) {
+	w, err := NewWriter(io.Discard, testKey, Metadata{Name: "f", Size: 3}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("four")); err == nil {
+		t.Error("wrote more than announced")
+	}
+	w.Write([]byte("ab"))
+	if err := w.Close(); err == nil {
+		t.Error("closed with less than announced")
+	}
+	if _, err := NewWriter(io.Discard, testKey, Metadata{Name: "f"}, MIN_CHUNK_SIZE-1); err == nil {
+		t.Error("chunk size below the minimum accepted")
+	}
+}
+
+func TestParseSecret(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	raw := write("raw", testKey.key)
+	hexKey := write("hex", []byte(hex.EncodeToString(testKey.key)+"\n"))
+	short := write("short", []byte("too short"))
+	t.Setenv("TRANSFER_TEST_PASSPHRASE", testPassphrase)
+
+	tests := []struct {
+		s    string
+		want Secret // Nil fields for an error
+	}{
+		{"pass:" + testPassphrase, Secret{passphrase: []byte(testPassphrase)}},
+		{"pass:with:colons", Secret{passphrase: []byte("with:colons")}},
+		{"env:TRANSFER_TEST_PASSPHRASE", Secret{passphrase: []byte(testPassphrase)}},
+		{"file:" + raw, testKey},
+		{"file:" + hexKey, testKey},
+		{"file:" + short, Secret{}},
+		{"file:" + filepath.Join(dir, "missing"), Secret{}},
+		{"pass:", Secret{}},
+		{"env:TRANSFER_TEST_UNSET", Secret{}},
+		{"", Secret{}},
+		{raw, Secret{}}, // No guessing it is a key file
+		{testPassphrase, Secret{}},
+		{"key:" + raw, Secret{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseSecret(tt.s)
+			if tt.want.key == nil && tt.want.passphrase == nil {
+				if err == nil {
+					t.Errorf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.key, tt.want.key) || !bytes.Equal(got.passphrase, tt.want.passphrase) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Package fec implements a systematic Reed-Solomon erasure code over
+// GF(2^8).
+//
+// A Code extends k data shards with m parity shards so that any k of the
+// k+m shards recover the data. The parity rows form a Cauchy matrix, which
+// keeps every square submatrix of the encoding matrix invertible.
+package fec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxShards bounds data plus parity shards: the field has 256 elements.
+const MaxShards = 256
+
+var ErrTooFewShards = errors.New("fec: too few shards to reconstruct")
+
+// Code encodes and reconstructs groups of k data and m parity shards.
+type Code struct {
+	k, m   int
+	parity [][]byte // m rows of k coefficients
+}
+
+// New returns a code for k data and m parity shards.
+func New(k, m int) (*Code, error) {
+	if k < 1 || m < 1 || k+m > MaxShards {
+		return nil, fmt.Errorf("fec: invalid code %d/%d", k, k+m)
+	}
+	c := &Code{k: k, m: m, parity: make([][]byte, m)}
+	for i := range c.parity {
+		row := make([]byte, k)
+		for j := range row {
+			row[j] = inv(byte(k+i) ^ byte(j))
+		}
+		c.parity[i] = row
+	}
+	return c, nil
+}
+
+// DataShards returns k.
+func (c *Code) DataShards() int { return c.k }
+
+// ParityShards returns m.
+func (c *Code) ParityShards() int { return c.m }
+
+// Accumulate adds data shard j to the m parity shards, so a sender can
+// encode a group as its data goes out. Parity shards start zeroed and must
+// be at least as long as data; a shorter data shard counts as zero-padded.
+func (c *Code) Accumulate(j int, data []byte, parity [][]byte) {
+	for i, p := range parity {
+		mulAdd(p, data, c.parity[i][j])
+	}
+}
+
+// Encode computes the m parity shards of k equally long data shards.
+func (c *Code) Encode(data, parity [][]byte) {
+	for _, p := range parity {
+		clear(p)
+	}
+	for j, d := range data {
+		c.Accumulate(j, d, parity)
+	}
+}
+
+// Reconstruct fills in the missing data shards of shards, which holds the k
+// data shards followed by the m parity shards, nil where missing. Present
+// shards must all have the same length. Missing parity shards are left nil.
+func (c *Code) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.k+c.m {
+		return fmt.Errorf("fec: %d shards for a %d/%d code", len(shards), c.k, c.k+c.m)
+	}
+
+	// Pick k present shards and the encoding matrix rows that made them
+	var missing []int
+	size := -1
+	rows := make([][]byte, 0, c.k)
+	inputs := make([][]byte, 0, c.k)
+	for i, s := range shards {
+		if s == nil {
+			if i < c.k {
+				missing = append(missing, i)
+			}
+			continue
+		}
+		if size >= 0 && len(s) != size {
+			return fmt.Errorf("fec: shard %d is %d bytes, want %d", i, len(s), size)
+		}
+		size = len(s)
+		if len(rows) == c.k {
+			continue
+		}
+		if i < c.k {
+			row := make([]byte, c.k)
+			row[i] = 1
+			rows = append(rows, row)
+		} else {
+			rows = append(rows, c.parity[i-c.k])
+		}
+		inputs = append(inputs, s)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if len(rows) < c.k {
+		return ErrTooFewShards
+	}
+
+	decode := invert(rows)
+	for _, j := range missing {
+		out := make([]byte, size)
+		for r, in := range inputs {
+			mulAdd(out, in, decode[j][r])
+		}
+		shards[j] = out
+	}
+	return nil
+}
+
+// invert returns the inverse of the square matrix m by Gauss-Jordan
+// elimination. Rows of an encoding matrix are always independent.
+func invert(m [][]byte) [][]byte {
+	n := len(m)
+	a := make([][]byte, n)
+	for i := range a {
+		a[i] = make([]byte, 2*n)
+		copy(a[i], m[i])
+		a[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for a[pivot][col] == 0 {
+			pivot++
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+
+		scale := inv(a[col][col])
+		for j := range a[col] {
+			a[col][j] = mul(a[col][j], scale)
+		}
+		for i := range a {
+			if i != col && a[i][col] != 0 {
+				mulAdd(a[i], a[col], a[i][col])
+			}
+		}
+	}
+
+	for i := range a {
+		a[i] = a[i][n:]
+	}
+	return a
+}
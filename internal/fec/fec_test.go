@@ -0,0 +1,171 @@
+package fec
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := mul(byte(a), inv(byte(a))); got != 1 {
+			t.Fatalf("%d * inv(%d) = %d", a, a, got)
+		}
+		if mul(byte(a), 0) != 0 || mul(byte(a), 1) != byte(a) {
+			t.Fatalf("%d times 0 or 1 is off", a)
+		}
+	}
+	// Multiplication distributes over addition, which is XOR
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		a, b, c := byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))
+		if mul(a, b^c) != mul(a, b)^mul(a, c) {
+			t.Fatalf("%d*(%d+%d) doesn't distribute", a, b, c)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, km := range [][2]int{{0, 1}, {1, 0}, {200, 57}, {-1, 2}} {
+		if _, err := New(km[0], km[1]); err == nil {
+			t.Errorf("New(%d, %d) accepted", km[0], km[1])
+		}
+	}
+	c, err := New(200, 56)
+	if err != nil || c.DataShards() != 200 || c.ParityShards() != 56 {
+		t.Errorf("New(200, 56) = %v, %v", c, err)
+	}
+}
+
+// shards returns k random data shards of size bytes and their m parity
+// shards, encoded by c.
+func shards(t *testing.T, c *Code, size int, seed int64) [][]byte {
+	t.Helper()
+	r := rand.New(rand.NewSource(seed))
+	all := make([][]byte, c.k+c.m)
+	for i := range all {
+		all[i] = make([]byte, size)
+		if i < c.k {
+			r.Read(all[i])
+		}
+	}
+	c.Encode(all[:c.k], all[c.k:])
+	return all
+}
+
+// lose returns a copy of all with the shards at the given indexes nil.
+func lose(all [][]byte, indexes ...int) [][]byte {
+	got := append([][]byte(nil), all...)
+	for _, i := range indexes {
+		got[i] = nil
+	}
+	return got
+}
+
+// Parity shard i is the sum of the data shards j weighted by
+// 1/((k+i) XOR j), as PROTOCOL.md specifies.
+func TestParityCoefficients(t *testing.T) {
+	const k, m = 5, 2
+	c, _ := New(k, m)
+	all := shards(t, c, 100, 2)
+	for i := 0; i < m; i++ {
+		want := make([]byte, 100)
+		for j, d := range all[:k] {
+			for b := range want {
+				want[b] ^= mul(inv(byte(k+i)^byte(j)), d[b])
+			}
+		}
+		if !bytes.Equal(all[k+i], want) {
+			t.Errorf("parity shard %d doesn't match the Cauchy coefficients", i)
+		}
+	}
+}
+
+// Every pattern of up to m lost shards of a small code is recovered.
+func TestReconstructAllPatterns(t *testing.T) {
+	const k, m = 5, 3
+	c, _ := New(k, m)
+	all := shards(t, c, 64, 3)
+	for mask := 0; mask < 1<<(k+m); mask++ {
+		var lost []int
+		for i := 0; i < k+m; i++ {
+			if mask&(1<<i) != 0 {
+				lost = append(lost, i)
+			}
+		}
+		got := lose(all, lost...)
+		err := c.Reconstruct(got)
+		if len(lost) > m {
+			if !errors.Is(err, ErrTooFewShards) {
+				t.Fatalf("lost %v: got %v, want ErrTooFewShards", lost, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("lost %v: %v", lost, err)
+		}
+		for i := 0; i < k; i++ {
+			if !bytes.Equal(got[i], all[i]) {
+				t.Fatalf("lost %v: data shard %d rebuilt wrong", lost, i)
+			}
+		}
+	}
+}
+
+// The largest code recovers the most shards it can lose.
+func TestReconstructLarge(t *testing.T) {
+	c, _ := New(200, 56)
+	all := shards(t, c, 32, 4)
+	lost := rand.New(rand.NewSource(5)).Perm(256)[:56]
+	got := lose(all, lost...)
+	if err := c.Reconstruct(got); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if !bytes.Equal(got[i], all[i]) {
+			t.Fatalf("data shard %d rebuilt wrong", i)
+		}
+	}
+}
+
+// Accumulating shards one at a time, some shorter than the rest, encodes
+// the same as zero-padding them.
+func TestAccumulate(t *testing.T) {
+	c, _ := New(3, 2)
+	data := [][]byte{[]byte("first shard"), []byte("second one!"), []byte("end")}
+	parity := [][]byte{make([]byte, 11), make([]byte, 11)}
+	for j, d := range data {
+		c.Accumulate(j, d, parity)
+	}
+
+	padded := [][]byte{data[0], data[1], append([]byte("end"), make([]byte, 8)...)}
+	want := [][]byte{make([]byte, 11), make([]byte, 11)}
+	c.Encode(padded, want)
+	for i := range want {
+		if !bytes.Equal(parity[i], want[i]) {
+			t.Errorf("parity %d: accumulated %x, encoded %x", i, parity[i], want[i])
+		}
+	}
+
+	got := lose(append(padded, parity...), 0, 2)
+	if err := c.Reconstruct(got); err != nil || !bytes.Equal(got[2], padded[2]) {
+		t.Errorf("short shard rebuilt as %q (%v)", got[2], err)
+	}
+}
+
+func TestReconstructErrors(t *testing.T) {
+	c, _ := New(2, 1)
+	all := shards(t, c, 8, 6)
+	if err := c.Reconstruct(all[:2]); err == nil {
+		t.Error("accepted 2 shards for a 2/3 code")
+	}
+	uneven := lose(all, 0)
+	uneven[1] = uneven[1][:4]
+	if err := c.Reconstruct(uneven); err == nil {
+		t.Error("accepted shards of different lengths")
+	}
+	if err := c.Reconstruct(all); err != nil {
+		t.Errorf("nothing missing: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+// Package filter decides which files a server accepts, by the extension of
+// their name and, optionally, by what the start of their content looks
+// like to http.DetectContentType, which catches files renamed to pass the
+// extension check.
+package filter
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// How much of a file's content sniffing looks at, all that
+// http.DetectContentType considers
+const SNIFF_LEN = 512
+
+// Filter holds the rules of one server.
+type Filter struct {
+	accept []string
+	reject []string
+	types  []string
+}
+
+// New returns a Filter that accepts names ending in one of the accept
+// extensions, any if there are none, unless they end in one of the reject
+// ones, and content of one of types, any if there are none. Extensions
+// may omit the leading dot and may have several parts, like "tar.gz"; all
+// matching ignores case. New returns nil if nothing is restricted.
+func New(accept, reject, types []string) *Filter {
+	if len(accept) == 0 && len(reject) == 0 && len(types) == 0 {
+		return nil
+	}
+	f := &Filter{}
+	for _, ext := range accept {
+		f.accept = append(f.accept, normalizeExt(ext))
+	}
+	for _, ext := range reject {
+		f.reject = append(f.reject, normalizeExt(ext))
+	}
+	for _, t := range types {
+		f.types = append(f.types, mediaType(t))
+	}
+	return f
+}
+
+func normalizeExt(ext string) string {
+	return "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+}
+
+// mediaType strips the parameters from a content type, so that
+// "text/plain; charset=utf-8" matches "text/plain".
+func mediaType(t string) string {
+	t, _, _ = strings.Cut(t, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+func hasExt(name string, exts []string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range exts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckName returns an error wrapping wire.ErrRejected, and logs the
+// refusal, if name doesn't have an accepted extension. A nil Filter
+// accepts every name.
+func (f *Filter) CheckName(name string, log *slog.Logger) error {
+	if f == nil {
+		return nil
+	}
+	if hasExt(name, f.reject) || len(f.accept) > 0 && !hasExt(name, f.accept) {
+		log.Warn("Refused file", "name", name, "reason", "filter", "rule", "extension")
+		return fmt.Errorf("%w: %q does not have an accepted extension", wire.ErrRejected, name)
+	}
+	return nil
+}
+
+// Sniffer returns a Sniffer for the content of the file name, or nil if f
+// doesn't check content.
+func (f *Filter) Sniffer(name string, log *slog.Logger) *Sniffer {
+	if f == nil || len(f.types) == 0 {
+		return nil
+	}
+	return &Sniffer{types: f.types, name: name, log: log}
+}
+
+// Sniffer checks the content type of a file written to it in order. Its
+// first SNIFF_LEN bytes are checked as soon as they are written, so a
+// transfer can be aborted early; shorter files are checked by Close.
+// A nil Sniffer accepts everything.
+type Sniffer struct {
+	types   []string
+	name    string
+	log     *slog.Logger
+	head    []byte
+	checked bool
+	err     error
+}
+
+// Write adds p to the content seen, returning an error wrapping
+// wire.ErrRejected once the content is known not to be accepted.
+func (s *Sniffer) Write(p []byte) (int, error) {
+	if s == nil {
+		return len(p), nil
+	}
+	if !s.checked {
+		s.head = append(s.head, p[:min(len(p), SNIFF_LEN-len(s.head))]...)
+		if len(s.head) == SNIFF_LEN {
+			s.check()
+		}
+	}
+	return len(p), s.err
+}
+
+// Close checks the content of a file shorter than SNIFF_LEN bytes.
+func (s *Sniffer) Close() error {
+	if s == nil {
+		return nil
+	}
+	if !s.checked {
+		s.check()
+	}
+	return s.err
+}
+
+func (s *Sniffer) check() {
+	s.checked = true
+	detected := mediaType(http.DetectContentType(s.head))
+	s.head = nil
+	for _, t := range s.types {
+		if t == detected {
+			return
+		}
+	}
+	s.log.Warn("Refused file", "name", s.name, "reason", "filter", "rule", "content", "type", detected)
+	s.err = fmt.Errorf("%w: content of %q looks like %s, not an accepted type", wire.ErrRejected, s.name, detected)
+}
@@ -0,0 +1,106 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"socket-file-transfer/internal/wire"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name           string
+		accept, reject []string
+		file           string
+		ok             bool
+	}{
+		{"accepted", []string{".zip", "tar.gz"}, nil, "a.zip", true},
+		{"accepted without dot", []string{".zip", "tar.gz"}, nil, "a.tar.gz", true},
+		{"accepted any case", []string{".ZIP"}, nil, "A.Zip", true},
+		{"not accepted", []string{".zip", "tar.gz"}, nil, "a.gz", false},
+		{"extension only in the middle", []string{".zip"}, nil, "a.zip.exe", false},
+		{"no extension", []string{".zip"}, nil, "zip", false},
+		{"rejected", nil, []string{"exe"}, "setup.EXE", false},
+		{"not rejected", nil, []string{"exe"}, "notes.txt", true},
+		{"reject wins", []string{".gz"}, []string{".tar.gz"}, "a.tar.gz", false},
+		{"accept with reject", []string{".gz"}, []string{".tar.gz"}, "a.gz", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := New(tt.accept, tt.reject, nil).CheckName(tt.file, quiet)
+			if (err == nil) != tt.ok || err != nil && !errors.Is(err, wire.ErrRejected) {
+				t.Errorf("CheckName(%q) = %v, want accepted %v", tt.file, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNilFilter(t *testing.T) {
+	f := New(nil, nil, nil)
+	if f != nil {
+		t.Fatal("New without rules returned a Filter")
+	}
+	if err := f.CheckName("anything.exe", quiet); err != nil {
+		t.Error(err)
+	}
+	if f.Sniffer("a", quiet) != nil || New([]string{".zip"}, nil, nil).Sniffer("a", quiet) != nil {
+		t.Error("Sniffer without types")
+	}
+	var s *Sniffer
+	if _, err := s.Write([]byte("MZ")); err != nil || s.Close() != nil {
+		t.Error("nil Sniffer refused content")
+	}
+}
+
+var (
+	zipHead = append([]byte("PK\x03\x04"), make([]byte, 600)...)
+	gzHead  = append([]byte("\x1f\x8b\x08"), make([]byte, 600)...)
+	exeHead = append([]byte("MZ\x90\x00"), bytes.Repeat([]byte{0xff}, 600)...)
+)
+
+func TestSniffer(t *testing.T) {
+	types := []string{"application/zip", "application/x-gzip", "text/plain; charset=utf-8"}
+	tests := []struct {
+		name    string
+		content []byte
+		ok      bool
+	}{
+		{"zip", zipHead, true},
+		{"gzip", gzHead, true},
+		{"exe renamed", exeHead, false},
+		{"short text", []byte("hello"), true},
+		{"short exe", []byte("MZ\x90\x00\xff\xff"), false},
+		{"empty", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(nil, nil, types).Sniffer("a.zip", quiet)
+
+			// Written a few bytes at a time, the verdict comes at SNIFF_LEN
+			var err error
+			written := 0
+			for written < len(tt.content) && err == nil {
+				n := min(7, len(tt.content)-written)
+				_, err = s.Write(tt.content[written : written+n])
+				written += n
+			}
+			if err != nil && written < SNIFF_LEN {
+				t.Fatalf("refused after %d bytes, before SNIFF_LEN", written)
+			}
+			if err == nil {
+				err = s.Close()
+			}
+			if (err == nil) != tt.ok || err != nil && !errors.Is(err, wire.ErrRejected) {
+				t.Errorf("got %v, want accepted %v", err, tt.ok)
+			}
+			if !tt.ok && len(tt.content) > SNIFF_LEN && written > SNIFF_LEN+7 {
+				t.Errorf("refused only after %d bytes", written)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+// Package fsck checks the files a server stored against the digests
+// recorded when they were received: their checksum sidecars, see
+// internal/hashcache, or else the SHA256SUMS manifest of a synced
+// directory, see internal/manifest. It finds files that rotted on disk
+// since, which nothing else rereads.
+//
+// Like retention it skips names starting with a dot (sidecars, files
+// being received, the quarantine) and symbolic links. Files modified in
+// the last RECENT are skipped too, as they may still be being stored or
+// extracted. Reading is throttled to Config.Rate, and on Linux done at
+// idle I/O priority, so a pass doesn't starve transfers.
+package fsck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/checksum"
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/manifest"
+	"socket-file-transfer/internal/wire"
+)
+
+// Files modified more recently are left for the next pass
+const RECENT = time.Minute
+
+// Config says how to check a directory.
+type Config struct {
+	Root       string
+	Rate       int64 // Bytes read per second at most, unlimited if 0
+	Seed       bool  // Hash unverifiable files, recording their SHA-256 for later passes
+	Quarantine bool  // Move files that fail to Root/.quarantine, as <name>.corrupt
+}
+
+// Status is the outcome of checking a file.
+type Status string
+
+const (
+	StatusOK           Status = "ok"
+	StatusCorrupt      Status = "corrupt"      // Content differs from its recorded digest
+	StatusUnverifiable Status = "unverifiable" // No digest on record, or the file changed since
+	StatusSeeded       Status = "seeded"       // Unverifiable, but now hashed for later passes
+	StatusError        Status = "error"        // Couldn't be read
+)
+
+// File is a checked file.
+type File struct {
+	Path   string
+	Size   int64
+	Status Status
+	Hash   checksum.Algorithm // Of the recorded digest
+	Err    error              // Why, if not StatusOK
+
+	// Where the file was moved, with Config.Quarantine
+	Quarantined string
+}
+
+// Report sums up a pass.
+type Report struct {
+	Started      time.Time     `json:"started"`
+	Duration     time.Duration `json:"duration_ns"`
+	Files        int           `json:"files"`
+	Bytes        int64         `json:"bytes"`
+	OK           int           `json:"ok"`
+	Corrupt      int           `json:"corrupt"`
+	Unverifiable int           `json:"unverifiable"`
+	Seeded       int           `json:"seeded"`
+	Errors       int           `json:"errors"`
+	Skipped      int           `json:"skipped"` // Modified in the last RECENT
+}
+
+func (r *Report) add(f *File) {
+	r.Files++
+	r.Bytes += f.Size
+	switch f.Status {
+	case StatusOK:
+		r.OK++
+	case StatusCorrupt:
+		r.Corrupt++
+	case StatusUnverifiable:
+		r.Unverifiable++
+	case StatusSeeded:
+		r.Seeded++
+	case StatusError:
+		r.Errors++
+	}
+}
+
+// Check checks the files under c.Root, passing each to report unless
+// nil, until ctx ends. It only fails if Root can't be listed or ctx
+// ended; the report counts the files that failed.
+func Check(ctx context.Context, c Config, report func(*File)) (Report, error) {
+	restore := lowPriority()
+	defer restore()
+
+	ck := &checker{Config: c, ctx: ctx, report: report, manifested: make(map[string][]byte)}
+	ck.rep.Started = time.Now()
+	err := ck.dir(c.Root)
+	ck.rep.Duration = time.Since(ck.rep.Started)
+	return ck.rep, err
+}
+
+type checker struct {
+	Config
+	ctx    context.Context
+	report func(*File)
+	rep    Report
+
+	// SHA-256 of the files manifests list, by path
+	manifested map[string][]byte
+
+	// Throttle
+	read  int64
+	since time.Time
+}
+
+// dir checks the files under dir, descending into directories but not
+// into symbolic links.
+func (ck *checker) dir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error listing %s: %w", dir, err)
+	}
+	if entries, err := manifest.Load(dir); err == nil {
+		for _, e := range entries {
+			clean := path.Clean(e.Path)
+			if !path.IsAbs(clean) && clean != ".." && !strings.HasPrefix(clean, "../") {
+				ck.manifested[filepath.Join(dir, filepath.FromSlash(clean))] = e.Sum
+			}
+		}
+	}
+
+	for _, e := range entries {
+		if err := ck.ctx.Err(); err != nil {
+			return err
+		}
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		switch {
+		case e.IsDir():
+			if err := ck.dir(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		case e.Type().IsRegular():
+			info, err := e.Info()
+			if err != nil {
+				continue // Removed since ReadDir
+			}
+			if time.Since(info.ModTime()) < RECENT {
+				ck.rep.Skipped++
+				continue
+			}
+			f := ck.file(p, info)
+			if f == nil {
+				continue
+			}
+			if err := ck.ctx.Err(); err != nil {
+				return err
+			}
+			ck.rep.add(f)
+			if ck.report != nil {
+				ck.report(f)
+			}
+		}
+	}
+	return nil
+}
+
+// file checks the file at p, nil if it went away meanwhile.
+func (ck *checker) file(p string, info os.FileInfo) *File {
+	f := &File{Path: p, Size: info.Size()}
+	algo, want, ok := hashcache.Recorded(p, info)
+	if !ok {
+		want, ok = ck.manifested[p]
+		algo = checksum.SHA256
+	}
+	f.Hash = algo
+	if !ok && !ck.Seed {
+		f.Status, f.Err = StatusUnverifiable, errors.New("no digest on record")
+		return f
+	}
+
+	got, err := ck.hash(p, algo.New())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		f.Status, f.Err = StatusError, err
+		return f
+	}
+
+	// A file replaced meanwhile was hashed in part or has a new record
+	if now, err := os.Stat(p); err != nil || now.Size() != info.Size() || !now.ModTime().Equal(info.ModTime()) {
+		return nil
+	}
+
+	switch {
+	case !ok:
+		if err := hashcache.Store(p, checksum.SHA256, got); err != nil {
+			f.Status, f.Err = StatusError, fmt.Errorf("error recording checksum: %w", err)
+		} else {
+			f.Status, f.Err = StatusSeeded, errors.New("no digest on record")
+		}
+	case string(got) != string(want):
+		f.Status, f.Err = StatusCorrupt, fmt.Errorf("%s is %x, recorded %x", algo, got, want)
+		if ck.Quarantine {
+			f.Quarantined, err = ck.quarantine(p)
+			if err != nil {
+				f.Err = fmt.Errorf("%w; error quarantining it: %w", f.Err, err)
+			}
+		}
+	default:
+		f.Status = StatusOK
+	}
+	return f
+}
+
+// hash returns the digest of the file at p in h, reading it no faster
+// than the rate allows.
+func (ck *checker) hash(p string, h hash.Hash) ([]byte, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buffer := make([]byte, 1<<20)
+	for {
+		n, err := file.Read(buffer)
+		h.Write(buffer[:n])
+		if err == io.EOF {
+			return h.Sum(nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := ck.throttle(int64(n)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// throttle waits until reading n more bytes keeps to the rate.
+func (ck *checker) throttle(n int64) error {
+	if ck.Rate <= 0 {
+		return nil
+	}
+	due := func() time.Time {
+		return ck.since.Add(time.Duration(float64(ck.read) / float64(ck.Rate) * float64(time.Second)))
+	}
+	// Time spent elsewhere, such as between passes, doesn't bank more
+	// than a second's burst
+	if now := time.Now(); ck.since.IsZero() || now.Sub(due()) > time.Second {
+		ck.since, ck.read = now, 0
+	}
+	ck.read += n
+	wait := time.Until(due())
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ck.ctx.Done():
+		return ck.ctx.Err()
+	}
+}
+
+// quarantine moves the file at p out of sight into the quarantine,
+// removing its sidecar and completion marker, which vouch for what it
+// was, and returns where it went.
+func (ck *checker) quarantine(p string) (string, error) {
+	dest := filepath.Join(ck.Root, wire.QUARANTINE_DIR, filepath.Base(p)+".corrupt")
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(p, dest); err != nil {
+		return "", err
+	}
+	os.Remove(hashcache.SidecarPath(p))
+	os.Remove(wire.MarkerPath(p))
+	return dest, nil
+}
+
+// Verifier checks a directory in the background, see Run.
+type Verifier struct {
+	Config
+	Interval time.Duration
+	Log      *slog.Logger
+
+	mu   sync.Mutex
+	last *Report
+}
+
+// Run checks the directory every Interval, the first time one Interval
+// from now, logging what fails, until ctx ends.
+func (v *Verifier) Run(ctx context.Context) error {
+	ticker := time.NewTicker(v.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		v.pass(ctx)
+	}
+}
+
+// pass runs one check, logging it.
+func (v *Verifier) pass(ctx context.Context) {
+	log := v.Log
+	log.Info("Verifying stored files", "dir", v.Root)
+	rep, err := Check(ctx, v.Config, func(f *File) {
+		switch f.Status {
+		case StatusCorrupt:
+			if f.Quarantined != "" {
+				log.Error("Stored file is corrupt, quarantined", "path", f.Path, "err", f.Err, "quarantined", f.Quarantined)
+			} else {
+				log.Error("Stored file is corrupt", "path", f.Path, "err", f.Err)
+			}
+		case StatusError:
+			log.Warn("Error verifying stored file", "path", f.Path, "err", f.Err)
+		case StatusUnverifiable:
+			log.Debug("Stored file is unverifiable", "path", f.Path)
+		case StatusSeeded:
+			log.Debug("Recorded checksum of stored file", "path", f.Path)
+		}
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Error("Error verifying stored files", "err", err)
+		return
+	}
+	v.mu.Lock()
+	v.last = &rep
+	v.mu.Unlock()
+	log.Info("Verified stored files", "files", rep.Files, "ok", rep.OK, "corrupt", rep.Corrupt, "unverifiable", rep.Unverifiable, "seeded", rep.Seeded, "errors", rep.Errors, "skipped", rep.Skipped, "duration", rep.Duration.Round(time.Millisecond))
+}
+
+// Last returns the report of the last complete pass, nil before the first.
+func (v *Verifier) Last() *Report {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.last
+}
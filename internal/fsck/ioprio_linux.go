@@ -0,0 +1,33 @@
+package fsck
+
+import (
+	"runtime"
+	"syscall"
+)
+
+// ioprio_set(2) arguments
+const (
+	IOPRIO_WHO_PROCESS = 1
+	IOPRIO_CLASS_SHIFT = 13
+	IOPRIO_CLASS_IDLE  = 3
+)
+
+// lowPriority has the calling goroutine's reads wait for everyone else's,
+// holding it on its thread, whose I/O priority it lowers, until restore.
+func lowPriority() (restore func()) {
+	runtime.LockOSThread()
+	old, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_GET, IOPRIO_WHO_PROCESS, 0, 0)
+	if errno != 0 {
+		runtime.UnlockOSThread()
+		return func() {}
+	}
+	_, _, errno = syscall.Syscall(syscall.SYS_IOPRIO_SET, IOPRIO_WHO_PROCESS, 0, IOPRIO_CLASS_IDLE<<IOPRIO_CLASS_SHIFT)
+	if errno != 0 {
+		runtime.UnlockOSThread()
+		return func() {}
+	}
+	return func() {
+		syscall.Syscall(syscall.SYS_IOPRIO_SET, IOPRIO_WHO_PROCESS, 0, old)
+		runtime.UnlockOSThread()
+	}
+}
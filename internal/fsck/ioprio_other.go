@@ -0,0 +1,8 @@
+//go:build !linux
+
+package fsck
+
+// lowPriority does nothing on this platform.
+func lowPriority() (restore func()) {
+	return func() {}
+}
@@ -0,0 +1,151 @@
+// Package hashcache computes SHA-256 digests of files, caching the digest of
+// stored uploads in a sidecar file so unchanged files are not rehashed. A
+// file a client had checked with another hash, see internal/checksum, has
+// that digest recorded instead, which the functions here don't use.
+package hashcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"socket-file-transfer/internal/checksum"
+)
+
+// Size is the length in bytes of a digest.
+const Size = sha256.Size
+
+// SidecarPath returns the path of the cache file kept next to path.
+func SidecarPath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "."+name+".sha256")
+}
+
+// File hashes the whole content of path without consulting the cache.
+func File(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Sum returns the digest of path. The sidecar is used when its recorded size
+// and modification time still match the file; otherwise the file is hashed
+// and the sidecar rewritten.
+func Sum(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if sum, ok := readSidecar(path, info); ok {
+		return sum, nil
+	}
+
+	sum, err := File(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// A failed cache write only costs a rehash next time
+	_ = writeSidecar(path, info, checksum.SHA256, sum)
+	return sum, nil
+}
+
+// Matches reports whether path exists with the given size and digest.
+func Matches(path string, size int64, sum []byte) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != size {
+		return false
+	}
+
+	stored, err := Sum(path)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(stored, sum)
+}
+
+// Store records sum as the digest of path in algo, e.g. after a transfer
+// computed it.
+func Store(path string, algo checksum.Algorithm, sum []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return writeSidecar(path, info, algo, sum)
+}
+
+// Cached returns the digest the sidecar of path records, if it still
+// matches info, without hashing the file.
+func Cached(path string, info os.FileInfo) ([]byte, bool) {
+	return readSidecar(path, info)
+}
+
+// readSidecar returns the SHA-256 the sidecar of path records, if any.
+func readSidecar(path string, info os.FileInfo) ([]byte, bool) {
+	algo, sum, ok := Recorded(path, info)
+	return sum, ok && algo == checksum.SHA256
+}
+
+// Recorded returns the digest the sidecar of path records and its
+// algorithm, if it still matches info.
+//
+// Sidecar format: "<hex digest> <size> <mtime unix nanos>\n", the digest
+// prefixed with "<algorithm>:" unless it is a SHA-256, e.g. "blake3:".
+func Recorded(path string, info os.FileInfo) (checksum.Algorithm, []byte, bool) {
+	data, err := os.ReadFile(SidecarPath(path))
+	if err != nil {
+		return 0, nil, false
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return 0, nil, false
+	}
+
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size != info.Size() {
+		return 0, nil, false
+	}
+	mtime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || mtime != info.ModTime().UnixNano() {
+		return 0, nil, false
+	}
+
+	algo := checksum.SHA256
+	digest := fields[0]
+	if name, rest, ok := strings.Cut(digest, ":"); ok {
+		if algo, err = checksum.Parse(name); err != nil {
+			return 0, nil, false
+		}
+		digest = rest
+	}
+	sum, err := hex.DecodeString(digest)
+	if err != nil || len(sum) != algo.Size() {
+		return 0, nil, false
+	}
+	return algo, sum, true
+}
+
+func writeSidecar(path string, info os.FileInfo, algo checksum.Algorithm, sum []byte) error {
+	digest := hex.EncodeToString(sum)
+	if algo != checksum.SHA256 {
+		digest = algo.String() + ":" + digest
+	}
+	line := fmt.Sprintf("%s %d %d\n", digest, info.Size(), info.ModTime().UnixNano())
+	return os.WriteFile(SidecarPath(path), []byte(line), 0644)
+}
@@ -0,0 +1,244 @@
+// Package hook tells other programs about files a server has stored, by
+// running a command, posting to a URL, or both.
+//
+// The command runs through the shell with the upload described in the
+// environment:
+//
+//	TRANSFER_PATH    where the file is stored
+//	TRANSFER_NAME    the name the client sent
+//	TRANSFER_CLIENT  the client's address
+//	TRANSFER_SIZE    the file size in bytes
+//	TRANSFER_SHA256  the file's SHA-256, in hex
+//
+// The URL receives the same fields as a JSON object in a POST request.
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+const (
+	// How long a command or request may take, including retries
+	TIMEOUT = 30 * time.Second
+
+	// Most hooks running at once; further uploads wait for a slot
+	MAX_CONCURRENT = 4
+
+	// Attempts at posting to the URL, doubling the wait from RETRY_DELAY
+	// between them
+	POST_ATTEMPTS = 3
+	RETRY_DELAY   = time.Second
+)
+
+var ErrFailed = errors.New("post-receive hook failed")
+
+// Upload describes a stored file.
+type Upload struct {
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+	Client string `json:"client"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Environ describes u in TRANSFER_* environment variables, as the command
+// gets them.
+func (u Upload) Environ() []string {
+	return []string{
+		"TRANSFER_PATH=" + u.Path,
+		"TRANSFER_NAME=" + u.Name,
+		"TRANSFER_CLIENT=" + u.Client,
+		"TRANSFER_SIZE=" + strconv.FormatInt(u.Size, 10),
+		"TRANSFER_SHA256=" + u.SHA256,
+	}
+}
+
+// Runner runs the hooks of one server.
+type Runner struct {
+	command    string
+	url        string
+	strict     bool
+	quarantine string
+	log        *slog.Logger
+	client     *http.Client
+
+	slots    chan struct{}
+	wg       sync.WaitGroup
+	failures atomic.Int64
+}
+
+// New returns a Runner for command and url, either of which may be empty,
+// or nil if both are. A strict Runner fails uploads whose hook fails and
+// moves their file into quarantine.
+func New(command, url string, strict bool, quarantine string, log *slog.Logger) *Runner {
+	if command == "" && url == "" {
+		return nil
+	}
+	return &Runner{
+		command:    command,
+		url:        url,
+		strict:     strict,
+		quarantine: quarantine,
+		log:        log,
+		client:     &http.Client{},
+		slots:      make(chan struct{}, MAX_CONCURRENT),
+	}
+}
+
+// Notify runs the hooks for u. A strict Runner waits for them and returns
+// an error wrapping ErrFailed if one fails, after moving the file into
+// quarantine; otherwise they run in the background and failures are only
+// logged. A nil Runner does nothing. done, if not nil, is called once the
+// hooks finished, failed or not, before Wait returns.
+func (r *Runner) Notify(u Upload, done func()) error {
+	if done == nil {
+		done = func() {}
+	}
+	if r == nil {
+		done()
+		return nil
+	}
+	if !r.strict {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.run(u)
+			done()
+		}()
+		return nil
+	}
+
+	err := r.run(u)
+	done()
+	if err == nil {
+		return nil
+	}
+	if qerr := r.moveToQuarantine(u.Path); qerr != nil {
+		r.log.Error("Error quarantining file", "path", u.Path, "err", qerr)
+	}
+	return fmt.Errorf("%w: %w", ErrFailed, err)
+}
+
+// Wait blocks until hooks running in the background have finished.
+func (r *Runner) Wait() {
+	if r != nil {
+		r.wg.Wait()
+	}
+}
+
+// Failures returns how many uploads' hooks have failed.
+func (r *Runner) Failures() int64 {
+	if r == nil {
+		return 0
+	}
+	return r.failures.Load()
+}
+
+func (r *Runner) run(u Upload) error {
+	r.slots <- struct{}{}
+	defer func() { <-r.slots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+	if r.command != "" {
+		err = r.runCommand(ctx, u)
+	}
+	if err == nil && r.url != "" {
+		err = r.post(ctx, u)
+	}
+	if err != nil {
+		r.log.Warn("Hook failed", "path", u.Path, "err", err, "failures", r.failures.Add(1))
+		return err
+	}
+	r.log.Debug("Hook done", "path", u.Path, "duration", time.Since(start))
+	return nil
+}
+
+func (r *Runner) runCommand(ctx context.Context, u Upload) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", r.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", r.command)
+	}
+	cmd.Env = append(os.Environ(), u.Environ()...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("command %q: %w: %s", r.command, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (r *Runner) post(ctx context.Context, u Upload) error {
+	body, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	delay := RETRY_DELAY
+	for attempt := 1; ; attempt++ {
+		err = r.postOnce(ctx, body)
+		if err == nil || attempt == POST_ATTEMPTS {
+			return err
+		}
+		r.log.Debug("Retrying hook URL", "attempt", attempt, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("%w (last attempt: %v)", ctx.Err(), err)
+		}
+		delay *= 2
+	}
+}
+
+func (r *Runner) postOnce(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", r.url, resp.Status)
+	}
+	return nil
+}
+
+// moveToQuarantine moves the file at path into the quarantine directory.
+func (r *Runner) moveToQuarantine(path string) error {
+	dest := filepath.Join(r.quarantine, filepath.Base(path))
+	if err := wire.CheckNoSymlinks(filepath.Dir(r.quarantine), dest); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(r.quarantine, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(path, dest); err != nil {
+		return err
+	}
+	r.log.Warn("File quarantined", "path", dest)
+	return nil
+}
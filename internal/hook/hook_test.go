@@ -0,0 +1,175 @@
+package hook
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// stored writes a file as a server would have stored it and describes it.
+func stored(t *testing.T) Upload {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Upload{Path: path, Name: "in.txt", Client: "192.0.2.7:5000", Size: 7, SHA256: "ab12"}
+}
+
+func skipWithoutShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands run through /bin/sh here")
+	}
+}
+
+func TestNilRunner(t *testing.T) {
+	r := New("", "", true, "", quiet)
+	if r != nil {
+		t.Fatal("Runner without hooks")
+	}
+	called := false
+	if err := r.Notify(Upload{}, func() { called = true }); err != nil || !called {
+		t.Errorf("nil Runner: %v, done called %v", err, called)
+	}
+	r.Wait()
+}
+
+func TestCommandEnvironment(t *testing.T) {
+	skipWithoutShell(t)
+	u := stored(t)
+	out := filepath.Join(t.TempDir(), "env")
+	r := New(`env | grep ^TRANSFER_ | sort > `+out, "", false, "", quiet)
+	if err := r.Notify(u, nil); err != nil {
+		t.Fatal(err)
+	}
+	r.Wait()
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "TRANSFER_CLIENT=192.0.2.7:5000\nTRANSFER_NAME=in.txt\nTRANSFER_PATH=" + u.Path + "\nTRANSFER_SHA256=ab12\nTRANSFER_SIZE=7\n"
+	if string(got) != want {
+		t.Errorf("command saw\n%s\nwant\n%s", got, want)
+	}
+}
+
+// Without -hook-strict a failing hook is counted, and the file stays.
+func TestCommandFailure(t *testing.T) {
+	skipWithoutShell(t)
+	u := stored(t)
+	r := New("exit 3", "", false, filepath.Join(t.TempDir(), "quarantine"), quiet)
+	if err := r.Notify(u, nil); err != nil {
+		t.Fatalf("non-strict hook failed the upload: %v", err)
+	}
+	r.Wait()
+	if r.Failures() != 1 {
+		t.Errorf("%d failures counted, want 1", r.Failures())
+	}
+	if _, err := os.Stat(u.Path); err != nil {
+		t.Errorf("file gone after a non-strict failure: %v", err)
+	}
+}
+
+func TestStrictQuarantine(t *testing.T) {
+	skipWithoutShell(t)
+	u := stored(t)
+	quarantine := filepath.Join(filepath.Dir(u.Path), ".quarantine")
+	r := New("echo scan failed >&2; exit 1", "", true, quarantine, quiet)
+	err := r.Notify(u, nil)
+	if !errors.Is(err, ErrFailed) || !strings.Contains(err.Error(), "scan failed") {
+		t.Fatalf("got %v, want ErrFailed with the command's output", err)
+	}
+	if _, err := os.Stat(u.Path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("failed file still in place: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(quarantine, "in.txt")); err != nil {
+		t.Errorf("file not quarantined: %v", err)
+	}
+}
+
+func TestPost(t *testing.T) {
+	u := stored(t)
+	got := make(chan Upload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var posted Upload
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s with Content-Type %q", req.Method, req.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(req.Body).Decode(&posted); err != nil {
+			t.Error(err)
+		}
+		got <- posted
+	}))
+	defer srv.Close()
+
+	r := New("", srv.URL, true, "", quiet)
+	if err := r.Notify(u, nil); err != nil {
+		t.Fatal(err)
+	}
+	if posted := <-got; posted != u {
+		t.Errorf("posted %+v, want %+v", posted, u)
+	}
+}
+
+// A failed POST is retried after RETRY_DELAY.
+func TestPostRetry(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if attempts.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	r := New("", srv.URL, true, "", quiet)
+	if err := r.Notify(stored(t), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("%d attempts, want 2", n)
+	}
+}
+
+// No more than MAX_CONCURRENT hooks run at once.
+func TestConcurrencyLimit(t *testing.T) {
+	var mu sync.Mutex
+	active, peak := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	r := New("", srv.URL, false, "", quiet)
+	var done atomic.Int32
+	for i := 0; i < 3*MAX_CONCURRENT; i++ {
+		r.Notify(Upload{Name: "f"}, func() { done.Add(1) })
+	}
+	r.Wait()
+	if done.Load() != 3*MAX_CONCURRENT {
+		t.Errorf("done called %d times, want %d", done.Load(), 3*MAX_CONCURRENT)
+	}
+	if peak > MAX_CONCURRENT {
+		t.Errorf("%d hooks ran at once, want at most %d", peak, MAX_CONCURRENT)
+	}
+}
@@ -0,0 +1,556 @@
+// Package httpfiles serves the files a server has stored over HTTP:
+//
+//	GET /files         JSON list of the files in the upload directory
+//	GET /files/<dir>   JSON list of the files in one of its subdirectories
+//	GET /files/<path>  the file itself, resumable with Range requests
+//
+// Hidden names (checksum sidecars, files being received, the quarantine)
+// and symbolic links are neither listed nor served, so nothing outside the
+// directory is reachable.
+//
+// A Server with an Upload configuration also stores files, through the
+// same internal/store pipeline as the TCP and UDP servers:
+//
+//	PUT /files/<name>  the request body is the file
+//	POST /files        each file of a multipart/form-data body
+//
+// Both answer with a JSON description of what was stored.
+//
+// A Server with Tokens also serves the file each retrieval token was
+// issued for, see internal/tokens, to anyone holding the token, without
+// authentication:
+//
+//	GET /t/<token>     the file, once per use of the token; 404 once
+//	                   it expired or is used up
+//
+// A Server with a WebSocket handler, such as a tcpft.WebSocketListener,
+// also serves it at WS_PATH, behind the same authentication.
+//
+// A Server with Tenants, see internal/tenant, serves each request from the
+// directory of the tenant whose token it bears, "Authorization: Bearer
+// <token>", at the tenant's rate, storing uploads within its limits.
+// Requests without a tenant's token are refused; WebSocket clients
+// authenticate to the TCP server instead.
+package httpfiles
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/index"
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/tenant"
+	"socket-file-transfer/internal/tokens"
+	"socket-file-transfer/internal/wire"
+)
+
+// Path under which the files are served
+const PREFIX = "/files"
+
+// Path of the WebSocket handler
+const WS_PATH = "/ws"
+
+// Path under which files are fetched by retrieval token
+const TOKEN_PREFIX = "/t"
+
+const (
+	// How long a client may take to send its request headers
+	READ_HEADER_TIMEOUT = 10 * time.Second
+
+	// Size of the reads of an upload's body
+	BUFFER_SIZE = 256 * 1024
+)
+
+// Server serves the files under Root.
+type Server struct {
+	Addr     string       // Listen address
+	Root     string       // Directory to serve
+	User     string       // Basic auth user; anyone may download if empty
+	Password string       // Basic auth password
+	Logger   *slog.Logger // wire.DefaultLogger if nil
+
+	// Where uploads are stored and the rules they must pass; Root must be
+	// the same directory. Uploads are refused if nil.
+	Upload *store.Config
+
+	// Serves WS_PATH if not nil
+	WebSocket http.Handler
+
+	// Redeems the tokens under TOKEN_PREFIX if not nil
+	Tokens *tokens.Store
+
+	// Splits Root among these in place of the basic auth of User if not
+	// nil. Not with Tokens.
+	Tenants *tenant.Set
+
+	store   *store.Store
+	index   *index.Index               // Of Root
+	tenants map[*tenant.Tenant]*Server // Serving each of Tenants
+}
+
+// Stored describes a file stored by an upload.
+type Stored struct {
+	Name   string `json:"name"` // Path under /files
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Token  string `json:"token,omitempty"` // Fetches it at /t/<token>, see Server.Tokens
+}
+
+// File describes a file in a listing.
+type File struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return wire.DefaultLogger
+}
+
+// ListenAndServe listens on s.Addr and calls Serve.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("error starting HTTP server: %w", err)
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve answers requests arriving on listener until ctx ends, which also
+// aborts downloads under way. The listener is closed on return.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	if s.Tenants != nil {
+		if err := s.openTenants(); err != nil {
+			return err
+		}
+		defer s.closeTenants()
+	} else {
+		if err := s.open(); err != nil {
+			return err
+		}
+		defer s.close()
+	}
+
+	srv := &http.Server{Handler: s, ReadHeaderTimeout: READ_HEADER_TIMEOUT}
+	stop := context.AfterFunc(ctx, func() { srv.Close() })
+	defer stop()
+
+	s.logger().Info("HTTP Server listening", "addr", listener.Addr())
+	err := srv.Serve(listener)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// open opens the store of uploads, if any, and the index of Root.
+func (s *Server) open() error {
+	if s.Upload != nil {
+		st, err := store.Open(*s.Upload, s.logger())
+		if err != nil {
+			return err
+		}
+		s.store = st
+	}
+	// Listings come from the index of Root, shared with the servers
+	// storing there
+	ix, err := index.Open(s.Root, s.logger())
+	if err != nil {
+		if s.store != nil {
+			s.store.Close()
+		}
+		return err
+	}
+	s.index = ix
+	return nil
+}
+
+func (s *Server) close() {
+	s.index.Close()
+	if s.store != nil {
+		s.store.Close()
+	}
+}
+
+// openTenants opens the directory of each of s.Tenants under Root for a
+// server of its own, which serves the tenant's requests.
+func (s *Server) openTenants() error {
+	if s.Tokens != nil {
+		return errors.New("tenants can't be served with retrieval tokens")
+	}
+	s.tenants = make(map[*tenant.Tenant]*Server)
+	for _, t := range s.Tenants.All() {
+		ts := &Server{Root: filepath.Join(s.Root, t.Directory()), Logger: s.logger().With("tenant", t.Name)}
+		if s.Upload != nil {
+			c := *s.Upload
+			c.Root = ts.Root
+			c.SizeLimit, c.Quota = t.MaxFileSize, t.Quota
+			ts.Upload = &c
+		}
+		if err := ts.open(); err != nil {
+			s.closeTenants()
+			return err
+		}
+		s.tenants[t] = ts
+	}
+	return nil
+}
+
+func (s *Server) closeTenants() {
+	for _, ts := range s.tenants {
+		ts.close()
+	}
+}
+
+// ServeHTTP answers one request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The token is the credential
+	if token, ok := strings.CutPrefix(r.URL.Path, TOKEN_PREFIX+"/"); ok && s.Tokens != nil {
+		s.serveToken(w, r, token)
+		return
+	}
+	if s.Tenants != nil {
+		s.serveTenant(w, r)
+		return
+	}
+	if s.User != "" && !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="transfer", charset="UTF-8"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.WebSocket != nil && r.URL.Path == WS_PATH {
+		s.WebSocket.ServeHTTP(w, r)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+	case s.store != nil && r.Method == http.MethodPut:
+		s.servePut(w, r)
+		return
+	case s.store != nil && r.Method == http.MethodPost:
+		s.servePost(w, r)
+		return
+	default:
+		allow := "GET, HEAD"
+		if s.store != nil {
+			allow += ", PUT, POST"
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rel, ok := s.resolve(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	full := filepath.Join(s.Root, filepath.FromSlash(rel))
+	// A symbolic link to a directory would reach outside Root
+	if err := wire.CheckNoSymlinks(s.Root, full); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := os.Lstat(full)
+	switch {
+	case err != nil:
+		if !errors.Is(err, os.ErrNotExist) {
+			s.logger().Warn("Error serving file", "path", full, "err", err)
+		}
+		http.NotFound(w, r)
+	case info.IsDir():
+		s.serveList(w, rel)
+	case info.Mode().IsRegular():
+		s.serveFile(w, r, full, info)
+	default:
+		http.NotFound(w, r) // Symbolic links and devices
+	}
+}
+
+// serveTenant answers a request as the server of the tenant whose token
+// it bears, at the tenant's rate.
+func (s *Server) serveTenant(w http.ResponseWriter, r *http.Request) {
+	if s.WebSocket != nil && r.URL.Path == WS_PATH {
+		s.WebSocket.ServeHTTP(w, r)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	t, known := s.Tenants.ByToken(token)
+	if !ok || !known {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="transfer"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if l := t.Limiter(); l != nil {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{l.Reader(r.Body), r.Body}
+		w = &limitedResponse{ResponseWriter: w, w: l.Writer(w)}
+	}
+	s.tenants[t].ServeHTTP(w, r)
+}
+
+// limitedResponse writes a response body through w, at a tenant's rate.
+type limitedResponse struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (lr *limitedResponse) Write(p []byte) (int, error) {
+	return lr.w.Write(p)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.User)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.Password)) == 1
+	return ok && userOK && passOK
+}
+
+// resolve returns the slash-separated path under Root a URL path names,
+// or false if it is outside PREFIX or names something hidden.
+func (s *Server) resolve(urlPath string) (string, bool) {
+	rel, ok := strings.CutPrefix(urlPath, PREFIX)
+	if !ok || rel != "" && rel[0] != '/' {
+		return "", false
+	}
+	// Clean drops ".." segments at the root, so nothing above Root remains
+	rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+	if rel == "" {
+		return ".", true
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") || strings.ContainsRune(part, '\\') {
+			return "", false
+		}
+	}
+	return rel, true
+}
+
+// serveList lists the directory rel, "." for Root.
+func (s *Server) serveList(w http.ResponseWriter, rel string) {
+	if rel == "." {
+		rel = ""
+	}
+	infos, err := s.index.List(rel)
+	if err != nil {
+		s.logger().Warn("Error listing files", "path", filepath.Join(s.Root, filepath.FromSlash(rel)), "err", err)
+		http.Error(w, "error listing files", http.StatusInternalServerError)
+		return
+	}
+	files := make([]File, 0, len(infos))
+	for _, info := range infos {
+		files = append(files, File{Name: info.Name, Size: info.Size, ModTime: info.ModTime})
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+// serveFile sends the file at full, letting http.ServeContent handle
+// Range and conditional requests.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, full string, info os.FileInfo) {
+	file, err := os.Open(full)
+	if err != nil {
+		s.logger().Warn("Error serving file", "path", full, "err", err)
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	// Only a checksum already on record, hashing here would stall the reply
+	if sum, ok := hashcache.Cached(full, info); ok {
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+	}
+	if r.Method == http.MethodGet {
+		s.logger().Info("File fetched", "path", full, "remote", r.RemoteAddr, "range", r.Header.Get("Range"))
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// serveToken sends the file token was issued for, using up one of its
+// fetches.
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request, token string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stored, ok := s.Tokens.Redeem(token)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rel, ok := s.resolve(PREFIX + "/" + stored)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	full := filepath.Join(s.Root, filepath.FromSlash(rel))
+	if err := wire.CheckNoSymlinks(s.Root, full); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := os.Lstat(full)
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+	s.serveFile(w, r, full, info)
+}
+
+// servePut stores the body of a PUT to /files/<name>.
+func (s *Server) servePut(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutPrefix(r.URL.Path, PREFIX+"/")
+	if !ok || wire.CheckName(name) != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: upload to %s/<name>", wire.ErrInvalidName, PREFIX))
+		return
+	}
+	if r.ContentLength < 0 {
+		writeError(w, http.StatusLengthRequired, errors.New("Content-Length required"))
+		return
+	}
+	stored, err := s.receive(r, name, r.ContentLength, r.Body)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, stored)
+}
+
+// servePost stores each file of a multipart POST to /files. Files before
+// a failing one stay stored.
+func (s *Server) servePost(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != PREFIX && r.URL.Path != PREFIX+"/" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: post uploads to %s", wire.ErrInvalidName, PREFIX))
+		return
+	}
+	parts, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	stored := []Stored{}
+	for {
+		part, err := parts.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		name := part.FileName()
+		if name == "" {
+			continue // A form field rather than a file
+		}
+		if err := wire.CheckName(name); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		f, err := s.receive(r, name, -1, part)
+		if err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		stored = append(stored, f)
+	}
+	writeJSON(w, http.StatusCreated, stored)
+}
+
+// receive stores the file name of size bytes, -1 if unknown, read from
+// body, logging like the other servers do.
+func (s *Server) receive(r *http.Request, name string, size int64, body io.Reader) (Stored, error) {
+	log := s.logger().With("remote", r.RemoteAddr)
+	log.Info("Receiving file", "name", name, "size", size)
+	stored, err := s.storeFile(r.RemoteAddr, name, size, body, log)
+	if errors.Is(err, wire.ErrPolicy) {
+		log.Warn("Transfer rejected by policy", "err", err)
+	} else if err != nil {
+		log.Error("Transfer failed", "err", err)
+	}
+	return stored, err
+}
+
+func (s *Server) storeFile(remote, name string, size int64, body io.Reader, log *slog.Logger) (Stored, error) {
+	addr, err := net.ResolveTCPAddr("tcp", remote)
+	if err != nil {
+		return Stored{}, err
+	}
+	in, err := s.store.Place(addr, name, size, nil, log)
+	if err != nil {
+		return Stored{}, err
+	}
+	if err := in.Create(); err != nil {
+		return Stored{}, err
+	}
+	defer in.Close()
+
+	buffer := make([]byte, BUFFER_SIZE)
+	for {
+		n, err := body.Read(buffer)
+		if n > 0 {
+			if _, err := in.Write(buffer[:n]); err != nil {
+				return Stored{}, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Stored{}, fmt.Errorf("%w: error reading body: %w", wire.ErrProtocol, err)
+		}
+	}
+
+	upload, err := in.Commit()
+	if err != nil {
+		return Stored{}, err
+	}
+	log.Info("File saved", "path", upload.Path, "bytes", upload.Size, "duration", time.Since(in.Started()))
+	return Stored{Name: s.store.Name(in.Path), Size: upload.Size, SHA256: upload.SHA256, Token: in.Token}, nil
+}
+
+// statusOf returns the HTTP status reporting an upload failing with err.
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, wire.ErrNoSpace):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, wire.ErrTooLarge), errors.Is(err, wire.ErrExpansion):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, wire.ErrProtocol), errors.Is(err, wire.ErrInvalidName):
+		return http.StatusBadRequest
+	case errors.Is(err, wire.ErrPolicy):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, wire.ErrRejected):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
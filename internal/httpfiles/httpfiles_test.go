@@ -0,0 +1,250 @@
+package httpfiles
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/checksum"
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/tokens"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// open readies s to answer requests through ServeHTTP until the test ends.
+func open(t *testing.T, s *Server) *Server {
+	t.Helper()
+	s.Logger = quiet
+	if err := s.open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.close)
+	return s
+}
+
+// get answers a GET of path with s, with extra headers as name, value
+// pairs.
+func get(s *Server, path string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// files returns a directory with a few stored files, a file being
+// received, a hidden file and a completion marker.
+func files(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("0123456789"), 0644)
+	os.Mkdir(filepath.Join(root, "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "sub", "b.bin"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(root, ".a.txt.123.part"), []byte("partial"), 0644)
+	os.WriteFile(filepath.Join(root, ".hidden"), []byte("hidden"), 0644)
+	os.WriteFile(filepath.Join(root, ".a.txt.done"), []byte("{}"), 0644)
+	return root
+}
+
+func TestList(t *testing.T) {
+	s := open(t, &Server{Root: files(t)})
+	for path, want := range map[string]string{
+		"/files":      "a.txt",
+		"/files/":     "a.txt",
+		"/files/sub":  "b.bin",
+		"/files/sub/": "b.bin",
+	} {
+		w := get(s, path)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("GET %s: %d %s", path, w.Code, w.Header().Get("Content-Type"))
+		}
+		var list []File
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range list {
+			names = append(names, f.Name)
+		}
+		if got := strings.Join(names, " "); got != want {
+			t.Errorf("GET %s listed %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestGetFile(t *testing.T) {
+	root := files(t)
+	s := open(t, &Server{Root: root})
+
+	w := get(s, "/files/a.txt")
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" || w.Header().Get("Content-Length") != "10" {
+		t.Fatalf("GET: %d %q, Content-Length %s", w.Code, w.Body, w.Header().Get("Content-Length"))
+	}
+	if etag := w.Header().Get("ETag"); etag != "" {
+		t.Errorf("ETag %s without a sidecar", etag)
+	}
+
+	// The ETag is the checksum on record
+	sum := sha256.Sum256([]byte("0123456789"))
+	if err := hashcache.Store(filepath.Join(root, "a.txt"), checksum.SHA256, sum[:]); err != nil {
+		t.Fatal(err)
+	}
+	w = get(s, "/files/a.txt")
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("ETag %s, want %s", got, etag)
+	}
+	if w = get(s, "/files/a.txt", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: %d, want 304", w.Code)
+	}
+
+	// curl -C - resumes with a Range request
+	w = get(s, "/files/a.txt", "Range", "bytes=4-")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "456789" || w.Header().Get("Content-Range") != "bytes 4-9/10" {
+		t.Errorf("Range: %d %q %s", w.Code, w.Body, w.Header().Get("Content-Range"))
+	}
+
+	if w = get(s, "/files/sub/b.bin"); w.Code != http.StatusOK || w.Body.String() != "b" {
+		t.Errorf("GET in a subdirectory: %d %q", w.Code, w.Body)
+	}
+}
+
+func TestNotServed(t *testing.T) {
+	root := files(t)
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "link"))
+	os.Symlink(outside, filepath.Join(root, "linkdir"))
+	s := open(t, &Server{Root: root})
+
+	for _, path := range []string{
+		"/files/missing",
+		"/files/.hidden",
+		"/files/.a.txt.123.part",
+		"/files/.a.txt.sha256",
+		"/files/.a.txt.done",
+		"/files/../" + filepath.Base(root) + "/a.txt",
+		"/files/%2e%2e/etc/passwd",
+		"/files/sub/../../etc/passwd",
+		`/files/sub\..\a.txt`,
+		"/filesx",
+		"/other",
+		"/files/link",
+		"/files/linkdir",
+		"/files/linkdir/secret",
+		"/files/linkdir/",
+	} {
+		w := get(s, path)
+		if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "secret") {
+			t.Errorf("GET %s: %d %q, want 404", path, w.Code, w.Body)
+		}
+	}
+}
+
+// An upload directory that is itself a symbolic link is served.
+func TestSymlinkedRoot(t *testing.T) {
+	link := filepath.Join(t.TempDir(), "uploads")
+	os.Symlink(files(t), link)
+	s := open(t, &Server{Root: link})
+	if w := get(s, "/files/a.txt"); w.Code != http.StatusOK {
+		t.Errorf("GET through a symlinked root: %d", w.Code)
+	}
+}
+
+func TestToken(t *testing.T) {
+	root := files(t)
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	os.Symlink(outside, filepath.Join(root, "linkdir"))
+	ts, err := tokens.Open(root, time.Hour, 1, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := open(t, &Server{Root: root, User: "u", Password: "p", Tokens: ts})
+
+	token, _, _ := ts.Issue("sub/b.bin")
+	w := get(s, "/t/"+token)
+	if w.Code != http.StatusOK || w.Body.String() != "b" || !strings.Contains(w.Header().Get("Content-Disposition"), "b.bin") {
+		t.Errorf("GET by token: %d %q", w.Code, w.Body)
+	}
+	if w = get(s, "/t/"+token); w.Code != http.StatusNotFound {
+		t.Errorf("used up token: %d, want 404", w.Code)
+	}
+
+	token, _, _ = ts.Issue("linkdir/secret")
+	if w = get(s, "/t/"+token); w.Code != http.StatusNotFound {
+		t.Errorf("token through a symlinked directory: %d %q, want 404", w.Code, w.Body)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	s := open(t, &Server{Root: files(t), User: "user", Password: "pass"})
+	if w := get(s, "/files/a.txt"); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("without credentials: %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/files/a.txt", nil)
+	r.SetBasicAuth("user", "wrong")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: %d", w.Code)
+	}
+	r.SetBasicAuth("user", "pass")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("right password: %d", w.Code)
+	}
+}
+
+// Without an Upload configuration the server is read-only.
+func TestReadOnly(t *testing.T) {
+	s := open(t, &Server{Root: files(t)})
+	for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, "/files/a.txt", strings.NewReader("x")))
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s: %d, Allow %q", method, w.Code, w.Header().Get("Allow"))
+		}
+	}
+}
+
+// TestServe fetches a file from a real listener.
+func TestServe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- (&Server{Root: files(t), Logger: quiet}).Serve(ctx, ln) }()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/files/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "0123456789" {
+		t.Errorf("GET: %d %q", resp.StatusCode, body)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Serve returned %v, want context.Canceled", err)
+	}
+}
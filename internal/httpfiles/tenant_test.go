@@ -0,0 +1,112 @@
+package httpfiles
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/tenant"
+)
+
+// tenants returns a Server taking uploads for tenant a, with token-a and
+// a quota of 100 bytes, and b, with token-b and a quota of 250.
+func tenants(t *testing.T) *Server {
+	t.Helper()
+	set, err := tenant.New([]tenant.Tenant{
+		{Name: "a", Token: "token-a", Quota: 100},
+		{Name: "b", Token: "token-b", Quota: 250},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	s := &Server{Root: root, Upload: &store.Config{Root: root}, Tenants: set, Logger: quiet}
+	if err := s.openTenants(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.closeTenants)
+	return s
+}
+
+// as answers a request for path with s, bearing token if not empty.
+func as(s *Server, token, method, path string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// Each tenant's uploads count against its own quota only.
+func TestTenantQuotas(t *testing.T) {
+	s := tenants(t)
+	steps := []struct {
+		token, name string
+		size        int
+		status      int
+	}{
+		{"token-a", "a1", 60, http.StatusCreated},
+		{"token-b", "b1", 60, http.StatusCreated},
+		{"token-a", "a2", 60, http.StatusInsufficientStorage},
+		{"token-b", "b2", 60, http.StatusCreated},
+		{"token-b", "b3", 60, http.StatusCreated},
+		{"token-b", "b4", 60, http.StatusCreated},
+		{"token-a", "a3", 40, http.StatusCreated},
+		{"token-b", "b5", 60, http.StatusInsufficientStorage},
+	}
+	for _, st := range steps {
+		if w := as(s, st.token, http.MethodPut, "/files/"+st.name, make([]byte, st.size)); w.Code != st.status {
+			t.Fatalf("PUT %s with %s: %d %s, want %d", st.name, st.token, w.Code, w.Body, st.status)
+		}
+	}
+	for _, name := range []string{"a/a1", "a/a3", "b/b1", "b/b4"} {
+		if _, err := os.Stat(filepath.Join(s.Root, name)); err != nil {
+			t.Errorf("%s not stored: %v", name, err)
+		}
+	}
+}
+
+// Requests are answered from the directory of the tenant whose token they
+// bear, and refused without one.
+func TestTenantScope(t *testing.T) {
+	s := tenants(t)
+	as(s, "token-a", http.MethodPut, "/files/mine", []byte("a's"))
+	as(s, "token-b", http.MethodPut, "/files/theirs", []byte("b's"))
+
+	w := as(s, "token-a", http.MethodGet, "/files", nil)
+	var list []File
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("listing %q: %v", w.Body, err)
+	}
+	if len(list) != 1 || list[0].Name != "mine" {
+		t.Errorf("a lists %+v, want mine only", list)
+	}
+	if w := as(s, "token-a", http.MethodGet, "/files/mine", nil); w.Code != http.StatusOK || w.Body.String() != "a's" {
+		t.Errorf("a's own file: %d %q", w.Code, w.Body)
+	}
+	for _, path := range []string{"/files/theirs", "/files/../b/theirs", "/files/b/theirs"} {
+		if w := as(s, "token-a", http.MethodGet, path, nil); w.Code == http.StatusOK {
+			t.Errorf("a fetches %s", path)
+		}
+	}
+
+	for _, token := range []string{"", "token-c"} {
+		w := as(s, token, http.MethodGet, "/files", nil)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("listing with token %q: %d, want 401 with a challenge", token, w.Code)
+		}
+		if w := as(s, token, http.MethodPut, "/files/sneaky", []byte("x")); w.Code != http.StatusUnauthorized {
+			t.Errorf("PUT with token %q: %d, want 401", token, w.Code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, "sneaky")); err == nil {
+		t.Error("upload without a tenant stored")
+	}
+}
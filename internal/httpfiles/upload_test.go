@@ -0,0 +1,200 @@
+package httpfiles
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/wire"
+	"socket-file-transfer/tcpft"
+)
+
+// journalHook appends the name, size and SHA-256 of each stored file to
+// journal.
+func journalHook(journal string) string {
+	return `echo "$TRANSFER_NAME $TRANSFER_SIZE $TRANSFER_SHA256" >> ` + journal
+}
+
+// uploads returns a Server storing uploads under a new directory, with
+// policy, recording each in journal.
+func uploads(t *testing.T, policy store.Policy, journal string) *Server {
+	t.Helper()
+	root := t.TempDir()
+	return open(t, &Server{Root: root, Upload: &store.Config{Root: root, Policy: policy, HookCommand: journalHook(journal), HookStrict: true}})
+}
+
+func put(s *Server, name string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/files/"+name, bytes.NewReader(body)))
+	return w
+}
+
+// A file uploaded over HTTP is stored, hooked and described exactly as
+// the same file sent over TCP.
+func TestPutMatchesTCP(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands run through /bin/sh here")
+	}
+	data := bytes.Repeat([]byte("gateway "), 100000)
+	sum := sha256.Sum256(data)
+
+	httpJournal := filepath.Join(t.TempDir(), "journal")
+	s := uploads(t, store.Policy{}, httpJournal)
+	w := put(s, "data.bin", data)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	var stored Stored
+	if err := json.Unmarshal(w.Body.Bytes(), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stored{Name: "data.bin", Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}); stored != want {
+		t.Errorf("PUT answered %+v, want %+v", stored, want)
+	}
+	if got, _ := os.ReadFile(filepath.Join(s.Root, "data.bin")); !bytes.Equal(got, data) {
+		t.Errorf("stored %d bytes, want %d", len(got), len(data))
+	}
+
+	// The same file over TCP
+	tcpJournal := filepath.Join(t.TempDir(), "journal")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &tcpft.Server{UploadDir: t.TempDir()}
+	ts.Logger, ts.Progress = quiet, func(tcpft.Event) {}
+	ts.HookCommand, ts.HookStrict = journalHook(tcpJournal), true
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ts.Serve(ctx, ln)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	var c tcpft.Client
+	opts := tcpft.Options{Logger: quiet, Progress: func(tcpft.Event) {}}
+	if _, err := c.Send(ctx, ln.Addr().String(), "data.bin", bytes.NewReader(data), int64(len(data)), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	httpEntry, _ := os.ReadFile(httpJournal)
+	tcpEntry, _ := os.ReadFile(tcpJournal)
+	if want := fmt.Sprintf("data.bin %d %s\n", len(data), stored.SHA256); string(httpEntry) != want {
+		t.Errorf("HTTP journal %q, want %q", httpEntry, want)
+	}
+	if string(httpEntry) != string(tcpEntry) {
+		t.Errorf("HTTP journal %q, TCP journal %q", httpEntry, tcpEntry)
+	}
+}
+
+func TestPost(t *testing.T) {
+	s := uploads(t, store.Policy{}, filepath.Join(t.TempDir(), "journal"))
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("comment", "not a file")
+	for name, data := range map[string]string{"one.txt": "1", "two.txt": "22"} {
+		fw, _ := mw.CreateFormFile("file", name)
+		fw.Write([]byte(data))
+	}
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/files", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+	var stored []Stored
+	json.Unmarshal(w.Body.Bytes(), &stored)
+	if len(stored) != 2 {
+		t.Fatalf("POST stored %+v, want two files", stored)
+	}
+	for _, f := range stored {
+		if got, err := os.ReadFile(filepath.Join(s.Root, f.Name)); err != nil || int64(len(got)) != f.Size {
+			t.Errorf("%s: stored %q, %v", f.Name, got, err)
+		}
+	}
+}
+
+// Refused uploads answer with the status of their error and store nothing.
+func TestPutRefused(t *testing.T) {
+	s := uploads(t, store.Policy{MaxFileSize: 10, RejectExt: []string{".exe"}}, filepath.Join(t.TempDir(), "journal"))
+	tests := []struct {
+		name   string
+		file   string
+		body   []byte
+		status int
+	}{
+		{"too large", "big.bin", make([]byte, 11), http.StatusRequestEntityTooLarge},
+		{"filtered", "setup.exe", []byte("MZ"), http.StatusForbidden},
+		{"parent", "..", []byte("x"), http.StatusBadRequest},
+		{"subdirectory", "a/b", []byte("x"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := put(s, tt.file, tt.body); w.Code != tt.status || !strings.Contains(w.Body.String(), `"error"`) {
+				t.Errorf("PUT: %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+		})
+	}
+
+	// Without a Content-Length the size limit couldn't be checked up front
+	r := httptest.NewRequest(http.MethodPut, "/files/chunked", strings.NewReader("x"))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusLengthRequired {
+		t.Errorf("chunked PUT: %d, want 411", w.Code)
+	}
+
+	entries, _ := os.ReadDir(s.Root)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") {
+			t.Errorf("refused uploads left %s", e.Name())
+		}
+	}
+}
+
+// Uploads need the same credentials as downloads.
+func TestPutAuth(t *testing.T) {
+	s := uploads(t, store.Policy{}, filepath.Join(t.TempDir(), "journal"))
+	s.User, s.Password = "user", "pass"
+	if w := put(s, "a.txt", []byte("x")); w.Code != http.StatusUnauthorized {
+		t.Errorf("PUT without credentials: %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, "a.txt")); err == nil {
+		t.Error("unauthorized upload stored")
+	}
+}
+
+func TestStatusOf(t *testing.T) {
+	for err, want := range map[error]int{
+		wire.ErrNoSpace:     http.StatusInsufficientStorage,
+		wire.ErrTooLarge:    http.StatusRequestEntityTooLarge,
+		wire.ErrInvalidName: http.StatusBadRequest,
+		wire.ErrPolicy:      http.StatusUnprocessableEntity,
+		wire.ErrRejected:    http.StatusForbidden,
+		os.ErrPermission:    http.StatusInternalServerError,
+	} {
+		if got := statusOf(err); got != want {
+			t.Errorf("statusOf(%v) = %d, want %d", err, got, want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Package i18n translates what the transfer command prints for people:
+// usage, progress and summary lines, and the messages it fails with. Logs
+// stay in English, so they can be searched and compared across machines.
+//
+// Each language has a catalog in locales/<lang>.json, embedded in the
+// binary, with two tables. "messages" holds each message by key, as an
+// fmt format, which T looks up; a key the language lacks falls back to
+// English, and a key no catalog has is printed as is. "flags" translates
+// flag descriptions, keyed by their English text as the command defines
+// it, since that is where they are written; English needs none.
+//
+// The language is the first of LC_ALL, LC_MESSAGES and LANG that is set,
+// e.g. pt_BR.UTF-8 for Portuguese, until SetLanguage changes it, as the
+// -lang flag does.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Language of the messages in the code, and of those a catalog lacks
+const DEFAULT = "en"
+
+//go:embed locales/*.json
+var locales embed.FS
+
+// Catalog is the translation of the messages into one language.
+type Catalog struct {
+	Messages map[string]string `json:"messages"`
+	Flags    map[string]string `json:"flags"`
+}
+
+var (
+	loadOnce sync.Once
+	catalogs map[string]*Catalog
+
+	mu      sync.RWMutex
+	current string
+)
+
+// load reads the embedded catalogs. They are part of the binary, so one
+// that doesn't parse is a build mistake.
+func load() {
+	catalogs = make(map[string]*Catalog)
+	entries, err := locales.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range entries {
+		data, err := locales.ReadFile(path.Join("locales", e.Name()))
+		if err != nil {
+			panic(err)
+		}
+		c := new(Catalog)
+		if err := json.Unmarshal(data, c); err != nil {
+			panic(fmt.Sprintf("i18n: locales/%s: %v", e.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(e.Name(), ".json")] = c
+	}
+}
+
+// Catalogs returns the catalog of each language shipped, by its code.
+func Catalogs() map[string]*Catalog {
+	loadOnce.Do(load)
+	return catalogs
+}
+
+// Languages returns the codes of the languages shipped, sorted.
+func Languages() []string {
+	var langs []string
+	for lang := range Catalogs() {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Detect returns the language the environment asks for, DEFAULT if it
+// names none that is shipped.
+func Detect() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if v := os.Getenv(name); v != "" {
+			if lang, ok := match(v); ok {
+				return lang
+			}
+			return DEFAULT
+		}
+	}
+	return DEFAULT
+}
+
+// match returns the shipped language of a locale such as pt_BR.UTF-8,
+// pt-BR or pt.
+func match(locale string) (string, bool) {
+	lang, _, _ := strings.Cut(locale, ".")
+	lang, _, _ = strings.Cut(lang, "@")
+	lang = strings.ToLower(strings.ReplaceAll(lang, "_", "-"))
+	if _, ok := Catalogs()[lang]; ok {
+		return lang, true
+	}
+	lang, _, _ = strings.Cut(lang, "-")
+	_, ok := Catalogs()[lang]
+	return lang, ok
+}
+
+// SetLanguage makes messages come out in lang, a code such as pt or a
+// locale such as pt_BR, or in the language Detect finds if empty.
+func SetLanguage(lang string) error {
+	if lang == "" {
+		lang = Detect()
+	}
+	matched, ok := match(lang)
+	if !ok {
+		return fmt.Errorf("unknown language %q, want one of %s", lang, strings.Join(Languages(), ", "))
+	}
+	mu.Lock()
+	current = matched
+	mu.Unlock()
+	return nil
+}
+
+// Language returns the code of the language messages come out in.
+func Language() string {
+	mu.RLock()
+	lang := current
+	mu.RUnlock()
+	if lang == "" {
+		lang = Detect()
+		mu.Lock()
+		if current == "" {
+			current = lang
+		}
+		mu.Unlock()
+	}
+	return lang
+}
+
+// T returns the message key in the current language, formatted with args.
+func T(key string, args ...any) string {
+	format, ok := Catalogs()[Language()].Messages[key]
+	if !ok {
+		format, ok = Catalogs()[DEFAULT].Messages[key]
+	}
+	if !ok {
+		format = key
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Flag returns the English flag description usage in the current
+// language, or as is if it has no translation.
+func Flag(usage string) string {
+	if t, ok := Catalogs()[Language()].Flags[usage]; ok {
+		return t
+	}
+	return usage
+}
@@ -0,0 +1,214 @@
+package i18n
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// verb matches an fmt verb, with its flags, width, precision and index
+var verb = regexp.MustCompile(`%(\[\d+\])?[-+# 0]*(\d+|\*)?(\.(\d+|\*)?)?[a-zA-Z%]`)
+
+// verbs returns the verbs of format, sorted, so a translation may put
+// them in another order.
+func verbs(format string) []string {
+	var out []string
+	for _, v := range verb.FindAllString(format, -1) {
+		if v != "%%" {
+			out = append(out, v)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// Every message has a translation in every catalog, taking the same
+// arguments, and no catalog holds one English lacks.
+func TestCatalogsComplete(t *testing.T) {
+	en := Catalogs()[DEFAULT]
+	if len(en.Messages) == 0 {
+		t.Fatal("no English messages")
+	}
+	for lang, c := range Catalogs() {
+		if lang == DEFAULT {
+			continue
+		}
+		t.Run(lang, func(t *testing.T) {
+			for key, format := range en.Messages {
+				translated, ok := c.Messages[key]
+				if !ok {
+					t.Errorf("message %q missing", key)
+					continue
+				}
+				if want, got := verbs(format), verbs(translated); !slices.Equal(got, want) {
+					t.Errorf("message %q takes %q, English %q", key, got, want)
+				}
+			}
+			for key := range c.Messages {
+				if _, ok := en.Messages[key]; !ok {
+					t.Errorf("message %q not in English", key)
+				}
+			}
+			for usage, translated := range c.Flags {
+				if want, got := verbs(usage), verbs(translated); !slices.Equal(got, want) {
+					t.Errorf("flag %q takes %q, English %q", usage, got, want)
+				}
+			}
+		})
+	}
+}
+
+// usedKeys returns the keys the module's Go code passes to i18n.T.
+func usedKeys(t *testing.T) map[string]bool {
+	t.Helper()
+	keys := make(map[string]bool)
+	fset := token.NewFileSet()
+	err := filepath.WalkDir(filepath.Join("..", ".."), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".go") {
+			return err
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || sel.Sel.Name != "T" {
+				return true
+			}
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == "i18n" {
+				if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					key, _ := strconv.Unquote(lit.Value)
+					keys[key] = true
+				}
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// Every message the code asks for is in the English catalog. Flag
+// descriptions are checked by the transfer command's tests, which see
+// them as its subcommands print them.
+func TestCatalogsMatchCode(t *testing.T) {
+	keys := usedKeys(t)
+	if len(keys) == 0 {
+		t.Fatal("found no i18n.T calls")
+	}
+	for key := range keys {
+		if _, ok := Catalogs()[DEFAULT].Messages[key]; !ok {
+			t.Errorf("message %q used but not in %s.json", key, DEFAULT)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		locale string
+		want   string
+		ok     bool
+	}{
+		{"pt", "pt", true},
+		{"pt_BR.UTF-8", "pt", true},
+		{"pt-BR", "pt", true},
+		{"pt_PT@euro", "pt", true},
+		{"en_US.UTF-8", "en", true},
+		{"EN", "en", true},
+		{"C", "", false},
+		{"fr_FR.UTF-8", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := match(tt.locale)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("match(%q) = %q, %v, want %q, %v", tt.locale, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// LC_ALL wins over LC_MESSAGES, which wins over LANG, and a locale with
+// no catalog gives English rather than falling through.
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		all, messages, lang string
+		want                string
+	}{
+		{"", "", "pt_BR.UTF-8", "pt"},
+		{"", "pt_BR", "en_US", "pt"},
+		{"C", "", "pt_BR.UTF-8", "en"},
+		{"", "", "", "en"},
+		{"fr_FR", "", "pt_BR", "en"},
+	}
+	for _, tt := range tests {
+		t.Setenv("LC_ALL", tt.all)
+		t.Setenv("LC_MESSAGES", tt.messages)
+		t.Setenv("LANG", tt.lang)
+		if got := Detect(); got != tt.want {
+			t.Errorf("LC_ALL=%q LC_MESSAGES=%q LANG=%q: got %q, want %q", tt.all, tt.messages, tt.lang, got, tt.want)
+		}
+	}
+}
+
+// setLanguage sets lang until the test ends.
+func setLanguage(t *testing.T, lang string) {
+	t.Helper()
+	if err := SetLanguage(lang); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetLanguage(DEFAULT) })
+}
+
+func TestT(t *testing.T) {
+	setLanguage(t, "pt_BR")
+	if got, want := T("error", "x"), strings.Replace(Catalogs()["pt"].Messages["error"], "%v", "x", 1); got != want {
+		t.Errorf("T = %q, want %q", got, want)
+	}
+
+	// A message Portuguese lacks comes out in English
+	pt := Catalogs()["pt"].Messages
+	saved := pt["error"]
+	delete(pt, "error")
+	defer func() { pt["error"] = saved }()
+	if got, want := T("error", "x"), strings.Replace(Catalogs()[DEFAULT].Messages["error"], "%v", "x", 1); got != want {
+		t.Errorf("missing translation: got %q, want %q", got, want)
+	}
+
+	// And one no catalog has as its key
+	if got := T("no.such.key"); got != "no.such.key" {
+		t.Errorf("unknown key: got %q", got)
+	}
+}
+
+func TestSetLanguage(t *testing.T) {
+	if err := SetLanguage("xx"); err == nil {
+		t.Error("unknown language accepted")
+	}
+	setLanguage(t, "pt")
+	if got := Language(); got != "pt" {
+		t.Errorf("Language = %q, want pt", got)
+	}
+	for usage, translated := range Catalogs()["pt"].Flags {
+		if got := Flag(usage); got != translated {
+			t.Errorf("Flag(%q) = %q, want %q", usage, got, translated)
+		}
+		break
+	}
+	if got := Flag("Not a real flag"); got != "Not a real flag" {
+		t.Errorf("untranslated flag: got %q", got)
+	}
+}
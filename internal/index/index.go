@@ -0,0 +1,561 @@
+// Package index keeps track of the files stored in an upload directory:
+// each one's size, modification time and SHA-256 if its checksum sidecar
+// records one. Listing a directory, totalling what is stored and
+// enforcing retention then don't walk the upload directory every time.
+//
+// Opening an Index walks the directory once, several directories at a
+// time. What it found is kept in INDEX_NAME there, saved every
+// CHECK_INTERVAL if it changed and on Close, so the next start only
+// rescans the directories modified since, as their modification time
+// shows; an index left behind by a crash is brought up to date the same
+// way. The server updates the index as it stores and removes files, and
+// every CHECK_INTERVAL rescans directories that something else changed.
+// A file rewritten in place doesn't change its directory, so it is only
+// seen anew when its directory next changes.
+//
+// Like internal/retention it skips names starting with a dot (checksum
+// sidecars, files being received, the quarantine) and symbolic links.
+package index
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/wire"
+)
+
+// Name of the index file in the upload directory
+const INDEX_NAME = ".files.json"
+
+// Version of the index file; others are rebuilt
+const VERSION = 1
+
+// How often the index is checked against the directory and saved
+const CHECK_INTERVAL = time.Minute
+
+// Directories scanned at once
+const WALKERS = 8
+
+// A directory modified this shortly before it was scanned may have
+// changed again within its modification time's resolution, so it is
+// rescanned once more
+const RACY_WINDOW = 2 * time.Second
+
+// Entry describes a stored file.
+type Entry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256,omitempty"` // Hex, if known
+}
+
+// File is an Entry with its slash-separated path under the upload
+// directory.
+type File struct {
+	Name string
+	Entry
+}
+
+// dir is what a scan of a directory found in it.
+type dir struct {
+	ModTime time.Time        `json:"mod_time"`
+	Racy    bool             `json:"racy,omitempty"` // See RACY_WINDOW
+	Files   map[string]Entry `json:"files"`          // By name
+}
+
+// saved is the content of INDEX_NAME.
+type saved struct {
+	Version int             `json:"version"`
+	Dirs    map[string]*dir `json:"dirs"`
+}
+
+// Index tracks the files under an upload directory. It is safe for
+// concurrent use.
+type Index struct {
+	root string
+	log  *slog.Logger
+
+	mu    sync.RWMutex
+	dirs  map[string]*dir // By slash-separated path under root, "" for root
+	total int64
+	dirty bool // Changed since saved
+
+	refs int
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Servers of one process storing under the same directory share an Index
+var (
+	mu      sync.Mutex
+	indexes = make(map[string]*Index)
+)
+
+// Open returns the Index of the upload directory root, creating it if
+// needed, loading the index from INDEX_NAME and rescanning what changed
+// since, or walking root if there is no usable index. Each Open is paired
+// with a Close.
+func Open(root string, log *slog.Logger) (*Index, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return nil, fmt.Errorf("error creating uploads directory: %w", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if ix, ok := indexes[abs]; ok {
+		ix.refs++
+		return ix, nil
+	}
+
+	ix := &Index{root: abs, log: log, refs: 1, stop: make(chan struct{}), done: make(chan struct{})}
+	start := time.Now()
+	if ix.load() {
+		if err := ix.Check(); err != nil {
+			log.Warn("Some uploads couldn't be indexed", "err", err)
+		}
+		log.Info("Uploads index loaded", "files", ix.Len(), "bytes", ix.TotalBytes(), "took", time.Since(start).Round(time.Millisecond))
+	} else {
+		dirs, err := walk(abs, []string{""})
+		if dirs[""] == nil {
+			return nil, fmt.Errorf("error indexing uploads: %w", err)
+		}
+		if err != nil {
+			log.Warn("Some uploads couldn't be indexed", "err", err)
+		}
+		ix.dirs = dirs
+		ix.count()
+		ix.dirty = true
+		log.Info("Uploads indexed", "files", ix.Len(), "bytes", ix.TotalBytes(), "took", time.Since(start).Round(time.Millisecond))
+	}
+	if err := ix.Save(); err != nil {
+		return nil, err
+	}
+	go ix.run()
+	indexes[abs] = ix
+	return ix, nil
+}
+
+// load reads INDEX_NAME, reporting whether it held a usable index.
+func (ix *Index) load() bool {
+	file := filepath.Join(ix.root, INDEX_NAME)
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	var s saved
+	if err == nil {
+		err = json.Unmarshal(data, &s)
+	}
+	if err == nil && (s.Version != VERSION || s.Dirs[""] == nil) {
+		err = fmt.Errorf("version %d, want %d", s.Version, VERSION)
+	}
+	if err != nil {
+		ix.log.Warn("Uploads index unreadable, rebuilding it", "path", file, "err", err)
+		return false
+	}
+	for _, d := range s.Dirs {
+		if d.Files == nil {
+			d.Files = make(map[string]Entry)
+		}
+	}
+	ix.dirs = s.Dirs
+	ix.count()
+	return true
+}
+
+// count totals the sizes of the files indexed.
+func (ix *Index) count() {
+	ix.total = 0
+	for _, d := range ix.dirs {
+		for _, e := range d.Files {
+			ix.total += e.Size
+		}
+	}
+}
+
+// run checks and saves the index every CHECK_INTERVAL until Close.
+func (ix *Index) run() {
+	defer close(ix.done)
+	ticker := time.NewTicker(CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ix.stop:
+			return
+		}
+		if err := ix.Check(); err != nil {
+			ix.log.Error("Error checking uploads index", "err", err)
+		}
+		if err := ix.Save(); err != nil {
+			ix.log.Error("Error saving uploads index", "err", err)
+		}
+	}
+}
+
+// Close releases the Index; the last Close of those sharing it stops
+// checking it and saves it.
+func (ix *Index) Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if ix.refs--; ix.refs > 0 {
+		return nil
+	}
+	delete(indexes, ix.root)
+	close(ix.stop)
+	<-ix.done
+	return ix.Save()
+}
+
+// Save writes the index to a temporary file renamed over INDEX_NAME, so
+// it is never seen half written, unless it is unchanged since last saved.
+func (ix *Index) Save() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if !ix.dirty {
+		return nil
+	}
+	data, err := json.Marshal(saved{Version: VERSION, Dirs: ix.dirs})
+	if err != nil {
+		return err
+	}
+	// Saving modifies the upload directory, which mustn't look like a
+	// change made by something else
+	before, berr := os.Stat(ix.root)
+	tmp, err := os.CreateTemp(ix.root, INDEX_NAME+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error saving uploads index: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(ix.root, INDEX_NAME))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error saving uploads index: %w", err)
+	}
+	ix.dirty = false
+	if after, err := os.Stat(ix.root); err == nil && berr == nil && ix.dirs[""].ModTime.Equal(before.ModTime()) {
+		ix.dirs[""].ModTime = after.ModTime()
+	}
+	return nil
+}
+
+// Check rescans the directories modified since they were last scanned,
+// and forgets those removed.
+func (ix *Index) Check() error {
+	ix.mu.RLock()
+	names := make([]string, 0, len(ix.dirs))
+	for name := range ix.dirs {
+		names = append(names, name)
+	}
+	ix.mu.RUnlock()
+
+	// Parents first, so a removed directory is forgotten with its parent's
+	// rescan before its own is tried
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		if err := ix.refresh(name, false); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// refresh rescans the directory name if it changed since it was scanned,
+// or regardless if force is set, forgetting it if it is gone.
+func (ix *Index) refresh(name string, force bool) error {
+	stat := os.Lstat
+	if name == "" {
+		stat = os.Stat // The upload directory may be a symlink
+	}
+	info, err := stat(ix.path(name))
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	d, known := ix.dirs[name]
+	if errors.Is(err, os.ErrNotExist) || err == nil && !info.IsDir() {
+		if known {
+			ix.forget(name)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error indexing %s: %w", ix.path(name), err)
+	}
+	if known && !force && !d.Racy && d.ModTime.Equal(info.ModTime()) {
+		return nil
+	}
+	return ix.rescan(name)
+}
+
+// rescan scans the directory name again, walking the subdirectories it
+// didn't have before and forgetting those it no longer has. The caller
+// holds ix.mu.
+func (ix *Index) rescan(name string) error {
+	d, subdirs, err := scan(ix.root, name)
+	if err != nil {
+		return err
+	}
+	if old, ok := ix.dirs[name]; ok {
+		for _, e := range old.Files {
+			ix.total -= e.Size
+		}
+	}
+	for _, e := range d.Files {
+		ix.total += e.Size
+	}
+	ix.dirs[name] = d
+	ix.dirty = true
+
+	have := make(map[string]bool, len(subdirs))
+	var added []string
+	for _, sub := range subdirs {
+		have[sub] = true
+		if _, ok := ix.dirs[sub]; !ok {
+			added = append(added, sub)
+		}
+	}
+	for sub := range ix.dirs {
+		if parent(sub) == name && sub != name && !have[sub] {
+			ix.forget(sub)
+		}
+	}
+	if len(added) > 0 {
+		return ix.walk(added)
+	}
+	return nil
+}
+
+// walk indexes the directories names, which aren't yet, and those below
+// them, some of which Add may have recorded already. The caller holds
+// ix.mu.
+func (ix *Index) walk(names []string) error {
+	dirs, err := walk(ix.root, names)
+	for sub, d := range dirs {
+		if old, ok := ix.dirs[sub]; ok {
+			for _, e := range old.Files {
+				ix.total -= e.Size
+			}
+		}
+		ix.dirs[sub] = d
+		for _, e := range d.Files {
+			ix.total += e.Size
+		}
+	}
+	ix.dirty = true
+	return err
+}
+
+// forget drops the directory name and those under it. The caller holds
+// ix.mu.
+func (ix *Index) forget(name string) {
+	for sub, d := range ix.dirs {
+		if sub == name || name == "" || strings.HasPrefix(sub, name+"/") {
+			for _, e := range d.Files {
+				ix.total -= e.Size
+			}
+			delete(ix.dirs, sub)
+		}
+	}
+	ix.dirty = true
+}
+
+// Refresh rescans the directory name under the upload directory and what
+// it holds, e.g. after files were unpacked into it.
+func (ix *Index) Refresh(name string) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.forget(name)
+	return ix.walk([]string{name})
+}
+
+// Add records the file name, just stored, as it is now, and its SHA-256
+// if its checksum sidecar records it.
+func (ix *Index) Add(name string) error {
+	full := ix.path(name)
+	info, err := os.Lstat(full)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file: %w", name, os.ErrNotExist)
+	}
+	e := Entry{Size: info.Size(), ModTime: info.ModTime()}
+	if sum, ok := hashcache.Cached(full, info); ok {
+		e.SHA256 = hex.EncodeToString(sum)
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	dirName, base := parent(name), path.Base(name)
+	d, ok := ix.dirs[dirName]
+	if !ok {
+		// A directory made for it, which the next check scans in full
+		d = &dir{Racy: true, Files: make(map[string]Entry)}
+		for sub := dirName; sub != ""; {
+			sub = parent(sub)
+			if _, ok := ix.dirs[sub]; ok {
+				ix.dirs[sub].Racy = true
+				break
+			}
+		}
+		ix.dirs[dirName] = d
+	}
+	ix.total += e.Size - d.Files[base].Size
+	d.Files[base] = e
+	ix.dirty = true
+	return nil
+}
+
+// Remove forgets the file name, once removed.
+func (ix *Index) Remove(name string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	d, ok := ix.dirs[parent(name)]
+	if !ok {
+		return
+	}
+	base := path.Base(name)
+	if e, ok := d.Files[base]; ok {
+		ix.total -= e.Size
+		delete(d.Files, base)
+		ix.dirty = true
+	}
+}
+
+// Stat returns the file name, rescanning its directory first if the file
+// isn't indexed and the directory changed since scanned.
+func (ix *Index) Stat(name string) (Entry, bool) {
+	if e, ok := ix.lookup(name); ok {
+		return e, true
+	}
+	if dir := parent(name); ix.known(dir) {
+		if err := ix.refresh(dir, false); err != nil {
+			ix.log.Warn("Error indexing directory", "path", ix.path(dir), "err", err)
+		}
+	}
+	return ix.lookup(name)
+}
+
+func (ix *Index) lookup(name string) (Entry, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	d, ok := ix.dirs[parent(name)]
+	if !ok {
+		return Entry{}, false
+	}
+	e, ok := d.Files[path.Base(name)]
+	return e, ok
+}
+
+func (ix *Index) known(name string) bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	_, ok := ix.dirs[name]
+	return ok
+}
+
+// List describes the files directly in the directory name, "" for the
+// upload directory, sorted by name, rescanning it first if it changed
+// since scanned. A directory that isn't there fails with an error
+// wrapping os.ErrNotExist.
+func (ix *Index) List(name string) ([]wire.FileInfo, error) {
+	if hidden(name) {
+		return nil, fmt.Errorf("%s: %w", ix.path(name), os.ErrNotExist)
+	}
+	if err := ix.refresh(name, false); err != nil {
+		return nil, err
+	}
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	d, ok := ix.dirs[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", ix.path(name), os.ErrNotExist)
+	}
+	infos := make([]wire.FileInfo, 0, len(d.Files))
+	for base, e := range d.Files {
+		infos = append(infos, wire.FileInfo{Name: base, Size: e.Size, ModTime: e.ModTime})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// Files returns every file indexed, sorted by name.
+func (ix *Index) Files() []File {
+	ix.mu.RLock()
+	var files []File
+	for name, d := range ix.dirs {
+		for base, e := range d.Files {
+			files = append(files, File{Name: path.Join(name, base), Entry: e})
+		}
+	}
+	ix.mu.RUnlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files
+}
+
+// TotalBytes returns the size of the files indexed, together.
+func (ix *Index) TotalBytes() int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.total
+}
+
+// Len returns how many files are indexed.
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	n := 0
+	for _, d := range ix.dirs {
+		n += len(d.Files)
+	}
+	return n
+}
+
+// Root returns the upload directory, as an absolute path.
+func (ix *Index) Root() string {
+	return ix.root
+}
+
+// path returns where the file or directory name is.
+func (ix *Index) path(name string) string {
+	return filepath.Join(ix.root, filepath.FromSlash(name))
+}
+
+// hidden reports whether the slash-separated name is, or is under, a
+// name starting with a dot, which the index leaves out.
+func hidden(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// parent returns the directory of the slash-separated name, "" for the
+// upload directory.
+func parent(name string) string {
+	dir := path.Dir(name)
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return dir
+}
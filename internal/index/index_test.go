@@ -0,0 +1,412 @@
+package index
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/checksum"
+	"socket-file-transfer/internal/hashcache"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// put writes data to the slash-separated name under root, making its
+// directories.
+func put(t *testing.T, root, name, data string) {
+	t.Helper()
+	full := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(full, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// age sets the modification time of every directory under root an hour
+// back, so the index trusts what it scanned of them rather than finding
+// them racy.
+func age(t *testing.T, root string) {
+	t.Helper()
+	old := time.Now().Add(-time.Hour)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return os.Chtimes(path, old, old)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sizes returns the size of each file by name.
+func sizes(files []File) map[string]int64 {
+	m := make(map[string]int64)
+	for _, f := range files {
+		m[f.Name] = f.Size
+	}
+	return m
+}
+
+// onDisk walks root the way the index should, returning the size of each
+// file found.
+func onDisk(t *testing.T, root string) map[string]int64 {
+	t.Helper()
+	m := make(map[string]int64)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(root, path)
+			m[filepath.ToSlash(rel)] = info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// open opens the index of root, closing it when the test ends.
+func open(t *testing.T, root string) *Index {
+	t.Helper()
+	ix, err := Open(root, quiet)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { ix.Close() })
+	return ix
+}
+
+// check compares what ix holds with what is on disk under its root.
+func check(t *testing.T, ix *Index) {
+	t.Helper()
+	want := onDisk(t, ix.Root())
+	if got := sizes(ix.Files()); !reflect.DeepEqual(got, want) {
+		t.Errorf("indexed %v, want %v", got, want)
+	}
+	var total int64
+	for _, size := range want {
+		total += size
+	}
+	if got := ix.TotalBytes(); got != total {
+		t.Errorf("TotalBytes = %d, want %d", got, total)
+	}
+	if got := ix.Len(); got != len(want) {
+		t.Errorf("Len = %d, want %d", got, len(want))
+	}
+}
+
+// tree fills root with files at several depths and the names the index
+// leaves out.
+func tree(t *testing.T, root string) {
+	t.Helper()
+	put(t, root, "a.txt", "alpha")
+	put(t, root, "sub/b.txt", "bravo!")
+	put(t, root, "sub/deep/c.txt", "charlie")
+	put(t, root, "sub/deep/empty", "")
+	put(t, root, ".hidden", "not a file")
+	put(t, root, "sub/.b.txt.part", "receiving")
+	put(t, root, ".quarantine/bad.bin", "quarantined")
+	if err := os.Symlink("a.txt", filepath.Join(root, "link")); err != nil {
+		t.Logf("no symlink: %v", err)
+	}
+}
+
+// The first Open walks the whole directory, leaving out dot names and
+// symbolic links, and records the SHA-256 checksum sidecars hold.
+func TestOpenWalk(t *testing.T) {
+	root := t.TempDir()
+	tree(t, root)
+	sum := sha256.Sum256([]byte("alpha"))
+	if err := hashcache.Store(filepath.Join(root, "a.txt"), checksum.SHA256, sum[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	ix := open(t, root)
+	want := map[string]int64{"a.txt": 5, "sub/b.txt": 6, "sub/deep/c.txt": 7, "sub/deep/empty": 0}
+	if got := sizes(ix.Files()); !reflect.DeepEqual(got, want) {
+		t.Errorf("indexed %v, want %v", got, want)
+	}
+	check(t, ix)
+	e, ok := ix.Stat("a.txt")
+	if !ok || e.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Stat(a.txt) = %+v, %v, want SHA-256 %x", e, ok, sum)
+	}
+	if e, _ := ix.Stat("sub/b.txt"); e.SHA256 != "" {
+		t.Errorf("file without a sidecar has SHA-256 %s", e.SHA256)
+	}
+	if _, err := os.Stat(filepath.Join(root, INDEX_NAME)); err != nil {
+		t.Errorf("index not saved: %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	root := t.TempDir()
+	tree(t, root)
+	ix := open(t, root)
+
+	tests := []struct {
+		dir  string
+		want []string
+		err  error
+	}{
+		{"", []string{"a.txt"}, nil},
+		{"sub", []string{"b.txt"}, nil},
+		{"sub/deep", []string{"c.txt", "empty"}, nil},
+		{"missing", nil, os.ErrNotExist},
+		{".quarantine", nil, os.ErrNotExist},
+		{"sub/.b.txt.part", nil, os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			infos, err := ix.List(tt.dir)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			var got []string
+			for _, info := range infos {
+				got = append(got, info.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// What the server stores and removes is counted at once.
+func TestAddRemove(t *testing.T) {
+	root := t.TempDir()
+	ix := open(t, root)
+
+	put(t, root, "one", "1")
+	put(t, root, "new/dir/two", "22")
+	for _, name := range []string{"one", "new/dir/two"} {
+		if err := ix.Add(name); err != nil {
+			t.Fatalf("Add(%s): %v", name, err)
+		}
+	}
+	if got := ix.TotalBytes(); got != 3 {
+		t.Errorf("TotalBytes = %d, want 3", got)
+	}
+	// Rewritten, it replaces what was there
+	put(t, root, "one", "1111")
+	ix.Add("one")
+	if got := ix.TotalBytes(); got != 6 {
+		t.Errorf("TotalBytes after a rewrite = %d, want 6", got)
+	}
+	if err := ix.Add("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Add(missing): got %v, want os.ErrNotExist", err)
+	}
+	if err := ix.Add("new"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Add of a directory: got %v, want os.ErrNotExist", err)
+	}
+
+	os.Remove(filepath.Join(root, "one"))
+	ix.Remove("one")
+	ix.Remove("never/there")
+	if _, ok := ix.Stat("one"); ok {
+		t.Error("removed file still indexed")
+	}
+	check(t, ix)
+	// The directory made for the file is scanned in full once checked
+	put(t, root, "new/dir/three", "333")
+	if err := ix.Check(); err != nil {
+		t.Fatal(err)
+	}
+	check(t, ix)
+}
+
+// Files something else stores or removes are seen once their directory is
+// checked, and a file looked up by name as soon as it is there.
+func TestChangedOutside(t *testing.T) {
+	root := t.TempDir()
+	tree(t, root)
+	age(t, root)
+	ix := open(t, root)
+
+	put(t, root, "sub/deep/later", "later")
+	if e, ok := ix.Stat("sub/deep/later"); !ok || e.Size != 5 {
+		t.Errorf("Stat of a file stored outside = %+v, %v, want 5 bytes", e, ok)
+	}
+
+	os.Remove(filepath.Join(root, "a.txt"))
+	os.RemoveAll(filepath.Join(root, "sub", "deep"))
+	put(t, root, "other/x", "x")
+	if err := ix.Check(); err != nil {
+		t.Fatal(err)
+	}
+	check(t, ix)
+	if _, err := ix.List("sub/deep"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("List of a removed directory: got %v, want os.ErrNotExist", err)
+	}
+}
+
+// A restart loads the index rather than walking again: directories that
+// didn't change aren't read, so a file rewritten in place keeps its old
+// entry, while those that changed are rescanned.
+func TestReopen(t *testing.T) {
+	root := t.TempDir()
+	tree(t, root)
+	age(t, root)
+	ix, err := Open(root, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Rewritten in place, leaving sub/deep as it was
+	put(t, root, "sub/deep/c.txt", "charlie, longer")
+	put(t, root, "sub/new.txt", "new")
+	ix = open(t, root)
+	if e, _ := ix.Stat("sub/deep/c.txt"); e.Size != 7 {
+		t.Errorf("file in an unchanged directory has size %d, want the 7 indexed", e.Size)
+	}
+	if e, ok := ix.Stat("sub/new.txt"); !ok || e.Size != 3 {
+		t.Errorf("file added while stopped = %+v, %v, want 3 bytes", e, ok)
+	}
+}
+
+// An index left behind by a crash, older than what was stored and removed
+// after it was saved, is brought up to date on the next Open.
+func TestStaleIndex(t *testing.T) {
+	root := t.TempDir()
+	tree(t, root)
+	age(t, root)
+	ix, err := Open(root, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix.Close()
+	stale, err := os.ReadFile(filepath.Join(root, INDEX_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ix, err = Open(root, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(root, "a.txt"))
+	ix.Remove("a.txt")
+	put(t, root, "sub/d.txt", "delta")
+	ix.Add("sub/d.txt")
+	put(t, root, "fresh/dir/e.txt", "echo")
+	ix.Add("fresh/dir/e.txt")
+	os.RemoveAll(filepath.Join(root, "sub", "deep"))
+	ix.Close()
+
+	// The process died before saving any of that
+	if err := os.WriteFile(filepath.Join(root, INDEX_NAME), stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	check(t, open(t, root))
+}
+
+// An index that can't be used is rebuilt by walking, then saved again.
+func TestUnusableIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"garbage", "{not json"},
+		{"other version", `{"version":99,"dirs":{"":{"files":{"ghost":{"size":1}}}}}`},
+		{"no root", `{"version":1,"dirs":{"sub":{"files":{"ghost":{"size":1}}}}}`},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			tree(t, root)
+			if err := os.WriteFile(filepath.Join(root, INDEX_NAME), []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ix, err := Open(root, quiet)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			check(t, ix)
+			ix.Close()
+			ix = open(t, root)
+			if !ix.known("") || ix.Len() != 4 {
+				t.Errorf("rebuilt index not saved: %d files", ix.Len())
+			}
+		})
+	}
+}
+
+// Servers storing under the same directory share its Index until the last
+// one closes it.
+func TestShared(t *testing.T) {
+	root := t.TempDir()
+	a, err := Open(root, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Open(root+string(filepath.Separator)+".", quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatal("two Opens of one directory have their own Index")
+	}
+	a.Close()
+	put(t, root, "f", "f")
+	if err := b.Add("f"); err != nil {
+		t.Fatalf("Add after the other Close: %v", err)
+	}
+	b.Close()
+
+	c := open(t, root)
+	if c == a {
+		t.Error("Open after the last Close returned the closed Index")
+	}
+	if _, ok := c.Stat("f"); !ok {
+		t.Error("file added before the last Close not saved")
+	}
+}
+
+// Refresh picks up a directory filled all at once, e.g. by unpacking an
+// archive into it.
+func TestRefresh(t *testing.T) {
+	root := t.TempDir()
+	ix := open(t, root)
+	put(t, root, "unpacked/a", "a")
+	put(t, root, "unpacked/nested/b", "bb")
+	if err := ix.Refresh("unpacked"); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	check(t, ix)
+
+	os.RemoveAll(filepath.Join(root, "unpacked", "nested"))
+	if err := ix.Refresh("unpacked"); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	check(t, ix)
+}
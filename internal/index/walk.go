@@ -0,0 +1,108 @@
+package index
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/hashcache"
+)
+
+// walk scans the directories names under root and those below them,
+// WALKERS at a time. Directories removed meanwhile are left out; it fails
+// for those that can't be read, returning what it found in the others.
+func walk(root string, names []string) (map[string]*dir, error) {
+	var (
+		mu   sync.Mutex
+		dirs = make(map[string]*dir)
+		errs []error
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, WALKERS)
+	)
+	var visit func(name string)
+	visit = func(name string) {
+		d, subdirs, err := scan(root, name)
+		mu.Lock()
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			errs = append(errs, err)
+		default:
+			dirs[name] = d
+		}
+		mu.Unlock()
+		for _, sub := range subdirs {
+			// Scan it here once WALKERS are busy
+			select {
+			case sem <- struct{}{}:
+				wg.Add(1)
+				go func(sub string) {
+					defer wg.Done()
+					defer func() { <-sem }()
+					visit(sub)
+				}(sub)
+			default:
+				visit(sub)
+			}
+		}
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	wg.Wait()
+	return dirs, errors.Join(errs...)
+}
+
+// scan reads the directory name under root, returning its files and the
+// names of its subdirectories.
+func scan(root, name string) (*dir, []string, error) {
+	full := filepath.Join(root, filepath.FromSlash(name))
+	// Before reading it, so a change made meanwhile shows next time
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error indexing %s: %w", full, err)
+	}
+	entries, err := os.ReadDir(full)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error indexing %s: %w", full, err)
+	}
+
+	d := &dir{ModTime: info.ModTime(), Racy: time.Since(info.ModTime()) < RACY_WINDOW, Files: make(map[string]Entry)}
+	sidecars := make(map[string]bool)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") && e.Type().IsRegular() {
+			sidecars[e.Name()] = true
+		}
+	}
+	var subdirs []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		switch {
+		case e.IsDir():
+			subdirs = append(subdirs, path.Join(name, e.Name()))
+		case e.Type().IsRegular():
+			info, err := e.Info()
+			if err != nil {
+				continue // Removed since ReadDir
+			}
+			entry := Entry{Size: info.Size(), ModTime: info.ModTime()}
+			file := filepath.Join(full, e.Name())
+			// Only read the sidecars that are there
+			if sidecars[filepath.Base(hashcache.SidecarPath(file))] {
+				if sum, ok := hashcache.Cached(file, info); ok {
+					entry.SHA256 = hex.EncodeToString(sum)
+				}
+			}
+			d.Files[e.Name()] = entry
+		}
+	}
+	return d, subdirs, nil
+}
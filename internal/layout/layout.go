@@ -0,0 +1,143 @@
+// Package layout decides where a server stores a received file, following
+// a template such as "{year}/{month}/{day}/{name}". Tokens:
+//
+//	{date}    2006-01-02
+//	{year}    2006
+//	{month}   01
+//	{day}     02
+//	{time}    150405
+//	{client}  the sender, see wire.ClientDir
+//	{name}    the file name
+//	{hash8}   the first 8 hex digits of the file's SHA-256
+//
+// Dates and times are the server's local time when the transfer starts.
+// Slashes in the template separate directories; expanded paths must stay
+// inside the upload directory.
+package layout
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+var ErrInvalid = errors.New("invalid layout")
+
+// Fields are what the tokens of a template expand to for one transfer.
+type Fields struct {
+	Time   time.Time
+	Client string // Directory name of the sender
+	Name   string // File name, already checked to be a plain path element
+	Sum    []byte // SHA-256 of the file, nil if not known yet
+}
+
+var tokens = map[string]func(f *Fields) string{
+	"date":   func(f *Fields) string { return f.Time.Format("2006-01-02") },
+	"year":   func(f *Fields) string { return f.Time.Format("2006") },
+	"month":  func(f *Fields) string { return f.Time.Format("01") },
+	"day":    func(f *Fields) string { return f.Time.Format("02") },
+	"time":   func(f *Fields) string { return f.Time.Format("150405") },
+	"client": func(f *Fields) string { return f.Client },
+	"name":   func(f *Fields) string { return f.Name },
+	"hash8":  func(f *Fields) string { return hex.EncodeToString(f.Sum)[:8] },
+}
+
+// Check reports whether template is usable: empty, or every token known
+// and the result inside the upload directory.
+func Check(template string) error {
+	if template == "" {
+		return nil
+	}
+	_, err := Expand(template, Fields{Client: "client", Name: "name", Sum: make([]byte, 4)})
+	return err
+}
+
+// NeedsSum reports whether template uses the file's checksum.
+func NeedsSum(template string) bool {
+	return strings.Contains(template, "{hash8}")
+}
+
+// Expand returns the path template gives f, relative to the upload
+// directory. Values are substituted once, so a name containing a token is
+// taken literally, and may not add or climb directories.
+func Expand(template string, f Fields) (string, error) {
+	var b strings.Builder
+	rest := template
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			b.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("%w %q: unclosed {", ErrInvalid, template)
+		}
+		token := rest[open+1 : open+end]
+		expand, ok := tokens[token]
+		if !ok {
+			return "", fmt.Errorf("%w %q: unknown token {%s}", ErrInvalid, template, token)
+		}
+		if token == "hash8" && len(f.Sum) < 4 {
+			return "", fmt.Errorf("%w %q: checksum not known", ErrInvalid, template)
+		}
+		// A value is at most part of one path element, whatever the sender
+		// put in it
+		value := expand(&f)
+		if strings.ContainsAny(value, `/\`) || value == "." || value == ".." {
+			return "", fmt.Errorf("%w: {%s} expands to %q", ErrInvalid, token, value)
+		}
+		b.WriteString(rest[:open])
+		b.WriteString(value)
+		rest = rest[open+end+1:]
+	}
+
+	path := filepath.Clean(filepath.FromSlash(b.String()))
+	if !filepath.IsLocal(path) || path == "." {
+		return "", fmt.Errorf("%w %q: %q is not a file in the upload directory", ErrInvalid, template, path)
+	}
+	return path, nil
+}
+
+// Place returns where a transfer writes its file under root and a function
+// that, given the file's SHA-256 once received, returns where the file
+// belongs. The two differ only when template needs a checksum f lacks;
+// the caller then moves the file. Directories are created as needed. An
+// empty template stores the file as root/name.
+func Place(root, template string, f Fields) (path string, final func(sum []byte) (string, error), err error) {
+	if template == "" {
+		path = filepath.Join(root, f.Name)
+		return path, func([]byte) (string, error) { return path, nil }, nil
+	}
+
+	if NeedsSum(template) && f.Sum == nil {
+		path = filepath.Join(root, "."+f.Name+".partial")
+		return path, func(sum []byte) (string, error) {
+			f.Sum = sum
+			return place(root, template, f)
+		}, nil
+	}
+	path, err = place(root, template, f)
+	return path, func([]byte) (string, error) { return path, err }, err
+}
+
+func place(root, template string, f Fields) (string, error) {
+	rel, err := Expand(template, f)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(root, rel)
+	if err := wire.CheckNoSymlinks(root, path); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("error creating directory: %w", err)
+	}
+	return path, nil
+}
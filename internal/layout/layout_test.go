@@ -0,0 +1,136 @@
+package layout
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var fields = Fields{
+	Time:   time.Date(2024, 6, 17, 9, 5, 3, 0, time.Local),
+	Client: "192.0.2.7",
+	Name:   "report.pdf",
+	Sum:    []byte{0xde, 0xad, 0xbe, 0xef, 0x01},
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"{name}", "report.pdf"},
+		{"{year}/{month}/{day}/{name}", "2024/06/17/report.pdf"},
+		{"{date}/{time}-{name}", "2024-06-17/090503-report.pdf"},
+		{"{client}/{name}", "192.0.2.7/report.pdf"},
+		{"{hash8}/{name}", "deadbeef/report.pdf"},
+		{"in/./{name}", "in/report.pdf"},
+		{"a/../{name}", "report.pdf"},
+		{"{name}.bak", "report.pdf.bak"},
+	}
+	for _, tt := range tests {
+		got, err := Expand(tt.template, fields)
+		if err != nil || got != filepath.FromSlash(tt.want) {
+			t.Errorf("Expand(%q) = %q, %v, want %q", tt.template, got, err, tt.want)
+		}
+	}
+}
+
+func TestExpandInvalid(t *testing.T) {
+	for _, template := range []string{
+		"{nope}/{name}",
+		"{name",
+		"../{name}",
+		"/abs/{name}",
+		"{year}/..",
+		"..",
+		".",
+	} {
+		if _, err := Expand(template, fields); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Expand(%q) = %v, want ErrInvalid", template, err)
+		}
+	}
+	noSum := fields
+	noSum.Sum = nil
+	if _, err := Expand("{hash8}", noSum); !errors.Is(err, ErrInvalid) {
+		t.Errorf("{hash8} without a checksum: %v, want ErrInvalid", err)
+	}
+}
+
+// Names can't add directories or climb out through {name}, nor be taken
+// as tokens.
+func TestExpandAdversarialNames(t *testing.T) {
+	for _, name := range []string{"..", ".", "a/b", "../../etc/passwd", `..\..\win.ini`, "x/../../y"} {
+		f := fields
+		f.Name = name
+		for _, template := range []string{"{name}", "{year}/{name}", "pre-{name}"} {
+			if got, err := Expand(template, f); !errors.Is(err, ErrInvalid) {
+				t.Errorf("Expand(%q) of name %q = %q, %v, want ErrInvalid", template, name, got, err)
+			}
+		}
+	}
+
+	f := fields
+	f.Name = "{client}{year}"
+	if got, err := Expand("{name}", f); err != nil || got != "{client}{year}" {
+		t.Errorf("name of tokens expanded to %q, %v, want it literally", got, err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, template := range []string{"", "{name}", "{year}/{month}/{name}", "{hash8}-{name}"} {
+		if err := Check(template); err != nil {
+			t.Errorf("Check(%q) = %v", template, err)
+		}
+	}
+	for _, template := range []string{"{bad}", "../{name}", "{name"} {
+		if err := Check(template); err == nil {
+			t.Errorf("Check(%q) accepted", template)
+		}
+	}
+}
+
+func TestPlace(t *testing.T) {
+	root := t.TempDir()
+	path, final, err := Place(root, "{year}/{month}/{name}", fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, "2024", "06", "report.pdf"); path != want {
+		t.Errorf("placed at %q, want %q", path, want)
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		t.Errorf("directories not created: %v", err)
+	}
+	if got, err := final(nil); got != path || err != nil {
+		t.Errorf("final = %q, %v, want %q", got, err, path)
+	}
+
+	// Without the checksum yet, the file is received next to the root and
+	// placed once it is known
+	noSum := fields
+	noSum.Sum = nil
+	path, final, err = Place(root, "{hash8}/{name}", noSum)
+	if err != nil || filepath.Dir(path) != root || filepath.Base(path)[0] != '.' {
+		t.Fatalf("received at %q, %v, want a hidden file in the root", path, err)
+	}
+	got, err := final(fields.Sum)
+	if want := filepath.Join(root, "deadbeef", "report.pdf"); got != want || err != nil {
+		t.Errorf("final = %q, %v, want %q", got, err, want)
+	}
+
+	if path, _, _ := Place(root, "", fields); path != filepath.Join(root, "report.pdf") {
+		t.Errorf("empty layout placed at %q", path)
+	}
+}
+
+func TestPlaceSymlink(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink(t.TempDir(), filepath.Join(root, "2024")); err != nil {
+		t.Skip(err)
+	}
+	if _, _, err := Place(root, "{year}/{name}", fields); err == nil {
+		t.Error("placed a file through a symlinked directory")
+	}
+}
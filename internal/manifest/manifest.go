@@ -0,0 +1,105 @@
+// Package manifest reads, writes and checks SHA256SUMS manifests: a line
+// "<hex SHA-256>  <path>" per file, as sha256sum prints them, so
+// sha256sum -c can check one too. Paths are slash-separated and relative
+// to the manifest's directory.
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// Name of a manifest, in the directory whose files it lists
+const NAME = "SHA256SUMS"
+
+// Entry is a file a manifest lists.
+type Entry struct {
+	Path string
+	Sum  []byte
+}
+
+// Write writes entries in manifest format.
+func Write(w io.Writer, entries []Entry) error {
+	bw := bufio.NewWriter(w)
+	for _, e := range entries {
+		fmt.Fprintf(bw, "%x  %s\n", e.Sum, e.Path)
+	}
+	return bw.Flush()
+}
+
+// Parse reads a manifest. Lines in sha256sum's binary mode, with a '*'
+// before the path, are accepted too.
+func Parse(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		if !ok || len(name) < 2 || name[0] != ' ' && name[0] != '*' {
+			return nil, fmt.Errorf("manifest line %d: not \"<sha256>  <path>\"", n)
+		}
+		b, err := hex.DecodeString(sum)
+		if err != nil || len(b) != wire.CHECKSUM_LEN {
+			return nil, fmt.Errorf("manifest line %d: invalid SHA-256 %q", n, sum)
+		}
+		entries = append(entries, Entry{Path: name[1:], Sum: b})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	return entries, nil
+}
+
+// Load reads the manifest in dir.
+func Load(dir string) ([]Entry, error) {
+	file, err := os.Open(filepath.Join(dir, NAME))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+// Mismatch is a file that doesn't match its manifest entry.
+type Mismatch struct {
+	Path string
+	Err  error
+}
+
+// ErrDiffers is the Err of a Mismatch whose file has other content.
+var ErrDiffers = errors.New("content differs from the manifest")
+
+// Check hashes each file entries lists under dir with sum and returns
+// those that are missing, unreadable or differ. A path leading outside
+// dir is reported rather than followed.
+func Check(dir string, entries []Entry, sum func(path string) ([]byte, error)) []Mismatch {
+	var mismatches []Mismatch
+	for _, e := range entries {
+		clean := path.Clean(e.Path)
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			mismatches = append(mismatches, Mismatch{Path: e.Path, Err: errors.New("path leads outside the directory")})
+			continue
+		}
+		got, err := sum(filepath.Join(dir, filepath.FromSlash(clean)))
+		switch {
+		case err != nil:
+			mismatches = append(mismatches, Mismatch{Path: e.Path, Err: err})
+		case !bytes.Equal(got, e.Sum):
+			mismatches = append(mismatches, Mismatch{Path: e.Path, Err: ErrDiffers})
+		}
+	}
+	return mismatches
+}
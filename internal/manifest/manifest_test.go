@@ -0,0 +1,122 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sum(data string) []byte {
+	s := sha256.Sum256([]byte(data))
+	return s[:]
+}
+
+// What Write writes, Parse reads back, in the format sha256sum prints.
+func TestWriteParse(t *testing.T) {
+	entries := []Entry{{Path: "a.txt", Sum: sum("a")}, {Path: "with space", Sum: sum("b")}}
+	var buf bytes.Buffer
+	if err := Write(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	want := "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb  a.txt\n"
+	if line, _, _ := strings.Cut(buf.String(), "\n"); line+"\n" != want {
+		t.Errorf("wrote %q, want %q", line+"\n", want)
+	}
+
+	got, err := Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("parsed %d entries, want %d", len(got), len(entries))
+	}
+	for i := range got {
+		if got[i].Path != entries[i].Path || !bytes.Equal(got[i].Sum, entries[i].Sum) {
+			t.Errorf("entry %d = %s %x, want %s %x", i, got[i].Path, got[i].Sum, entries[i].Path, entries[i].Sum)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	tests := []struct {
+		name  string
+		in    string
+		paths []string // nil if it fails
+	}{
+		{"text mode", hash + "  f\n", []string{"f"}},
+		{"binary mode", hash + " *f\n", []string{"f"}},
+		{"CRLF and blank lines", hash + "  f\r\n\r\n" + hash + "  g\n", []string{"f", "g"}},
+		{"empty", "", []string{}},
+		{"one space", hash + " f\n", nil},
+		{"no path", hash + "  \n", nil},
+		{"short hash", "abcd  f\n", nil},
+		{"not hex", strings.Repeat("zz", 32) + "  f\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := Parse(strings.NewReader(tt.in))
+			if tt.paths == nil {
+				if err == nil {
+					t.Errorf("parsed %v, want an error", entries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, e := range entries {
+				paths = append(paths, e.Path)
+			}
+			if strings.Join(paths, ",") != strings.Join(tt.paths, ",") {
+				t.Errorf("got %v, want %v", paths, tt.paths)
+			}
+		})
+	}
+}
+
+// Check reports missing, differing and escaping files, and nothing for
+// files that match.
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "good"), []byte("good"), 0644)
+	os.WriteFile(filepath.Join(dir, "bad"), []byte("tampered"), 0644)
+	entries := []Entry{
+		{Path: "good", Sum: sum("good")},
+		{Path: "bad", Sum: sum("bad")},
+		{Path: "missing", Sum: sum("x")},
+		{Path: "../outside", Sum: sum("x")},
+		{Path: "/etc/passwd", Sum: sum("x")},
+	}
+	hashed := 0
+	mismatches := Check(dir, entries, func(path string) ([]byte, error) {
+		hashed++
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return sum(string(data)), nil
+	})
+
+	got := make(map[string]error)
+	for _, m := range mismatches {
+		got[m.Path] = m.Err
+	}
+	if len(got) != 4 || got["good"] != nil {
+		t.Fatalf("mismatches %v, want all but good", mismatches)
+	}
+	if !errors.Is(got["bad"], ErrDiffers) {
+		t.Errorf("bad: %v, want ErrDiffers", got["bad"])
+	}
+	if !errors.Is(got["missing"], os.ErrNotExist) {
+		t.Errorf("missing: %v, want os.ErrNotExist", got["missing"])
+	}
+	if hashed != 3 {
+		t.Errorf("hashed %d files, want 3, none outside the directory", hashed)
+	}
+}
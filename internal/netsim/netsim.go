@@ -0,0 +1,290 @@
+// Package netsim impairs connections on purpose, so the transfer code can
+// be exercised without a bad network. It drops, duplicates, reorders and
+// delays the packets written to datagram connections, see PacketConn and
+// Conn, and slows stream connections down as TCP would be on such a
+// network, see Stream. Only what is written is impaired; wrap both ends to
+// impair both directions. Decisions come from a seeded random source, so a
+// given Config misbehaves the same way on every run.
+package netsim
+
+import (
+	"container/heap"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Config describes how outgoing packets are impaired. The zero value passes
+// every packet through unchanged.
+type Config struct {
+	Loss      float64       // Probability of dropping a packet
+	DropEvery int           // Also drop every Nth packet, 0 to disable
+	Duplicate float64       // Probability of sending a packet twice
+	Reorder   float64       // Probability of holding a packet back
+	Delay     time.Duration // How long held-back packets wait on top of Latency, 10ms if 0
+	Latency   time.Duration // How long every packet takes to leave
+	Seed      int64
+}
+
+// Enabled reports whether c impairs anything.
+func (c Config) Enabled() bool {
+	return c.Loss > 0 || c.DropEvery > 0 || c.Duplicate > 0 || c.Reorder > 0 || c.Latency > 0
+}
+
+// Stats counts what a wrapped connection did to its packets, or to the
+// segments of a Stream.
+type Stats struct {
+	Sent, Dropped, Duplicated, Reordered int
+}
+
+// Add returns the sum of s and t, e.g. for the connections of a transfer.
+func (s Stats) Add(t Stats) Stats {
+	return Stats{s.Sent + t.Sent, s.Dropped + t.Dropped, s.Duplicated + t.Duplicated, s.Reordered + t.Reordered}
+}
+
+// impairer decides the fate of each outgoing packet.
+type impairer struct {
+	cfg   Config
+	mu    sync.Mutex
+	rand  *rand.Rand
+	stats Stats
+	later *scheduler // Sends the delayed packets
+}
+
+func newImpairer(cfg Config) *impairer {
+	if cfg.Delay <= 0 {
+		cfg.Delay = 10 * time.Millisecond
+	}
+	return &impairer{cfg: cfg, rand: rand.New(rand.NewSource(cfg.Seed)), later: newScheduler()}
+}
+
+// send passes p to write zero, one or two times, now or after cfg.Latency,
+// plus cfg.Delay if held back. Delayed packets are copied since the caller
+// may reuse p, and their write errors are dropped along with them.
+func (im *impairer) send(p []byte, write func([]byte) error) error {
+	im.mu.Lock()
+	im.stats.Sent++
+	drop := im.rand.Float64() < im.cfg.Loss ||
+		im.cfg.DropEvery > 0 && im.stats.Sent%im.cfg.DropEvery == 0
+	dup := im.rand.Float64() < im.cfg.Duplicate
+	hold := im.rand.Float64() < im.cfg.Reorder
+	switch {
+	case drop:
+		im.stats.Dropped++
+	case hold:
+		im.stats.Reordered++
+	}
+	if dup && !drop {
+		im.stats.Duplicated++
+	}
+	im.mu.Unlock()
+
+	if drop {
+		return nil
+	}
+	copies := 1
+	if dup {
+		copies = 2
+	}
+	delay := im.cfg.Latency
+	if hold {
+		delay += im.cfg.Delay
+	}
+	if delay > 0 {
+		held := append([]byte(nil), p...)
+		due := time.Now().Add(delay)
+		for i := 0; i < copies; i++ {
+			im.later.add(due, func() { write(held) })
+		}
+		return nil
+	}
+	for i := 0; i < copies; i++ {
+		if err := write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *impairer) snapshot() Stats {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return im.stats
+}
+
+// PacketConn impairs the packets written to an unconnected socket.
+type PacketConn struct {
+	net.PacketConn
+	im *impairer
+}
+
+// WrapPacketConn returns pc with its outgoing packets impaired per cfg.
+func WrapPacketConn(pc net.PacketConn, cfg Config) *PacketConn {
+	return &PacketConn{PacketConn: pc, im: newImpairer(cfg)}
+}
+
+// WriteTo reports every packet as sent, even dropped or delayed ones.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	err := c.im.send(p, func(b []byte) error {
+		_, err := c.PacketConn.WriteTo(b, addr)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Stats returns what has been done to the packets so far.
+func (c *PacketConn) Stats() Stats {
+	return c.im.snapshot()
+}
+
+// Close closes the socket, dropping the packets still delayed.
+func (c *PacketConn) Close() error {
+	c.im.later.close()
+	return c.PacketConn.Close()
+}
+
+// Conn impairs the packets written to a connected datagram socket.
+type Conn struct {
+	net.Conn
+	im *impairer
+}
+
+// WrapConn returns conn with its outgoing packets impaired per cfg.
+func WrapConn(conn net.Conn, cfg Config) *Conn {
+	return &Conn{Conn: conn, im: newImpairer(cfg)}
+}
+
+// Write reports every packet as sent, even dropped or delayed ones.
+func (c *Conn) Write(p []byte) (int, error) {
+	err := c.im.send(p, func(b []byte) error {
+		_, err := c.Conn.Write(b)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Stats returns what has been done to the packets so far.
+func (c *Conn) Stats() Stats {
+	return c.im.snapshot()
+}
+
+// Close closes the socket, dropping the packets still delayed.
+func (c *Conn) Close() error {
+	c.im.later.close()
+	return c.Conn.Close()
+}
+
+// scheduler runs functions at the times they are due, in that order, and
+// those due together in the order they were added, from a goroutine it
+// starts with the first.
+type scheduler struct {
+	mu      sync.Mutex
+	queue   schedule
+	added   uint64
+	started bool
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{wake: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+func (s *scheduler) add(due time.Time, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.added++
+	heap.Push(&s.queue, task{due, s.added, fn})
+	if !s.started {
+		s.started = true
+		go s.run()
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the scheduler, dropping the functions not yet run.
+func (s *scheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+func (s *scheduler) run() {
+	for {
+		s.mu.Lock()
+		var wait time.Duration = -1
+		var next *task
+		if len(s.queue) > 0 {
+			if wait = time.Until(s.queue[0].due); wait <= 0 {
+				t := heap.Pop(&s.queue).(task)
+				next = &t
+			}
+		}
+		s.mu.Unlock()
+
+		if next != nil {
+			next.fn()
+			continue
+		}
+		var timer *time.Timer
+		var tick <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			tick = timer.C
+		}
+		select {
+		case <-tick:
+		case <-s.wake:
+		case <-s.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+type task struct {
+	due time.Time
+	seq uint64
+	fn  func()
+}
+
+// schedule is a heap of tasks, the first due on top.
+type schedule []task
+
+func (q schedule) Len() int { return len(q) }
+func (q schedule) Less(i, j int) bool {
+	if !q[i].due.Equal(q[j].due) {
+		return q[i].due.Before(q[j].due)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q schedule) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *schedule) Push(x any)   { *q = append(*q, x.(task)) }
+func (q *schedule) Pop() any {
+	old := *q
+	t := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,290 @@
+package netsim
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects the packets an impairer writes, by their number.
+type recorder struct {
+	mu   sync.Mutex
+	seqs []uint32
+	at   []time.Time
+}
+
+func (r *recorder) write(p []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seqs = append(r.seqs, binary.BigEndian.Uint32(p))
+	r.at = append(r.at, time.Now())
+	return nil
+}
+
+func (r *recorder) written() []uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]uint32(nil), r.seqs...)
+}
+
+// sendAll passes n numbered packets through im, returning what it wrote
+// once the delayed ones are due.
+func sendAll(t *testing.T, im *impairer, n int, wait time.Duration) []uint32 {
+	t.Helper()
+	var rec recorder
+	p := make([]byte, 4)
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint32(p, uint32(i))
+		if err := im.send(p, rec.write); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(wait)
+	im.later.close()
+	return rec.written()
+}
+
+// The same seed makes the same choices, another seed others.
+func TestDeterministic(t *testing.T) {
+	cfg := Config{Loss: 0.2, Duplicate: 0.1, Seed: 42}
+	a := sendAll(t, newImpairer(cfg), 1000, 0)
+	b := sendAll(t, newImpairer(cfg), 1000, 0)
+	if !reflect.DeepEqual(a, b) {
+		t.Error("same seed, different packets written")
+	}
+	cfg.Seed++
+	if c := sendAll(t, newImpairer(cfg), 1000, 0); reflect.DeepEqual(a, c) {
+		t.Error("another seed, the same packets written")
+	}
+}
+
+// Each impairment happens about as often as asked, and Stats counts it.
+func TestRates(t *testing.T) {
+	const n = 20000
+	tests := []struct {
+		name string
+		cfg  Config
+		want func(s Stats) int // The count to compare with the rate
+		rate float64
+	}{
+		{"loss", Config{Loss: 0.1}, func(s Stats) int { return s.Dropped }, 0.1},
+		{"duplicate", Config{Duplicate: 0.25}, func(s Stats) int { return s.Duplicated }, 0.25},
+		{"reorder", Config{Reorder: 0.05, Delay: time.Millisecond}, func(s Stats) int { return s.Reordered }, 0.05},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := newImpairer(tt.cfg)
+			written := sendAll(t, im, n, 50*time.Millisecond)
+			s := im.snapshot()
+			if s.Sent != n {
+				t.Errorf("Sent = %d, want %d", s.Sent, n)
+			}
+			got := float64(tt.want(s)) / n
+			if got < tt.rate*0.8 || got > tt.rate*1.2 {
+				t.Errorf("rate %.3f, want about %.3f", got, tt.rate)
+			}
+			if want := n - s.Dropped + s.Duplicated; len(written) != want {
+				t.Errorf("wrote %d packets, want %d", len(written), want)
+			}
+		})
+	}
+}
+
+func TestDropEvery(t *testing.T) {
+	written := sendAll(t, newImpairer(Config{DropEvery: 3}), 9, 0)
+	if want := []uint32{0, 1, 3, 4, 6, 7}; !reflect.DeepEqual(written, want) {
+		t.Errorf("wrote %v, want %v", written, want)
+	}
+}
+
+// Packets held back arrive after those sent after them; every packet
+// arrives.
+func TestReorder(t *testing.T) {
+	im := newImpairer(Config{Reorder: 0.2, Delay: 20 * time.Millisecond, Seed: 3})
+	written := sendAll(t, im, 200, 100*time.Millisecond)
+	if len(written) != 200 {
+		t.Fatalf("wrote %d packets, want 200", len(written))
+	}
+	if sort.SliceIsSorted(written, func(i, j int) bool { return written[i] < written[j] }) {
+		t.Error("packets written in order")
+	}
+	sorted := append([]uint32(nil), written...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, seq := range sorted {
+		if seq != uint32(i) {
+			t.Fatalf("packet %d missing", i)
+		}
+	}
+}
+
+// Latency delays every packet, keeping them in order.
+func TestLatency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	im := newImpairer(Config{Latency: latency})
+	var rec recorder
+	start := time.Now()
+	p := make([]byte, 4)
+	for i := 0; i < 20; i++ {
+		binary.BigEndian.PutUint32(p, uint32(i))
+		im.send(p, rec.write)
+	}
+	if len(rec.written()) != 0 {
+		t.Error("packets written before the latency")
+	}
+	time.Sleep(2 * latency)
+	im.later.close()
+	written := rec.written()
+	for i, seq := range written {
+		if seq != uint32(i) {
+			t.Fatalf("wrote %v, want them in order", written)
+		}
+	}
+	if len(written) != 20 {
+		t.Fatalf("wrote %d packets, want 20", len(written))
+	}
+	if first := rec.at[0].Sub(start); first < latency {
+		t.Errorf("first packet written after %v, want at least %v", first, latency)
+	}
+}
+
+// A PacketConn drops the packets still delayed when closed, and passes
+// the others to the socket.
+func TestPacketConn(t *testing.T) {
+	rx, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rx.Close()
+	tx, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := WrapPacketConn(tx, Config{})
+	if n, err := plain.WriteTo([]byte("now"), rx.LocalAddr()); n != 3 || err != nil {
+		t.Fatalf("WriteTo = %d, %v", n, err)
+	}
+	buf := make([]byte, 16)
+	rx.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := rx.ReadFrom(buf); err != nil || string(buf[:n]) != "now" {
+		t.Fatalf("received %q, %v", buf[:n], err)
+	}
+
+	delayed := WrapPacketConn(tx, Config{Latency: 200 * time.Millisecond})
+	delayed.WriteTo([]byte("later"), rx.LocalAddr())
+	delayed.Close()
+	rx.SetReadDeadline(time.Now().Add(400 * time.Millisecond))
+	if n, _, err := rx.ReadFrom(buf); err == nil {
+		t.Errorf("received %q sent after Close", buf[:n])
+	}
+}
+
+// streamPair returns a Stream wrapping one end of a TCP connection per cfg,
+// and the other end.
+func streamPair(t *testing.T, cfg Config) (*Stream, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	if peer == nil {
+		t.Fatal("accept failed")
+	}
+	s := WrapStream(conn, cfg)
+	t.Cleanup(func() {
+		s.Close()
+		peer.Close()
+	})
+	return s, peer
+}
+
+// Whatever is lost or reordered, a Stream delivers everything intact and
+// in order, as TCP would.
+func TestStreamIntact(t *testing.T) {
+	s, peer := streamPair(t, Config{Loss: 0.1, Duplicate: 0.1, Reorder: 0.1, Delay: time.Millisecond, Seed: 9})
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	received := make(chan []byte, 1)
+	go func() {
+		got, _ := io.ReadAll(peer)
+		received <- got
+	}()
+	for off := 0; off < len(data); off += 32 << 10 {
+		if _, err := s.Write(data[off : off+32<<10]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, not the %d written", len(got), len(data))
+	}
+	stats := s.Stats()
+	if want := len(data) / (32 << 10) * ((32<<10 + SEGMENT_SIZE - 1) / SEGMENT_SIZE); stats.Sent != want {
+		t.Errorf("Sent = %d segments, want %d", stats.Sent, want)
+	}
+	if stats.Dropped == 0 || stats.Duplicated == 0 || stats.Reordered == 0 {
+		t.Errorf("stats %+v, want some of each", stats)
+	}
+}
+
+// Each lost segment holds the stream up for a retransmission.
+func TestStreamStall(t *testing.T) {
+	s, peer := streamPair(t, Config{DropEvery: 1})
+	const segments = 20
+	start := time.Now()
+	if _, err := s.Write(make([]byte, segments*SEGMENT_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(peer, make([]byte, segments*SEGMENT_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	if took, want := time.Since(start), segments*MIN_RETRANSMIT; took < want {
+		t.Errorf("delivered after %v, want at least %v", took, want)
+	}
+}
+
+// A Stream holding a window's worth blocks further writes, until the write
+// deadline.
+func TestStreamWindow(t *testing.T) {
+	s, _ := streamPair(t, Config{Latency: 300 * time.Millisecond})
+	if _, err := s.Write(make([]byte, WINDOW)); err != nil {
+		t.Fatal(err)
+	}
+	s.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := s.Write([]byte("x")); err == nil {
+		t.Error("write past the window succeeded")
+	}
+}
+
+// Close delivers what is held before closing.
+func TestStreamCloseFlushes(t *testing.T) {
+	s, peer := streamPair(t, Config{Latency: 50 * time.Millisecond})
+	if _, err := s.Write([]byte("held back")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	got, _ := io.ReadAll(peer)
+	if string(got) != "held back" {
+		t.Errorf("received %q, want what was written before Close", got)
+	}
+}
@@ -0,0 +1,213 @@
+package netsim
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Bytes of a Stream each decision is taken for, a TCP segment on Ethernet
+const SEGMENT_SIZE = 1448
+
+// Least a lost segment holds a Stream up, the round trip of a
+// retransmission on a fast network
+const MIN_RETRANSMIT = 5 * time.Millisecond
+
+// Most bytes a Stream holds back before Write blocks, as TCP's window would
+const WINDOW = 4 << 20
+
+// Longest Close waits past the last write falling due for the Stream to
+// deliver it
+const FLUSH_GRACE = time.Second
+
+// Stream impairs a stream connection, such as TCP, as a network impaired
+// per Config would slow TCP down: what is written still arrives, intact
+// and in order, only later. Each write leaves Config.Latency after it is
+// made. It is cut into SEGMENT_SIZE segments; a lost one holds up the
+// stream, and everything written after it, for a retransmission, twice the
+// Latency but at least MIN_RETRANSMIT, and a reordered one for
+// Config.Delay, as TCP delivers nothing past a gap. Duplicates, which TCP
+// discards, are only counted. Reads are left alone.
+type Stream struct {
+	net.Conn
+	cfg   Config
+	rand  *rand.Rand
+	later *scheduler
+
+	mu       sync.Mutex
+	sent     *sync.Cond // Signalled as held bytes are written
+	stats    Stats
+	held     int       // Bytes written to the Stream but not yet to Conn
+	last     time.Time // When the last of them fall due
+	err      error     // Of writing them, returned by the next Write
+	deadline time.Time
+	closed   bool
+}
+
+// WrapStream returns conn with what is written to it impaired per cfg.
+func WrapStream(conn net.Conn, cfg Config) *Stream {
+	if cfg.Delay <= 0 {
+		cfg.Delay = 10 * time.Millisecond
+	}
+	s := &Stream{Conn: conn, cfg: cfg, rand: rand.New(rand.NewSource(cfg.Seed)), later: newScheduler()}
+	s.sent = sync.NewCond(&s.mu)
+	return s
+}
+
+// Write reports p as written once the Stream holds it, returning the error
+// of an earlier write that failed since.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+
+	// How long the segments lost or reordered hold the stream up
+	var stall time.Duration
+	retransmit := max(2*s.cfg.Latency, MIN_RETRANSMIT)
+	for off := 0; off < len(p); off += SEGMENT_SIZE {
+		s.stats.Sent++
+		seq := s.stats.Sent
+		switch {
+		case s.rand.Float64() < s.cfg.Loss || s.cfg.DropEvery > 0 && seq%s.cfg.DropEvery == 0:
+			s.stats.Dropped++
+			stall += retransmit
+		case s.rand.Float64() < s.cfg.Reorder:
+			s.stats.Reordered++
+			stall += s.cfg.Delay
+		}
+		if s.rand.Float64() < s.cfg.Duplicate {
+			s.stats.Duplicated++
+		}
+	}
+
+	for {
+		var err error
+		switch {
+		case s.closed:
+			err = net.ErrClosed
+		case s.err != nil:
+			err = s.err
+		case !s.deadline.IsZero() && !time.Now().Before(s.deadline):
+			err = os.ErrDeadlineExceeded
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+		if s.held == 0 || s.held+len(p) <= WINDOW {
+			break
+		}
+		s.wait()
+	}
+
+	now := time.Now()
+	due := now.Add(s.cfg.Latency)
+	if s.held > 0 && s.last.After(due) {
+		due = s.last
+	}
+	due = due.Add(stall)
+	if s.held == 0 && !due.After(now) {
+		// Nothing to wait for; a write that blocks mustn't hold up Close
+		s.mu.Unlock()
+		return s.Conn.Write(p)
+	}
+
+	data := append([]byte(nil), p...)
+	s.held += len(data)
+	s.last = due
+	s.later.add(due, func() {
+		_, err := s.Conn.Write(data)
+		s.mu.Lock()
+		s.held -= len(data)
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		s.sent.Broadcast()
+		s.mu.Unlock()
+	})
+	s.mu.Unlock()
+	return len(p), nil
+}
+
+// wait waits for held bytes to be written, or the write deadline. Must
+// hold s.mu.
+func (s *Stream) wait() {
+	if !s.deadline.IsZero() {
+		timer := time.AfterFunc(time.Until(s.deadline), func() {
+			s.mu.Lock()
+			s.sent.Broadcast()
+			s.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+	s.sent.Wait()
+}
+
+// flush waits for the held bytes to be written, for FLUSH_GRACE past when
+// the last of them fall due at most.
+func (s *Stream) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held == 0 {
+		return
+	}
+	limit := s.last.Add(FLUSH_GRACE)
+	timer := time.AfterFunc(time.Until(limit), func() {
+		s.mu.Lock()
+		s.sent.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+	for s.held > 0 && s.err == nil && time.Now().Before(limit) {
+		s.sent.Wait()
+	}
+}
+
+// CloseWrite delivers the held bytes, then shuts down the writing side of
+// a connection that can, such as a *net.TCPConn.
+func (s *Stream) CloseWrite() error {
+	s.flush()
+	if cw, ok := s.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("connection can't close its writing side only")
+}
+
+// Close delivers the held bytes, as the kernel delivers those of a closed
+// socket, then closes the connection.
+func (s *Stream) Close() error {
+	s.flush()
+	s.mu.Lock()
+	s.closed = true
+	s.sent.Broadcast()
+	s.mu.Unlock()
+	s.later.close()
+	return s.Conn.Close()
+}
+
+// SetDeadline sets the read and write deadlines, see net.Conn.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.setWriteDeadline(t)
+	return s.Conn.SetDeadline(t)
+}
+
+// SetWriteDeadline also bounds how long Write waits for room.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.setWriteDeadline(t)
+	return s.Conn.SetWriteDeadline(t)
+}
+
+func (s *Stream) setWriteDeadline(t time.Time) {
+	s.mu.Lock()
+	s.deadline = t
+	s.sent.Broadcast()
+	s.mu.Unlock()
+}
+
+// Stats returns what has been done to the segments so far.
+func (s *Stream) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
@@ -0,0 +1,192 @@
+// Package pathfilter picks the files a client sends out of a directory by
+// gitignore-style patterns, as send -archive, send -watch and sync take
+// them with -include, -exclude and -exclude-from.
+//
+// Patterns match slash-separated paths relative to the directory:
+//
+//   - A pattern with a slash at its start or in its middle is anchored to
+//     the directory, like "/build" or "docs/*.md"; one without matches at
+//     any depth, like "*.o" or "node_modules".
+//   - A pattern ending in a slash only matches directories, like "cache/".
+//   - "**" as a whole element matches any number of directories, as in
+//     "src/**/testdata" or "logs/**"; otherwise "*", "?" and "[...]" match
+//     within one element as path.Match has them, and "\" escapes.
+//   - A pattern that matches a directory matches everything under it.
+//
+// Names are compared ignoring case on Windows and macOS, whose file systems
+// usually do, and exactly elsewhere. Negated patterns, "!keep.o", are
+// refused; -include says what to send.
+package pathfilter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// FoldCase is whether the filters New returns ignore case
+var FoldCase = runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+
+// Filter decides which files under a directory are sent.
+type Filter struct {
+	include []pattern
+	exclude []pattern
+	fold    bool
+}
+
+// pattern is a parsed pattern.
+type pattern struct {
+	text    string   // As given
+	elems   []string // Split at slashes, "**" first unless anchored
+	dirOnly bool
+}
+
+// New returns a Filter that keeps the files matching one of the include
+// patterns, any if there are none, unless they match one of the exclude
+// ones. It returns nil, which keeps everything, if there are no patterns.
+func New(include, exclude []string) (*Filter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	f := &Filter{fold: FoldCase}
+	for _, s := range include {
+		p, err := parse(s, f.fold)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, p)
+	}
+	for _, s := range exclude {
+		p, err := parse(s, f.fold)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, p)
+	}
+	return f, nil
+}
+
+func parse(s string, fold bool) (pattern, error) {
+	p := pattern{text: s}
+	if strings.HasPrefix(s, "!") {
+		return p, fmt.Errorf("pattern %q: negated patterns aren't supported, use -include", s)
+	}
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly = true
+		s = strings.TrimSuffix(s, "/")
+	}
+	anchored := strings.Contains(s, "/")
+	s = strings.TrimPrefix(s, "/")
+	if s == "" {
+		return p, fmt.Errorf("pattern %q matches nothing", p.text)
+	}
+	if fold {
+		s = strings.ToLower(s)
+	}
+	p.elems = strings.Split(s, "/")
+	for _, e := range p.elems {
+		if e == "" {
+			return p, fmt.Errorf("pattern %q has an empty element", p.text)
+		}
+		if _, err := path.Match(e, ""); err != nil {
+			return p, fmt.Errorf("pattern %q: %w", p.text, err)
+		}
+	}
+	if !anchored {
+		p.elems = append([]string{"**"}, p.elems...)
+	}
+	return p, nil
+}
+
+// matches reports whether p matches the path split into elems, a
+// directory if dir.
+func (p *pattern) matches(elems []string, dir bool) bool {
+	if p.dirOnly && !dir {
+		return false
+	}
+	return matchElems(p.elems, elems)
+}
+
+func matchElems(pat, elems []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchElems(pat[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], elems[0]); !ok {
+			return false
+		}
+		pat, elems = pat[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// Keep reports whether to send the file at rel, a slash-separated path
+// relative to the directory, or to descend into it if dir. If not, reason
+// says why, like `excluded by "*.o"`. A directory that isn't included is
+// still kept, since files under it may be.
+func (f *Filter) Keep(rel string, dir bool) (keep bool, reason string) {
+	if f == nil {
+		return true, ""
+	}
+	if f.fold {
+		rel = strings.ToLower(rel)
+	}
+	elems := strings.Split(rel, "/")
+	// A pattern that matches a directory takes everything under it along
+	for i := 1; i <= len(elems); i++ {
+		isDir := dir || i < len(elems)
+		for _, p := range f.exclude {
+			if p.matches(elems[:i], isDir) {
+				return false, fmt.Sprintf("excluded by %q", p.text)
+			}
+		}
+	}
+	if len(f.include) == 0 || dir {
+		return true, ""
+	}
+	for i := 1; i <= len(elems); i++ {
+		isDir := i < len(elems)
+		for _, p := range f.include {
+			if p.matches(elems[:i], isDir) {
+				return true, ""
+			}
+		}
+	}
+	return false, "not included"
+}
+
+// ReadPatterns reads the patterns in the file at path, one per line as in
+// a .gitignore: blank lines and lines starting with "#" are skipped, as
+// are trailing spaces.
+func ReadPatterns(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,103 @@
+package pathfilter
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newFilter returns a Filter for the patterns that folds case if fold.
+func newFilter(t *testing.T, include, exclude []string, fold bool) *Filter {
+	t.Helper()
+	saved := FoldCase
+	FoldCase = fold
+	defer func() { FoldCase = saved }()
+	f, err := New(include, exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestKeep(t *testing.T) {
+	tests := []struct {
+		name             string
+		include, exclude []string
+		fold             bool
+		path             string
+		dir              bool
+		want             bool
+		reason           string
+	}{
+		{"no patterns", nil, nil, false, "a.o", false, true, ""},
+		{"unanchored at the root", nil, []string{"*.o"}, false, "a.o", false, false, `excluded by "*.o"`},
+		{"unanchored at any depth", nil, []string{"*.o"}, false, "src/lib/a.o", false, false, `excluded by "*.o"`},
+		{"unanchored no match", nil, []string{"*.o"}, false, "src/a.c", false, true, ""},
+		{"directory name anywhere", nil, []string{"node_modules"}, false, "web/node_modules/x/index.js", false, false, `excluded by "node_modules"`},
+		{"anchored at the root", nil, []string{"/build"}, false, "build/out", false, false, `excluded by "/build"`},
+		{"anchored not deeper", nil, []string{"/build"}, false, "src/build/out", false, true, ""},
+		{"middle slash anchors", nil, []string{"docs/*.md"}, false, "docs/a.md", false, false, `excluded by "docs/*.md"`},
+		{"middle slash not deeper", nil, []string{"docs/*.md"}, false, "x/docs/a.md", false, true, ""},
+		{"star stays in its element", nil, []string{"docs/*.md"}, false, "docs/sub/a.md", false, true, ""},
+		{"directory only matches a directory", nil, []string{"cache/"}, false, "cache", true, false, `excluded by "cache/"`},
+		{"directory only skips a file", nil, []string{"cache/"}, false, "cache", false, true, ""},
+		{"directory only takes what's under it", nil, []string{"cache/"}, false, "a/cache/f", false, false, `excluded by "cache/"`},
+		{"double star in the middle", nil, []string{"src/**/testdata"}, false, "src/a/b/testdata/f", false, false, `excluded by "src/**/testdata"`},
+		{"double star matching nothing", nil, []string{"src/**/testdata"}, false, "src/testdata", true, false, `excluded by "src/**/testdata"`},
+		{"trailing double star", nil, []string{"logs/**"}, false, "logs/2024/a.log", false, false, `excluded by "logs/**"`},
+		{"escaped star", nil, []string{`\*.txt`}, false, "a.txt", false, true, ""},
+		{"escaped star literal", nil, []string{`\*.txt`}, false, "*.txt", false, false, `excluded by "\\*.txt"`},
+		{"question mark", nil, []string{"?.c"}, false, "ab.c", false, true, ""},
+		{"character class", nil, []string{"[ab].c"}, false, "b.c", false, false, `excluded by "[ab].c"`},
+		{"included", []string{"*.go"}, nil, false, "cmd/main.go", false, true, ""},
+		{"not included", []string{"*.go"}, nil, false, "README.md", false, false, "not included"},
+		{"directories kept for their files", []string{"*.go"}, nil, false, "cmd", true, true, ""},
+		{"included directory takes its files", []string{"/src"}, nil, false, "src/a/b.txt", false, true, ""},
+		{"exclude wins", []string{"*.go"}, []string{"vendor/"}, false, "vendor/x.go", false, false, `excluded by "vendor/"`},
+		{"case matters", nil, []string{"*.O"}, false, "a.o", false, true, ""},
+		{"case folded", nil, []string{"*.O"}, true, "A.o", false, false, `excluded by "*.O"`},
+		{"case folded include", []string{"Docs/"}, nil, true, "docs/a", false, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFilter(t, tt.include, tt.exclude, tt.fold)
+			keep, reason := f.Keep(tt.path, tt.dir)
+			if keep != tt.want || reason != tt.reason {
+				t.Errorf("Keep(%q, %v) = %v, %q, want %v, %q", tt.path, tt.dir, keep, reason, tt.want, tt.reason)
+			}
+		})
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, pattern := range []string{"!keep.o", "/", "a//b", "[", "a/[b"} {
+		if _, err := New(nil, []string{pattern}); err == nil {
+			t.Errorf("pattern %q accepted", pattern)
+		}
+		if _, err := New([]string{pattern}, nil); err == nil {
+			t.Errorf("include pattern %q accepted", pattern)
+		}
+	}
+	if f, err := New(nil, nil); f != nil || err != nil {
+		t.Errorf("New without patterns = %v, %v, want nil", f, err)
+	}
+}
+
+func TestReadPatterns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exclude")
+	content := "# build output\n*.o\n\n/build/  \r\nnode_modules\n   \n#not a pattern\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadPatterns(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"*.o", "/build/", "node_modules"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := ReadPatterns(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing file read")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package ports
+
+import (
+	"errors"
+	"syscall"
+)
+
+// InUse reports whether err is the failure to listen on a port another
+// socket holds.
+func InUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package ports
+
+import "syscall"
+
+// The error listening on a port in use gives
+var errInUse error = syscall.EADDRINUSE
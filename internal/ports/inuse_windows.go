@@ -0,0 +1,13 @@
+package ports
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// InUse reports whether err is the failure to listen on a port another
+// socket holds.
+func InUse(err error) bool {
+	return errors.Is(err, windows.WSAEADDRINUSE)
+}
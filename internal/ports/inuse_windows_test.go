@@ -0,0 +1,6 @@
+package ports
+
+import "golang.org/x/sys/windows"
+
+// The error listening on a port in use gives
+var errInUse error = windows.WSAEADDRINUSE
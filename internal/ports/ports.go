@@ -0,0 +1,42 @@
+// Package ports moves a server that can't listen on its port because
+// another process holds it to one of the ports above, as serve
+// -port-retry does.
+package ports
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Listen calls listen with addr, then, while it fails because its port is
+// in use, with each of the retries ports above in turn, and returns what
+// the first call that succeeds returns. Port 0, which the system picks,
+// is never in use.
+func Listen[T any](addr string, retries int, listen func(addr string) (T, error)) (T, error) {
+	l, err := listen(addr)
+	if err == nil || retries <= 0 || !InUse(err) {
+		return l, err
+	}
+	host, portStr, splitErr := net.SplitHostPort(addr)
+	port, atoiErr := strconv.Atoi(portStr)
+	if splitErr != nil || atoiErr != nil || port == 0 {
+		return l, err
+	}
+	for i := 1; i <= retries && port+i <= 65535; i++ {
+		next := net.JoinHostPort(host, strconv.Itoa(port+i))
+		if l, err = listen(next); err == nil || !InUse(err) {
+			return l, err
+		}
+	}
+	return l, fmt.Errorf("ports %d to %d are in use: %w", port, min(port+retries, 65535), err)
+}
+
+// WithPort returns addr, a host:port, with port instead.
+func WithPort(addr, port string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,126 @@
+package ports
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// blocked returns a loopback TCP port held until the test ends, with want
+// free ports above it, and a function that holds the nth of those too.
+func blocked(t *testing.T, want int) (int, func(n int) net.Listener) {
+	t.Helper()
+	hold := func(port int) net.Listener {
+		ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			return nil
+		}
+		t.Cleanup(func() { ln.Close() })
+		return ln
+	}
+	// Look for a port with enough free ones above it
+	for tries := 0; tries < 20; tries++ {
+		ln := hold(0)
+		port := ln.Addr().(*net.TCPAddr).Port
+		free := true
+		for i := 1; i <= want && free; i++ {
+			probe := hold(port + i)
+			free = probe != nil
+			if probe != nil {
+				probe.Close()
+			}
+		}
+		if free {
+			return port, func(n int) net.Listener { return hold(port + n) }
+		}
+		ln.Close()
+	}
+	t.Fatal("no run of free ports")
+	return 0, nil
+}
+
+func listenTCP(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// A port in use moves the listener to the next free one above it.
+func TestListenRetry(t *testing.T) {
+	port, hold := blocked(t, 3)
+	hold(1) // So the retry has to skip one
+	ln, err := Listen(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 3, listenTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if got := ln.Addr().(*net.TCPAddr).Port; got != port+2 {
+		t.Errorf("listening on port %d, want %d", got, port+2)
+	}
+}
+
+// Once the retries run out the error names the ports tried.
+func TestListenRetriesExhausted(t *testing.T) {
+	port, hold := blocked(t, 2)
+	hold(1)
+	hold(2)
+	_, err := Listen(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 2, listenTCP)
+	if err == nil || !InUse(err) {
+		t.Fatalf("got %v, want the ports in use", err)
+	}
+	if want := strconv.Itoa(port) + " to " + strconv.Itoa(port+2); !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q doesn't name ports %s", err, want)
+	}
+}
+
+// Without retries, on other errors and for port 0, listen is called once.
+func TestListenNoRetry(t *testing.T) {
+	port, _ := blocked(t, 0)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	other := errors.New("permission denied")
+	tests := []struct {
+		name    string
+		addr    string
+		retries int
+		err     error
+	}{
+		{"no retries", addr, 0, nil},
+		{"other error", addr, 3, other},
+		{"port 0", "127.0.0.1:0", 3, nil},
+		{"no port", "127.0.0.1", 3, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			_, err := Listen(tt.addr, tt.retries, func(addr string) (net.Listener, error) {
+				calls++
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				return nil, &net.OpError{Op: "listen", Err: errInUse}
+			})
+			if calls != 1 || err == nil {
+				t.Errorf("%d calls, got %v, want one call and its error", calls, err)
+			}
+		})
+	}
+}
+
+func TestWithPort(t *testing.T) {
+	tests := []struct {
+		addr, port, want string
+	}{
+		{":8080", "9000", ":9000"},
+		{"127.0.0.1:8080", "0", "127.0.0.1:0"},
+		{"[::1]:8080", "9000", "[::1]:9000"},
+	}
+	for _, tt := range tests {
+		got, err := WithPort(tt.addr, tt.port)
+		if err != nil || got != tt.want {
+			t.Errorf("WithPort(%q, %q) = %q, %v, want %q", tt.addr, tt.port, got, err, tt.want)
+		}
+	}
+	if _, err := WithPort("no port", "1"); err == nil {
+		t.Error("address without a port accepted")
+	}
+}
@@ -0,0 +1,47 @@
+// Package prealloc reserves disk space for a file before it is written, so
+// a large upload neither fragments the file nor runs out of space halfway.
+package prealloc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// Free, unless a test fakes the filesystem's free space
+var freeSpace = Free
+
+// Allocate grows f to size bytes, reserving its blocks up front where the
+// platform supports it. A full disk is reported as wire.ErrNoSpace.
+func Allocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	return NoSpace(allocate(f, size))
+}
+
+// Check fails with wire.ErrNoSpace if storing size more bytes in dir would
+// leave less than reserve bytes free on its filesystem. Where the free
+// space can't be found out nothing is refused.
+func Check(dir string, size, reserve int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return nil
+	}
+	if need := uint64(size) + uint64(max(reserve, 0)); need > free {
+		return fmt.Errorf("%w: %s needed, %s free with %s kept in reserve", wire.ErrNoSpace,
+			wire.FormatBytes(size), wire.FormatBytes(int64(min(free, 1<<62))), wire.FormatBytes(max(reserve, 0)))
+	}
+	return nil
+}
+
+// NoSpace marks err with wire.ErrNoSpace if a full disk caused it, so a
+// write that fails halfway reports the same failure as Check.
+func NoSpace(err error) error {
+	if err != nil && isNoSpace(err) && !errors.Is(err, wire.ErrNoSpace) {
+		return fmt.Errorf("%w: %w", wire.ErrNoSpace, err)
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package prealloc
+
+import "os"
+
+func allocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
@@ -0,0 +1,103 @@
+package prealloc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// fakeFree makes Check see free bytes, or err, until the test ends.
+func fakeFree(t *testing.T, free uint64, err error) {
+	old := freeSpace
+	freeSpace = func(string) (uint64, error) { return free, err }
+	t.Cleanup(func() { freeSpace = old })
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name          string
+		free          uint64
+		size, reserve int64
+		full          bool
+	}{
+		{"fits", 1000, 500, 0, false},
+		{"exactly", 1000, 1000, 0, false},
+		{"one over", 1000, 1001, 0, true},
+		{"reserve fits", 1000, 500, 500, false},
+		{"reserve over", 1000, 500, 501, true},
+		{"negative reserve", 1000, 1000, -5, false},
+		{"disk full", 0, 1, 0, true},
+		{"empty file on a full disk", 0, 0, 0, false},
+		{"huge free", 1 << 63, 1 << 62, 1 << 62, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeFree(t, tt.free, nil)
+			err := Check("dir", tt.size, tt.reserve)
+			if full := errors.Is(err, wire.ErrNoSpace); full != tt.full || !full && err != nil {
+				t.Errorf("got %v, want refused %v", err, tt.full)
+			}
+		})
+	}
+}
+
+// Where the free space can't be found out nothing is refused.
+func TestCheckUnknown(t *testing.T) {
+	fakeFree(t, 0, errors.ErrUnsupported)
+	if err := Check("dir", 1<<40, 1<<40); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
+
+func TestCheckRealFilesystem(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Free(dir); err != nil {
+		t.Skipf("free space unknown here: %v", err)
+	}
+	if err := Check(dir, 1, 0); err != nil {
+		t.Errorf("one byte refused: %v", err)
+	}
+	if err := Check(dir, 1, 1<<62); !errors.Is(err, wire.ErrNoSpace) {
+		t.Errorf("reserve of 4EiB: got %v, want ErrNoSpace", err)
+	}
+}
+
+func TestNoSpace(t *testing.T) {
+	enospc := fmt.Errorf("error writing to file: %w", &os.PathError{Op: "write", Path: "f", Err: syscall.ENOSPC})
+	if err := NoSpace(enospc); !errors.Is(err, wire.ErrNoSpace) || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("ENOSPC became %v, want ErrNoSpace wrapping it", err)
+	}
+	marked := NoSpace(enospc)
+	if err := NoSpace(marked); err != marked {
+		t.Errorf("marked twice: %v", err)
+	}
+	other := errors.New("disk on fire")
+	if err := NoSpace(other); err != other {
+		t.Errorf("other error became %v", err)
+	}
+	if err := NoSpace(nil); err != nil {
+		t.Errorf("nil became %v", err)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := Allocate(f, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := Allocate(f, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := f.Stat(); info.Size() != 1<<20 {
+		t.Errorf("allocated %d bytes, want %d", info.Size(), 1<<20)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !windows
+
+package prealloc
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Free is not implemented here; Check then refuses nothing.
+func Free(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
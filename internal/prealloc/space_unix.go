@@ -0,0 +1,22 @@
+//go:build linux || darwin
+
+package prealloc
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Free returns the bytes available to unprivileged users on the
+// filesystem holding dir.
+func Free(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,33 @@
+package prealloc
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+const (
+	ERROR_HANDLE_DISK_FULL syscall.Errno = 39
+	ERROR_DISK_FULL        syscall.Errno = 112
+)
+
+// Free returns the bytes available to the calling user on the volume
+// holding dir.
+func Free(dir string) (uint64, error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var avail uint64
+	ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&avail)), 0, 0)
+	if ok == 0 {
+		return 0, err
+	}
+	return avail, nil
+}
+
+func isNoSpace(err error) bool {
+	return errors.Is(err, ERROR_DISK_FULL) || errors.Is(err, ERROR_HANDLE_DISK_FULL)
+}
@@ -0,0 +1,344 @@
+// Package punch connects two peers behind NAT for a UDP transfer. Both
+// register the same code with a Relay, which tells each the public address
+// it sees the other at. The peers then probe each other at those
+// addresses, which opens the mappings in their NATs, and talk directly.
+// If no probe gets through in time, the relay forwards their packets
+// instead.
+//
+// Packets of the rendezvous start with MAGIC and a kind:
+//
+//	REGISTER   peer → relay  code
+//	PEER       relay → peer  the other peer's address, as text
+//	PROBE      peer → peer   code
+//	PROBE_ACK  peer → peer   code
+//	RELAY      peer ↔ relay  a packet for the other peer
+//	BYE        peer → peer   code, directly or relayed
+//
+// Once connected, the transfer's own packets go between the peers as they
+// are, or inside RELAY packets through the relay.
+package punch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+const (
+	MAGIC = "\xC7SFP"
+
+	KIND_REGISTER  = 1
+	KIND_PEER      = 2
+	KIND_PROBE     = 3
+	KIND_PROBE_ACK = 4
+	KIND_RELAY     = 5
+	KIND_BYE       = 6
+
+	HEADER_LEN   = len(MAGIC) + 1
+	MAX_CODE_LEN = 64
+
+	// How often a peer registers until the relay pairs it
+	REGISTER_EVERY = 500 * time.Millisecond
+
+	// How often a peer probes the other while punching
+	PROBE_EVERY = 100 * time.Millisecond
+
+	// How long peers try to reach each other before relaying by default
+	DefaultTimeout = 5 * time.Second
+)
+
+func header(kind byte) []byte {
+	return append([]byte(MAGIC), kind)
+}
+
+func packet(kind byte, body []byte) []byte {
+	return append(header(kind), body...)
+}
+
+// parse returns the kind and body of a rendezvous packet, reporting false
+// for anything else, such as the transfer's own packets.
+func parse(b []byte) (kind byte, body []byte, ok bool) {
+	if len(b) < HEADER_LEN || !bytes.HasPrefix(b, []byte(MAGIC)) {
+		return 0, nil, false
+	}
+	return b[len(MAGIC)], b[HEADER_LEN:], true
+}
+
+// CheckCode reports whether code can pair peers.
+func CheckCode(code string) error {
+	if code == "" || len(code) > MAX_CODE_LEN {
+		return fmt.Errorf("%w: peer code must be 1 to %d bytes", wire.ErrInvalidName, MAX_CODE_LEN)
+	}
+	return nil
+}
+
+// Options tunes Connect. The zero value uses the defaults.
+type Options struct {
+	Timeout time.Duration // How long to try reaching the peer directly, DefaultTimeout if 0
+	Logger  *slog.Logger  // wire.DefaultLogger if nil
+}
+
+func (o *Options) logger() *slog.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return wire.DefaultLogger
+}
+
+// Conn is the path to the peer, direct or through the relay. It is both a
+// net.Conn and a net.PacketConn whose only remote is the peer, so a
+// udpft.Client can dial it and a udpft.Server serve it. Closing it tells
+// the peer, whose reads then fail with net.ErrClosed.
+type Conn struct {
+	conn    *net.UDPConn
+	relay   *net.UDPAddr
+	peer    *net.UDPAddr
+	code    []byte
+	relayed bool
+	pending []byte // A packet of the transfer that arrived while punching
+	buffer  []byte // Reads land here first, as relayed packets are framed
+
+	bye       atomic.Bool // The peer hung up
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Connect registers code with the relay at relay, waits for the peer that
+// registers the same code and returns the path to it: direct if probing
+// opens one within opts.Timeout, through the relay otherwise. Waiting for
+// the peer only ends with ctx.
+func Connect(ctx context.Context, relay, code string, opts Options) (*Conn, error) {
+	if err := CheckCode(code); err != nil {
+		return nil, err
+	}
+	relayAddr, err := net.ResolveUDPAddr("udp4", relay)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("error creating UDP socket: %w", err)
+	}
+	// Unblock pending reads once ctx ends
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	log := opts.logger().With("relay", relay)
+	c := &Conn{conn: conn, relay: relayAddr, code: []byte(code), buffer: make([]byte, 64<<10)}
+	if c.peer, err = c.register(ctx, log); err != nil {
+		conn.Close()
+		return nil, wire.ContextError(ctx, err)
+	}
+	log = log.With("peer", c.peer.String())
+	log.Info("Peer found, punching through NAT")
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	direct, err := c.punch(ctx, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, wire.ContextError(ctx, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if direct {
+		log.Info("Connected to peer directly")
+	} else {
+		c.relayed = true
+		log.Warn("Couldn't reach peer directly, relaying", "after", timeout)
+	}
+	return c, nil
+}
+
+// register announces the code to the relay until it sends the peer's
+// address.
+func (c *Conn) register(ctx context.Context, log *slog.Logger) (*net.UDPAddr, error) {
+	log.Info("Waiting for peer")
+	buffer := make([]byte, 512)
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if _, err := c.conn.WriteToUDP(packet(KIND_REGISTER, c.code), c.relay); err != nil {
+			return nil, fmt.Errorf("error reaching relay: %w", err)
+		}
+		c.conn.SetReadDeadline(time.Now().Add(REGISTER_EVERY))
+		for {
+			n, from, err := c.conn.ReadFromUDP(buffer)
+			if err != nil {
+				if isTimeout(err) {
+					break
+				}
+				return nil, fmt.Errorf("error reaching relay: %w", err)
+			}
+			kind, body, ok := parse(buffer[:n])
+			if !ok || kind != KIND_PEER || !sameAddr(from, c.relay) {
+				continue
+			}
+			peer, err := net.ResolveUDPAddr("udp4", string(body))
+			if err != nil {
+				return nil, fmt.Errorf("%w: relay sent peer address %q", wire.ErrProtocol, body)
+			}
+			return peer, nil
+		}
+	}
+}
+
+// punch probes the peer until one of its answers arrives, reporting true,
+// or timeout passes or the peer starts relaying, reporting false.
+func (c *Conn) punch(ctx context.Context, timeout time.Duration) (bool, error) {
+	probe := packet(KIND_PROBE, c.code)
+	buffer := c.buffer
+	end := time.Now().Add(timeout)
+	for time.Now().Before(end) {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		c.conn.WriteToUDP(probe, c.peer)
+		c.conn.SetReadDeadline(time.Now().Add(min(PROBE_EVERY, time.Until(end))))
+		for {
+			n, from, err := c.conn.ReadFromUDP(buffer)
+			if err != nil {
+				if isTimeout(err) {
+					break
+				}
+				return false, err
+			}
+			p := buffer[:n]
+			relayed := false
+			if sameAddr(from, c.relay) {
+				kind, body, ok := parse(p)
+				if !ok || kind != KIND_RELAY {
+					continue
+				}
+				p, relayed = body, true
+			} else if !sameAddr(from, c.peer) {
+				continue
+			}
+
+			kind, body, ok := parse(p)
+			switch {
+			case !ok:
+				// The peer already started the transfer, so it heard us;
+				// keep what it sent for the first read
+				c.pending = append([]byte(nil), p...)
+				return !relayed, nil
+			case !bytes.Equal(body, c.code):
+			case kind == KIND_PROBE && !relayed:
+				c.conn.WriteToUDP(packet(KIND_PROBE_ACK, c.code), c.peer)
+			case kind == KIND_PROBE_ACK && !relayed:
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Relayed reports whether packets go through the relay.
+func (c *Conn) Relayed() bool { return c.relayed }
+
+// ReadFrom reads the next packet of the transfer from the peer, answering
+// its probes on the way. Reads must not be concurrent.
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.pending != nil {
+		n := copy(b, c.pending)
+		c.pending = nil
+		return n, c.peer, nil
+	}
+	for {
+		if c.bye.Load() {
+			return 0, nil, net.ErrClosed
+		}
+		n, from, err := c.conn.ReadFromUDP(c.buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+		p := c.buffer[:n]
+		relayed := false
+		if sameAddr(from, c.relay) {
+			kind, body, ok := parse(p)
+			if !ok || kind != KIND_RELAY {
+				continue
+			}
+			p, relayed = body, true
+		} else if !sameAddr(from, c.peer) {
+			continue
+		}
+
+		kind, body, ok := parse(p)
+		if !ok {
+			return copy(b, p), c.peer, nil
+		}
+		if !bytes.Equal(body, c.code) {
+			continue
+		}
+		switch {
+		case kind == KIND_PROBE && !relayed:
+			// The peer is still punching
+			c.conn.WriteToUDP(packet(KIND_PROBE_ACK, c.code), c.peer)
+		case kind == KIND_BYE:
+			c.bye.Store(true)
+		}
+	}
+}
+
+// WriteTo sends b to the peer, whatever addr is.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// Read reads the next packet of the transfer from the peer.
+func (c *Conn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// Write sends b to the peer.
+func (c *Conn) Write(b []byte) (int, error) {
+	if !c.relayed {
+		return c.conn.WriteToUDP(b, c.peer)
+	}
+	if _, err := c.conn.WriteToUDP(packet(KIND_RELAY, b), c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close tells the peer the transfer is over and closes the socket.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		if !c.bye.Load() {
+			bye := packet(KIND_BYE, c.code)
+			for i := 0; i < 3; i++ {
+				c.Write(bye)
+			}
+		}
+		c.closeErr = c.conn.Close()
+	})
+	return c.closeErr
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.peer }
+
+func (c *Conn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
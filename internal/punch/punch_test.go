@@ -0,0 +1,208 @@
+package punch
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"socket-file-transfer/udpft"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// natConn stands in for NATs that map each peer to another port than the
+// relay sees, as symmetric NATs do: the peer addresses the relay hands out
+// point at a socket that drops everything, so probes never get through.
+type natConn struct {
+	net.PacketConn
+	hole string
+}
+
+func (c *natConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if kind, _, ok := parse(b); ok && kind == KIND_PEER {
+		b = packet(KIND_PEER, []byte(c.hole))
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// relay runs a Relay on a loopback port until the test ends and returns
+// its address. Behind NAT, it hands out peer addresses nothing answers
+// on.
+func relay(t *testing.T, behindNAT bool) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pc net.PacketConn = conn
+	if behindNAT {
+		hole, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { hole.Close() })
+		pc = &natConn{PacketConn: conn, hole: hole.LocalAddr().String()}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		(&Relay{Logger: quiet}).Serve(ctx, pc)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return conn.LocalAddr().String()
+}
+
+// pair connects two peers with code through the relay at addr.
+func pair(t *testing.T, addr, code string) (a, b *Conn) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := Options{Timeout: 500 * time.Millisecond, Logger: quiet}
+
+	type result struct {
+		c   *Conn
+		err error
+	}
+	other := make(chan result)
+	go func() {
+		c, err := Connect(ctx, addr, code, opts)
+		other <- result{c, err}
+	}()
+	a, err := Connect(ctx, addr, code, opts)
+	r := <-other
+	if err != nil || r.err != nil {
+		t.Fatalf("Connect: %v, %v", err, r.err)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		r.c.Close()
+	})
+	return a, r.c
+}
+
+func TestConnect(t *testing.T) {
+	for _, behindNAT := range []bool{false, true} {
+		name := "direct"
+		if behindNAT {
+			name = "relayed"
+		}
+		t.Run(name, func(t *testing.T) {
+			a, b := pair(t, relay(t, behindNAT), "swordfish")
+			if a.Relayed() != behindNAT || b.Relayed() != behindNAT {
+				t.Fatalf("relayed %v and %v, want %v", a.Relayed(), b.Relayed(), behindNAT)
+			}
+
+			if _, err := a.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 64)
+			b.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := b.Read(buf)
+			if err != nil || string(buf[:n]) != "hello" {
+				t.Fatalf("read %q, %v", buf[:n], err)
+			}
+
+			// Hanging up ends the other side's reads
+			a.Close()
+			if _, err := b.Read(buf); !errors.Is(err, net.ErrClosed) {
+				t.Errorf("read after the peer hung up: %v, want net.ErrClosed", err)
+			}
+		})
+	}
+}
+
+// A file goes through a punched or relayed path with the usual UDP
+// protocol, as transfer punch sends it.
+func TestTransfer(t *testing.T) {
+	for _, behindNAT := range []bool{false, true} {
+		name := "direct"
+		if behindNAT {
+			name = "relayed"
+		}
+		t.Run(name, func(t *testing.T) {
+			sender, receiver := pair(t, relay(t, behindNAT), "transfer-"+name)
+
+			dir := t.TempDir()
+			server := &udpft.Server{UploadDir: dir}
+			server.Logger = quiet
+			server.Progress = func(udpft.Event) {}
+			served := make(chan error, 1)
+			go func() { served <- server.Serve(context.Background(), receiver) }()
+
+			data := make([]byte, 200<<10)
+			rand.Read(data)
+			path := filepath.Join(t.TempDir(), "f.bin")
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			client := udpft.Client{Dial: func(context.Context, string, string) (net.Conn, error) { return sender, nil }}
+			if _, err := client.SendFile(context.Background(), sender.RemoteAddr().String(), path, udpft.Options{Logger: quiet, Progress: func(udpft.Event) {}}); err != nil {
+				t.Fatalf("SendFile: %v", err)
+			}
+
+			select {
+			case <-served:
+			case <-time.After(5 * time.Second):
+				t.Fatal("receiver still serving after the sender hung up")
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "f.bin"))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("stored %d bytes (%v), want the %d sent", len(got), err, len(data))
+			}
+		})
+	}
+}
+
+// The relay forwards only between the two addresses it paired.
+func TestRelayForwardsPairsOnly(t *testing.T) {
+	addr := relay(t, true)
+	a, b := pair(t, addr, "pair")
+
+	stranger, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	to, _ := net.ResolveUDPAddr("udp4", addr)
+	stranger.WriteTo(packet(KIND_RELAY, []byte("injected")), to)
+	stranger.WriteTo(packet(KIND_REGISTER, []byte("pair")), to)
+
+	a.Write([]byte("real"))
+	buf := make([]byte, 64)
+	b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := b.Read(buf)
+	if err != nil || string(buf[:n]) != "real" {
+		t.Fatalf("read %q, %v, want the peer's packet", buf[:n], err)
+	}
+}
+
+func TestConnectCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := Connect(ctx, relay(t, false), "alone", Options{Logger: quiet}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestCheckCode(t *testing.T) {
+	for _, code := range []string{"", string(make([]byte, MAX_CODE_LEN+1))} {
+		if CheckCode(code) == nil {
+			t.Errorf("%d byte code accepted", len(code))
+		}
+	}
+	if err := CheckCode("ok"); err != nil {
+		t.Error(err)
+	}
+}
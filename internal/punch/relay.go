@@ -0,0 +1,138 @@
+package punch
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// Pairs and registrations idle this long are forgotten
+const PAIR_TTL = 10 * time.Minute
+
+// Relay pairs the peers that register the same code, telling each where
+// the other is, and forwards the packets of pairs that couldn't reach each
+// other directly. It stores nothing and only forwards between the two
+// addresses it paired, so codes should be hard to guess.
+type Relay struct {
+	Addr   string       // Listen address, wire.RELAY_PORT if empty
+	Logger *slog.Logger // wire.DefaultLogger if nil
+}
+
+func (r *Relay) logger() *slog.Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return wire.DefaultLogger
+}
+
+// ListenAndServe listens on r.Addr and relays until ctx ends.
+func (r *Relay) ListenAndServe(ctx context.Context) error {
+	addr := r.Addr
+	if addr == "" {
+		addr = wire.RELAY_PORT
+	}
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("error starting relay: %w", err)
+	}
+	return r.Serve(ctx, conn)
+}
+
+// registration is a peer waiting for the other of its code.
+type registration struct {
+	addr net.Addr
+	seen time.Time
+}
+
+// pairing is one side of a pair, keyed by its address.
+type pairing struct {
+	code string
+	peer net.Addr
+	seen time.Time
+}
+
+// Serve pairs and relays the peers talking to conn until ctx ends. The
+// connection is closed on return.
+func (r *Relay) Serve(ctx context.Context, conn net.PacketConn) error {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	log := r.logger()
+	log.Info("Relay listening", "addr", conn.LocalAddr())
+
+	waiting := make(map[string]*registration) // By code
+	pairs := make(map[string]*pairing)        // By address
+	lastSweep := time.Now()
+
+	buffer := make([]byte, 64<<10)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		now := time.Now()
+		if now.Sub(lastSweep) > time.Minute {
+			lastSweep = now
+			for code, w := range waiting {
+				if now.Sub(w.seen) > PAIR_TTL {
+					delete(waiting, code)
+				}
+			}
+			for key, p := range pairs {
+				if now.Sub(p.seen) > PAIR_TTL {
+					delete(pairs, key)
+				}
+			}
+		}
+
+		kind, body, ok := parse(buffer[:n])
+		if !ok {
+			continue
+		}
+		key := addr.String()
+		switch kind {
+		case KIND_REGISTER:
+			code := string(body)
+			if CheckCode(code) != nil {
+				continue
+			}
+			if p := pairs[key]; p != nil && p.code == code {
+				// Our answer was lost
+				p.seen = now
+				conn.WriteTo(packet(KIND_PEER, []byte(p.peer.String())), addr)
+				continue
+			}
+			w := waiting[code]
+			if w == nil || w.addr.String() == key {
+				waiting[code] = &registration{addr: addr, seen: now}
+				log.Debug("Peer waiting", "remote", key)
+				continue
+			}
+			delete(waiting, code)
+			pairs[key] = &pairing{code: code, peer: w.addr, seen: now}
+			pairs[w.addr.String()] = &pairing{code: code, peer: addr, seen: now}
+			log.Info("Paired peers", "a", w.addr.String(), "b", key)
+			conn.WriteTo(packet(KIND_PEER, []byte(w.addr.String())), addr)
+			conn.WriteTo(packet(KIND_PEER, []byte(key)), w.addr)
+		case KIND_RELAY:
+			p := pairs[key]
+			if p == nil {
+				continue
+			}
+			other := pairs[p.peer.String()]
+			if other == nil || other.peer.String() != key {
+				continue
+			}
+			p.seen, other.seen = now, now
+			conn.WriteTo(buffer[:n], p.peer)
+		}
+	}
+}
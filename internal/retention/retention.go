@@ -0,0 +1,228 @@
+// Package retention removes stored files a server no longer needs to keep:
+// files older than a maximum age, and the oldest files while the upload
+// directory holds more than a byte budget.
+//
+// Only regular files are removed. Symbolic links are neither followed nor
+// removed, so nothing outside the upload directory is touched, and names
+// starting with a dot (checksum sidecars, files being received, the
+// quarantine) are left alone; a removed file's checksum sidecar goes with
+// it. Directories are kept even once empty, since a transfer may be about
+// to store a file in them. With an internal/index.Index of the directory,
+// the files are taken from it rather than walked, and removed from it.
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/index"
+	"socket-file-transfer/internal/wire"
+)
+
+// How often a Pruner enforces its policy besides after each transfer
+const INTERVAL = time.Hour
+
+// Policy says which stored files to keep. Zero fields don't limit.
+type Policy struct {
+	MaxAge   time.Duration
+	MaxBytes int64
+	DryRun   bool // Only log what would be removed
+}
+
+// Enabled reports whether p limits anything.
+func (p Policy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxBytes > 0
+}
+
+type file struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Enforce removes the files under root that p doesn't keep, logging each.
+// ix, if not nil, is the index of root.
+func Enforce(root string, p Policy, ix *index.Index, log *slog.Logger) error {
+	if !p.Enabled() {
+		return nil
+	}
+	var files []file
+	if ix != nil {
+		if err := ix.Check(); err != nil {
+			log.Warn("Error checking uploads index", "err", err)
+		}
+		// Nothing to do under the byte budget alone
+		if p.MaxAge == 0 && ix.TotalBytes() <= p.MaxBytes {
+			return nil
+		}
+		for _, f := range ix.Files() {
+			files = append(files, file{filepath.Join(root, filepath.FromSlash(f.Name)), f.Size, f.ModTime})
+		}
+	} else {
+		var err error
+		if files, err = walk(root); err != nil {
+			return err
+		}
+	}
+
+	// Oldest first, so the byte budget evicts them first
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	now := time.Now()
+	var errs []error
+	for _, f := range files {
+		var rule string
+		switch {
+		case p.MaxAge > 0 && now.Sub(f.modTime) > p.MaxAge:
+			rule = "age"
+		case p.MaxBytes > 0 && total > p.MaxBytes:
+			rule = "size"
+		default:
+			continue
+		}
+		total -= f.size
+
+		if p.DryRun {
+			log.Info("Would remove file", "path", f.path, "size", f.size, "reason", "retention", "rule", rule)
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			// Another server sharing the directory may have removed it
+			if !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		os.Remove(hashcache.SidecarPath(f.path))
+		os.Remove(wire.MarkerPath(f.path))
+		if ix != nil {
+			if rel, err := filepath.Rel(root, f.path); err == nil {
+				ix.Remove(filepath.ToSlash(rel))
+			}
+		}
+		log.Info("Removed file", "path", f.path, "size", f.size, "reason", "retention", "rule", rule)
+	}
+	return errors.Join(errs...)
+}
+
+// walk lists the regular files under root, descending into directories
+// but not into symbolic links.
+func walk(root string) ([]file, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", root, err)
+	}
+	var files []file
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(root, e.Name())
+		switch {
+		case e.IsDir():
+			sub, err := walk(path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+		case e.Type().IsRegular():
+			info, err := e.Info()
+			if err != nil {
+				continue // Removed since ReadDir
+			}
+			files = append(files, file{path, info.Size(), info.ModTime()})
+		}
+	}
+	return files, nil
+}
+
+// Pruner enforces a Policy on a directory in the background: at once,
+// every INTERVAL and whenever Stored or Sweep is called.
+type Pruner struct {
+	kick  chan struct{}
+	sweep chan chan error
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Start returns a running Pruner, or nil if p doesn't limit anything. ix,
+// if not nil, is the index of root.
+func Start(root string, p Policy, ix *index.Index, log *slog.Logger) *Pruner {
+	if !p.Enabled() {
+		return nil
+	}
+	pr := &Pruner{kick: make(chan struct{}, 1), sweep: make(chan chan error), done: make(chan struct{})}
+	pr.wg.Add(1)
+	go func() {
+		defer pr.wg.Done()
+		ticker := time.NewTicker(INTERVAL)
+		defer ticker.Stop()
+		var swept chan error // Waiting for the pass, see Sweep
+		for {
+			err := Enforce(root, p, ix, log)
+			if err != nil {
+				log.Error("Error enforcing retention", "err", err)
+			}
+			if swept != nil {
+				swept <- err
+				swept = nil
+			}
+			select {
+			case <-ticker.C:
+			case <-pr.kick:
+			case swept = <-pr.sweep:
+			case <-pr.done:
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// Stored tells the Pruner a file was stored, which may exceed the byte
+// budget. A nil Pruner does nothing.
+func (pr *Pruner) Stored() {
+	if pr == nil {
+		return
+	}
+	select {
+	case pr.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Sweep enforces the policy now, returning once the pass is over with
+// its error. A nil or closed Pruner does nothing.
+func (pr *Pruner) Sweep() error {
+	if pr == nil {
+		return nil
+	}
+	swept := make(chan error, 1)
+	select {
+	case pr.sweep <- swept:
+		return <-swept
+	case <-pr.done:
+		return nil
+	}
+}
+
+// Close stops the Pruner and waits for a pass under way to finish.
+func (pr *Pruner) Close() {
+	if pr == nil {
+		return
+	}
+	close(pr.done)
+	pr.wg.Wait()
+}
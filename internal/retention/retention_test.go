@@ -0,0 +1,194 @@
+package retention
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/index"
+	"socket-file-transfer/internal/wire"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// put writes a file of size bytes at root/name, modified age ago.
+func put(t *testing.T, root, name string, size int, age time.Duration) string {
+	t.Helper()
+	path := filepath.Join(root, name)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	when := time.Now().Add(-age)
+	if err := os.Chtimes(path, when, when); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestEnforce(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		name   string
+		policy Policy
+		kept   []string
+	}{
+		{"no limits", Policy{}, []string{"old", "sub/older", "mid", "new"}},
+		{"age", Policy{MaxAge: 7 * day}, []string{"mid", "new"}},
+		{"bytes evict oldest", Policy{MaxBytes: 250}, []string{"mid", "new"}},
+		{"bytes exactly", Policy{MaxBytes: 400}, []string{"old", "sub/older", "mid", "new"}},
+		{"bytes keep newest", Policy{MaxBytes: 150}, []string{"new"}},
+		{"both", Policy{MaxAge: 7 * day, MaxBytes: 100}, []string{"new"}},
+		{"dry run", Policy{MaxAge: 7 * day, MaxBytes: 1, DryRun: true}, []string{"old", "sub/older", "mid", "new"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			put(t, root, "sub/older", 100, 30*day)
+			put(t, root, "old", 100, 10*day)
+			put(t, root, "mid", 100, 2*day)
+			put(t, root, "new", 100, time.Hour)
+			if err := Enforce(root, tt.policy, nil, quiet); err != nil {
+				t.Fatal(err)
+			}
+			var kept []string
+			for _, name := range []string{"old", "sub/older", "mid", "new"} {
+				if exists(filepath.Join(root, name)) {
+					kept = append(kept, name)
+				}
+			}
+			if strings.Join(kept, " ") != strings.Join(tt.kept, " ") {
+				t.Errorf("kept %v, want %v", kept, tt.kept)
+			}
+			if !exists(filepath.Join(root, "sub")) {
+				t.Error("emptied directory removed")
+			}
+		})
+	}
+}
+
+// Removals are logged with reason retention, and a dry run only logs.
+func TestEnforceLog(t *testing.T) {
+	for _, dry := range []bool{false, true} {
+		root := t.TempDir()
+		put(t, root, "old", 1, 48*time.Hour)
+		var buf bytes.Buffer
+		log := slog.New(slog.NewTextHandler(&buf, nil))
+		Enforce(root, Policy{MaxAge: time.Hour, DryRun: dry}, nil, log)
+
+		want := "Removed file"
+		if dry {
+			want = "Would remove file"
+		}
+		if out := buf.String(); !strings.Contains(out, want) || !strings.Contains(out, "reason=retention") || !strings.Contains(out, "rule=age") {
+			t.Errorf("dry run %v logged %q", dry, out)
+		}
+		if exists(filepath.Join(root, "old")) == !dry {
+			t.Errorf("dry run %v: old file exists is %v", dry, !dry)
+		}
+	}
+}
+
+// Symbolic links, dot-files and what links point to outside the root are
+// never removed; a removed file's checksum sidecar and completion marker
+// go with it.
+func TestEnforceLeavesAlone(t *testing.T) {
+	const old = 48 * time.Hour
+	outside := t.TempDir()
+	target := put(t, outside, "target", 10, old)
+	put(t, outside, "dir/inner", 10, old)
+
+	root := t.TempDir()
+	os.Symlink(target, filepath.Join(root, "link"))
+	os.Symlink(filepath.Join(outside, "dir"), filepath.Join(root, "linkdir"))
+	put(t, root, ".receiving", 10, old)
+	victim := put(t, root, "victim", 10, old)
+	sidecar := hashcache.SidecarPath(victim)
+	os.WriteFile(sidecar, []byte("sum"), 0644)
+	marker := wire.MarkerPath(victim)
+	os.WriteFile(marker, []byte("{}"), 0644)
+
+	if err := Enforce(root, Policy{MaxAge: time.Hour}, nil, quiet); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{target, filepath.Join(outside, "dir/inner"), filepath.Join(root, "link"), filepath.Join(root, "linkdir"), filepath.Join(root, ".receiving")} {
+		if !exists(path) {
+			t.Errorf("%s removed", path)
+		}
+	}
+	if exists(victim) || exists(sidecar) || exists(marker) {
+		t.Errorf("old file, its sidecar or its marker kept")
+	}
+}
+
+// With an index the files come from it and leave it as they are removed.
+func TestEnforceIndex(t *testing.T) {
+	root := t.TempDir()
+	put(t, root, "old", 100, 48*time.Hour)
+	put(t, root, "new", 100, 0)
+	ix, err := index.Open(root, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	if err := Enforce(root, Policy{MaxBytes: 150}, ix, quiet); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(root, "old")) || !exists(filepath.Join(root, "new")) {
+		t.Error("wrong file evicted")
+	}
+	if _, ok := ix.Stat("old"); ok || ix.TotalBytes() != 100 {
+		t.Errorf("index still lists old, or totals %d bytes", ix.TotalBytes())
+	}
+}
+
+func TestPruner(t *testing.T) {
+	if Start(t.TempDir(), Policy{}, nil, quiet) != nil {
+		t.Error("Pruner started without limits")
+	}
+	var pr *Pruner
+	pr.Stored()
+	if err := pr.Sweep(); err != nil {
+		t.Errorf("nil Pruner swept with %v", err)
+	}
+	pr.Close()
+
+	root := t.TempDir()
+	pr = Start(root, Policy{MaxBytes: 100}, nil, quiet)
+	put(t, root, "a", 100, time.Hour)
+	put(t, root, "b", 100, 0)
+	if err := pr.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(root, "a")) || !exists(filepath.Join(root, "b")) {
+		t.Error("Sweep didn't evict the older file")
+	}
+
+	// Stored wakes the Pruner without waiting for INTERVAL
+	put(t, root, "c", 100, -time.Minute)
+	pr.Stored()
+	deadline := time.Now().Add(5 * time.Second)
+	for exists(filepath.Join(root, "b")) {
+		if time.Now().After(deadline) {
+			t.Fatal("Stored didn't enforce the budget")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pr.Close()
+	if err := pr.Sweep(); err != nil {
+		t.Errorf("closed Pruner swept with %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+// Package scan runs a server's scanner on each file it receives, before the
+// file becomes visible under its name, e.g. a virus scanner compliance
+// requires.
+//
+// The command runs through the shell with the file described in the
+// environment as for hooks, see internal/hook, TRANSFER_PATH being the
+// temporary file the upload was received into. Exit status 0 passes the
+// file; any other fails it, as does a scanner that can't be started. What
+// the command writes to standard output is kept as its report.
+package scan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"socket-file-transfer/internal/hook"
+	"socket-file-transfer/internal/wire"
+)
+
+const (
+	// How long a scan may take by default
+	DefaultTimeout = time.Minute
+
+	// Most scans running at once; further uploads wait for a slot
+	MAX_CONCURRENT = 4
+
+	// Most of a scanner's output kept as its report
+	MAX_REPORT = 64 << 10
+)
+
+// ErrTimedOut is wrapped by the error of a scan that took too long.
+var ErrTimedOut = errors.New("scan timed out")
+
+// Scanner runs the scan command of one server.
+type Scanner struct {
+	command          string
+	timeout          time.Duration
+	promoteOnTimeout bool
+	log              *slog.Logger
+
+	slots    chan struct{}
+	rejected atomic.Int64
+	timedOut atomic.Int64
+}
+
+// New returns a Scanner for command, or nil if it is empty. A scan running
+// longer than timeout, DefaultTimeout if 0, is killed; the file then
+// passes if promoteOnTimeout is set and fails otherwise.
+func New(command string, timeout time.Duration, promoteOnTimeout bool, log *slog.Logger) *Scanner {
+	if command == "" {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Scanner{
+		command:          command,
+		timeout:          timeout,
+		promoteOnTimeout: promoteOnTimeout,
+		log:              log,
+		slots:            make(chan struct{}, MAX_CONCURRENT),
+	}
+}
+
+// Scan runs the scanner on the file u describes, returning its report. A
+// file it fails yields an error wrapping wire.ErrPolicy, and ErrTimedOut as
+// well if the scan took too long. waiting is called if the scan has to
+// wait for a slot first.
+func (s *Scanner) Scan(u hook.Upload, waiting func()) ([]byte, error) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		waiting()
+		s.slots <- struct{}{}
+	}
+	defer func() { <-s.slots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", s.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", s.command)
+	}
+	cmd.Env = append(os.Environ(), u.Environ()...)
+	// A killed shell's children may keep its output open
+	cmd.WaitDelay = time.Second
+	var stdout, stderr limitedBuffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	report := stdout.Bytes()
+	if ctx.Err() != nil {
+		n := s.timedOut.Add(1)
+		if s.promoteOnTimeout {
+			s.log.Warn("Scan timed out, passing the file", "path", u.Path, "timeout", s.timeout, "timeouts", n)
+			return report, nil
+		}
+		s.log.Warn("Scan timed out, rejecting the file", "path", u.Path, "timeout", s.timeout, "timeouts", n, "rejected", s.rejected.Add(1))
+		return report, fmt.Errorf("%w: %w after %s", wire.ErrPolicy, ErrTimedOut, s.timeout)
+	}
+	if err != nil {
+		s.log.Warn("Scan rejected file", "path", u.Path, "err", err, "stderr", string(bytes.TrimSpace(stderr.Bytes())), "rejected", s.rejected.Add(1))
+		return report, fmt.Errorf("%w: the file failed the server's scan", wire.ErrPolicy)
+	}
+	s.log.Debug("Scan passed", "path", u.Path, "duration", time.Since(start))
+	return report, nil
+}
+
+// Rejected returns how many files scans have failed, including those that
+// timed out.
+func (s *Scanner) Rejected() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.rejected.Load()
+}
+
+// TimedOut returns how many scans took too long, whether or not their
+// file passed.
+func (s *Scanner) TimedOut() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.timedOut.Load()
+}
+
+// limitedBuffer keeps the first MAX_REPORT bytes written to it and drops
+// the rest, so a chatty scanner can't exhaust memory.
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := MAX_REPORT - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,100 @@
+//go:build !windows
+
+package scan
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/hook"
+	"socket-file-transfer/internal/wire"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  string
+		promote  bool
+		report   string
+		want     error // Besides ErrPolicy, which any failure wraps
+		fails    bool
+		timedOut int64
+	}{
+		{name: "pass", command: `test "$TRANSFER_PATH" = /tmp/upload && test "$TRANSFER_NAME" = f.txt && echo clean`, report: "clean\n"},
+		{name: "reject", command: "echo infected; exit 1", report: "infected\n", fails: true},
+		{name: "can't run", command: "/nonexistent/scanner", fails: true},
+		{name: "timeout", command: "echo started; exec sleep 5", report: "started\n", fails: true, want: ErrTimedOut, timedOut: 1},
+		{name: "timeout promoted", command: "exec sleep 5", promote: true, timedOut: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.command, 200*time.Millisecond, tt.promote, quiet)
+			report, err := s.Scan(hook.Upload{Path: "/tmp/upload", Name: "f.txt"}, func() {})
+			if tt.fails != (err != nil) || err != nil && !errors.Is(err, wire.ErrPolicy) {
+				t.Fatalf("got %v, want failure %v with ErrPolicy", err, tt.fails)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			if string(report) != tt.report {
+				t.Errorf("report %q, want %q", report, tt.report)
+			}
+			wantRejected := int64(0)
+			if tt.fails {
+				wantRejected = 1
+			}
+			if s.Rejected() != wantRejected || s.TimedOut() != tt.timedOut {
+				t.Errorf("%d rejected, %d timed out, want %d and %d", s.Rejected(), s.TimedOut(), wantRejected, tt.timedOut)
+			}
+		})
+	}
+}
+
+// Scans beyond MAX_CONCURRENT wait for a slot, saying so.
+func TestScanConcurrency(t *testing.T) {
+	s := New("sleep 0.3", time.Minute, false, quiet)
+	var waited atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < MAX_CONCURRENT+2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Scan(hook.Upload{}, func() { waited.Add(1) }); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := waited.Load(); n != 2 {
+		t.Errorf("%d scans waited for a slot, want 2", n)
+	}
+}
+
+func TestNoScanner(t *testing.T) {
+	var s *Scanner = New("", 0, false, quiet)
+	if s != nil || s.Rejected() != 0 || s.TimedOut() != 0 {
+		t.Errorf("New without a command = %v", s)
+	}
+}
+
+// A chatty scanner's report is cut at MAX_REPORT.
+func TestReportLimit(t *testing.T) {
+	var b limitedBuffer
+	chunk := strings.Repeat("x", MAX_REPORT/3+1)
+	for i := 0; i < 4; i++ {
+		if n, err := b.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+	if b.Len() != MAX_REPORT {
+		t.Errorf("kept %d bytes, want %d", b.Len(), MAX_REPORT)
+	}
+}
@@ -0,0 +1,124 @@
+// Package schedule orders the files a client sends out of a directory, as
+// sync and send -watch do: by name, size or age, with the files matching
+// priority patterns ahead of the rest. It is a queue rather than a sorted
+// list so files found later, as -watch finds them, take their place among
+// those still waiting.
+package schedule
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+
+	"socket-file-transfer/internal/pathfilter"
+)
+
+// Order is the order files leave a Queue in, within their priority.
+type Order int
+
+const (
+	OrderName     Order = iota // By name
+	OrderSizeAsc               // Smallest first
+	OrderSizeDesc              // Largest first
+	OrderMtime                 // Least recently modified first
+)
+
+// ParseOrder parses "name", "size-asc", "size-desc" or "mtime".
+func ParseOrder(s string) (Order, error) {
+	switch s {
+	case "name":
+		return OrderName, nil
+	case "size-asc":
+		return OrderSizeAsc, nil
+	case "size-desc":
+		return OrderSizeDesc, nil
+	case "mtime":
+		return OrderMtime, nil
+	}
+	return 0, fmt.Errorf("unknown order %q, want name, size-asc, size-desc or mtime", s)
+}
+
+// Item is a file waiting to be sent.
+type Item struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+
+	priority bool
+}
+
+// Queue hands out files in order. It is not safe for concurrent use.
+type Queue struct {
+	order    Order
+	priority *pathfilter.Filter
+	items    items
+}
+
+// New returns an empty Queue of the given order in which files matching
+// one of the priority patterns, see internal/pathfilter, come first.
+func New(order Order, priority []string) (*Queue, error) {
+	filter, err := pathfilter.New(priority, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Queue{order: order, priority: filter, items: items{order: order}}, nil
+}
+
+// Push adds a file to the queue.
+func (q *Queue) Push(it Item) {
+	if q.priority != nil {
+		it.priority, _ = q.priority.Keep(it.Name, false)
+	}
+	heap.Push(&q.items, it)
+}
+
+// Pop removes and returns the file to send next, false if there is none.
+func (q *Queue) Pop() (Item, bool) {
+	if len(q.items.list) == 0 {
+		return Item{}, false
+	}
+	return heap.Pop(&q.items).(Item), true
+}
+
+// Len returns how many files are waiting.
+func (q *Queue) Len() int {
+	return len(q.items.list)
+}
+
+// items implements heap.Interface.
+type items struct {
+	order Order
+	list  []Item
+}
+
+func (h *items) Len() int      { return len(h.list) }
+func (h *items) Swap(i, j int) { h.list[i], h.list[j] = h.list[j], h.list[i] }
+func (h *items) Push(x any)    { h.list = append(h.list, x.(Item)) }
+
+func (h *items) Pop() any {
+	it := h.list[len(h.list)-1]
+	h.list = h.list[:len(h.list)-1]
+	return it
+}
+
+func (h *items) Less(i, j int) bool {
+	a, b := &h.list[i], &h.list[j]
+	if a.priority != b.priority {
+		return a.priority
+	}
+	switch h.order {
+	case OrderSizeAsc:
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+	case OrderSizeDesc:
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+	case OrderMtime:
+		if !a.ModTime.Equal(b.ModTime) {
+			return a.ModTime.Before(b.ModTime)
+		}
+	}
+	return a.Name < b.Name
+}
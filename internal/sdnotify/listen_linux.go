@@ -0,0 +1,65 @@
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// The first descriptor systemd passes
+const LISTEN_FDS_START = 3
+
+// Sockets returns the sockets systemd passed under socket activation:
+// stream sockets as listeners, datagram sockets as packet connections.
+// Both are empty if the process wasn't socket-activated. The environment
+// variables that pass them are cleared, and the descriptors closed on
+// exec, so commands the server runs don't take them for theirs.
+func Sockets() (listeners []net.Listener, conns []net.PacketConn, err error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for fd := LISTEN_FDS_START; fd < LISTEN_FDS_START+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+		switch {
+		case err != nil:
+			err = fmt.Errorf("descriptor %d is not a socket: %w", fd, err)
+		case typ == syscall.SOCK_STREAM:
+			var l net.Listener
+			if l, err = net.FileListener(f); err == nil {
+				listeners = append(listeners, l)
+			}
+		case typ == syscall.SOCK_DGRAM:
+			var c net.PacketConn
+			if c, err = net.FilePacketConn(f); err == nil {
+				conns = append(conns, c)
+			}
+		default:
+			err = fmt.Errorf("descriptor %d is neither a stream nor a datagram socket", fd)
+		}
+		// The listener or connection has its own copy of the descriptor
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, nil, fmt.Errorf("error taking over the sockets systemd passed: %w", err)
+		}
+	}
+	return listeners, conns, nil
+}
@@ -0,0 +1,91 @@
+package sdnotify
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestSocketsChild runs in a process started by TestSockets with the
+// sockets as descriptors 3 and 4, as systemd starts a service, and prints
+// what Sockets makes of them. LISTEN_PID is set here, as only now is the
+// PID known.
+func TestSocketsChild(t *testing.T) {
+	if os.Getenv("SDNOTIFY_TEST_CHILD") == "" {
+		t.Skip("run by TestSockets")
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	listeners, conns, err := Sockets()
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	for _, l := range listeners {
+		fmt.Println("listener", l.Addr())
+	}
+	for _, c := range conns {
+		fmt.Println("conn", c.LocalAddr())
+	}
+	fmt.Printf("env %q %q\n", os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_PID"))
+}
+
+func TestSockets(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	lf, _ := ln.(*net.TCPListener).File()
+	defer lf.Close()
+	pf, _ := pc.(*net.UDPConn).File()
+	defer pf.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSocketsChild$", "-test.v")
+	cmd.Env = append(os.Environ(), "SDNOTIFY_TEST_CHILD=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=tcp:udp")
+	cmd.ExtraFiles = []*os.File{lf, pf}
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v:\n%s", err, out.String())
+	}
+	for _, want := range []string{
+		"listener " + ln.Addr().String(),
+		"conn " + pc.LocalAddr().String(),
+		`env "" ""`,
+	} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("child lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// Sockets meant for another process, or none at all, are left alone.
+func TestSocketsNotActivated(t *testing.T) {
+	tests := []struct {
+		name, pid, fds string
+	}{
+		{"unset", "", ""},
+		{"another process", "1", "2"},
+		{"no descriptors", strconv.Itoa(os.Getpid()), "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", tt.pid)
+			t.Setenv("LISTEN_FDS", tt.fds)
+			listeners, conns, err := Sockets()
+			if len(listeners) != 0 || len(conns) != 0 || err != nil {
+				t.Errorf("got %v, %v, %v, want nothing", listeners, conns, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package sdnotify
+
+import "net"
+
+// Sockets returns nothing, as only systemd passes sockets, and it runs on
+// Linux alone.
+func Sockets() (listeners []net.Listener, conns []net.PacketConn, err error) {
+	return nil, nil, nil
+}
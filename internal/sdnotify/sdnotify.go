@@ -0,0 +1,83 @@
+// Package sdnotify lets a server run as a systemd service: take over the
+// sockets systemd listens on for it (socket activation, see Sockets),
+// tell systemd when it is ready and stopping, and ping its watchdog. Every
+// function does nothing when the server wasn't started by systemd, so
+// callers needn't check.
+package sdnotify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends state, such as "READY=1", to systemd through the socket
+// NOTIFY_SOCKET names, doing nothing if it is unset.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("error notifying systemd: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("error notifying systemd: %w", err)
+	}
+	return nil
+}
+
+// Ready tells systemd the server accepts connections, which completes
+// the start of a Type=notify service.
+func Ready() error {
+	return Notify("READY=1")
+}
+
+// Stopping tells systemd the server is shutting down.
+func Stopping() error {
+	return Notify("STOPPING=1")
+}
+
+// WatchdogInterval returns how often systemd expects a watchdog ping,
+// zero if the service has no WatchdogSec or it is meant for another
+// process.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog pings systemd's watchdog at half the interval it expects,
+// until ctx ends. It returns at once if the service has no watchdog.
+func Watchdog(ctx context.Context) error {
+	interval := WatchdogInterval()
+	if interval <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		if err := Notify("WATCHDOG=1"); err != nil {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
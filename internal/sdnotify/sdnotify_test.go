@@ -0,0 +1,124 @@
+package sdnotify
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// notifySocket listens where NOTIFY_SOCKET points for the test, returning
+// the socket.
+func notifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix datagram sockets")
+	}
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// expect fails the test unless the next notification on conn is want.
+func expect(t *testing.T, conn *net.UnixConn, want string) {
+	t.Helper()
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no notification, want %q: %v", want, err)
+	}
+	if got := string(buf[:n]); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	conn := notifySocket(t)
+	for _, tt := range []struct {
+		notify func() error
+		want   string
+	}{
+		{Ready, "READY=1"},
+		{Stopping, "STOPPING=1"},
+		{func() error { return Notify("STATUS=serving") }, "STATUS=serving"},
+	} {
+		if err := tt.notify(); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, conn, tt.want)
+	}
+}
+
+// Outside systemd there is nothing to notify, and no error.
+func TestNotifyOutsideSystemd(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Ready(); err != nil {
+		t.Errorf("Ready: %v", err)
+	}
+	if err := Watchdog(context.Background()); err != nil {
+		t.Errorf("Watchdog: %v", err)
+	}
+}
+
+// A socket that isn't there is an error, so the server can log it.
+func TestNotifyMissingSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "gone"))
+	if err := Ready(); err == nil {
+		t.Error("notified a socket that doesn't exist")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name, usec, pid string
+		want            time.Duration
+	}{
+		{"unset", "", "", 0},
+		{"set", "30000000", "", 30 * time.Second},
+		{"for this process", "1000", self, time.Millisecond},
+		{"for another process", "1000", "1", 0},
+		{"invalid", "soon", "", 0},
+		{"zero", "0", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+			if got := WatchdogInterval(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The watchdog is pinged at half its interval until the context ends.
+func TestWatchdog(t *testing.T) {
+	conn := notifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "40000")
+	t.Setenv("WATCHDOG_PID", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- Watchdog(ctx) }()
+	for i := 0; i < 3; i++ {
+		expect(t, conn, "WATCHDOG=1")
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("3 pings in %v, want them 20ms apart", elapsed)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,61 @@
+// Package sparse finds the data in files with holes, such as disk images,
+// so a transfer can send just the data and the receiver can leave the
+// holes unwritten instead of storing them as zeros.
+package sparse
+
+import (
+	"io"
+	"os"
+)
+
+// Extent is a run of a file's data between holes.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// End returns the offset just past e.
+func (e Extent) End() int64 {
+	return e.Offset + e.Length
+}
+
+// Extents returns the data extents of the first size bytes of f, in order.
+// Where the platform or filesystem can't tell holes apart, the whole file
+// is one extent. The list is nil only if size is 0, so a file that is all
+// hole has an empty one. It leaves f's offset at the start.
+func Extents(f *os.File, size int64) ([]Extent, error) {
+	return extents(f, size)
+}
+
+// HasHoles reports whether extents leave any of size bytes out.
+func HasHoles(extents []Extent, size int64) bool {
+	var data int64
+	for _, e := range extents {
+		data += e.Length
+	}
+	return data < size
+}
+
+// dense returns the single extent of a file without holes.
+func dense(size int64) []Extent {
+	if size == 0 {
+		return nil
+	}
+	return []Extent{{Offset: 0, Length: size}}
+}
+
+// Zeros, written in place of holes where storage can't keep them
+var zeros [64 << 10]byte
+
+// WriteZeros writes n zero bytes to w, which hashes a hole or fills it in
+// on storage that can't seek.
+func WriteZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		k, err := w.Write(zeros[:min(n, int64(len(zeros)))])
+		n -= int64(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
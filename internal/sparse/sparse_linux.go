@@ -0,0 +1,49 @@
+package sparse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lseek whence values for the next data and the next hole at or after an
+// offset, which syscall lacks
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+func extents(f *os.File, size int64) ([]Extent, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	list := []Extent{}
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break // Nothing but a hole from off on
+		}
+		if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EOPNOTSUPP) {
+			list = dense(size)
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if data >= size {
+			break
+		}
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		hole = min(hole, size)
+		list = append(list, Extent{Offset: data, Length: hole - data})
+		off = hole
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,24 @@
+package sparse
+
+import "testing"
+
+// Where the filesystem keeps holes, only the data is listed.
+func TestExtentsFindHoles(t *testing.T) {
+	const size = 8 << 20
+	f := makeSparse(t, size, map[int64][]byte{2 << 20: make([]byte, 4096), 6 << 20: {1}})
+	list, err := Extents(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !HasHoles(list, size) {
+		t.Skip("the filesystem of the temporary directory doesn't keep holes")
+	}
+	if len(list) != 2 {
+		t.Errorf("got extents %v, want the two written", list)
+	}
+	for _, e := range list {
+		if e.Length > 1<<20 {
+			t.Errorf("extent %v takes in a hole", e)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package sparse
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeSparse creates a file of size bytes holding data at each offset of
+// data and holes elsewhere, where the filesystem keeps them.
+func makeSparse(t *testing.T, size int64, data map[int64][]byte) *os.File {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for off, b := range data {
+		if _, err := f.WriteAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f
+}
+
+func TestExtents(t *testing.T) {
+	const mb = 1 << 20
+	block := bytes.Repeat([]byte{1}, 64<<10)
+	tests := []struct {
+		name string
+		size int64
+		data map[int64][]byte
+	}{
+		{"empty", 0, nil},
+		{"all hole", 8 * mb, nil},
+		{"data in the middle", 8 * mb, map[int64][]byte{3 * mb: block}},
+		{"data at both ends", 8 * mb, map[int64][]byte{0: block, 8*mb - int64(len(block)): block}},
+		{"dense", 256 << 10, map[int64][]byte{0: bytes.Repeat(block, 4)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := makeSparse(t, tt.size, tt.data)
+			list, err := Extents(f, tt.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if off, _ := f.Seek(0, 1); off != 0 {
+				t.Errorf("file offset left at %d", off)
+			}
+			if tt.size == 0 {
+				if list != nil {
+					t.Errorf("got %v for an empty file, want nil", list)
+				}
+				return
+			}
+
+			// Extents are ordered, within the file and cover all its data,
+			// whether or not the filesystem keeps holes
+			var prev int64
+			for _, e := range list {
+				if e.Offset < prev || e.Length <= 0 || e.End() > tt.size {
+					t.Fatalf("extents %v out of order or out of the %d bytes", list, tt.size)
+				}
+				prev = e.End()
+			}
+			for off, b := range tt.data {
+				covered := false
+				for _, e := range list {
+					covered = covered || e.Offset <= off && off+int64(len(b)) <= e.End()
+				}
+				if !covered {
+					t.Errorf("data at %d outside extents %v", off, list)
+				}
+			}
+		})
+	}
+}
+
+func TestHasHoles(t *testing.T) {
+	if HasHoles([]Extent{{0, 10}}, 10) {
+		t.Error("dense file has holes")
+	}
+	if !HasHoles([]Extent{{0, 4}, {6, 4}}, 10) {
+		t.Error("gap not taken for a hole")
+	}
+	if !HasHoles([]Extent{}, 10) {
+		t.Error("all-hole file has no holes")
+	}
+}
+
+func TestWriteZeros(t *testing.T) {
+	for _, n := range []int64{0, 1, int64(len(zeros)), 3*int64(len(zeros)) + 5} {
+		var buf bytes.Buffer
+		if err := WriteZeros(&buf, n); err != nil {
+			t.Fatal(err)
+		}
+		if int64(buf.Len()) != n || bytes.ContainsFunc(buf.Bytes(), func(r rune) bool { return r != 0 }) {
+			t.Errorf("WriteZeros(%d) wrote %d bytes, not all zero", n, buf.Len())
+		}
+	}
+}
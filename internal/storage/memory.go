@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps files in memory, for exercising servers without a disk or
+// a bucket.
+type Memory struct {
+	mu      sync.Mutex
+	files   map[string]memFile
+	pending map[string]*memWriter
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemory returns an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string]memFile), pending: make(map[string]*memWriter)}
+}
+
+type memWriter struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	return w.Buffer.Write(p)
+}
+
+func (w *memWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func (m *Memory) Create(name string) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.pending[name]; ok {
+		return nil, busy(name)
+	}
+	w := &memWriter{}
+	m.pending[name] = w
+	return w, nil
+}
+
+func (m *Memory) take(name string) (*memWriter, error) {
+	w, ok := m.pending[name]
+	if !ok {
+		return nil, fmt.Errorf("%q is not being received", name)
+	}
+	delete(m.pending, name)
+	return w, nil
+}
+
+func (m *Memory) Finalize(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, err := m.take(name)
+	if err != nil {
+		return err
+	}
+	if !w.closed {
+		return fmt.Errorf("%q finalized before its writer was closed", name)
+	}
+	m.files[name] = memFile{data: w.Bytes(), modTime: time.Now()}
+	return nil
+}
+
+func (m *Memory) Abort(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.take(name)
+	return err
+}
+
+func (m *Memory) List(dir string) ([]FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+	infos := []FileInfo{}
+	for name, f := range m.files {
+		base, ok := strings.CutPrefix(name, prefix)
+		if !ok || strings.Contains(base, "/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+		infos = append(infos, FileInfo{Name: base, Size: int64(len(f.data)), ModTime: f.modTime})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (m *Memory) Stat(name string) (*FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return &FileInfo{Name: path.Base(name), Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
+
+func (m *Memory) Open(name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+func (m *Memory) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *Memory) Location(name string) string {
+	return "mem:" + name
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"socket-file-transfer/internal/sparse"
+	"socket-file-transfer/internal/wire"
+)
+
+// How old a file left in a staging directory must be for CleanStaging to
+// remove it, long enough that no transfer is still writing it
+const STAGING_TTL = 24 * time.Hour
+
+// rename moves a received file into place; tests replace it to make it
+// cross filesystems
+var rename = os.Rename
+
+// move renames src to dst, copying it over when they are on different
+// filesystems, which rename can't cross. A copy is fsynced and renamed
+// into place, so dst never holds part of the file, before src goes.
+func move(src, dst string) error {
+	err := rename(src, dst)
+	if err == nil || !crossDevice(err) {
+		return err
+	}
+	return copyMove(src, dst)
+}
+
+// copyMove moves src to dst by copying, keeping its holes.
+func copyMove(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	dir, base := filepath.Split(dst)
+	out, err := os.CreateTemp(dir, wire.PartPattern(base))
+	if err != nil {
+		return err
+	}
+	err = copySparse(out, in, info.Size())
+	if err == nil {
+		err = out.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return fmt.Errorf("error copying %s to %s: %w", src, dst, err)
+	}
+	return os.Remove(src)
+}
+
+// copySparse copies size bytes of in's data to out, leaving its holes
+// unwritten.
+func copySparse(out, in *os.File, size int64) error {
+	extents, err := sparse.Extents(in, size)
+	if err != nil {
+		return err
+	}
+	for _, e := range extents {
+		if _, err := in.Seek(e.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := out.Seek(e.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(out, in, e.Length); err != nil {
+			return err
+		}
+	}
+	return out.Truncate(size)
+}
+
+// CleanStaging removes files older than STAGING_TTL that transfers left
+// in dir, the staging directory, when the server died before finishing
+// them. It returns the paths removed.
+func CleanStaging(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".part") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < STAGING_TTL {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if err := os.Remove(path); err == nil {
+			removed = append(removed, path)
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,137 @@
+//go:build !windows
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// crossFilesystems makes renames out of staging fail as they do between
+// filesystems until the test ends, returning how many did.
+func crossFilesystems(t *testing.T, staging string) *int {
+	t.Helper()
+	crossed := new(int)
+	rename = func(src, dst string) error {
+		if filepath.Dir(src) == staging {
+			*crossed++
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EXDEV}
+		}
+		return os.Rename(src, dst)
+	}
+	t.Cleanup(func() { rename = os.Rename })
+	return crossed
+}
+
+// Files received into a staging directory on another filesystem are
+// copied into place, leaving nothing staged or half copied.
+func TestStagingCrossDevice(t *testing.T) {
+	for _, crossing := range []bool{false, true} {
+		name := "same filesystem"
+		if crossing {
+			name = "across filesystems"
+		}
+		t.Run(name, func(t *testing.T) {
+			l := NewLocal(t.TempDir())
+			l.Staging = t.TempDir()
+			crossed := new(int)
+			if crossing {
+				crossed = crossFilesystems(t, l.Staging)
+			}
+
+			store(t, l, "dir/f.txt", "staged")
+			if got := content(t, l, "dir/f.txt"); got != "staged" {
+				t.Errorf("stored %q, want %q", got, "staged")
+			}
+
+			w, err := l.Create("bad.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte("bad"))
+			w.Close()
+			quarantined := filepath.Join(l.Root, wire.QUARANTINE_DIR, "bad.txt.rejected")
+			if err := l.Quarantine("bad.txt", quarantined); err != nil {
+				t.Fatalf("Quarantine: %v", err)
+			}
+			if data, err := os.ReadFile(quarantined); string(data) != "bad" {
+				t.Errorf("quarantined %q, %v, want %q", data, err, "bad")
+			}
+
+			if crossing && *crossed != 2 {
+				t.Errorf("%d moves crossed filesystems, want 2", *crossed)
+			}
+			if entries, _ := os.ReadDir(l.Staging); len(entries) != 0 {
+				t.Errorf("%d files left in staging", len(entries))
+			}
+			filepath.WalkDir(l.Root, func(path string, d os.DirEntry, err error) error {
+				if err == nil && strings.HasSuffix(path, ".part") {
+					t.Errorf("%s left behind", path)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+// A file copied across filesystems keeps its content around its holes.
+func TestCopyMoveSparse(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	file, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("start"), 0)
+	file.WriteAt([]byte("end"), 8<<20)
+	file.Close()
+	want, _ := os.ReadFile(src)
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := copyMove(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil || string(got) != string(want) {
+		t.Errorf("copied %d bytes (%v), want the %d of the source", len(got), err, len(want))
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source still there after the move: %v", err)
+	}
+}
+
+// Only staged files older than STAGING_TTL are cleaned up.
+func TestCleanStaging(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * STAGING_TTL)
+	files := map[string]bool{ // Whether it goes
+		".old.bin.123.part":   true,
+		".fresh.bin.456.part": false,
+		"old-but-not-staged":  false,
+	}
+	for name, goes := range files {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte("x"), 0644)
+		if goes || name == "old-but-not-staged" {
+			os.Chtimes(path, old, old)
+		}
+	}
+
+	removed, err := CleanStaging(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || filepath.Base(removed[0]) != ".old.bin.123.part" {
+		t.Errorf("removed %v, want just the old staged file", removed)
+	}
+	for name, goes := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) == goes {
+			t.Errorf("%s: %v after cleaning", name, err)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package storage
+
+import (
+	"errors"
+	"syscall"
+)
+
+const ERROR_NOT_SAME_DEVICE syscall.Errno = 17
+
+// crossDevice reports whether a rename failed for crossing volumes.
+func crossDevice(err error) bool {
+	return errors.Is(err, ERROR_NOT_SAME_DEVICE)
+}
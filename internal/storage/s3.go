@@ -0,0 +1,532 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Size of the parts of a multipart upload, at least the 5 MiB S3
+	// wants; with its limit of 10000 parts objects can reach 156 GiB
+	PART_SIZE = 16 << 20
+	MAX_PARTS = 10000
+
+	// Attempts at a request S3 fails with a server error, doubling the
+	// wait from RETRY_DELAY between them
+	REQUEST_ATTEMPTS = 3
+	RETRY_DELAY      = time.Second
+
+	// Longest to wait for S3 to start answering a request
+	RESPONSE_TIMEOUT = time.Minute
+)
+
+// S3 keeps files as objects under a prefix of an S3 bucket. Files being
+// received are multipart uploads, which S3 only shows once completed, or,
+// below PART_SIZE, held in memory and put whole.
+//
+// Credentials and region come from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and AWS_REGION or
+// AWS_DEFAULT_REGION. AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL point it at
+// an S3-compatible service instead of AWS, addressing buckets by path.
+type S3 struct {
+	bucket   string
+	prefix   string
+	region   string
+	endpoint *url.URL // Nil for AWS itself
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+
+	mu      sync.Mutex
+	pending map[string]*s3Writer
+}
+
+// NewS3 returns an S3 keeping files under prefix in bucket.
+func NewS3(bucket, prefix string) (*S3, error) {
+	if bucket == "" {
+		return nil, errors.New("S3 storage needs a bucket, as in s3://bucket/prefix")
+	}
+	s := &S3{
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		pending:      make(map[string]*s3Writer),
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("S3 storage needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		s.endpoint = u
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = RESPONSE_TIMEOUT
+	s.client = &http.Client{Transport: transport}
+	return s, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (s *S3) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *S3) Create(name string) (io.WriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[name]; ok {
+		return nil, busy(name)
+	}
+	w := &s3Writer{s: s, key: s.key(name)}
+	s.pending[name] = w
+	return w, nil
+}
+
+func (s *S3) take(name string) (*s3Writer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.pending[name]
+	if !ok {
+		return nil, fmt.Errorf("%q is not being received", name)
+	}
+	delete(s.pending, name)
+	return w, nil
+}
+
+func (s *S3) Finalize(name string) error {
+	w, err := s.take(name)
+	if err != nil {
+		return err
+	}
+	if w.uploadID == "" {
+		resp, err := s.do(http.MethodPut, w.key, nil, w.buf)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	var complete struct {
+		XMLName xml.Name     `xml:"CompleteMultipartUpload"`
+		Parts   []s3Uploaded `xml:"Part"`
+	}
+	complete.Parts = w.parts
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, body)
+	if err != nil {
+		w.abort()
+		return err
+	}
+	defer resp.Body.Close()
+	// Completing can fail after S3 has answered 200
+	reply, err := io.ReadAll(resp.Body)
+	if err == nil {
+		err = replyError(reply)
+	}
+	if err != nil {
+		w.abort()
+		return fmt.Errorf("error completing upload of %s: %w", w.key, err)
+	}
+	return nil
+}
+
+func (s *S3) Abort(name string) error {
+	w, err := s.take(name)
+	if err != nil {
+		return err
+	}
+	return w.abort()
+}
+
+func (s *S3) List(dir string) ([]FileInfo, error) {
+	prefix := s.key(dir) + "/"
+	if prefix == "/" {
+		prefix = ""
+	}
+	var infos []FileInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading S3 listing: %w", err)
+		}
+		for _, c := range list.Contents {
+			name := strings.TrimPrefix(c.Key, prefix)
+			if name == "" || strings.HasPrefix(name, ".") {
+				continue
+			}
+			infos = append(infos, FileInfo{Name: name, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !list.IsTruncated {
+			return infos, nil
+		}
+		query.Set("continuation-token", list.NextContinuationToken)
+	}
+}
+
+func (s *S3) Stat(name string) (*FileInfo, error) {
+	resp, err := s.do(http.MethodHead, s.key(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &FileInfo{Name: path.Base(name), Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.key(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Remove(name string) error {
+	// Deleting a missing object succeeds, so check it is there
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, s.key(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Location(name string) string {
+	return "s3://" + s.bucket + "/" + s.key(name)
+}
+
+// do sends a signed request for key, "" for the bucket, retrying server
+// errors, and returns a successful response. A missing object is an error
+// wrapping os.ErrNotExist.
+func (s *S3) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	delay := RETRY_DELAY
+	for attempt := 1; ; attempt++ {
+		resp, err := s.send(method, key, query, body)
+		retry := err != nil || resp.StatusCode >= 500
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		if err == nil {
+			reply, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			err = replyError(reply)
+			if err == nil {
+				err = errors.New(resp.Status)
+			}
+			if resp.StatusCode == http.StatusNotFound {
+				err = fmt.Errorf("%w: %w", os.ErrNotExist, err)
+			}
+			err = fmt.Errorf("S3 %s %s: %w", method, s.bucket+"/"+key, err)
+		}
+		if !retry || attempt == REQUEST_ATTEMPTS {
+			return nil, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (s *S3) send(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := &url.URL{Scheme: "https", Host: s.bucket + ".s3." + s.region + ".amazonaws.com", Path: "/" + key}
+	if s.endpoint != nil {
+		u = &url.URL{Scheme: s.endpoint.Scheme, Host: s.endpoint.Host, Path: "/" + s.bucket + "/" + key}
+	}
+	u.RawPath = escape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now())
+	return s.client.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	stamp := now.UTC().Format("20060102T150405Z")
+	date := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	names := []string{"host"}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers.String(), signed, payload}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escape percent-encodes s the way Signature Version 4 wants, leaving
+// slashes alone unless slash is set.
+func escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', strings.IndexByte("-._~", c) >= 0:
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, escape(k, true)+"="+escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// replyError returns the error an S3 reply body carries, if any.
+func replyError(reply []byte) error {
+	var e struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(reply, &e) != nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", e.Code, e.Message)
+}
+
+type s3Uploaded struct {
+	PartNumber int
+	ETag       string
+}
+
+// s3Writer collects a file into parts and uploads them in the background,
+// so the transfer goes on while the previous part is sent.
+type s3Writer struct {
+	s   *S3
+	key string
+	buf []byte
+
+	uploadID string
+	parts    []s3Uploaded // Filled in by upload
+	queued   int
+	queue    chan []byte
+	done     chan struct{}
+	err      error // Of a part upload, once done is closed or queue blocked
+	errMu    sync.Mutex
+	closed   bool
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if err := w.failed(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		// Only a full part followed by more data is uploaded here, so a
+		// file of one part can still be put whole
+		if len(w.buf) == PART_SIZE {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+		}
+		if w.buf == nil {
+			w.buf = make([]byte, 0, PART_SIZE)
+		}
+		take := min(len(p), PART_SIZE-len(w.buf))
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+	}
+	return n, nil
+}
+
+// flush queues the buffered part for upload, starting the multipart
+// upload with the first one.
+func (w *s3Writer) flush() error {
+	if w.uploadID == "" {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	if w.queued == MAX_PARTS-1 {
+		return fmt.Errorf("%s: more than %d parts", w.key, MAX_PARTS)
+	}
+	w.queued++
+	w.queue <- w.buf
+	w.buf = nil
+	return nil
+}
+
+func (w *s3Writer) start() error {
+	resp, err := w.s.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var created struct{ UploadId string }
+	if err := xml.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return fmt.Errorf("error starting upload of %s: %w", w.key, err)
+	}
+	w.uploadID = created.UploadId
+	w.queue = make(chan []byte, 1)
+	w.done = make(chan struct{})
+	go w.upload()
+	return nil
+}
+
+func (w *s3Writer) upload() {
+	defer close(w.done)
+	number := 0
+	for part := range w.queue {
+		if w.failed() != nil {
+			continue // Drain so flush never blocks
+		}
+		number++
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}
+		resp, err := w.s.do(http.MethodPut, w.key, query, part)
+		if err != nil {
+			w.errMu.Lock()
+			w.err = err
+			w.errMu.Unlock()
+			continue
+		}
+		resp.Body.Close()
+		w.parts = append(w.parts, s3Uploaded{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	}
+}
+
+func (w *s3Writer) failed() error {
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	return w.err
+}
+
+// Close uploads the last part and waits for the others. A file that fits
+// in one part stays in memory until Finalize.
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return w.failed()
+	}
+	w.closed = true
+	if w.uploadID == "" {
+		return nil
+	}
+	if len(w.buf) > 0 {
+		w.queue <- w.buf
+		w.buf = nil
+	}
+	close(w.queue)
+	<-w.done
+	return w.failed()
+}
+
+func (w *s3Writer) abort() error {
+	w.buf = nil
+	if w.uploadID == "" {
+		return nil
+	}
+	if !w.closed {
+		w.Close()
+	}
+	resp, err := w.s.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
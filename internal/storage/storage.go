@@ -0,0 +1,242 @@
+// Package storage keeps a server's stored files, on local disk or in an
+// S3 bucket. A file being received stays invisible under its name until
+// Finalize, so a failed transfer never leaves a partial file behind.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/wire"
+)
+
+// FileInfo describes a stored file.
+type FileInfo = wire.FileInfo
+
+// Storage holds stored files. Names are slash-separated paths relative to
+// its root, like "report.pdf" or "192.0.2.7/report.pdf".
+type Storage interface {
+	// Create starts receiving the file name; what is written becomes
+	// visible under name once the writer is closed and Finalize called.
+	Create(name string) (io.WriteCloser, error)
+	Finalize(name string) error
+	// Abort discards a file being received; call it after closing the
+	// writer if Finalize won't be called.
+	Abort(name string) error
+
+	// List describes the files directly in dir, "" for the root.
+	List(dir string) ([]FileInfo, error)
+	// Stat and Open return an error wrapping os.ErrNotExist if name isn't
+	// a stored file.
+	Stat(name string) (*FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	Remove(name string) error
+
+	// Location names a stored file for people and hooks: a path or URL.
+	Location(name string) string
+}
+
+// Open returns the Storage rawURL names: "s3://bucket/prefix" for S3,
+// configured from the standard AWS environment variables, "mem://" for a
+// new Memory, or, if rawURL is empty, root on local disk.
+func Open(rawURL, root string) (Storage, error) {
+	if rawURL == "" {
+		return NewLocal(root), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage %q: %w", rawURL, err)
+	}
+	switch u.Scheme {
+	case "s3":
+		return NewS3(u.Host, strings.Trim(u.Path, "/"))
+	case "mem":
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("invalid storage %q: unknown scheme %q", rawURL, u.Scheme)
+}
+
+// busy reports a second upload of a file already being received.
+func busy(name string) error {
+	return fmt.Errorf("%w: %q is already being received", wire.ErrRejected, name)
+}
+
+// Local keeps files in a directory. Files being received are written to
+// hidden temp files next to where they go, or in Staging if set, and
+// moved into place. It never writes through a symlink under Root.
+type Local struct {
+	Root string
+	// Staging holds files being received instead, e.g. on a faster disk
+	// than Root; they are copied over where rename can't reach Root
+	Staging string
+
+	mu      sync.Mutex
+	pending map[string]*os.File
+}
+
+// NewLocal returns a Local keeping files under root.
+func NewLocal(root string) *Local {
+	return &Local{Root: root, pending: make(map[string]*os.File)}
+}
+
+// Path returns where the file name is stored.
+func (l *Local) Path(name string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(name))
+}
+
+// Create returns an *os.File, so callers may preallocate it or write at
+// offsets.
+func (l *Local) Create(name string) (io.WriteCloser, error) {
+	dir, base := filepath.Split(l.Path(name))
+	if err := wire.CheckNoSymlinks(l.Root, l.Path(name)); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// Again, in case a directory was swapped for a symlink meanwhile
+	if err := wire.CheckNoSymlinks(l.Root, dir); err != nil {
+		return nil, err
+	}
+	if l.Staging != "" {
+		dir = l.Staging
+	}
+	file, err := os.CreateTemp(dir, wire.PartPattern(base))
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp makes it private, stored files are as os.Create makes them
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.pending[name]; ok {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, busy(name)
+	}
+	l.pending[name] = file
+	return file, nil
+}
+
+func (l *Local) take(name string) (*os.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, ok := l.pending[name]
+	if !ok {
+		return nil, fmt.Errorf("%q is not being received", name)
+	}
+	delete(l.pending, name)
+	return file, nil
+}
+
+func (l *Local) Finalize(name string) error {
+	file, err := l.take(name)
+	if err != nil {
+		return err
+	}
+	if err := wire.CheckNoSymlinks(l.Root, l.Path(name)); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := move(file.Name(), l.Path(name)); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+func (l *Local) Abort(name string) error {
+	file, err := l.take(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(file.Name())
+}
+
+// Quarantine moves the file being received as name to path instead of
+// storing it, for a file to be kept out of sight, not discarded. Call it
+// after closing the writer, in place of Finalize or Abort.
+func (l *Local) Quarantine(name, path string) error {
+	file, err := l.take(name)
+	if err != nil {
+		return err
+	}
+	if err := wire.CheckNoSymlinks(l.Root, path); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := move(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+func (l *Local) List(dir string) ([]FileInfo, error) {
+	return wire.ListDir(l.Path(dir))
+}
+
+func (l *Local) Stat(name string) (*FileInfo, error) {
+	info, err := os.Stat(l.Path(name))
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: not a regular file: %w", name, os.ErrNotExist)
+	}
+	return &FileInfo{Name: path.Base(name), Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Open returns an *os.File.
+func (l *Local) Open(name string) (io.ReadCloser, error) {
+	file, err := os.Open(l.Path(name))
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("%s: not a regular file: %w", name, os.ErrNotExist)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Remove also removes the file's checksum sidecar.
+func (l *Local) Remove(name string) error {
+	if _, err := l.Stat(name); err != nil {
+		return err
+	}
+	if err := os.Remove(l.Path(name)); err != nil {
+		return err
+	}
+	for _, p := range []string{hashcache.SidecarPath(l.Path(name)), wire.MarkerPath(l.Path(name))} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Local) Location(name string) string {
+	return l.Path(name)
+}
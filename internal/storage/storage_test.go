@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// store writes data to name through st and finalizes it.
+func store(t *testing.T, st Storage, name, data string) {
+	t.Helper()
+	w, err := st.Create(name)
+	if err != nil {
+		t.Fatalf("Create(%q): %v", name, err)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Finalize(name); err != nil {
+		t.Fatalf("Finalize(%q): %v", name, err)
+	}
+}
+
+// content returns what the stored file name holds.
+func content(t *testing.T, st Storage, name string) string {
+	t.Helper()
+	r, err := st.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", name, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func listed(t *testing.T, st Storage, dir string) []string {
+	t.Helper()
+	infos, err := st.List(dir)
+	if err != nil {
+		t.Fatalf("List(%q): %v", dir, err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	return names
+}
+
+// testStorage checks what every backend must do.
+func testStorage(t *testing.T, st Storage) {
+	// Nothing shows until Finalize
+	w, err := st.Create("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "hello")
+	if _, err := st.Stat("a.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat before Finalize: got %v, want ErrNotExist", err)
+	}
+	if slices.Contains(listed(t, st, ""), "a.txt") {
+		t.Error("listed before Finalize")
+	}
+	if _, err := st.Create("a.txt"); !errors.Is(err, wire.ErrRejected) {
+		t.Errorf("second Create of a file being received: got %v, want ErrRejected", err)
+	}
+	w.Close()
+	if err := st.Finalize("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := st.Stat("a.txt")
+	if err != nil || info.Name != "a.txt" || info.Size != 5 {
+		t.Errorf("Stat = %+v, %v", info, err)
+	}
+	if got := content(t, st, "a.txt"); got != "hello" {
+		t.Errorf("Open read %q", got)
+	}
+	if loc := st.Location("a.txt"); !strings.Contains(loc, "a.txt") {
+		t.Errorf("Location %q doesn't name the file", loc)
+	}
+
+	// An aborted file leaves nothing, and the name free
+	w, err = st.Create("aborted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "partial")
+	w.Close()
+	if err := st.Abort("aborted"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Stat("aborted"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat after Abort: got %v, want ErrNotExist", err)
+	}
+	store(t, st, "aborted", "second try")
+	if got := content(t, st, "aborted"); got != "second try" {
+		t.Errorf("after Abort and a new upload: %q", got)
+	}
+
+	// Replacing and subdirectories
+	store(t, st, "a.txt", "replaced")
+	if got := content(t, st, "a.txt"); got != "replaced" {
+		t.Errorf("replaced file holds %q", got)
+	}
+	store(t, st, "sub/b.txt", "b")
+	if got := listed(t, st, "sub"); !slices.Equal(got, []string{"b.txt"}) {
+		t.Errorf("List(sub) = %v", got)
+	}
+	if got := listed(t, st, ""); !slices.Contains(got, "a.txt") || slices.Contains(got, "b.txt") {
+		t.Errorf("List() = %v", got)
+	}
+
+	if err := st.Remove("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{st.Remove("a.txt"), func() error { _, err := st.Open("a.txt"); return err }(), func() error { _, err := st.Stat("a.txt"); return err }()} {
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("removed file: got %v, want ErrNotExist", err)
+		}
+	}
+	if err := st.Finalize("never created"); err == nil {
+		t.Error("Finalize of a file never created succeeded")
+	}
+}
+
+func TestLocal(t *testing.T) {
+	testStorage(t, NewLocal(t.TempDir()))
+}
+
+func TestMemory(t *testing.T) {
+	testStorage(t, NewMemory())
+}
+
+// A Local's file being received is hidden, and aborting it leaves no trace.
+func TestLocalPending(t *testing.T) {
+	root := t.TempDir()
+	l := NewLocal(root)
+	w, err := l.Create("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), ".") {
+		t.Errorf("while receiving the directory holds %v, want one hidden file", entries)
+	}
+	w.Close()
+	l.Abort("f")
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("Abort left %v", entries)
+	}
+}
+
+// Files staged elsewhere land under Root.
+func TestLocalStaging(t *testing.T) {
+	root, staging := t.TempDir(), t.TempDir()
+	l := NewLocal(root)
+	l.Staging = staging
+	store(t, l, "f", "staged")
+	if got, _ := os.ReadFile(filepath.Join(root, "f")); string(got) != "staged" {
+		t.Errorf("stored %q", got)
+	}
+	if entries, _ := os.ReadDir(staging); len(entries) != 0 {
+		t.Errorf("staging directory left with %v", entries)
+	}
+}
+
+func TestLocalSymlink(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	os.Symlink(outside, filepath.Join(root, "link"))
+	if _, err := NewLocal(root).Create("link/f"); err == nil {
+		t.Error("Create wrote through a symlink")
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("wrote %v outside the root", entries)
+	}
+}
+
+// The Memory's writer must be closed before Finalize.
+func TestMemoryUnclosed(t *testing.T) {
+	m := NewMemory()
+	w, _ := m.Create("f")
+	io.WriteString(w, "x")
+	if err := m.Finalize("f"); err == nil {
+		t.Error("finalized an open writer")
+	}
+	w.Close()
+	if _, err := w.Write([]byte("x")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("write after Close: got %v", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"", true},
+		{"mem://", true},
+		{"ftp://host/dir", false},
+		{"s3:///prefix", false},
+		{"s3://bucket/prefix", false}, // No credentials
+		{"%zz", false},
+	}
+	for _, tt := range tests {
+		st, err := Open(tt.url, t.TempDir())
+		if (err == nil) != tt.ok {
+			t.Errorf("Open(%q) = %T, %v", tt.url, st, err)
+		}
+	}
+	if st, _ := Open("", "root"); st.(*Local).Root != "root" {
+		t.Error("empty URL isn't the local root")
+	}
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/wire"
+)
+
+// Completion is what the completion marker of a stored file records, see
+// Config.CompletionMarker.
+type Completion struct {
+	Name      string    `json:"name"` // As the client sent it
+	Path      string    `json:"path"` // Where the file is stored, in CompletedDir if set
+	Size      int64     `json:"size"`
+	Hash      string    `json:"hash"` // "<algorithm>:<hex digest>", e.g. "sha256:9f86..."
+	Completed time.Time `json:"completed"`
+}
+
+// completes reports whether st does anything with a file once it is done
+// with it.
+func (st *Store) completes() bool {
+	return st.CompletionMarker || st.CompletedDir != ""
+}
+
+// openCompletion checks the completion settings, local disk only, and
+// creates CompletedDir.
+func (st *Store) openCompletion() error {
+	if !st.completes() {
+		return nil
+	}
+	if st.local == nil {
+		st.log.Warn("Completion markers and -completed-dir only apply to local storage, ignoring them", "storage", st.Config.Storage)
+		st.CompletionMarker, st.CompletedDir = false, ""
+		return nil
+	}
+	if st.CompletedDir == "" {
+		return nil
+	}
+	// Both record where a file is stored, which the move would make stale
+	if st.Tokens != nil || st.Config.Dedupe {
+		return errors.New("a completed directory can't be combined with retrieval tokens or deduplication")
+	}
+	root, err := filepath.Abs(st.Root)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(st.CompletedDir)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(root, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("completed directory %s must be outside the upload directory", st.CompletedDir)
+	}
+	if err := os.MkdirAll(st.CompletedDir, 0755); err != nil {
+		return fmt.Errorf("error creating completed directory: %w", err)
+	}
+	return nil
+}
+
+// clearMarkers removes the markers left by an earlier file at path, which
+// a file about to be stored there replaces, so none vouches for it before
+// its own. They go before the file is visible.
+func (st *Store) clearMarkers(path string) {
+	if !st.CompletionMarker {
+		return
+	}
+	paths := []string{path}
+	if moved, err := st.completedPath(path); err == nil {
+		paths = append(paths, moved)
+	}
+	for _, p := range paths {
+		if err := os.Remove(wire.MarkerPath(p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			st.log.Warn("Error removing stale completion marker", "path", wire.MarkerPath(p), "err", err)
+		}
+	}
+}
+
+// completedPath returns where CompletedDir keeps the file stored at path,
+// at the same place relative to it as under Root.
+func (st *Store) completedPath(path string) (string, error) {
+	if st.CompletedDir == "" {
+		return "", errors.New("no completed directory")
+	}
+	rel, err := filepath.Rel(st.Root, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(st.CompletedDir, rel), nil
+}
+
+// complete is the last step of storing a file, once hooked is closed: the
+// hooks are done, as are its checksum sidecar and index entry. It moves
+// the file to CompletedDir and writes its completion marker, in that
+// order. Hooks running in the background are waited for on a goroutine of
+// its own, which Close waits for. Failures are logged: the file is stored
+// either way.
+func (st *Store) complete(c Completion, hooked <-chan struct{}) {
+	if !st.completes() {
+		return
+	}
+	select {
+	case <-hooked:
+		st.completeNow(c)
+	default:
+		st.completing.Add(1)
+		go func() {
+			defer st.completing.Done()
+			<-hooked
+			st.completeNow(c)
+		}()
+	}
+}
+
+func (st *Store) completeNow(c Completion) {
+	if st.CompletedDir != "" {
+		moved, err := st.moveCompleted(c.Path)
+		if err != nil {
+			// Without the move the file isn't complete, so it gets no marker
+			st.log.Warn("Error moving file to completed directory", "path", c.Path, "err", err)
+			return
+		}
+		st.log.Info("Moved to completed directory", "path", moved)
+		c.Path = moved
+	}
+	if st.CompletionMarker {
+		c.Completed = time.Now().UTC()
+		if err := writeMarker(c); err != nil {
+			st.log.Warn("Error writing completion marker", "path", wire.MarkerPath(c.Path), "err", err)
+		}
+	}
+}
+
+// moveCompleted moves the stored file at path, with its checksum sidecar,
+// to CompletedDir, taking it out of the index. It returns where it went.
+func (st *Store) moveCompleted(path string) (string, error) {
+	moved, err := st.completedPath(path)
+	if err != nil {
+		return "", err
+	}
+	if err := wire.CheckNoSymlinks(st.CompletedDir, moved); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(moved), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path, moved); err != nil {
+		return "", err
+	}
+	if err := os.Rename(hashcache.SidecarPath(path), hashcache.SidecarPath(moved)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		st.log.Warn("Checksum sidecar not moved", "path", path, "err", err)
+	}
+	if st.Index != nil {
+		st.Index.Remove(st.Name(path))
+	}
+	return moved, nil
+}
+
+// writeMarker writes c next to the file as .<name>.done, under a
+// temporary name first so it only appears once complete and on disk.
+func writeMarker(c Completion) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir, name := filepath.Split(c.Path)
+	f, err := os.CreateTemp(dir, "."+name+wire.MARKER_SUFFIX+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), wire.MarkerPath(c.Path))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
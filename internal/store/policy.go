@@ -0,0 +1,145 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"socket-file-transfer/internal/filter"
+	"socket-file-transfer/internal/retention"
+)
+
+// Policy holds the settings of a Store that may change while it serves,
+// see Live.
+type Policy struct {
+	MaxFileSize  int64
+	ReserveSpace int64
+	AcceptExt    []string
+	RejectExt    []string
+	SniffTypes   []string
+	Retention    retention.Policy
+}
+
+// Equal reports whether p and q are the same settings.
+func (p Policy) Equal(q Policy) bool {
+	return p.MaxFileSize == q.MaxFileSize && p.ReserveSpace == q.ReserveSpace &&
+		slices.Equal(p.AcceptExt, q.AcceptExt) && slices.Equal(p.RejectExt, q.RejectExt) &&
+		slices.Equal(p.SniffTypes, q.SniffTypes) && p.Retention == q.Retention
+}
+
+// policy is a Policy in force, with the Filter it makes.
+type policy struct {
+	Policy
+	filter *filter.Filter
+}
+
+func newPolicy(p Policy) *policy {
+	return &policy{Policy: p, filter: filter.New(p.AcceptExt, p.RejectExt, p.SniffTypes)}
+}
+
+// Live is a Policy that can be replaced while the Stores following it
+// serve, e.g. those of the servers of one process. A transfer keeps the
+// policy it was placed under; those placed after Set get the new one. A
+// changed retention policy is enforced at once. It is safe for concurrent
+// use.
+type Live struct {
+	p atomic.Pointer[policy]
+
+	mu     sync.Mutex
+	stores map[*Store]bool
+}
+
+// NewLive returns a Live starting out as p.
+func NewLive(p Policy) *Live {
+	l := &Live{stores: make(map[*Store]bool)}
+	l.p.Store(newPolicy(p))
+	return l
+}
+
+// Policy returns the policy in force.
+func (l *Live) Policy() Policy {
+	return l.p.Load().Policy
+}
+
+// Set puts p in force, returning once the Stores following l have
+// restarted retention under it.
+func (l *Live) Set(p Policy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.p.Store(newPolicy(p))
+	for st := range l.stores {
+		st.retain(p.Retention)
+	}
+}
+
+// Sweep enforces the retention policy now on the directories of the local
+// Stores following l, once each, returning once they are done.
+func (l *Live) Sweep() error {
+	l.mu.Lock()
+	roots := make(map[string]*Store)
+	for st := range l.stores {
+		if st.local != nil {
+			roots[st.Root] = st
+		}
+	}
+	l.mu.Unlock()
+	var errs []error
+	for _, st := range roots {
+		if err := st.sweep(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", st.Root, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *Live) load() *policy {
+	return l.p.Load()
+}
+
+func (l *Live) follow(st *Store) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stores[st] = true
+	st.retain(l.load().Retention)
+}
+
+func (l *Live) unfollow(st *Store) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.stores, st)
+}
+
+// retain enforces p from now on, restarting the Pruner if it changed.
+func (st *Store) retain(p retention.Policy) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed || p == st.retention {
+		return
+	}
+	st.retention = p
+	if st.local == nil {
+		if p.Enabled() {
+			st.log.Warn("Retention only applies to local storage, ignoring it", "storage", st.Config.Storage)
+		}
+		return
+	}
+	st.pruner.Close()
+	// Enforce retention now, periodically and after each transfer
+	st.pruner = retention.Start(st.Root, p, st.Index, st.log)
+}
+
+// sweep runs a retention pass now, see Live.Sweep.
+func (st *Store) sweep() error {
+	st.mu.Lock()
+	pr := st.pruner
+	st.mu.Unlock()
+	return pr.Sweep()
+}
+
+func (st *Store) pruned() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruner.Stored()
+}
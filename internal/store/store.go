@@ -0,0 +1,920 @@
+// Package store puts received files into a server's storage, see
+// internal/storage. It is the part of receiving a file that doesn't depend
+// on how the file arrives: checking its name and size against the
+// server's rules, placing it by the layout, writing and hashing it,
+// committing it, running the hooks and recording its checksum.
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/archive"
+	"socket-file-transfer/internal/checksum"
+	"socket-file-transfer/internal/dedupe"
+	"socket-file-transfer/internal/filter"
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/hook"
+	"socket-file-transfer/internal/index"
+	"socket-file-transfer/internal/layout"
+	"socket-file-transfer/internal/manifest"
+	"socket-file-transfer/internal/prealloc"
+	"socket-file-transfer/internal/retention"
+	"socket-file-transfer/internal/scan"
+	"socket-file-transfer/internal/sparse"
+	"socket-file-transfer/internal/storage"
+	"socket-file-transfer/internal/tokens"
+	"socket-file-transfer/internal/wire"
+)
+
+// Config holds a server's storage settings, see tcpft.Server.
+type Config struct {
+	Root          string
+	PerClientDirs bool
+	Layout        string
+	Policy
+	Live          *Live // Followed in place of Policy if set
+	NoPreallocate bool
+	HookCommand   string
+	HookURL       string
+	HookStrict    bool
+	Storage       string // storage.Open URL, Root on local disk if empty
+	AutoExtract   bool   // Unpack stored archives next to them, on local disk
+	Dedupe        bool   // Keep one copy of identical files, see internal/dedupe, on local disk
+	StagingDir    string // Receive files here rather than next to where they go, on local disk
+
+	// MaxExtractSize is what the files unpacked from one archive may total,
+	// the policy's MaxFileSize if 0, which also bounds each of them, or
+	// archive.DefaultMaxTotal without one, and MaxExtractEntries how many
+	// entries it may hold, see archive.Limits
+	MaxExtractSize    int64
+	MaxExtractEntries int
+
+	// CompletionMarker writes .<name>.done next to each stored file as the
+	// last step of storing it, and CompletedDir, outside Root, moves the
+	// file there just before; on local disk, see complete
+	CompletionMarker bool
+	CompletedDir     string
+
+	// Tokens issues a retrieval token for each stored file, on local disk
+	Tokens *tokens.Store
+
+	// SizeLimit replaces the policy's MaxFileSize if not 0, and Quota is
+	// what the stored files may total, on local disk, as for a tenant, see
+	// internal/tenant
+	SizeLimit int64
+	Quota     int64
+
+	// ScanCommand checks each file before it is stored, see internal/scan,
+	// ScanTimeout long at most; on local disk only
+	ScanCommand          string
+	ScanTimeout          time.Duration
+	ScanPromoteOnTimeout bool // Store files whose scan timed out rather than quarantine them
+}
+
+// Store is an upload directory in use by a server.
+type Store struct {
+	Config
+	Storage storage.Storage
+	Hooks   *hook.Runner
+	Dedupe  *dedupe.Index // With Config.Dedupe on local disk, else nil
+	Index   *index.Index  // Of the files stored on local disk, else nil
+	Scanner *scan.Scanner
+
+	local *storage.Local // Storage if on local disk, else nil
+	live  *Live          // Config.Live, or one of its own holding Config.Policy
+	log   *slog.Logger
+
+	completing sync.WaitGroup // Files waiting for their hooks to complete
+
+	mu        sync.Mutex
+	pruner    *retention.Pruner
+	retention retention.Policy // What pruner enforces
+	closed    bool
+}
+
+// Open creates the upload directory if needed, opens the storage and
+// starts the hooks and retention c asks for. Root stays a local directory
+// with remote storage, holding the quarantine and client directories.
+func Open(c Config, log *slog.Logger) (*Store, error) {
+	if err := os.MkdirAll(c.Root, 0755); err != nil {
+		return nil, fmt.Errorf("error creating uploads directory: %w", err)
+	}
+	backend, err := storage.Open(c.Storage, c.Root)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := backend.(*storage.Local); !ok && c.ScanCommand != "" {
+		return nil, errors.New("files can only be scanned on local storage")
+	}
+	st := &Store{
+		Config:  c,
+		Storage: backend,
+		Hooks:   hook.New(c.HookCommand, c.HookURL, c.HookStrict, filepath.Join(c.Root, wire.QUARANTINE_DIR), log),
+		Scanner: scan.New(c.ScanCommand, c.ScanTimeout, c.ScanPromoteOnTimeout, log),
+		live:    c.Live,
+		log:     log,
+	}
+	st.local, _ = backend.(*storage.Local)
+	if st.local != nil {
+		if st.Index, err = index.Open(c.Root, log); err != nil {
+			return nil, err
+		}
+	}
+	if st.live == nil {
+		st.live = NewLive(c.Policy)
+	}
+	st.live.follow(st)
+	if c.StagingDir != "" {
+		if st.local == nil {
+			log.Warn("A staging directory only applies to local storage, ignoring it", "storage", c.Storage)
+		} else if err := st.openStaging(log); err != nil {
+			st.Close()
+			return nil, err
+		}
+	}
+	if err := st.openCompletion(); err != nil {
+		st.Close()
+		return nil, err
+	}
+	if c.Quota > 0 && st.local == nil {
+		log.Warn("A quota only applies to local storage, ignoring it", "storage", c.Storage)
+	}
+	if c.Dedupe {
+		if st.local == nil {
+			log.Warn("Deduplication only applies to local storage, ignoring it", "storage", c.Storage)
+		} else if st.Dedupe, err = dedupe.Open(c.Root, st.Index, log); err != nil {
+			st.Close()
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// openStaging has files received into StagingDir, removing those that
+// transfers interrupted long ago left there.
+func (st *Store) openStaging(log *slog.Logger) error {
+	if err := os.MkdirAll(st.StagingDir, 0755); err != nil {
+		return fmt.Errorf("error creating staging directory: %w", err)
+	}
+	removed, err := storage.CleanStaging(st.StagingDir)
+	if err != nil {
+		return fmt.Errorf("error cleaning staging directory: %w", err)
+	}
+	for _, path := range removed {
+		log.Info("Removed stale staging file", "path", path)
+	}
+	st.local.Staging = st.StagingDir
+	return nil
+}
+
+// Local reports whether files are stored on local disk, at the paths
+// Place returns.
+func (st *Store) Local() bool {
+	return st.local != nil
+}
+
+// Name returns the Storage name of the file at path under Root, "" for
+// Root itself.
+func (st *Store) Name(path string) string {
+	rel, err := filepath.Rel(st.Root, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	if rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Close waits for hooks started in the background and the files
+// completing after them, stops retention and saves the index.
+func (st *Store) Close() {
+	st.Hooks.Wait()
+	st.completing.Wait()
+	st.live.unfollow(st)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.closed = true
+	st.pruner.Close()
+	if st.Index != nil {
+		if err := st.Index.Close(); err != nil {
+			st.log.Error("Error closing uploads index", "err", err)
+		}
+	}
+}
+
+// List describes the stored files directly in dir, "" for the root, from
+// the index on local disk.
+func (st *Store) List(dir string) ([]storage.FileInfo, error) {
+	if st.Index != nil {
+		return st.Index.List(dir)
+	}
+	return st.Storage.List(dir)
+}
+
+// Stat describes the stored file name, from the index on local disk,
+// failing with an error wrapping os.ErrNotExist if there is none.
+func (st *Store) Stat(name string) (*storage.FileInfo, error) {
+	if st.Index == nil {
+		return st.Storage.Stat(name)
+	}
+	e, ok := st.Index.Stat(name)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return &storage.FileInfo{Name: path.Base(name), Size: e.Size, ModTime: e.ModTime}, nil
+}
+
+// Remove removes the stored file name, and from the index.
+func (st *Store) Remove(name string) error {
+	if err := st.Storage.Remove(name); err != nil {
+		return err
+	}
+	if st.Index != nil {
+		st.Index.Remove(name)
+	}
+	return nil
+}
+
+// ClientRoot returns the directory the client at addr stores files in,
+// creating it for PerClientDirs.
+func (st *Store) ClientRoot(addr net.Addr) (string, error) {
+	if !st.PerClientDirs {
+		return st.Root, nil
+	}
+	root := filepath.Join(st.Root, wire.ClientDir(addr))
+	if err := wire.CheckNoSymlinks(st.Root, root); err != nil {
+		return "", fmt.Errorf("%w: %w", wire.ErrRejected, err)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", fmt.Errorf("%w: error creating client directory: %w", wire.ErrRejected, err)
+	}
+	return root, nil
+}
+
+// Stored records that a file was stored at path with the given digest,
+// once its hooks succeeded.
+func (st *Store) Stored(path string, algo checksum.Algorithm, sum []byte) {
+	if st.local != nil {
+		// Seed the checksum cache so later skip-identical checks don't
+		// rehash, and later checks know what the file was received as
+		hashcache.Store(path, algo, sum)
+		if err := st.Index.Add(st.Name(path)); err != nil {
+			st.log.Warn("File not indexed", "path", path, "err", err)
+		}
+	}
+	st.pruned()
+}
+
+// checkQuota fails with ErrNoSpace if storing n more bytes would take the
+// stored files past the Quota.
+func (st *Store) checkQuota(n int64) error {
+	if st.Quota <= 0 || st.Index == nil {
+		return nil
+	}
+	if total := st.Index.TotalBytes(); total+n > st.Quota {
+		return fmt.Errorf("%w: %d more bytes would take the %d stored past the quota of %d", wire.ErrNoSpace, n, total, st.Quota)
+	}
+	return nil
+}
+
+// needsSum reports whether st needs the SHA-256 of each file it stores,
+// whatever the client checks it with.
+func (st *Store) needsSum() bool {
+	return st.Hooks != nil || st.Dedupe != nil || st.Scanner != nil || layout.NeedsSum(st.Layout)
+}
+
+// Incoming is a file being received into a Store.
+type Incoming struct {
+	Name string // As the client sent it
+	Path string // Where the file goes under Root, final after Commit
+	Size int64  // As announced, -1 if unknown
+
+	// Sparse is set before Create for a file whose holes arrive through
+	// Hole or AddHole, so it isn't preallocated, which would fill them in
+	Sparse bool
+
+	// Linked is set by Commit when the file was stored as a hard link to
+	// this identical stored file, see Config.Dedupe
+	Linked string
+
+	// Token is set by Commit to the retrieval token it issued for the
+	// file, see Config.Tokens
+	Token string
+
+	// Hash is set before Create to what the client checks the file with,
+	// see Digest. Other than SHA-256, the file's SHA-256 is only computed
+	// if the store needs it.
+	Hash checksum.Algorithm
+
+	st     *Store
+	policy *policy // In force when the file was placed
+	client string
+	final  func(sum []byte) (string, error)
+	log    *slog.Logger
+
+	w       io.WriteCloser
+	hasher  hash.Hash // SHA-256, nil if not needed
+	check   hash.Hash // Of Hash if not SHA-256, else nil
+	hashes  io.Writer // Both, through pipe once Buffer was called
+	pipe    *checksum.Pipe
+	sniff   *filter.Sniffer
+	written int64
+	start   time.Time
+	closed  bool
+	done    bool
+
+	mu     sync.Mutex
+	status string // What Commit or AddWritten is doing, see Status
+}
+
+// Place checks the file name of size bytes, -1 if unknown, from the
+// client at addr against st's rules and works out where it goes, without
+// creating it. sum is the file's SHA-256 if the client sent it. The name
+// must have passed wire.CheckName.
+func (st *Store) Place(addr net.Addr, name string, size int64, sum []byte, log *slog.Logger) (*Incoming, error) {
+	policy := st.live.load()
+	if st.SizeLimit > 0 {
+		limited := *policy
+		limited.MaxFileSize = st.SizeLimit
+		policy = &limited
+	}
+	if policy.MaxFileSize > 0 && size > policy.MaxFileSize {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", wire.ErrTooLarge, size, policy.MaxFileSize)
+	}
+	if size > 0 {
+		if err := st.checkQuota(size); err != nil {
+			return nil, err
+		}
+	}
+	// Remote storage can't move a file once stored
+	if st.local == nil && sum == nil && layout.NeedsSum(st.Layout) {
+		return nil, fmt.Errorf("%w: the layout needs the file's checksum up front", wire.ErrRejected)
+	}
+
+	root, err := st.ClientRoot(addr)
+	if err != nil {
+		return nil, err
+	}
+	local := wire.LocalName(root, name)
+	if local != name {
+		log.Info("Storing under a name valid here", "name", name, "stored", local)
+	}
+	if err := policy.filter.CheckName(local, log); err != nil {
+		return nil, err
+	}
+	// Consumers trust a marker to mean its file is complete
+	if st.CompletionMarker && wire.IsMarker(filepath.Base(local)) {
+		return nil, fmt.Errorf("%w: %s is the name of a completion marker", wire.ErrRejected, name)
+	}
+	fields := layout.Fields{Time: time.Now(), Client: wire.ClientDir(addr), Name: local, Sum: sum}
+	path, final, err := layout.Place(root, st.Layout, fields)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", wire.ErrRejected, err)
+	}
+	return &Incoming{Name: name, Path: path, Size: size, st: st, policy: policy, client: wire.ClientName(addr), final: final, log: log}, nil
+}
+
+// FinalPath returns where the file belongs once its SHA-256 is known,
+// usually Path.
+func (in *Incoming) FinalPath(sum []byte) (string, error) {
+	return in.final(sum)
+}
+
+// Upload describes the file for hooks once stored at path.
+func (in *Incoming) Upload(path string, size int64, sum []byte) hook.Upload {
+	return hook.Upload{Path: in.st.Storage.Location(in.st.Name(path)), Name: in.Name, Client: in.client, Size: size, SHA256: hex.EncodeToString(sum)}
+}
+
+// StoredName returns where the file goes under Root, as Store.Name does,
+// final after Commit.
+func (in *Incoming) StoredName() string {
+	return in.st.Name(in.Path)
+}
+
+// Create starts writing the file, refusing up front one that can't fit
+// on local disk rather than failing halfway. Once it succeeds the caller
+// must call Close.
+func (in *Incoming) Create() error {
+	if in.Size >= 0 && in.st.local != nil {
+		if err := prealloc.Check(filepath.Dir(in.Path), in.Size, in.policy.ReserveSpace); err != nil {
+			return err
+		}
+		// The file is written there first, and needs room in both
+		if in.st.local.Staging != "" {
+			if err := prealloc.Check(in.st.local.Staging, in.Size, in.policy.ReserveSpace); err != nil {
+				return err
+			}
+		}
+	}
+	name := in.st.Name(in.Path)
+	w, err := in.st.Storage.Create(name)
+	if err != nil {
+		return fmt.Errorf("%w: error creating output file: %w", wire.ErrRejected, err)
+	}
+	if file, ok := w.(*os.File); ok && in.Size > 0 && !in.st.NoPreallocate && !in.Sparse {
+		if err := prealloc.Allocate(file, in.Size); err != nil {
+			file.Close()
+			in.st.Storage.Abort(name)
+			return fmt.Errorf("%w: error preallocating output file: %w", wire.ErrRejected, err)
+		}
+	}
+	in.w = w
+	var hashes []io.Writer
+	if in.Hash == checksum.SHA256 || in.st.needsSum() {
+		in.hasher = sha256.New()
+		hashes = append(hashes, in.hasher)
+	}
+	if in.Hash != checksum.SHA256 {
+		in.check = in.Hash.New()
+		hashes = append(hashes, in.check)
+	}
+	in.hashes = io.MultiWriter(hashes...)
+	in.sniff = in.policy.filter.Sniffer(in.Name, in.log)
+	in.start = time.Now()
+	return nil
+}
+
+// Write appends p to the file. It fails once the file exceeds the size
+// limit or its content is refused, so the transfer can stop early.
+func (in *Incoming) Write(p []byte) (int, error) {
+	if err := in.checkSize(int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := in.w.Write(p)
+	if err != nil {
+		in.written += int64(n)
+		return n, prealloc.NoSpace(fmt.Errorf("error writing to file: %w", err))
+	}
+	return n, in.Add(p)
+}
+
+// Buffer returns a buffer of size bytes, from the pool of package
+// buffers, to read the file's next bytes into and pass to Write, which
+// then hashes them on a goroutine of its own, overlapping the next read
+// and write. The buffer must be left alone until Buffer returns it again,
+// and not used once the Incoming is closed. It must be called after
+// Create.
+func (in *Incoming) Buffer(size int) []byte {
+	if in.pipe == nil {
+		in.pipe = checksum.NewPipe(in.hashes, size)
+		in.hashes = in.pipe
+	}
+	return in.pipe.Next()
+}
+
+// WriterAt returns a writer for the file's bytes at their offsets, and
+// whether they may be written in any order; if not, the storage needs
+// them in order. Whatever is written through it must also be passed to
+// Add, in order.
+func (in *Incoming) WriterAt() (io.WriterAt, bool) {
+	if w, ok := in.w.(io.WriterAt); ok {
+		return w, true
+	}
+	return inOrder{in.w}, false
+}
+
+// inOrder writes to storage that only appends, ignoring the offsets.
+type inOrder struct {
+	w io.Writer
+}
+
+func (o inOrder) WriteAt(p []byte, off int64) (int, error) {
+	return o.w.Write(p)
+}
+
+// Add counts, hashes and sniffs p, the next bytes of a file written
+// through WriterAt, failing like Write.
+func (in *Incoming) Add(p []byte) error {
+	if err := in.checkSize(int64(len(p))); err != nil {
+		return err
+	}
+	in.written += int64(len(p))
+	in.hashes.Write(p)
+	_, err := in.sniff.Write(p)
+	return err
+}
+
+// AddWritten passes the rest of the file's first n bytes to Add once they
+// were written through WriterAt in no particular order, reading them back.
+// Only storage that can be read back, local disk, supports it.
+func (in *Incoming) AddWritten(n int64) error {
+	r, ok := in.w.(io.ReaderAt)
+	if !ok {
+		return fmt.Errorf("%w: the storage can't read back the file", wire.ErrRejected)
+	}
+	buffer := make([]byte, 1<<20)
+	for in.written < n {
+		in.setStatus(fmt.Sprintf("hashing %d%%", in.written*100/n))
+		m, err := r.ReadAt(buffer[:min(int64(len(buffer)), n-in.written)], in.written)
+		if m > 0 {
+			if err := in.Add(buffer[:m]); err != nil {
+				return err
+			}
+		}
+		if err != nil && in.written < n {
+			return fmt.Errorf("error reading back file: %w", err)
+		}
+	}
+	return nil
+}
+
+// Hole skips the next n bytes of the file, which read as zeros. On local
+// disk they are seeked past, leaving a hole; other storage gets the zeros
+// written.
+func (in *Incoming) Hole(n int64) error {
+	file, ok := in.w.(*os.File)
+	if !ok {
+		return sparse.WriteZeros(in, n)
+	}
+	if err := in.AddHole(n); err != nil {
+		return err
+	}
+	if _, err := file.Seek(n, io.SeekCurrent); err != nil {
+		return fmt.Errorf("error seeking in file: %w", err)
+	}
+	// A hole at the end only counts once the file is that long
+	if err := file.Truncate(in.written); err != nil {
+		return prealloc.NoSpace(fmt.Errorf("error writing to file: %w", err))
+	}
+	return nil
+}
+
+// AddHole counts, hashes and sniffs the next n bytes of a file written
+// through WriterAt as zeros without writing them, failing like Add.
+func (in *Incoming) AddHole(n int64) error {
+	if err := in.checkSize(n); err != nil {
+		return err
+	}
+	in.written += n
+	return sparse.WriteZeros(io.MultiWriter(in.hashes, in.sniff), n)
+}
+
+func (in *Incoming) checkSize(n int64) error {
+	if in.policy.MaxFileSize > 0 && in.written+n > in.policy.MaxFileSize {
+		return fmt.Errorf("%w: more than the limit of %d bytes", wire.ErrTooLarge, in.policy.MaxFileSize)
+	}
+	// Place checked a file of known size
+	if in.Size < 0 {
+		return in.st.checkQuota(in.written + n)
+	}
+	return nil
+}
+
+// Sync flushes the file to stable storage, if the storage supports it.
+func (in *Incoming) Sync() error {
+	if s, ok := in.w.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil {
+			return prealloc.NoSpace(fmt.Errorf("error writing to file: %w", err))
+		}
+	}
+	return nil
+}
+
+// Written returns how many bytes were written so far.
+func (in *Incoming) Written() int64 {
+	return in.written
+}
+
+// Started returns when Create was called.
+func (in *Incoming) Started() time.Time {
+	return in.start
+}
+
+// Sum returns the SHA-256 of what was written so far, nil if Hash is
+// another and the store doesn't need it.
+func (in *Incoming) Sum() []byte {
+	if in.hasher == nil {
+		return nil
+	}
+	in.flushHashes()
+	return in.hasher.Sum(nil)
+}
+
+// Digest returns the Hash of what was written so far.
+func (in *Incoming) Digest() []byte {
+	if in.check == nil {
+		return in.Sum()
+	}
+	in.flushHashes()
+	return in.check.Sum(nil)
+}
+
+// flushHashes waits for the hashes to catch up with what was written.
+func (in *Incoming) flushHashes() {
+	if in.pipe != nil {
+		in.pipe.Flush()
+	}
+}
+
+// Status returns what the file is waiting for once received, e.g.
+// "hashing 43%" or "running hooks", "" if nothing yet. It may be called
+// while AddWritten or Commit runs, to keep the client informed.
+func (in *Incoming) Status() string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.status
+}
+
+func (in *Incoming) setStatus(status string) {
+	in.mu.Lock()
+	in.status = status
+	in.mu.Unlock()
+}
+
+// Commit makes the complete file visible where it belongs and runs the
+// hooks, returning the stored file's description, whose Path is its
+// storage Location. A hook failure under HookStrict fails it.
+func (in *Incoming) Commit() (hook.Upload, error) {
+	if in.Size >= 0 && in.written != in.Size {
+		return hook.Upload{}, fmt.Errorf("%w: received %d of %d bytes", wire.ErrProtocol, in.written, in.Size)
+	}
+	if err := in.sniff.Close(); err != nil {
+		return hook.Upload{}, err
+	}
+	in.closed = true
+	if in.st.local == nil {
+		in.setStatus("uploading to storage")
+	} else {
+		in.setStatus("storing")
+	}
+	if err := in.w.Close(); err != nil {
+		return hook.Upload{}, prealloc.NoSpace(fmt.Errorf("error writing to file: %w", err))
+	}
+
+	// Nothing sees the file under its name before the scanner passed it
+	sum := in.Sum()
+	if err := in.scan(sum); err != nil {
+		return hook.Upload{}, err
+	}
+
+	// Move the file where the layout wants it once its checksum is known;
+	// Place made sure that only happens on local disk
+	stored, err := in.final(sum)
+	if err == nil {
+		// Nor an archive that won't be unpacked
+		if err := in.checkArchive(stored); err != nil {
+			return hook.Upload{}, err
+		}
+		in.st.clearMarkers(in.Path)
+		in.st.clearMarkers(stored)
+		err = in.st.Storage.Finalize(in.st.Name(in.Path))
+	}
+	if err != nil {
+		return hook.Upload{}, fmt.Errorf("%w: error storing file: %w", wire.ErrRejected, err)
+	}
+	in.done = true
+	if stored != in.Path {
+		err := wire.CheckNoSymlinks(in.st.Root, stored)
+		if err == nil {
+			err = os.Rename(in.Path, stored)
+		}
+		if err != nil {
+			os.Remove(in.Path)
+			return hook.Upload{}, fmt.Errorf("%w: error storing file: %w", wire.ErrRejected, err)
+		}
+		in.Path = stored
+	}
+
+	// Content stored before is kept once, under both names
+	if in.st.Dedupe != nil {
+		original, err := in.st.Dedupe.Link(stored, in.written, sum)
+		if err != nil {
+			in.log.Warn("File not deduplicated", "path", stored, "err", err)
+		} else if original != "" {
+			in.log.Info("Deduplicated", "path", stored, "original", original)
+			in.Linked = original
+		}
+	}
+
+	upload := in.Upload(stored, in.written, sum)
+	in.setStatus("running hooks")
+	hooked := make(chan struct{})
+	if err := in.st.Hooks.Notify(upload, func() { close(hooked) }); err != nil {
+		return hook.Upload{}, fmt.Errorf("%w: %w", wire.ErrRejected, err)
+	}
+	// SHA-256 when there is one, which skip-identical checks can use
+	algo, digest := checksum.SHA256, sum
+	if sum == nil {
+		algo, digest = in.Hash, in.Digest()
+	}
+	in.st.Stored(stored, algo, digest)
+
+	// A manifest vouches for the files stored next to it
+	if in.st.local != nil && filepath.Base(stored) == manifest.NAME {
+		in.setStatus("checking manifest")
+		if err := in.checkManifest(stored); err != nil {
+			return hook.Upload{}, err
+		}
+	}
+
+	// An archive is unpacked into the directory named after it
+	if in.st.AutoExtract && in.st.local != nil {
+		if dir, _, ok := archive.Split(filepath.Base(stored)); ok {
+			in.setStatus("extracting archive")
+			if err := in.extract(stored, filepath.Join(filepath.Dir(stored), dir), sum); err != nil {
+				return hook.Upload{}, err
+			}
+		}
+	}
+
+	// A file stored without a token is still stored
+	if in.st.Tokens != nil && in.st.local != nil {
+		token, t, err := in.st.Tokens.Issue(in.StoredName())
+		if err != nil {
+			in.log.Warn("No retrieval token issued", "path", stored, "err", err)
+		} else {
+			in.log.Info("Issued retrieval token", "path", stored, "uses", t.Uses, "expires", t.Expires.Format(time.RFC3339))
+			in.Token = token
+		}
+	}
+
+	// Last of all, once hooks running in the background are done too
+	in.st.complete(Completion{Name: in.Name, Path: stored, Size: in.written, Hash: algo.String() + ":" + hex.EncodeToString(digest)}, hooked)
+	return upload, nil
+}
+
+// scan runs the server's scanner on the received file, still under its
+// temporary name. A file it fails is quarantined as for Quarantine, with
+// the scanner's report next to it as <name>.<reason>.scan.
+func (in *Incoming) scan(sum []byte) error {
+	file, ok := in.w.(*os.File)
+	if in.st.Scanner == nil || !ok {
+		return nil
+	}
+	in.setStatus("scanning")
+	u := hook.Upload{Path: file.Name(), Name: in.Name, Client: in.client, Size: in.written, SHA256: hex.EncodeToString(sum)}
+	report, err := in.st.Scanner.Scan(u, func() { in.setStatus("waiting to scan") })
+	if err == nil {
+		return nil
+	}
+
+	reason := "rejected"
+	if errors.Is(err, scan.ErrTimedOut) {
+		reason = "scan-timeout"
+	}
+	path, qerr := in.Quarantine(reason)
+	if qerr != nil {
+		in.log.Error("Error quarantining file", "path", in.Path, "err", qerr)
+		return err
+	}
+	if werr := os.WriteFile(path+".scan", report, 0644); werr != nil {
+		in.log.Warn("Error saving scan report", "path", path+".scan", "err", werr)
+	}
+	return err
+}
+
+// extractLimits returns what an archive the client sent may unpack to:
+// MaxExtractSize and MaxExtractEntries, with the policy's MaxFileSize
+// bounding each file, and the total too unless MaxExtractSize is set.
+func (in *Incoming) extractLimits() archive.Limits {
+	limits := archive.Limits{MaxEntry: in.policy.MaxFileSize, MaxTotal: in.st.MaxExtractSize, MaxEntries: in.st.MaxExtractEntries}
+	if limits.MaxTotal == 0 {
+		limits.MaxTotal = in.policy.MaxFileSize
+	}
+	return limits
+}
+
+// checkArchive refuses with wire.ErrExpansion an archive to be stored at
+// path that goes past extractLimits, see archive.Check, while it is still
+// under its temporary name: one that won't be unpacked is never stored,
+// deduplicated or seen by hooks. Other failures are left to extract.
+func (in *Incoming) checkArchive(path string) error {
+	file, ok := in.w.(*os.File)
+	if !in.st.AutoExtract || !ok {
+		return nil
+	}
+	_, gz, isArchive := archive.Split(filepath.Base(path))
+	if !isArchive {
+		return nil
+	}
+	in.setStatus("checking archive")
+	if err := archive.Check(file.Name(), gz, in.extractLimits()); errors.Is(err, wire.ErrExpansion) {
+		in.log.Warn("Archive refused", "path", path, "err", err)
+		return err
+	}
+	return nil
+}
+
+// extract unpacks the archive stored at path into dir, replacing what dir
+// held, within extractLimits. checkArchive refused one going past them
+// before it was stored; should it still fail with wire.ErrExpansion, it
+// is removed, with its sidecar, index and deduplication entries, as
+// archive.Extract removes what it unpacked of it. An archive failing
+// otherwise stays stored, so -skip-identical still recognizes it when it
+// is sent again.
+func (in *Incoming) extract(path, dir string, sum []byte) error {
+	if strings.HasPrefix(filepath.Base(dir), ".") {
+		return fmt.Errorf("%w: won't extract %s into hidden directory %s", wire.ErrRejected, filepath.Base(path), filepath.Base(dir))
+	}
+	if err := wire.CheckNoSymlinks(in.st.Root, dir); err != nil {
+		return fmt.Errorf("%w: %w", wire.ErrRejected, err)
+	}
+	files, err := archive.Extract(path, dir, in.policy.ReserveSpace, in.extractLimits())
+	if err != nil {
+		in.log.Warn("Archive not extracted", "path", path, "err", err)
+		if errors.Is(err, wire.ErrExpansion) {
+			// Nothing of a decompression bomb is kept, not even the bomb
+			if in.st.Dedupe != nil && sum != nil {
+				if ferr := in.st.Dedupe.Forget(path, sum); ferr != nil {
+					in.log.Warn("Archive past the limits still deduplicated against", "path", path, "err", ferr)
+				}
+			}
+			if rerr := in.st.Remove(in.st.Name(path)); rerr != nil {
+				in.log.Error("Error removing archive past the limits", "path", path, "err", rerr)
+			}
+			return err
+		}
+		if errors.Is(err, wire.ErrNoSpace) {
+			return err
+		}
+		return fmt.Errorf("%w: %w", wire.ErrRejected, err)
+	}
+	in.log.Info("Archive extracted", "path", dir, "files", files)
+	if err := in.st.Index.Refresh(in.st.Name(dir)); err != nil {
+		in.log.Warn("Extracted files not indexed", "path", dir, "err", err)
+	}
+	return nil
+}
+
+// checkManifest checks the files the manifest stored at path lists against
+// it, failing with ErrChecksumMismatch if any are missing or differ. The
+// manifest stays stored either way.
+func (in *Incoming) checkManifest(path string) error {
+	entries, err := manifest.Load(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("%w: %w", wire.ErrRejected, err)
+	}
+	mismatches := manifest.Check(filepath.Dir(path), entries, hashcache.Sum)
+	if len(mismatches) == 0 {
+		in.log.Info("Manifest verified", "path", path, "files", len(entries))
+		return nil
+	}
+	var names []string
+	for _, m := range mismatches {
+		in.log.Warn("File does not match manifest", "manifest", path, "file", m.Path, "err", m.Err)
+		names = append(names, m.Path)
+	}
+	return fmt.Errorf("%w: %d of %d files don't match the manifest: %s", wire.ErrChecksumMismatch, len(mismatches), len(entries), strings.Join(names, ", "))
+}
+
+// Quarantine releases the file without storing it, keeping what was
+// received in the quarantine directory as its name with reason appended,
+// e.g. "report.pdf.truncated", and returning that path. Remote storage
+// can't keep it, so there it is discarded and "" returned. It does nothing
+// before Create or once the file is stored.
+func (in *Incoming) Quarantine(reason string) (string, error) {
+	if in.w == nil || in.done {
+		return "", nil
+	}
+	if !in.closed {
+		// Drop the space preallocated past what arrived
+		if file, ok := in.w.(*os.File); ok {
+			file.Truncate(in.written)
+		}
+		in.closed = true
+		in.w.Close()
+	}
+	name := in.st.Name(in.Path)
+	in.w = nil
+	if in.st.local == nil {
+		return "", in.st.Storage.Abort(name)
+	}
+	path := filepath.Join(in.st.Root, wire.QUARANTINE_DIR, filepath.Base(in.Path)+"."+reason)
+	if err := in.st.local.Quarantine(name, path); err != nil {
+		return "", fmt.Errorf("error quarantining file: %w", err)
+	}
+	in.log.Warn("File quarantined", "path", path, "reason", reason)
+	return path, nil
+}
+
+// Close releases the file, discarding it unless Commit stored it. It may
+// be called more than once, and does nothing before Create.
+func (in *Incoming) Close() {
+	if in.w == nil {
+		return
+	}
+	if in.pipe != nil {
+		in.pipe.Close()
+	}
+	if !in.closed {
+		in.w.Close()
+	}
+	if !in.done {
+		in.st.Storage.Abort(in.st.Name(in.Path))
+	}
+	in.w = nil
+}
@@ -0,0 +1,113 @@
+package tenant
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter holds the transfers sharing it to a rate, letting them burst
+// up to a second's worth of bytes. A nil Limiter doesn't limit. It is
+// safe for concurrent use.
+type Limiter struct {
+	rate float64 // Bytes per second
+
+	mu     sync.Mutex
+	tokens float64 // Bytes that may go now, negative while in debt
+	last   time.Time
+}
+
+// NewLimiter returns a limiter to rate bytes per second.
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// burst returns the most bytes a single read or write through l moves,
+// so none waits much longer than a second.
+func (l *Limiter) burst(n int) int {
+	return min(n, max(int(l.rate), 1))
+}
+
+// wait blocks until moving n more bytes keeps to the rate.
+func (l *Limiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// Reader returns r, reading at l's rate.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r, l}
+}
+
+// Writer returns w, writing at l's rate.
+func (l *Limiter) Writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &limitedWriter{w, l}
+}
+
+// Conn returns c, reading and writing at l's rate.
+func (l *Limiter) Conn(c net.Conn) net.Conn {
+	if l == nil {
+		return c
+	}
+	return &limitedConn{Conn: c, r: limitedReader{c, l}, w: limitedWriter{c, l}}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p[:r.l.burst(len(p))])
+	if n > 0 {
+		r.l.wait(n)
+	}
+	return n, err
+}
+
+type limitedWriter struct {
+	w io.Writer
+	l *Limiter
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:w.l.burst(len(p))]
+		w.l.wait(len(chunk))
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// limitedConn hides the connection's ReadFrom and WriteTo, so a file sent
+// or received through it can't bypass the limit.
+type limitedConn struct {
+	net.Conn
+	r limitedReader
+	w limitedWriter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *limitedConn) Write(p []byte) (int, error) { return c.w.Write(p) }
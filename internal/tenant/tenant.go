@@ -0,0 +1,138 @@
+// Package tenant splits a server among tenants. Each is known by an auth
+// token its clients send, see wire.FEATURE_AUTH, or by the common name of
+// the TLS client certificates they present over QUIC, and gets a
+// directory of its own under the upload directory, which is all its
+// clients see, with its own file size limit, quota and rate limit.
+//
+// A server with tenants refuses clients that aren't one.
+package tenant
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// Tenant is one of the parties sharing a server.
+type Tenant struct {
+	Name        string
+	Token       string // Its clients send this, see wire.WriteAuth; empty if only CN identifies it
+	CN          string // Common name of the TLS client certificates identifying it
+	Dir         string // Its directory under the upload directory, Name if empty
+	MaxFileSize int64  // Replaces the server's limit if not 0
+	Quota       int64  // Bytes its stored files may total, no quota if 0
+	Rate        int64  // Bytes per second its transfers move at most, together; no limit if 0
+
+	limiter *Limiter
+}
+
+// Directory returns the directory of t's files under the upload
+// directory.
+func (t *Tenant) Directory() string {
+	if t.Dir != "" {
+		return t.Dir
+	}
+	return t.Name
+}
+
+// Limiter returns the limiter t's transfers share, nil without Rate.
+func (t *Tenant) Limiter() *Limiter {
+	return t.limiter
+}
+
+// Set is the tenants of a server, looked up by token or common name.
+type Set struct {
+	tenants []*Tenant
+	tokens  map[[sha256.Size]byte]*Tenant
+	cns     map[string]*Tenant
+}
+
+// New returns the set of tenants, failing if one lacks a name or both a
+// token and a common name, or if two share a name, token, common name or
+// directory.
+func New(tenants []Tenant) (*Set, error) {
+	if len(tenants) == 0 {
+		return nil, errors.New("no tenants")
+	}
+	s := &Set{tokens: make(map[[sha256.Size]byte]*Tenant), cns: make(map[string]*Tenant)}
+	names := make(map[string]bool)
+	dirs := make(map[string]string)
+	for i := range tenants {
+		t := &tenants[i]
+		switch {
+		case t.Name == "":
+			return nil, errors.New("tenant without a name")
+		case names[t.Name]:
+			return nil, fmt.Errorf("tenant %s twice", t.Name)
+		case t.Token == "" && t.CN == "":
+			return nil, fmt.Errorf("tenant %s has neither a token nor a cn", t.Name)
+		case len(t.Token) > 255:
+			return nil, fmt.Errorf("tenant %s: token is %d bytes, the limit is 255", t.Name, len(t.Token))
+		case t.MaxFileSize < 0, t.Quota < 0, t.Rate < 0:
+			return nil, fmt.Errorf("tenant %s: negative limit", t.Name)
+		}
+		names[t.Name] = true
+
+		dir := t.Directory()
+		if err := wire.CheckName(dir); err != nil || strings.HasPrefix(dir, ".") {
+			return nil, fmt.Errorf("tenant %s: directory %q is not a plain name", t.Name, dir)
+		}
+		if other, ok := dirs[dir]; ok {
+			return nil, fmt.Errorf("tenants %s and %s share directory %s", other, t.Name, dir)
+		}
+		dirs[dir] = t.Name
+
+		if t.Token != "" {
+			key := sha256.Sum256([]byte(t.Token))
+			if other, ok := s.tokens[key]; ok {
+				return nil, fmt.Errorf("tenants %s and %s share a token", other.Name, t.Name)
+			}
+			s.tokens[key] = t
+		}
+		if t.CN != "" {
+			if other, ok := s.cns[t.CN]; ok {
+				return nil, fmt.Errorf("tenants %s and %s share cn %s", other.Name, t.Name, t.CN)
+			}
+			s.cns[t.CN] = t
+		}
+		if t.Rate > 0 {
+			t.limiter = NewLimiter(t.Rate)
+		}
+		s.tenants = append(s.tenants, t)
+	}
+	sort.Slice(s.tenants, func(i, j int) bool { return s.tenants[i].Name < s.tenants[j].Name })
+	return s, nil
+}
+
+// All returns the tenants by name.
+func (s *Set) All() []*Tenant {
+	return s.tenants
+}
+
+// ByToken returns the tenant whose clients send token.
+func (s *Set) ByToken(token string) (*Tenant, bool) {
+	if token == "" {
+		return nil, false
+	}
+	key := sha256.Sum256([]byte(token))
+	t, ok := s.tokens[key]
+	// The map found it by hash; compare the tokens themselves too
+	if !ok || subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) != 1 {
+		return nil, false
+	}
+	return t, true
+}
+
+// ByCN returns the tenant whose client certificates have common name cn.
+func (s *Set) ByCN(cn string) (*Tenant, bool) {
+	if cn == "" {
+		return nil, false
+	}
+	t, ok := s.cns[cn]
+	return t, ok
+}
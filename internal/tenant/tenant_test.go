@@ -0,0 +1,153 @@
+package tenant
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		tenants []Tenant
+		err     string // Substring of the error, "" for none
+	}{
+		{"token and cn", []Tenant{{Name: "a", Token: "ta"}, {Name: "b", CN: "b.example"}, {Name: "c", Token: "tc", CN: "c", Dir: "team-c"}}, ""},
+		{"none", nil, "no tenants"},
+		{"no name", []Tenant{{Token: "t"}}, "without a name"},
+		{"same name", []Tenant{{Name: "a", Token: "1"}, {Name: "a", Token: "2", Dir: "x"}}, "tenant a twice"},
+		{"no credential", []Tenant{{Name: "a"}}, "neither a token nor a cn"},
+		{"long token", []Tenant{{Name: "a", Token: strings.Repeat("t", 256)}}, "limit is 255"},
+		{"negative quota", []Tenant{{Name: "a", Token: "t", Quota: -1}}, "negative limit"},
+		{"negative rate", []Tenant{{Name: "a", Token: "t", Rate: -1}}, "negative limit"},
+		{"nested dir", []Tenant{{Name: "a", Token: "t", Dir: "x/y"}}, "not a plain name"},
+		{"parent dir", []Tenant{{Name: "a", Token: "t", Dir: ".."}}, "not a plain name"},
+		{"hidden dir", []Tenant{{Name: ".a", Token: "t"}}, "not a plain name"},
+		{"same dir", []Tenant{{Name: "a", Token: "1"}, {Name: "b", Token: "2", Dir: "a"}}, "share directory a"},
+		{"same token", []Tenant{{Name: "a", Token: "t"}, {Name: "b", Token: "t"}}, "share a token"},
+		{"same cn", []Tenant{{Name: "a", CN: "c"}, {Name: "b", CN: "c"}}, "share cn c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.tenants)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("got %v, want no error", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("got %v, want an error about %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// Tenants are found by their exact token or common name only, and listed
+// by name.
+func TestLookup(t *testing.T) {
+	s, err := New([]Tenant{
+		{Name: "zeta", Token: "secret-z", Rate: 1000},
+		{Name: "alpha", Token: "secret-a", CN: "alpha.example", Dir: "team-a"},
+		{Name: "beta", CN: "beta.example"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tn := range s.All() {
+		names = append(names, tn.Name)
+	}
+	if got := strings.Join(names, " "); got != "alpha beta zeta" {
+		t.Errorf("All = %s, want alpha beta zeta", got)
+	}
+
+	for token, want := range map[string]string{"secret-a": "alpha", "secret-z": "zeta", "secret-": "", "secret-aa": "", "": ""} {
+		tn, ok := s.ByToken(token)
+		if ok && tn.Name != want || !ok && want != "" {
+			t.Errorf("ByToken(%q) = %v, %v, want %q", token, tn, ok, want)
+		}
+	}
+	for cn, want := range map[string]string{"alpha.example": "alpha", "beta.example": "beta", "gamma.example": "", "": ""} {
+		tn, ok := s.ByCN(cn)
+		if ok && tn.Name != want || !ok && want != "" {
+			t.Errorf("ByCN(%q) = %v, %v, want %q", cn, tn, ok, want)
+		}
+	}
+
+	alpha, _ := s.ByToken("secret-a")
+	beta, _ := s.ByCN("beta.example")
+	zeta, _ := s.ByToken("secret-z")
+	if alpha.Directory() != "team-a" || beta.Directory() != "beta" {
+		t.Errorf("directories %s and %s, want team-a and beta", alpha.Directory(), beta.Directory())
+	}
+	if alpha.Limiter() != nil || zeta.Limiter() == nil {
+		t.Error("only the tenant with a rate has a limiter")
+	}
+}
+
+// Transfers sharing a limiter move at its rate together, after a burst of
+// a second's worth.
+func TestLimiter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes a second")
+	}
+	const rate = 64 << 10
+	l := NewLimiter(rate)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// One reads, the other writes: both draw from the same budget
+			data := bytes.Repeat([]byte{byte(i)}, rate)
+			if i == 0 {
+				n, err := io.Copy(io.Discard, l.Reader(bytes.NewReader(data)))
+				if n != rate || err != nil {
+					t.Errorf("read %d, %v", n, err)
+				}
+			} else {
+				var buf bytes.Buffer
+				n, err := l.Writer(&buf).Write(data)
+				if n != rate || err != nil || !bytes.Equal(buf.Bytes(), data) {
+					t.Errorf("wrote %d, %v", n, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	// Two seconds' worth, the first of which was the burst
+	if took := time.Since(start); took < 800*time.Millisecond || took > 3*time.Second {
+		t.Errorf("moving %d bytes at %d a second took %v, want about a second", 2*rate, rate, took)
+	}
+}
+
+// A nil Limiter passes everything through, and a limited connection can't
+// be copied to or from around its limit.
+func TestLimiterWrappers(t *testing.T) {
+	var none *Limiter
+	r := strings.NewReader("x")
+	if none.Reader(r) != io.Reader(r) {
+		t.Error("nil Limiter wrapped a reader")
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if none.Conn(a) != a {
+		t.Error("nil Limiter wrapped a connection")
+	}
+	c := NewLimiter(1 << 20).Conn(a)
+	if _, ok := c.(io.ReaderFrom); ok {
+		t.Error("limited connection has ReadFrom")
+	}
+	if _, ok := c.(io.WriterTo); ok {
+		t.Error("limited connection has WriteTo")
+	}
+	go b.Write([]byte("through"))
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "through" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+}
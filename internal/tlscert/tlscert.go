@@ -0,0 +1,120 @@
+// Package tlscert serves a server's certificate from files that may be
+// replaced while it runs, e.g. by an ACME client renewing it, so new
+// handshakes pick up the new certificate without a restart while the
+// connections already made carry on with the old one.
+//
+// A Loader checks the files' modification times at most once every
+// CHECK_INTERVAL, from a handshake, and reads the pair again once either
+// changed; Reload reads it at once. A pair that fails to load, such as a
+// certificate written before its new key, is logged and the old one kept
+// until the files change again.
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Most often a Loader looks at its files for changes
+const CHECK_INTERVAL = time.Minute
+
+// Loader holds the certificate of a PEM certificate and key file pair.
+// It is safe for concurrent use.
+type Loader struct {
+	certFile, keyFile string
+	log               *slog.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime [2]time.Time // Of the files the last load read
+	checked time.Time
+}
+
+// Load returns a Loader serving the pair in certFile and keyFile, failing
+// if it can't be loaded now.
+func Load(certFile, keyFile string, log *slog.Logger) (*Loader, error) {
+	l := &Loader{certFile: certFile, keyFile: keyFile, log: log}
+	modTime, err := l.modTimes()
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate: %w", err)
+	}
+	if err := l.load(modTime); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Config returns a tls.Config serving l's certificate.
+func (l *Loader) Config() *tls.Config {
+	return &tls.Config{GetCertificate: l.GetCertificate}
+}
+
+// GetCertificate returns the certificate, reading the files again first
+// if they changed since and CHECK_INTERVAL passed since the last look.
+func (l *Loader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.checked) >= CHECK_INTERVAL {
+		l.checked = time.Now()
+		if modTime, err := l.modTimes(); err != nil {
+			l.log.Error("Certificate not reloaded, still serving the old one", "cert", l.certFile, "err", err)
+		} else if modTime != l.modTime {
+			l.load(modTime)
+		}
+	}
+	return l.cert, nil
+}
+
+// Reload reads the files again, whether or not they changed, returning
+// the error that kept the old certificate in use, if any.
+func (l *Loader) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.checked = time.Now()
+	modTime, err := l.modTimes()
+	if err != nil {
+		l.log.Error("Certificate not reloaded, still serving the old one", "cert", l.certFile, "err", err)
+		return err
+	}
+	return l.load(modTime)
+}
+
+func (l *Loader) modTimes() ([2]time.Time, error) {
+	var modTime [2]time.Time
+	for i, path := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTime, err
+		}
+		modTime[i] = info.ModTime()
+	}
+	return modTime, nil
+}
+
+// load reads the pair, last modified at modTime, keeping the old one if
+// it fails. Its caller holds l.mu, or l isn't shared yet.
+func (l *Loader) load(modTime [2]time.Time) error {
+	// Not retried until the files change again
+	l.modTime = modTime
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if err != nil {
+		err = fmt.Errorf("error loading certificate: %w", err)
+		if l.cert != nil {
+			l.log.Error("Certificate not reloaded, still serving the old one", "cert", l.certFile, "err", err)
+		}
+		return err
+	}
+	if l.cert != nil {
+		l.log.Info("Certificate reloaded", "cert", l.certFile, "serial", cert.Leaf.SerialNumber.Text(16), "expires", cert.Leaf.NotAfter)
+	}
+	l.cert = &cert
+	return nil
+}
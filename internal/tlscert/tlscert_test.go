@@ -0,0 +1,137 @@
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// writePair writes a self-signed certificate with serial and its key to
+// certFile and keyFile, dated modTime.
+func writePair(t *testing.T, certFile, keyFile string, serial int64, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+// handshake connects to addr and returns the connection and the serial of
+// the certificate it got.
+func handshake(t *testing.T, addr string) (*tls.Conn, int64) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+// A rotated pair is served to new handshakes once reloaded, or once its
+// files changed and the check interval passed, while a broken one leaves
+// the last good pair in use.
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writePair(t, certFile, keyFile, 1, start)
+	l, err := Load(certFile, keyFile, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", l.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	addr := ln.Addr().String()
+
+	first, serial := handshake(t, addr)
+	if serial != 1 {
+		t.Fatalf("serial %d, want 1", serial)
+	}
+
+	// Within the check interval only Reload looks at the files
+	writePair(t, certFile, keyFile, 2, start.Add(time.Minute))
+	if _, serial := handshake(t, addr); serial != 1 {
+		t.Errorf("serial %d before the check interval passed, want 1", serial)
+	}
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, serial := handshake(t, addr); serial != 2 {
+		t.Errorf("serial %d after Reload, want 2", serial)
+	}
+	if serial := first.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 1 {
+		t.Errorf("open connection's serial changed to %d", serial)
+	}
+
+	// Once the interval passed, changed files are read again
+	writePair(t, certFile, keyFile, 3, start.Add(2*time.Minute))
+	l.mu.Lock()
+	l.checked = time.Now().Add(-CHECK_INTERVAL)
+	l.mu.Unlock()
+	if _, serial := handshake(t, addr); serial != 3 {
+		t.Errorf("serial %d after the check interval, want 3", serial)
+	}
+
+	// A certificate written before its key
+	os.WriteFile(certFile, []byte("not a certificate"), 0644)
+	if err := l.Reload(); err == nil {
+		t.Error("broken pair reloaded")
+	}
+	if _, serial := handshake(t, addr); serial != 3 {
+		t.Errorf("serial %d after a broken pair, want 3", serial)
+	}
+}
+
+func TestLoadFails(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "key.pem"), quiet); err == nil {
+		t.Error("missing pair loaded")
+	}
+}
@@ -0,0 +1,182 @@
+// Package tokens issues retrieval tokens for stored files: random strings
+// that fetch a file over HTTP, see httpfiles, a set number of times
+// before they expire. A server hands one to the client for each file it
+// stores, so the client can pass on a link that stops working once used.
+//
+// Tokens are kept in FILE in the upload directory, rewritten on every
+// change, so they survive a restart. The leading dot keeps the file from
+// being listed, served or removed by retention. Expired tokens and those
+// whose file is gone are swept every retention.INTERVAL.
+package tokens
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/retention"
+)
+
+// Name of the token file in the upload directory
+const FILE = ".tokens.json"
+
+// How long a token lasts by default
+const DefaultTTL = 24 * time.Hour
+
+// Random bytes in a token, which is their unpadded URL-safe base64
+const TOKEN_BYTES = 16
+
+// Token is what a token fetches.
+type Token struct {
+	Path    string    `json:"path"` // Of the file under Root, with slashes
+	Expires time.Time `json:"expires"`
+	Uses    int       `json:"uses"` // Fetches left
+}
+
+// Store holds the tokens issued for the files under Root.
+type Store struct {
+	Root string
+	TTL  time.Duration // How long a token lasts
+	Uses int           // How many fetches it allows
+	Log  *slog.Logger
+
+	mu     sync.Mutex
+	tokens map[string]Token
+}
+
+// Open returns the store of the tokens issued for the files under root,
+// loading those a previous run left.
+func Open(root string, ttl time.Duration, uses int, log *slog.Logger) (*Store, error) {
+	s := &Store{Root: root, TTL: ttl, Uses: uses, Log: log, tokens: make(map[string]Token)}
+	data, err := os.ReadFile(s.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading tokens: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.tokens); err != nil {
+		return nil, fmt.Errorf("error reading tokens %s: %w", s.path(), err)
+	}
+	if s.tokens == nil {
+		s.tokens = make(map[string]Token)
+	}
+	return s, nil
+}
+
+func (s *Store) path() string {
+	return filepath.Join(s.Root, FILE)
+}
+
+// Issue returns a new token for the file at path, slash-separated under
+// Root, lasting TTL for Uses fetches.
+func (s *Store) Issue(path string) (string, Token, error) {
+	b := make([]byte, TOKEN_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return "", Token{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	t := Token{Path: path, Expires: time.Now().Add(s.TTL), Uses: s.Uses}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token] = t
+	if err := s.save(); err != nil {
+		delete(s.tokens, token)
+		return "", Token{}, err
+	}
+	return token, t, nil
+}
+
+// Redeem uses up one fetch of token, returning the path of its file, or
+// false if the token is unknown, expired or used up. The last fetch
+// forgets the token.
+func (s *Store) Redeem(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(t.Expires) || t.Uses <= 0 {
+		delete(s.tokens, token)
+		s.save()
+		return "", false
+	}
+	issued := t
+	t.Uses--
+	if t.Uses == 0 {
+		delete(s.tokens, token)
+	} else {
+		s.tokens[token] = t
+	}
+	// A fetch that can't be recorded isn't served, or a restart would
+	// allow it again
+	if err := s.save(); err != nil {
+		s.tokens[token] = issued
+		s.Log.Error("Error redeeming token", "err", err)
+		return "", false
+	}
+	return t.Path, true
+}
+
+// Sweep forgets the tokens that expired and those whose file is gone,
+// such as removed by retention.
+func (s *Store) Sweep() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	swept := 0
+	for token, t := range s.tokens {
+		_, err := os.Lstat(filepath.Join(s.Root, filepath.FromSlash(t.Path)))
+		if now.After(t.Expires) || errors.Is(err, os.ErrNotExist) {
+			delete(s.tokens, token)
+			swept++
+		}
+	}
+	if swept == 0 {
+		return nil
+	}
+	return s.save()
+}
+
+// Run sweeps the tokens every retention.INTERVAL until ctx ends.
+func (s *Store) Run(ctx context.Context) error {
+	ticker := time.NewTicker(retention.INTERVAL)
+	defer ticker.Stop()
+	for {
+		if err := s.Sweep(); err != nil {
+			s.Log.Error("Error sweeping tokens", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// save writes the tokens, replacing the previous file in a single rename
+// so a crash leaves either version intact. Only the server may read it.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("error saving tokens: %w", err)
+	}
+	if err := os.Rename(tmp, s.path()); err != nil {
+		return fmt.Errorf("error saving tokens: %w", err)
+	}
+	return nil
+}
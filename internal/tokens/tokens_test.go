@@ -0,0 +1,157 @@
+package tokens
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// open returns a store over a directory holding the file a.txt.
+func open(t *testing.T, ttl time.Duration, uses int) *Store {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(root, ttl, uses, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// A token fetches its file as many times as it allows, then no more.
+func TestRedeemUses(t *testing.T) {
+	for _, uses := range []int{1, 2, 5} {
+		s := open(t, time.Hour, uses)
+		token, issued, err := s.Issue("a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if issued.Uses != uses || issued.Path != "a.txt" {
+			t.Errorf("issued %+v, want a.txt for %d uses", issued, uses)
+		}
+		for i := 0; i < uses; i++ {
+			if path, ok := s.Redeem(token); !ok || path != "a.txt" {
+				t.Fatalf("%d uses: fetch %d got %q, %v", uses, i+1, path, ok)
+			}
+		}
+		if _, ok := s.Redeem(token); ok {
+			t.Errorf("%d uses: fetch %d allowed", uses, uses+1)
+		}
+	}
+}
+
+func TestRedeemUnknown(t *testing.T) {
+	s := open(t, time.Hour, 1)
+	s.Issue("a.txt")
+	for _, token := range []string{"", "nope", "../a.txt"} {
+		if _, ok := s.Redeem(token); ok {
+			t.Errorf("token %q redeemed", token)
+		}
+	}
+}
+
+// Tokens are random, and differ for the same file.
+func TestIssueUnique(t *testing.T) {
+	s := open(t, time.Hour, 1)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		token, _, err := s.Issue("a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[token] {
+			t.Fatalf("token %q issued twice", token)
+		}
+		seen[token] = true
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := open(t, 50*time.Millisecond, 3)
+	token, _, _ := s.Issue("a.txt")
+	if _, ok := s.Redeem(token); !ok {
+		t.Fatal("fresh token refused")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := s.Redeem(token); ok {
+		t.Error("expired token redeemed")
+	}
+	if _, known := s.tokens[token]; known {
+		t.Error("expired token still kept")
+	}
+}
+
+// Tokens and the fetches they have left survive a restart.
+func TestPersistence(t *testing.T) {
+	s := open(t, time.Hour, 2)
+	token, _, _ := s.Issue("a.txt")
+	used, _, _ := s.Issue("a.txt")
+	s.Redeem(token)
+	s.Redeem(used)
+	s.Redeem(used)
+
+	again, err := Open(s.Root, time.Hour, 2, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path, ok := again.Redeem(token); !ok || path != "a.txt" {
+		t.Errorf("after a restart got %q, %v, want the last fetch", path, ok)
+	}
+	if _, ok := again.Redeem(token); ok {
+		t.Error("fetch past the uses allowed after a restart")
+	}
+	if _, ok := again.Redeem(used); ok {
+		t.Error("used up token redeemed after a restart")
+	}
+	info, err := os.Stat(filepath.Join(s.Root, FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("token file mode %o, want 600", mode)
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, FILE), []byte("{not json"), 0600)
+	if _, err := Open(root, time.Hour, 1, quiet); err == nil {
+		t.Error("corrupt token file accepted")
+	}
+}
+
+// Sweeping forgets expired tokens and those whose file is gone, keeping
+// the rest.
+func TestSweep(t *testing.T) {
+	s := open(t, time.Hour, 1)
+	os.WriteFile(filepath.Join(s.Root, "gone.txt"), []byte("g"), 0644)
+	kept, _, _ := s.Issue("a.txt")
+	gone, _, _ := s.Issue("gone.txt")
+	s.TTL = -time.Second
+	expired, _, _ := s.Issue("a.txt")
+	os.Remove(filepath.Join(s.Root, "gone.txt"))
+
+	if err := s.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	for token, want := range map[string]bool{kept: true, gone: false, expired: false} {
+		if _, known := s.tokens[token]; known != want {
+			t.Errorf("token for %s kept %v, want %v", s.tokens[token].Path, known, want)
+		}
+	}
+	// And on disk
+	again, err := Open(s.Root, time.Hour, 1, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.tokens) != 1 {
+		t.Errorf("%d tokens on disk after the sweep, want 1", len(again.tokens))
+	}
+}
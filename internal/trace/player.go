@@ -0,0 +1,197 @@
+package trace
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Player is a net.PacketConn that replays a server's trace: reads return
+// the datagrams it received, as long after the first read as they came
+// after the trace began, and writes are collected, see Sent, to compare
+// with those it sent. Read deadlines work as on a socket, so the timeouts
+// the trace ran into happen again.
+type Player struct {
+	in     []Record
+	origin time.Time // Of the trace
+	end    time.Time // Of its last record
+	fast   bool
+
+	mu       sync.Mutex
+	start    time.Time // Of the replay, at the first read
+	next     int       // Of in, to read
+	deadline time.Time
+	sent     []Record
+	closed   bool
+
+	wake     chan struct{} // The deadline changed
+	done     chan struct{} // Closed by Close
+	idle     chan struct{} // Closed once a read finds nothing left
+	idleOnce sync.Once
+}
+
+// NewPlayer replays t, which must have records. With fast set the
+// datagrams are read without waiting for their time, which is quicker
+// but may change what timers do.
+func NewPlayer(t *Trace, fast bool) *Player {
+	p := &Player{
+		origin: t.Records[0].Time,
+		end:    t.Records[len(t.Records)-1].Time,
+		fast:   fast,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		idle:   make(chan struct{}),
+	}
+	for _, rec := range t.Records {
+		if rec.Dir == RECEIVED {
+			p.in = append(p.in, rec)
+		}
+	}
+	return p
+}
+
+// due returns when rec is read. Must hold p.mu.
+func (p *Player) due(rec Record) time.Time {
+	if p.fast {
+		return time.Time{}
+	}
+	return p.start.Add(rec.Time.Sub(p.origin))
+}
+
+// Idle is closed once every datagram was read and a read waits for more.
+func (p *Player) Idle() <-chan struct{} {
+	return p.idle
+}
+
+// End returns when the trace ended, in the replay's time, or the zero
+// time if not replaying in real time or not started yet.
+func (p *Player) End() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fast || p.start.IsZero() {
+		return time.Time{}
+	}
+	return p.start.Add(p.end.Sub(p.origin))
+}
+
+// Sent returns the datagrams written so far, timed as if in the trace.
+func (p *Player) Sent() []Record {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Record(nil), p.sent...)
+}
+
+// Received returns how many datagrams were read so far.
+func (p *Player) Received() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.next
+}
+
+func (p *Player) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return 0, nil, net.ErrClosed
+		}
+		if p.start.IsZero() {
+			p.start = time.Now()
+		}
+		now := time.Now()
+		deadline := p.deadline
+		// As on a socket, a deadline that passed wins over what is queued
+		if !deadline.IsZero() && !deadline.After(now) {
+			p.mu.Unlock()
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		var due time.Time
+		pending := p.next < len(p.in)
+		if pending {
+			rec := p.in[p.next]
+			if due = p.due(rec); !due.After(now) {
+				p.next++
+				p.mu.Unlock()
+				addr, err := net.ResolveUDPAddr("udp", rec.Addr)
+				if err != nil {
+					return 0, nil, err
+				}
+				return copy(b, rec.Data), addr, nil
+			}
+		} else {
+			p.idleOnce.Do(func() { close(p.idle) })
+		}
+		p.mu.Unlock()
+
+		// Wait for the next datagram or the deadline, whichever is first
+		if !deadline.IsZero() && (!pending || deadline.Before(due)) {
+			due = deadline
+		}
+		var wait <-chan time.Time
+		var timer *time.Timer
+		if pending || !deadline.IsZero() {
+			timer = time.NewTimer(due.Sub(now))
+			wait = timer.C
+		}
+		select {
+		case <-wait:
+		case <-p.wake:
+		case <-p.done:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (p *Player) WriteTo(b []byte, addr net.Addr) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, net.ErrClosed
+	}
+	rec := Record{Time: p.origin, Dir: SENT, Data: append([]byte(nil), b...)}
+	if !p.start.IsZero() {
+		rec.Time = p.origin.Add(time.Since(p.start))
+	}
+	if addr != nil {
+		rec.Addr = addr.String()
+	}
+	p.sent = append(p.sent, rec)
+	return len(b), nil
+}
+
+func (p *Player) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+	return nil
+}
+
+// LocalAddr returns a placeholder, as a trace doesn't record it.
+func (p *Player) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (p *Player) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *Player) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.deadline = t
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (p *Player) SetWriteDeadline(t time.Time) error {
+	return nil
+}
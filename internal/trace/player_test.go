@@ -0,0 +1,118 @@
+package trace
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// playerTrace returns a server's trace receiving "a" at once and "b" after
+// gap, having sent "ack" in between.
+func playerTrace(gap time.Duration) *Trace {
+	origin := time.Unix(1700000000, 0)
+	return &Trace{Side: SERVER, Records: []Record{
+		{Time: origin, Dir: RECEIVED, Addr: peer.String(), Data: []byte("a")},
+		{Time: origin.Add(gap / 2), Dir: SENT, Addr: peer.String(), Data: []byte("ack")},
+		{Time: origin.Add(gap), Dir: RECEIVED, Addr: peer.String(), Data: []byte("b")},
+	}}
+}
+
+// read reads a datagram from p, failing the test unless it is want.
+func read(t *testing.T, p *Player, want string) {
+	t.Helper()
+	buf := make([]byte, 16)
+	n, addr, err := p.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != want || addr.String() != peer.String() {
+		t.Fatalf("read %q from %v, %v, want %q from %s", buf[:n], addr, err, want, peer)
+	}
+}
+
+// Datagrams come as long after the first as they were traced, or at once
+// when fast.
+func TestPlayerTiming(t *testing.T) {
+	const gap = 100 * time.Millisecond
+	for _, fast := range []bool{false, true} {
+		p := NewPlayer(playerTrace(gap), fast)
+		start := time.Now()
+		read(t, p, "a")
+		read(t, p, "b")
+		took := time.Since(start)
+		if !fast && took < gap {
+			t.Errorf("real time: read both after %v, want at least %v", took, gap)
+		}
+		if fast && took >= gap {
+			t.Errorf("fast: read both after %v, want at once", took)
+		}
+		if end := p.End(); fast != end.IsZero() {
+			t.Errorf("fast %v: End = %v", fast, end)
+		}
+		p.Close()
+	}
+}
+
+// A read deadline passes as on a socket, and once every datagram was read
+// the Player is idle.
+func TestPlayerDeadline(t *testing.T) {
+	p := NewPlayer(playerTrace(time.Hour), false)
+	defer p.Close()
+	read(t, p, "a")
+	select {
+	case <-p.Idle():
+		t.Fatal("idle with a datagram left")
+	default:
+	}
+	p.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := p.ReadFrom(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if p.Received() != 1 {
+		t.Errorf("Received = %d, want 1", p.Received())
+	}
+
+	q := NewPlayer(playerTrace(0), true)
+	read(t, q, "a")
+	read(t, q, "b")
+	q.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	q.ReadFrom(make([]byte, 16))
+	select {
+	case <-q.Idle():
+	default:
+		t.Error("not idle with every datagram read")
+	}
+	q.Close()
+	if _, _, err := q.ReadFrom(make([]byte, 16)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read after Close: got %v, want %v", err, net.ErrClosed)
+	}
+}
+
+// What is written is collected, not sent, and Close ends a waiting read.
+func TestPlayerSent(t *testing.T) {
+	p := NewPlayer(playerTrace(time.Hour), false)
+	read(t, p, "a")
+	p.WriteTo([]byte("ack"), peer)
+	sent := p.Sent()
+	if len(sent) != 1 || string(sent[0].Data) != "ack" || sent[0].Dir != SENT || sent[0].Addr != peer.String() {
+		t.Fatalf("Sent = %+v, want the ack", sent)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := p.ReadFrom(make([]byte, 16))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	p.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("got %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read still waiting after Close")
+	}
+	if _, err := p.WriteTo([]byte("late"), peer); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after Close: got %v, want %v", err, net.ErrClosed)
+	}
+}
@@ -0,0 +1,303 @@
+// Package trace records every datagram an endpoint sends and receives, to
+// a file 'transfer trace-replay' reads back to debug a UDP transfer
+// offline, see Player.
+//
+// A trace file starts with MAGIC, a version byte and the Side that
+// recorded it, followed by a record per datagram, big-endian:
+//
+//	8 bytes  when, in nanoseconds since the Unix epoch
+//	1 byte   SENT or RECEIVED
+//	1 byte   length of the peer's address, then the address as text
+//	2 bytes  length of the datagram, then the datagram
+//
+// Recording costs nothing unless a connection is wrapped, see
+// WrapPacketConn and WrapConn. A Writer with a limit keeps the file below
+// it by moving it to path.1 once full and starting over, so the last two
+// files hold the end of the trace.
+package trace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	MAGIC   = "SFTTRACE"
+	VERSION = 1
+
+	HEADER_LEN = len(MAGIC) + 2
+
+	// Fixed part of a record, before the address and the datagram
+	RECORD_LEN = 8 + 1 + 1 + 2
+)
+
+// Direction of a recorded datagram
+const (
+	SENT     byte = 'S'
+	RECEIVED byte = 'R'
+)
+
+// Side is the endpoint a trace was recorded on.
+type Side byte
+
+const (
+	SERVER Side = 's' // An unconnected socket, see WrapPacketConn
+	CLIENT Side = 'c' // A connected one, see WrapConn
+)
+
+func (s Side) String() string {
+	switch s {
+	case SERVER:
+		return "server"
+	case CLIENT:
+		return "client"
+	}
+	return fmt.Sprintf("side %#x", byte(s))
+}
+
+// ErrFormat is returned for a file that isn't a trace, or is corrupt.
+var ErrFormat = errors.New("not a trace file")
+
+// Record is one datagram of a trace.
+type Record struct {
+	Time time.Time
+	Dir  byte   // SENT or RECEIVED
+	Addr string // Of the peer
+	Data []byte
+}
+
+// Trace is a recorded trace, its records in the order they happened.
+type Trace struct {
+	Side    Side
+	Records []Record
+}
+
+// Writer records datagrams to a trace file. It is safe for concurrent
+// use. Each record is a single write, so a process that exits without
+// closing the Writer loses none.
+type Writer struct {
+	path  string
+	side  Side
+	limit int64 // Size the file is kept below, 0 for none
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	buf  []byte
+	err  error // First failure, after which nothing more is recorded
+}
+
+// Create starts a trace of side at path, replacing any file there. With a
+// limit above zero the file is moved to path.1 whenever the next record
+// would grow it past limit.
+func Create(path string, side Side, limit int64) (*Writer, error) {
+	w := &Writer{path: path, side: side, limit: limit}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open starts a new file at w.path with its header. Must hold w.mu, if
+// there is a file already.
+func (w *Writer) open() error {
+	f, err := os.Create(w.path)
+	if err != nil {
+		return err
+	}
+	header := append([]byte(MAGIC), VERSION, byte(w.side))
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, int64(len(header))
+	return nil
+}
+
+// rotate moves the full file aside and starts over. Must hold w.mu.
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// Record adds a datagram sent to, or received from, addr. Failures are
+// kept for Close, and stop the recording rather than the transfer.
+func (w *Writer) Record(dir byte, addr net.Addr, p []byte) {
+	now := time.Now()
+	var peer string
+	if addr != nil {
+		peer = addr.String()
+	}
+	if len(peer) > math.MaxUint8 || len(p) > math.MaxUint16 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	b := binary.BigEndian.AppendUint64(w.buf[:0], uint64(now.UnixNano()))
+	b = append(b, dir, byte(len(peer)))
+	b = append(b, peer...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(p)))
+	b = append(b, p...)
+	w.buf = b
+
+	if w.limit > 0 && w.size > int64(HEADER_LEN) && w.size+int64(len(b)) > w.limit {
+		if w.err = w.rotate(); w.err != nil {
+			return
+		}
+	}
+	n, err := w.file.Write(b)
+	w.size += int64(n)
+	w.err = err
+}
+
+// Close ends the trace, returning the first error recording it.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return w.err
+	}
+	err := w.file.Close()
+	w.file = nil
+	if w.err == nil {
+		w.err = err
+	}
+	if w.err == nil {
+		// So records after Close are dropped
+		w.err = os.ErrClosed
+		return nil
+	}
+	return w.err
+}
+
+// Read decodes a trace.
+func Read(r io.Reader) (*Trace, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, HEADER_LEN)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(MAGIC)]) != MAGIC {
+		return nil, ErrFormat
+	}
+	if v := header[len(MAGIC)]; v != VERSION {
+		return nil, fmt.Errorf("%w: version %d", ErrFormat, v)
+	}
+	t := &Trace{Side: Side(header[len(MAGIC)+1])}
+	if t.Side != SERVER && t.Side != CLIENT {
+		return nil, fmt.Errorf("%w: %s", ErrFormat, t.Side)
+	}
+
+	fixed := make([]byte, RECORD_LEN)
+	for {
+		// A record cut short is where the recording process died
+		if _, err := io.ReadFull(br, fixed[:10]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return t, nil
+			}
+			return nil, err
+		}
+		rec := Record{
+			Time: time.Unix(0, int64(binary.BigEndian.Uint64(fixed))),
+			Dir:  fixed[8],
+		}
+		if rec.Dir != SENT && rec.Dir != RECEIVED {
+			return nil, fmt.Errorf("%w: record %d: direction %#x", ErrFormat, len(t.Records), rec.Dir)
+		}
+		addr := make([]byte, fixed[9])
+		if _, err := io.ReadFull(br, addr); err != nil {
+			return t, nil
+		}
+		if _, err := io.ReadFull(br, fixed[10:]); err != nil {
+			return t, nil
+		}
+		rec.Addr = string(addr)
+		rec.Data = make([]byte, binary.BigEndian.Uint16(fixed[10:]))
+		if _, err := io.ReadFull(br, rec.Data); err != nil {
+			return t, nil
+		}
+		t.Records = append(t.Records, rec)
+	}
+}
+
+// ReadFile reads the trace at path.
+func ReadFile(path string) (*Trace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// PacketConn records the datagrams of an unconnected socket.
+type PacketConn struct {
+	net.PacketConn
+	w *Writer
+}
+
+// WrapPacketConn returns pc recording to w, which must be of SERVER.
+func WrapPacketConn(pc net.PacketConn, w *Writer) *PacketConn {
+	return &PacketConn{PacketConn: pc, w: w}
+}
+
+func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.w.Record(RECEIVED, addr, p[:n])
+	}
+	return n, addr, err
+}
+
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if err == nil {
+		c.w.Record(SENT, addr, p)
+	}
+	return n, err
+}
+
+// Conn records the datagrams of a connected socket.
+type Conn struct {
+	net.Conn
+	w *Writer
+}
+
+// WrapConn returns conn recording to w, which must be of CLIENT.
+func WrapConn(conn net.Conn, w *Writer) *Conn {
+	return &Conn{Conn: conn, w: w}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err == nil {
+		c.w.Record(RECEIVED, c.RemoteAddr(), p[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err == nil {
+		c.w.Record(SENT, c.RemoteAddr(), p)
+	}
+	return n, err
+}
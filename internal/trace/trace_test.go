@@ -0,0 +1,207 @@
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var peer = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+// What a Writer records reads back the same, in order.
+func TestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.trace")
+	w, err := Create(path, CLIENT, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := [][]byte{[]byte("header"), {}, bytes.Repeat([]byte{7}, 1500)}
+	before := time.Now()
+	for i, p := range packets {
+		dir := SENT
+		if i%2 == 1 {
+			dir = RECEIVED
+		}
+		w.Record(dir, peer, p)
+	}
+	w.Record(SENT, nil, []byte("no peer"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w.Record(SENT, peer, []byte("after Close"))
+
+	tr, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Side != CLIENT || len(tr.Records) != 4 {
+		t.Fatalf("read a %s trace of %d records, want a client's of 4", tr.Side, len(tr.Records))
+	}
+	for i, p := range packets {
+		rec := tr.Records[i]
+		if !bytes.Equal(rec.Data, p) || rec.Addr != peer.String() || rec.Time.Before(before) {
+			t.Errorf("record %d = %d bytes from %s at %v, want %d bytes from %s", i, len(rec.Data), rec.Addr, rec.Time, len(p), peer)
+		}
+		if want := [...]byte{SENT, RECEIVED}[i%2]; rec.Dir != want {
+			t.Errorf("record %d direction %c, want %c", i, rec.Dir, want)
+		}
+	}
+	if rec := tr.Records[3]; rec.Addr != "" || string(rec.Data) != "no peer" {
+		t.Errorf("last record %q from %q", rec.Data, rec.Addr)
+	}
+}
+
+// With a limit the file stays below it, the earlier records moved to
+// path.1.
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.trace")
+	const limit = 1000
+	w, err := Create(path, SERVER, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 100)
+	for i := 0; i < 25; i++ {
+		p[0] = byte(i)
+		w.Record(RECEIVED, peer, p)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var seqs []byte
+	for _, name := range []string{path + ".1", path} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > limit {
+			t.Errorf("%s has %d bytes, over the limit of %d", filepath.Base(name), info.Size(), limit)
+		}
+		tr, err := ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range tr.Records {
+			seqs = append(seqs, rec.Data[0])
+		}
+	}
+	// The last two files hold the end of the trace, in order
+	if len(seqs) == 0 || seqs[len(seqs)-1] != 24 {
+		t.Fatalf("records %v, want them to end with 24", seqs)
+	}
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] != seqs[i-1]+1 {
+			t.Fatalf("records %v, want them consecutive", seqs)
+		}
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	header := []byte(MAGIC + "\x01s")
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a trace", []byte("PK\x03\x04 an archive, really")},
+		{"other version", []byte(MAGIC + "\x02s")},
+		{"unknown side", []byte(MAGIC + "\x01x")},
+		{"unknown direction", append(append([]byte(nil), header...), 0, 0, 0, 0, 0, 0, 0, 0, 'X', 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Read(bytes.NewReader(tt.data)); !errors.Is(err, ErrFormat) {
+				t.Errorf("got %v, want %v", err, ErrFormat)
+			}
+		})
+	}
+}
+
+// A record cut short, by a process dying while writing it, ends the trace.
+func TestReadTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.trace")
+	w, err := Create(path, SERVER, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Record(RECEIVED, peer, []byte("whole"))
+	w.Record(SENT, peer, []byte("cut short"))
+	w.Close()
+	data, _ := os.ReadFile(path)
+
+	tr, err := Read(bytes.NewReader(data[:len(data)-3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Records) != 1 || string(tr.Records[0].Data) != "whole" {
+		t.Errorf("read %d records, want the whole one", len(tr.Records))
+	}
+}
+
+// Wrapped sockets record what they send and receive, with the peer.
+func TestWrap(t *testing.T) {
+	dir := t.TempDir()
+	sw, err := Create(filepath.Join(dir, "server.trace"), SERVER, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw, err := Create(filepath.Join(dir, "client.trace"), CLIENT, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	server := WrapPacketConn(pc, sw)
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := WrapConn(conn, cw)
+
+	buf := make([]byte, 64)
+	client.Write([]byte("ping"))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.WriteTo([]byte("pong"), from)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err = client.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("client read %q, %v", buf[:n], err)
+	}
+	sw.Close()
+	cw.Close()
+
+	tests := []struct {
+		name string
+		side Side
+		want []Record
+	}{
+		{"server.trace", SERVER, []Record{{Dir: RECEIVED, Addr: from.String(), Data: []byte("ping")}, {Dir: SENT, Addr: from.String(), Data: []byte("pong")}}},
+		{"client.trace", CLIENT, []Record{{Dir: SENT, Addr: pc.LocalAddr().String(), Data: []byte("ping")}, {Dir: RECEIVED, Addr: pc.LocalAddr().String(), Data: []byte("pong")}}},
+	}
+	for _, tt := range tests {
+		tr, err := ReadFile(filepath.Join(dir, tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.Side != tt.side || len(tr.Records) != len(tt.want) {
+			t.Fatalf("%s: a %s trace of %d records, want a %s's of %d", tt.name, tr.Side, len(tr.Records), tt.side, len(tt.want))
+		}
+		for i, want := range tt.want {
+			got := tr.Records[i]
+			if got.Dir != want.Dir || got.Addr != want.Addr || !bytes.Equal(got.Data, want.Data) {
+				t.Errorf("%s record %d = %c %s %q, want %c %s %q", tt.name, i, got.Dir, got.Addr, got.Data, want.Dir, want.Addr, want.Data)
+			}
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// Package transfers keeps track of the transfers a process has under way,
+// fed by the progress events of its servers, for whatever reports on them:
+// the status lines, the debug endpoint, the admin socket.
+//
+// A transfer is listed from its started event until it completes or
+// fails. Its rate is measured over the last RATE_WINDOW or so, falling
+// towards zero once the transfer stalls.
+//
+// Subscribers, such as the debug endpoint's event stream, are also passed
+// the events of each transfer as they happen, see Subscribe.
+package transfers
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// Period a transfer's rate is measured over
+const RATE_WINDOW = time.Second
+
+// Least time between the progress events of a transfer passed to
+// subscribers
+const PROGRESS_INTERVAL = time.Second
+
+// Events a subscriber can fall behind by before the oldest are dropped
+const SUBSCRIBER_BUFFER = 256
+
+// What a transfer is doing
+const (
+	STATE_TRANSFERRING = "transferring"
+	STATE_PAUSED       = "paused"
+	STATE_STORING      = "storing" // Receiving is over, see Status
+)
+
+// Transfer is a transfer under way.
+type Transfer struct {
+	ID      uint64    `json:"id"`
+	Remote  string    `json:"remote"`
+	Name    string    `json:"file"`
+	Bytes   int64     `json:"bytes"`
+	Total   int64     `json:"total"`
+	Rate    int64     `json:"rate"` // Bytes per second
+	State   string    `json:"state"`
+	Status  string    `json:"status,omitempty"` // What the server is doing while storing, e.g. "hashing 43%"
+	Started time.Time `json:"started"`
+}
+
+// Event is a step of a transfer, as passed to subscribers.
+type Event struct {
+	Kind   string      `json:"event"` // started, progress, completed or failed
+	ID     uint64      `json:"id"`
+	Time   time.Time   `json:"time"`
+	Remote string      `json:"remote"`
+	Name   string      `json:"file"`
+	Bytes  int64       `json:"bytes"`
+	Total  int64       `json:"total"`
+	Rate   int64       `json:"rate"` // Bytes per second
+	Error  string      `json:"error,omitempty"`
+	Stats  *wire.Stats `json:"stats,omitempty"` // Of a completed UDP transfer
+}
+
+// entry is a Transfer with what its rate is measured from.
+type entry struct {
+	Transfer
+	mark      time.Time // Start of the current rate window
+	markBytes int64
+	cancel    func(error)
+	published time.Time // Of the last progress event passed to subscribers
+}
+
+// event returns e's transfer as an event of kind.
+func (e *entry) event(kind wire.EventKind, at time.Time) Event {
+	return Event{Kind: kind.String(), ID: e.ID, Time: at, Remote: e.Remote, Name: e.Name, Bytes: e.Bytes, Total: e.Total, Rate: e.Rate}
+}
+
+// Why Kill failed
+var (
+	ErrUnknown    = errors.New("no such transfer under way")
+	ErrUnkillable = errors.New("transfer can't be killed")
+)
+
+// Registry holds the transfers under way. It is safe for concurrent use.
+type Registry struct {
+	mu          sync.Mutex
+	transfers   map[uint64]*entry
+	subscribers map[*Subscription]bool
+}
+
+// New returns an empty Registry.
+func New() *Registry {
+	return &Registry{transfers: make(map[uint64]*entry), subscribers: make(map[*Subscription]bool)}
+}
+
+// Progress updates r with ev. It is a wire.ProgressFunc.
+func (r *Registry) Progress(ev wire.Event) {
+	if ev.ID == 0 {
+		return // Failed before it started
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ev.Kind == wire.EventStarted {
+		e := &entry{
+			Transfer:  Transfer{ID: ev.ID, Remote: ev.Remote, Name: ev.Name, Total: ev.Total, State: STATE_TRANSFERRING, Started: ev.Time},
+			mark:      ev.Time,
+			cancel:    ev.Cancel,
+			published: ev.Time,
+		}
+		r.transfers[ev.ID] = e
+		r.publish(e.event(ev.Kind, ev.Time))
+		return
+	}
+	e := r.transfers[ev.ID]
+	if e == nil {
+		return
+	}
+	switch ev.Kind {
+	case wire.EventProgress:
+		e.Bytes = ev.Bytes
+		if elapsed := ev.Time.Sub(e.mark); elapsed >= RATE_WINDOW {
+			e.Rate = rate(e.Bytes-e.markBytes, elapsed)
+			e.mark, e.markBytes = ev.Time, e.Bytes
+		}
+		if ev.Time.Sub(e.published) >= PROGRESS_INTERVAL {
+			e.published = ev.Time
+			r.publish(e.event(ev.Kind, ev.Time))
+		}
+	case wire.EventPaused:
+		e.State = STATE_PAUSED
+	case wire.EventResumed:
+		e.State = STATE_TRANSFERRING
+	case wire.EventBusy:
+		e.State, e.Status = STATE_STORING, ev.Status
+	case wire.EventCompleted, wire.EventFailed:
+		delete(r.transfers, ev.ID)
+		e.Bytes = ev.Bytes
+		out := e.event(ev.Kind, ev.Time)
+		out.Stats = ev.Stats
+		if ev.Err != nil {
+			out.Error = ev.Err.Error()
+		}
+		if elapsed := ev.Time.Sub(e.Started); elapsed > 0 {
+			out.Rate = rate(out.Bytes, elapsed) // Over the whole transfer
+		}
+		r.publish(out)
+	}
+}
+
+// Subscription passes the events of the transfers in a Registry, see
+// Subscribe.
+type Subscription struct {
+	r      *Registry
+	events chan Event
+}
+
+// Subscribe returns a Subscription to the events of r's transfers, which
+// starts with a started event for each transfer already under way, with
+// its progress so far. Events are started, completed, failed or, at most
+// every PROGRESS_INTERVAL for each transfer, progress. A subscriber that
+// falls SUBSCRIBER_BUFFER events behind loses the oldest, rather than
+// holding up the transfers.
+func (r *Registry) Subscribe() *Subscription {
+	s := &Subscription{r: r, events: make(chan Event, SUBSCRIBER_BUFFER)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range r.sorted() {
+		s.send(r.transfers[t.ID].event(wire.EventStarted, t.Started))
+	}
+	r.subscribers[s] = true
+	return s
+}
+
+// Events returns the channel the events arrive on, closed by Close.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	if s.r.subscribers[s] {
+		delete(s.r.subscribers, s)
+		close(s.events)
+	}
+}
+
+// send queues ev, dropping the oldest event queued if s is full. Must hold
+// s.r.mu, as the only sender.
+func (s *Subscription) send(ev Event) {
+	select {
+	case s.events <- ev:
+		return
+	default:
+	}
+	select {
+	case <-s.events:
+	default:
+	}
+	select {
+	case s.events <- ev:
+	default:
+	}
+}
+
+// publish passes ev to the subscribers. Must hold r.mu.
+func (r *Registry) publish(ev Event) {
+	for s := range r.subscribers {
+		s.send(ev)
+	}
+}
+
+// sorted returns the transfers in r, oldest first. Must hold r.mu.
+func (r *Registry) sorted() []Transfer {
+	list := make([]Transfer, 0, len(r.transfers))
+	for _, e := range r.transfers {
+		list = append(list, e.Transfer)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// List returns the transfers under way, oldest first.
+func (r *Registry) List() []Transfer {
+	now := time.Now()
+	r.mu.Lock()
+	list := make([]Transfer, 0, len(r.transfers))
+	for _, e := range r.transfers {
+		t := e.Transfer
+		// No progress for a whole window
+		if elapsed := now.Sub(e.mark); elapsed >= 2*RATE_WINDOW {
+			t.Rate = rate(e.Bytes-e.markBytes, elapsed)
+		}
+		list = append(list, t)
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Kill ends transfer id with wire.ErrKilled, taking the path of a client
+// abort: the server drops the partial file and reports the transfer
+// failed.
+func (r *Registry) Kill(id uint64) error {
+	r.mu.Lock()
+	e := r.transfers[id]
+	r.mu.Unlock()
+	switch {
+	case e == nil:
+		return ErrUnknown
+	case e.cancel == nil:
+		return ErrUnkillable
+	}
+	e.cancel(wire.ErrKilled)
+	return nil
+}
+
+func rate(bytes int64, elapsed time.Duration) int64 {
+	return int64(float64(bytes) / elapsed.Seconds())
+}
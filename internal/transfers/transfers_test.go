@@ -0,0 +1,187 @@
+package transfers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// A transfer is listed from its start until it ends, with its state
+// following its events and its rate measured over RATE_WINDOW.
+func TestProgress(t *testing.T) {
+	r := New()
+	start := time.Now()
+	r.Progress(wire.Event{Kind: wire.EventStarted, ID: 1, Time: start, Remote: "192.0.2.1:4000", Name: "f", Total: 4000})
+	r.Progress(wire.Event{Kind: wire.EventStarted, ID: 2, Time: start, Name: "g"})
+	r.Progress(wire.Event{Kind: wire.EventFailed}) // Failed before it started
+
+	steps := []struct {
+		ev    wire.Event
+		state string
+		bytes int64
+		rate  int64
+	}{
+		{wire.Event{Kind: wire.EventProgress, Bytes: 500, Time: start.Add(RATE_WINDOW / 2)}, STATE_TRANSFERRING, 500, 0},
+		{wire.Event{Kind: wire.EventProgress, Bytes: 2000, Time: start.Add(2 * RATE_WINDOW)}, STATE_TRANSFERRING, 2000, int64(2000 / (2 * RATE_WINDOW).Seconds())},
+		{wire.Event{Kind: wire.EventPaused, Time: start.Add(3 * RATE_WINDOW)}, STATE_PAUSED, 2000, int64(2000 / (2 * RATE_WINDOW).Seconds())},
+		{wire.Event{Kind: wire.EventResumed, Time: start.Add(4 * RATE_WINDOW)}, STATE_TRANSFERRING, 2000, int64(2000 / (2 * RATE_WINDOW).Seconds())},
+		{wire.Event{Kind: wire.EventProgress, Bytes: 2000, Time: start.Add(5 * RATE_WINDOW)}, STATE_TRANSFERRING, 2000, 0}, // Stalled
+		{wire.Event{Kind: wire.EventBusy, Status: "hashing 43%", Time: start.Add(6 * RATE_WINDOW)}, STATE_STORING, 2000, 0},
+	}
+	for i, step := range steps {
+		step.ev.ID = 1
+		r.Progress(step.ev)
+		list := r.List()
+		if len(list) != 2 || list[0].ID != 1 {
+			t.Fatalf("step %d: listed %+v, want transfers 1 and 2", i, list)
+		}
+		got := list[0]
+		if got.State != step.state || got.Bytes != step.bytes || got.Rate != step.rate {
+			t.Errorf("step %d: got %s with %d bytes at %d/s, want %s with %d at %d/s", i, got.State, got.Bytes, got.Rate, step.state, step.bytes, step.rate)
+		}
+	}
+	if got := r.List()[0]; got.Status != "hashing 43%" || got.Remote != "192.0.2.1:4000" || got.Total != 4000 {
+		t.Errorf("listed %+v", got)
+	}
+
+	r.Progress(wire.Event{Kind: wire.EventCompleted, ID: 1, Bytes: 4000, Time: start.Add(7 * RATE_WINDOW)})
+	if list := r.List(); len(list) != 1 || list[0].ID != 2 {
+		t.Errorf("listed %+v after completion, want transfer 2 alone", list)
+	}
+	r.Progress(wire.Event{Kind: wire.EventProgress, ID: 1, Bytes: 5000, Time: start.Add(8 * RATE_WINDOW)})
+	if list := r.List(); len(list) != 1 {
+		t.Errorf("listed %+v, want late progress of an ended transfer ignored", list)
+	}
+}
+
+// drain returns the events queued on sub.
+func drain(sub *Subscription) []Event {
+	var events []Event
+	for {
+		select {
+		case ev := <-sub.Events():
+			events = append(events, ev)
+		default:
+			return events
+		}
+	}
+}
+
+// A subscriber gets a transfer's events in order, with its progress at most
+// once a PROGRESS_INTERVAL, and one joining later first a started event for
+// each transfer under way.
+func TestSubscribe(t *testing.T) {
+	r := New()
+	sub := r.Subscribe()
+	defer sub.Close()
+	start := time.Now()
+	r.Progress(wire.Event{Kind: wire.EventStarted, ID: 1, Time: start, Remote: "192.0.2.1:4000", Name: "f", Total: 3000})
+	for i := 1; i <= 10; i++ {
+		r.Progress(wire.Event{Kind: wire.EventProgress, ID: 1, Bytes: int64(i * 100), Time: start.Add(time.Duration(i) * PROGRESS_INTERVAL / 4)})
+	}
+	r.Progress(wire.Event{Kind: wire.EventPaused, ID: 1, Time: start.Add(3 * PROGRESS_INTERVAL)})
+
+	late := r.Subscribe()
+	defer late.Close()
+	stats := &wire.Stats{PacketsReceived: 3}
+	r.Progress(wire.Event{Kind: wire.EventCompleted, ID: 1, Bytes: 3000, Time: start.Add(3 * time.Second), Stats: stats})
+	r.Progress(wire.Event{Kind: wire.EventStarted, ID: 2, Time: start, Name: "g"})
+	r.Progress(wire.Event{Kind: wire.EventFailed, ID: 2, Bytes: 10, Time: start, Err: errors.New("connection reset")})
+
+	type step struct {
+		kind  string
+		id    uint64
+		bytes int64
+	}
+	tests := []struct {
+		name  string
+		sub   *Subscription
+		steps []step
+	}{
+		{"from the start", sub, []step{{"started", 1, 0}, {"progress", 1, 400}, {"progress", 1, 800}, {"completed", 1, 3000}, {"started", 2, 0}, {"failed", 2, 10}}},
+		{"joined later", late, []step{{"started", 1, 1000}, {"completed", 1, 3000}, {"started", 2, 0}, {"failed", 2, 10}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := drain(tt.sub)
+			if len(events) != len(tt.steps) {
+				t.Fatalf("got %d events %+v, want %d", len(events), events, len(tt.steps))
+			}
+			for i, want := range tt.steps {
+				if ev := events[i]; ev.Kind != want.kind || ev.ID != want.id || ev.Bytes != want.bytes {
+					t.Errorf("event %d: %s of %d at %d bytes, want %s of %d at %d", i, ev.Kind, ev.ID, ev.Bytes, want.kind, want.id, want.bytes)
+				}
+			}
+			completed, failed := events[len(events)-3], events[len(events)-1]
+			if completed.Stats != stats || completed.Rate != 1000 || completed.Name != "f" || completed.Remote != "192.0.2.1:4000" {
+				t.Errorf("completed event %+v, want f's with its stats and a rate of 1000/s", completed)
+			}
+			if failed.Error != "connection reset" {
+				t.Errorf("failed event's error %q", failed.Error)
+			}
+		})
+	}
+}
+
+// A subscriber that doesn't keep up loses its oldest events without
+// holding up the transfers, or the other subscribers.
+func TestSubscriberDropOldest(t *testing.T) {
+	r := New()
+	slow := r.Subscribe()
+	defer slow.Close()
+	fast := r.Subscribe()
+	defer fast.Close()
+
+	// In rounds the fast one keeps up with, while the slow one reads
+	// nothing
+	const n, round = 3 * SUBSCRIBER_BUFFER, SUBSCRIBER_BUFFER / 2
+	var got []Event
+	for id := 1; id <= n; {
+		published := make(chan struct{})
+		go func(first int) {
+			defer close(published)
+			for i := first; i < first+round; i++ {
+				r.Progress(wire.Event{Kind: wire.EventStarted, ID: uint64(i), Time: time.Now()})
+			}
+		}(id)
+		select {
+		case <-published:
+		case <-time.After(5 * time.Second):
+			t.Fatal("publishing blocked on the slow subscriber")
+		}
+		id += round
+		got = append(got, drain(fast)...)
+	}
+	if len(got) != n {
+		t.Fatalf("fast subscriber got %d events, want %d", len(got), n)
+	}
+	for i, ev := range got {
+		if ev.ID != uint64(i+1) {
+			t.Fatalf("fast subscriber's event %d is of transfer %d", i, ev.ID)
+		}
+	}
+
+	kept := drain(slow)
+	if len(kept) != SUBSCRIBER_BUFFER {
+		t.Fatalf("slow subscriber kept %d events, want %d", len(kept), SUBSCRIBER_BUFFER)
+	}
+	for i, ev := range kept {
+		if want := uint64(n - SUBSCRIBER_BUFFER + i + 1); ev.ID != want {
+			t.Fatalf("slow subscriber's event %d is of transfer %d, want %d, the newest kept", i, ev.ID, want)
+		}
+	}
+}
+
+// Close ends the events, once.
+func TestSubscriptionClose(t *testing.T) {
+	r := New()
+	sub := r.Subscribe()
+	sub.Close()
+	sub.Close()
+	r.Progress(wire.Event{Kind: wire.EventStarted, ID: 1, Time: time.Now()})
+	if _, ok := <-sub.Events(); ok {
+		t.Error("event after Close")
+	}
+}
@@ -0,0 +1,61 @@
+//go:build !windows
+
+package unixsock
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// bind creates the socket in a directory of its own next to path, which
+// only this user may enter, sets its permissions there and only then
+// moves it to path. Creating it at path and setting them after would let
+// anyone connect in between, with the umask's permissions.
+func bind(path string, mode os.FileMode) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sock-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+	tmp := filepath.Join(dir, "s")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ul := l.(*net.UnixListener)
+	// The file won't be at tmp for Close to remove
+	ul.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, mode); err != nil {
+		ul.Close()
+		os.Remove(tmp)
+		return nil, fmt.Errorf("error setting socket permissions: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ul.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return &listener{UnixListener: ul, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// listener is a socket moved to addr once bound, which it reports and
+// removes on Close.
+type listener struct {
+	*net.UnixListener
+	addr   *net.UnixAddr
+	unlink sync.Once
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Close removes the file before closing the socket, as net.UnixListener
+// does, so it is gone once Accept returns.
+func (l *listener) Close() error {
+	l.unlink.Do(func() { os.Remove(l.addr.Name) })
+	return l.UnixListener.Close()
+}
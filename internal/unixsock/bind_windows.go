@@ -0,0 +1,21 @@
+package unixsock
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// bind creates the socket at path. Windows keeps no permission bits on it
+// for mode to set beyond read-only, so there is nothing to set first.
+func bind(path string, mode os.FileMode) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("error setting socket permissions: %w", err)
+	}
+	return l, nil
+}
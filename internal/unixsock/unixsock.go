@@ -0,0 +1,38 @@
+// Package unixsock listens on unix sockets that no one can connect to
+// before their permissions are set, as the TCP server's -unix-socket and
+// the admin socket are.
+package unixsock
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// How long Listen waits for a server already on the socket to answer
+const PROBE_TIMEOUT = time.Second
+
+// Listen listens on the unix socket at path with permissions mode,
+// replacing the socket file a server that didn't shut down cleanly left
+// behind. The file is removed when the listener is closed.
+func Listen(path string, mode os.FileMode) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	case err == nil:
+		conn, err := net.DialTimeout("unix", path, PROBE_TIMEOUT)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("error removing stale socket: %w", err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	return bind(path, mode)
+}
@@ -0,0 +1,124 @@
+//go:build !windows
+
+package unixsock
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// listen listens on path with mode, closing the listener when the test
+// ends.
+func listen(t *testing.T, path string, mode os.FileMode) net.Listener {
+	t.Helper()
+	l, err := Listen(path, mode)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// The socket has the mode asked for, answers at path and leaves nothing
+// else behind, nor itself once closed.
+func TestListen(t *testing.T) {
+	for _, mode := range []os.FileMode{0600, 0660, 0666} {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "s.sock")
+			l := listen(t, path, mode)
+			if got := l.Addr().String(); got != path {
+				t.Errorf("Addr = %s, want %s", got, path)
+			}
+			info, err := os.Lstat(path)
+			if err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != mode {
+				t.Fatalf("socket file %v, %v, want a socket with %v", info.Mode(), err, mode)
+			}
+			go func() {
+				if conn, err := net.Dial("unix", path); err == nil {
+					conn.Write([]byte("x"))
+					conn.Close()
+				}
+			}()
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatalf("Accept: %v", err)
+			}
+			conn.Close()
+			if names, _ := os.ReadDir(dir); len(names) != 1 {
+				t.Errorf("directory holds %d entries, want just the socket", len(names))
+			}
+
+			if err := l.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Errorf("socket file left after Close: %v", err)
+			}
+		})
+	}
+}
+
+// No one can find the socket before its permissions are set, even with a
+// umask that would leave it open to all.
+func TestNeverWideOpen(t *testing.T) {
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+	path := filepath.Join(t.TempDir(), "s.sock")
+	seen := make(chan os.FileMode, 1)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				close(seen)
+				return
+			default:
+			}
+			if info, err := os.Lstat(path); err == nil {
+				seen <- info.Mode().Perm()
+				return
+			}
+		}
+	}()
+	listen(t, path, 0600)
+	mode, ok := <-seen
+	close(stop)
+	if ok && mode != 0600 {
+		t.Errorf("socket first seen with %v, want 0600", mode)
+	}
+}
+
+// The socket file of a server that didn't shut down cleanly is replaced,
+// while one in use, or a file that isn't a socket, is left alone.
+func TestListenExisting(t *testing.T) {
+	dir := t.TempDir()
+
+	stale := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	listen(t, stale, 0600)
+
+	inUse := filepath.Join(dir, "in-use.sock")
+	listen(t, inUse, 0600)
+	if _, err := Listen(inUse, 0600); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("socket in use: got %v, want it refused", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, []byte("keep"), 0644)
+	if _, err := Listen(file, 0600); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("regular file: got %v, want it refused", err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != "keep" {
+		t.Errorf("regular file now holds %q", data)
+	}
+}
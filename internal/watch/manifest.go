@@ -0,0 +1,61 @@
+package watch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Name of the manifest in the watched directory; the leading dot keeps the
+// watcher from sending it
+const MANIFEST_NAME = ".transfer-sent.json"
+
+// Entry records the state of a file when it was sent.
+type Entry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// Manifest records the files sent from a directory, by name.
+type Manifest struct {
+	Files map[string]Entry `json:"files"`
+
+	path string
+}
+
+// LoadManifest reads the manifest of dir, empty if there is none yet.
+func LoadManifest(dir string) (*Manifest, error) {
+	m := &Manifest{Files: make(map[string]Entry), path: filepath.Join(dir, MANIFEST_NAME)}
+	data, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %w", m.path, err)
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]Entry)
+	}
+	return m, nil
+}
+
+// Save writes the manifest, replacing the previous one in a single rename
+// so a crash leaves either version intact.
+func (m *Manifest) Save() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
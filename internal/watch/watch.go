@@ -0,0 +1,404 @@
+// Package watch ships the files that appear in a directory. It polls the
+// directory and sends each new or changed file once its size and
+// modification time have held still for a settle period, remembering what
+// it sent in a manifest in the directory so a restart doesn't send it
+// again.
+//
+// A server out of disk space holds up every file rather than each failing
+// on its own: the watcher stops starting sends and probes with one file at
+// a time, FULL_DELAY apart and doubling up to MAX_FULL_DELAY, until one
+// goes through.
+//
+// Only regular files directly in the directory are sent; subdirectories,
+// names starting with a dot, which editors and copy tools use for files
+// they are still writing, and files the Watcher's Filter drops are left
+// alone.
+package watch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"socket-file-transfer/internal/pathfilter"
+	"socket-file-transfer/internal/schedule"
+	"socket-file-transfer/internal/wire"
+)
+
+const (
+	DefaultSettle = 5 * time.Second
+	DefaultPoll   = time.Second
+
+	// Most files being sent at once
+	MAX_UPLOADS = 4
+
+	// Wait before resending a failed file, doubling on each failure up to
+	// MAX_RETRY_DELAY
+	RETRY_DELAY     = 2 * time.Second
+	MAX_RETRY_DELAY = 5 * time.Minute
+
+	// Wait while the server is out of disk space before sending a file to
+	// see if it still is, doubling each time it is up to MAX_FULL_DELAY
+	FULL_DELAY     = 10 * time.Second
+	MAX_FULL_DELAY = 10 * time.Minute
+
+	// Where sent files go with AfterMove, inside the watched directory
+	SENT_DIR = "sent"
+)
+
+// SendFunc sends the file at path, asking the server to store it as name.
+type SendFunc func(ctx context.Context, path, name string) error
+
+// After is what happens to a file once it has been sent.
+type After int
+
+const (
+	AfterKeep   After = iota // Leave it, the manifest stops it being sent again
+	AfterDelete              // Remove it
+	AfterMove                // Move it into SENT_DIR
+)
+
+// ParseAfter parses "keep", "delete" or "move".
+func ParseAfter(s string) (After, error) {
+	switch s {
+	case "keep":
+		return AfterKeep, nil
+	case "delete":
+		return AfterDelete, nil
+	case "move":
+		return AfterMove, nil
+	}
+	return 0, fmt.Errorf("unknown action %q, want keep, delete or move", s)
+}
+
+// Watcher sends the files that settle in Dir.
+type Watcher struct {
+	Dir    string
+	Send   SendFunc
+	After  After
+	Settle time.Duration      // How long a file must stay unchanged, DefaultSettle if 0
+	Poll   time.Duration      // Time between scans, DefaultPoll if 0
+	Filter *pathfilter.Filter // Which files to send, all if nil
+	Queue  *schedule.Queue    // Orders the files that settled, by name if nil
+
+	// Stop with an error once the server is out of disk space, instead of
+	// waiting for it to have room again
+	FailFast bool
+
+	// First wait for room on a full server, FULL_DELAY if 0
+	FullDelay time.Duration
+
+	Logger *slog.Logger // wire.DefaultLogger if nil
+}
+
+func (w *Watcher) settle() time.Duration {
+	if w.Settle > 0 {
+		return w.Settle
+	}
+	return DefaultSettle
+}
+
+func (w *Watcher) poll() time.Duration {
+	if w.Poll > 0 {
+		return w.Poll
+	}
+	return DefaultPoll
+}
+
+func (w *Watcher) fullDelay() time.Duration {
+	if w.FullDelay > 0 {
+		return w.FullDelay
+	}
+	return FULL_DELAY
+}
+
+func (w *Watcher) logger() *slog.Logger {
+	if w.Logger != nil {
+		return w.Logger
+	}
+	return wire.DefaultLogger
+}
+
+// What the watcher knows of a file in the directory
+type file struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // When size or modTime last changed
+
+	queued   bool      // Waiting in the queue to be sent
+	busy     bool      // Being sent
+	failures int       // Failed sends since it last changed
+	retryAt  time.Time // Don't send before then
+	invalid  bool      // Its name can't be sent; skipped until it changes
+}
+
+// The outcome of sending a file
+type result struct {
+	name     string
+	entry    Entry
+	duration time.Duration
+	err      error
+}
+
+// While the server is out of disk space
+type destinationFull struct {
+	since   time.Time
+	delay   time.Duration // Before the next probe
+	probeAt time.Time
+	probe   string // File being sent to see if there is room, if any
+}
+
+// Run watches the directory until ctx ends, then waits for the files being
+// sent to finish; their sends don't see ctx end. It returns an error only
+// if the directory or manifest can't be used, or with FailFast once the
+// server is out of disk space.
+func (w *Watcher) Run(ctx context.Context) error {
+	log := w.logger()
+	manifest, err := LoadManifest(w.Dir)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]*file)
+	results := make(chan result)
+	busy := 0
+	queue := w.Queue
+	if queue == nil {
+		queue, _ = schedule.New(schedule.OrderName, nil)
+	}
+	var full *destinationFull
+	var fatal error
+
+	finish := func(r result) {
+		busy--
+		f := files[r.name]
+		if f != nil {
+			f.busy = false
+		}
+		if errors.Is(r.err, wire.ErrNoSpace) {
+			switch {
+			case w.FailFast:
+				if fatal == nil {
+					fatal = fmt.Errorf("error sending %s: %w", r.name, r.err)
+				}
+			case full == nil:
+				full = &destinationFull{since: time.Now(), delay: w.fullDelay()}
+				full.probeAt = full.since.Add(full.delay)
+				log.Warn("Destination full, waiting", "name", r.name, "err", r.err, "retry_in", full.delay)
+			case r.name == full.probe:
+				full.probe = ""
+				full.delay = min(full.delay*2, MAX_FULL_DELAY)
+				full.probeAt = time.Now().Add(full.delay)
+				log.Info("Destination still full", "waited", time.Since(full.since).Round(time.Second), "retry_in", full.delay)
+			}
+			return
+		}
+		if full != nil && (r.err == nil || r.name == full.probe) {
+			if r.err == nil {
+				log.Info("Destination has room again, resuming", "waited", time.Since(full.since).Round(time.Second))
+				full = nil
+			} else {
+				full.probe = ""
+				full.probeAt = time.Now().Add(full.delay)
+			}
+		}
+		if r.err != nil {
+			if f != nil {
+				f.failures++
+				delay := min(RETRY_DELAY<<min(f.failures-1, 16), MAX_RETRY_DELAY)
+				f.retryAt = time.Now().Add(delay)
+				log.Warn("Error sending file", "name", r.name, "err", r.err, "failures", f.failures, "retry_in", delay)
+			}
+			return
+		}
+		log.Info("Sent file", "name", r.name, "size", r.entry.Size, "duration", r.duration)
+		if f != nil {
+			f.failures = 0
+		}
+		manifest.Files[r.name] = r.entry
+		if err := manifest.Save(); err != nil {
+			log.Error("Error saving manifest", "err", err)
+		}
+		w.dispose(manifest, r.name)
+	}
+
+	ticker := time.NewTicker(w.poll())
+	defer ticker.Stop()
+	for {
+		if err := w.scan(files); err != nil {
+			return err
+		}
+		now := time.Now()
+		for name, f := range files {
+			if f.queued || f.busy || f.invalid || now.Before(f.retryAt) || now.Sub(f.since) < w.settle() {
+				continue
+			}
+			if e, ok := manifest.Files[name]; ok && e.Size == f.size && e.ModTime.Equal(f.modTime) {
+				// Sent before a restart but not yet disposed of
+				w.dispose(manifest, name)
+				continue
+			}
+			if err := wire.CheckName(name); err != nil {
+				log.Warn("Skipping file", "name", name, "err", err)
+				f.invalid = true
+				continue
+			}
+			queue.Push(schedule.Item{Name: name, Size: f.size, ModTime: f.modTime})
+			f.queued = true
+		}
+
+		for busy < MAX_UPLOADS && fatal == nil {
+			// While the server is full, one file at a time probes it
+			if full != nil && (busy > 0 || now.Before(full.probeAt)) {
+				break
+			}
+			it, ok := queue.Pop()
+			if !ok {
+				break
+			}
+			f := files[it.Name]
+			if f == nil || !f.queued || f.size != it.Size || !f.modTime.Equal(it.ModTime) {
+				continue // Gone or changed since queued
+			}
+			f.queued = false
+			if full != nil {
+				full.probe = it.Name
+			}
+			f.busy = true
+			busy++
+			go func(name string, f file, prev Entry) {
+				start := time.Now()
+				entry, err := w.send(context.WithoutCancel(ctx), name, f, prev)
+				results <- result{name, entry, time.Since(start), err}
+			}(it.Name, *f, manifest.Files[it.Name])
+		}
+
+		select {
+		case <-ticker.C:
+		case r := <-results:
+			finish(r)
+			if fatal != nil && busy == 0 {
+				return fatal
+			}
+		case <-ctx.Done():
+			if busy > 0 {
+				log.Info("Finishing uploads", "count", busy)
+			}
+			for ; busy > 0; finish(<-results) {
+			}
+			return nil
+		}
+	}
+}
+
+// scan brings files up to date with the directory.
+func (w *Watcher) scan(files map[string]*file) error {
+	entries, err := os.ReadDir(w.Dir)
+	if err != nil {
+		return fmt.Errorf("error reading watched directory: %w", err)
+	}
+	now := time.Now()
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || !e.Type().IsRegular() {
+			continue
+		}
+		if keep, _ := w.Filter.Keep(name, false); !keep {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // Removed since ReadDir
+		}
+		seen[name] = true
+		f := files[name]
+		if f == nil {
+			files[name] = &file{size: info.Size(), modTime: info.ModTime(), since: now}
+			continue
+		}
+		if f.size != info.Size() || !f.modTime.Equal(info.ModTime()) {
+			f.size, f.modTime, f.since = info.Size(), info.ModTime(), now
+			f.failures, f.retryAt, f.invalid, f.queued = 0, time.Time{}, false, false
+		}
+	}
+	for name, f := range files {
+		if !seen[name] && !f.busy {
+			delete(files, name)
+		}
+	}
+	return nil
+}
+
+// send hashes and sends the file called name, unless it has the content
+// prev records as sent, and returns its manifest entry.
+func (w *Watcher) send(ctx context.Context, name string, f file, prev Entry) (Entry, error) {
+	path := filepath.Join(w.Dir, name)
+	sum, err := hashFile(path)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry := Entry{Size: f.size, ModTime: f.modTime, SHA256: sum}
+	if sum == prev.SHA256 {
+		// Touched but unchanged
+		return entry, nil
+	}
+	if err := w.Send(ctx, path, name); err != nil {
+		return Entry{}, err
+	}
+
+	// A file that changed while being sent is sent again once it settles
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != f.size || !info.ModTime().Equal(f.modTime) {
+		return Entry{}, errors.New("file changed while being sent")
+	}
+	return entry, nil
+}
+
+// dispose deletes or moves a sent file, as w.After says, and forgets it
+// once it has left the directory.
+func (w *Watcher) dispose(m *Manifest, name string) {
+	path := filepath.Join(w.Dir, name)
+	var err error
+	switch w.After {
+	case AfterKeep:
+		return
+	case AfterDelete:
+		err = os.Remove(path)
+	case AfterMove:
+		dir := filepath.Join(w.Dir, SENT_DIR)
+		if err = os.MkdirAll(dir, 0755); err == nil {
+			err = os.Rename(path, filepath.Join(dir, name))
+		}
+	}
+	if err != nil {
+		w.logger().Error("Error disposing of sent file", "name", name, "err", err)
+		return
+	}
+	// A new file of the same name is a new upload
+	delete(m.Files, name)
+	if err := m.Save(); err != nil {
+		w.logger().Error("Error saving manifest", "err", err)
+	}
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,330 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// recorder is a SendFunc that records what it sent and can be made to fail.
+type recorder struct {
+	mu    sync.Mutex
+	sent  []string
+	fail  map[string]int // Sends of a name left to fail
+	block chan struct{}  // Sends wait for it if not nil
+	calls chan string
+
+	full    int           // Sends left to fail with wire.ErrNoSpace, whatever their name
+	hold    time.Duration // How long each send takes
+	times   []time.Time   // Of each send
+	wasFull bool          // A send failed with wire.ErrNoSpace
+	running int
+	probing int // Most sends at once since one failed with wire.ErrNoSpace
+}
+
+func newRecorder() *recorder {
+	return &recorder{fail: map[string]int{}, calls: make(chan string, 100)}
+}
+
+func (r *recorder) send(ctx context.Context, path, name string) error {
+	r.calls <- name
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	r.times = append(r.times, time.Now())
+	r.running++
+	if r.wasFull {
+		r.probing = max(r.probing, r.running)
+	}
+	r.mu.Unlock()
+	time.Sleep(r.hold)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running--
+	if r.full > 0 {
+		r.full--
+		r.wasFull = true
+		return fmt.Errorf("remote: %w", wire.ErrNoSpace)
+	}
+	r.wasFull = false
+	if r.fail[name] > 0 {
+		r.fail[name]--
+		return errors.New("send failed")
+	}
+	r.sent = append(r.sent, name)
+	return nil
+}
+
+func (r *recorder) sentNames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.sent...)
+}
+
+// start runs w until the test ends or the returned stop is called, which
+// waits for Run to return and gives its error.
+func start(t *testing.T, w *Watcher) (stop func() error) {
+	t.Helper()
+	w.Settle, w.Poll, w.Logger = 30*time.Millisecond, 5*time.Millisecond, quiet
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+	var once sync.Once
+	var err error
+	stop = func() error {
+		once.Do(func() {
+			cancel()
+			err = <-done
+		})
+		return err
+	}
+	t.Cleanup(func() { stop() })
+	return stop
+}
+
+// waitSent waits until r sent n files.
+func waitSent(t *testing.T, r *recorder, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.sentNames()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("sent %v, want %d files", r.sentNames(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func write(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchSendsSettledFiles(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "a.txt"), "a")
+	write(t, filepath.Join(dir, "b.txt"), "b")
+	write(t, filepath.Join(dir, ".partial"), "still being written")
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+
+	r := newRecorder()
+	stop := start(t, &Watcher{Dir: dir, Send: r.send})
+	waitSent(t, r, 2)
+	time.Sleep(50 * time.Millisecond)
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.sentNames(); len(got) != 2 {
+		t.Errorf("sent %v, want a.txt and b.txt once each", got)
+	}
+
+	m, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 2 || m.Files["a.txt"].Size != 1 || m.Files["a.txt"].SHA256 == "" {
+		t.Errorf("manifest %+v", m.Files)
+	}
+
+	// After a restart nothing is sent again until a file changes
+	r2 := newRecorder()
+	stop = start(t, &Watcher{Dir: dir, Send: r2.send})
+	time.Sleep(100 * time.Millisecond)
+	if got := r2.sentNames(); len(got) != 0 {
+		t.Fatalf("sent %v again after a restart", got)
+	}
+	write(t, filepath.Join(dir, "a.txt"), "changed")
+	waitSent(t, r2, 1)
+	if got := r2.sentNames(); got[0] != "a.txt" {
+		t.Errorf("sent %v, want the changed a.txt", got)
+	}
+}
+
+// A file still growing isn't sent until it holds still.
+func TestWatchSettle(t *testing.T) {
+	dir := t.TempDir()
+	r := newRecorder()
+	start(t, &Watcher{Dir: dir, Send: r.send})
+
+	path := filepath.Join(dir, "growing.log")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := 0; i < 10; i++ {
+		f.WriteString("line\n")
+		time.Sleep(10 * time.Millisecond)
+		if got := r.sentNames(); len(got) != 0 {
+			t.Fatalf("sent while still being written")
+		}
+	}
+	waitSent(t, r, 1)
+}
+
+func TestWatchAfter(t *testing.T) {
+	for _, after := range []After{AfterDelete, AfterMove} {
+		dir := t.TempDir()
+		write(t, filepath.Join(dir, "done.txt"), "x")
+		r := newRecorder()
+		stop := start(t, &Watcher{Dir: dir, Send: r.send, After: after})
+		waitSent(t, r, 1)
+		time.Sleep(20 * time.Millisecond)
+		stop()
+
+		if _, err := os.Stat(filepath.Join(dir, "done.txt")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("after %d: sent file still in place (%v)", after, err)
+		}
+		_, err := os.Stat(filepath.Join(dir, SENT_DIR, "done.txt"))
+		if moved := err == nil; moved != (after == AfterMove) {
+			t.Errorf("after %d: moved into %s is %v", after, SENT_DIR, moved)
+		}
+		if m, _ := LoadManifest(dir); len(m.Files) != 0 {
+			t.Errorf("after %d: manifest keeps %v", after, m.Files)
+		}
+	}
+}
+
+// A failed file is retried after RETRY_DELAY without holding up others.
+func TestWatchRetry(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "flaky.txt"), "x")
+	r := newRecorder()
+	r.fail["flaky.txt"] = 1
+	start(t, &Watcher{Dir: dir, Send: r.send})
+
+	<-r.calls
+	write(t, filepath.Join(dir, "other.txt"), "y")
+	waitSent(t, r, 1)
+	if got := r.sentNames(); got[0] != "other.txt" {
+		t.Fatalf("sent %v first, want other.txt while flaky.txt waits", got)
+	}
+	waitSent(t, r, 2)
+}
+
+// Stopping waits for the sends under way and records them.
+func TestWatchShutdownFlushes(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "slow.txt"), "x")
+	r := newRecorder()
+	r.block = make(chan struct{})
+	stop := start(t, &Watcher{Dir: dir, Send: r.send})
+	<-r.calls
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- stop() }()
+	select {
+	case <-stopped:
+		t.Fatal("stopped with a send under way")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(r.block)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := LoadManifest(dir); m.Files["slow.txt"].Size != 1 {
+		t.Errorf("manifest %v lacks the file sent while stopping", m.Files)
+	}
+}
+
+func TestParseAfter(t *testing.T) {
+	for s, want := range map[string]After{"keep": AfterKeep, "delete": AfterDelete, "move": AfterMove} {
+		if got, err := ParseAfter(s); got != want || err != nil {
+			t.Errorf("ParseAfter(%q) = %v, %v", s, got, err)
+		}
+	}
+	if _, err := ParseAfter("archive"); err == nil {
+		t.Error("ParseAfter accepted an unknown action")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	m, err := LoadManifest(dir)
+	if err != nil || len(m.Files) != 0 {
+		t.Fatalf("new manifest %v, %v", m, err)
+	}
+	when := time.Date(2024, 6, 17, 9, 0, 0, 0, time.UTC)
+	m.Files["a"] = Entry{Size: 3, ModTime: when, SHA256: "abc"}
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadManifest(dir)
+	if err != nil || again.Files["a"] != m.Files["a"] {
+		t.Errorf("reloaded %v, %v, want %v", again.Files, err, m.Files)
+	}
+
+	write(t, filepath.Join(dir, MANIFEST_NAME), "{not json")
+	if _, err := LoadManifest(dir); err == nil {
+		t.Error("corrupt manifest loaded")
+	}
+}
+
+// A full server holds every file up: the watcher probes it with one file
+// at a time, waiting twice as long after each probe that fails, and sends
+// the rest once one goes through.
+func TestWatchDestinationFull(t *testing.T) {
+	const delay = 40 * time.Millisecond
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		write(t, filepath.Join(dir, name), name)
+	}
+	r := newRecorder()
+	r.full, r.hold = 6, 5*time.Millisecond
+	start(t, &Watcher{Dir: dir, Send: r.send, FullDelay: delay})
+	waitSent(t, r, 4)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.probing != 1 {
+		t.Errorf("%d sends at once while the server was full, want 1", r.probing)
+	}
+	// The first 4 sends fail together, then 2 probes do and the third
+	// goes through before the remaining files
+	if len(r.times) != 10 {
+		t.Fatalf("%d sends, want 10", len(r.times))
+	}
+	for i, want := range []time.Duration{delay, 2 * delay, 4 * delay} {
+		if gap := r.times[4+i].Sub(r.times[3+i]); gap < want {
+			t.Errorf("probe %d came %v after the send before, want at least %v", i+1, gap, want)
+		}
+	}
+	if gap := r.times[9].Sub(r.times[6]); gap > 2*delay {
+		t.Errorf("remaining files took %v to go once the server had room", gap)
+	}
+}
+
+// With FailFast a full server stops the watcher, once the sends under way
+// end.
+func TestWatchDestinationFullFailFast(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "a"), "a")
+	r := newRecorder()
+	r.full = 1
+	w := &Watcher{Dir: dir, Send: r.send, FailFast: true}
+	w.Settle, w.Poll, w.Logger = 30*time.Millisecond, 5*time.Millisecond, quiet
+	done := make(chan error, 1)
+	go func() { done <- w.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, wire.ErrNoSpace) {
+			t.Errorf("got %v, want wire.ErrNoSpace", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher still running after the server filled up")
+	}
+}
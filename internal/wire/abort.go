@@ -0,0 +1,31 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// How long a cancelled client spends telling the server it gave up
+const ABORT_TIMEOUT = time.Second
+
+// NewAbort describes why a client gives up on its transfer, for telling
+// the server so it drops the partial file right away.
+func NewAbort(reason error) *RemoteError {
+	msg := reason.Error()
+	if len(msg) > MAX_ERROR_MSG_LEN {
+		msg = msg[:MAX_ERROR_MSG_LEN]
+	}
+	return &RemoteError{Code: CODE_ABORTED, Message: msg}
+}
+
+// Aborted returns the error a server fails a transfer with if err is the
+// abort its client sent, wrapping ErrAborted with the client's reason, and
+// nil for anything else.
+func Aborted(err error) error {
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Code != CODE_ABORTED {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrAborted, rerr.Message)
+}
@@ -0,0 +1,34 @@
+package wire
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// WriteAuth sends token, which tells the server which of its tenants the
+// client is, once FEATURE_AUTH is negotiated. On the wire it is an 8-bit
+// length and the token, straight after the hellos.
+func WriteAuth(w io.Writer, token string) error {
+	if len(token) > math.MaxUint8 {
+		return fmt.Errorf("%w: auth token is %d bytes, the limit is %d", ErrMalformed, len(token), math.MaxUint8)
+	}
+	b := append([]byte{byte(len(token))}, token...)
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("error sending auth token: %w", err)
+	}
+	return nil
+}
+
+// ReadAuth decodes the token WriteAuth sent.
+func ReadAuth(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", fmt.Errorf("error reading auth token: %w", err)
+	}
+	token := make([]byte, n[0])
+	if _, err := io.ReadFull(r, token); err != nil {
+		return "", fmt.Errorf("error reading auth token: %w", err)
+	}
+	return string(token), nil
+}
@@ -0,0 +1,168 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Failures a transfer can end with. Errors reported by the remote side in
+// an error frame unwrap to the matching sentinel, so callers can tell them
+// apart with errors.Is.
+var (
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrRejected         = errors.New("transfer rejected")
+	ErrTooLarge         = errors.New("file too large")
+	ErrTimeout          = errors.New("timed out")
+	ErrProtocol         = errors.New("protocol error")
+	ErrInvalidName      = errors.New("invalid filename")
+	ErrNotFound         = errors.New("file not found")
+	ErrNoSpace          = errors.New("insufficient disk space")
+	ErrAborted          = errors.New("aborted by client")
+	ErrPolicy           = errors.New("rejected by policy")
+	ErrKilled           = errors.New("killed by admin") // See Reporter.SetCancel
+	ErrExpansion        = errors.New("archive expands past the limits")
+)
+
+// ErrorCode identifies a failure on the wire.
+type ErrorCode byte
+
+const (
+	CODE_INTERNAL ErrorCode = iota // Anything without a more specific code
+	CODE_PROTOCOL
+	CODE_REJECTED
+	CODE_TOO_LARGE
+	CODE_CHECKSUM_MISMATCH
+	CODE_TIMEOUT
+	CODE_NOT_FOUND
+	CODE_NO_SPACE
+	CODE_ABORTED // The client gave up, see NewAbort
+	CODE_POLICY  // The server's scanner refused the file
+	CODE_EXPANSION
+)
+
+// Longest message carried by an error frame; longer ones are truncated
+const MAX_ERROR_MSG_LEN = 512
+
+// Error frame: code, 16-bit message length, message
+const MAX_ERROR_FRAME_LEN = 3 + MAX_ERROR_MSG_LEN
+
+var codeErrors = map[ErrorCode]error{
+	CODE_PROTOCOL:          ErrProtocol,
+	CODE_REJECTED:          ErrRejected,
+	CODE_TOO_LARGE:         ErrTooLarge,
+	CODE_CHECKSUM_MISMATCH: ErrChecksumMismatch,
+	CODE_TIMEOUT:           ErrTimeout,
+	CODE_NOT_FOUND:         ErrNotFound,
+	CODE_NO_SPACE:          ErrNoSpace,
+	CODE_ABORTED:           ErrAborted,
+	CODE_POLICY:            ErrPolicy,
+	CODE_EXPANSION:         ErrExpansion,
+}
+
+// Most specific first, for errors that wrap several sentinels
+var codeOrder = []ErrorCode{
+	CODE_ABORTED,
+	CODE_POLICY,
+	CODE_EXPANSION,
+	CODE_NO_SPACE,
+	CODE_NOT_FOUND,
+	CODE_TOO_LARGE,
+	CODE_CHECKSUM_MISMATCH,
+	CODE_TIMEOUT,
+	CODE_PROTOCOL,
+	CODE_REJECTED,
+}
+
+// CodeOf returns the code for the sentinel err wraps, the most specific one
+// if it wraps several, such as a rejection caused by a full disk.
+func CodeOf(err error) ErrorCode {
+	for _, code := range codeOrder {
+		if errors.Is(err, codeErrors[code]) {
+			return code
+		}
+	}
+	return CODE_INTERNAL
+}
+
+// RemoteError is a failure reported by the other side of a transfer.
+type RemoteError struct {
+	Code    ErrorCode
+	Message string
+}
+
+// NewRemoteError describes err for sending to the other side.
+func NewRemoteError(err error) *RemoteError {
+	msg := err.Error()
+	if len(msg) > MAX_ERROR_MSG_LEN {
+		msg = msg[:MAX_ERROR_MSG_LEN]
+	}
+	return &RemoteError{Code: CodeOf(err), Message: msg}
+}
+
+func (e *RemoteError) Error() string {
+	return "remote: " + e.Message
+}
+
+// Unwrap returns the sentinel matching e.Code, nil for CODE_INTERNAL.
+func (e *RemoteError) Unwrap() error {
+	return codeErrors[e.Code]
+}
+
+// MarshalBinary encodes e as an error frame.
+func (e *RemoteError) MarshalBinary() ([]byte, error) {
+	if len(e.Message) > MAX_ERROR_MSG_LEN {
+		return nil, fmt.Errorf("%w: %d byte error message", ErrMalformed, len(e.Message))
+	}
+	b := make([]byte, 0, 3+len(e.Message))
+	b = append(b, byte(e.Code))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(e.Message)))
+	return append(b, e.Message...), nil
+}
+
+// UnmarshalBinary decodes an error frame that must fill b exactly.
+func (e *RemoteError) UnmarshalBinary(b []byte) error {
+	if len(b) < 3 {
+		return fmt.Errorf("%w: %d byte error frame", ErrTruncated, len(b))
+	}
+	n := int(binary.BigEndian.Uint16(b[1:]))
+	if n > MAX_ERROR_MSG_LEN {
+		return fmt.Errorf("%w: %d byte error message", ErrMalformed, n)
+	}
+	if len(b) != 3+n {
+		return fmt.Errorf("%w: error frame needs %d bytes, got %d", ErrTruncated, 3+n, len(b))
+	}
+	e.Code = ErrorCode(b[0])
+	e.Message = printable(b[3:])
+	return nil
+}
+
+// ReadRemoteError decodes an error frame from a stream.
+func ReadRemoteError(r io.Reader) (*RemoteError, error) {
+	var fixed [3]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, fmt.Errorf("error reading error frame: %w", err)
+	}
+	n := int(binary.BigEndian.Uint16(fixed[1:]))
+	if n > MAX_ERROR_MSG_LEN {
+		return nil, fmt.Errorf("%w: %d byte error message", ErrMalformed, n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("error reading error frame: %w", err)
+	}
+	return &RemoteError{Code: ErrorCode(fixed[0]), Message: printable(msg)}, nil
+}
+
+// printable replaces characters a peer could use to garble a terminal.
+func printable(b []byte) string {
+	return strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return '?'
+		}
+		return r
+	}, string(b))
+}
@@ -0,0 +1,24 @@
+package wire
+
+import "time"
+
+const (
+	// How often a server storing a received file tells the client waiting
+	// for it what it is doing, once FEATURE_HEARTBEAT is negotiated
+	HEARTBEAT_INTERVAL = time.Second
+
+	// Heartbeats a TCP client may miss in a row before giving up on the
+	// server
+	HEARTBEAT_MISSES = 5
+
+	// Longest status a heartbeat carries; longer ones are truncated
+	MAX_STATUS_LEN = 255
+)
+
+// BusyStatus truncates status to fit a heartbeat.
+func BusyStatus(status string) string {
+	if len(status) > MAX_STATUS_LEN {
+		status = status[:MAX_STATUS_LEN]
+	}
+	return status
+}
@@ -0,0 +1,54 @@
+package wire
+
+import (
+	"fmt"
+	"time"
+)
+
+// FormatBytes renders n in the largest binary unit that keeps it above 1.
+func FormatBytes(n int64) string {
+	const units = "KMGT"
+	if n < 1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v, i := float64(n)/(1<<10), 0
+	for v >= 1<<10 && i < len(units)-1 {
+		v /= 1 << 10
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", v, units[i])
+}
+
+// FormatRate renders bytes moved in d as a speed in B/s, KB/s, MB/s or
+// GB/s, counting 1024 bytes to the KB. It returns "" when d is too short
+// to time, under a millisecond.
+func FormatRate(bytes int64, d time.Duration) string {
+	if d < time.Millisecond {
+		return ""
+	}
+	const units = "KMG"
+	v := float64(bytes) / d.Seconds()
+	if v < 1<<10 {
+		return fmt.Sprintf("%.0f B/s", v)
+	}
+	v, i := v/(1<<10), 0
+	for v >= 1<<10 && i < len(units)-1 {
+		v /= 1 << 10
+		i++
+	}
+	return fmt.Sprintf("%.2f %cB/s", v, units[i])
+}
+
+// FormatDuration rounds d to a precision that suits its size: microseconds
+// below a millisecond, down to whole seconds from a minute on.
+func FormatDuration(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return d.Round(time.Microsecond).String()
+	case d < time.Second:
+		return d.Round(10 * time.Microsecond).String()
+	case d < time.Minute:
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
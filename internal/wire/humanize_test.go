@@ -0,0 +1,98 @@
+package wire
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1, "1 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{1<<20 - 1, "1024.0 KiB"},
+		{1 << 20, "1.0 MiB"},
+		{5 << 30, "5.0 GiB"},
+		{3 << 40, "3.0 TiB"},
+		{1 << 50, "1024.0 TiB"},
+		{math.MaxInt64, "8388608.0 TiB"},
+	}
+	for _, tt := range tests {
+		if got := FormatBytes(tt.n); got != tt.want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	tests := []struct {
+		bytes int64
+		d     time.Duration
+		want  string
+	}{
+		{0, 0, ""},
+		{1 << 20, 0, ""},
+		{1 << 20, 999 * time.Microsecond, ""},
+		{0, time.Second, "0 B/s"},
+		{512, time.Second, "512 B/s"},
+		{1, time.Millisecond, "1000 B/s"},
+		{2048, time.Second, "2.00 KB/s"},
+		{100 << 20, 2 * time.Second, "50.00 MB/s"},
+		{3 << 30, time.Second, "3.00 GB/s"},
+		{5 << 40, time.Second, "5120.00 GB/s"},
+	}
+	for _, tt := range tests {
+		got := FormatRate(tt.bytes, tt.d)
+		if got != tt.want {
+			t.Errorf("FormatRate(%d, %v) = %q, want %q", tt.bytes, tt.d, got, tt.want)
+		}
+		if strings.Contains(got, "NaN") || strings.Contains(got, "Inf") {
+			t.Errorf("FormatRate(%d, %v) = %q", tt.bytes, tt.d, got)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0s"},
+		{1500 * time.Nanosecond, "2µs"},
+		{123456 * time.Nanosecond, "123µs"},
+		{12345678 * time.Nanosecond, "12.35ms"},
+		{1234567890 * time.Nanosecond, "1.235s"},
+		{90*time.Second + 400*time.Millisecond, "1m30s"},
+		{2*time.Hour + 500*time.Millisecond, "2h0m1s"},
+	}
+	for _, tt := range tests {
+		if got := FormatDuration(tt.d); got != tt.want {
+			t.Errorf("FormatDuration(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		done, total int64
+		want        float64
+	}{
+		{0, 0, 100},
+		{5, 0, 100},
+		{0, 10, 0},
+		{5, 10, 50},
+		{10, 10, 100},
+	}
+	for _, tt := range tests {
+		if got := percent(tt.done, tt.total); got != tt.want {
+			t.Errorf("percent(%d, %d) = %v, want %v", tt.done, tt.total, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package wire
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// DefaultLogger is used when a caller does not supply its own logger.
+var DefaultLogger = NewConsoleLogger(os.Stdout)
+
+// NewConsoleLogger returns a logger that prints one plain line per record,
+// "message key=value ...", prefixing warnings and errors with their level.
+// Floods of records are held back as NewSuppressHandler describes, over
+// SUPPRESS_WINDOW.
+func NewConsoleLogger(w io.Writer) *slog.Logger {
+	h := &consoleHandler{mu: new(sync.Mutex), w: w}
+	return slog.New(NewSuppressHandler(h, SUPPRESS_WINDOW, SUPPRESS_PER_SOURCE))
+}
+
+type consoleHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	attrs  []slog.Attr
+	prefix string // Group prefix for attribute keys
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	if r.Level >= slog.LevelWarn {
+		buf.WriteString(r.Level.String())
+		buf.WriteString(": ")
+	}
+	buf.WriteString(r.Message)
+
+	for _, a := range h.attrs {
+		writeAttr(&buf, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&buf, h.prefix, a)
+		return true
+	})
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func writeAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			writeAttr(buf, prefix+a.Key+".", ga)
+		}
+		return
+	}
+	fmt.Fprintf(buf, " %s%s=%v", prefix, a.Key, a.Value)
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	h2.attrs = append(h2.attrs, h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
@@ -0,0 +1,196 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// Length of a metadata frame, and tag and length of each of its fields
+	METADATA_LEN_LEN   = 4
+	METADATA_FIELD_LEN = 2 + 2
+
+	// Largest metadata frame a reader accepts
+	MAX_METADATA_LEN = 64 << 10
+
+	// Metadata fields. A reader skips tags it doesn't know, so new ones
+	// can be added without a new protocol version.
+	META_NAME        = 1 // Filename, required
+	META_SIZE        = 2 // 64-bit file size, required
+	META_FLAGS       = 3 // Header flags byte, none if absent
+	META_CHECKSUM    = 4 // SHA-256, iff the flags have FLAG_SKIP_IDENTICAL or FLAG_RANGE
+	META_PACKET_SIZE = 5 // 16-bit payload size, iff FLAG_PACKET_SIZE
+	META_FEC         = 6 // Data and parity packets per group, a byte each, iff FLAG_FEC
+	META_RANGE       = 7 // Transfer ID, 64-bit offset and length, iff FLAG_RANGE
+)
+
+// MarshalMetadata encodes h as a metadata frame, the file header of peers
+// that negotiated FEATURE_METADATA. On the wire it is the 32-bit length of
+// the fields that follow, each a 16-bit tag, a 16-bit length and its
+// value. Unlike the fixed layout of MarshalBinary, a field is added by
+// giving it a tag, which peers that don't know it skip.
+func (h *FileHeader) MarshalMetadata() ([]byte, error) {
+	if len(h.Name) > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: filename is %d bytes", ErrMalformed, len(h.Name))
+	}
+	hasSum := h.Flags&(FLAG_SKIP_IDENTICAL|FLAG_RANGE) != 0
+	if hasSum && len(h.Checksum) != CHECKSUM_LEN || !hasSum && h.Checksum != nil {
+		return nil, fmt.Errorf("%w: checksum does not match flags", ErrMalformed)
+	}
+
+	b := make([]byte, METADATA_LEN_LEN, 64+len(h.Name))
+	field := func(tag uint16, value []byte) {
+		b = binary.BigEndian.AppendUint16(b, tag)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+		b = append(b, value...)
+	}
+	field(META_NAME, []byte(h.Name))
+	field(META_SIZE, binary.BigEndian.AppendUint64(nil, h.Size))
+	if h.Flags != 0 {
+		field(META_FLAGS, []byte{h.Flags})
+	}
+	if hasSum {
+		field(META_CHECKSUM, h.Checksum)
+	}
+	if h.Flags&FLAG_PACKET_SIZE != 0 {
+		field(META_PACKET_SIZE, binary.BigEndian.AppendUint16(nil, h.PacketSize))
+	}
+	if h.Flags&FLAG_FEC != 0 {
+		field(META_FEC, []byte{h.FECData, h.FECParity})
+	}
+	if h.Flags&FLAG_RANGE != 0 {
+		rng := append([]byte(nil), h.RangeID[:]...)
+		rng = binary.BigEndian.AppendUint64(rng, h.RangeOffset)
+		field(META_RANGE, binary.BigEndian.AppendUint64(rng, h.RangeLength))
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-METADATA_LEN_LEN))
+	return b, nil
+}
+
+// UnmarshalMetadata decodes a metadata frame that must fill b exactly.
+func (h *FileHeader) UnmarshalMetadata(b []byte) error {
+	if len(b) < METADATA_LEN_LEN {
+		return fmt.Errorf("%w: %d byte metadata frame", ErrTruncated, len(b))
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(len(b)) < METADATA_LEN_LEN+uint64(n) {
+		return fmt.Errorf("%w: metadata frame needs %d bytes, got %d", ErrTruncated, METADATA_LEN_LEN+uint64(n), len(b))
+	}
+	if uint64(len(b)) > METADATA_LEN_LEN+uint64(n) {
+		return fmt.Errorf("%w: %d trailing bytes after metadata frame", ErrMalformed, uint64(len(b))-METADATA_LEN_LEN-uint64(n))
+	}
+	return h.unmarshalFields(b[METADATA_LEN_LEN:])
+}
+
+// unmarshalFields decodes the fields of a metadata frame.
+func (h *FileHeader) unmarshalFields(b []byte) error {
+	*h = FileHeader{}
+	seen := make(map[uint16]bool)
+	for len(b) > 0 {
+		if len(b) < METADATA_FIELD_LEN {
+			return fmt.Errorf("%w: %d byte metadata field", ErrTruncated, len(b))
+		}
+		tag := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[METADATA_FIELD_LEN:]
+		if len(b) < n {
+			return fmt.Errorf("%w: metadata field %d needs %d bytes, got %d", ErrTruncated, tag, n, len(b))
+		}
+		value := b[:n]
+		b = b[n:]
+		if tag < META_NAME || tag > META_RANGE {
+			continue // From a newer peer
+		}
+		if seen[tag] {
+			return fmt.Errorf("%w: metadata field %d repeated", ErrMalformed, tag)
+		}
+		seen[tag] = true
+
+		want := -1 // Length of a fixed-size field
+		switch tag {
+		case META_NAME:
+			h.Name = string(value)
+		case META_SIZE:
+			want = 8
+			if n == want {
+				h.Size = binary.BigEndian.Uint64(value)
+			}
+		case META_FLAGS:
+			want = 1
+			if n == want {
+				h.Flags = value[0]
+			}
+		case META_CHECKSUM:
+			want = CHECKSUM_LEN
+			h.Checksum = append([]byte(nil), value...)
+		case META_PACKET_SIZE:
+			want = PACKET_SIZE_LEN
+			if n == want {
+				h.PacketSize = binary.BigEndian.Uint16(value)
+			}
+		case META_FEC:
+			want = FEC_LEN
+			if n == want {
+				h.FECData, h.FECParity = value[0], value[1]
+			}
+		case META_RANGE:
+			want = RANGE_LEN
+			if n == want {
+				copy(h.RangeID[:], value)
+				h.RangeOffset = binary.BigEndian.Uint64(value[RANGE_ID_LEN:])
+				h.RangeLength = binary.BigEndian.Uint64(value[RANGE_ID_LEN+8:])
+			}
+		}
+		if want >= 0 && n != want {
+			return fmt.Errorf("%w: metadata field %d is %d bytes, want %d", ErrMalformed, tag, n, want)
+		}
+	}
+
+	if !seen[META_NAME] || !seen[META_SIZE] {
+		return fmt.Errorf("%w: metadata frame lacks the name or size", ErrMalformed)
+	}
+	// The flags say which of the optional fields are there
+	for _, f := range []struct {
+		tag   uint16
+		flags byte
+	}{
+		{META_CHECKSUM, FLAG_SKIP_IDENTICAL | FLAG_RANGE},
+		{META_PACKET_SIZE, FLAG_PACKET_SIZE},
+		{META_FEC, FLAG_FEC},
+		{META_RANGE, FLAG_RANGE},
+	} {
+		if seen[f.tag] != (h.Flags&f.flags != 0) {
+			return fmt.Errorf("%w: metadata field %d does not match flags %#x", ErrMalformed, f.tag, h.Flags)
+		}
+	}
+	return nil
+}
+
+// ReadMetadata decodes a metadata frame from a stream, rejecting frames
+// longer than MAX_METADATA_LEN before reading them and filenames longer
+// than maxName bytes.
+func ReadMetadata(r io.Reader, maxName int) (*FileHeader, error) {
+	var length [METADATA_LEN_LEN]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, fmt.Errorf("error reading metadata length: %w", err)
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > MAX_METADATA_LEN {
+		return nil, fmt.Errorf("%w: metadata frame is %d bytes", ErrMalformed, n)
+	}
+	fields, err := readDeclared(r, int(n))
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata: %w", err)
+	}
+
+	var h FileHeader
+	if err := h.unmarshalFields(fields); err != nil {
+		return nil, err
+	}
+	if len(h.Name) > maxName {
+		return nil, fmt.Errorf("%w: filename is %d bytes", ErrMalformed, len(h.Name))
+	}
+	return &h, nil
+}
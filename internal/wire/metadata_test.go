@@ -0,0 +1,190 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// metaField encodes one metadata field.
+func metaField(tag uint16, value []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, tag)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// metaFrame puts fields behind their length.
+func metaFrame(fields ...[]byte) []byte {
+	body := bytes.Join(fields, nil)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...)
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		h    FileHeader
+	}{
+		{"plain", FileHeader{Name: "a.txt", Size: 42}},
+		{"empty file", FileHeader{Name: "empty"}},
+		{"largest size", FileHeader{Name: "huge", Size: 1<<64 - 1}},
+		{"skip identical", FileHeader{Name: "s", Size: 7, Flags: FLAG_SKIP_IDENTICAL, Checksum: testSum}},
+		{"packet size", FileHeader{Name: "p", Size: 9, Flags: FLAG_PACKET_SIZE, PacketSize: 1400}},
+		{"fec", FileHeader{Name: "f", Size: 9, Flags: FLAG_FEC, FECData: 8, FECParity: 2}},
+		{"range", FileHeader{Name: "r", Size: 1 << 40, Flags: FLAG_RANGE, Checksum: testSum, RangeID: [RANGE_ID_LEN]byte{1, 2, 3}, RangeOffset: 1 << 30, RangeLength: 1 << 20}},
+		{"unicode name", FileHeader{Name: "relatório 📄.pdf", Size: 1}},
+		{"long name", FileHeader{Name: string(bytes.Repeat([]byte{'n'}, MAX_NAME_BYTES)), Size: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.h.MarshalMetadata()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got FileHeader
+			if err := got.UnmarshalMetadata(b); err != nil {
+				t.Fatalf("UnmarshalMetadata: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.h) {
+				t.Errorf("UnmarshalMetadata = %+v, want %+v", got, tt.h)
+			}
+			read, err := ReadMetadata(bytes.NewReader(b), MAX_NAME_BYTES)
+			if err != nil {
+				t.Fatalf("ReadMetadata: %v", err)
+			}
+			if !reflect.DeepEqual(*read, tt.h) {
+				t.Errorf("ReadMetadata = %+v, want %+v", *read, tt.h)
+			}
+		})
+	}
+}
+
+// The layout PROTOCOL.md documents: the frame length, then each field's
+// tag, length and value.
+func TestMetadataEncoding(t *testing.T) {
+	b, _ := (&FileHeader{Name: "ab", Size: 5, Flags: FLAG_PACKET_SIZE, PacketSize: 1400}).MarshalMetadata()
+	want := metaFrame(
+		metaField(META_NAME, []byte("ab")),
+		metaField(META_SIZE, []byte{0, 0, 0, 0, 0, 0, 0, 5}),
+		metaField(META_FLAGS, []byte{FLAG_PACKET_SIZE}),
+		metaField(META_PACKET_SIZE, []byte{0x05, 0x78}),
+	)
+	if !bytes.Equal(b, want) {
+		t.Errorf("encoded %x, want %x", b, want)
+	}
+}
+
+// Fields a newer peer added are skipped, wherever they are.
+func TestMetadataUnknownFields(t *testing.T) {
+	b := metaFrame(
+		metaField(99, []byte("from the future")),
+		metaField(META_NAME, []byte("f")),
+		metaField(META_RANGE+1, nil),
+		metaField(META_SIZE, []byte{0, 0, 0, 0, 0, 0, 0, 3}),
+		metaField(0xffff, bytes.Repeat([]byte{1}, 300)),
+	)
+	var h FileHeader
+	if err := h.UnmarshalMetadata(b); err != nil {
+		t.Fatal(err)
+	}
+	if h.Name != "f" || h.Size != 3 {
+		t.Errorf("decoded %+v, want f of 3 bytes", h)
+	}
+}
+
+func TestMetadataErrors(t *testing.T) {
+	name := metaField(META_NAME, []byte("f"))
+	size := metaField(META_SIZE, make([]byte, 8))
+	tests := []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"empty", nil, ErrTruncated},
+		{"frame cut short", metaFrame(name, size)[:8], ErrTruncated},
+		{"trailing bytes", append(metaFrame(name, size), 0), ErrMalformed},
+		{"field header cut short", metaFrame(name, size, []byte{0, 1}), ErrTruncated},
+		{"field value cut short", metaFrame(name, size, []byte{0, 99, 0, 5, 'x'}), ErrTruncated},
+		{"no name", metaFrame(size), ErrMalformed},
+		{"no size", metaFrame(name), ErrMalformed},
+		{"short size", metaFrame(name, metaField(META_SIZE, make([]byte, 4))), ErrMalformed},
+		{"repeated name", metaFrame(name, size, name), ErrMalformed},
+		{"checksum without flag", metaFrame(name, size, metaField(META_CHECKSUM, testSum)), ErrMalformed},
+		{"flag without checksum", metaFrame(name, size, metaField(META_FLAGS, []byte{FLAG_SKIP_IDENTICAL})), ErrMalformed},
+		{"short checksum", metaFrame(name, size, metaField(META_FLAGS, []byte{FLAG_SKIP_IDENTICAL}), metaField(META_CHECKSUM, testSum[:5])), ErrMalformed},
+		{"wide flags", metaFrame(name, size, metaField(META_FLAGS, []byte{0, 0})), ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h FileHeader
+			err := h.UnmarshalMetadata(tt.b)
+			if !errors.Is(err, tt.want) || !errors.Is(err, ErrProtocol) {
+				t.Errorf("got %v, want %v wrapping ErrProtocol", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataMarshalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		h    FileHeader
+	}{
+		{"checksum without flag", FileHeader{Name: "a", Checksum: testSum}},
+		{"flag without checksum", FileHeader{Name: "a", Flags: FLAG_RANGE}},
+		{"name too long for a field", FileHeader{Name: string(make([]byte, 1<<16))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.h.MarshalMetadata(); !errors.Is(err, ErrMalformed) {
+				t.Errorf("got %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+// A stream reader refuses a frame declared too long before reading it, and
+// a name longer than it allows.
+func TestReadMetadataLimits(t *testing.T) {
+	huge := binary.BigEndian.AppendUint32(nil, MAX_METADATA_LEN+1)
+	if _, err := ReadMetadata(bytes.NewReader(huge), MAX_NAME_BYTES); !errors.Is(err, ErrMalformed) {
+		t.Errorf("%d byte frame: got %v, want ErrMalformed", MAX_METADATA_LEN+1, err)
+	}
+	b, _ := (&FileHeader{Name: "twelve bytes", Size: 1}).MarshalMetadata()
+	if _, err := ReadMetadata(bytes.NewReader(b), 11); !errors.Is(err, ErrMalformed) {
+		t.Errorf("name past the limit: got %v, want ErrMalformed", err)
+	}
+}
+
+func FuzzMetadata(f *testing.F) {
+	for _, h := range []FileHeader{
+		{Name: "a.txt", Size: 42},
+		{Name: "r", Size: 1 << 40, Flags: FLAG_RANGE, Checksum: testSum, RangeOffset: 1, RangeLength: 2},
+		{Name: "p", Flags: FLAG_PACKET_SIZE | FLAG_FEC, PacketSize: 512, FECData: 4, FECParity: 1},
+	} {
+		b, _ := h.MarshalMetadata()
+		f.Add(b)
+	}
+	f.Add(metaFrame(metaField(99, nil), metaField(META_NAME, []byte("x")), metaField(META_SIZE, make([]byte, 8))))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var h FileHeader
+		if err := h.UnmarshalMetadata(b); err != nil {
+			return
+		}
+		// What decodes encodes again, if not to the same bytes, since
+		// unknown fields are dropped and known ones put in order
+		again, err := h.MarshalMetadata()
+		if err != nil {
+			t.Fatalf("MarshalMetadata of a decoded header: %v", err)
+		}
+		var h2 FileHeader
+		if err := h2.UnmarshalMetadata(again); err != nil {
+			t.Fatalf("re-encoded header doesn't decode: %v", err)
+		}
+		if !reflect.DeepEqual(h, h2) {
+			t.Fatalf("decoded %+v, then %+v", h, h2)
+		}
+	})
+}
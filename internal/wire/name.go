@@ -0,0 +1,131 @@
+package wire
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Longest path, in UTF-16 code units and including the terminating NUL,
+// that Windows programs handle unless long paths are enabled
+const WINDOWS_MAX_PATH = 260
+
+// Device names Windows reserves whatever the extension
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Longest part of a filename a partial file's name keeps, leaving room
+// within MAX_NAME_BYTES for the leading dot, os.CreateTemp's random number
+// and the .part suffix
+const MAX_PART_STEM = MAX_NAME_BYTES - len(".") - len(".4294967295.part")
+
+// PartPattern returns the os.CreateTemp pattern of the hidden file a file
+// named base is received into, "."+base+".*.part", with base cut short on
+// a character boundary so even a name of MAX_NAME_BYTES leaves one that
+// file systems accept.
+func PartPattern(base string) string {
+	if len(base) > MAX_PART_STEM {
+		base = base[:MAX_PART_STEM]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+	}
+	return "." + base + ".*.part"
+}
+
+// Appended to the hidden name of a stored file's completion marker
+const MARKER_SUFFIX = ".done"
+
+// MarkerPath returns the path of the completion marker of the file at
+// path, ".<name>.done" next to it. Being hidden, it is skipped wherever
+// stored files are listed, as checksum sidecars are.
+func MarkerPath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "."+name+MARKER_SUFFIX)
+}
+
+// IsMarker reports whether name, a file's base name, is that of a
+// completion marker.
+func IsMarker(name string) bool {
+	return len(name) > len("."+MARKER_SUFFIX) && strings.HasPrefix(name, ".") && strings.HasSuffix(name, MARKER_SUFFIX)
+}
+
+// LocalName returns the name a checked filename is stored under in dir on
+// this platform. Elsewhere than on Windows that is the name itself. On
+// Windows each of < > : " | ? * becomes _, trailing dots and spaces are
+// dropped, device names such as CON or com1.txt get a leading _, and
+// unless long paths are enabled the name is shortened, keeping its
+// extension, so the path stays under WINDOWS_MAX_PATH.
+func LocalName(dir, name string) string {
+	return localName(dir, name)
+}
+
+// ClientDir names the upload subdirectory of the client at addr after its
+// IP address, with the colons of IPv6 addresses and the % of a zone turned
+// into _ so the name is valid everywhere. Unix socket clients, which have
+// no address, share LOCAL_CLIENT.
+func ClientDir(addr net.Addr) string {
+	host := ClientName(addr)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return strings.NewReplacer(":", "_", "%", "_").Replace(host)
+}
+
+// Name of clients connected over a unix socket
+const LOCAL_CLIENT = "local"
+
+// ClientName returns addr as a string, or LOCAL_CLIENT for the unnamed
+// address, "@" or "", of a unix socket client.
+func ClientName(addr net.Addr) string {
+	if s := addr.String(); addr.Network() != "unix" || s != "" && s != "@" {
+		return s
+	}
+	return LOCAL_CLIENT
+}
+
+// windowsName maps name to one Windows accepts, at most room UTF-16 code
+// units long if room is positive.
+func windowsName(name string, room int) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		name = "_"
+	}
+	base, _, _ := strings.Cut(name, ".")
+	if windowsReserved[strings.ToUpper(strings.TrimRight(base, " "))] {
+		name = "_" + name
+	}
+
+	if room <= 0 || utf16Len(name) <= room {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if utf16Len(ext) >= room {
+		ext = ""
+	}
+	stem := []rune(strings.TrimSuffix(name, ext))
+	for len(stem) > 1 && utf16Len(string(stem))+utf16Len(ext) > room {
+		stem = stem[:len(stem)-1]
+	}
+	return strings.TrimRight(string(stem), ". ") + ext
+}
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
@@ -0,0 +1,7 @@
+//go:build !windows
+
+package wire
+
+func localName(dir, name string) string {
+	return name
+}
@@ -0,0 +1,99 @@
+package wire
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// Partial files of names up to the limit get names file systems accept.
+func TestPartPattern(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"a.txt",
+		strings.Repeat("x", MAX_NAME_BYTES),
+		strings.Repeat("é", MAX_NAME_BYTES/2) + "x",
+		strings.Repeat("🎉", MAX_NAME_BYTES/4),
+	} {
+		pattern := PartPattern(name)
+		if !utf8.ValidString(pattern) || !strings.HasPrefix(pattern, ".") || !strings.HasSuffix(pattern, ".*.part") {
+			t.Errorf("PartPattern(%q) = %q", name, pattern)
+		}
+		f, err := os.CreateTemp(dir, pattern)
+		if err != nil {
+			t.Fatalf("%d byte name: %v", len(name), err)
+		}
+		f.Close()
+	}
+}
+
+// windowsName is a pure function, so its table runs on every platform.
+func TestWindowsName(t *testing.T) {
+	tests := []struct {
+		name string
+		room int
+		want string
+	}{
+		{"report.pdf", 0, "report.pdf"},
+		{`a<b>c:d"e|f?g*h.txt`, 0, "a_b_c_d_e_f_g_h.txt"},
+		{"aux.txt", 0, "_aux.txt"},
+		{"CON", 0, "_CON"},
+		{"com1.tar.gz", 0, "_com1.tar.gz"},
+		{"Lpt9", 0, "_Lpt9"},
+		{"nul .txt", 0, "_nul .txt"},
+		{"conin$", 0, "_conin$"},
+		{"com10.txt", 0, "com10.txt"},
+		{"console.log", 0, "console.log"},
+		{"trailing. . ", 0, "trailing"},
+		{"...", 0, "_"},
+		{"отчёт?.pdf", 0, "отчёт_.pdf"},
+
+		// Shortened to room UTF-16 code units, keeping the extension
+		{"abcdefghij.txt", 10, "abcdef.txt"},
+		{"abcdefghij.txt", 14, "abcdefghij.txt"},
+		{"abcdefghij.verylongextension", 10, "abcdefghij"},
+		{"🎉🎉🎉🎉.txt", 8, "🎉🎉.txt"},
+		{"abc. .txt", 7, "abc.txt"},
+	}
+	for _, tt := range tests {
+		if got := windowsName(tt.name, tt.room); got != tt.want {
+			t.Errorf("windowsName(%q, %d) = %q, want %q", tt.name, tt.room, got, tt.want)
+		}
+		if got := windowsName(tt.name, tt.room); tt.room > 0 && utf16Len(got) > tt.room {
+			t.Errorf("windowsName(%q, %d) = %q, %d code units", tt.name, tt.room, got, utf16Len(got))
+		}
+	}
+}
+
+func TestLocalNamePassThrough(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("names are mapped on Windows")
+	}
+	for _, name := range []string{"aux.txt", `a:b?.txt`, "trailing. "} {
+		if got := LocalName(t.TempDir(), name); got != name {
+			t.Errorf("LocalName(%q) = %q, want it unchanged", name, got)
+		}
+	}
+}
+
+// A file's marker is hidden next to it, and only marker names look like
+// one.
+func TestMarker(t *testing.T) {
+	if got, want := MarkerPath(filepath.Join("up", "sub", "a.txt")), filepath.Join("up", "sub", ".a.txt.done"); got != want {
+		t.Errorf("MarkerPath = %s, want %s", got, want)
+	}
+	for name, want := range map[string]bool{
+		".a.txt.done": true,
+		".done":       false,
+		"a.txt.done":  false,
+		".a.txt":      false,
+		".a.done.1":   false,
+	} {
+		if got := IsMarker(name); got != want {
+			t.Errorf("IsMarker(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
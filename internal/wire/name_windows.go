@@ -0,0 +1,29 @@
+package wire
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+var rtlAreLongPathsEnabled = syscall.NewLazyDLL("ntdll.dll").NewProc("RtlAreLongPathsEnabled")
+
+func localName(dir, name string) string {
+	room := 0
+	if !longPathsEnabled() {
+		if abs, err := filepath.Abs(dir); err == nil {
+			// Leave room for the separator and the terminating NUL
+			room = max(1, WINDOWS_MAX_PATH-utf16Len(abs)-2)
+		}
+	}
+	return windowsName(name, room)
+}
+
+// longPathsEnabled reports whether the system lifts the MAX_PATH limit,
+// which Windows 10 1607 and later can.
+func longPathsEnabled() bool {
+	if rtlAreLongPathsEnabled.Find() != nil {
+		return false
+	}
+	ret, _, _ := rtlAreLongPathsEnabled.Call()
+	return byte(ret) != 0
+}
@@ -0,0 +1,416 @@
+package wire
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// Fixed part of a file header: flags and filename length, file size
+	FILE_HEADER_LEN = 4 + 8
+
+	// Checksum carried by headers with FLAG_SKIP_IDENTICAL or FLAG_RANGE
+	CHECKSUM_LEN = sha256.Size
+
+	// Transfer ID, byte offset and length of the range carried by headers
+	// with FLAG_RANGE
+	RANGE_ID_LEN = 16
+	RANGE_LEN    = RANGE_ID_LEN + 8 + 8
+
+	// Payload size carried by headers with FLAG_PACKET_SIZE
+	PACKET_SIZE_LEN = 2
+
+	// Data and parity packets per group, carried by headers with FLAG_FEC
+	FEC_LEN = 2
+
+	// UDP data packet header: sequence number, flags, payload size and the
+	// parity index
+	DATA_HEADER_LEN = 8
+	MAX_PAYLOAD_LEN = 1<<16 - 1
+
+	// Byte offset following the header of packets with PACKET_OFFSET
+	DATA_OFFSET_LEN = 8
+
+	// Data packet flags
+	PACKET_LAST   = 0x01 // Last data packet of the file
+	PACKET_PARITY = 0x02 // Parity of an FEC group rather than file data
+	PACKET_OFFSET = 0x04 // Carries the payload's byte offset in the file
+
+	ACK_LEN = 4
+
+	// Ack flags
+	ACK_REPAIRED   = 0x01 // Rebuilt from FEC parity
+	ACK_CUMULATIVE = 0x02 // Acknowledges every packet up to Seq
+
+	// UDP header ACK since version 3: magic, version, status, session ID,
+	// packet size, features, starting offset
+	HEADER_ACK_LEN = len(MAGIC) + 1 + 1 + 4 + 2 + 4 + 8
+
+	// Header ACK statuses
+	HEADER_STATUS_OK   = 0 // Send the file's data
+	HEADER_STATUS_SKIP = 1 // The server already holds an identical copy
+)
+
+// Decoding errors, both of which wrap ErrProtocol
+var (
+	ErrTruncated = fmt.Errorf("%w: truncated packet", ErrProtocol)
+	ErrMalformed = fmt.Errorf("%w: malformed packet", ErrProtocol)
+)
+
+// FileHeader announces a file. On the wire it is the flags byte and a
+// 24-bit filename length, the filename, the 64-bit file size, with
+// FLAG_SKIP_IDENTICAL or FLAG_RANGE the file's SHA-256, with
+// FLAG_PACKET_SIZE the 16-bit payload size of the data packets to follow,
+// with FLAG_FEC the data and parity packet counts of an FEC group, a byte
+// each, and with FLAG_RANGE the transfer's ID and the 64-bit offset and
+// length of the range the connection sends. Integers are big-endian.
+type FileHeader struct {
+	Name        string
+	Size        uint64
+	Flags       byte
+	Checksum    []byte             // Present iff Flags has FLAG_SKIP_IDENTICAL or FLAG_RANGE
+	PacketSize  uint16             // Sent iff Flags has FLAG_PACKET_SIZE
+	FECData     byte               // Sent iff Flags has FLAG_FEC
+	FECParity   byte               // Sent iff Flags has FLAG_FEC
+	RangeID     [RANGE_ID_LEN]byte // Sent iff Flags has FLAG_RANGE, the same for each range of a file
+	RangeOffset uint64             // Sent iff Flags has FLAG_RANGE
+	RangeLength uint64             // Sent iff Flags has FLAG_RANGE
+}
+
+// Len returns the encoded size of h.
+func (h *FileHeader) Len() int {
+	return FILE_HEADER_LEN + len(h.Name) + trailerLen(h.Flags)
+}
+
+// trailerLen returns the length of the optional fields flags announce.
+func trailerLen(flags byte) int {
+	n := 0
+	if flags&(FLAG_SKIP_IDENTICAL|FLAG_RANGE) != 0 {
+		n += CHECKSUM_LEN
+	}
+	if flags&FLAG_PACKET_SIZE != 0 {
+		n += PACKET_SIZE_LEN
+	}
+	if flags&FLAG_FEC != 0 {
+		n += FEC_LEN
+	}
+	if flags&FLAG_RANGE != 0 {
+		n += RANGE_LEN
+	}
+	return n
+}
+
+// MarshalBinary encodes h.
+func (h *FileHeader) MarshalBinary() ([]byte, error) {
+	if len(h.Name) > MAX_FILENAME_LEN {
+		return nil, fmt.Errorf("%w: filename is %d bytes", ErrMalformed, len(h.Name))
+	}
+	hasSum := h.Flags&(FLAG_SKIP_IDENTICAL|FLAG_RANGE) != 0
+	if hasSum && len(h.Checksum) != CHECKSUM_LEN || !hasSum && h.Checksum != nil {
+		return nil, fmt.Errorf("%w: checksum does not match flags", ErrMalformed)
+	}
+
+	b := make([]byte, 0, h.Len())
+	b = binary.BigEndian.AppendUint32(b, uint32(h.Flags)<<24|uint32(len(h.Name)))
+	b = append(b, h.Name...)
+	b = binary.BigEndian.AppendUint64(b, h.Size)
+	b = append(b, h.Checksum...)
+	if h.Flags&FLAG_PACKET_SIZE != 0 {
+		b = binary.BigEndian.AppendUint16(b, h.PacketSize)
+	}
+	if h.Flags&FLAG_FEC != 0 {
+		b = append(b, h.FECData, h.FECParity)
+	}
+	if h.Flags&FLAG_RANGE != 0 {
+		b = append(b, h.RangeID[:]...)
+		b = binary.BigEndian.AppendUint64(b, h.RangeOffset)
+		b = binary.BigEndian.AppendUint64(b, h.RangeLength)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a header that must fill b exactly.
+func (h *FileHeader) UnmarshalBinary(b []byte) error {
+	if len(b) < 4 {
+		return fmt.Errorf("%w: %d byte file header", ErrTruncated, len(b))
+	}
+	flags, nameLen := splitNameLen(b)
+	need := FILE_HEADER_LEN + nameLen + trailerLen(flags)
+	if len(b) < need {
+		return fmt.Errorf("%w: file header needs %d bytes, got %d", ErrTruncated, need, len(b))
+	}
+	if len(b) > need {
+		return fmt.Errorf("%w: %d trailing bytes after file header", ErrMalformed, len(b)-need)
+	}
+
+	b = b[4:]
+	h.Flags = flags
+	h.Name = string(b[:nameLen])
+	h.Size = binary.BigEndian.Uint64(b[nameLen:])
+	h.Checksum, h.PacketSize = nil, 0
+	h.FECData, h.FECParity = 0, 0
+	h.RangeID, h.RangeOffset, h.RangeLength = [RANGE_ID_LEN]byte{}, 0, 0
+	b = b[nameLen+8:]
+	if flags&(FLAG_SKIP_IDENTICAL|FLAG_RANGE) != 0 {
+		h.Checksum = append([]byte(nil), b[:CHECKSUM_LEN]...)
+		b = b[CHECKSUM_LEN:]
+	}
+	if flags&FLAG_PACKET_SIZE != 0 {
+		h.PacketSize = binary.BigEndian.Uint16(b)
+		b = b[PACKET_SIZE_LEN:]
+	}
+	if flags&FLAG_FEC != 0 {
+		h.FECData, h.FECParity = b[0], b[1]
+		b = b[FEC_LEN:]
+	}
+	if flags&FLAG_RANGE != 0 {
+		copy(h.RangeID[:], b)
+		h.RangeOffset = binary.BigEndian.Uint64(b[RANGE_ID_LEN:])
+		h.RangeLength = binary.BigEndian.Uint64(b[RANGE_ID_LEN+8:])
+	}
+	return nil
+}
+
+// ReadFileHeader decodes a header from a stream, rejecting filenames longer
+// than maxName bytes before reading them.
+func ReadFileHeader(r io.Reader, maxName int) (*FileHeader, error) {
+	var fixed [4]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, fmt.Errorf("error reading filename length: %w", err)
+	}
+	flags, nameLen := splitNameLen(fixed[:])
+	if nameLen > maxName {
+		return nil, fmt.Errorf("%w: filename is %d bytes", ErrMalformed, nameLen)
+	}
+
+	rest := make([]byte, nameLen+8)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("error reading filename and size: %w", err)
+	}
+
+	h := &FileHeader{
+		Name:  string(rest[:nameLen]),
+		Size:  binary.BigEndian.Uint64(rest[nameLen:]),
+		Flags: flags,
+	}
+	if flags&(FLAG_SKIP_IDENTICAL|FLAG_RANGE) != 0 {
+		h.Checksum = make([]byte, CHECKSUM_LEN)
+		if _, err := io.ReadFull(r, h.Checksum); err != nil {
+			return nil, fmt.Errorf("error reading file checksum: %w", err)
+		}
+	}
+	if flags&FLAG_PACKET_SIZE != 0 {
+		var size [PACKET_SIZE_LEN]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, fmt.Errorf("error reading packet size: %w", err)
+		}
+		h.PacketSize = binary.BigEndian.Uint16(size[:])
+	}
+	if flags&FLAG_FEC != 0 {
+		var fec [FEC_LEN]byte
+		if _, err := io.ReadFull(r, fec[:]); err != nil {
+			return nil, fmt.Errorf("error reading FEC group size: %w", err)
+		}
+		h.FECData, h.FECParity = fec[0], fec[1]
+	}
+	if flags&FLAG_RANGE != 0 {
+		var rng [RANGE_LEN]byte
+		if _, err := io.ReadFull(r, rng[:]); err != nil {
+			return nil, fmt.Errorf("error reading range: %w", err)
+		}
+		copy(h.RangeID[:], rng[:])
+		h.RangeOffset = binary.BigEndian.Uint64(rng[RANGE_ID_LEN:])
+		h.RangeLength = binary.BigEndian.Uint64(rng[RANGE_ID_LEN+8:])
+	}
+	return h, nil
+}
+
+func splitNameLen(b []byte) (flags byte, n int) {
+	v := binary.BigEndian.Uint32(b)
+	return byte(v >> 24), int(v & MAX_FILENAME_LEN)
+}
+
+// DataPacket carries one chunk of a file over UDP, or with Parity set one
+// parity packet of FEC group Seq. Since protocol version 2 data packets
+// also carry the byte offset of their payload, so the receiver can place
+// it without counting packets.
+type DataPacket struct {
+	Seq       uint32
+	Last      bool
+	Parity    bool
+	Index     byte // Of the parity packet within its group
+	HasOffset bool
+	Offset    uint64 // Sent iff HasOffset
+	Payload   []byte
+}
+
+// Len returns the encoded size of p.
+func (p *DataPacket) Len() int {
+	if p.HasOffset {
+		return DATA_HEADER_LEN + DATA_OFFSET_LEN + len(p.Payload)
+	}
+	return DATA_HEADER_LEN + len(p.Payload)
+}
+
+// MarshalBinary encodes p.
+func (p *DataPacket) MarshalBinary() ([]byte, error) {
+	return p.AppendBinary(make([]byte, 0, p.Len()))
+}
+
+// AppendBinary appends the encoding of p to b.
+func (p *DataPacket) AppendBinary(b []byte) ([]byte, error) {
+	if len(p.Payload) > MAX_PAYLOAD_LEN {
+		return nil, fmt.Errorf("%w: %d byte payload", ErrMalformed, len(p.Payload))
+	}
+	var flags byte
+	if p.Last {
+		flags |= PACKET_LAST
+	}
+	if p.Parity {
+		flags |= PACKET_PARITY
+	}
+	if p.HasOffset {
+		flags |= PACKET_OFFSET
+	}
+	b = binary.BigEndian.AppendUint32(b, p.Seq)
+	b = append(b, flags)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(p.Payload)))
+	b = append(b, p.Index)
+	if p.HasOffset {
+		b = binary.BigEndian.AppendUint64(b, p.Offset)
+	}
+	return append(b, p.Payload...), nil
+}
+
+// UnmarshalBinary decodes a packet from b. Payload aliases b. Bytes past
+// the declared payload size are ignored.
+func (p *DataPacket) UnmarshalBinary(b []byte) error {
+	if len(b) < DATA_HEADER_LEN {
+		return fmt.Errorf("%w: %d byte data packet", ErrTruncated, len(b))
+	}
+	flags := b[4]
+	switch flags &^ PACKET_OFFSET {
+	case 0, PACKET_LAST, PACKET_PARITY:
+	default:
+		return fmt.Errorf("%w: packet flags %#x", ErrMalformed, flags)
+	}
+	header := DATA_HEADER_LEN
+	if flags&PACKET_OFFSET != 0 {
+		header += DATA_OFFSET_LEN
+	}
+	size := int(binary.BigEndian.Uint16(b[5:]))
+	if header+size > len(b) {
+		return fmt.Errorf("%w: packet needs %d bytes, got %d", ErrTruncated, header+size, len(b))
+	}
+
+	p.Seq = binary.BigEndian.Uint32(b)
+	p.Last = flags&PACKET_LAST != 0
+	p.Parity = flags&PACKET_PARITY != 0
+	p.Index = b[7]
+	p.HasOffset = flags&PACKET_OFFSET != 0
+	p.Offset = 0
+	if p.HasOffset {
+		p.Offset = binary.BigEndian.Uint64(b[DATA_HEADER_LEN:])
+	}
+	p.Payload = b[header : header+size]
+	return nil
+}
+
+// Ack acknowledges the UDP data packet with sequence number Seq, or with
+// Cumulative set every packet up to and including Seq. Either kind for a
+// packet the receiver rebuilt from FEC parity is Repaired. Flags are sent
+// in an extra byte only when set, so a peer that requested neither
+// FLAG_FEC nor FLAG_CUMULATIVE_ACK only ever sees plain 4-byte ACKs.
+type Ack struct {
+	Seq        uint32
+	Repaired   bool
+	Cumulative bool
+}
+
+// MarshalBinary encodes a.
+func (a *Ack) MarshalBinary() ([]byte, error) {
+	b := binary.BigEndian.AppendUint32(make([]byte, 0, ACK_LEN+1), a.Seq)
+	var flags byte
+	if a.Repaired {
+		flags |= ACK_REPAIRED
+	}
+	if a.Cumulative {
+		flags |= ACK_CUMULATIVE
+	}
+	if flags != 0 {
+		b = append(b, flags)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes an ack that must fill b exactly.
+func (a *Ack) UnmarshalBinary(b []byte) error {
+	if len(b) < ACK_LEN {
+		return fmt.Errorf("%w: %d byte ack", ErrTruncated, len(b))
+	}
+	if len(b) > ACK_LEN+1 {
+		return fmt.Errorf("%w: %d byte ack", ErrMalformed, len(b))
+	}
+	var flags byte
+	if len(b) > ACK_LEN {
+		flags = b[ACK_LEN]
+		if flags == 0 || flags&^(ACK_REPAIRED|ACK_CUMULATIVE) != 0 {
+			return fmt.Errorf("%w: ack flags %#x", ErrMalformed, flags)
+		}
+	}
+	a.Seq = binary.BigEndian.Uint32(b)
+	a.Repaired = flags&ACK_REPAIRED != 0
+	a.Cumulative = flags&ACK_CUMULATIVE != 0
+	return nil
+}
+
+// HeaderAck answers a UDP file header from a client that speaks version 3
+// or later with what the server decided for the transfer: the version and
+// features negotiated, whether to send the data, the ID the server knows
+// the transfer by, the payload size of the data packets and the offset to
+// send the file from.
+type HeaderAck struct {
+	Version    byte
+	Status     byte
+	Session    uint32
+	PacketSize uint16
+	Features   uint32
+	Offset     uint64
+}
+
+// MarshalBinary encodes a.
+func (a *HeaderAck) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, HEADER_ACK_LEN)
+	b = append(b, MAGIC...)
+	b = append(b, a.Version, a.Status)
+	b = binary.BigEndian.AppendUint32(b, a.Session)
+	b = binary.BigEndian.AppendUint16(b, a.PacketSize)
+	b = binary.BigEndian.AppendUint32(b, a.Features)
+	return binary.BigEndian.AppendUint64(b, a.Offset), nil
+}
+
+// UnmarshalBinary decodes a header ACK that must fill b exactly. A status
+// it doesn't know is malformed.
+func (a *HeaderAck) UnmarshalBinary(b []byte) error {
+	if !HasMagic(b) {
+		return fmt.Errorf("%w: missing magic", ErrMalformed)
+	}
+	if len(b) < HEADER_ACK_LEN {
+		return fmt.Errorf("%w: %d byte header ack", ErrTruncated, len(b))
+	}
+	if len(b) > HEADER_ACK_LEN {
+		return fmt.Errorf("%w: %d byte header ack", ErrMalformed, len(b))
+	}
+	b = b[len(MAGIC):]
+	if status := b[1]; status != HEADER_STATUS_OK && status != HEADER_STATUS_SKIP {
+		return fmt.Errorf("%w: header ack status %d", ErrMalformed, status)
+	}
+	a.Version, a.Status = b[0], b[1]
+	a.Session = binary.BigEndian.Uint32(b[2:])
+	a.PacketSize = binary.BigEndian.Uint16(b[6:])
+	a.Features = binary.BigEndian.Uint32(b[8:])
+	a.Offset = binary.BigEndian.Uint64(b[12:])
+	return nil
+}
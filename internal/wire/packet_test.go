@@ -0,0 +1,289 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func FuzzDataPacket(f *testing.F) {
+	for _, p := range []DataPacket{
+		{Seq: 1, Payload: []byte("hello")},
+		{Seq: 7, Last: true, HasOffset: true, Offset: 1 << 33, Payload: []byte("end")},
+		{Seq: 3, Parity: true, Index: 2, Payload: make([]byte, 1400)},
+	} {
+		b, _ := p.MarshalBinary()
+		f.Add(b)
+	}
+	// A payload size past the end of the packet
+	f.Add([]byte{0, 0, 0, 1, 0, 0xff, 0xff, 0, 'x'})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var p DataPacket
+		if err := p.UnmarshalBinary(b); err != nil {
+			return
+		}
+		if p.Len() > len(b) {
+			t.Fatalf("decoded a %d byte packet from %d bytes", p.Len(), len(b))
+		}
+		if p.Last && p.Parity {
+			t.Fatal("decoded a last parity packet")
+		}
+		again, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary of a decoded packet: %v", err)
+		}
+		if !bytes.Equal(again, b[:p.Len()]) {
+			t.Fatalf("re-encoded %x, decoded %x", again, b[:p.Len()])
+		}
+	})
+}
+
+func FuzzAck(f *testing.F) {
+	for _, a := range []Ack{{Seq: 9}, {Seq: 1 << 31, Repaired: true}, {Seq: 4, Cumulative: true, Repaired: true}} {
+		b, _ := a.MarshalBinary()
+		f.Add(b)
+	}
+	f.Add([]byte{0, 0, 0, 1, 0})
+	f.Add([]byte{0, 0, 1})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var a Ack
+		if err := a.UnmarshalBinary(b); err != nil {
+			return
+		}
+		again, _ := a.MarshalBinary()
+		if !bytes.Equal(again, b) {
+			t.Fatalf("re-encoded %x, decoded %x", again, b)
+		}
+	})
+}
+
+func FuzzHeaderAck(f *testing.F) {
+	b, _ := (&HeaderAck{Version: 3, Status: HEADER_STATUS_OK, Session: 5, PacketSize: 1400, Features: 0xff, Offset: 1 << 20}).MarshalBinary()
+	f.Add(b)
+	f.Add(b[:len(b)-1])
+	f.Add([]byte(MAGIC))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var a HeaderAck
+		if err := a.UnmarshalBinary(b); err != nil {
+			return
+		}
+		if a.Status != HEADER_STATUS_OK && a.Status != HEADER_STATUS_SKIP {
+			t.Fatalf("decoded status %d", a.Status)
+		}
+		again, _ := a.MarshalBinary()
+		if !bytes.Equal(again, b) {
+			t.Fatalf("re-encoded %x, decoded %x", again, b)
+		}
+	})
+}
+
+// Largest frame each stream reader may consume, whatever it is fed
+var frameReaders = []struct {
+	name string
+	max  int
+	read func(r io.Reader) error
+}{
+	{"hello", HELLO_LEN, func(r io.Reader) error { _, err := ReadHello(r); return err }},
+	{"error", 3 + MAX_ERROR_MSG_LEN, func(r io.Reader) error { _, err := ReadRemoteError(r); return err }},
+	{"auth", 1 + 255, func(r io.Reader) error { _, err := ReadAuth(r); return err }},
+	{"metadata", METADATA_LEN_LEN + MAX_METADATA_LEN, func(r io.Reader) error { _, err := ReadMetadata(r, MAX_NAME_BYTES); return err }},
+	{"request", REQUEST_LEN + MAX_NAME_BYTES, func(r io.Reader) error { _, err := ReadRequest(r); return err }},
+	{"file info", 2 + MAX_NAME_BYTES + 16, func(r io.Reader) error { _, err := ReadFileInfo(r); return err }},
+	{"receipt", RECEIPT_LEN + 1<<16 - 1 + 1 + 255, func(r io.Reader) error { _, err := ReadReceipt(r, FEATURE_TOKEN); return err }},
+}
+
+// FuzzReadFrame feeds the TCP frame readers, all from the same input, and
+// checks none reads past its largest frame.
+func FuzzReadFrame(f *testing.F) {
+	hello, _ := (&Hello{Version: PROTOCOL_VERSION, Features: 0xff}).MarshalBinary()
+	f.Add(hello)
+	rerr, _ := (&RemoteError{Code: CODE_PROTOCOL, Message: "bad\x1b[2J"}).MarshalBinary()
+	f.Add(rerr)
+	meta, _ := (&FileHeader{Name: "m.txt", Size: 3}).MarshalMetadata()
+	f.Add(meta)
+	req, _ := (&Request{Op: 1, Name: "r.txt"}).MarshalBinary()
+	f.Add(req)
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, fr := range frameReaders {
+			r := &countingReader{r: bytes.NewReader(b)}
+			fr.read(r)
+			if r.n > fr.max {
+				t.Fatalf("%s: read %d bytes, the frame is at most %d", fr.name, r.n, fr.max)
+			}
+		}
+	})
+}
+
+// A frame declaring its largest length, then ending, costs a reader little
+// more than a short frame.
+func TestReadFrameAllocation(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation sizes differ under the race detector")
+	}
+	for _, fr := range frameReaders {
+		t.Run(fr.name, func(t *testing.T) {
+			b := bytes.Repeat([]byte{0xff}, 16)
+			binary.BigEndian.PutUint32(b, MAX_METADATA_LEN)
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for i := 0; i < 100; i++ {
+				fr.read(bytes.NewReader(b))
+			}
+			runtime.ReadMemStats(&after)
+			if grew := after.TotalAlloc - before.TotalAlloc; grew > 100*2*SMALL_FRAME_LEN {
+				t.Errorf("100 truncated frames allocated %d bytes", grew)
+			}
+		})
+	}
+}
+
+func TestReadDeclaredShort(t *testing.T) {
+	for _, n := range []int{10, SMALL_FRAME_LEN + 10} {
+		_, err := readDeclared(bytes.NewReader(make([]byte, n-1)), n)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%d bytes declared, one missing: got %v, want io.ErrUnexpectedEOF", n, err)
+		}
+		b, err := readDeclared(bytes.NewReader(make([]byte, n+1)), n)
+		if err != nil || len(b) != n {
+			t.Errorf("%d bytes declared: read %d (%v)", n, len(b), err)
+		}
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"report.pdf", true},
+		{".hidden", true},
+		{"名前.txt", true},
+		{"a b", true},
+		{strings.Repeat("x", MAX_NAME_BYTES), true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"a/b", false},
+		{"../etc/passwd", false},
+		{`a\b`, false},
+		{"/abs", false},
+		{"tab\there", false},
+		{"new\nline", false},
+		{"nul\x00", false},
+		{"esc\x1b[2J", false},
+		{"\x85next", false},
+		{"bad\xff", false},
+		{strings.Repeat("x", MAX_NAME_BYTES+1), false},
+	}
+	for _, tt := range tests {
+		err := CheckName(tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckName(%q) = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidName) {
+			t.Errorf("CheckName(%q) = %v, want ErrInvalidName", tt.name, err)
+		}
+	}
+}
+
+func FuzzCheckName(f *testing.F) {
+	for _, s := range []string{"a.txt", "..", "a/b", `a\b`, "x\x00", "\xff"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		if CheckName(name) != nil {
+			return
+		}
+		if !utf8.ValidString(name) || len(name) > MAX_NAME_BYTES {
+			t.Fatalf("accepted %q", name)
+		}
+		// An accepted name stays a single element right under the directory
+		dir := filepath.Join("uploads", "sub")
+		if got := filepath.Join(dir, name); filepath.Dir(got) != dir || filepath.Base(got) != name {
+			t.Fatalf("%q joins to %q, outside %q", name, got, dir)
+		}
+	})
+}
+
+func TestHeaderAckRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		a    HeaderAck
+	}{
+		{"zero", HeaderAck{}},
+		{"ok", HeaderAck{Version: 3, Status: HEADER_STATUS_OK, Session: 7, PacketSize: 1024, Features: FEATURE_FEC | FEATURE_PACKET_SIZE}},
+		{"skip", HeaderAck{Version: 3, Status: HEADER_STATUS_SKIP, Session: 1}},
+		{"resume", HeaderAck{Version: 3, Session: 1<<32 - 1, PacketSize: 1<<16 - 1, Features: 1<<32 - 1, Offset: 1<<64 - 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.a.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != HEADER_ACK_LEN {
+				t.Errorf("encoded %d bytes, want %d", len(b), HEADER_ACK_LEN)
+			}
+			var got HeaderAck
+			if err := got.UnmarshalBinary(b); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if got != tt.a {
+				t.Errorf("got %+v, want %+v", got, tt.a)
+			}
+		})
+	}
+}
+
+// The layout PROTOCOL.md documents, field by field.
+func TestHeaderAckEncoding(t *testing.T) {
+	a := HeaderAck{Version: 3, Status: HEADER_STATUS_SKIP, Session: 0x01020304, PacketSize: 0x0506, Features: 0x0708090a, Offset: 0x0b0c0d0e0f101112}
+	b, _ := a.MarshalBinary()
+	want := append([]byte(MAGIC),
+		3, 1,
+		0x01, 0x02, 0x03, 0x04,
+		0x05, 0x06,
+		0x07, 0x08, 0x09, 0x0a,
+		0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11, 0x12)
+	if !bytes.Equal(b, want) {
+		t.Errorf("encoded %x, want %x", b, want)
+	}
+}
+
+func TestHeaderAckUnmarshalErrors(t *testing.T) {
+	valid, _ := (&HeaderAck{Version: 3, PacketSize: 1024}).MarshalBinary()
+	badStatus := append([]byte(nil), valid...)
+	badStatus[len(MAGIC)+1] = 2
+	tests := []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"empty", nil, ErrMalformed},
+		{"old format", []byte("HEADER_ACK"), ErrMalformed},
+		{"magic alone", []byte(MAGIC), ErrTruncated},
+		{"one byte short", valid[:len(valid)-1], ErrTruncated},
+		{"trailing byte", append(append([]byte(nil), valid...), 0), ErrMalformed},
+		{"unknown status", badStatus, ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a HeaderAck
+			err := a.UnmarshalBinary(tt.b)
+			if !errors.Is(err, tt.want) || !errors.Is(err, ErrProtocol) {
+				t.Errorf("got %v, want %v wrapping ErrProtocol", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package wire
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// Segments of a TCP upload body once FEATURE_PAUSE is negotiated
+	SEGMENT_DATA   = 0x01 // Followed by a 64-bit length and that many bytes of the body
+	SEGMENT_PAUSE  = 0x02 // The client stops sending until SEGMENT_RESUME
+	SEGMENT_RESUME = 0x03
+	SEGMENT_ABORT  = 0x04 // Followed by an error frame, see NewAbort; the client sends nothing more
+
+	// Type and length of a data segment
+	SEGMENT_HEADER_LEN = 1 + 8
+
+	// How long servers let a client stay paused by default
+	DefaultMaxPause = 10 * time.Minute
+)
+
+// Pause holds back the transfers it is passed to while paused, which tell
+// the server so it doesn't take the silence for a dead client. The zero
+// value is running; a nil Pause never pauses. It is safe for concurrent
+// use.
+type Pause struct {
+	mu      sync.Mutex
+	resumed chan struct{} // Open while paused
+}
+
+// Pause pauses the transfers from their next write on.
+func (p *Pause) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+	}
+}
+
+// Resume lets paused transfers go on where they stopped.
+func (p *Pause) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+	}
+}
+
+// Toggle pauses p if it is running and resumes it otherwise, reporting
+// whether it is now paused.
+func (p *Pause) Toggle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+		return false
+	}
+	p.resumed = make(chan struct{})
+	return true
+}
+
+// Paused reports whether p is paused.
+func (p *Pause) Paused() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed != nil
+}
+
+// Wait blocks while p is paused, returning ctx's error if ctx ends first.
+func (p *Pause) Wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
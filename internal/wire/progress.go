@@ -0,0 +1,298 @@
+package wire
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"socket-file-transfer/internal/i18n"
+)
+
+// EventKind identifies what happened in a transfer.
+type EventKind int
+
+const (
+	EventStarted    EventKind = iota // Header exchanged, data about to flow
+	EventProgress                    // More bytes transferred
+	EventRetransmit                  // A packet had to be resent (UDP)
+	EventCompleted                   // Transfer finished successfully
+	EventFailed                      // Transfer aborted, see Err
+	EventPaused                      // The client paused the transfer
+	EventResumed                     // The client resumed it
+	EventBusy                        // The server is still storing the file, see Status
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventStarted:
+		return "started"
+	case EventProgress:
+		return "progress"
+	case EventRetransmit:
+		return "retransmit"
+	case EventCompleted:
+		return "completed"
+	case EventFailed:
+		return "failed"
+	case EventPaused:
+		return "paused"
+	case EventResumed:
+		return "resumed"
+	case EventBusy:
+		return "busy"
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// Event describes a step of a single transfer.
+type Event struct {
+	Kind   EventKind
+	ID     uint64 // Tells apart the transfers of the process, 0 before Started
+	Time   time.Time
+	Name   string // File name as sent on the wire
+	Remote string // Address of the peer
+	Bytes  int64  // Bytes transferred so far
+	Total  int64  // File size
+	Seq    uint32 // Packet resent (EventRetransmit)
+	Err    error  // Why the transfer failed (EventFailed)
+	Stats  *Stats // Packet counters of a UDP transfer (EventCompleted)
+	Status string // What the server is doing, e.g. "hashing 43%" (EventBusy)
+
+	// Ends the transfer with the error given, as when its client aborts
+	// it (EventStarted); nil if it can't be ended early
+	Cancel func(error)
+}
+
+// ProgressFunc receives the events of a transfer.
+type ProgressFunc func(Event)
+
+// PrintProgress redraws the console progress line of a transfer, ending
+// the line once the transfer is complete. An empty file is complete from
+// the start.
+func PrintProgress(done, total int64) {
+	fmt.Print("\r" + i18n.T("progress", percent(done, total), done, total))
+	if done >= total {
+		fmt.Println()
+	}
+}
+
+func percent(done, total int64) float64 {
+	if total <= 0 {
+		return 100
+	}
+	return float64(done) / float64(total) * 100
+}
+
+// ConsoleProgress is the ProgressFunc used when none is configured: it
+// draws the console progress line.
+func ConsoleProgress(ev Event) {
+	switch ev.Kind {
+	case EventProgress:
+		PrintProgress(ev.Bytes, ev.Total)
+	case EventFailed:
+		if ev.Bytes < ev.Total {
+			fmt.Println() // Terminate the unfinished progress line
+		}
+	case EventPaused:
+		fmt.Println("\n" + i18n.T("progress.paused", percent(ev.Bytes, ev.Total)))
+	case EventResumed:
+		fmt.Println(i18n.T("progress.resumed"))
+	case EventBusy:
+		fmt.Println(i18n.T("progress.server", ev.Status))
+	}
+}
+
+// PrintSummary prints the duration and average speed of a finished
+// transfer, leaving out the speed of one too quick to time.
+func PrintSummary(bytes int64, duration time.Duration) {
+	fmt.Println(i18n.T("progress.completed", FormatDuration(duration)))
+	if rate := FormatRate(bytes, duration); rate != "" {
+		fmt.Println(i18n.T("progress.speed", rate))
+	}
+}
+
+// Reporter delivers the events of one transfer to a ProgressFunc from a
+// single goroutine, in order, without ever blocking the transfer: while the
+// consumer is busy, byte-progress events are coalesced so only the latest
+// is delivered. Other events are always delivered.
+//
+// The console default is instead called synchronously, so progress lines
+// stay ordered with log output as they always have.
+type Reporter struct {
+	fn     ProgressFunc
+	remote string
+	direct bool // Call fn from the transfer's goroutine
+
+	mu      sync.Mutex
+	cancel  func(error)
+	id      uint64
+	name    string
+	total   int64
+	bytes   int64
+	queue   []Event
+	pending bool // A progress event for bytes is waiting to be queued
+	closed  bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// NewReporter starts a Reporter for a transfer with remote. A nil fn
+// reports to the console.
+func NewReporter(fn ProgressFunc, remote string) *Reporter {
+	r := &Reporter{
+		fn:     fn,
+		remote: remote,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if fn == nil {
+		r.fn, r.direct = ConsoleProgress, true
+		close(r.done)
+		return r
+	}
+	go r.run()
+	return r
+}
+
+// Last ID given to a transfer
+var lastID atomic.Uint64
+
+// SetCancel has the started events carry cancel, which ends the transfer
+// with the error it is given, e.g. ErrKilled.
+func (r *Reporter) SetCancel(cancel func(error)) {
+	r.mu.Lock()
+	r.cancel = cancel
+	r.mu.Unlock()
+}
+
+// Start reports that the transfer of name, total bytes long, has begun,
+// giving it a new ID.
+func (r *Reporter) Start(name string, total int64) {
+	r.mu.Lock()
+	r.id, r.name, r.total = lastID.Add(1), name, total
+	cancel := r.cancel
+	r.mu.Unlock()
+	r.emit(Event{Kind: EventStarted, Cancel: cancel})
+}
+
+// Progress reports that done bytes have been transferred.
+func (r *Reporter) Progress(done int64) {
+	r.mu.Lock()
+	r.bytes = done
+	if r.direct {
+		ev := r.fill(Event{Kind: EventProgress})
+		r.mu.Unlock()
+		r.fn(ev)
+		return
+	}
+	r.pending = true
+	r.mu.Unlock()
+	r.signal()
+}
+
+// Retransmit reports that packet seq was sent again.
+func (r *Reporter) Retransmit(seq uint32) {
+	r.emit(Event{Kind: EventRetransmit, Seq: seq})
+}
+
+// Complete reports success after bytes were transferred.
+func (r *Reporter) Complete(bytes int64) {
+	r.CompleteStats(bytes, nil)
+}
+
+// CompleteStats reports success after bytes were transferred, with the
+// transfer's packet counters.
+func (r *Reporter) CompleteStats(bytes int64, stats *Stats) {
+	r.mu.Lock()
+	r.bytes = bytes
+	r.mu.Unlock()
+	r.emit(Event{Kind: EventCompleted, Stats: stats})
+}
+
+// Paused reports that the client paused the transfer.
+func (r *Reporter) Paused() {
+	r.emit(Event{Kind: EventPaused})
+}
+
+// Resumed reports that the client resumed the transfer.
+func (r *Reporter) Resumed() {
+	r.emit(Event{Kind: EventResumed})
+}
+
+// Busy reports what the server is doing while it stores the file.
+func (r *Reporter) Busy(status string) {
+	r.emit(Event{Kind: EventBusy, Status: status})
+}
+
+// Fail reports that the transfer was aborted by err.
+func (r *Reporter) Fail(err error) {
+	r.emit(Event{Kind: EventFailed, Err: err})
+}
+
+// Close delivers any outstanding events and stops the Reporter.
+func (r *Reporter) Close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.signal()
+	<-r.done
+}
+
+func (r *Reporter) emit(ev Event) {
+	r.mu.Lock()
+	if r.direct {
+		ev = r.fill(ev)
+		r.mu.Unlock()
+		r.fn(ev)
+		return
+	}
+	r.flushProgress()
+	r.queue = append(r.queue, r.fill(ev))
+	r.mu.Unlock()
+	r.signal()
+}
+
+// flushProgress queues the coalesced progress event, keeping it ordered
+// before the event about to be queued. Must hold r.mu.
+func (r *Reporter) flushProgress() {
+	if r.pending {
+		r.queue = append(r.queue, r.fill(Event{Kind: EventProgress}))
+		r.pending = false
+	}
+}
+
+// fill completes ev with the transfer's state. Must hold r.mu.
+func (r *Reporter) fill(ev Event) Event {
+	ev.Time = time.Now()
+	ev.ID, ev.Name, ev.Remote = r.id, r.name, r.remote
+	ev.Bytes, ev.Total = r.bytes, r.total
+	return ev
+}
+
+func (r *Reporter) signal() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Reporter) run() {
+	defer close(r.done)
+	for range r.wake {
+		r.mu.Lock()
+		r.flushProgress()
+		events := r.queue
+		r.queue = nil
+		closed := r.closed
+		r.mu.Unlock()
+
+		for _, ev := range events {
+			r.fn(ev)
+		}
+		if closed {
+			return
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package wire
+
+// The race detector allocates on its own behalf, so allocation sizes mean
+// nothing under it
+const raceEnabled = true
@@ -0,0 +1,121 @@
+package wire
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrSourceStalled is returned by a transfer whose deadline passed, or
+// that was cancelled, while a read of the file being sent was stuck, as
+// on a network mount that hung, rather than while the network was.
+var ErrSourceStalled = errors.New("source read stalled")
+
+// Chunks a read-ahead holds ready for the transfer
+const READ_AHEAD_CHUNKS = 4
+
+// ReadAhead returns a reader of r that reads it in chunks of size bytes
+// from a goroutine of its own, so a read that never returns can't keep
+// the transfer from seeing ctx end: reading then fails with
+// ErrSourceStalled, wrapping ctx's cause. Without a deadline in ctx, r is
+// returned as is, so a file can still go straight from the page cache
+// (sendfile on Linux). The caller calls stop once done reading, which
+// waits for the pending read of r to return unless ctx ended, so r can
+// be read or seeked again.
+func ReadAhead(ctx context.Context, r io.Reader, size int) (reader io.Reader, stop func()) {
+	if _, ok := ctx.Deadline(); !ok {
+		return r, func() {}
+	}
+	ra := &readAhead{
+		ctx:    ctx,
+		chunks: make(chan chunk, READ_AHEAD_CHUNKS),
+		free:   make(chan []byte, READ_AHEAD_CHUNKS+1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for i := 0; i <= READ_AHEAD_CHUNKS; i++ {
+		ra.free <- make([]byte, size)
+	}
+	go ra.fill(r)
+	var once sync.Once
+	return ra, func() {
+		once.Do(func() {
+			close(ra.quit)
+			select {
+			case <-ra.done:
+			case <-ctx.Done():
+			}
+		})
+	}
+}
+
+// chunk is what one read of the source returned.
+type chunk struct {
+	data []byte
+	err  error
+}
+
+type readAhead struct {
+	ctx    context.Context
+	chunks chan chunk  // Read, in order
+	free   chan []byte // Buffers to read into
+	quit   chan struct{}
+	done   chan struct{}
+
+	cur []byte // Rest of the chunk being handed out
+	buf []byte // Buffer of cur, returned to free once handed out
+	err error
+}
+
+// fill reads r into free buffers until it fails or the reader is stopped.
+func (ra *readAhead) fill(r io.Reader) {
+	defer close(ra.done)
+	for {
+		var buf []byte
+		select {
+		case buf = <-ra.free:
+		case <-ra.quit:
+			return
+		}
+		n, err := r.Read(buf)
+		select {
+		case ra.chunks <- chunk{buf[:n], err}:
+		case <-ra.quit:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (ra *readAhead) Read(p []byte) (int, error) {
+	for len(ra.cur) == 0 {
+		if ra.buf != nil {
+			ra.free <- ra.buf[:cap(ra.buf)]
+			ra.buf = nil
+		}
+		if ra.err != nil {
+			return 0, ra.err
+		}
+		select {
+		case c := <-ra.chunks:
+			ra.cur, ra.buf, ra.err = c.data, c.data, c.err
+		case <-ra.ctx.Done():
+			// Prefer what was read by the time ctx ended
+			select {
+			case c := <-ra.chunks:
+				ra.cur, ra.buf, ra.err = c.data, c.data, c.err
+				continue
+			default:
+			}
+			ra.err = fmt.Errorf("%w: %w", ErrSourceStalled, context.Cause(ra.ctx))
+			return 0, ra.err
+		}
+	}
+	n := copy(p, ra.cur)
+	ra.cur = ra.cur[n:]
+	return n, nil
+}
@@ -0,0 +1,179 @@
+package wire
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// stuckReader reads from data until it runs out, then blocks, as a read
+// of a hung network mount does, until released.
+type stuckReader struct {
+	data     []byte
+	stuck    chan struct{} // Closed when a read blocks
+	released chan struct{}
+}
+
+func newStuckReader(data []byte) *stuckReader {
+	return &stuckReader{data: data, stuck: make(chan struct{}), released: make(chan struct{})}
+}
+
+func (r *stuckReader) Read(p []byte) (int, error) {
+	if len(r.data) > 0 {
+		n := copy(p, r.data)
+		r.data = r.data[n:]
+		return n, nil
+	}
+	select {
+	case <-r.stuck:
+	default:
+		close(r.stuck)
+	}
+	<-r.released
+	return 0, io.EOF
+}
+
+// Without a deadline there is nothing to watch, and the source is read
+// directly.
+func TestReadAheadNoDeadline(t *testing.T) {
+	src := bytes.NewReader([]byte("direct"))
+	r, stop := ReadAhead(context.Background(), src, 16)
+	defer stop()
+	if r != io.Reader(src) {
+		t.Errorf("got %T, want the source itself", r)
+	}
+}
+
+// What is read ahead comes out as the source gave it, however it is read.
+func TestReadAheadContent(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	tests := []struct {
+		name string
+		src  func() io.Reader
+		read func(r io.Reader) io.Reader
+	}{
+		{"whole chunks", func() io.Reader { return bytes.NewReader(data) }, func(r io.Reader) io.Reader { return r }},
+		{"source a byte at a time", func() io.Reader { return iotest.OneByteReader(bytes.NewReader(data)) }, func(r io.Reader) io.Reader { return r }},
+		{"read a byte at a time", func() io.Reader { return bytes.NewReader(data) }, iotest.OneByteReader},
+		{"half reads", func() io.Reader { return iotest.HalfReader(bytes.NewReader(data)) }, iotest.HalfReader},
+		{"data with EOF", func() io.Reader { return iotest.DataErrReader(bytes.NewReader(data)) }, func(r io.Reader) io.Reader { return r }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			r, stop := ReadAhead(ctx, tt.src(), 4096)
+			defer stop()
+			got, err := io.ReadAll(tt.read(r))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("read %d bytes, not the %d written", len(got), len(data))
+			}
+		})
+	}
+}
+
+// An error of the source is returned once what came before it was read.
+func TestReadAheadSourceError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	broken := errors.New("I/O error")
+	r, stop := ReadAhead(ctx, io.MultiReader(bytes.NewReader([]byte("before")), iotest.ErrReader(broken)), 16)
+	defer stop()
+	got, err := io.ReadAll(r)
+	if string(got) != "before" || !errors.Is(err, broken) {
+		t.Errorf("got %q, %v, want what came before and the source's error", got, err)
+	}
+	if errors.Is(err, ErrSourceStalled) {
+		t.Error("source error reported as a stall")
+	}
+}
+
+// A read that never returns fails the reader once the deadline passes,
+// as a stall, with what was read before it still handed out.
+func TestReadAheadStalled(t *testing.T) {
+	src := newStuckReader([]byte("some data"))
+	defer close(src.released)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r, stop := ReadAhead(ctx, src, 16)
+
+	start := time.Now()
+	got, err := io.ReadAll(r)
+	if string(got) != "some data" {
+		t.Errorf("read %q before the stall, want all the source gave", got)
+	}
+	if !errors.Is(err, ErrSourceStalled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want ErrSourceStalled wrapping the deadline", err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("gave up after %v, want soon after the 100ms deadline", took)
+	}
+
+	// Stopping doesn't wait for the stuck read either
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop waits for the stuck read")
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, ErrSourceStalled) {
+		t.Errorf("read after the stall: got %v", err)
+	}
+}
+
+// Cancelling reports the cause, still as a stall.
+func TestReadAheadCancelled(t *testing.T) {
+	src := newStuckReader(nil)
+	defer close(src.released)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	r, stop := ReadAhead(ctx, src, 16)
+	defer stop()
+	go func() {
+		<-src.stuck
+		cancel()
+	}()
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, ErrSourceStalled) || !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want ErrSourceStalled wrapping the cancel", err)
+	}
+}
+
+// Stopping a reader still in time waits for the pending read of the
+// source, so the caller can use it again.
+func TestReadAheadStopWaits(t *testing.T) {
+	src := newStuckReader([]byte("x"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, stop := ReadAhead(ctx, src, 1)
+	<-src.stuck
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stop returned while the source was still being read")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(src.released)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop still waiting once the read returned")
+	}
+}
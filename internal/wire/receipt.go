@@ -0,0 +1,69 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Fixed part of a receipt: 64-bit byte count and 16-bit path length
+const RECEIPT_LEN = 8 + 2
+
+// Receipt follows a TCP server's confirmation that it stored a file, once
+// FEATURE_RECEIPT is negotiated, saying how many bytes it stored and
+// where. On the wire it is the 64-bit byte count, a 16-bit path length and
+// the path, relative to the server's upload directory with slashes between
+// its elements. Once FEATURE_TOKEN is negotiated too, an 8-bit token length
+// and the token follow, empty if the server issued none.
+type Receipt struct {
+	Bytes uint64
+	Path  string
+	Token string // Fetches the file over the server's HTTP, see internal/tokens
+}
+
+// Marshal encodes r for a connection with features.
+func (r *Receipt) Marshal(features uint32) ([]byte, error) {
+	if len(r.Path) > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: path is %d bytes", ErrMalformed, len(r.Path))
+	}
+	if len(r.Token) > math.MaxUint8 {
+		return nil, fmt.Errorf("%w: token is %d bytes", ErrMalformed, len(r.Token))
+	}
+	b := make([]byte, 0, RECEIPT_LEN+len(r.Path)+1+len(r.Token))
+	b = binary.BigEndian.AppendUint64(b, r.Bytes)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.Path)))
+	b = append(b, r.Path...)
+	if features&FEATURE_TOKEN != 0 {
+		b = append(b, byte(len(r.Token)))
+		b = append(b, r.Token...)
+	}
+	return b, nil
+}
+
+// ReadReceipt decodes a receipt from a stream of a connection with
+// features.
+func ReadReceipt(r io.Reader, features uint32) (*Receipt, error) {
+	var fixed [RECEIPT_LEN]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, fmt.Errorf("error reading receipt: %w", err)
+	}
+	path, err := readDeclared(r, int(binary.BigEndian.Uint16(fixed[8:])))
+	if err != nil {
+		return nil, fmt.Errorf("error reading receipt: %w", err)
+	}
+	receipt := &Receipt{Bytes: binary.BigEndian.Uint64(fixed[:]), Path: string(path)}
+	if features&FEATURE_TOKEN == 0 {
+		return receipt, nil
+	}
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, fmt.Errorf("error reading receipt: %w", err)
+	}
+	token := make([]byte, n[0])
+	if _, err := io.ReadFull(r, token); err != nil {
+		return nil, fmt.Errorf("error reading receipt: %w", err)
+	}
+	receipt.Token = string(token)
+	return receipt, nil
+}
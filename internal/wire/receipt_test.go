@@ -0,0 +1,62 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReceiptRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		r        Receipt
+		features uint32
+	}{
+		{"path", Receipt{Bytes: 42, Path: "a/b.txt"}, 0},
+		{"empty file", Receipt{Path: "empty"}, 0},
+		{"largest count", Receipt{Bytes: 1<<64 - 1, Path: "huge"}, 0},
+		{"token", Receipt{Bytes: 1, Path: "t", Token: "abc123"}, FEATURE_TOKEN},
+		{"no token issued", Receipt{Bytes: 1, Path: "t"}, FEATURE_TOKEN},
+		{"unicode path", Receipt{Bytes: 1, Path: "relatório 📄.pdf"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.r.Marshal(tt.features)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadReceipt(bytes.NewReader(b), tt.features)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.r {
+				t.Errorf("got %+v, want %+v", *got, tt.r)
+			}
+		})
+	}
+}
+
+// A token is only sent once both sides negotiated FEATURE_TOKEN.
+func TestReceiptTokenNotNegotiated(t *testing.T) {
+	b, _ := (&Receipt{Bytes: 1, Path: "t", Token: "secret"}).Marshal(0)
+	if bytes.Contains(b, []byte("secret")) {
+		t.Errorf("receipt %q carries the token without FEATURE_TOKEN", b)
+	}
+}
+
+func TestReceiptErrors(t *testing.T) {
+	if _, err := (&Receipt{Path: strings.Repeat("p", 1<<16)}).Marshal(0); !errors.Is(err, ErrMalformed) {
+		t.Errorf("long path: got %v, want ErrMalformed", err)
+	}
+	if _, err := (&Receipt{Token: strings.Repeat("t", 256)}).Marshal(FEATURE_TOKEN); !errors.Is(err, ErrMalformed) {
+		t.Errorf("long token: got %v, want ErrMalformed", err)
+	}
+	full, _ := (&Receipt{Bytes: 7, Path: "cut.txt", Token: "tok"}).Marshal(FEATURE_TOKEN)
+	for n := 0; n < len(full); n++ {
+		if _, err := ReadReceipt(bytes.NewReader(full[:n]), FEATURE_TOKEN); !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			t.Errorf("receipt cut at %d bytes: got %v, want an EOF", n, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Requests of a session, see FLAG_SESSION
+const (
+	REQ_LIST   = 0x01 // List the stored files
+	REQ_STAT   = 0x02 // Describe one stored file
+	REQ_PUT    = 0x03 // Store a file; followed by its 64-bit size and body
+	REQ_GET    = 0x04 // Fetch a stored file
+	REQ_DELETE = 0x05 // Remove a stored file
+	REQ_PING   = 0x06 // Nothing, keeps an idle session's connection alive
+	REQ_STAGE  = 0x07 // Stage a file under a short code; followed by its 64-bit size, then its body and SHA-256 once accepted
+	REQ_CLAIM  = 0x08 // Fetch and acknowledge the file staged under the code the name holds
+
+	// Fixed part of a request: op and 16-bit name length
+	REQUEST_LEN = 1 + 2
+)
+
+// Request is one request of a session. On the wire it is the op byte, a
+// 16-bit name length and the name, which is empty for REQ_LIST and
+// REQ_PING.
+type Request struct {
+	Op   byte
+	Name string
+}
+
+// MarshalBinary encodes r.
+func (r *Request) MarshalBinary() ([]byte, error) {
+	if len(r.Name) > MAX_NAME_BYTES {
+		return nil, fmt.Errorf("%w: filename is %d bytes", ErrMalformed, len(r.Name))
+	}
+	b := make([]byte, 0, REQUEST_LEN+len(r.Name))
+	b = append(b, r.Op)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.Name)))
+	return append(b, r.Name...), nil
+}
+
+// ReadRequest decodes a request from a stream.
+func ReadRequest(r io.Reader) (*Request, error) {
+	var fixed [REQUEST_LEN]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, fmt.Errorf("error reading request: %w", err)
+	}
+	n := int(binary.BigEndian.Uint16(fixed[1:]))
+	if n > MAX_NAME_BYTES {
+		return nil, fmt.Errorf("%w: filename is %d bytes", ErrMalformed, n)
+	}
+	name := make([]byte, n)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, fmt.Errorf("error reading request: %w", err)
+	}
+	return &Request{Op: fixed[0], Name: string(name)}, nil
+}
+
+// FileInfo describes a stored file in replies to REQ_LIST and REQ_STAT. On
+// the wire it is a 16-bit name length, the name, the 64-bit size and the
+// modification time in nanoseconds since the Unix epoch.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ListDir describes the regular files in dir, leaving out hidden files
+// such as checksum sidecars and files being received.
+func ListDir(dir string) ([]FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []FileInfo
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // Removed since ReadDir
+		}
+		infos = append(infos, FileInfo{Name: e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return infos, nil
+}
+
+// AppendBinary appends the encoding of f to b.
+func (f *FileInfo) AppendBinary(b []byte) ([]byte, error) {
+	if len(f.Name) > MAX_NAME_BYTES {
+		return nil, fmt.Errorf("%w: filename is %d bytes", ErrMalformed, len(f.Name))
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(f.Name)))
+	b = append(b, f.Name...)
+	b = binary.BigEndian.AppendUint64(b, uint64(f.Size))
+	return binary.BigEndian.AppendUint64(b, uint64(f.ModTime.UnixNano())), nil
+}
+
+// ReadFileInfo decodes a file description from a stream.
+func ReadFileInfo(r io.Reader) (*FileInfo, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, fmt.Errorf("error reading file info: %w", err)
+	}
+	nameLen := int(binary.BigEndian.Uint16(n[:]))
+	if nameLen > MAX_NAME_BYTES {
+		return nil, fmt.Errorf("%w: filename is %d bytes", ErrMalformed, nameLen)
+	}
+	b := make([]byte, nameLen+8+8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("error reading file info: %w", err)
+	}
+	return &FileInfo{
+		Name:    string(b[:nameLen]),
+		Size:    int64(binary.BigEndian.Uint64(b[nameLen:])),
+		ModTime: time.Unix(0, int64(binary.BigEndian.Uint64(b[nameLen+8:]))),
+	}, nil
+}
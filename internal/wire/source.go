@@ -0,0 +1,67 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// ErrFileChanged is returned by clients whose file shrank or was rewritten
+// while being sent, so what the server stored may mix old and new content.
+var ErrFileChanged = errors.New("file changed while it was sent")
+
+// Source is a file opened for sending, with the size and modification
+// time it had then.
+type Source struct {
+	*os.File
+	Size    int64
+	ModTime time.Time
+}
+
+// OpenSource opens the file at path for sending, failing before anything
+// is sent if it isn't a regular file or can't be read to its end.
+func OpenSource(path string) (*Source, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error accessing file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if info.Size() > 0 {
+		var last [1]byte
+		if _, err := file.ReadAt(last[:], info.Size()-1); err != nil && err != io.EOF {
+			file.Close()
+			return nil, fmt.Errorf("error reading file: %w", err)
+		}
+	}
+	return &Source{File: file, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Check looks at the file again once it was sent. Only its first Size
+// bytes were, so a file that grew is merely logged; one that shrank or
+// was modified otherwise fails with ErrFileChanged.
+func (s *Source) Check(log *slog.Logger) error {
+	info, err := s.Stat()
+	if err != nil {
+		return fmt.Errorf("error accessing file: %w", err)
+	}
+	switch {
+	case info.Size() > s.Size:
+		log.Warn("File grew while it was sent, sent the size it had when opened", "sent", s.Size, "size", info.Size())
+	case info.Size() < s.Size:
+		return fmt.Errorf("%w: it shrank from %d to %d bytes", ErrFileChanged, s.Size, info.Size())
+	case !info.ModTime().Equal(s.ModTime):
+		return fmt.Errorf("%w: it was modified at %s", ErrFileChanged, info.ModTime().Format(time.RFC3339))
+	}
+	return nil
+}
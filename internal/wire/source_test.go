@@ -0,0 +1,80 @@
+package wire
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenSource(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := OpenSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if src.Size != 5 {
+		t.Errorf("size %d, want 5", src.Size)
+	}
+
+	for _, bad := range []string{dir, filepath.Join(dir, "missing")} {
+		if src, err := OpenSource(bad); err == nil {
+			src.Close()
+			t.Errorf("OpenSource(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestSourceCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(path string) error
+		want   error
+	}{
+		{"unchanged", func(string) error { return nil }, nil},
+		{"grew", func(path string) error {
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.WriteString(" and more")
+			return err
+		}, nil},
+		{"shrank", func(path string) error { return os.Truncate(path, 2) }, ErrFileChanged},
+		{"modified", func(path string) error {
+			if err := os.WriteFile(path, []byte("HELLO"), 0644); err != nil {
+				return err
+			}
+			later := time.Now().Add(time.Hour)
+			return os.Chtimes(path, later, later)
+		}, ErrFileChanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "f")
+			if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			src, err := OpenSource(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.Close()
+			if err := tt.change(path); err != nil {
+				t.Fatal(err)
+			}
+			if err := src.Check(slog.New(slog.NewTextHandler(io.Discard, nil))); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
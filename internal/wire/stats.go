@@ -0,0 +1,30 @@
+package wire
+
+import "time"
+
+// Stats counts the packets of a UDP transfer, for comparing it with other
+// protocols. What only one side can see is zero on the other.
+type Stats struct {
+	PacketsSent     int   `json:"packets_sent"`     // Data and parity packets sent, retransmissions included (client)
+	PacketsReceived int   `json:"packets_received"` // Valid data and parity packets received (server)
+	WireBytes       int64 `json:"wire_bytes"`       // Bytes of the packets sent, headers and retransmissions included (client)
+	Retransmits     int   `json:"retransmits"`      // Data packets sent again (client)
+	Timeouts        int   `json:"timeouts"`         // Waits for an ACK (client) or the next packet (server) that ran out
+	DuplicateAcks   int   `json:"duplicate_acks"`   // ACKs for packets already acknowledged (client)
+	Duplicates      int   `json:"duplicates"`       // Data packets received again (server)
+	Repaired        int   `json:"repaired"`         // Lost data packets the server rebuilt from FEC parity
+	Strays          int   `json:"strays"`           // Packets ignored as not from the peer or unparseable
+
+	// Round-trip times of the ACKs of packets sent once (client)
+	RTTMin time.Duration `json:"rtt_min_ns"`
+	RTTAvg time.Duration `json:"rtt_avg_ns"`
+	RTTMax time.Duration `json:"rtt_max_ns"`
+}
+
+// RetransmitRate is the share of the packets sent that were retransmissions.
+func (s *Stats) RetransmitRate() float64 {
+	if s.PacketsSent == 0 {
+		return 0
+	}
+	return float64(s.Retransmits) / float64(s.PacketsSent)
+}
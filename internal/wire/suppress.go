@@ -0,0 +1,209 @@
+package wire
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Window over which NewConsoleLogger collapses repeated records and
+	// counts each source's warnings and errors
+	SUPPRESS_WINDOW = 10 * time.Second
+
+	// Warnings and errors a source may cause in a window before the rest
+	// of its records in that window are dropped
+	SUPPRESS_PER_SOURCE = 20
+)
+
+// NewSuppressHandler wraps h so floods of records, such as those a port
+// scan or a stream of malformed packets causes, don't drown the log:
+//
+//   - A record identical to the one before it, message and attributes,
+//     within window of it is dropped; the next record that isn't, or the
+//     end of the window, first logs "Last message repeated" with how many
+//     times.
+//   - Records carry their source in a "remote" attribute, as a host or
+//     host:port. Once records from one host include more than perSource
+//     warnings and errors in a window, the host's other records are dropped
+//     until the window ends, which then logs how many were.
+//
+// Records without a remote attribute are only collapsed.
+func NewSuppressHandler(h slog.Handler, window time.Duration, perSource int) slog.Handler {
+	return &suppressHandler{inner: h, s: &suppressor{out: h, window: window, perSource: perSource, sources: make(map[string]*noisySource)}}
+}
+
+// suppressor is the state the handlers derived from one NewSuppressHandler
+// share.
+type suppressor struct {
+	out       slog.Handler // The wrapped handler without attributes, for summaries
+	window    time.Duration
+	perSource int
+
+	mu        sync.Mutex
+	last      string // Key of the last record logged
+	lastLevel slog.Level
+	lastAt    time.Time
+	repeats   int // Of the last record, dropped since
+
+	sources map[string]*noisySource // By host
+	swept   time.Time
+	timer   *time.Timer // Logs the summaries due once nothing else does
+}
+
+// noisySource counts a host's records in its current window.
+type noisySource struct {
+	start   time.Time
+	errors  int // Warnings and errors
+	dropped int
+}
+
+type suppressHandler struct {
+	inner  slog.Handler
+	s      *suppressor
+	attrs  []byte // Key of the attributes added by WithAttrs
+	prefix string // Group prefix for attribute keys
+	remote string // Host of a remote attribute added by WithAttrs
+}
+
+func (h *suppressHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *suppressHandler) Handle(ctx context.Context, r slog.Record) error {
+	key := bytes.NewBuffer(append([]byte(nil), h.attrs...))
+	host := h.remote
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(key, h.prefix, a)
+		if h.prefix == "" && a.Key == "remote" {
+			host = sourceHost(a.Value)
+		}
+		return true
+	})
+	key.WriteString(" ")
+	key.WriteString(r.Level.String())
+	key.WriteString(" ")
+	key.WriteString(r.Message)
+
+	s := h.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.expire(ctx, now)
+
+	if host != "" {
+		src := s.sources[host]
+		if src == nil {
+			src = &noisySource{start: now}
+			s.sources[host] = src
+		}
+		if src.errors >= s.perSource {
+			src.dropped++
+			s.arm()
+			return nil
+		}
+		if r.Level >= slog.LevelWarn {
+			src.errors++
+		}
+	}
+	if key.String() == s.last {
+		s.repeats++
+		s.arm()
+		return nil
+	}
+
+	s.flushRepeats(ctx, now)
+	s.last, s.lastLevel, s.lastAt = key.String(), r.Level, now
+	return h.inner.Handle(ctx, r)
+}
+
+// sourceHost returns the host of a remote attribute's address.
+func sourceHost(v slog.Value) string {
+	addr := v.Resolve().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// expire logs the summaries of the windows that ended by now. Must hold
+// s.mu.
+func (s *suppressor) expire(ctx context.Context, now time.Time) {
+	if s.last != "" && now.Sub(s.lastAt) >= s.window {
+		s.flushRepeats(ctx, now)
+		// The next one is logged again, so the log shows it's still going on
+		s.last = ""
+	}
+	if now.Sub(s.swept) < time.Second {
+		return
+	}
+	s.swept = now
+	for host, src := range s.sources {
+		if now.Sub(src.start) < s.window {
+			continue
+		}
+		if src.dropped > 0 {
+			r := slog.NewRecord(now, slog.LevelWarn, "Suppressed messages about a noisy source", 0)
+			r.AddAttrs(slog.String("remote", host), slog.Int("suppressed", src.dropped), slog.Duration("window", s.window))
+			s.out.Handle(ctx, r)
+		}
+		delete(s.sources, host)
+	}
+}
+
+// flushRepeats logs how many times the last record was dropped since it
+// was logged, if any. Must hold s.mu.
+func (s *suppressor) flushRepeats(ctx context.Context, now time.Time) {
+	if s.repeats == 0 {
+		return
+	}
+	r := slog.NewRecord(now, s.lastLevel, "Last message repeated", 0)
+	r.AddAttrs(slog.Int("times", s.repeats))
+	s.out.Handle(ctx, r)
+	s.repeats = 0
+}
+
+// arm makes sure the summaries of what was just dropped are logged even if
+// no other record comes along to log them. Must hold s.mu.
+func (s *suppressor) arm() {
+	if s.timer != nil {
+		return
+	}
+	s.timer = time.AfterFunc(s.window, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.timer = nil
+		s.swept = time.Time{}
+		s.expire(context.Background(), time.Now())
+		if s.repeats > 0 || len(s.sources) > 0 {
+			s.arm()
+		}
+	})
+}
+
+func (h *suppressHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.inner = h.inner.WithAttrs(attrs)
+	key := bytes.NewBuffer(append([]byte(nil), h.attrs...))
+	for _, a := range attrs {
+		writeAttr(key, h.prefix, a)
+		if h.prefix == "" && a.Key == "remote" {
+			h2.remote = sourceHost(a.Value)
+		}
+	}
+	h2.attrs = key.Bytes()
+	return &h2
+}
+
+func (h *suppressHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.inner = h.inner.WithGroup(name)
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
@@ -0,0 +1,177 @@
+package wire
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer collects the lines of a text handler, safe to read while the
+// suppressor's timer writes to it.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns the lines logged so far.
+func (b *logBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSuffix(b.buf.String(), "\n"), "\n")
+}
+
+// suppressed returns a logger that suppresses over window and perSource,
+// and the buffer it logs to.
+func suppressed(window time.Duration, perSource int) (*slog.Logger, *logBuffer) {
+	out := &logBuffer{}
+	h := slog.NewTextHandler(out, &slog.HandlerOptions{ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+		if a.Key == slog.TimeKey && len(groups) == 0 {
+			return slog.Attr{}
+		}
+		return a
+	}})
+	return slog.New(NewSuppressHandler(h, window, perSource)), out
+}
+
+// Bursts of identical records collapse into the first and a count, while
+// distinct ones are all logged.
+func TestSuppressRepeats(t *testing.T) {
+	tests := []struct {
+		name string
+		log  func(l *slog.Logger)
+		want []string
+	}{
+		{
+			name: "identical burst",
+			log: func(l *slog.Logger) {
+				for i := 0; i < 100; i++ {
+					l.Warn("Invalid header packet", "remote", "192.0.2.1:4000")
+				}
+				l.Info("Transfer completed")
+			},
+			want: []string{
+				`level=WARN msg="Invalid header packet" remote=192.0.2.1:4000`,
+				`level=WARN msg="Last message repeated" times=99`,
+				`level=INFO msg="Transfer completed"`,
+			},
+		},
+		{
+			name: "distinct messages",
+			log: func(l *slog.Logger) {
+				for i := 0; i < 3; i++ {
+					l.Info("Upload", "file", fmt.Sprint(i))
+				}
+			},
+			want: []string{
+				`level=INFO msg=Upload file=0`,
+				`level=INFO msg=Upload file=1`,
+				`level=INFO msg=Upload file=2`,
+			},
+		},
+		{
+			name: "alternating",
+			log: func(l *slog.Logger) {
+				for i := 0; i < 2; i++ {
+					l.Info("a")
+					l.Info("b")
+				}
+			},
+			want: []string{`level=INFO msg=a`, `level=INFO msg=b`, `level=INFO msg=a`, `level=INFO msg=b`},
+		},
+		{
+			name: "same message at another level",
+			log: func(l *slog.Logger) {
+				l.Info("x")
+				l.Warn("x")
+			},
+			want: []string{`level=INFO msg=x`, `level=WARN msg=x`},
+		},
+		{
+			name: "attributes added by With",
+			log: func(l *slog.Logger) {
+				l.With("id", 1).Info("Started")
+				l.With("id", 1).Info("Started")
+				l.With("id", 2).Info("Started")
+			},
+			want: []string{
+				`level=INFO msg=Started id=1`,
+				`level=INFO msg="Last message repeated" times=1`,
+				`level=INFO msg=Started id=2`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, out := suppressed(time.Hour, 1000)
+			tt.log(l)
+			if got := out.lines(); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("logged\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+// A repeat that goes on past the window is counted, then logged again.
+func TestSuppressWindow(t *testing.T) {
+	l, out := suppressed(50*time.Millisecond, 1000)
+	for i := 0; i < 5; i++ {
+		l.Info("Accept failed")
+	}
+	time.Sleep(100 * time.Millisecond)
+	l.Info("Accept failed")
+	want := []string{
+		`level=INFO msg="Accept failed"`,
+		`level=INFO msg="Last message repeated" times=4`,
+		`level=INFO msg="Accept failed"`,
+	}
+	if got := out.lines(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("logged\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// A source past its share of warnings and errors is silenced until the
+// window ends, which logs how much it lost, without affecting the others.
+func TestSuppressSource(t *testing.T) {
+	const perSource = 20
+	l, out := suppressed(200*time.Millisecond, perSource)
+	for i := 0; i < 100; i++ {
+		l.Warn("Invalid header packet", "remote", fmt.Sprint("192.0.2.1:", 4000+i), "seq", i)
+	}
+	l.With("remote", "192.0.2.1:5000").Info("Transfer started")
+	l.Info("Transfer started", "remote", "192.0.2.2:4000")
+
+	got := out.lines()
+	if len(got) != perSource+1 {
+		t.Fatalf("logged %d lines, want %d from the noisy source and 1 from the other:\n%s", len(got), perSource+1, strings.Join(got, "\n"))
+	}
+	if !strings.Contains(got[perSource], "remote=192.0.2.2:4000") {
+		t.Errorf("last line %q, want the quiet source's", got[perSource])
+	}
+
+	// Nothing else is logged, so the timer reports what was dropped
+	deadline := time.Now().Add(5 * time.Second)
+	for len(out.lines()) == perSource+1 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	got = out.lines()
+	want := `level=WARN msg="Suppressed messages about a noisy source" remote=192.0.2.1 suppressed=81 window=200ms`
+	if len(got) != perSource+2 || got[perSource+1] != want {
+		t.Fatalf("logged\n%s\nwant the summary\n%s", strings.Join(got, "\n"), want)
+	}
+
+	// A new window starts the count over
+	l.Warn("Invalid header packet", "remote", "192.0.2.1:4000")
+	if got := out.lines(); len(got) != perSource+3 {
+		t.Errorf("logged %d lines, want the source heard again", len(got))
+	}
+}
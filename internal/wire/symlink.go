@@ -0,0 +1,38 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CheckNoSymlinks refuses a path under root that goes through a symlink,
+// which could redirect a write outside root. Root itself may be one, the
+// server's operator chose it; components that don't exist yet are fine,
+// as the server creates them as directories.
+func CheckNoSymlinks(root, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside %s", path, root)
+	}
+	if rel == "." {
+		return nil
+	}
+	p := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("won't write through symlink %s", p)
+		}
+	}
+	return nil
+}
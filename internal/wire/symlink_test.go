@@ -0,0 +1,46 @@
+//go:build !windows
+
+package wire
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckNoSymlinks(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+	os.WriteFile(filepath.Join(root, "dir", "file"), nil, 0644)
+	os.Symlink(outside, filepath.Join(root, "linkdir"))
+	os.WriteFile(filepath.Join(outside, "passwd"), nil, 0644)
+	os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(root, "linkfile"))
+	os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling"))
+	linkedRoot := filepath.Join(t.TempDir(), "root")
+	os.Symlink(root, linkedRoot)
+
+	tests := []struct {
+		name string
+		root string
+		path string
+		ok   bool
+	}{
+		{"root", root, root, true},
+		{"file", root, filepath.Join(root, "dir", "file"), true},
+		{"not created yet", root, filepath.Join(root, "new", "deeper", "file"), true},
+		{"symlinked directory", root, filepath.Join(root, "linkdir", "file"), false},
+		{"symlinked file", root, filepath.Join(root, "linkfile"), false},
+		{"dangling symlink", root, filepath.Join(root, "dangling"), false},
+		{"outside", root, filepath.Join(outside, "file"), false},
+		{"parent", root, filepath.Dir(root), false},
+		{"symlinked root", linkedRoot, filepath.Join(linkedRoot, "dir", "file"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckNoSymlinks(tt.root, tt.path); (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
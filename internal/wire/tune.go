@@ -0,0 +1,120 @@
+package wire
+
+import "time"
+
+const (
+	// How long a Tuner measures each setting, after letting the first one
+	// settle for as long
+	TUNE_STEP = 500 * time.Millisecond
+
+	// Longest a Tuner tries settings before keeping the best one so far
+	TUNE_PERIOD = 5 * time.Second
+
+	// How much faster a larger setting must be to be kept, or how many
+	// fewer calls per byte it must take when about as fast
+	TUNE_GAIN = 1.05
+
+	// Settings in a row that must fail to beat the best one before a
+	// Tuner stops trying larger ones, so one noisy measurement doesn't
+	// end the tuning
+	TUNE_MISSES = 2
+)
+
+// Tuner picks a transfer setting, such as a buffer size or a window,
+// from the throughput it measures over the first seconds of the transfer.
+// Starting small, it doubles the setting every TUNE_STEP while that makes
+// the transfer faster, or about as fast in fewer calls, and keeps the
+// best one measured once TUNE_MISSES in a row didn't or TUNE_PERIOD
+// passed. It is not safe
+// for concurrent use.
+type Tuner struct {
+	steps []int // Settings to try, smallest first
+	step  int   // Index of the setting in use
+	best  int   // Index of the best setting measured, -1 before any
+
+	bestRate float64 // Its bytes per second
+	bestCost float64 // Its calls per byte
+
+	start time.Time // Of the first Observe
+	since time.Time // Of the measurement under way
+	from  int64     // Bytes moved when it started
+	calls int       // Observe calls since
+	warm  bool      // Past the first TUNE_STEP
+	miss  int       // Settings in a row that didn't beat the best
+	done  bool
+}
+
+// NewTuner returns a Tuner trying from, doubled until it reaches to.
+func NewTuner(from, to int) *Tuner {
+	t := &Tuner{best: -1}
+	for v := from; v > 0 && v < to; v *= 2 {
+		t.steps = append(t.steps, v)
+	}
+	t.steps = append(t.steps, to)
+	t.done = len(t.steps) == 1
+	return t
+}
+
+// Steps returns the settings t tries, smallest first.
+func (t *Tuner) Steps() []int {
+	return t.steps
+}
+
+// Value returns the setting to use now.
+func (t *Tuner) Value() int {
+	return t.steps[t.step]
+}
+
+// Done reports whether t settled on its Value.
+func (t *Tuner) Done() bool {
+	return t.done
+}
+
+// Observe is called as the transfer moves data, with the bytes moved so
+// far, each call counting as one of the calls a setting costs. It reports
+// whether Value changed.
+func (t *Tuner) Observe(now time.Time, total int64) bool {
+	if t.done {
+		return false
+	}
+	if t.start.IsZero() {
+		t.start, t.since, t.from = now, now, total
+		return false
+	}
+	t.calls++
+	elapsed := now.Sub(t.since)
+	if elapsed < TUNE_STEP {
+		return false
+	}
+	bytes := total - t.from
+	calls := t.calls
+	t.since, t.from, t.calls = now, total, 0
+
+	// The first moments fill the kernel's buffers and open windows, which
+	// says nothing about the setting
+	if !t.warm {
+		t.warm = true
+		return false
+	}
+
+	rate := float64(bytes) / elapsed.Seconds()
+	cost := float64(calls) / float64(max(bytes, 1))
+	better := t.best < 0 || rate > t.bestRate*TUNE_GAIN ||
+		rate*TUNE_GAIN >= t.bestRate && cost*TUNE_GAIN < t.bestCost
+	if better {
+		// Kept for being cheaper, the setting is held to the fastest rate
+		// seen, so a string of them can't drift slower
+		t.best, t.bestRate, t.bestCost = t.step, max(rate, t.bestRate), cost
+		t.miss = 0
+	} else {
+		t.miss++
+	}
+	if t.miss < TUNE_MISSES && t.step+1 < len(t.steps) && now.Sub(t.start) < TUNE_PERIOD {
+		t.step++
+		return true
+	}
+	t.done = true
+	changed := t.step != t.best
+	t.step = t.best
+	return changed
+}
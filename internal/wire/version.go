@@ -0,0 +1,113 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// Opens every TCP connection and UDP header packet from a versioned
+	// peer. A legacy file header can't start with it: its flags byte only
+	// uses the low bits.
+	MAGIC = "\xC7SFT"
+
+	// Highest and lowest protocol versions this build speaks. Version 2
+	// puts byte offsets in UDP data packets, version 3 answers UDP file
+	// headers with a HeaderAck.
+	PROTOCOL_VERSION     = 3
+	MIN_PROTOCOL_VERSION = 1
+
+	// Optional capabilities advertised in a Hello. Each is the bit of the
+	// header flag that requests it.
+	FEATURE_SKIP_IDENTICAL = FLAG_SKIP_IDENTICAL
+	FEATURE_DELTA          = FLAG_DELTA
+	FEATURE_PACKET_SIZE    = FLAG_PACKET_SIZE
+	FEATURE_FEC            = FLAG_FEC
+	FEATURE_CUMULATIVE_ACK = FLAG_CUMULATIVE_ACK
+	FEATURE_SESSION        = FLAG_SESSION
+	FEATURE_SPARSE         = FLAG_SPARSE
+	FEATURE_RANGE          = FLAG_RANGE
+
+	// Features no header flag requests take the bits past the flags byte
+	FEATURE_PING      = 0x100  // Sessions answer REQ_PING
+	FEATURE_PAUSE     = 0x200  // Clients may pause uploads, see Pause
+	FEATURE_ABORT     = 0x400  // Clients may abort uploads, see SEGMENT_ABORT
+	FEATURE_HEARTBEAT = 0x800  // Servers report what they do while storing a file, see HEARTBEAT_INTERVAL
+	FEATURE_METADATA  = 0x1000 // TCP file headers are metadata frames, see FileHeader.MarshalMetadata
+	FEATURE_RECEIPT   = 0x2000 // TCP servers confirm a stored file with a Receipt
+
+	// TCP file bodies end with a digest of the file in one of these
+	// hashes, see internal/checksum
+	FEATURE_HASH_SHA256 = 0x4000
+	FEATURE_HASH_BLAKE3 = 0x8000
+	FEATURE_HASH_XXH3   = 0x10000
+	FEATURE_HASH_CRC32C = 0x20000
+
+	FEATURE_TOKEN = 0x40000  // TCP receipts carry a retrieval token, see Receipt
+	FEATURE_CODES = 0x80000  // Sessions stage files under short codes, see REQ_STAGE
+	FEATURE_AUTH  = 0x100000 // TCP clients send an auth token after the hello, see WriteAuth
+
+	// Magic, version, features
+	HELLO_LEN = len(MAGIC) + 1 + 4
+)
+
+// Hello announces the highest protocol version a peer speaks and the
+// optional features it supports. See PROTOCOL.md for when it is exchanged.
+type Hello struct {
+	Version  byte
+	Features uint32
+}
+
+// HasMagic reports whether b starts like a Hello rather than a legacy
+// file header.
+func HasMagic(b []byte) bool {
+	return len(b) >= len(MAGIC) && string(b[:len(MAGIC)]) == MAGIC
+}
+
+// MarshalBinary encodes h.
+func (h *Hello) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, HELLO_LEN)
+	b = append(b, MAGIC...)
+	b = append(b, h.Version)
+	return binary.BigEndian.AppendUint32(b, h.Features), nil
+}
+
+// UnmarshalBinary decodes a hello from the first HELLO_LEN bytes of b.
+func (h *Hello) UnmarshalBinary(b []byte) error {
+	if !HasMagic(b) {
+		return fmt.Errorf("%w: missing magic", ErrMalformed)
+	}
+	if len(b) < HELLO_LEN {
+		return fmt.Errorf("%w: %d byte hello", ErrTruncated, len(b))
+	}
+	h.Version = b[len(MAGIC)]
+	h.Features = binary.BigEndian.Uint32(b[len(MAGIC)+1:])
+	return nil
+}
+
+// ReadHello decodes a hello from a stream.
+func ReadHello(r io.Reader) (*Hello, error) {
+	b := make([]byte, HELLO_LEN)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("error reading hello: %w", err)
+	}
+	var h Hello
+	if err := h.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// Negotiate returns the highest version and the features both local and
+// peer support, failing if they have no version in common.
+func Negotiate(local, peer Hello) (Hello, error) {
+	common := Hello{
+		Version:  min(local.Version, peer.Version),
+		Features: local.Features & peer.Features,
+	}
+	if common.Version < MIN_PROTOCOL_VERSION {
+		return Hello{}, fmt.Errorf("%w: peer speaks protocol version %d, need at least %d", ErrProtocol, peer.Version, MIN_PROTOCOL_VERSION)
+	}
+	return common, nil
+}
@@ -0,0 +1,100 @@
+// Package wire holds the pieces shared by the TCP and UDP transfer
+// protocols: default ports, packet encodings, logging and progress
+// reporting.
+package wire
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	TCP_PORT  = ":8080"
+	UDP_PORT  = ":8081"
+	QUIC_PORT = ":8082"
+	TFTP_PORT = ":69"
+
+	// Where servers answer discovery probes, see internal/discover
+	DISCOVER_PORT = ":8083"
+
+	// Where relays pair peers behind NAT, see internal/punch
+	RELAY_PORT = ":8084"
+
+	// Header flags, carried in the top byte of the filename length field
+	FLAG_SKIP_IDENTICAL = 0x01
+	FLAG_DELTA          = 0x02 // TCP only
+	FLAG_PACKET_SIZE    = 0x04 // UDP only
+	FLAG_FEC            = 0x08 // UDP only
+	FLAG_CUMULATIVE_ACK = 0x10 // UDP only, client understands cumulative ACKs
+	FLAG_SESSION        = 0x20 // TCP only, opens a session of requests instead of sending a file
+	FLAG_SPARSE         = 0x40 // Only the file's data is sent, the holes between it are left out
+	FLAG_RANGE          = 0x80 // TCP only, one of several connections each sending a range of the file
+
+	// Largest filename the 24-bit length field can describe
+	MAX_FILENAME_LEN = 1<<24 - 1
+
+	// Longest filename a server accepts, the usual file system limit
+	MAX_NAME_BYTES = 255
+
+	// Subdirectory of the upload directory that receives files whose
+	// strict post-receive hook failed
+	QUARANTINE_DIR = ".quarantine"
+)
+
+// CheckName rejects filenames that aren't a single, plain path element of
+// valid UTF-8, so a received file can't land outside the upload directory.
+// Clients check names before connecting; servers report a bad one as a
+// protocol error.
+func CheckName(name string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("%w %q", ErrInvalidName, name)
+	case len(name) > MAX_NAME_BYTES:
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrInvalidName, len(name), MAX_NAME_BYTES)
+	case !utf8.ValidString(name):
+		return fmt.Errorf("%w %q: not UTF-8", ErrInvalidName, name)
+	case strings.ContainsAny(name, "/\\"), strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return fmt.Errorf("%w %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// Frames up to this size are read into a buffer of their declared length
+const SMALL_FRAME_LEN = 4 << 10
+
+// readDeclared reads the n bytes a peer said it would send. Past
+// SMALL_FRAME_LEN the buffer grows with what actually arrives, so a length
+// the peer never backs with data costs it nothing. A short read is
+// io.ErrUnexpectedEOF, as with io.ReadFull.
+func readDeclared(r io.Reader, n int) ([]byte, error) {
+	if n <= SMALL_FRAME_LEN {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(SMALL_FRAME_LEN)
+	m, err := buf.ReadFrom(io.LimitReader(r, int64(n)))
+	if err == nil && m < int64(n) {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+// ContextError returns ctx's error, wrapped with the failure it caused,
+// once ctx is done, so callers can tell cancellation (context.Canceled,
+// context.DeadlineExceeded) apart from network and disk errors. Otherwise
+// err is returned unchanged, as is ErrSourceStalled, which already wraps
+// ctx's error and says where the transfer was stuck.
+func ContextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ErrSourceStalled) {
+		return err
+	}
+	return fmt.Errorf("transfer aborted: %w (%v)", ctx.Err(), err)
+}
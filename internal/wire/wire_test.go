@@ -0,0 +1,205 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+var testSum = bytes.Repeat([]byte{0xab}, CHECKSUM_LEN)
+
+func TestFileHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		h    FileHeader
+	}{
+		{"plain", FileHeader{Name: "a.txt", Size: 42}},
+		{"empty file", FileHeader{Name: "empty", Size: 0}},
+		{"largest size", FileHeader{Name: "huge", Size: 1<<64 - 1}},
+		{"skip identical", FileHeader{Name: "s", Size: 7, Flags: FLAG_SKIP_IDENTICAL, Checksum: testSum}},
+		{"packet size", FileHeader{Name: "p", Size: 9, Flags: FLAG_PACKET_SIZE, PacketSize: 1400}},
+		{"fec", FileHeader{Name: "f", Size: 9, Flags: FLAG_FEC, FECData: 8, FECParity: 2}},
+		{"range", FileHeader{Name: "r", Size: 1 << 40, Flags: FLAG_RANGE, Checksum: testSum, RangeID: [RANGE_ID_LEN]byte{1, 2, 3}, RangeOffset: 1 << 30, RangeLength: 1 << 20}},
+		{"every flag", FileHeader{Name: "all", Size: 3, Flags: FLAG_SKIP_IDENTICAL | FLAG_PACKET_SIZE | FLAG_FEC | FLAG_CUMULATIVE_ACK | FLAG_SPARSE, Checksum: testSum, PacketSize: 512, FECData: 4, FECParity: 1}},
+		{"unicode name", FileHeader{Name: "relatório 📄.pdf", Size: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.h.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != tt.h.Len() {
+				t.Errorf("encoded %d bytes, Len says %d", len(b), tt.h.Len())
+			}
+			var got FileHeader
+			if err := got.UnmarshalBinary(b); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.h) {
+				t.Errorf("UnmarshalBinary = %+v, want %+v", got, tt.h)
+			}
+			read, err := ReadFileHeader(bytes.NewReader(b), MAX_NAME_BYTES)
+			if err != nil {
+				t.Fatalf("ReadFileHeader: %v", err)
+			}
+			if !reflect.DeepEqual(*read, tt.h) {
+				t.Errorf("ReadFileHeader = %+v, want %+v", *read, tt.h)
+			}
+		})
+	}
+}
+
+func TestFileHeaderMarshalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		h    FileHeader
+	}{
+		{"checksum without flag", FileHeader{Name: "a", Checksum: testSum}},
+		{"flag without checksum", FileHeader{Name: "a", Flags: FLAG_SKIP_IDENTICAL}},
+		{"short checksum", FileHeader{Name: "a", Flags: FLAG_RANGE, Checksum: testSum[:5]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.h.MarshalBinary(); !errors.Is(err, ErrMalformed) {
+				t.Errorf("got %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+// header encodes the fixed start of a file header.
+func header(flags byte, nameLen int, rest ...byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(flags)<<24|uint32(nameLen))
+	return append(b, rest...)
+}
+
+func TestFileHeaderUnmarshalErrors(t *testing.T) {
+	size := make([]byte, 8)
+	tests := []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"empty", nil, ErrTruncated},
+		{"three bytes", []byte{0, 0, 1}, ErrTruncated},
+		{"name cut short", header(0, 5, 'a', 'b'), ErrTruncated},
+		{"size cut short", header(0, 1, 'a', 0, 0, 0), ErrTruncated},
+		{"largest name length", header(0, MAX_FILENAME_LEN), ErrTruncated},
+		{"checksum missing", header(FLAG_SKIP_IDENTICAL, 1, append([]byte{'a'}, size...)...), ErrTruncated},
+		{"trailing bytes", header(0, 1, append(append([]byte{'a'}, size...), 0)...), ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h FileHeader
+			err := h.UnmarshalBinary(tt.b)
+			if !errors.Is(err, tt.want) || !errors.Is(err, ErrProtocol) {
+				t.Errorf("got %v, want %v wrapping ErrProtocol", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadFileHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"empty", nil, io.EOF},
+		{"name over the limit", header(0, MAX_NAME_BYTES+1), ErrMalformed},
+		{"largest name length", header(0, MAX_FILENAME_LEN), ErrMalformed},
+		{"name cut short", header(0, 5, 'a'), io.ErrUnexpectedEOF},
+		{"range cut short", header(FLAG_RANGE, 1, append([]byte{'a'}, make([]byte, 8+CHECKSUM_LEN+3)...)...), io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadFileHeader(bytes.NewReader(tt.b), MAX_NAME_BYTES); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// Longest header ReadFileHeader reads with a name of MAX_NAME_BYTES
+const maxHeaderLen = FILE_HEADER_LEN + MAX_NAME_BYTES + CHECKSUM_LEN + PACKET_SIZE_LEN + FEC_LEN + RANGE_LEN
+
+func FuzzReadHeader(f *testing.F) {
+	for _, h := range []FileHeader{
+		{Name: "a.txt", Size: 42},
+		{Name: "s", Size: 7, Flags: FLAG_SKIP_IDENTICAL | FLAG_PACKET_SIZE | FLAG_FEC, Checksum: testSum, PacketSize: 1400, FECData: 8, FECParity: 2},
+		{Name: "r", Size: 1 << 40, Flags: FLAG_RANGE, Checksum: testSum, RangeOffset: 1 << 30, RangeLength: 1 << 20},
+	} {
+		b, _ := h.MarshalBinary()
+		f.Add(b)
+	}
+	f.Add(header(0xff, MAX_FILENAME_LEN))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := &countingReader{r: bytes.NewReader(b)}
+		read, err := ReadFileHeader(r, MAX_NAME_BYTES)
+		if r.n > maxHeaderLen {
+			t.Fatalf("read %d bytes, a header is at most %d", r.n, maxHeaderLen)
+		}
+		var h FileHeader
+		uerr := h.UnmarshalBinary(b)
+		if err != nil {
+			if uerr == nil && len(h.Name) <= MAX_NAME_BYTES {
+				t.Fatalf("UnmarshalBinary accepts what ReadFileHeader refuses with %v", err)
+			}
+			return
+		}
+		if len(read.Name) > MAX_NAME_BYTES {
+			t.Fatalf("%d byte name accepted", len(read.Name))
+		}
+
+		// What decodes encodes back to the bytes read
+		again, merr := read.MarshalBinary()
+		if merr != nil {
+			t.Fatalf("MarshalBinary of a decoded header: %v", merr)
+		}
+		if !bytes.Equal(again, b[:r.n]) {
+			t.Fatalf("re-encoded %x, read %x", again, b[:r.n])
+		}
+		if uerr == nil && !reflect.DeepEqual(h, *read) {
+			t.Fatalf("UnmarshalBinary = %+v, ReadFileHeader = %+v", h, *read)
+		}
+	})
+}
+
+// A header announcing the longest name costs no more than a short one
+// before it is refused.
+func TestReadFileHeaderAllocation(t *testing.T) {
+	b := header(0, MAX_FILENAME_LEN)
+	allocs := testing.AllocsPerRun(100, func() {
+		ReadFileHeader(bytes.NewReader(b), MAX_NAME_BYTES)
+	})
+	if allocs > 8 {
+		t.Errorf("%v allocations refusing a long name", allocs)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 100; i++ {
+		ReadFileHeader(bytes.NewReader(b), MAX_NAME_BYTES)
+	}
+	runtime.ReadMemStats(&after)
+	if grew := after.TotalAlloc - before.TotalAlloc; grew > 1<<20 {
+		t.Errorf("refusing 100 headers with %d byte names allocated %d bytes", MAX_FILENAME_LEN, grew)
+	}
+}
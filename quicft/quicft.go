@@ -0,0 +1,261 @@
+// Package quicft carries the tcpft protocol over QUIC. Each file, or
+// session, gets a stream of its own, and the streams to one server share
+// a connection, so several files can be sent at once over a single UDP
+// port with TLS 1.3 throughout.
+//
+// A Listener presents the streams a server accepts as connections to
+// tcpft.Server.Serve:
+//
+//	l, err := quicft.ListenAddr(":8082", tlsConfig)
+//	err = srv.Serve(ctx, l) // srv is a *tcpft.Server
+//
+// A Dialer opens a stream for each connection a tcpft.Client dials:
+//
+//	d := &quicft.Dialer{TLSConfig: &tls.Config{RootCAs: pool}}
+//	defer d.Close()
+//	c := tcpft.Client{Dial: d.Dial}
+//	res, err := c.SendFile(ctx, "host:8082", "backup.tar", tcpft.Options{})
+package quicft
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN protocol name both sides require
+const ALPN = "socket-file-transfer"
+
+// Application error code of connections closed by a Listener or Dialer
+const CLOSE_CODE = 0
+
+// withALPN returns a copy of c, which may be nil, that negotiates ALPN.
+func withALPN(c *tls.Config) *tls.Config {
+	c = c.Clone()
+	if c == nil {
+		c = &tls.Config{}
+	}
+	c.NextProtos = []string{ALPN}
+	return c
+}
+
+// streamConn is a stream with the addresses of its connection, so it can
+// stand in for a TCP connection.
+type streamConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *streamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// ConnectionState describes the connection's TLS, like a *tls.Conn's, so
+// a server can tell a client by its certificate.
+func (c *streamConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// CloseWrite ends the sending side only, like a TCP half-close.
+func (c *streamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// Close ends both sides; data already written is still delivered.
+func (c *streamConn) Close() error {
+	c.Stream.CancelRead(CLOSE_CODE)
+	return c.Stream.Close()
+}
+
+// Listener accepts the streams clients open, as net.Conns.
+type Listener struct {
+	ql      *quic.Listener
+	streams chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+
+	mu    sync.Mutex
+	conns map[quic.Connection]struct{}
+}
+
+// ListenAddr listens for QUIC connections on the UDP address addr. The
+// TLS configuration must hold the server's certificate.
+func ListenAddr(addr string, tlsConfig *tls.Config) (*Listener, error) {
+	ql, err := quic.ListenAddr(addr, withALPN(tlsConfig), &quic.Config{KeepAlivePeriod: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{ql: ql, streams: make(chan net.Conn), done: make(chan struct{}), conns: make(map[quic.Connection]struct{})}
+	go l.acceptConns()
+	return l, nil
+}
+
+func (l *Listener) acceptConns() {
+	for {
+		conn, err := l.ql.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		l.conns[conn] = struct{}{}
+		l.mu.Unlock()
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *Listener) acceptStreams(conn quic.Connection) {
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+	}()
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- &streamConn{Stream: stream, conn: conn}:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.streams:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and closes every connection, aborting their
+// streams.
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.ql.Close()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for conn := range l.conns {
+			conn.CloseWithError(CLOSE_CODE, "server shutting down")
+		}
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ql.Addr()
+}
+
+// Dialer opens streams to servers, sharing one connection per address
+// among them. The zero value verifies servers against the system roots.
+type Dialer struct {
+	TLSConfig *tls.Config
+
+	mu    sync.Mutex
+	conns map[string]quic.Connection
+}
+
+// Dial opens a new stream to the server at addr, connecting first unless
+// a connection to it is open. The network is ignored, so Dial fits
+// tcpft.Client.Dial.
+func (d *Dialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.connection(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{Stream: stream, conn: conn}, nil
+}
+
+func (d *Dialer) connection(ctx context.Context, addr string) (quic.Connection, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if conn, ok := d.conns[addr]; ok && conn.Context().Err() == nil {
+		return conn, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := withALPN(d.TLSConfig)
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	conn, err := quic.DialAddr(ctx, addr, tlsConfig, &quic.Config{KeepAlivePeriod: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if d.conns == nil {
+		d.conns = make(map[string]quic.Connection)
+	}
+	d.conns[addr] = conn
+	return conn, nil
+}
+
+// Close closes the connections the Dialer opened, aborting their streams.
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var errs []error
+	for addr, conn := range d.conns {
+		errs = append(errs, conn.CloseWithError(CLOSE_CODE, ""))
+		delete(d.conns, addr)
+	}
+	return errors.Join(errs...)
+}
+
+// SelfSigned returns a certificate for hosts, valid for a year, that
+// clients can't verify unless told to trust it, along with the SHA-256
+// fingerprint to compare.
+func SelfSigned(hosts ...string) (tls.Certificate, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "transfer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("error creating certificate: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, hex.EncodeToString(sum[:]), nil
+}
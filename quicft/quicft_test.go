@@ -0,0 +1,163 @@
+package quicft
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"socket-file-transfer/tcpft"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+var quietOptions = tcpft.Options{Logger: quiet, Progress: func(tcpft.Event) {}}
+
+// serve runs a tcpft.Server on a QUIC listener on loopback until the test
+// ends. It returns the address, the upload directory and a Dialer that
+// trusts the server's certificate.
+func serve(t *testing.T) (string, string, *Dialer) {
+	t.Helper()
+	cert, _, err := SelfSigned("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &tcpft.Server{UploadDir: t.TempDir()}
+	s.Logger, s.Progress = quiet, func(tcpft.Event) {}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(ctx, l)
+	}()
+
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	d := &Dialer{TLSConfig: &tls.Config{RootCAs: roots}}
+	t.Cleanup(func() {
+		d.Close()
+		cancel()
+		<-done
+	})
+	return l.Addr().String(), s.UploadDir, d
+}
+
+func TestTransfer(t *testing.T) {
+	addr, dir, d := serve(t)
+	data := bytes.Repeat([]byte("quic "), 1<<20)
+	c := tcpft.Client{Dial: d.Dial}
+	res, err := c.Send(context.Background(), addr, "quic.bin", bytes.NewReader(data), int64(len(data)), quietOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(res.Checksum, sum[:]) {
+		t.Errorf("checksum %x, want %x", res.Checksum, sum)
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, "quic.bin"))
+	if !bytes.Equal(got, data) {
+		t.Errorf("stored %d bytes, want %d", len(got), len(data))
+	}
+}
+
+// Files sent at once take streams of one connection.
+func TestConcurrentStreams(t *testing.T) {
+	addr, dir, d := serve(t)
+	c := tcpft.Client{Dial: d.Dial}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte(i)}, 256<<10+i)
+			_, err := c.Send(context.Background(), addr, fmt.Sprintf("f%d", i), bytes.NewReader(data), int64(len(data)), quietOptions)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if len(d.conns) != 1 {
+		t.Errorf("%d connections, want one shared", len(d.conns))
+	}
+	for i := 0; i < 8; i++ {
+		if info, err := os.Stat(filepath.Join(dir, fmt.Sprintf("f%d", i))); err != nil || info.Size() != int64(256<<10+i) {
+			t.Errorf("f%d: %v", i, err)
+		}
+	}
+}
+
+// A session's requests share one stream.
+func TestSession(t *testing.T) {
+	addr, _, d := serve(t)
+	c := tcpft.Client{Dial: d.Dial}
+	sess, err := c.OpenSession(context.Background(), addr, quietOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	path := filepath.Join(t.TempDir(), "s.txt")
+	os.WriteFile(path, []byte("session"), 0644)
+	if _, err := sess.Put(context.Background(), path, ""); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := sess.Stat(context.Background(), "s.txt"); err != nil || info.Size != 7 {
+		t.Errorf("Stat = %+v, %v", info, err)
+	}
+}
+
+// A client that doesn't trust the certificate never sends.
+func TestUntrusted(t *testing.T) {
+	addr, dir, _ := serve(t)
+	d := &Dialer{}
+	defer d.Close()
+	c := tcpft.Client{Dial: d.Dial}
+	if _, err := c.Send(context.Background(), addr, "f", bytes.NewReader([]byte("x")), 1, quietOptions); err == nil {
+		t.Error("sent to a server with an unknown certificate")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "f")); err == nil {
+		t.Error("file stored")
+	}
+}
+
+func TestSelfSigned(t *testing.T) {
+	cert, fingerprint, err := SelfSigned("127.0.0.1", "files.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(cert.Certificate[0]); fingerprint != hex.EncodeToString(sum[:]) {
+		t.Errorf("fingerprint %s isn't the certificate's SHA-256", fingerprint)
+	}
+	if err := leaf.VerifyHostname("files.example"); err != nil {
+		t.Error(err)
+	}
+	if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	if leaf.VerifyHostname("other.example") == nil {
+		t.Error("certificate valid for a host it wasn't made for")
+	}
+}
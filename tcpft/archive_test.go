@@ -0,0 +1,92 @@
+package tcpft
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"socket-file-transfer/internal/archive"
+	"socket-file-transfer/internal/wire"
+)
+
+// A server with AutoExtract unpacks an archive next to it, and refuses one
+// with an entry leading outside, unpacking none of it.
+func TestAutoExtract(t *testing.T) {
+	s := &Server{Options: quietOptions(), AutoExtract: true}
+	addr := serve(t, s)
+
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("b"), 0644)
+	var buf bytes.Buffer
+	if _, err := archive.Write(&buf, src, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Client{}).Send(context.Background(), addr, "site.tar.gz", bytes.NewReader(buf.Bytes()), int64(buf.Len()), quietOptions()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	checkStored(t, filepath.Join(s.UploadDir, "site"), "a.txt", []byte("a"))
+	checkStored(t, filepath.Join(s.UploadDir, "site", "sub"), "b.txt", []byte("b"))
+
+	buf.Reset()
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"ok", "../evil"} {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+		tw.Write([]byte("evil"))
+	}
+	tw.Close()
+	_, err := (&Client{}).Send(context.Background(), addr, "bad.tar", bytes.NewReader(buf.Bytes()), int64(buf.Len()), quietOptions())
+	if !errors.Is(err, wire.ErrRejected) {
+		t.Errorf("got %v, want ErrRejected", err)
+	}
+	for _, name := range []string{"bad", "evil", filepath.Join("..", "evil")} {
+		if _, err := os.Lstat(filepath.Join(s.UploadDir, name)); err == nil {
+			t.Errorf("%s unpacked from a malicious archive", name)
+		}
+	}
+	names, _ := readDirNames(s.UploadDir)
+	for _, name := range names {
+		if strings.HasSuffix(name, ".extract") || strings.HasSuffix(name, ".old") {
+			t.Errorf("extraction left %s behind", name)
+		}
+	}
+}
+
+// An archive expanding past the limits, or misstating its entries' sizes,
+// fails with ErrExpansion before it is stored: no hook runs for it, and
+// nothing of it is left, nor deduplicated against.
+func TestAutoExtractExpansion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands run through /bin/sh here")
+	}
+	for _, name := range []string{"bomb.tar.gz", "lying-size.tar"} {
+		t.Run(name, func(t *testing.T) {
+			hooked := filepath.Join(t.TempDir(), "hooked")
+			s := &Server{Options: quietOptions(), AutoExtract: true, MaxFileSize: 1 << 20, Dedupe: true}
+			s.HookCommand = "touch " + hooked
+			addr := serve(t, s)
+			path := filepath.Join("..", "internal", "archive", "testdata", name)
+			_, err := (&Client{}).SendFile(context.Background(), addr, path, quietOptions())
+			if !errors.Is(err, wire.ErrExpansion) {
+				t.Fatalf("got %v, want ErrExpansion", err)
+			}
+			stem, _, _ := archive.Split(name)
+			names, _ := readDirNames(s.UploadDir)
+			for _, n := range names {
+				if strings.Contains(n, stem) {
+					t.Errorf("refused archive left %s behind", n)
+				}
+			}
+			if _, err := os.Stat(hooked); err == nil {
+				t.Error("hook ran for a refused archive")
+			}
+		})
+	}
+}
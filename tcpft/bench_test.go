@@ -0,0 +1,74 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/checksum"
+	"socket-file-transfer/internal/wire"
+)
+
+// benchmarkSend sends size bytes over loopback b.N times, storing each copy
+// under the same name.
+func benchmarkSend(b *testing.B, size int, opts Options) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	s := &Server{}
+	s.Legacy = opts.Legacy
+	addr := serve(b, s)
+	var c Client
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Send(context.Background(), addr, "bench.bin", bytes.NewReader(data), int64(size), opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSend1MB(b *testing.B)  { benchmarkSend(b, 1<<20, quietOptions()) }
+func BenchmarkSend16MB(b *testing.B) { benchmarkSend(b, 16<<20, quietOptions()) }
+
+func BenchmarkSendLegacy16MB(b *testing.B) {
+	opts := quietOptions()
+	opts.Legacy = true
+	benchmarkSend(b, 16<<20, opts)
+}
+
+// Sends of 2 GiB over loopback with each buffer size Options.Autotune may
+// settle on, then autotuned: of-best-% is the tuned sends' throughput as a
+// share of the fastest fixed size's over all of them, as single sends vary
+// by 10-20% here. CRC-32C keeps the hash out of the way.
+func BenchmarkAutotune(b *testing.B) {
+	const size = 2 << 30
+	addr := serve(b, &Server{})
+	var c Client
+	send := func(opts Options) time.Duration {
+		opts.Hash = checksum.CRC32C
+		start := time.Now()
+		if _, err := c.Send(context.Background(), addr, "bench.bin", rand.New(rand.NewSource(1)), size, opts); err != nil {
+			b.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	steps := wire.NewTuner(MIN_TUNED_BUFFER, MAX_TUNED_BUFFER).Steps()
+	fixed := make([]time.Duration, len(steps))
+	var tuned time.Duration
+	for i := 0; i < b.N; i++ {
+		for j, v := range steps {
+			opts := quietOptions()
+			opts.BufferSize = v
+			fixed[j] += send(opts)
+		}
+		opts := quietOptions()
+		opts.Autotune = true
+		tuned += send(opts)
+	}
+	b.ReportMetric(100*slices.Min(fixed).Seconds()/tuned.Seconds(), "of-best-%")
+}
@@ -0,0 +1,110 @@
+package tcpft
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// Transfers come out whole whatever the buffer sizes of either end,
+// including ones that don't divide the file.
+func TestBufferSizes(t *testing.T) {
+	data := make([]byte, 3<<20+123)
+	rand.New(rand.NewSource(4)).Read(data)
+
+	for _, size := range []int{1000, 4096, 64 << 10, DefaultBufferSize, 1 << 20} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			s := &Server{}
+			s.BufferSize = size
+			addr := serve(t, s)
+			opts := quietOptions()
+			opts.BufferSize = size
+
+			var c Client
+			res, err := c.SendFile(context.Background(), addr, writeFile(t, "buf.bin", data), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkStored(t, s.UploadDir, "buf.bin", data)
+			if res.Bytes != int64(len(data)) {
+				t.Errorf("sent %d bytes, want %d", res.Bytes, len(data))
+			}
+
+			// And back out of the uploads directory
+			session, err := c.OpenSession(context.Background(), addr, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			path := filepath.Join(t.TempDir(), "back.bin")
+			if _, err := session.Get(context.Background(), "buf.bin", path); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sha256.Sum256(got) != sha256.Sum256(data) {
+				t.Errorf("downloaded %d bytes with a different SHA-256 than the %d uploaded", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestGetBuffer(t *testing.T) {
+	small := getBuffer(1000)
+	if len(*small) < 1000 {
+		t.Fatalf("asked for 1000 bytes, got %d", len(*small))
+	}
+	putBuffer(small)
+
+	// A pooled buffer too small for the request isn't handed out
+	big := getBuffer(1 << 20)
+	if len(*big) < 1<<20 {
+		t.Fatalf("asked for %d bytes, got %d", 1<<20, len(*big))
+	}
+	putBuffer(big)
+}
+
+// Uploads take the buffers the server receives and hashes them in from
+// the pool, rather than allocating them for each.
+func TestBufferReuse(t *testing.T) {
+	// Several CPUs, for a hash pipe of several buffers
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	const size = 4 << 20
+	s := &Server{}
+	s.BufferSize = size
+	addr := serve(t, s)
+	opts := quietOptions()
+	opts.BufferSize = 64 << 10
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(5)).Read(data)
+	path := writeFile(t, "reuse.bin", data)
+
+	var c Client
+	send := func() {
+		if _, err := c.SendFile(context.Background(), addr, path, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Fills the pool
+	send()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	const uploads = 10
+	for i := 0; i < uploads; i++ {
+		send()
+	}
+	runtime.ReadMemStats(&after)
+	checkStored(t, s.UploadDir, "reuse.bin", data)
+	// The race detector drops some of what is put back, so allow for a
+	// few new buffers
+	if per := (after.TotalAlloc - before.TotalAlloc) / uploads; per > 2*size {
+		t.Errorf("allocated %d bytes an upload, want the server's %d byte buffers reused", per, size)
+	}
+}
@@ -0,0 +1,175 @@
+package tcpft
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// slowReader yields zeros in small pieces, slowly enough that a transfer
+// of it is still under way when a test cancels it.
+type slowReader struct{}
+
+func (slowReader) Read(p []byte) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	n := min(len(p), 4096)
+	clear(p[:n])
+	return n, nil
+}
+
+// checkGoroutines returns a function failing the test if more goroutines
+// run than when checkGoroutines was called, once those winding down had
+// a moment to.
+func checkGoroutines(t *testing.T) func() {
+	before := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := runtime.NumGoroutine(); n > before {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%d goroutines leaked:\n%s", n-before, buf)
+		}
+	}
+}
+
+func TestCancelSend(t *testing.T) {
+	check := checkGoroutines(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	s := &Server{UploadDir: t.TempDir()}
+	s.Logger, s.Progress = quiet, func(Event) {}
+	go func() { served <- s.Serve(ctx, ln) }()
+
+	sendCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	var c Client
+	_, err = c.Send(sendCtx, ln.Addr().String(), "slow.bin", slowReader{}, 1<<30, quietOptions())
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if took := time.Since(start) - 200*time.Millisecond; took > time.Second {
+		t.Errorf("returned %v after the cancel, want under a second", took)
+	}
+
+	// The server drops the partial file
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && !dirEmpty(t, s.UploadDir) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !dirEmpty(t, s.UploadDir) {
+		t.Error("partial file left behind")
+	}
+
+	stop()
+	if err := <-served; !errors.Is(err, context.Canceled) {
+		t.Errorf("Serve returned %v, want context.Canceled", err)
+	}
+	check()
+}
+
+// Stopping the server aborts the transfers in flight promptly.
+func TestShutdownDuringTransfer(t *testing.T) {
+	check := checkGoroutines(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	s := &Server{UploadDir: t.TempDir()}
+	s.Logger, s.Progress = quiet, func(Event) {}
+	go func() { served <- s.Serve(ctx, ln) }()
+
+	sent := make(chan error, 1)
+	go func() {
+		var c Client
+		_, err := c.Send(context.Background(), ln.Addr().String(), "slow.bin", slowReader{}, 1<<30, quietOptions())
+		sent <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	stop()
+	select {
+	case err := <-served:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Serve returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve still running a second after its context ended")
+	}
+	if err := <-sent; err == nil {
+		t.Error("send succeeded though the server stopped")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("took %v to stop, want under a second", took)
+	}
+	check()
+}
+
+// dirEmpty reports whether dir holds no file, stored or partial, only the
+// store's own hidden records.
+func dirEmpty(t *testing.T, dir string) bool {
+	t.Helper()
+	entries, err := readDirNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range entries {
+		if !strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".part") {
+			return false
+		}
+	}
+	return true
+}
+
+// stuckReader yields some zeros, then blocks as a read of a hung network
+// mount does, until released.
+type stuckReader struct {
+	left     int
+	released chan struct{}
+}
+
+func (r *stuckReader) Read(p []byte) (int, error) {
+	if r.left > 0 {
+		n := min(len(p), r.left)
+		clear(p[:n])
+		r.left -= n
+		return n, nil
+	}
+	<-r.released
+	return 0, errors.New("read after the transfer ended")
+}
+
+// A read of the source that never returns fails the send at its deadline,
+// as a stall of the source rather than of the network.
+func TestSendSourceStalled(t *testing.T) {
+	addr := serve(t, &Server{})
+	src := &stuckReader{left: 5000, released: make(chan struct{})}
+	defer close(src.released)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := (&Client{}).Send(ctx, addr, "stuck.bin", src, 1<<20, quietOptions())
+	if !errors.Is(err, wire.ErrSourceStalled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want ErrSourceStalled wrapping the deadline", err)
+	}
+	if took := time.Since(start); took > 3*time.Second {
+		t.Errorf("took %v, want about the 500ms deadline", took)
+	}
+}
@@ -0,0 +1,455 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"socket-file-transfer/internal/checksum"
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/sparse"
+	"socket-file-transfer/internal/wire"
+)
+
+// Client sends files to a Server. The zero value is ready to use.
+type Client struct {
+	// Dial opens the connection to the server. A net.Dialer is used if nil.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// UnixSocket is the path of a unix socket to connect to in place of
+	// the addr passed to each call, which then only names the server in
+	// progress events.
+	UnixSocket string
+
+	// WebSocket is a ws:// or wss:// URL, of a WebSocketListener, to
+	// tunnel through in place of addr, like UnixSocket. The connection
+	// goes through the proxy HTTPS_PROXY or HTTP_PROXY names, if any.
+	WebSocket string
+	TLSConfig *tls.Config // For wss://; the defaults if nil
+
+	// Proxy is the URL of a proxy to reach addr through: http:// for one
+	// that takes CONNECT requests, socks5:// or socks5h:// for SOCKS5, the
+	// latter letting the proxy resolve the host name. User info in the URL
+	// is sent as credentials. Connections go direct if empty; see
+	// ProxyFromEnvironment.
+	Proxy string
+}
+
+func (c *Client) dial(ctx context.Context, addr string) (net.Conn, error) {
+	switch {
+	case c.WebSocket != "":
+		return c.dialWebSocket(ctx, c.WebSocket)
+	case c.UnixSocket != "":
+		return c.dialNetwork(ctx, "unix", c.UnixSocket)
+	case c.Proxy != "":
+		proxy, err := parseProxy(c.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		return c.dialThrough(ctx, proxy, addr)
+	}
+	return c.dialNetwork(ctx, "tcp", addr)
+}
+
+func (c *Client) dialNetwork(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.Dial != nil {
+		return c.Dial(ctx, network, addr)
+	}
+	d := net.Dialer{KeepAlive: TCP_KEEPALIVE}
+	return d.DialContext(ctx, network, addr)
+}
+
+// SendFile sends the file at path to the server at addr. Ending ctx aborts
+// the transfer; the returned error then wraps ctx's error.
+func (c *Client) SendFile(ctx context.Context, addr, path string, opts Options) (*Result, error) {
+	rep := opts.reporter(addr)
+	defer rep.Close()
+
+	res, err := c.sendFile(ctx, addr, path, &opts, rep)
+	if err != nil {
+		err = wire.ContextError(ctx, err)
+		rep.Fail(err)
+		return nil, err
+	}
+
+	rep.Complete(res.Bytes)
+	return res, nil
+}
+
+// Send streams size bytes read from r to the server at addr, which stores
+// them as name. SkipIdentical is ignored since a stream can't be hashed up
+// front. Ending ctx aborts the transfer like it does for SendFile.
+func (c *Client) Send(ctx context.Context, addr, name string, r io.Reader, size int64, opts Options) (*Result, error) {
+	rep := opts.reporter(addr)
+	defer rep.Close()
+
+	opts.SkipIdentical = false
+	res, err := c.send(ctx, addr, name, io.LimitReader(r, size), size, nil, nil, &opts, rep)
+	if err != nil {
+		err = wire.ContextError(ctx, err)
+		rep.Fail(err)
+		return nil, err
+	}
+
+	rep.Complete(res.Bytes)
+	return res, nil
+}
+
+func (c *Client) sendFile(ctx context.Context, addr, path string, opts *Options, rep *wire.Reporter) (*Result, error) {
+	// Make sure the file can be read before connecting
+	file, err := wire.OpenSource(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Hash the file up front so the server can tell us to skip it
+	var sum []byte
+	if opts.SkipIdentical {
+		sum, err = hashcache.File(path)
+		if err != nil {
+			return nil, fmt.Errorf("error hashing file: %w", err)
+		}
+	}
+
+	// Leave out the holes of a sparse file, unless a delta leaves out more
+	var extents []sparse.Extent
+	if !opts.Delta && !opts.Legacy {
+		extents, err = sparse.Extents(file.File, file.Size)
+		if err != nil {
+			return nil, fmt.Errorf("error finding holes in file: %w", err)
+		}
+		if !sparse.HasHoles(extents, file.Size) {
+			extents = nil
+		}
+	}
+
+	// Spread a large file over several connections, which need its
+	// checksum up front
+	var res *Result
+	if opts.Streams > 1 && extents == nil && !opts.Delta && !opts.Legacy && file.Size > MIN_STREAM_RANGE {
+		if sum == nil {
+			sum, err = hashcache.File(path)
+			if err != nil {
+				return nil, fmt.Errorf("error hashing file: %w", err)
+			}
+		}
+		res, err = c.sendStreams(ctx, addr, opts.remoteName(path), file.File, file.Size, sum, opts, rep)
+		if errors.Is(err, errNoRanges) {
+			opts.logger().Warn("Server does not support parallel streams, sending over one connection")
+			res, err = nil, nil
+			if !opts.SkipIdentical {
+				sum = nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if res == nil {
+		res, err = c.send(ctx, addr, opts.remoteName(path), file.File, file.Size, sum, extents, opts, rep)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := file.Check(opts.logger()); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// send transfers size bytes from r as filename. sum is the SHA-256 of the
+// content when opts.SkipIdentical is set. With extents, the data extents
+// of a file with holes, only those are sent if the server can take them;
+// r must then be an io.ReadSeeker.
+func (c *Client) send(ctx context.Context, addr, filename string, r io.Reader, fileSize int64, sum []byte, extents []sparse.Extent, opts *Options, rep *wire.Reporter) (*Result, error) {
+	if err := wire.CheckName(filename); err != nil {
+		return nil, err
+	}
+	// Connect to server
+	conn, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to server: %w", err)
+	}
+	defer conn.Close()
+	conn = opts.wrap(conn)
+
+	// Closing the connection unblocks whatever read or write is pending
+	aborted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(aborted)
+		conn.Close()
+	})
+	defer func() {
+		if !stop() {
+			<-aborted
+		}
+	}()
+
+	log := opts.logger()
+	log.Info("Connected to TCP server", "addr", addr)
+
+	// Agree on a protocol version and drop what the server can't do
+	var features uint32
+	if !opts.Legacy {
+		offer := wire.FEATURE_ABORT | checksum.Offer(opts.Hash)
+		if opts.Pause != nil {
+			offer |= wire.FEATURE_PAUSE
+		}
+		common, err := offerHello(conn, offer, opts.AuthToken)
+		if err != nil {
+			return nil, err
+		}
+		features = common.Features
+		log.Debug("Negotiated protocol", "version", common.Version, "features", common.Features)
+
+		if opts.SkipIdentical && common.Features&wire.FEATURE_SKIP_IDENTICAL == 0 {
+			log.Warn("Server does not support skipping identical files")
+			opts.SkipIdentical = false
+			sum = nil
+		}
+		if opts.Delta && common.Features&wire.FEATURE_DELTA == 0 {
+			log.Warn("Server does not support delta transfers, sending the whole file")
+			opts.Delta = false
+		}
+		if extents != nil && common.Features&wire.FEATURE_SPARSE == 0 {
+			log.Info("Server does not support sparse files, sending the holes as zeros")
+			extents = nil
+		}
+		if algo, ok := checksum.Negotiated(common.Features); ok && algo != opts.Hash {
+			log.Info("Server does not support the hash, checking the file with SHA-256", "hash", opts.Hash)
+		}
+	}
+
+	log.Info("Sending file", "name", filename, "size", fileSize)
+	rep.Start(filename, fileSize)
+
+	// Send file header
+	header := &wire.FileHeader{Name: filename, Size: uint64(fileSize), Checksum: sum}
+	if opts.SkipIdentical {
+		header.Flags |= wire.FLAG_SKIP_IDENTICAL
+	}
+	if opts.Delta {
+		header.Flags |= wire.FLAG_DELTA
+	}
+	if extents != nil {
+		header.Flags |= wire.FLAG_SPARSE
+	}
+	if err := writeHeader(conn, header, features); err != nil {
+		return nil, err
+	}
+
+	if opts.SkipIdentical {
+		status, err := readStatus(conn, "skip status")
+		if err != nil {
+			return nil, err
+		}
+
+		if status == STATUS_SKIP {
+			return &Result{Checksum: sum, Skipped: true}, nil
+		}
+	}
+
+	if opts.Pause != nil || features&segmentFeatures != 0 {
+		body := &pauseConn{Conn: conn, ctx: ctx, pause: opts.Pause, segments: features&segmentFeatures != 0, aborts: features&wire.FEATURE_ABORT != 0, log: log, rep: rep}
+
+		// Ending ctx now tells the server before closing the connection;
+		// returning waits until it did
+		if !stop() {
+			return nil, ctx.Err()
+		}
+		stop = context.AfterFunc(ctx, func() {
+			defer close(aborted)
+			body.abort(context.Cause(ctx))
+			body.Close()
+		})
+		conn = body
+	}
+	if opts.Delta {
+		return sendDelta(conn, r, fileSize, features, opts, rep)
+	}
+	digest := newDigest(features, sum)
+	if extents != nil {
+		return sendSparse(conn, r.(io.ReadSeeker), fileSize, extents, digest, features, opts, rep)
+	}
+
+	// Send file data
+	startTime := time.Now()
+	var totalSent int64
+	buffer := make([]byte, opts.bufferSize())
+
+	// Tuning starts with small chunks of a buffer large enough for any
+	var tuner *wire.Tuner
+	if opts.Autotune {
+		tuner = wire.NewTuner(MIN_TUNED_BUFFER, MAX_TUNED_BUFFER)
+		buffer = make([]byte, MAX_TUNED_BUFFER)
+	}
+
+	// A read stuck on the file mustn't outlast ctx's deadline
+	r, stopReading := wire.ReadAhead(ctx, r, len(buffer))
+	defer stopReading()
+
+	// Without the digest yet each chunk is hashed on another goroutine
+	// while it is sent and the next one read; otherwise a file can go
+	// straight from the page cache (sendfile on Linux)
+	var pipe *checksum.Pipe
+	if digest.hasher != nil {
+		pipe = checksum.NewPipe(digest.hasher, len(buffer))
+		defer pipe.Close()
+	}
+
+	for totalSent < fileSize {
+		size := int64(len(buffer))
+		if tuner != nil {
+			size = int64(tuner.Value())
+		}
+		size = min(size, fileSize-totalSent)
+		var n int64
+		var err error
+		if pipe != nil {
+			n, err = sendChunk(conn, r, pipe, size)
+		} else {
+			n, err = io.CopyBuffer(conn, io.LimitReader(r, size), buffer[:size])
+		}
+		totalSent += n
+		if errors.Is(err, wire.ErrSourceStalled) {
+			return nil, fmt.Errorf("error reading file after %d of %d bytes: %w", totalSent, fileSize, err)
+		}
+		if err != nil {
+			return nil, serverError(conn, conn, fmt.Errorf("error sending data: %w", err))
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("file ended after %d of %d bytes", totalSent, fileSize)
+		}
+		rep.Progress(totalSent)
+		if tuner != nil && tuner.Observe(time.Now(), totalSent) {
+			log.Debug("Tuning the buffer", "size", tuner.Value(), "settled", tuner.Done())
+		}
+	}
+	if pipe != nil {
+		pipe.Close()
+	}
+	if err := digest.send(conn); err != nil {
+		return nil, serverError(conn, conn, err)
+	}
+
+	// Wait for the server to confirm the file is stored
+	status, err := awaitStored(conn, conn, "status", rep.Busy)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := readReceipt(conn, features, fileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{Bytes: totalSent, Duration: time.Since(startTime), Checksum: digest.sum(), Hash: digest.algo, Deduped: status == STATUS_DEDUPED, StoredAs: receipt.Path, Token: receipt.Token}
+	if tuner != nil && tuner.Done() {
+		res.Buffer = tuner.Value()
+	}
+	return res, nil
+}
+
+// sendChunk reads the next chunk of the file, at most left bytes, into a
+// buffer of pipe, queues it for the hash and sends it. Unlike a read
+// error, an error sending it may have sent part of it.
+func sendChunk(w io.Writer, r io.Reader, pipe *checksum.Pipe, left int64) (int64, error) {
+	buf := pipe.Next()
+	n, err := r.Read(buf[:min(int64(len(buf)), left)])
+	if n == 0 {
+		if err == io.EOF {
+			err = nil // Reported as the file ending early
+		}
+		return 0, err
+	}
+	pipe.Write(buf[:n])
+	sent, err := w.Write(buf[:n])
+	return int64(sent), err
+}
+
+// readReceipt reads the receipt that follows the server's confirmation of
+// a stored file if features include FEATURE_RECEIPT, returning where the
+// server stored the file and the token it issued, empty without a receipt.
+// A server that stored other than the size bytes of the file fails it with
+// ErrChecksumMismatch.
+func readReceipt(r io.Reader, features uint32, size int64) (wire.Receipt, error) {
+	if features&wire.FEATURE_RECEIPT == 0 {
+		return wire.Receipt{}, nil
+	}
+	receipt, err := wire.ReadReceipt(r, features)
+	if err != nil {
+		return wire.Receipt{}, err
+	}
+	if receipt.Bytes != uint64(size) {
+		return wire.Receipt{}, fmt.Errorf("%w: server stored %d bytes of the %d sent as %s", wire.ErrChecksumMismatch, receipt.Bytes, size, receipt.Path)
+	}
+	return *receipt, nil
+}
+
+// writeHeader sends header as a metadata frame if features include
+// FEATURE_METADATA, in the fixed layout otherwise.
+func writeHeader(conn net.Conn, header *wire.FileHeader, features uint32) error {
+	encode := header.MarshalBinary
+	if features&wire.FEATURE_METADATA != 0 {
+		encode = header.MarshalMetadata
+	}
+	b, err := encode()
+	if err != nil {
+		return fmt.Errorf("error encoding file header: %w", err)
+	}
+	if _, err := conn.Write(b); err != nil {
+		return fmt.Errorf("error sending file header: %w", err)
+	}
+	return nil
+}
+
+// offerHello sends our hello and returns what both sides support. Of the
+// features that change how a file body is sent, those of a body sent in
+// segments, FEATURE_PAUSE and FEATURE_ABORT, and the hashes of its
+// trailer, only those in optional are offered. With a token, FEATURE_AUTH
+// is offered too, and the token sent if the server takes it.
+func offerHello(conn net.Conn, optional uint32, token string) (wire.Hello, error) {
+	offer := hello
+	offer.Features &^= (segmentFeatures | checksum.FEATURES) &^ optional
+	if token != "" {
+		offer.Features |= wire.FEATURE_AUTH
+	}
+	b, _ := offer.MarshalBinary()
+	_, err := conn.Write(b)
+	if err != nil {
+		return wire.Hello{}, fmt.Errorf("error sending hello: %w", err)
+	}
+
+	// The reply starts with the magic, or is an error frame
+	conn.SetReadDeadline(time.Now().Add(HELLO_TIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+	first, err := readStatus(conn, "hello")
+	// An old server either waits for more header or hangs up on the magic
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
+		return wire.Hello{}, fmt.Errorf("%w: no hello from server, it may predate version negotiation (try -legacy)", wire.ErrProtocol)
+	}
+	if err != nil {
+		return wire.Hello{}, err
+	}
+	peer, err := wire.ReadHello(io.MultiReader(bytes.NewReader([]byte{first}), conn))
+	if err != nil {
+		return wire.Hello{}, err
+	}
+	common, err := wire.Negotiate(offer, *peer)
+	if err != nil {
+		return wire.Hello{}, err
+	}
+	if common.Features&wire.FEATURE_AUTH != 0 {
+		if err := wire.WriteAuth(conn, token); err != nil {
+			return wire.Hello{}, err
+		}
+	}
+	return common, nil
+}
@@ -0,0 +1,86 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSendFile(t *testing.T) {
+	s := &Server{}
+	addr := serve(t, s)
+	data := bytes.Repeat([]byte("library API "), 100000)
+
+	var c Client
+	res, err := c.SendFile(context.Background(), addr, writeFile(t, "api.txt", data), quietOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, s.UploadDir, "api.txt", data)
+	sum := sha256.Sum256(data)
+	if res.Bytes != int64(len(data)) || !bytes.Equal(res.Checksum, sum[:]) {
+		t.Errorf("result reports %d bytes with checksum %x, want %d and %x", res.Bytes, res.Checksum, len(data), sum)
+	}
+	if res.StoredAs != "api.txt" {
+		t.Errorf("StoredAs = %q, want api.txt", res.StoredAs)
+	}
+}
+
+func TestSendReader(t *testing.T) {
+	s := &Server{}
+	addr := serve(t, s)
+	data := []byte(strings.Repeat("streamed ", 5000))
+
+	var c Client
+	_, err := c.Send(context.Background(), addr, "stream.txt", bytes.NewReader(data), int64(len(data)), quietOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, s.UploadDir, "stream.txt", data)
+}
+
+func TestSendErrors(t *testing.T) {
+	s := &Server{MaxFileSize: 10}
+	addr := serve(t, s)
+	var c Client
+
+	_, err := c.SendFile(context.Background(), addr, writeFile(t, "big.txt", make([]byte, 11)), quietOptions())
+	var remote *RemoteError
+	if !errors.Is(err, ErrTooLarge) || !errors.As(err, &remote) {
+		t.Errorf("oversized file: got %v, want a *RemoteError wrapping ErrTooLarge", err)
+	}
+
+	// Refused before connecting, so no server is needed
+	_, err = c.Send(context.Background(), "127.0.0.1:1", "../escape", strings.NewReader("x"), 1, quietOptions())
+	if !errors.Is(err, ErrInvalidName) {
+		t.Errorf("invalid name: got %v, want ErrInvalidName", err)
+	}
+}
+
+func TestProgressEvents(t *testing.T) {
+	addr := serve(t, &Server{})
+	var mu sync.Mutex
+	var kinds []EventKind
+	opts := quietOptions()
+	opts.Progress = func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(kinds) == 0 || kinds[len(kinds)-1] != e.Kind {
+			kinds = append(kinds, e.Kind)
+		}
+	}
+
+	var c Client
+	if _, err := c.SendFile(context.Background(), addr, writeFile(t, "events.bin", make([]byte, 1<<20)), opts); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(kinds) < 2 || kinds[0] != EventStarted || kinds[len(kinds)-1] != EventCompleted {
+		t.Errorf("events %v, want Started first and Completed last", kinds)
+	}
+}
@@ -0,0 +1,286 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"socket-file-transfer/internal/codes"
+	"socket-file-transfer/internal/wire"
+)
+
+// errNoCodes refuses short codes on a server without Codes.
+var errNoCodes = fmt.Errorf("%w: short codes are not enabled on this server", wire.ErrRejected)
+
+// stageFile answers REQ_STAGE: it accepts or refuses the file whose size
+// follows the request, then receives its body and SHA-256 into the
+// staging directory and replies with its code. Only failing to read the
+// body ends the session.
+func (s *Server) stageFile(conn net.Conn, name string, log *slog.Logger, rep *wire.Reporter) error {
+	var sizeBuf [8]byte
+	if _, err := io.ReadFull(conn, sizeBuf[:]); err != nil {
+		return fmt.Errorf("error reading file size: %w", err)
+	}
+	if binary.BigEndian.Uint64(sizeBuf[:]) > math.MaxInt64 {
+		return fmt.Errorf("%w: file size %d", wire.ErrProtocol, binary.BigEndian.Uint64(sizeBuf[:]))
+	}
+	size := int64(binary.BigEndian.Uint64(sizeBuf[:]))
+
+	// Staged files are held to the rules of stored ones
+	var file *os.File
+	err := errNoCodes
+	if s.Codes != nil {
+		_, err = s.store.Place(conn.RemoteAddr(), name, size, nil, log)
+	}
+	if err == nil {
+		file, err = s.Codes.Create()
+	}
+	if err != nil {
+		log.Warn("Request failed", "op", wire.REQ_STAGE, "name", name, "err", err)
+	}
+	if err := s.reply(conn, nil, err); err != nil || file == nil {
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+		return err
+	}
+	staged := false
+	defer func() {
+		file.Close()
+		if !staged {
+			os.Remove(file.Name())
+		}
+	}()
+
+	log.Info("Receiving file to stage", "name", name, "size", size)
+	rep.Start(name, size)
+	pooled := getBuffer(s.bufferSize())
+	defer putBuffer(pooled)
+	hasher := sha256.New()
+	n, err := io.CopyBuffer(writerOnly{io.MultiWriter(file, hasher)}, io.LimitReader(conn, size), (*pooled)[:s.bufferSize()])
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	sum := make([]byte, wire.CHECKSUM_LEN)
+	if err == nil {
+		_, err = io.ReadFull(conn, sum)
+	}
+	if err != nil {
+		err = fmt.Errorf("error receiving data: %w", err)
+		rep.Fail(err)
+		return err
+	}
+
+	var code string
+	var p codes.Pending
+	err = file.Close()
+	if err == nil && !bytes.Equal(sum, hasher.Sum(nil)) {
+		err = fmt.Errorf("%w: %s", wire.ErrChecksumMismatch, name)
+	}
+	if err == nil {
+		code, p, err = s.Codes.Add(file.Name(), name, size)
+		staged = err == nil
+	}
+	if err != nil {
+		log.Warn("Request failed", "op", wire.REQ_STAGE, "name", name, "err", err)
+		rep.Fail(err)
+		return s.reply(conn, nil, err)
+	}
+	rep.Complete(n)
+	log.Info("File staged", "name", name, "bytes", n, "expires", p.Expires.Format(time.RFC3339), "uses", p.Uses)
+	reply := binary.BigEndian.AppendUint16(nil, uint16(len(code)))
+	return s.reply(conn, append(reply, code...), nil)
+}
+
+// claimFile answers REQ_CLAIM: it sends the description, body and
+// SHA-256 of the file staged under code, then waits for the client to
+// acknowledge it before using up the code. Failing to send the file or
+// get the acknowledgement ends the session and leaves the code as it was.
+func (s *Server) claimFile(conn net.Conn, code string, log *slog.Logger) error {
+	// The code isn't logged: it may be someone else's
+	err := errNoCodes
+	var p codes.Pending
+	var path string
+	if s.Codes != nil {
+		p, path, err = s.Codes.Claim(code, wire.ClientDir(conn.RemoteAddr()))
+	}
+	if err != nil {
+		log.Warn("Request failed", "op", wire.REQ_CLAIM, "err", err)
+		return s.reply(conn, nil, err)
+	}
+	file, err := os.Open(path)
+	var info os.FileInfo
+	if err == nil {
+		info, err = file.Stat()
+	}
+	if err != nil {
+		s.Codes.Release(code)
+		if file != nil {
+			file.Close()
+		}
+		err = notFound(p.Name, err)
+		log.Warn("Request failed", "op", wire.REQ_CLAIM, "name", p.Name, "err", err)
+		return s.reply(conn, nil, err)
+	}
+	defer file.Close()
+
+	fi := wire.FileInfo{Name: p.Name, Size: p.Size, ModTime: info.ModTime()}
+	b, err := fi.AppendBinary([]byte{STATUS_OK})
+	if err == nil {
+		_, err = conn.Write(b)
+	}
+	if err == nil {
+		err = s.sendBody(conn, file, p.Size)
+	}
+	if err == nil {
+		_, err = readStatus(conn, "acknowledgement")
+	}
+	if err != nil {
+		s.Codes.Release(code)
+		return err
+	}
+	s.Codes.Done(code)
+	log.Info("Staged file claimed", "name", p.Name, "bytes", p.Size, "uses_left", p.Uses)
+	return nil
+}
+
+// Stage uploads the file at path, named name or the file's base name if
+// empty, for a receiver to Claim, and returns the short code the server
+// staged it under. Servers refuse it with ErrRejected unless they stage
+// files.
+func (s *Session) Stage(ctx context.Context, path, name string) (string, *Result, error) {
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	if err := wire.CheckName(name); err != nil {
+		return "", nil, err
+	}
+	file, err := wire.OpenSource(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	size := file.Size
+
+	rep := s.opts.reporter(s.addr)
+	defer rep.Close()
+	var code string
+	var res *Result
+	// A refused file or a failed check leaves the stream in step
+	err = s.do(ctx, true, func() error {
+		if s.features&wire.FEATURE_CODES == 0 {
+			return fmt.Errorf("%w: server does not support short codes", wire.ErrProtocol)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("error reading file: %w", err)
+		}
+		b, err := (&wire.Request{Op: wire.REQ_STAGE, Name: name}).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		b = binary.BigEndian.AppendUint64(b, uint64(size))
+		if _, err := s.conn.Write(b); err != nil {
+			return fmt.Errorf("error sending request: %w", err)
+		}
+		if _, err := readStatus(s.conn, "reply"); err != nil {
+			return err
+		}
+
+		rep.Start(name, size)
+		start := time.Now()
+		hasher := sha256.New()
+		src, stopReading := wire.ReadAhead(ctx, file, s.opts.bufferSize())
+		defer stopReading()
+		n, err := s.copy(s.conn, io.TeeReader(src, hasher), size, rep)
+		if err != nil {
+			return serverError(s.conn, s.conn, err)
+		}
+		if _, err := s.conn.Write(hasher.Sum(nil)); err != nil {
+			return fmt.Errorf("error sending checksum: %w", err)
+		}
+		if _, err := readStatus(s.conn, "status"); err != nil {
+			return err
+		}
+		var n16 [2]byte
+		if _, err := io.ReadFull(s.conn, n16[:]); err != nil {
+			return fmt.Errorf("error reading code: %w", err)
+		}
+		b = make([]byte, binary.BigEndian.Uint16(n16[:]))
+		if _, err := io.ReadFull(s.conn, b); err != nil {
+			return fmt.Errorf("error reading code: %w", err)
+		}
+		code = string(b)
+		res = &Result{Bytes: n, Duration: time.Since(start), Checksum: hasher.Sum(nil)}
+		return nil
+	})
+	if err != nil {
+		rep.Fail(err)
+		return "", nil, err
+	}
+	if err := file.Check(s.opts.logger()); err != nil {
+		rep.Fail(err)
+		return "", nil, err
+	}
+	rep.Complete(res.Bytes)
+	return code, res, nil
+}
+
+// Claim downloads the file staged under code to the path dest returns for
+// the name it was staged as, checking it against the SHA-256 the server
+// sends, and returns that path. The server uses up the code once told the
+// file arrived; until then a failed claim leaves it as it was. A wrong
+// code fails with ErrNotFound.
+func (s *Session) Claim(ctx context.Context, code string, dest func(name string) (string, error)) (string, *Result, error) {
+	code = codes.Normalize(code)
+	if code == "" {
+		return "", nil, errors.New("empty code")
+	}
+	rep := s.opts.reporter(s.addr)
+	defer rep.Close()
+
+	var path string
+	var res *Result
+	err := s.do(ctx, true, func() error {
+		if s.features&wire.FEATURE_CODES == 0 {
+			return fmt.Errorf("%w: server does not support short codes", wire.ErrProtocol)
+		}
+		if err := s.request(wire.REQ_CLAIM, code); err != nil {
+			return err
+		}
+		info, err := wire.ReadFileInfo(s.conn)
+		if err != nil {
+			return err
+		}
+		// The name comes from the sender
+		if err := wire.CheckName(info.Name); err != nil {
+			return fmt.Errorf("%w: %w", wire.ErrProtocol, err)
+		}
+		if path, err = dest(info.Name); err != nil {
+			return err
+		}
+		if res, err = s.receive(info.Name, info.Size, path, rep); err != nil {
+			return err
+		}
+		if _, err := s.conn.Write([]byte{STATUS_OK}); err != nil {
+			return fmt.Errorf("error acknowledging file: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		rep.Fail(err)
+		return "", nil, err
+	}
+	rep.Complete(res.Bytes)
+	return path, res, nil
+}
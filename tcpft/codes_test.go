@@ -0,0 +1,115 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/codes"
+)
+
+// codesServer serves s staging files under short codes, allowing uses
+// fetches each, and returns its address.
+func codesServer(t *testing.T, s *Server, uses int) string {
+	t.Helper()
+	s.UploadDir = t.TempDir()
+	cs, err := codes.Open(s.UploadDir, time.Hour, uses, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Codes = cs
+	return serve(t, s)
+}
+
+// A file staged by one session is fetched once by another, under the name
+// it was sent as, then removed from the server.
+func TestStageClaim(t *testing.T) {
+	s := &Server{}
+	addr := codesServer(t, s, 1)
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("staged "), 10000)
+
+	code, res, err := openSession(t, addr).Stage(ctx, writeFile(t, "local.bin", data), "shared.bin")
+	if err != nil {
+		t.Fatalf("Stage: %v", err)
+	}
+	if res.Bytes != int64(len(data)) || code == "" {
+		t.Errorf("staged %d bytes as %q", res.Bytes, code)
+	}
+
+	dir := t.TempDir()
+	var named string
+	dest := func(name string) (string, error) {
+		named = name
+		return filepath.Join(dir, name), nil
+	}
+	path, _, err := openSession(t, addr).Claim(ctx, code, dest)
+	if err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+	if got, _ := os.ReadFile(path); named != "shared.bin" || !bytes.Equal(got, data) {
+		t.Errorf("claimed %q with %d bytes, want shared.bin with %d", named, len(got), len(data))
+	}
+
+	if _, _, err := openSession(t, addr).Claim(ctx, code, dest); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second claim: got %v, want ErrNotFound", err)
+	}
+	// Only the index is left
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		names, _ := readDirNames(s.Codes.Dir)
+		if len(names) == 1 && names[0] == codes.INDEX {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("staged directory holds %q after the last fetch", names)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A claim whose destination is refused leaves the code for a retry.
+func TestClaimRetry(t *testing.T) {
+	addr := codesServer(t, &Server{}, 1)
+	ctx := context.Background()
+	code, _, err := openSession(t, addr).Stage(ctx, writeFile(t, "r.txt", []byte("retry")), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := openSession(t, addr)
+	refused := errors.New("exists")
+	if _, _, err := sess.Claim(ctx, code, func(string) (string, error) { return "", refused }); !errors.Is(err, refused) {
+		t.Fatalf("got %v, want the destination's error", err)
+	}
+	path, _, err := sess.Claim(ctx, code, func(name string) (string, error) { return filepath.Join(t.TempDir(), name), nil })
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "retry" {
+		t.Errorf("retry got %q", got)
+	}
+}
+
+// Staged files are held to the server's upload rules.
+func TestStageTooLarge(t *testing.T) {
+	addr := codesServer(t, &Server{MaxFileSize: 4}, 1)
+	if _, _, err := openSession(t, addr).Stage(context.Background(), writeFile(t, "big", []byte("too large")), ""); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+}
+
+// A server without Codes has no codes to stage or claim under.
+func TestStageNoCodes(t *testing.T) {
+	addr := serve(t, &Server{})
+	sess := openSession(t, addr)
+	if _, _, err := sess.Stage(context.Background(), writeFile(t, "f", []byte("f")), ""); err == nil {
+		t.Error("Stage succeeded")
+	}
+	if _, _, err := sess.Claim(context.Background(), "1-frog-apple", func(name string) (string, error) { return name, nil }); err == nil {
+		t.Error("Claim succeeded")
+	}
+}
@@ -0,0 +1,97 @@
+package tcpft
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/wire"
+)
+
+// A consumer that waits for the marker finds the file whole, its
+// background hook done and its checksum recorded, in the completed
+// directory if there is one.
+func TestCompletionMarker(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands run through /bin/sh here")
+	}
+	for _, moved := range []bool{false, true} {
+		t.Run(map[bool]string{false: "in place", true: "completed dir"}[moved], func(t *testing.T) {
+			hooked := filepath.Join(t.TempDir(), "hooked")
+			s := &Server{Options: quietOptions(), Marker: true}
+			s.HookCommand = `sleep 0.3; touch ` + hooked
+			if moved {
+				s.CompletedDir = t.TempDir()
+			}
+			addr := serve(t, s)
+			dir := s.UploadDir
+			if moved {
+				dir = s.CompletedDir
+			}
+
+			data := []byte(strings.Repeat("complete ", 50000))
+			if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "data.txt", data), quietOptions()); err != nil {
+				t.Fatal(err)
+			}
+			marker := wire.MarkerPath(filepath.Join(dir, "data.txt"))
+			var raw []byte
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+				var err error
+				if raw, err = os.ReadFile(marker); err == nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("no marker: %v", err)
+				}
+			}
+
+			if _, err := os.Stat(hooked); err != nil {
+				t.Errorf("marker written before the hook finished: %v", err)
+			}
+			if _, err := os.Stat(hashcache.SidecarPath(filepath.Join(dir, "data.txt"))); err != nil {
+				t.Errorf("marker written before the checksum was recorded: %v", err)
+			}
+			checkStored(t, dir, "data.txt", data)
+			if _, err := os.Stat(filepath.Join(s.UploadDir, "data.txt")); moved != errors.Is(err, os.ErrNotExist) {
+				t.Errorf("moved %v, but the upload directory's copy: %v", moved, err)
+			}
+			var c store.Completion
+			if err := json.Unmarshal(raw, &c); err != nil {
+				t.Fatalf("marker %q: %v", raw, err)
+			}
+			sum := sha256.Sum256(data)
+			if c.Name != "data.txt" || c.Path != filepath.Join(dir, "data.txt") || c.Size != int64(len(data)) || c.Hash != "sha256:"+hex.EncodeToString(sum[:]) {
+				t.Errorf("marker records %+v", c)
+			}
+			names, _ := readDirNames(s.UploadDir)
+			for _, name := range names {
+				if !strings.HasPrefix(name, ".") && name != "data.txt" {
+					t.Errorf("upload directory also holds %s", name)
+				}
+			}
+		})
+	}
+}
+
+// With markers on, a client can't upload a file that would pass for one.
+func TestMarkerNameRefused(t *testing.T) {
+	s := &Server{Options: quietOptions(), Marker: true}
+	addr := serve(t, s)
+	_, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "src", []byte("{}")), withName(".data.txt.done"))
+	if !errors.Is(err, wire.ErrRejected) {
+		t.Errorf("got %v, want ErrRejected", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.UploadDir, ".data.txt.done")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("marker-named upload stored: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package tcpft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"socket-file-transfer/internal/buffers"
+	"socket-file-transfer/internal/wire"
+)
+
+// timeoutConn applies a fresh deadline before every read and write, so
+// Options.Timeout bounds how long a single operation may stall.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Read(p)
+	return n, timeoutError(err)
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Write(p)
+	return n, timeoutError(err)
+}
+
+// timeoutError marks an expired deadline with wire.ErrTimeout.
+func timeoutError(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return fmt.Errorf("%w: %w", wire.ErrTimeout, err)
+	}
+	return err
+}
+
+// writerOnly hides a connection's ReadFrom, so io.CopyBuffer fills the
+// buffer it is given instead of falling back to a small internal one.
+type writerOnly struct {
+	io.Writer
+}
+
+func (o *Options) wrap(conn net.Conn) net.Conn {
+	if o.Timeout <= 0 {
+		return conn
+	}
+	return &timeoutConn{Conn: conn, timeout: o.Timeout}
+}
+
+// readStatus reads a one-byte server reply. An error frame sent in its
+// place is returned as a *wire.RemoteError.
+func readStatus(r io.Reader, what string) (byte, error) {
+	var status [1]byte
+	if _, err := io.ReadFull(r, status[:]); err != nil {
+		return 0, fmt.Errorf("error reading %s: %w", what, err)
+	}
+	if status[0] != STATUS_ERROR {
+		return status[0], nil
+	}
+
+	rerr, err := wire.ReadRemoteError(r)
+	if err != nil {
+		return 0, err
+	}
+	return 0, rerr
+}
+
+// serverError returns the reason the server sent for failing the transfer
+// if conn broke because of it, err otherwise.
+func serverError(conn net.Conn, r io.Reader, err error) error {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var rerr *wire.RemoteError
+	if _, serr := readStatus(r, "server reply"); errors.As(serr, &rerr) {
+		return rerr
+	}
+	return err
+}
+
+// sendError tells the client why its transfer failed, then reads whatever
+// it still sends for up to ERROR_LINGER, so that data doesn't reset the
+// connection before the client has read the error frame.
+func sendError(conn net.Conn, err error) {
+	frame, _ := wire.NewRemoteError(err).MarshalBinary()
+	conn.SetDeadline(time.Now().Add(ERROR_LINGER))
+	if _, err := conn.Write(append([]byte{STATUS_ERROR}, frame...)); err != nil {
+		return
+	}
+	if tc, ok := conn.(interface{ CloseWrite() error }); ok {
+		tc.CloseWrite()
+	}
+	io.Copy(io.Discard, conn)
+}
+
+// getBuffer returns a buffer of size bytes, reused across connections.
+func getBuffer(size int) *[]byte {
+	return buffers.Get(size)
+}
+
+func putBuffer(b *[]byte) {
+	buffers.Put(b)
+}
@@ -0,0 +1,37 @@
+package tcpft
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The same content uploaded under three names is stored once, the client
+// told of each duplicate.
+func TestDedupe(t *testing.T) {
+	s := &Server{Options: quietOptions(), Dedupe: true}
+	addr := serve(t, s)
+	data := []byte("the same artifact")
+
+	var first os.FileInfo
+	for i, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		res, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, name, data), quietOptions())
+		if err != nil {
+			t.Fatalf("SendFile %s: %v", name, err)
+		}
+		if res.Deduped != (i > 0) {
+			t.Errorf("%s: deduplicated %v, want %v", name, res.Deduped, i > 0)
+		}
+		checkStored(t, s.UploadDir, name, data)
+		info, err := os.Stat(filepath.Join(s.UploadDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = info
+		} else if !os.SameFile(first, info) {
+			t.Errorf("%s stored as a copy of its own", name)
+		}
+	}
+}
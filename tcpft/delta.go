@@ -0,0 +1,166 @@
+package tcpft
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"socket-file-transfer/internal/delta"
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/wire"
+)
+
+// receiveDelta rebuilds in.Path from the copy already stored there and a
+// delta stream from the client. The result is only committed, replacing
+// the copy, if its checksum matches the client's.
+func (s *Server) receiveDelta(conn net.Conn, in *store.Incoming, features uint32, log *slog.Logger, rep *wire.Reporter) error {
+	outputPath, fileSize := in.Path, in.Size
+
+	// Sign the copy we hold. Without one, as with remote storage, the
+	// signature is empty and the client falls back to sending the whole
+	// file as literals.
+	blockSize := delta.BlockSizeFor(fileSize)
+	sig := &delta.Signature{BlockSize: blockSize}
+	var base *os.File
+	if s.store.Local() {
+		file, err := os.Open(outputPath)
+		if err == nil {
+			defer file.Close()
+			base = file
+			sig, err = delta.Sign(bufio.NewReader(base), blockSize)
+			if err != nil {
+				return fmt.Errorf("error signing existing file: %w", err)
+			}
+		}
+	}
+
+	log.Info("Sending signature", "blocks", len(sig.Blocks), "block_size", blockSize)
+	_, err := sig.WriteTo(conn)
+	if err != nil {
+		return fmt.Errorf("error sending signature: %w", err)
+	}
+
+	if err := in.Create(); err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Apply operations until the client sends its checksum
+	startTime := time.Now()
+	output := bufio.NewWriterSize(in, s.bufferSize())
+	patcher := delta.NewPatcher(base, sig, output)
+	reader := bufio.NewReader(conn)
+	buffer := make([]byte, delta.MaxLiteral)
+	var sum []byte
+
+	for sum == nil {
+		op, err := delta.ReadOp(reader, buffer)
+		if err != nil {
+			return fmt.Errorf("error reading delta: %w", err)
+		}
+
+		if op.Kind == delta.OpEnd {
+			sum = op.Data
+			continue
+		}
+
+		err = patcher.Apply(op)
+		if err != nil {
+			return fmt.Errorf("error applying delta: %w", err)
+		}
+		if patcher.Copied+patcher.Literal > fileSize {
+			return fmt.Errorf("%w: delta rebuilds more than the announced %d bytes", wire.ErrProtocol, fileSize)
+		}
+		rep.Progress(patcher.Copied + patcher.Literal)
+	}
+
+	if err := output.Flush(); err != nil {
+		return err
+	}
+	if patcher.Copied+patcher.Literal != fileSize || !bytes.Equal(sum, in.Sum()) {
+		log.Warn("Checksum mismatch, keeping existing file", "path", outputPath)
+		return fmt.Errorf("%w: rebuilt file differs from the client's", wire.ErrChecksumMismatch)
+	}
+
+	base.Close()
+	beat := startHeartbeat(conn, features, in.Status)
+	upload, err := in.Commit()
+	beat.stop()
+	if err != nil {
+		return err
+	}
+
+	err = confirmStored(conn, in, upload.Size, features)
+	if err != nil {
+		return fmt.Errorf("error sending delta status: %w", err)
+	}
+
+	log.Info("Delta applied", "path", upload.Path, "reused", patcher.Copied, "received", patcher.Literal, "duration", time.Since(startTime))
+	rep.Complete(patcher.Literal)
+	return nil
+}
+
+// sendDelta matches the local file against the signature of the server's
+// copy and sends only the literal ranges plus block copy instructions.
+func sendDelta(conn net.Conn, file io.Reader, fileSize int64, features uint32, opts *Options, rep *wire.Reporter) (*Result, error) {
+	reader := bufio.NewReader(conn)
+	if b, err := reader.Peek(1); err == nil && b[0] == STATUS_ERROR {
+		_, err = readStatus(reader, "signature")
+		return nil, err
+	}
+	sig, err := delta.ReadSignature(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signature: %w", err)
+	}
+
+	log := opts.logger()
+	if len(sig.Blocks) == 0 {
+		log.Info("Server has no copy of the file, sending it in full")
+	}
+
+	startTime := time.Now()
+	var copied, literal, done int64
+	var sum []byte
+	output := bufio.NewWriterSize(conn, opts.bufferSize())
+
+	err = delta.Diff(sig, bufio.NewReader(file), func(op delta.Op) error {
+		switch op.Kind {
+		case delta.OpCopy:
+			copied++
+			done += int64(sig.BlockSize)
+		case delta.OpLiteral:
+			literal += int64(len(op.Data))
+			done += int64(len(op.Data))
+		case delta.OpEnd:
+			sum = op.Data
+		}
+		if op.Kind != delta.OpEnd {
+			rep.Progress(min(done, fileSize))
+		}
+		return delta.WriteOp(output, op)
+	})
+	if err == nil {
+		err = output.Flush()
+	}
+	if err != nil {
+		return nil, serverError(conn, reader, fmt.Errorf("error sending delta: %w", err))
+	}
+
+	status, err := awaitStored(conn, reader, "delta status", rep.Busy)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := readReceipt(reader, features, fileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	duration := time.Since(startTime)
+	log.Info("Delta sent", "blocks_reused", copied, "literal_bytes", literal)
+	return &Result{Bytes: literal, Duration: duration, Checksum: sum, Deduped: status == STATUS_DEDUPED, StoredAs: receipt.Path, Token: receipt.Token}, nil
+}
@@ -0,0 +1,63 @@
+package tcpft
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeltaTransfer(t *testing.T) {
+	base := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(base)
+	other := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(other)
+	edit := []byte("a few bytes that changed")
+
+	tests := []struct {
+		name      string
+		next      []byte
+		maxOnWire int64 // Most bytes the delta may send as literals
+	}{
+		{"prepend", append(append([]byte{}, edit...), base...), 64 << 10},
+		{"append", append(append([]byte{}, base...), edit...), 64 << 10},
+		{"middle", append(append(append([]byte{}, base[:1<<20]...), edit...), base[1<<20+len(edit):]...), 64 << 10},
+		{"completely different", other, int64(len(other))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			addr := serve(t, s)
+			if err := os.WriteFile(filepath.Join(s.UploadDir, "f.bin"), base, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := quietOptions()
+			opts.Delta, opts.Name = true, "f.bin"
+			var c Client
+			res, err := c.SendFile(context.Background(), addr, writeFile(t, "next.bin", tt.next), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkStored(t, s.UploadDir, "f.bin", tt.next)
+			if res.Bytes > tt.maxOnWire {
+				t.Errorf("sent %d bytes of %d, want at most %d", res.Bytes, len(tt.next), tt.maxOnWire)
+			}
+		})
+	}
+}
+
+// A server without a copy gets the whole file.
+func TestDeltaWithoutBase(t *testing.T) {
+	s := &Server{}
+	addr := serve(t, s)
+	data := []byte("no copy on the server yet")
+	opts := quietOptions()
+	opts.Delta = true
+	var c Client
+	if _, err := c.SendFile(context.Background(), addr, writeFile(t, "new.txt", data), opts); err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, s.UploadDir, "new.txt", data)
+}
@@ -0,0 +1,75 @@
+package tcpft
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"socket-file-transfer/internal/checksum"
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/wire"
+)
+
+// digest hashes a file body as a client sends it, for the trailer that
+// follows the body if the peers negotiated a hash, see checksum.Negotiated,
+// and the Result.
+type digest struct {
+	algo    checksum.Algorithm
+	trailer bool      // The body ends with the digest
+	known   []byte    // SHA-256 the client hashed up front, if any
+	hasher  hash.Hash // Of algo, nil if the digest is known
+}
+
+// newDigest returns the digest of a body sent with features. The body
+// is only hashed on the way when sum, its SHA-256 if hashed up front,
+// isn't its digest.
+func newDigest(features uint32, sum []byte) *digest {
+	algo, trailer := checksum.Negotiated(features)
+	d := &digest{algo: algo, trailer: trailer, known: sum}
+	if sum == nil || algo != checksum.SHA256 {
+		d.hasher = algo.New()
+	}
+	return d
+}
+
+// sum returns the digest of the body sent.
+func (d *digest) sum() []byte {
+	if d.hasher == nil {
+		return d.known
+	}
+	return d.hasher.Sum(nil)
+}
+
+// send sends the trailer once the body is sent, if the peers agreed on one.
+func (d *digest) send(w io.Writer) error {
+	if !d.trailer {
+		return nil
+	}
+	if _, err := w.Write(d.sum()); err != nil {
+		return fmt.Errorf("error sending checksum: %w", err)
+	}
+	return nil
+}
+
+// checkDigest reads the trailer of a body received with features, if the
+// peers agreed on one, and compares it with what in holds, quarantining
+// the file if they differ.
+func checkDigest(r io.Reader, in *store.Incoming, features uint32) error {
+	if _, ok := checksum.Negotiated(features); !ok {
+		return nil
+	}
+	want := make([]byte, in.Hash.Size())
+	if _, err := io.ReadFull(r, want); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			in.Quarantine("truncated")
+			return fmt.Errorf("%w: connection closed before the checksum", wire.ErrProtocol)
+		}
+		return fmt.Errorf("error reading checksum: %w", err)
+	}
+	if got := in.Digest(); string(got) != string(want) {
+		in.Quarantine("mismatch")
+		return fmt.Errorf("%w: %s of the received file is %x, the client sent %x", wire.ErrChecksumMismatch, in.Hash, got, want)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+// Files the server's filters refuse fail with ErrRejected and leave
+// nothing stored.
+func TestFilters(t *testing.T) {
+	exe := append([]byte("MZ\x90\x00"), bytes.Repeat([]byte{0xff}, 64<<10)...)
+	zip := append([]byte("PK\x03\x04"), make([]byte, 64<<10)...)
+	tests := []struct {
+		name string
+		file string
+		data []byte
+		ok   bool
+	}{
+		{"accepted", "ok.zip", zip, true},
+		{"wrong extension", "setup.exe", exe, false},
+		{"rejected extension", "backup.old.zip", zip, false},
+		{"renamed exe", "setup.zip", exe, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{AcceptExt: []string{".zip"}, RejectExt: []string{".old.zip"}, SniffTypes: []string{"application/zip"}}
+			addr := serve(t, s)
+			var c Client
+			_, err := c.SendFile(context.Background(), addr, writeFile(t, tt.file, tt.data), quietOptions())
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkStored(t, s.UploadDir, tt.file, tt.data)
+				return
+			}
+			if !errors.Is(err, ErrRejected) {
+				t.Fatalf("got %v, want ErrRejected", err)
+			}
+			if !dirEmpty(t, s.UploadDir) {
+				names, _ := os.ReadDir(s.UploadDir)
+				t.Errorf("refused upload left %v", names)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package tcpft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// heartbeat sends a client waiting for its file to be stored a STATUS_BUSY
+// frame every wire.HEARTBEAT_INTERVAL, telling it what the server is doing,
+// so a slow hook or upload to remote storage isn't mistaken for a dead
+// server. A nil heartbeat, for clients that didn't negotiate
+// FEATURE_HEARTBEAT, does nothing.
+type heartbeat struct {
+	conn  net.Conn
+	stopc chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// startHeartbeat starts sending status() on conn if features include
+// FEATURE_HEARTBEAT. Nothing else may write to conn until stop.
+func startHeartbeat(conn net.Conn, features uint32, status func() string) *heartbeat {
+	if features&wire.FEATURE_HEARTBEAT == 0 {
+		return nil
+	}
+	conn = beneathWatchdogs(conn)
+	h := &heartbeat{conn: conn, stopc: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(wire.HEARTBEAT_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.stopc:
+				return
+			case <-ticker.C:
+			}
+			msg := wire.BusyStatus(status())
+			frame := append([]byte{STATUS_BUSY, byte(len(msg))}, msg...)
+			// A client that is gone, or stopped reading, fails the reply
+			// once the work is done
+			conn.SetWriteDeadline(time.Now().Add(wire.HEARTBEAT_INTERVAL * wire.HEARTBEAT_MISSES))
+			if _, err := conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+	return h
+}
+
+// stop stops the heartbeats, returning once none is being sent. It may
+// be called more than once.
+func (h *heartbeat) stop() {
+	if h == nil {
+		return
+	}
+	h.once.Do(func() { close(h.stopc) })
+	<-h.done
+	h.conn.SetWriteDeadline(time.Time{})
+}
+
+// awaitStored reads the server's reply once the file is sent, STATUS_OK or
+// STATUS_DEDUPED, passing the status of each heartbeat the server sends
+// while storing it to busy when it changes. After the first one, a server
+// that misses wire.HEARTBEAT_MISSES of them in a row is given up on with
+// ErrTimeout.
+func awaitStored(conn net.Conn, r io.Reader, what string, busy func(status string)) (byte, error) {
+	var last string
+	for {
+		status, err := readStatus(r, what)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, fmt.Errorf("%w: the server stopped reporting while storing the file", wire.ErrTimeout)
+		}
+		if err != nil || status != STATUS_BUSY {
+			return status, err
+		}
+
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return 0, fmt.Errorf("error reading heartbeat: %w", err)
+		}
+		msg := make([]byte, n[0])
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return 0, fmt.Errorf("error reading heartbeat: %w", err)
+		}
+		if string(msg) != last && len(msg) > 0 {
+			last = string(msg)
+			busy(last)
+		}
+		conn.SetReadDeadline(time.Now().Add(wire.HEARTBEAT_INTERVAL * wire.HEARTBEAT_MISSES))
+	}
+}
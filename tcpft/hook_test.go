@@ -0,0 +1,35 @@
+package tcpft
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// The hook runs once the file is complete under its final name.
+func TestHookSeesStoredFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands run through /bin/sh here")
+	}
+	out := filepath.Join(t.TempDir(), "copy")
+	s := &Server{}
+	s.HookCommand = `cp "$TRANSFER_PATH" ` + out
+	s.HookStrict = true
+	addr := serve(t, s)
+
+	data := []byte(strings.Repeat("hooked ", 50000))
+	var c Client
+	if _, err := c.SendFile(context.Background(), addr, writeFile(t, "hooked.txt", data), quietOptions()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("hook saw %d bytes, want %d", len(got), len(data))
+	}
+}
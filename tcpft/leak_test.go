@@ -0,0 +1,174 @@
+package tcpft
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+// openFiles returns the number of file descriptors the process has open,
+// or -1 where /proc/self/fd doesn't list them.
+func openFiles() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+// settle waits until the goroutines and open files of the process are
+// back to at most the baseline given, failing the test if they aren't
+// within a few seconds.
+func settle(t *testing.T, goroutines, files int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		g, f := runtime.NumGoroutine(), openFiles()
+		if g <= goroutines && (files < 0 || f <= files) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines and %d open files, want the baseline of %d and %d", g, f, goroutines, files)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Hundreds of transfers that succeed, are cancelled, send garbage or
+// nothing at all leave no goroutine, file descriptor or partial file of
+// the server's behind once they end.
+func TestNoLeaks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("hundreds of transfers")
+	}
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	saved := handshakeTimeout
+	handshakeTimeout = 500 * time.Millisecond
+	defer func() { handshakeTimeout = saved }()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{Options: quietOptions()}
+	s.UploadDir = t.TempDir()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		s.Serve(ctx, ln)
+	}()
+	defer func() {
+		cancel()
+		<-served
+	}()
+
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+	path := writeFile(t, "f.bin", data)
+	// One upload first, so what the server sets up once is in the baseline
+	if _, err := (&Client{}).SendFile(context.Background(), addr, path, quietOptions()); err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	goroutines, files := runtime.NumGoroutine(), openFiles()
+
+	// run calls f n times, 20 at a time
+	run := func(n int, f func(i int)) {
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, 20)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(i int) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				f(i)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	t.Run("completed", func(t *testing.T) {
+		run(300, func(i int) {
+			if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, fmt.Sprint(i, ".bin"), data), quietOptions()); err != nil {
+				t.Errorf("SendFile: %v", err)
+			}
+		})
+	})
+
+	t.Run("cut off", func(t *testing.T) {
+		c := &Client{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &cutConn{Conn: conn, limit: 16 << 10}, nil
+		}}
+		run(120, func(i int) {
+			if _, err := c.SendFile(context.Background(), addr, writeFile(t, fmt.Sprint("cut", i, ".bin"), data), quietOptions()); err == nil {
+				t.Error("upload cut off half way succeeded")
+			}
+		})
+	})
+
+	t.Run("garbage", func(t *testing.T) {
+		run(300, func(i int) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			switch i % 3 {
+			case 0:
+				return // Hangs up at once
+			case 1:
+				conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+			case 2:
+				conn.Write([]byte{0, 0}) // Half a hello
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			io.Copy(io.Discard, conn)
+		})
+	})
+
+	t.Run("silent", func(t *testing.T) {
+		run(20, func(int) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			// The server hangs up on its own, with the timeout as the error
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.Copy(io.Discard, conn); errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Error("server still holds a silent connection")
+			}
+		})
+	})
+
+	settle(t, goroutines, files)
+	names, err := readDirNames(s.UploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, ".part") || strings.HasPrefix(name, "cut") {
+			t.Errorf("%s left in the upload directory", name)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package tcpft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"socket-file-transfer/internal/ports"
+)
+
+// listenAll listens on every address in addrs, returning one listener
+// that accepts from all of them. An address whose port is in use moves to
+// one of the retries ports above it, see ports.Listen. If an address
+// can't be bound, those already are closed and the error is returned;
+// with bestEffort it is only logged, and listenAll fails only if no
+// address could be bound.
+func listenAll(addrs []string, retries int, bestEffort bool, log *slog.Logger) (net.Listener, error) {
+	var listeners []net.Listener
+	var errs []error
+	lc := net.ListenConfig{KeepAlive: TCP_KEEPALIVE}
+	listen := func(addr string) (net.Listener, error) {
+		return lc.Listen(context.Background(), "tcp", addr)
+	}
+	for _, addr := range addrs {
+		listener, err := ports.Listen(addr, retries, listen)
+		if err != nil {
+			if !bestEffort {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return nil, err
+			}
+			log.Warn("Can't listen, skipping address", "addr", addr, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return joinListeners(listeners), nil
+}
+
+// joinListeners returns a listener accepting the connections of all of
+// listeners, which must not be empty.
+func joinListeners(listeners []net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+	m := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.accept(l)
+	}
+	return m
+}
+
+// multiListener accepts the connections of several listeners, which
+// close together.
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	once      sync.Once
+	closeErr  error
+}
+
+// accept passes the connections and errors of l on to Accept until the
+// listeners are closed.
+func (m *multiListener) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			select {
+			case m.errs <- fmt.Errorf("%s: %w", l.Addr(), err):
+				continue
+			case <-m.done:
+				return
+			}
+		}
+		select {
+		case m.conns <- conn:
+		case <-m.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+		var errs []error
+		for _, l := range m.listeners {
+			errs = append(errs, l.Close())
+		}
+		m.closeErr = errors.Join(errs...)
+	})
+	return m.closeErr
+}
+
+func (m *multiListener) Addr() net.Addr {
+	addrs := make(multiAddr, len(m.listeners))
+	for i, l := range m.listeners {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
+
+// multiAddr is the addresses of a multiListener.
+type multiAddr []net.Addr
+
+func (multiAddr) Network() string { return "tcp" }
+
+func (a multiAddr) String() string {
+	s := make([]string, len(a))
+	for i, addr := range a {
+		s[i] = addr.String()
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,150 @@
+package tcpft
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freePort returns a loopback address nothing listens on.
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// listenAndServe runs s.ListenAndServe until the test ends, returning the
+// addresses it listens on, or the error it returned at once.
+func listenAndServe(t *testing.T, s *Server) ([]string, error) {
+	t.Helper()
+	s.UploadDir = t.TempDir()
+	s.Logger = quiet
+	s.Progress = func(Event) {}
+	listening := make(chan net.Addr, 1)
+	s.Listening = func(addr net.Addr) { listening <- addr }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	select {
+	case addr := <-listening:
+		return strings.Split(addr.String(), ","), nil
+	case err := <-done:
+		done <- err
+		return nil, err
+	case <-time.After(5 * time.Second):
+		t.Fatal("server neither listening nor failed")
+		return nil, nil
+	}
+}
+
+// A server with several addresses takes uploads on each and closes them
+// all together.
+func TestListenAddrs(t *testing.T) {
+	var addrs []string
+	t.Run("serve", func(t *testing.T) {
+		s := &Server{Addrs: []string{"127.0.0.1:0", "127.0.0.2:0"}}
+		var err error
+		if addrs, err = listenAndServe(t, s); err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 2 {
+			t.Fatalf("listening on %v, want two addresses", addrs)
+		}
+		for i, addr := range addrs {
+			name := []string{"a", "b"}[i]
+			data := []byte("via " + addr)
+			if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, name, data), quietOptions()); err != nil {
+				t.Fatalf("SendFile to %s: %v", addr, err)
+			}
+			checkStored(t, s.UploadDir, name, data)
+		}
+	})
+
+	// The server stopped with the subtest
+	for _, addr := range addrs {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts connections after shutdown", addr)
+		}
+	}
+}
+
+// One address that can't be bound fails the server, closing the others,
+// unless it serves what it can.
+func TestListenFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	t.Run("fail fast", func(t *testing.T) {
+		free := freePort(t)
+		if _, err := listenAndServe(t, &Server{Addrs: []string{free, busy.Addr().String()}}); err == nil {
+			t.Fatal("server started with a busy address")
+		}
+		ln, err := net.Listen("tcp", free)
+		if err != nil {
+			t.Fatalf("address bound first left open: %v", err)
+		}
+		ln.Close()
+	})
+
+	t.Run("best effort", func(t *testing.T) {
+		free := freePort(t)
+		addrs, err := listenAndServe(t, &Server{Addrs: []string{free, busy.Addr().String()}, BestEffort: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0] != free {
+			t.Errorf("listening on %v, want just %s", addrs, free)
+		}
+	})
+
+	t.Run("best effort with nothing bound", func(t *testing.T) {
+		if _, err := listenAndServe(t, &Server{Addrs: []string{busy.Addr().String()}, BestEffort: true}); err == nil {
+			t.Error("server started without an address")
+		}
+	})
+}
+
+// A listen address whose port is taken moves up to the next free port.
+func TestListenPortRetry(t *testing.T) {
+	blocker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+	port := blocker.Addr().(*net.TCPAddr).Port
+	next := net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1))
+	if probe, err := net.Listen("tcp", next); err != nil {
+		t.Skipf("port above the blocker taken too: %v", err)
+	} else {
+		probe.Close()
+	}
+
+	s := &Server{Addrs: []string{blocker.Addr().String()}}
+	if _, err := listenAndServe(t, s); err == nil {
+		t.Fatal("listened on a port in use")
+	}
+	s = &Server{Addrs: []string{blocker.Addr().String()}, PortRetry: 3}
+	addrs, err := listenAndServe(t, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != next {
+		t.Errorf("listening on %q, want %s", addrs, next)
+	}
+}
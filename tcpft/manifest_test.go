@@ -0,0 +1,48 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"socket-file-transfer/internal/manifest"
+	"socket-file-transfer/internal/wire"
+)
+
+// A SHA256SUMS is checked against the files stored next to it and stays
+// stored whether they match or not.
+func TestManifest(t *testing.T) {
+	good := sha256.Sum256([]byte("a"))
+	bad := sha256.Sum256([]byte("not a"))
+	tests := []struct {
+		name    string
+		entries []manifest.Entry
+		fails   bool
+	}{
+		{"matches", []manifest.Entry{{Path: "a.txt", Sum: good[:]}}, false},
+		{"differs", []manifest.Entry{{Path: "a.txt", Sum: bad[:]}}, true},
+		{"missing file", []manifest.Entry{{Path: "a.txt", Sum: good[:]}, {Path: "gone.txt", Sum: good[:]}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{Options: quietOptions()}
+			addr := serve(t, s)
+			if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "a.txt", []byte("a")), quietOptions()); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			manifest.Write(&buf, tt.entries)
+			_, err := (&Client{}).Send(context.Background(), addr, manifest.NAME, bytes.NewReader(buf.Bytes()), int64(buf.Len()), quietOptions())
+			if tt.fails != (err != nil) {
+				t.Fatalf("got %v, want failure %v", err, tt.fails)
+			}
+			if tt.fails && !errors.Is(err, wire.ErrChecksumMismatch) {
+				t.Errorf("got %v, want ErrChecksumMismatch", err)
+			}
+			checkStored(t, s.UploadDir, manifest.NAME, buf.Bytes())
+		})
+	}
+}
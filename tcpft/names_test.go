@@ -0,0 +1,50 @@
+package tcpft
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// Non-ASCII names, up to MAX_NAME_BYTES of them, are stored as sent.
+func TestUnicodeNames(t *testing.T) {
+	s := &Server{}
+	addr := serve(t, s)
+	var c Client
+	for _, name := range []string{
+		"отчёт-2024.pdf",
+		"報告書.txt",
+		"🎉 party 🎂.bin",
+		strings.Repeat("é", wire.MAX_NAME_BYTES/2) + "x", // Every byte of the limit
+	} {
+		data := []byte(name)
+		if _, err := c.SendFile(context.Background(), addr, writeFile(t, "src", data), withName(name)); err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+		checkStored(t, s.UploadDir, name, data)
+	}
+}
+
+// A name past the limit is refused before connecting.
+func TestLongNameRefused(t *testing.T) {
+	name := strings.Repeat("é", wire.MAX_NAME_BYTES/2+1)
+	var c Client
+	c.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		t.Error("connected with a name over the limit")
+		return nil, errors.New("no dialing")
+	}
+	_, err := c.SendFile(context.Background(), "127.0.0.1:1", writeFile(t, "src", nil), withName(name))
+	if !errors.Is(err, ErrInvalidName) {
+		t.Errorf("got %v, want ErrInvalidName", err)
+	}
+}
+
+func withName(name string) Options {
+	opts := quietOptions()
+	opts.Name = name
+	return opts
+}
@@ -0,0 +1,256 @@
+package tcpft
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// Features only a client that sends its body in segments offers
+const segmentFeatures = wire.FEATURE_PAUSE | wire.FEATURE_ABORT
+
+// pauseConn holds back what is written to it while pause is paused. With
+// segments, see FEATURE_PAUSE, each write goes out as a data segment and a
+// pause is declared to the server, which then waits for it to end. With
+// aborts as well, abort tells the server the client gave up.
+type pauseConn struct {
+	net.Conn
+	ctx      context.Context
+	pause    *wire.Pause
+	segments bool
+	aborts   bool
+	log      *slog.Logger
+	rep      *wire.Reporter
+
+	mu    sync.Mutex // Held while sending
+	sent  bool       // Some of the body went out
+	ended bool       // Nothing more goes out: the body is complete, a write failed or the abort was sent
+}
+
+func (c *pauseConn) Write(p []byte) (int, error) {
+	if err := c.hold(); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.segment(int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(p)
+	return n, c.check(err)
+}
+
+// ReadFrom sends a chunk of a file as one segment, so it can still go
+// straight from the page cache.
+func (c *pauseConn) ReadFrom(r io.Reader) (int64, error) {
+	lr, ok := r.(*io.LimitedReader)
+	if !ok {
+		return io.Copy(writerOnly{c}, r)
+	}
+	if err := c.hold(); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	want := lr.N
+	if err := c.segment(want); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(c.Conn, lr)
+	if err == nil && c.segments && n < want {
+		// The segment promised more than the file had
+		err = fmt.Errorf("file ended %d bytes short of the data sent", want-n)
+	}
+	return n, c.check(err)
+}
+
+// Read reads the server's reply to the body, which is complete by then
+// unless ctx ended it, so there is nothing left to abort.
+func (c *pauseConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	c.ended = c.ended || c.sent && c.ctx.Err() == nil
+	c.mu.Unlock()
+	return c.Conn.Read(p)
+}
+
+// segment starts a data segment of n bytes.
+func (c *pauseConn) segment(n int64) error {
+	if c.ended {
+		return fmt.Errorf("upload aborted: %w", net.ErrClosed)
+	}
+	c.sent = true
+	if !c.segments {
+		return nil
+	}
+	var b [wire.SEGMENT_HEADER_LEN]byte
+	b[0] = wire.SEGMENT_DATA
+	binary.BigEndian.PutUint64(b[1:], uint64(n))
+	_, err := c.Conn.Write(b[:])
+	return c.check(err)
+}
+
+// control sends a segment with no data.
+func (c *pauseConn) control(segment byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ended {
+		return fmt.Errorf("upload aborted: %w", net.ErrClosed)
+	}
+	_, err := c.Conn.Write([]byte{segment})
+	return c.check(err)
+}
+
+// check ends the body once a write failed, since it may have stopped
+// part way through a segment.
+func (c *pauseConn) check(err error) error {
+	if err != nil {
+		c.ended = true
+	}
+	return err
+}
+
+// abort tells the server the client gave up on the upload because of
+// reason, unless the body is complete or was cut short. A write under way
+// gets ABORT_TIMEOUT to finish first.
+func (c *pauseConn) abort(reason error) {
+	if !c.aborts {
+		return
+	}
+	conn := beneathWatchdogs(c.Conn)
+	conn.SetWriteDeadline(time.Now().Add(wire.ABORT_TIMEOUT))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ended {
+		return
+	}
+	c.ended = true
+	frame, _ := wire.NewAbort(reason).MarshalBinary()
+	if _, err := conn.Write(append([]byte{wire.SEGMENT_ABORT}, frame...)); err != nil {
+		c.log.Debug("Error telling the server of the abort", "err", err)
+	}
+}
+
+// hold waits while the transfer is paused, telling the server.
+func (c *pauseConn) hold() error {
+	if !c.pause.Paused() {
+		return nil
+	}
+	if c.segments {
+		if err := c.control(wire.SEGMENT_PAUSE); err != nil {
+			return err
+		}
+	} else {
+		c.log.Warn("Server does not support pauses, it may give up on the transfer")
+	}
+	c.log.Info("Transfer paused")
+	c.rep.Paused()
+	started := time.Now()
+	if err := c.pause.Wait(c.ctx); err != nil {
+		return err
+	}
+	c.log.Info("Transfer resumed", "paused", time.Since(started))
+	c.rep.Resumed()
+	if c.segments {
+		return c.control(wire.SEGMENT_RESUME)
+	}
+	return nil
+}
+
+// segmentConn reads a body sent in segments, see FEATURE_PAUSE, passing on
+// their data. A pause may last up to maxPause.
+type segmentConn struct {
+	net.Conn
+	left     int64 // Of the current data segment
+	maxPause time.Duration
+	log      *slog.Logger
+	rep      *wire.Reporter
+}
+
+func (c *segmentConn) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Read(p[:min(int64(len(p)), c.left)])
+	c.left -= int64(n)
+	return n, err
+}
+
+// next reads the next segment header, waiting out a pause.
+func (c *segmentConn) next() error {
+	var b [wire.SEGMENT_HEADER_LEN]byte
+	if _, err := io.ReadFull(c.Conn, b[:1]); err != nil {
+		return err
+	}
+	switch b[0] {
+	case wire.SEGMENT_DATA:
+		if _, err := io.ReadFull(c.Conn, b[1:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = io.EOF
+			}
+			return err
+		}
+		c.left = int64(binary.BigEndian.Uint64(b[1:]))
+		if c.left < 0 {
+			return fmt.Errorf("%w: data segment of %d bytes", wire.ErrProtocol, uint64(c.left))
+		}
+		return nil
+	case wire.SEGMENT_PAUSE:
+		return c.wait()
+	case wire.SEGMENT_ABORT:
+		return readAbort(c.Conn)
+	}
+	return fmt.Errorf("%w: unknown body segment %#x", wire.ErrProtocol, b[0])
+}
+
+// wait waits for the client to resume. It reads the connection beneath
+// the watchdogs, whose timeouts a pause is exempt from.
+func (c *segmentConn) wait() error {
+	c.log.Info("Client paused")
+	c.rep.Paused()
+	started := time.Now()
+	conn := beneathWatchdogs(c.Conn)
+	conn.SetReadDeadline(started.Add(c.maxPause))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	_, err := io.ReadFull(conn, b[:])
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: client paused for longer than %s", wire.ErrTimeout, c.maxPause)
+	}
+	if err != nil {
+		return err
+	}
+	if b[0] == wire.SEGMENT_ABORT {
+		return readAbort(conn)
+	}
+	if b[0] != wire.SEGMENT_RESUME {
+		return fmt.Errorf("%w: body segment %#x during a pause", wire.ErrProtocol, b[0])
+	}
+	c.log.Info("Client resumed", "paused", time.Since(started))
+	c.rep.Resumed()
+	return nil
+}
+
+// readAbort reads the error frame of SEGMENT_ABORT, returning the error
+// the transfer fails with.
+func readAbort(r io.Reader) error {
+	rerr, err := wire.ReadRemoteError(r)
+	if err != nil {
+		return err
+	}
+	if aborted := wire.Aborted(rerr); aborted != nil {
+		return aborted
+	}
+	return fmt.Errorf("%w: abort with error code %d", wire.ErrProtocol, rerr.Code)
+}
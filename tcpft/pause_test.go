@@ -0,0 +1,95 @@
+package tcpft
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// pauseOnce returns options that pause the upload once it is under way,
+// resuming it after d.
+func pauseOnce(d time.Duration) Options {
+	opts := quietOptions()
+	opts.Pause = new(Pause)
+	var once sync.Once
+	opts.Progress = func(ev Event) {
+		if ev.Kind == EventProgress && ev.Bytes > 0 {
+			once.Do(func() {
+				opts.Pause.Pause()
+				time.AfterFunc(d, opts.Pause.Resume)
+			})
+		}
+	}
+	return opts
+}
+
+// A pause longer than the server's stall timeout leaves the upload intact,
+// while one longer than its MaxPause fails it.
+func TestPause(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxPause time.Duration
+		wantErr  error
+	}{
+		{"within MaxPause", time.Minute, nil},
+		{"past MaxPause", 100 * time.Millisecond, wire.ErrTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var kinds []wire.EventKind
+			s := &Server{StallTimeout: 100 * time.Millisecond, MaxPause: tt.maxPause}
+			s.Logger = quiet
+			s.Progress = func(ev Event) {
+				if ev.Kind == wire.EventPaused || ev.Kind == wire.EventResumed {
+					mu.Lock()
+					kinds = append(kinds, ev.Kind)
+					mu.Unlock()
+				}
+			}
+			addr := serve(t, s)
+
+			data := make([]byte, 8<<20)
+			rand.Read(data)
+			_, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "f.bin", data), pauseOnce(400*time.Millisecond))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if !dirEmpty(t, s.UploadDir) {
+					t.Error("upload paused for too long left files behind")
+				}
+				return
+			}
+			checkStored(t, s.UploadDir, "f.bin", data)
+			mu.Lock()
+			defer mu.Unlock()
+			if len(kinds) != 2 || kinds[0] != wire.EventPaused || kinds[1] != wire.EventResumed {
+				t.Errorf("server reported %v, want paused then resumed", kinds)
+			}
+		})
+	}
+}
+
+func TestPauseToggle(t *testing.T) {
+	var p Pause
+	if !p.Toggle() || !p.Paused() {
+		t.Error("Toggle didn't pause")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait while paused: got %v, want context.DeadlineExceeded", err)
+	}
+	if p.Toggle() || p.Paused() {
+		t.Error("Toggle didn't resume")
+	}
+	if err := p.Wait(context.Background()); err != nil {
+		t.Errorf("Wait while running: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/wire"
+)
+
+// A policy set while the server runs applies to the next upload, while
+// an upload under way finishes under the policy it started with.
+func TestLivePolicy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := &gateListener{Listener: ln, after: 64 << 10, reached: make(chan struct{}), release: make(chan struct{})}
+	live := store.NewLive(store.Policy{MaxFileSize: 4 << 20})
+	s := &Server{LivePolicy: live}
+	serveOn(t, s, gate)
+	addr := ln.Addr().String()
+
+	// Tightened while the first upload is held part way
+	big := bytes.Repeat([]byte("x"), 1<<20)
+	go func() {
+		<-gate.reached
+		live.Set(store.Policy{MaxFileSize: 1 << 10, RejectExt: []string{".exe"}})
+		close(gate.release)
+	}()
+	if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "under-way.bin", big), quietOptions()); err != nil {
+		t.Fatalf("upload under way when the policy changed: %v", err)
+	}
+	checkStored(t, s.UploadDir, "under-way.bin", big)
+
+	if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "next.bin", big), quietOptions()); !errors.Is(err, wire.ErrTooLarge) {
+		t.Errorf("upload after the change: got %v, want ErrTooLarge", err)
+	}
+	if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "tool.exe", []byte("MZ")), quietOptions()); !errors.Is(err, wire.ErrRejected) {
+		t.Errorf("rejected extension: got %v, want ErrRejected", err)
+	}
+
+	// Loosened again
+	live.Set(store.Policy{MaxFileSize: 4 << 20})
+	if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "next.bin", big), quietOptions()); err != nil {
+		t.Errorf("upload after loosening the policy: %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package tcpft
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+var (
+	// ErrProxy is wrapped by the refusals of a proxy, as opposed to errors
+	// reaching it.
+	ErrProxy = errors.New("proxy refused the connection")
+
+	// ErrProxyAuth is the refusal of a proxy that wants other credentials.
+	ErrProxyAuth = fmt.Errorf("%w: authentication required", ErrProxy)
+)
+
+// SOCKS5 (RFC 1928) and its username/password authentication (RFC 1929)
+const (
+	socksVersion    = 5
+	socksNoAuth     = 0
+	socksPassword   = 2
+	socksNoMethod   = 0xFF
+	socksConnect    = 1
+	socksIPv4       = 1
+	socksDomain     = 3
+	socksIPv6       = 4
+	socksAuthVer    = 1
+	socksMaxNameLen = 255
+)
+
+// socksReplies are the reasons a SOCKS5 proxy gives for refusing.
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused by upstream",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// ProxyFromEnvironment returns the proxy ALL_PROXY (or all_proxy) names
+// for addr, "" if there is none or NO_PROXY exempts addr. Like net/http,
+// it never proxies localhost.
+func ProxyFromEnvironment(addr string) string {
+	proxy := getenvAny("ALL_PROXY", "all_proxy")
+	if proxy == "" {
+		return ""
+	}
+	// Only NO_PROXY matters here, so any proxy stands in for ours
+	config := httpproxy.Config{HTTPProxy: "http://proxy", NoProxy: getenvAny("NO_PROXY", "no_proxy")}
+	if u, err := config.ProxyFunc()(&url.URL{Scheme: "http", Host: addr}); err != nil || u == nil {
+		return ""
+	}
+	return proxy
+}
+
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseProxy parses a proxy URL, taking one without a scheme as an HTTP
+// proxy.
+func parseProxy(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		if u, err = url.Parse("http://" + rawURL); err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL %q: want http://, socks5:// or socks5h://", u.Redacted())
+	}
+	if u.Port() == "" {
+		port := "1080"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// dialThrough connects to host, host:port, through proxy. Errors reaching
+// the proxy are reported as such; what the proxy refuses wraps ErrProxy.
+func (c *Client) dialThrough(ctx context.Context, proxy *url.URL, host string) (net.Conn, error) {
+	conn, err := c.dialNetwork(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to proxy %s: %w", proxy.Host, err)
+	}
+	// The handshakes have no context of their own
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if proxy.Scheme == "http" {
+		err = connectHTTP(conn, proxy, host)
+	} else {
+		err = connectSOCKS(ctx, conn, proxy, host)
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connectHTTP asks the HTTP proxy on conn to CONNECT to host.
+func connectHTTP(conn net.Conn, proxy *url.URL, host string) error {
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: host}, Host: host, Header: http.Header{}}
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("error talking to proxy %s: %w", proxy.Host, err)
+	}
+	// The proxy says nothing more until the server does, so nothing is
+	// lost to the reader's buffer
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("error talking to proxy %s: %w", proxy.Host, err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return fmt.Errorf("%s: %w", proxy.Host, ErrProxyAuth)
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("%s: %w: %s", proxy.Host, ErrProxy, resp.Status)
+	}
+	return nil
+}
+
+// connectSOCKS asks the SOCKS5 proxy on conn to connect to host. With
+// socks5:// the host name is resolved here, with socks5h:// by the proxy.
+func connectSOCKS(ctx context.Context, conn net.Conn, proxy *url.URL, host string) error {
+	hostname, portStr, err := net.SplitHostPort(host)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+	request := []byte{socksVersion, socksConnect, 0}
+	ip, err := netip.ParseAddr(hostname)
+	if err != nil && proxy.Scheme == "socks5" {
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", hostname)
+		if err != nil {
+			return err
+		}
+		ip = ips[0]
+	}
+	switch {
+	case ip.Is4() || ip.Is4In6():
+		request = append(append(request, socksIPv4), ip.Unmap().AsSlice()...)
+	case ip.Is6():
+		request = append(append(request, socksIPv6), ip.AsSlice()...)
+	default:
+		if len(hostname) > socksMaxNameLen {
+			return fmt.Errorf("host name %q is too long for SOCKS5", hostname)
+		}
+		request = append(append(request, socksDomain, byte(len(hostname))), hostname...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+
+	talkErr := func(err error) error {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("error talking to proxy %s: %w", proxy.Host, err)
+	}
+
+	// Offer username/password authentication only if we have credentials
+	greeting := []byte{socksVersion, 1, socksNoAuth}
+	if proxy.User != nil {
+		greeting = []byte{socksVersion, 2, socksNoAuth, socksPassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return talkErr(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return talkErr(err)
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("proxy %s doesn't speak SOCKS5", proxy.Host)
+	}
+	switch reply[1] {
+	case socksNoAuth:
+	case socksPassword:
+		if proxy.User == nil {
+			return fmt.Errorf("%s: %w", proxy.Host, ErrProxyAuth)
+		}
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return fmt.Errorf("proxy credentials are too long for SOCKS5")
+		}
+		auth := append([]byte{socksAuthVer, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return talkErr(err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return talkErr(err)
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("%s: %w: credentials rejected", proxy.Host, ErrProxyAuth)
+		}
+	case socksNoMethod:
+		return fmt.Errorf("%s: %w", proxy.Host, ErrProxyAuth)
+	default:
+		return fmt.Errorf("proxy %s chose unknown SOCKS5 method %d", proxy.Host, reply[1])
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return talkErr(err)
+	}
+	// Version, reply, reserved, address type, then the bound address
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return talkErr(err)
+	}
+	if head[1] != 0 {
+		reason, ok := socksReplies[head[1]]
+		if !ok {
+			reason = fmt.Sprintf("reply %d", head[1])
+		}
+		return fmt.Errorf("%s: %w to %s: %s", proxy.Host, ErrProxy, host, reason)
+	}
+	var skip int
+	switch head[3] {
+	case socksIPv4:
+		skip = 4
+	case socksIPv6:
+		skip = 16
+	case socksDomain:
+		if _, err := io.ReadFull(conn, head[:1]); err != nil {
+			return talkErr(err)
+		}
+		skip = int(head[0])
+	default:
+		return fmt.Errorf("proxy %s sent unknown address type %d", proxy.Host, head[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return talkErr(err)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package tcpft
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testProxy is an in-process proxy that counts the connections it made
+// for its clients.
+type testProxy struct {
+	user, pass string // Credentials it asks for, none if empty
+	refuse     byte   // SOCKS5 reply or HTTP status to refuse with, 0 to connect
+	connected  atomic.Int32
+}
+
+// listen runs p on a loopback port until the test ends, speaking SOCKS5
+// or, with http set, taking CONNECT requests. It returns the proxy URL.
+func (p *testProxy) listen(t *testing.T, http bool) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if http {
+					p.serveHTTP(conn)
+				} else {
+					p.serveSOCKS(conn)
+				}
+			}()
+		}
+	}()
+	if http {
+		return "http://" + ln.Addr().String()
+	}
+	return "socks5://" + ln.Addr().String()
+}
+
+// pipe connects client to target until either hangs up.
+func (p *testProxy) pipe(client io.ReadWriter, target string) {
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	p.connected.Add(1)
+	go io.Copy(upstream, client)
+	io.Copy(client, upstream)
+}
+
+func (p *testProxy) serveHTTP(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.user+":"+p.pass))
+	switch {
+	case p.user != "" && req.Header.Get("Proxy-Authorization") != want:
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+		return
+	case p.refuse != 0:
+		io.WriteString(conn, "HTTP/1.1 "+strconv.Itoa(int(p.refuse)+500)+" Refused\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	p.pipe(struct {
+		io.Reader
+		io.Writer
+	}{r, conn}, req.Host)
+}
+
+func (p *testProxy) serveSOCKS(conn net.Conn) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	want := byte(socksNoAuth)
+	if p.user != "" {
+		want = socksPassword
+	}
+	if !strings.ContainsRune(string(methods), rune(want)) {
+		conn.Write([]byte{socksVersion, socksNoMethod})
+		return
+	}
+	conn.Write([]byte{socksVersion, want})
+	if want == socksPassword {
+		// Version and username, then password, each after its length
+		field := func(skip int) string {
+			b := make([]byte, skip+1)
+			io.ReadFull(conn, b)
+			b = make([]byte, b[skip])
+			io.ReadFull(conn, b)
+			return string(b)
+		}
+		if user, pass := field(1), field(0); user != p.user || pass != p.pass {
+			conn.Write([]byte{socksAuthVer, 1})
+			return
+		}
+		conn.Write([]byte{socksAuthVer, 0})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		ip := make([]byte, 4)
+		if request[3] == socksIPv6 {
+			ip = make([]byte, 16)
+		}
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socksDomain:
+		name := make([]byte, 1)
+		io.ReadFull(conn, name)
+		name = make([]byte, name[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	reply := []byte{socksVersion, p.refuse, 0, socksIPv4, 0, 0, 0, 0, 0, 0}
+	conn.Write(reply)
+	if p.refuse == 0 {
+		p.pipe(conn, net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	}
+}
+
+func TestProxy(t *testing.T) {
+	tests := []struct {
+		name       string
+		http       bool
+		user, pass string
+		host       string // What the client asks for, the server's address if empty
+		scheme     string // In place of socks5
+	}{
+		{name: "socks5"},
+		{name: "socks5 with credentials", user: "alice", pass: "secret"},
+		{name: "socks5h resolves on the proxy", host: "localhost", scheme: "socks5h"},
+		{name: "http", http: true},
+		{name: "http with credentials", http: true, user: "alice", pass: "p@ss:word"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{Options: quietOptions()}
+			addr := serve(t, s)
+			if tt.host != "" {
+				_, port, _ := net.SplitHostPort(addr)
+				addr = net.JoinHostPort(tt.host, port)
+			}
+
+			p := &testProxy{user: tt.user, pass: tt.pass}
+			proxy := p.listen(t, tt.http)
+			if tt.scheme != "" {
+				proxy = tt.scheme + strings.TrimPrefix(proxy, "socks5")
+			}
+			if tt.user != "" {
+				scheme, rest, _ := strings.Cut(proxy, "://")
+				proxy = scheme + "://" + tt.user + ":" + strings.ReplaceAll(tt.pass, "@", "%40") + "@" + rest
+			}
+
+			data := []byte("through the proxy")
+			c := &Client{Proxy: proxy}
+			if _, err := c.SendFile(context.Background(), addr, writeFile(t, "f", data), quietOptions()); err != nil {
+				t.Fatalf("SendFile: %v", err)
+			}
+			checkStored(t, s.UploadDir, "f", data)
+			if n := p.connected.Load(); n != 1 {
+				t.Errorf("proxy made %d connections, want 1", n)
+			}
+		})
+	}
+}
+
+// What the proxy refuses wraps ErrProxy, ErrProxyAuth for credentials,
+// while failing to reach the proxy doesn't.
+func TestProxyErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		http  bool
+		proxy *testProxy
+		creds string
+		want  error
+	}{
+		{name: "socks5 wants credentials", proxy: &testProxy{user: "u", pass: "p"}, want: ErrProxyAuth},
+		{name: "socks5 wrong credentials", proxy: &testProxy{user: "u", pass: "p"}, creds: "u:nope@", want: ErrProxyAuth},
+		{name: "socks5 upstream refused", proxy: &testProxy{refuse: 5}, want: ErrProxy},
+		{name: "http wants credentials", http: true, proxy: &testProxy{user: "u", pass: "p"}, want: ErrProxyAuth},
+		{name: "http refused", http: true, proxy: &testProxy{refuse: 2}, want: ErrProxy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := tt.proxy.listen(t, tt.http)
+			scheme, rest, _ := strings.Cut(proxy, "://")
+			c := &Client{Proxy: scheme + "://" + tt.creds + rest}
+			_, err := c.SendFile(context.Background(), "127.0.0.1:1", writeFile(t, "f", []byte("x")), quietOptions())
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			if tt.want == ErrProxy && errors.Is(err, ErrProxyAuth) {
+				t.Errorf("refusal %v reported as an authentication failure", err)
+			}
+		})
+	}
+
+	t.Run("proxy unreachable", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+		c := &Client{Proxy: "socks5://" + addr}
+		_, err = c.SendFile(context.Background(), "127.0.0.1:1", writeFile(t, "f", []byte("x")), quietOptions())
+		if err == nil || errors.Is(err, ErrProxy) || !strings.Contains(err.Error(), "error connecting to proxy") {
+			t.Errorf("got %v, want an error reaching the proxy", err)
+		}
+	})
+}
+
+func TestParseProxy(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"http://proxy:3128", "http://proxy:3128"},
+		{"proxy:3128", "http://proxy:3128"},
+		{"http://proxy", "http://proxy:80"},
+		{"socks5://proxy", "socks5://proxy:1080"},
+		{"socks5h://u:p@proxy:9050", "socks5h://u:p@proxy:9050"},
+	}
+	for _, tt := range tests {
+		u, err := parseProxy(tt.in)
+		if err != nil {
+			t.Errorf("parseProxy(%q): %v", tt.in, err)
+			continue
+		}
+		if got := u.String(); got != tt.want {
+			t.Errorf("parseProxy(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if _, err := parseProxy("ftp://proxy:21"); err == nil {
+		t.Error("ftp:// proxy accepted")
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	tests := []struct {
+		name, all, no, addr, want string
+	}{
+		{"no proxy set", "", "", "files.example:9000", ""},
+		{"proxied", "socks5://proxy:1080", "", "files.example:9000", "socks5://proxy:1080"},
+		{"exempt", "socks5://proxy:1080", ".example", "files.example:9000", ""},
+		{"not exempt", "socks5://proxy:1080", ".example", "files.test:9000", "socks5://proxy:1080"},
+		{"localhost", "socks5://proxy:1080", "", "localhost:9000", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"ALL_PROXY", "all_proxy", "NO_PROXY", "no_proxy"} {
+				t.Setenv(name, "")
+			}
+			t.Setenv("ALL_PROXY", tt.all)
+			t.Setenv("NO_PROXY", tt.no)
+			if got := ProxyFromEnvironment(tt.addr); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package tcpft
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// A raw client announcing a size and sending less or more than it has the
+// upload quarantined with the reason, and told it failed.
+func TestQuarantine(t *testing.T) {
+	const announced = 1000
+	tests := []struct {
+		name   string
+		send   int
+		reason string // Quarantine suffix, none if stored
+	}{
+		{"exact", announced, ""},
+		{"under-send", announced - 300, "truncated"},
+		{"over-send", announced + 50, "oversized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			addr := serve(t, s)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			b, _ := (&wire.Hello{Version: 1}).MarshalBinary()
+			conn.Write(b)
+			if _, err := wire.ReadHello(conn); err != nil {
+				t.Fatal(err)
+			}
+			data := bytes.Repeat([]byte{'q'}, tt.send)
+			hb, _ := (&wire.FileHeader{Name: "f.bin", Size: announced}).MarshalBinary()
+			conn.Write(append(hb, data...))
+			if tt.send < announced {
+				conn.(*net.TCPConn).CloseWrite()
+			}
+			reply, _ := io.ReadAll(conn)
+
+			quarantined := filepath.Join(s.UploadDir, wire.QUARANTINE_DIR, "f.bin."+tt.reason)
+			if tt.reason == "" {
+				if !bytes.Equal(reply, []byte{STATUS_OK}) {
+					t.Errorf("reply %x, want STATUS_OK", reply)
+				}
+				checkStored(t, s.UploadDir, "f.bin", data)
+				return
+			}
+			if bytes.Equal(reply, []byte{STATUS_OK}) {
+				t.Error("server confirmed the upload")
+			}
+			if _, err := os.Stat(filepath.Join(s.UploadDir, "f.bin")); !os.IsNotExist(err) {
+				t.Errorf("upload stored: %v", err)
+			}
+			got, err := os.ReadFile(quarantined)
+			if err != nil {
+				t.Fatalf("quarantined file: %v", err)
+			}
+			if want := min(tt.send, announced); len(got) != want {
+				t.Errorf("quarantined %d bytes, want the %d received", len(got), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package tcpft
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/hook"
+	"socket-file-transfer/internal/prealloc"
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/wire"
+)
+
+// A file arriving in ranges over several connections, see Options.Streams.
+// The connection that completes it stores it; the others wait for that to
+// report the outcome to their client.
+type rangedFile struct {
+	header *wire.FileHeader // Of the connection that opened it
+	in     *store.Incoming
+	w      io.WriterAt
+
+	// Guarded by the rangeTable's mutex
+	received   []span // Ranges written in full
+	members    int    // Connections sending a range or waiting
+	completing bool
+
+	finished chan struct{} // Closed once stored or discarded
+	upload   hook.Upload
+	err      error
+}
+
+type span struct {
+	start, end int64
+}
+
+// rangeTable holds a Server's files arriving in ranges, by transfer ID.
+type rangeTable struct {
+	mu    sync.Mutex
+	files map[[wire.RANGE_ID_LEN]byte]*rangedFile
+	stop  <-chan struct{} // Closed when the server shuts down
+}
+
+func newRangeTable(stop <-chan struct{}) *rangeTable {
+	return &rangeTable{files: make(map[[wire.RANGE_ID_LEN]byte]*rangedFile), stop: stop}
+}
+
+// join adds a connection to the file the header's transfer ID names,
+// creating it through in if this is its first range.
+func (t *rangeTable) join(header *wire.FileHeader, in *store.Incoming) (*rangedFile, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f := t.files[header.RangeID]; f != nil {
+		if f.header.Name != header.Name || f.header.Size != header.Size || !bytes.Equal(f.header.Checksum, header.Checksum) {
+			return nil, fmt.Errorf("%w: range of another file under the same transfer ID", wire.ErrProtocol)
+		}
+		f.members++
+		return f, nil
+	}
+
+	if err := in.Create(); err != nil {
+		return nil, err
+	}
+	w, anyOrder := in.WriterAt()
+	if !anyOrder {
+		in.Close()
+		return nil, fmt.Errorf("%w: the storage can't take a file in ranges, send it over one connection", wire.ErrRejected)
+	}
+	f := &rangedFile{header: header, in: in, w: w, members: 1, finished: make(chan struct{})}
+	t.files[header.RangeID] = f
+	return f, nil
+}
+
+// received records that [start, end) of f was written, reporting whether
+// that completed the file. Only one caller is ever told so.
+func (t *rangeTable) received(f *rangedFile, start, end int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f.received = append(f.received, span{start, end})
+	if f.completing {
+		return false
+	}
+	slices.SortFunc(f.received, func(a, b span) int { return cmp.Compare(a.start, b.start) })
+	covered := int64(0)
+	for _, s := range f.received {
+		if s.start > covered {
+			return false
+		}
+		covered = max(covered, s.end)
+	}
+	f.completing = covered >= int64(f.header.Size)
+	return f.completing
+}
+
+// finish stores the complete f, checking it against the checksum its
+// ranges were sent with, and releases the connections waiting for it.
+func (t *rangeTable) finish(f *rangedFile) {
+	in := f.in
+	err := in.AddWritten(in.Size)
+	if err == nil && !bytes.Equal(in.Sum(), f.header.Checksum) {
+		in.Quarantine("mismatch")
+		err = fmt.Errorf("%w: the ranges received don't add up to the file sent", wire.ErrChecksumMismatch)
+	}
+	if err == nil {
+		f.upload, err = in.Commit()
+	}
+	in.Close()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f.err = err
+	delete(t.files, f.header.RangeID)
+	close(f.finished)
+}
+
+// leave drops a connection from f, discarding the file if no connection
+// is left to complete it.
+func (t *rangeTable) leave(f *rangedFile) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f.members--
+	if f.members > 0 || f.completing {
+		return
+	}
+	f.in.Close()
+	f.err = errors.New("transfer abandoned")
+	delete(t.files, f.header.RangeID)
+	close(f.finished)
+}
+
+// receiveRange writes the range of a file one connection carries, see
+// FLAG_RANGE, then waits until every range arrived and the file is stored
+// to confirm it, with heartbeats meanwhile if features include them.
+func (s *Server) receiveRange(conn net.Conn, header *wire.FileHeader, in *store.Incoming, features uint32, log *slog.Logger, rep *wire.Reporter) error {
+	if header.Flags&(wire.FLAG_DELTA|wire.FLAG_SPARSE) != 0 {
+		return fmt.Errorf("%w: a file sent in ranges can't be a delta or sparse", wire.ErrProtocol)
+	}
+	if header.RangeLength == 0 || header.RangeOffset > header.Size || header.RangeLength > header.Size-header.RangeOffset {
+		return fmt.Errorf("%w: range of %d bytes at %d of a %d byte file", wire.ErrProtocol, header.RangeLength, header.RangeOffset, header.Size)
+	}
+	start, end := int64(header.RangeOffset), int64(header.RangeOffset+header.RangeLength)
+
+	f, err := s.ranges.join(header, in)
+	if err != nil {
+		return err
+	}
+	defer s.ranges.leave(f)
+	log.Info("Receiving range", "offset", start, "length", end-start)
+	rep.Start(header.Name, end-start)
+	started := time.Now()
+
+	pooled := getBuffer(s.bufferSize())
+	defer putBuffer(pooled)
+	buffer := (*pooled)[:s.bufferSize()]
+
+	for pos := start; pos < end; {
+		n, err := conn.Read(buffer[:min(int64(len(buffer)), end-pos)])
+		if n > 0 {
+			if _, err := f.w.WriteAt(buffer[:n], pos); err != nil {
+				return prealloc.NoSpace(fmt.Errorf("error writing to file: %w", err))
+			}
+			pos += int64(n)
+			rep.Progress(pos - start)
+		}
+		if err == io.EOF {
+			return fmt.Errorf("%w: connection closed after %d of %d bytes of the range", wire.ErrProtocol, pos-start, end-start)
+		}
+		if err != nil {
+			return fmt.Errorf("error reading data: %w", err)
+		}
+	}
+	if trailingData(conn) {
+		return fmt.Errorf("%w: client sent more than the announced range of %d bytes", wire.ErrProtocol, end-start)
+	}
+
+	// The connection that completes the file stores it, the others wait
+	// to hear how that went
+	beat := startHeartbeat(conn, features, f.in.Status)
+	defer beat.stop()
+	if s.ranges.received(f, start, end) {
+		s.ranges.finish(f)
+		if f.err == nil {
+			log.Info("File saved", "path", f.upload.Path, "bytes", f.upload.Size, "duration", time.Since(f.in.Started()))
+		}
+	}
+	select {
+	case <-f.finished:
+	case <-time.After(RANGE_WAIT):
+		return fmt.Errorf("%w: the file's other ranges didn't arrive within %s", wire.ErrTimeout, RANGE_WAIT)
+	case <-s.ranges.stop:
+		return errors.New("server shutting down")
+	}
+	beat.stop()
+	if f.err != nil {
+		return f.err
+	}
+	log.Info("Range received", "offset", start, "length", end-start, "duration", time.Since(started))
+
+	err = confirmStored(conn, f.in, f.upload.Size, features)
+	if err != nil {
+		return fmt.Errorf("error sending status: %w", err)
+	}
+	rep.Complete(end - start)
+	return nil
+}
@@ -0,0 +1,144 @@
+package tcpft
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/tokens"
+	"socket-file-transfer/internal/wire"
+)
+
+// receiptServer handles a connection as a server negotiating
+// FEATURE_RECEIPT that confirms the file with the receipt made by receipt
+// from what it read.
+func receiptServer(receipt func(header *wire.FileHeader, got int64) wire.Receipt) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		if _, err := wire.ReadHello(conn); err != nil {
+			return
+		}
+		b, _ := (&wire.Hello{Version: wire.PROTOCOL_VERSION, Features: wire.FEATURE_RECEIPT}).MarshalBinary()
+		conn.Write(b)
+		header, err := wire.ReadFileHeader(conn, wire.MAX_NAME_BYTES)
+		if err != nil {
+			return
+		}
+		got, err := io.CopyN(io.Discard, conn, int64(header.Size))
+		if err != nil {
+			return
+		}
+		r := receipt(header, got)
+		b, _ = r.Marshal(wire.FEATURE_RECEIPT)
+		conn.Write(append([]byte{STATUS_OK}, b...))
+	}
+}
+
+// The client takes the path the server reports, and fails on a count
+// other than what it sent.
+func TestReceipt(t *testing.T) {
+	data := []byte("counted and stored")
+	tests := []struct {
+		name    string
+		receipt func(header *wire.FileHeader, got int64) wire.Receipt
+		want    string // StoredAs
+		err     error
+	}{
+		{"as sent", func(h *wire.FileHeader, got int64) wire.Receipt {
+			return wire.Receipt{Bytes: uint64(got), Path: h.Name}
+		}, "r.txt", nil},
+		{"renamed", func(h *wire.FileHeader, got int64) wire.Receipt {
+			return wire.Receipt{Bytes: uint64(got), Path: "elsewhere/r (1).txt"}
+		}, "elsewhere/r (1).txt", nil},
+		{"truncated", func(h *wire.FileHeader, got int64) wire.Receipt {
+			return wire.Receipt{Bytes: uint64(got) - 1, Path: h.Name}
+		}, "", ErrChecksumMismatch},
+		{"over-reported", func(h *wire.FileHeader, got int64) wire.Receipt {
+			return wire.Receipt{Bytes: uint64(got) + 1, Path: h.Name}
+		}, "", ErrChecksumMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := fakeServer(t, receiptServer(tt.receipt))
+			res, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "r.txt", data), quietOptions())
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StoredAs != tt.want {
+				t.Errorf("StoredAs = %q, want %q", res.StoredAs, tt.want)
+			}
+		})
+	}
+}
+
+// A server storing into per-client directories reports the path it
+// stored to, which the client passes on.
+func TestReceiptPerClientDir(t *testing.T) {
+	s := &Server{PerClientDirs: true}
+	addr := serve(t, s)
+	data := []byte("filed by client")
+	res, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "p.txt", data), quietOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "127.0.0.1/p.txt"; res.StoredAs != want {
+		t.Errorf("StoredAs = %q, want %q", res.StoredAs, want)
+	}
+	checkStored(t, s.UploadDir, filepath.FromSlash(res.StoredAs), data)
+}
+
+// Without FEATURE_RECEIPT there is no receipt to check, nor a path.
+func TestNoReceipt(t *testing.T) {
+	var got []byte
+	addr := fakeServer(t, func(conn net.Conn) {
+		wire.ReadHello(conn)
+		b, _ := (&wire.Hello{Version: wire.PROTOCOL_VERSION}).MarshalBinary()
+		conn.Write(b)
+		header, err := wire.ReadFileHeader(conn, wire.MAX_NAME_BYTES)
+		if err != nil {
+			return
+		}
+		got = make([]byte, header.Size)
+		io.ReadFull(conn, got)
+		conn.Write([]byte{STATUS_OK})
+	})
+	res, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "n.txt", []byte("no receipt")), quietOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StoredAs != "" || string(got) != "no receipt" {
+		t.Errorf("StoredAs = %q, server got %q", res.StoredAs, got)
+	}
+}
+
+// A server issuing tokens returns one in each receipt, fetching the file
+// stored.
+func TestReceiptToken(t *testing.T) {
+	s := &Server{}
+	s.UploadDir = t.TempDir()
+	ts, err := tokens.Open(s.UploadDir, time.Hour, 1, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Tokens = ts
+	addr := serve(t, s)
+	res, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "t.txt", []byte("fetch me once")), quietOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Token == "" {
+		t.Fatal("no token in the receipt")
+	}
+	if path, ok := ts.Redeem(res.Token); !ok || path != res.StoredAs {
+		t.Errorf("token fetches %q, %v, want %q", path, ok, res.StoredAs)
+	}
+}
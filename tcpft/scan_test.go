@@ -0,0 +1,36 @@
+//go:build !windows
+
+package tcpft
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// Files the scanner fails are quarantined with its report, the client
+// told they were rejected by policy; the others are stored.
+func TestScanCommand(t *testing.T) {
+	s := &Server{Options: quietOptions(), ScanCommand: `case "$TRANSFER_NAME" in evil*) echo infected; exit 1;; esac`}
+	addr := serve(t, s)
+
+	if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "good.txt", []byte("good")), quietOptions()); err != nil {
+		t.Fatalf("SendFile good.txt: %v", err)
+	}
+	checkStored(t, s.UploadDir, "good.txt", []byte("good"))
+
+	_, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "evil.txt", []byte("evil")), quietOptions())
+	if !errors.Is(err, wire.ErrPolicy) {
+		t.Fatalf("got %v, want ErrPolicy", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.UploadDir, "evil.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("rejected file stored: %v", err)
+	}
+	quarantine := filepath.Join(s.UploadDir, wire.QUARANTINE_DIR)
+	checkStored(t, quarantine, "evil.txt.rejected", []byte("evil"))
+	checkStored(t, quarantine, "evil.txt.rejected.scan", []byte("infected\n"))
+}
@@ -0,0 +1,631 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/checksum"
+	"socket-file-transfer/internal/codes"
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/retention"
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/tenant"
+	"socket-file-transfer/internal/tokens"
+	"socket-file-transfer/internal/unixsock"
+	"socket-file-transfer/internal/wire"
+)
+
+// Server receives files over TCP and stores them in UploadDir.
+type Server struct {
+	Addr          string        // Listen address, wire.TCP_PORT if empty
+	Addrs         []string      // Listen on all of these at once instead of Addr
+	BestEffort    bool          // Serve the Addrs that could be bound, failing only if none could
+	UnixSocket    string        // Listen on this unix socket path instead of Addr
+	SocketMode    os.FileMode   // Permissions of UnixSocket, 0660 if 0
+	UploadDir     string        // Where received files are stored, "uploads" if empty
+	Storage       string        // Store files elsewhere, e.g. "s3://bucket/prefix", see internal/storage.Open; UploadDir if empty
+	StagingDir    string        // Receive files here and move them into UploadDir once complete, next to where they go if empty
+	Marker        bool          // Write .<name>.done next to each file once stored, its hooks run and recorded, see store.Completion
+	CompletedDir  string        // Move each file here, outside UploadDir, once stored, its hooks run and recorded
+	MaxFileSize   int64         // Larger files are refused with ErrTooLarge, no limit if 0
+	PerClientDirs bool          // Store each client's files in UploadDir/<client IP>, see wire.ClientDir
+	Layout        string        // Where files go under UploadDir, see internal/layout; just the name if empty
+	AllowDelete   bool          // Let session clients remove stored files
+	RetainAge     time.Duration // Delete stored files older than this, see internal/retention; kept forever if 0
+	RetainBytes   int64         // Delete the oldest stored files while they total more, no budget if 0
+	RetainDryRun  bool          // Only log what retention would delete
+	ReserveSpace  int64         // Free bytes to keep on the upload filesystem; files that would use them are refused with ErrNoSpace
+	AcceptExt     []string      // Extensions of the files to accept, e.g. ".zip", see internal/filter; any if empty
+	RejectExt     []string      // Extensions of files to refuse with ErrRejected
+	SniffTypes    []string      // Content types to accept, as net/http.DetectContentType names them; any if empty
+	LivePolicy    *store.Live   // Replaces MaxFileSize, ReserveSpace, the filters above and retention if set, so they can change while serving
+	AutoExtract   bool          // Unpack stored .tar, .tar.gz and .tgz files into a directory of their name, see internal/archive
+	ExtractSize   int64         // What the files unpacked from one archive may total, MaxFileSize if 0, which bounds each file too, or archive.DefaultMaxTotal
+	ExtractCount  int           // Entries one archive may hold, archive.DefaultMaxEntries if 0
+	Dedupe        bool          // Store files whose content is already stored as hard links to it, see internal/dedupe
+	Tokens        *tokens.Store // Issue a retrieval token for each stored file, returned in its receipt, see internal/tokens
+	Codes         *codes.Store  // Stage files sessions send with REQ_STAGE under short codes, see internal/codes
+	ScanCommand   string        // Check each file before storing it, quarantining those failing with ErrPolicy, see internal/scan
+	ScanTimeout   time.Duration // Longest a scan may take, scan.DefaultTimeout if 0
+	ScanPromote   bool          // Store files whose scan timed out instead of quarantining them
+	StallTimeout  time.Duration // Abort a file transfer when no data arrives for this long, never if 0
+	MaxPause      time.Duration // Abort an upload its client paused for longer, wire.DefaultMaxPause if 0
+
+	// Tenants splits the server among these, refusing other clients. Each
+	// tenant's clients store in and see only its directory under
+	// UploadDir, within its limits, see internal/tenant. Not with Storage,
+	// Tokens or Codes.
+	Tenants *tenant.Set
+
+	Listeners []net.Listener          // Serve these, such as the sockets systemd passed, instead of listening on Addr
+	PortRetry int                     // Listen on one of this many ports above a listen address's port if it is in use
+	Listening func(net.Addr)          // Called with the address Serve accepts connections on once it does, e.g. to tell systemd the server is ready
+	WrapConn  func(net.Conn) net.Conn // Decorates each connection accepted, e.g. to impair it, see internal/netsim
+	Options
+
+	store   *store.Store
+	ranges  *rangeTable
+	tenants map[*tenant.Tenant]*Server // Serving each of Tenants
+}
+
+func (s *Server) maxPause() time.Duration {
+	if s.MaxPause > 0 {
+		return s.MaxPause
+	}
+	return wire.DefaultMaxPause
+}
+
+func (s *Server) uploadDir() string {
+	if s.UploadDir != "" {
+		return s.UploadDir
+	}
+	return "uploads"
+}
+
+func (s *Server) storeConfig() store.Config {
+	return store.Config{
+		Root:          s.uploadDir(),
+		PerClientDirs: s.PerClientDirs,
+		Layout:        s.Layout,
+		Policy: store.Policy{
+			MaxFileSize:  s.MaxFileSize,
+			ReserveSpace: s.ReserveSpace,
+			AcceptExt:    s.AcceptExt,
+			RejectExt:    s.RejectExt,
+			SniffTypes:   s.SniffTypes,
+			Retention:    retention.Policy{MaxAge: s.RetainAge, MaxBytes: s.RetainBytes, DryRun: s.RetainDryRun},
+		},
+		Live:          s.LivePolicy,
+		NoPreallocate: s.NoPreallocate,
+		HookCommand:   s.HookCommand,
+		HookURL:       s.HookURL,
+		HookStrict:    s.HookStrict,
+		Storage:       s.Storage,
+		AutoExtract:   s.AutoExtract,
+		Dedupe:        s.Dedupe,
+		StagingDir:    s.StagingDir,
+		Tokens:        s.Tokens,
+
+		MaxExtractSize:    s.ExtractSize,
+		MaxExtractEntries: s.ExtractCount,
+
+		CompletionMarker: s.Marker,
+		CompletedDir:     s.CompletedDir,
+
+		ScanCommand:          s.ScanCommand,
+		ScanTimeout:          s.ScanTimeout,
+		ScanPromoteOnTimeout: s.ScanPromote,
+	}
+}
+
+// ListenAndServe listens on s.Addr, s.Addrs or s.UnixSocket, or takes
+// s.Listeners, and serves connections until ctx ends, returning ctx's
+// error once every in-flight transfer has been aborted.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	if len(s.Listeners) > 0 {
+		return s.Serve(ctx, joinListeners(s.Listeners))
+	}
+	if s.UnixSocket != "" {
+		mode := s.SocketMode
+		if mode == 0 {
+			mode = DEFAULT_SOCKET_MODE
+		}
+		listener, err := unixsock.Listen(s.UnixSocket, mode)
+		if err != nil {
+			return fmt.Errorf("error starting TCP server: %w", err)
+		}
+		return s.Serve(ctx, listener)
+	}
+
+	addrs := s.Addrs
+	if len(addrs) == 0 {
+		addr := s.Addr
+		if addr == "" {
+			addr = wire.TCP_PORT
+		}
+		addrs = []string{addr}
+	}
+
+	listener, err := listenAll(addrs, s.PortRetry, s.BestEffort, s.logger())
+	if err != nil {
+		return fmt.Errorf("error starting TCP server: %w", err)
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve accepts connections on listener, handling each in its own
+// goroutine, until ctx ends. Ending ctx also aborts in-flight transfers;
+// Serve waits for their handlers to return. The listener is closed on
+// return.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	defer listener.Close()
+
+	// Hooks started in the background finish after the transfers
+	if s.Tenants != nil {
+		if err := s.openTenants(ctx); err != nil {
+			return err
+		}
+		defer s.closeTenants()
+	} else {
+		st, err := store.Open(s.storeConfig(), s.logger())
+		if err != nil {
+			return err
+		}
+		s.store = st
+		defer st.Close()
+		s.ranges = newRangeTable(ctx.Done())
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Unblock Accept once ctx ends
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	log := s.logger()
+	log.Info("TCP Server listening", "addr", listener.Addr())
+	if s.Listening != nil {
+		s.Listening(listener.Addr())
+	}
+
+	for {
+		// Accept incoming connections
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Error("Error accepting connection", "err", err)
+			continue
+		}
+
+		if s.WrapConn != nil {
+			conn = s.WrapConn(conn)
+		}
+
+		// Handle each connection in a separate goroutine
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleConnection(ctx, conn)
+		}()
+	}
+}
+
+// openTenants opens a store in the directory of each of s.Tenants, for
+// the copy of s that serves the tenant's connections.
+func (s *Server) openTenants(ctx context.Context) error {
+	if s.Storage != "" || s.Tokens != nil || s.Codes != nil {
+		return errors.New("tenants can't be served with remote storage, retrieval tokens or codes")
+	}
+	s.tenants = make(map[*tenant.Tenant]*Server)
+	for _, t := range s.Tenants.All() {
+		c := s.storeConfig()
+		c.Root = filepath.Join(c.Root, t.Directory())
+		if c.CompletedDir != "" {
+			c.CompletedDir = filepath.Join(c.CompletedDir, t.Directory())
+		}
+		c.SizeLimit, c.Quota = t.MaxFileSize, t.Quota
+		st, err := store.Open(c, s.logger().With("tenant", t.Name))
+		if err != nil {
+			s.closeTenants()
+			return err
+		}
+		ts := *s
+		ts.store, ts.ranges, ts.tenants = st, newRangeTable(ctx.Done()), nil
+		s.tenants[t] = &ts
+	}
+	return nil
+}
+
+func (s *Server) closeTenants() {
+	for _, ts := range s.tenants {
+		ts.store.Close()
+	}
+}
+
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// Closing the connection unblocks whatever read or write is pending,
+	// also when the transfer is killed
+	ctx, kill := context.WithCancelCause(ctx)
+	defer kill(nil)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	remote := remoteName(conn)
+	log := s.logger().With("remote", remote)
+	log.Info("New connection")
+
+	rep := s.reporter(remote)
+	defer rep.Close()
+	rep.SetCancel(kill)
+
+	log, err := s.receive(s.wrap(conn), log, rep)
+	if cause := context.Cause(ctx); err != nil && errors.Is(cause, wire.ErrKilled) {
+		// Like a client abort: the connection is gone, and the partial
+		// file with it
+		log.Warn("Transfer killed", "err", cause)
+		rep.Fail(cause)
+		return
+	}
+	err = wire.ContextError(ctx, err)
+	if errors.Is(err, wire.ErrAborted) {
+		// The client is gone, and its partial file with it
+		log.Warn("Transfer aborted", "err", err)
+		rep.Fail(err)
+		return
+	}
+	if errors.Is(err, wire.ErrPolicy) {
+		// The scanner's verdict, not a fault of ours or the client's
+		log.Warn("Transfer rejected by policy", "err", err)
+	} else if err != nil {
+		log.Error("Transfer failed", "err", err)
+	}
+	if err != nil {
+		rep.Fail(err)
+		if ctx.Err() == nil {
+			sendError(conn, err)
+		}
+	}
+}
+
+// handshakeTimeout is HANDSHAKE_TIMEOUT; tests shorten it to see silent
+// clients dropped
+var handshakeTimeout = HANDSHAKE_TIMEOUT
+
+// receive negotiates with the client and reads its file header, then
+// receives the file or, for FLAG_SESSION, serves the session's requests.
+// It returns log, tagged with the client's tenant once known.
+func (s *Server) receive(conn net.Conn, log *slog.Logger, rep *wire.Reporter) (*slog.Logger, error) {
+	// A client that connects and never says anything doesn't hold its
+	// handler forever
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	header, features, t, err := s.handshake(conn, log)
+	conn.SetReadDeadline(time.Time{})
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return log, fmt.Errorf("%w: no file header within %s", wire.ErrTimeout, handshakeTimeout)
+	}
+	if err != nil {
+		return log, err
+	}
+	if t != nil {
+		// From here on the tenant's store, directory and rate apply
+		log = log.With("tenant", t.Name)
+		log.Info("Tenant authenticated")
+		s = s.tenants[t]
+		conn = t.Limiter().Conn(conn)
+	}
+	if header.Flags&wire.FLAG_SESSION != 0 {
+		return log, s.serveSession(conn, log, rep)
+	}
+	return log, s.receiveFile(conn, header, features, log, rep)
+}
+
+// handshake reads the client's hello, answering it, its auth token when
+// serving Tenants, and its file header, returning the header, the
+// features both sides support and the client's tenant, if any.
+func (s *Server) handshake(conn net.Conn, log *slog.Logger) (*wire.FileHeader, uint32, *tenant.Tenant, error) {
+	// Versioned clients open with a hello, legacy ones with the file header
+	var magic [len(wire.MAGIC)]byte
+	_, err := io.ReadFull(conn, magic[:])
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("error reading hello: %w", err)
+	}
+	r := io.MultiReader(bytes.NewReader(magic[:]), conn)
+
+	var features uint32
+	if wire.HasMagic(magic[:]) {
+		common, err := acceptHello(r, conn, s.hello())
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		log.Debug("Negotiated protocol", "version", common.Version, "features", common.Features)
+		features = common.Features
+	} else if !s.Legacy {
+		return nil, 0, nil, fmt.Errorf("%w: client predates version negotiation, serve with -legacy to accept it", wire.ErrProtocol)
+	} else {
+		// Legacy clients only know the features header flags request; the
+		// others change what goes over the connection
+		features = hello.Features & 0xff
+	}
+
+	var t *tenant.Tenant
+	if s.Tenants != nil {
+		if t, err = s.authenticate(r, conn, features); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+
+	read := wire.ReadFileHeader
+	if features&wire.FEATURE_METADATA != 0 {
+		read = wire.ReadMetadata
+	}
+	header, err := read(r, wire.MAX_NAME_BYTES)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if uint32(header.Flags)&^features != 0 {
+		return nil, 0, nil, fmt.Errorf("%w: header flags %#x not negotiated", wire.ErrProtocol, header.Flags)
+	}
+	return header, features, t, nil
+}
+
+// hello returns what s speaks: a server with Tenants takes auth tokens.
+func (s *Server) hello() wire.Hello {
+	h := hello
+	if s.Tenants != nil {
+		h.Features |= wire.FEATURE_AUTH
+	}
+	return h
+}
+
+// authenticate returns the tenant the client is, by the auth token it
+// sent after the hellos if features include FEATURE_AUTH, else by the
+// common name of its TLS client certificate, failing with ErrRejected if
+// neither names one of s.Tenants.
+func (s *Server) authenticate(r io.Reader, conn net.Conn, features uint32) (*tenant.Tenant, error) {
+	if features&wire.FEATURE_AUTH != 0 {
+		token, err := wire.ReadAuth(r)
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := s.Tenants.ByToken(token); ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("%w: unknown auth token", wire.ErrRejected)
+	}
+	if cn := clientCN(conn); cn != "" {
+		if t, ok := s.Tenants.ByCN(cn); ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("%w: no tenant has client certificate %q", wire.ErrRejected, cn)
+	}
+	return nil, fmt.Errorf("%w: the server needs an auth token", wire.ErrRejected)
+}
+
+// clientCN returns the common name of the verified TLS client certificate
+// of conn, as a QUIC stream has, "" if there is none.
+func clientCN(conn net.Conn) string {
+	tc, ok := beneathWatchdogs(conn).(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return ""
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+// receiveFile stores the file header announces, reading its body from
+// conn, in segments the client may pause between or abort if features
+// include them, and telling it what takes so long once received if they
+// include FEATURE_HEARTBEAT. A partially received file is removed.
+func (s *Server) receiveFile(conn net.Conn, header *wire.FileHeader, features uint32, log *slog.Logger, rep *wire.Reporter) (err error) {
+	if s.StallTimeout > 0 {
+		watch := watchStall(conn, s.StallTimeout)
+		defer func() { err = watch.stop(err) }()
+		conn = watch
+	}
+	if features&segmentFeatures != 0 {
+		conn = &segmentConn{Conn: conn, maxPause: s.maxPause(), log: log, rep: rep}
+	}
+
+	if err := wire.CheckName(header.Name); err != nil {
+		return fmt.Errorf("%w: %w", wire.ErrProtocol, err)
+	}
+	if header.Size > math.MaxInt64 {
+		return fmt.Errorf("%w: file size %d", wire.ErrProtocol, header.Size)
+	}
+
+	filename := header.Name
+	fileSize := int64(header.Size)
+	log.Info("Receiving file", "name", filename, "size", fileSize)
+	rep.Start(filename, fileSize)
+
+	in, err := s.store.Place(conn.RemoteAddr(), filename, fileSize, header.Checksum, log)
+	if err != nil {
+		return err
+	}
+	if header.Flags&(wire.FLAG_RANGE|wire.FLAG_DELTA) == 0 {
+		in.Hash, _ = checksum.Negotiated(features)
+	}
+
+	// Let the client skip the body if we already hold an identical copy
+	if header.Flags&wire.FLAG_SKIP_IDENTICAL != 0 {
+		status := byte(STATUS_SEND)
+		if s.store.Local() && hashcache.Matches(in.Path, fileSize, header.Checksum) {
+			status = STATUS_SKIP
+		}
+
+		_, err = conn.Write([]byte{status})
+		if err != nil {
+			return fmt.Errorf("error sending skip status: %w", err)
+		}
+
+		if status == STATUS_SKIP {
+			log.Info("Skipped, identical copy already stored", "path", in.Path)
+			rep.Complete(0)
+			return nil
+		}
+	}
+
+	if header.Flags&wire.FLAG_RANGE != 0 {
+		return s.receiveRange(conn, header, in, features, log, rep)
+	}
+	switch header.Flags & (wire.FLAG_DELTA | wire.FLAG_SPARSE) {
+	case wire.FLAG_DELTA:
+		return s.receiveDelta(conn, in, features, log, rep)
+	case wire.FLAG_SPARSE:
+		return s.receiveSparse(conn, in, features, log, rep)
+	case wire.FLAG_DELTA | wire.FLAG_SPARSE:
+		return fmt.Errorf("%w: a delta transfer can't be sparse", wire.ErrProtocol)
+	}
+
+	if err := in.Create(); err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Receive file data
+	if err := receiveData(conn, in, fileSize, s.bufferSize(), rep); err != nil {
+		return err
+	}
+	if err := checkDigest(conn, in, features); err != nil {
+		return err
+	}
+
+	// Clients send nothing more until we confirm the file, so data
+	// arriving now means it was larger than announced
+	if trailingData(conn) {
+		in.Quarantine("oversized")
+		return fmt.Errorf("%w: client sent more than the announced %d bytes", wire.ErrProtocol, fileSize)
+	}
+
+	beat := startHeartbeat(conn, features, in.Status)
+	upload, err := in.Commit()
+	beat.stop()
+	if err != nil {
+		return err
+	}
+	log.Info("File saved", "path", upload.Path, "bytes", upload.Size, "duration", time.Since(in.Started()))
+
+	// Confirm the file is stored
+	err = confirmStored(conn, in, upload.Size, features)
+	if err != nil {
+		return fmt.Errorf("error sending status: %w", err)
+	}
+	rep.Complete(fileSize)
+	return nil
+}
+
+// confirmStored tells the client in is stored, STATUS_OK or
+// STATUS_DEDUPED, followed by a receipt for size bytes if features include
+// FEATURE_RECEIPT, with in's token if they include FEATURE_TOKEN.
+func confirmStored(conn net.Conn, in *store.Incoming, size int64, features uint32) error {
+	b := []byte{STATUS_OK}
+	if in.Linked != "" {
+		b[0] = STATUS_DEDUPED
+	}
+	if features&wire.FEATURE_RECEIPT != 0 {
+		receipt, err := (&wire.Receipt{Bytes: uint64(size), Path: in.StoredName(), Token: in.Token}).Marshal(features)
+		if err != nil {
+			return err
+		}
+		b = append(b, receipt...)
+	}
+	_, err := conn.Write(b)
+	return err
+}
+
+// receiveData writes what arrives on conn to in, size bytes at most at a
+// time, until it holds end bytes. A file cut short by the client closing
+// the connection is quarantined.
+func receiveData(conn net.Conn, in *store.Incoming, end int64, size int, rep *wire.Reporter) error {
+	for in.Written() < end {
+		// Hashed while the next chunk is read and written
+		buffer := in.Buffer(size)
+		readSize := min(int64(len(buffer)), end-in.Written())
+		n, err := conn.Read(buffer[:readSize])
+		if err == io.EOF {
+			in.Quarantine("truncated")
+			return fmt.Errorf("%w: connection closed after %d of %d bytes", wire.ErrProtocol, in.Written(), in.Size)
+		}
+		if err != nil {
+			return fmt.Errorf("error reading data: %w", err)
+		}
+
+		// Gives up on unwanted content before receiving the rest
+		if _, err := in.Write(buffer[:n]); err != nil {
+			return err
+		}
+		rep.Progress(in.Written())
+	}
+	return nil
+}
+
+// trailingData reports whether more data arrives on conn within
+// TRAILING_WAIT. It reads the connection beneath the watchdogs, so the wait
+// is the same whatever their timeouts.
+func trailingData(conn net.Conn) bool {
+	conn = beneathWatchdogs(conn)
+	conn.SetReadDeadline(time.Now().Add(TRAILING_WAIT))
+	defer conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	n, _ := conn.Read(b[:])
+	return n > 0
+}
+
+// beneathWatchdogs returns the connection conn wraps to time out reads
+// or pass on segments.
+func beneathWatchdogs(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *stallConn:
+			conn = c.Conn
+		case *timeoutConn:
+			conn = c.Conn
+		case *segmentConn:
+			conn = c.Conn
+		default:
+			return conn
+		}
+	}
+}
+
+// acceptHello answers the client's hello with local and returns what
+// both sides support.
+func acceptHello(r io.Reader, w io.Writer, local wire.Hello) (wire.Hello, error) {
+	peer, err := wire.ReadHello(r)
+	if err != nil {
+		return wire.Hello{}, err
+	}
+	common, err := wire.Negotiate(local, *peer)
+	if err != nil {
+		return wire.Hello{}, err
+	}
+
+	b, _ := local.MarshalBinary()
+	_, err = w.Write(b)
+	if err != nil {
+		return wire.Hello{}, fmt.Errorf("error sending hello: %w", err)
+	}
+	return common, nil
+}
@@ -0,0 +1,596 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// FileInfo describes a file stored on a Server.
+type FileInfo = wire.FileInfo
+
+// serveSession answers the requests of a session until the client closes
+// the connection. A failed request is answered with an error frame and the
+// session goes on, except for uploads and downloads: their body may be
+// half sent, so their failure ends the session.
+func (s *Server) serveSession(conn net.Conn, log *slog.Logger, rep *wire.Reporter) error {
+	root, err := s.store.ClientRoot(conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	log.Info("Session opened")
+
+	for {
+		req, err := wire.ReadRequest(conn)
+		if errors.Is(err, io.EOF) {
+			log.Info("Session closed")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.Op != wire.REQ_LIST && req.Op != wire.REQ_PING {
+			if err := wire.CheckName(req.Name); err != nil {
+				return fmt.Errorf("%w: %w", wire.ErrProtocol, err)
+			}
+		}
+		path := filepath.Join(root, wire.LocalName(root, req.Name))
+		name := s.store.Name(path)
+
+		var reply []byte
+		switch req.Op {
+		case wire.REQ_PING:
+		case wire.REQ_LIST:
+			reply, err = s.listFiles(s.store.Name(root))
+		case wire.REQ_STAT:
+			reply, err = s.statFile(name, req.Name)
+		case wire.REQ_DELETE:
+			err = s.deleteFile(name, req.Name)
+			if err == nil {
+				log.Info("File deleted", "path", s.store.Storage.Location(name))
+			}
+		case wire.REQ_PUT:
+			var size [8]byte
+			if _, err := io.ReadFull(conn, size[:]); err != nil {
+				return fmt.Errorf("error reading file size: %w", err)
+			}
+			header := &wire.FileHeader{Name: req.Name, Size: binary.BigEndian.Uint64(size[:])}
+			if err := s.receiveFile(conn, header, 0, log, rep); err != nil {
+				return err
+			}
+			continue
+		case wire.REQ_GET:
+			var file io.ReadCloser
+			var size int64
+			file, size, err = s.openStored(name, req.Name)
+			if err == nil {
+				err = s.sendStored(conn, file, size)
+				file.Close()
+				if err != nil {
+					return err
+				}
+				log.Info("File fetched", "path", s.store.Storage.Location(name), "bytes", size)
+				continue
+			}
+		case wire.REQ_STAGE:
+			if err := s.stageFile(conn, req.Name, log, rep); err != nil {
+				return err
+			}
+			continue
+		case wire.REQ_CLAIM:
+			if err := s.claimFile(conn, req.Name, log); err != nil {
+				return err
+			}
+			continue
+		default:
+			return fmt.Errorf("%w: unknown request %#x", wire.ErrProtocol, req.Op)
+		}
+
+		if err != nil {
+			log.Warn("Request failed", "op", req.Op, "name", req.Name, "err", err)
+		}
+		if err := s.reply(conn, reply, err); err != nil {
+			return err
+		}
+	}
+}
+
+// reply answers a request with STATUS_OK and reply, or with the error
+// frame of err if not nil.
+func (s *Server) reply(conn net.Conn, reply []byte, err error) error {
+	if err != nil {
+		frame, _ := wire.NewRemoteError(err).MarshalBinary()
+		reply = append([]byte{STATUS_ERROR}, frame...)
+	} else {
+		reply = append([]byte{STATUS_OK}, reply...)
+	}
+	if _, err := conn.Write(reply); err != nil {
+		return fmt.Errorf("error sending reply: %w", err)
+	}
+	return nil
+}
+
+// listFiles encodes the count and descriptions of the files in dir.
+func (s *Server) listFiles(dir string) ([]byte, error) {
+	infos, err := s.store.List(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error listing files: %w", wire.ErrRejected, err)
+	}
+
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(infos)))
+	for _, info := range infos {
+		if b, err = info.AppendBinary(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// statFile encodes the description of the stored file name, which the
+// client calls clientName.
+func (s *Server) statFile(name, clientName string) ([]byte, error) {
+	info, err := s.store.Stat(name)
+	if err != nil {
+		return nil, notFound(clientName, err)
+	}
+	fi := wire.FileInfo{Name: clientName, Size: info.Size, ModTime: info.ModTime}
+	return fi.AppendBinary(nil)
+}
+
+func (s *Server) deleteFile(name, clientName string) error {
+	if !s.AllowDelete {
+		return fmt.Errorf("%w: deleting files is not allowed on this server", wire.ErrRejected)
+	}
+	if err := s.store.Remove(name); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return notFound(clientName, err)
+		}
+		return fmt.Errorf("%w: error deleting %q: %w", wire.ErrRejected, clientName, err)
+	}
+	return nil
+}
+
+// openStored opens the stored file name for REQ_GET.
+func (s *Server) openStored(name, clientName string) (io.ReadCloser, int64, error) {
+	info, err := s.store.Storage.Stat(name)
+	if err != nil {
+		return nil, 0, notFound(clientName, err)
+	}
+	file, err := s.store.Storage.Open(name)
+	if err != nil {
+		return nil, 0, notFound(clientName, err)
+	}
+	return file, info.Size, nil
+}
+
+// sendStored answers REQ_GET with STATUS_OK, the file's 64-bit size, its
+// body and its SHA-256.
+func (s *Server) sendStored(conn net.Conn, file io.Reader, size int64) error {
+	b := binary.BigEndian.AppendUint64([]byte{STATUS_OK}, uint64(size))
+	if _, err := conn.Write(b); err != nil {
+		return fmt.Errorf("error sending file size: %w", err)
+	}
+	return s.sendBody(conn, file, size)
+}
+
+// sendBody sends size bytes of file and their SHA-256.
+func (s *Server) sendBody(conn net.Conn, file io.Reader, size int64) error {
+	pooled := getBuffer(s.bufferSize())
+	defer putBuffer(pooled)
+	hasher := sha256.New()
+	n, err := io.CopyBuffer(writerOnly{conn}, io.TeeReader(io.LimitReader(file, size), hasher), (*pooled)[:s.bufferSize()])
+	if err != nil {
+		return fmt.Errorf("error sending data: %w", err)
+	}
+	if n < size {
+		return fmt.Errorf("file ended after %d of %d bytes", n, size)
+	}
+	if _, err := conn.Write(hasher.Sum(nil)); err != nil {
+		return fmt.Errorf("error sending checksum: %w", err)
+	}
+	return nil
+}
+
+// notFound reports that name isn't a stored file, with err as the reason
+// if it is anything other than the file not existing.
+func notFound(name string, err error) error {
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %q", wire.ErrNotFound, name)
+	}
+	return fmt.Errorf("%w: %q: %w", wire.ErrRejected, name, err)
+}
+
+// Session is a connection to a Server that carries any number of requests,
+// one after another. Methods must not be called concurrently. Should the
+// connection drop, the next call reconnects, and a call it dropped under
+// is run once more on a new connection, a Put sending its file from the
+// start. Ending the context of a call drops the connection too; failures
+// the server reports leave it as it was. While idle the session pings the
+// server every Options.KeepAlive, so NAT mappings along the way don't
+// expire.
+type Session struct {
+	client *Client
+	addr   string
+	opts   Options
+
+	mu       sync.Mutex // Held by a call or a ping
+	conn     net.Conn   // Nil once dropped
+	features uint32
+	ping     *time.Timer // Guarded by mu
+	closed   bool
+}
+
+// OpenSession connects to the server at addr and opens a session.
+func (c *Client) OpenSession(ctx context.Context, addr string, opts Options) (*Session, error) {
+	s := &Session{client: c, addr: addr, opts: opts}
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+	if interval := s.keepAlive(); interval > 0 {
+		// Held so the first ping, which resets the timer, sees it
+		s.mu.Lock()
+		s.ping = time.AfterFunc(interval, s.pingIdle)
+		s.mu.Unlock()
+	}
+	return s, nil
+}
+
+// connect opens the session's connection.
+func (s *Session) connect(ctx context.Context) error {
+	conn, err := s.client.dial(ctx, s.addr)
+	if err != nil {
+		return wire.ContextError(ctx, fmt.Errorf("error connecting to server: %w", err))
+	}
+	conn = s.opts.wrap(conn)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	common, err := offerHello(conn, 0, s.opts.AuthToken)
+	if err == nil && common.Features&wire.FEATURE_SESSION == 0 {
+		err = fmt.Errorf("%w: server does not support sessions", wire.ErrProtocol)
+	}
+	if err == nil {
+		if werr := writeHeader(conn, &wire.FileHeader{Flags: wire.FLAG_SESSION}, common.Features); werr != nil {
+			err = fmt.Errorf("error opening session: %w", werr)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return wire.ContextError(ctx, err)
+	}
+	s.conn, s.features = conn, common.Features
+	s.opts.logger().Info("Session opened", "addr", s.addr)
+	return nil
+}
+
+// Close ends the session, which the server sees as its connection
+// closing.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.ping != nil {
+		s.ping.Stop()
+	}
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// do runs fn on the session's connection, reconnecting first if it
+// dropped, and once more on a new connection if it drops during fn. Ending
+// ctx closes the connection. The connection is dropped after any other
+// failure, except one the server reports when inStep says the stream is
+// still in step after it.
+func (s *Session) do(ctx context.Context, inStep bool, fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("session closed: %w", net.ErrClosed)
+	}
+	defer s.idle()
+
+	for retried := false; ; retried = true {
+		if s.conn == nil {
+			if err := s.connect(ctx); err != nil {
+				return err
+			}
+		}
+		conn := s.conn
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		err := fn()
+		stop()
+		if err == nil {
+			return nil
+		}
+
+		var rerr *RemoteError
+		if inStep && errors.As(err, &rerr) {
+			return err
+		}
+		conn.Close()
+		s.conn = nil
+		if retried || ctx.Err() != nil || !connectionLost(err) {
+			return wire.ContextError(ctx, err)
+		}
+		s.opts.logger().Warn("Session connection lost, reconnecting", "addr", s.addr, "err", err)
+	}
+}
+
+// connectionLost reports whether err means the connection dropped, rather
+// than the server refusing a request or a local failure.
+func connectionLost(err error) bool {
+	var rerr *RemoteError
+	if errors.As(err, &rerr) {
+		return false
+	}
+	var nerr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.As(err, &nerr)
+}
+
+func (s *Session) keepAlive() time.Duration {
+	if s.opts.KeepAlive == 0 {
+		return DefaultKeepAlive
+	}
+	return s.opts.KeepAlive
+}
+
+// idle restarts the wait before the next ping. s.mu must be held.
+func (s *Session) idle() {
+	if s.ping != nil && !s.closed {
+		s.ping.Reset(s.keepAlive())
+	}
+}
+
+// pingIdle pings the server unless a call is under way, which restarts the
+// wait itself. A connection that doesn't answer is dropped for the next
+// call to replace.
+func (s *Session) pingIdle() {
+	if !s.mu.TryLock() {
+		return
+	}
+	defer s.mu.Unlock()
+	if s.closed || s.conn == nil || s.features&wire.FEATURE_PING == 0 {
+		return
+	}
+	s.conn.SetDeadline(time.Now().Add(PING_TIMEOUT))
+	err := s.request(wire.REQ_PING, "")
+	s.conn.SetDeadline(time.Time{})
+	if err != nil {
+		s.opts.logger().Debug("Session ping failed", "addr", s.addr, "err", err)
+		s.conn.Close()
+		s.conn = nil
+		return
+	}
+	s.idle()
+}
+
+// request sends a request and reads the status of its reply.
+func (s *Session) request(op byte, name string) error {
+	b, err := (&wire.Request{Op: op, Name: name}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	_, err = readStatus(s.conn, "reply")
+	return err
+}
+
+// List describes the files stored on the server, leaving out files the
+// server's layout put in subdirectories.
+func (s *Session) List(ctx context.Context) ([]FileInfo, error) {
+	var infos []FileInfo
+	err := s.do(ctx, true, func() error {
+		infos = nil
+		if err := s.request(wire.REQ_LIST, ""); err != nil {
+			return err
+		}
+		var count [4]byte
+		if _, err := io.ReadFull(s.conn, count[:]); err != nil {
+			return fmt.Errorf("error reading listing: %w", err)
+		}
+		for i := binary.BigEndian.Uint32(count[:]); i > 0; i-- {
+			info, err := wire.ReadFileInfo(s.conn)
+			if err != nil {
+				return err
+			}
+			infos = append(infos, *info)
+		}
+		return nil
+	})
+	return infos, err
+}
+
+// Stat describes the stored file name, failing with ErrNotFound if there
+// is none.
+func (s *Session) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	if err := wire.CheckName(name); err != nil {
+		return nil, err
+	}
+	var info *FileInfo
+	err := s.do(ctx, true, func() error {
+		if err := s.request(wire.REQ_STAT, name); err != nil {
+			return err
+		}
+		var err error
+		info, err = wire.ReadFileInfo(s.conn)
+		return err
+	})
+	return info, err
+}
+
+// Remove deletes the stored file name. Servers refuse it with ErrRejected
+// unless they allow deleting.
+func (s *Session) Remove(ctx context.Context, name string) error {
+	if err := wire.CheckName(name); err != nil {
+		return err
+	}
+	return s.do(ctx, true, func() error {
+		return s.request(wire.REQ_DELETE, name)
+	})
+}
+
+// Put uploads the file at path, stored on the server as name, or as the
+// file's base name if name is empty.
+func (s *Session) Put(ctx context.Context, path, name string) (*Result, error) {
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	if err := wire.CheckName(name); err != nil {
+		return nil, err
+	}
+	file, err := wire.OpenSource(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	size := file.Size
+
+	rep := s.opts.reporter(s.addr)
+	defer rep.Close()
+	var res *Result
+	err = s.do(ctx, false, func() error {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("error reading file: %w", err)
+		}
+		b, err := (&wire.Request{Op: wire.REQ_PUT, Name: name}).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		b = binary.BigEndian.AppendUint64(b, uint64(size))
+		if _, err := s.conn.Write(b); err != nil {
+			return fmt.Errorf("error sending request: %w", err)
+		}
+
+		rep.Start(name, size)
+		start := time.Now()
+		hasher := sha256.New()
+		src, stopReading := wire.ReadAhead(ctx, file, s.opts.bufferSize())
+		defer stopReading()
+		n, err := s.copy(s.conn, io.TeeReader(src, hasher), size, rep)
+		if err != nil {
+			return serverError(s.conn, s.conn, err)
+		}
+		if _, err := readStatus(s.conn, "status"); err != nil {
+			return err
+		}
+		res = &Result{Bytes: n, Duration: time.Since(start), Checksum: hasher.Sum(nil)}
+		return nil
+	})
+	if err != nil {
+		rep.Fail(err)
+		return nil, err
+	}
+	// The session outlives a file that changed
+	if err := file.Check(s.opts.logger()); err != nil {
+		rep.Fail(err)
+		return nil, err
+	}
+	rep.Complete(res.Bytes)
+	return res, nil
+}
+
+// Get downloads the stored file name to path, checking it against the
+// SHA-256 the server sends. The file is received under a temporary name,
+// so a failed download leaves path as it was.
+func (s *Session) Get(ctx context.Context, name, path string) (res *Result, err error) {
+	if err := wire.CheckName(name); err != nil {
+		return nil, err
+	}
+	rep := s.opts.reporter(s.addr)
+	defer rep.Close()
+
+	// Only a refused request leaves the stream in step
+	err = s.do(ctx, true, func() error {
+		if err := s.request(wire.REQ_GET, name); err != nil {
+			return err
+		}
+		var sizeBuf [8]byte
+		if _, err := io.ReadFull(s.conn, sizeBuf[:]); err != nil {
+			return fmt.Errorf("error reading file size: %w", err)
+		}
+		res, err = s.receive(name, int64(binary.BigEndian.Uint64(sizeBuf[:])), path, rep)
+		return err
+	})
+	if err != nil {
+		rep.Fail(err)
+		return nil, err
+	}
+	rep.Complete(res.Bytes)
+	return res, nil
+}
+
+// receive downloads the body of size bytes and SHA-256 that answer a
+// request for the file name to path, under a temporary name until checked.
+func (s *Session) receive(name string, size int64, path string, rep *wire.Reporter) (*Result, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), wire.PartPattern(filepath.Base(path)))
+	if err != nil {
+		return nil, fmt.Errorf("error creating file: %w", err)
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	rep.Start(name, size)
+	start := time.Now()
+	hasher := sha256.New()
+	n, err := s.copy(io.MultiWriter(file, hasher), s.conn, size, rep)
+	if err != nil {
+		return nil, err
+	}
+	sum := make([]byte, wire.CHECKSUM_LEN)
+	if _, err := io.ReadFull(s.conn, sum); err != nil {
+		return nil, fmt.Errorf("error reading checksum: %w", err)
+	}
+	if !bytes.Equal(sum, hasher.Sum(nil)) {
+		return nil, fmt.Errorf("%w: %s", wire.ErrChecksumMismatch, name)
+	}
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("error writing file: %w", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return nil, fmt.Errorf("error storing file: %w", err)
+	}
+	return &Result{Bytes: n, Duration: time.Since(start), Checksum: sum}, nil
+}
+
+// copy moves size bytes from src to dst, reporting progress.
+func (s *Session) copy(dst io.Writer, src io.Reader, size int64, rep *wire.Reporter) (int64, error) {
+	buffer := make([]byte, s.opts.bufferSize())
+	var done int64
+	for done < size {
+		n, err := io.CopyBuffer(writerOnly{dst}, io.LimitReader(src, min(int64(len(buffer)), size-done)), buffer)
+		done += n
+		if errors.Is(err, wire.ErrSourceStalled) {
+			return done, fmt.Errorf("error reading file after %d of %d bytes: %w", done, size, err)
+		}
+		if err != nil {
+			return done, fmt.Errorf("error transferring data: %w", err)
+		}
+		if n == 0 {
+			return done, fmt.Errorf("data ended after %d of %d bytes", done, size)
+		}
+		rep.Progress(done)
+	}
+	return done, nil
+}
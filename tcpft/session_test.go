@@ -0,0 +1,271 @@
+package tcpft
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// openSession opens a session to the server at addr, closed when the test
+// ends.
+func openSession(t *testing.T, addr string) *Session {
+	t.Helper()
+	var c Client
+	sess, err := c.OpenSession(context.Background(), addr, quietOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sess.Close() })
+	return sess
+}
+
+func TestSessionCommands(t *testing.T) {
+	s := &Server{}
+	addr := serve(t, s)
+	sess := openSession(t, addr)
+	ctx := context.Background()
+	data := []byte("session data")
+
+	if _, err := sess.Put(ctx, writeFile(t, "local.txt", data), ""); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := sess.Put(ctx, writeFile(t, "other", []byte("x")), "renamed.txt"); err != nil {
+		t.Fatalf("Put with a name: %v", err)
+	}
+	checkStored(t, s.UploadDir, "local.txt", data)
+	checkStored(t, s.UploadDir, "renamed.txt", []byte("x"))
+
+	infos, err := sess.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	sizes := map[string]int64{}
+	for _, info := range infos {
+		sizes[info.Name] = info.Size
+	}
+	if len(sizes) != 2 || sizes["local.txt"] != int64(len(data)) || sizes["renamed.txt"] != 1 {
+		t.Errorf("List = %v, want local.txt and renamed.txt", infos)
+	}
+
+	info, err := sess.Stat(ctx, "local.txt")
+	if err != nil || info.Name != "local.txt" || info.Size != int64(len(data)) || time.Since(info.ModTime) > time.Minute {
+		t.Errorf("Stat = %+v, %v", info, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "fetched")
+	if _, err := sess.Get(ctx, "local.txt", path); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	checkStored(t, filepath.Dir(path), "fetched", data)
+
+	// Refusals leave the session usable
+	if _, err := sess.Stat(ctx, "missing"); !errors.Is(err, wire.ErrNotFound) {
+		t.Errorf("Stat of a missing file: got %v, want ErrNotFound", err)
+	}
+	if _, err := sess.Get(ctx, "missing", path+"2"); !errors.Is(err, wire.ErrNotFound) {
+		t.Errorf("Get of a missing file: got %v, want ErrNotFound", err)
+	}
+	if _, err := os.Stat(path + "2"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("failed Get left %s behind", path+"2")
+	}
+	if err := sess.Remove(ctx, "local.txt"); !errors.Is(err, ErrRejected) {
+		t.Errorf("Remove without -allow-delete: got %v, want ErrRejected", err)
+	}
+	checkStored(t, s.UploadDir, "local.txt", data)
+	if _, err := sess.List(ctx); err != nil {
+		t.Errorf("List after refusals: %v", err)
+	}
+}
+
+func TestSessionRemove(t *testing.T) {
+	s := &Server{AllowDelete: true}
+	addr := serve(t, s)
+	sess := openSession(t, addr)
+	ctx := context.Background()
+
+	if _, err := sess.Put(ctx, writeFile(t, "gone.txt", []byte("x")), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Remove(ctx, "gone.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.UploadDir, "gone.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("removed file still stored: %v", err)
+	}
+	if err := sess.Remove(ctx, "gone.txt"); !errors.Is(err, wire.ErrNotFound) {
+		t.Errorf("second Remove: got %v, want ErrNotFound", err)
+	}
+}
+
+// Names that would leave the uploads directory are refused by the client,
+// and by the server from clients that skip the check.
+func TestSessionNames(t *testing.T) {
+	s := &Server{AllowDelete: true}
+	addr := serve(t, s)
+	sess := openSession(t, addr)
+	ctx := context.Background()
+
+	for _, name := range []string{"../escape", "a/b", "..", ""} {
+		if _, err := sess.Stat(ctx, name); !errors.Is(err, wire.ErrInvalidName) {
+			t.Errorf("Stat(%q): got %v, want ErrInvalidName", name, err)
+		}
+		if err := sess.Remove(ctx, name); !errors.Is(err, wire.ErrInvalidName) {
+			t.Errorf("Remove(%q): got %v, want ErrInvalidName", name, err)
+		}
+		if _, err := sess.Get(ctx, name, filepath.Join(t.TempDir(), "x")); !errors.Is(err, wire.ErrInvalidName) {
+			t.Errorf("Get(%q): got %v, want ErrInvalidName", name, err)
+		}
+	}
+	if _, err := sess.Put(ctx, writeFile(t, "f", nil), "../f"); !errors.Is(err, wire.ErrInvalidName) {
+		t.Errorf("Put as ../f: got %v, want ErrInvalidName", err)
+	}
+
+	// A raw request for ../ ends the session without touching the file
+	outside := filepath.Join(filepath.Dir(s.UploadDir), "outside")
+	os.WriteFile(outside, []byte("keep"), 0644)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	common, err := offerHello(conn, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHeader(conn, &wire.FileHeader{Flags: wire.FLAG_SESSION}, common.Features); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := (&wire.Request{Op: wire.REQ_DELETE, Name: "../outside"}).MarshalBinary()
+	conn.Write(b)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := readStatus(conn, "reply"); err == nil {
+		t.Error("server answered a request for ../outside")
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file outside the uploads directory: %v", err)
+	}
+}
+
+// A session whose connection drops reconnects for the next call.
+func TestSessionReconnects(t *testing.T) {
+	addr := serve(t, &Server{})
+	sess := openSession(t, addr)
+	sess.conn.Close()
+	if _, err := sess.List(context.Background()); err != nil {
+		t.Fatalf("List after the connection dropped: %v", err)
+	}
+}
+
+// A session survives the server going away between files, once it is
+// back on the same address.
+func TestSessionServerRestart(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		(&Server{UploadDir: dir, Options: quietOptions()}).Serve(ctx, ln)
+	}()
+
+	sess := openSession(t, addr)
+	if _, err := sess.Put(context.Background(), writeFile(t, "first", []byte("1")), ""); err != nil {
+		t.Fatalf("Put before the restart: %v", err)
+	}
+	cancel()
+	<-done
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveOn(t, &Server{UploadDir: dir, Options: quietOptions()}, ln)
+	if _, err := sess.Put(context.Background(), writeFile(t, "second", []byte("2")), ""); err != nil {
+		t.Fatalf("Put after the restart: %v", err)
+	}
+	checkStored(t, dir, "first", []byte("1"))
+	checkStored(t, dir, "second", []byte("2"))
+}
+
+// A Put whose connection drops part way is sent again on a new one.
+func TestSessionPutRetried(t *testing.T) {
+	s := &Server{Options: quietOptions()}
+	addr := serve(t, s)
+	var dials atomic.Int32
+	c := &Client{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err == nil && dials.Add(1) == 1 {
+			return &cutConn{Conn: conn, limit: 2 << 20}, nil
+		}
+		return conn, err
+	}}
+	sess, err := c.OpenSession(context.Background(), addr, quietOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+	if _, err := sess.Put(context.Background(), writeFile(t, "f.bin", data), ""); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	checkStored(t, s.UploadDir, "f.bin", data)
+	if n := dials.Load(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+}
+
+// pingCounter counts the pings written through it.
+type pingCounter struct {
+	net.Conn
+	pings *atomic.Int32
+}
+
+func (c *pingCounter) Write(b []byte) (int, error) {
+	if len(b) == wire.REQUEST_LEN && b[0] == wire.REQ_PING {
+		c.pings.Add(1)
+	}
+	return c.Conn.Write(b)
+}
+
+// An idle session pings the server, which answers, leaving the session
+// usable.
+func TestSessionKeepAlive(t *testing.T) {
+	addr := serve(t, &Server{})
+	var pings atomic.Int32
+	c := &Client{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &pingCounter{Conn: conn, pings: &pings}, nil
+	}}
+	opts := quietOptions()
+	opts.KeepAlive = 20 * time.Millisecond
+	sess, err := c.OpenSession(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	if n := pings.Load(); n < 3 {
+		t.Errorf("%d pings while idle, want several", n)
+	}
+	if _, err := sess.List(context.Background()); err != nil {
+		t.Errorf("List after pings: %v", err)
+	}
+}
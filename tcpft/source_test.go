@@ -0,0 +1,124 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// gateListener holds the first connection's reads once after bytes have
+// arrived, until the test lets it go, so the test can change the file
+// while the client is sending it.
+type gateListener struct {
+	net.Listener
+	after   int
+	reached chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (l *gateListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &gateConn{Conn: conn, l: l}, nil
+}
+
+type gateConn struct {
+	net.Conn
+	l    *gateListener
+	read int
+}
+
+func (c *gateConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read += n
+	if c.read >= c.l.after {
+		c.l.once.Do(func() {
+			close(c.l.reached)
+			<-c.l.release
+		})
+	}
+	return n, err
+}
+
+// A file that changes while it is sent: one that grew is sent at its
+// original size, one that shrank or was rewritten fails.
+func TestFileChangesWhileSent(t *testing.T) {
+	const size = 16 << 20
+	tests := []struct {
+		name   string
+		change func(path string) error
+		fails  bool
+		want   error // What the failure wraps, if anything in particular
+	}{
+		{"grew", func(path string) error {
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.Write(make([]byte, 4096))
+			return err
+		}, false, nil},
+		{"shrank", func(path string) error { return os.Truncate(path, 1<<20) }, true, nil},
+		{"rewritten", func(path string) error {
+			f, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := f.WriteAt([]byte("changed"), size-100); err != nil {
+				return err
+			}
+			later := time.Now().Add(time.Hour)
+			return os.Chtimes(path, later, later)
+		}, true, wire.ErrFileChanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			gate := &gateListener{Listener: ln, after: 64 << 10, reached: make(chan struct{}), release: make(chan struct{})}
+			s := &Server{}
+			serveOn(t, s, gate)
+
+			data := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+			path := writeFile(t, "f.bin", data)
+			changed := make(chan error, 1)
+			go func() {
+				<-gate.reached
+				changed <- tt.change(path)
+				close(gate.release)
+			}()
+
+			_, err = (&Client{}).SendFile(context.Background(), ln.Addr().String(), path, quietOptions())
+			if cerr := <-changed; cerr != nil {
+				t.Fatal(cerr)
+			}
+			if !tt.fails {
+				if err != nil {
+					t.Fatalf("SendFile: %v", err)
+				}
+				checkStored(t, s.UploadDir, "f.bin", data)
+				return
+			}
+			if err == nil {
+				t.Fatal("SendFile succeeded")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
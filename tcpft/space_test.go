@@ -0,0 +1,31 @@
+package tcpft
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// A file that would eat into the reserve is refused before any of it is
+// sent, and nothing is left stored.
+func TestNoSpaceRefused(t *testing.T) {
+	s := &Server{ReserveSpace: 1 << 62}
+	addr := serve(t, s)
+	path := writeFile(t, "big.bin", make([]byte, 1<<20))
+
+	var c Client
+	start := time.Now()
+	_, err := c.SendFile(context.Background(), addr, path, quietOptions())
+	if !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("got %v, want ErrNoSpace", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("refused after %v, want at once", elapsed)
+	}
+	if !dirEmpty(t, s.UploadDir) {
+		names, _ := os.ReadDir(s.UploadDir)
+		t.Errorf("refused upload left %v", names)
+	}
+}
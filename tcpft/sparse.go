@@ -0,0 +1,155 @@
+package tcpft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"socket-file-transfer/internal/sparse"
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/wire"
+)
+
+// receiveSparse stores a file sent as its data extents, leaving the holes
+// between them unwritten where the storage can keep them. The body is a
+// series of extents, each framed by its offset and length, ending with an
+// empty extent at the file's size.
+func (s *Server) receiveSparse(conn net.Conn, in *store.Incoming, features uint32, log *slog.Logger, rep *wire.Reporter) error {
+	fileSize := in.Size
+	in.Sparse = true
+	if err := in.Create(); err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var frame [EXTENT_HEADER_LEN]byte
+	var data int64
+	for {
+		if _, err := io.ReadFull(conn, frame[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				in.Quarantine("truncated")
+				return fmt.Errorf("%w: connection closed after %d of %d bytes", wire.ErrProtocol, in.Written(), fileSize)
+			}
+			return fmt.Errorf("error reading extent: %w", err)
+		}
+		offset := binary.BigEndian.Uint64(frame[:])
+		length := binary.BigEndian.Uint64(frame[8:])
+		if offset < uint64(in.Written()) || offset > uint64(fileSize) || length > uint64(fileSize)-offset {
+			return fmt.Errorf("%w: extent of %d bytes at %d after %d of %d bytes", wire.ErrProtocol, length, offset, in.Written(), fileSize)
+		}
+		if length == 0 && offset != uint64(fileSize) {
+			return fmt.Errorf("%w: extents end at %d of %d bytes", wire.ErrProtocol, offset, fileSize)
+		}
+
+		if err := in.Hole(int64(offset) - in.Written()); err != nil {
+			return err
+		}
+		if length == 0 {
+			break
+		}
+		if err := receiveData(conn, in, int64(offset+length), s.bufferSize(), rep); err != nil {
+			return err
+		}
+		data += int64(length)
+	}
+	if err := checkDigest(conn, in, features); err != nil {
+		return err
+	}
+
+	// Clients send nothing more until we confirm the file, so data
+	// arriving now means it was larger than announced
+	if trailingData(conn) {
+		in.Quarantine("oversized")
+		return fmt.Errorf("%w: client sent more than the announced %d bytes", wire.ErrProtocol, fileSize)
+	}
+
+	beat := startHeartbeat(conn, features, in.Status)
+	upload, err := in.Commit()
+	beat.stop()
+	if err != nil {
+		return err
+	}
+	log.Info("File saved", "path", upload.Path, "bytes", upload.Size, "data", data, "duration", time.Since(in.Started()))
+
+	err = confirmStored(conn, in, upload.Size, features)
+	if err != nil {
+		return fmt.Errorf("error sending status: %w", err)
+	}
+	rep.Complete(data)
+	return nil
+}
+
+// sendSparse sends only the data extents of a file with holes, each framed
+// with its offset and length, then an empty extent at the file's size and
+// the digest's trailer. If the digest is hashed on the way, the holes are
+// hashed as the zeros they read as.
+func sendSparse(conn net.Conn, r io.ReadSeeker, fileSize int64, extents []sparse.Extent, digest *digest, features uint32, opts *Options, rep *wire.Reporter) (*Result, error) {
+	startTime := time.Now()
+	buffer := make([]byte, opts.bufferSize())
+
+	// As for a whole file, data goes straight from the page cache unless
+	// it must be hashed on the way
+	dst := io.Writer(conn)
+	hasher := digest.hasher
+	if hasher != nil {
+		dst = writerOnly{conn}
+	}
+
+	var frame [EXTENT_HEADER_LEN]byte
+	var sent, pos int64
+	for _, e := range append(extents, sparse.Extent{Offset: fileSize}) {
+		if hasher != nil {
+			sparse.WriteZeros(hasher, e.Offset-pos)
+		}
+		binary.BigEndian.PutUint64(frame[:], uint64(e.Offset))
+		binary.BigEndian.PutUint64(frame[8:], uint64(e.Length))
+		if _, err := conn.Write(frame[:]); err != nil {
+			return nil, serverError(conn, conn, fmt.Errorf("error sending extent: %w", err))
+		}
+		if e.Length == 0 {
+			break
+		}
+
+		if _, err := r.Seek(e.Offset, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("error seeking in file: %w", err)
+		}
+		src := io.Reader(r)
+		if hasher != nil {
+			src = io.TeeReader(r, hasher)
+		}
+		for done := int64(0); done < e.Length; {
+			chunk := io.LimitReader(src, min(int64(len(buffer)), e.Length-done))
+			n, err := io.CopyBuffer(dst, chunk, buffer)
+			done += n
+			sent += n
+			if err != nil {
+				return nil, serverError(conn, conn, fmt.Errorf("error sending data: %w", err))
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("file ended after %d of %d bytes", e.Offset+done, fileSize)
+			}
+			rep.Progress(e.Offset + done)
+		}
+		pos = e.End()
+	}
+	if err := digest.send(conn); err != nil {
+		return nil, serverError(conn, conn, err)
+	}
+
+	// Wait for the server to confirm the file is stored
+	status, err := awaitStored(conn, conn, "status", rep.Busy)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := readReceipt(conn, features, fileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.logger().Info("Sparse file sent", "data", sent, "holes", fileSize-sent, "extents", len(extents))
+	return &Result{Bytes: sent, Duration: time.Since(startTime), Checksum: digest.sum(), Hash: digest.algo, Deduped: status == STATUS_DEDUPED, StoredAs: receipt.Path, Token: receipt.Token}, nil
+}
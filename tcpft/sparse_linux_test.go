@@ -0,0 +1,70 @@
+package tcpft
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// sparseFile writes a 64 MB file with a little data among holes and
+// returns its path and content.
+func sparseFile(t *testing.T) (string, []byte) {
+	t.Helper()
+	const size = 64 << 20
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := make([]byte, size)
+	for _, off := range []int{0, 10 << 20, size - 4096} {
+		for i := 0; i < 4096; i++ {
+			data[off+i] = byte(i)
+		}
+		if _, err := f.WriteAt(data[off:off+4096], int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// allocated returns the bytes of disk the file at path takes.
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+// A sparse file arrives with its content and, where the filesystem keeps
+// holes, still sparse.
+func TestSparseTransfer(t *testing.T) {
+	path, data := sparseFile(t)
+	for _, skipIdentical := range []bool{false, true} {
+		t.Run(fmt.Sprint("skip identical ", skipIdentical), func(t *testing.T) {
+			s := &Server{}
+			addr := serve(t, s)
+			opts := quietOptions()
+			opts.SkipIdentical = skipIdentical
+			if _, err := (&Client{}).SendFile(context.Background(), addr, path, opts); err != nil {
+				t.Fatal(err)
+			}
+			checkStored(t, s.UploadDir, "disk.img", data)
+			if allocated(t, path) >= int64(len(data))/2 {
+				t.Skip("the filesystem of the temporary directory doesn't keep holes")
+			}
+			if got := allocated(t, filepath.Join(s.UploadDir, "disk.img")); got >= int64(len(data))/2 {
+				t.Errorf("stored file takes %d bytes of disk for %d of data, holes filled in", got, 3*4096)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package tcpft
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// stallConn closes its connection once a read has waited timeout for
+// data, or a write for the client to take it, which unblocks them. The
+// watchdog only runs while a read or write waits, so neither our own work
+// in between nor a client still trickling data trips it.
+type stallConn struct {
+	net.Conn
+	timeout time.Duration
+	timer   *time.Timer // Of reads
+	wtimer  *time.Timer // Of writes, which may wait alongside a read
+	stalled atomic.Bool
+}
+
+func watchStall(conn net.Conn, timeout time.Duration) *stallConn {
+	c := &stallConn{Conn: conn, timeout: timeout}
+	stalled := func() {
+		c.stalled.Store(true)
+		conn.Close()
+	}
+	c.timer, c.wtimer = time.AfterFunc(timeout, stalled), time.AfterFunc(timeout, stalled)
+	c.timer.Stop()
+	c.wtimer.Stop()
+	return c
+}
+
+func (c *stallConn) Read(p []byte) (int, error) {
+	c.timer.Reset(c.timeout)
+	n, err := c.Conn.Read(p)
+	c.timer.Stop()
+	return n, err
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	c.wtimer.Reset(c.timeout)
+	n, err := c.Conn.Write(p)
+	c.wtimer.Stop()
+	return n, err
+}
+
+// stop disarms the watchdog, returning err, or ErrTimeout in its place if
+// the watchdog closed the connection.
+func (c *stallConn) stop(err error) error {
+	c.timer.Stop()
+	c.wtimer.Stop()
+	if c.stalled.Load() {
+		return fmt.Errorf("%w: transfer stalled, no data for %s", wire.ErrTimeout, c.timeout)
+	}
+	return err
+}
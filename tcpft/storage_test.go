@@ -0,0 +1,46 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A server storing in memory receives, lists and serves files without
+// touching its upload directory, and a failed upload never shows.
+func TestMemoryStorage(t *testing.T) {
+	s := &Server{Storage: "mem://"}
+	addr := serve(t, s)
+	sess := openSession(t, addr)
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("in memory "), 100000)
+	if _, err := sess.Put(ctx, writeFile(t, "mem.bin", data), ""); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := sess.List(ctx)
+	if err != nil || len(infos) != 1 || infos[0].Name != "mem.bin" || infos[0].Size != int64(len(data)) {
+		t.Fatalf("List = %v, %v", infos, err)
+	}
+	path := filepath.Join(t.TempDir(), "back")
+	if _, err := sess.Get(ctx, "mem.bin", path); err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, filepath.Dir(path), "back", data)
+
+	// An upload whose source is shorter than announced fails
+	var c Client
+	if _, err := c.Send(ctx, addr, "short.bin", bytes.NewReader(data[:10]), int64(len(data)), quietOptions()); err == nil {
+		t.Fatal("short upload succeeded")
+	}
+	if _, err := sess.Stat(ctx, "short.bin"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("failed upload: Stat got %v, want ErrNotFound", err)
+	}
+
+	if names, _ := os.ReadDir(s.UploadDir); len(names) != 0 {
+		t.Errorf("memory storage wrote %v to the upload directory", names)
+	}
+}
@@ -0,0 +1,204 @@
+package tcpft
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// errNoRanges is returned by sendStreams when the server can't take a file
+// in ranges, so it can be sent over one connection instead.
+var errNoRanges = errors.New("server does not support files sent in ranges")
+
+// sendStreams sends the file r reads in opts.Streams contiguous ranges, each
+// over its own connection, all at once. A range whose connection fails is
+// sent again up to RANGE_RETRIES times. sum is the file's SHA-256, which
+// the server checks the ranges against once all arrived.
+func (c *Client) sendStreams(ctx context.Context, addr, filename string, r io.ReaderAt, fileSize int64, sum []byte, opts *Options, rep *wire.Reporter) (*Result, error) {
+	if err := wire.CheckName(filename); err != nil {
+		return nil, err
+	}
+	streams := int64(opts.Streams)
+	if n := (fileSize + MIN_STREAM_RANGE - 1) / MIN_STREAM_RANGE; n < streams {
+		streams = n
+	}
+	rangeLen := (fileSize + streams - 1) / streams
+
+	header := wire.FileHeader{Name: filename, Size: uint64(fileSize), Flags: wire.FLAG_RANGE, Checksum: sum}
+	if opts.SkipIdentical {
+		header.Flags |= wire.FLAG_SKIP_IDENTICAL
+	}
+	if _, err := rand.Read(header.RangeID[:]); err != nil {
+		return nil, fmt.Errorf("error generating transfer ID: %w", err)
+	}
+
+	log := opts.logger()
+	log.Info("Sending file", "name", filename, "size", fileSize, "streams", streams)
+	rep.Start(filename, fileSize)
+	startTime := time.Now()
+
+	// The first stream to fail for good, or to be skipped, stops the rest
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var sent int64
+	progress := func(n int64) {
+		mu.Lock()
+		sent += n
+		rep.Progress(sent)
+		mu.Unlock()
+	}
+	// Every connection hears the same heartbeats, so each status is
+	// reported once
+	var status string
+	busy := func(s string) {
+		mu.Lock()
+		if s != status {
+			status = s
+			rep.Busy(s)
+		}
+		mu.Unlock()
+	}
+
+	stats := make([]StreamStats, streams)
+	errs := make([]error, streams)
+	replies := make([]byte, streams)
+	receipts := make([]wire.Receipt, streams)
+	var wg sync.WaitGroup
+	for i := range stats {
+		h := header
+		h.RangeOffset = uint64(int64(i) * rangeLen)
+		h.RangeLength = uint64(min(rangeLen, fileSize-int64(h.RangeOffset)))
+		stats[i].Offset = int64(h.RangeOffset)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				var attempt int64
+				var err error
+				replies[i], receipts[i], err = c.sendRange(ctx, addr, &h, r, opts, func(n int64) {
+					attempt += n
+					stats[i].Bytes += n
+					stats[i].Duration = time.Since(startTime)
+					progress(n)
+				}, busy)
+				if err == nil {
+					if replies[i] == STATUS_SKIP {
+						cancel()
+					}
+					return
+				}
+				var rerr *RemoteError
+				if ctx.Err() != nil || errors.Is(err, errNoRanges) || errors.As(err, &rerr) || stats[i].Retries == RANGE_RETRIES {
+					errs[i] = err
+					cancel()
+					return
+				}
+				// Progress counts the file's bytes, each once
+				progress(-attempt)
+				stats[i].Retries++
+				log.Warn("Stream failed, sending its range again", "stream", i+1, "offset", h.RangeOffset, "err", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	res := &Result{Duration: time.Since(startTime), Checksum: sum, Streams: stats}
+	for i := range stats {
+		if replies[i] == STATUS_SKIP {
+			res.Skipped = true
+			return res, nil
+		}
+		res.Deduped = res.Deduped || replies[i] == STATUS_DEDUPED
+		res.StoredAs = max(res.StoredAs, receipts[i].Path)
+		res.Token = max(res.Token, receipts[i].Token)
+		res.Bytes += stats[i].Bytes
+	}
+	// Report the failure that stopped the others, not their cancellation
+	var err error
+	for _, e := range errs {
+		if e != nil && (err == nil || errors.Is(err, context.Canceled) && !errors.Is(e, context.Canceled)) {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// sendRange sends the range of r the header describes over a connection of
+// its own, calling sent with each chunk written, and waits for the server
+// to store the whole file, calling busy with what it reports doing
+// meanwhile. It returns the server's reply, STATUS_SKIP if it skipped the
+// file as identical to its copy, else STATUS_OK or STATUS_DEDUPED, and
+// the receipt for the file, see readReceipt.
+func (c *Client) sendRange(ctx context.Context, addr string, header *wire.FileHeader, r io.ReaderAt, opts *Options, sent func(int64), busy func(string)) (status byte, receipt wire.Receipt, err error) {
+	conn, err := c.dial(ctx, addr)
+	if err != nil {
+		return 0, wire.Receipt{}, fmt.Errorf("error connecting to server: %w", err)
+	}
+	defer conn.Close()
+	conn = opts.wrap(conn)
+
+	// Closing the connection unblocks whatever read or write is pending
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	common, err := offerHello(conn, 0, opts.AuthToken)
+	if err != nil {
+		return 0, wire.Receipt{}, err
+	}
+	if common.Features&wire.FEATURE_RANGE == 0 {
+		return 0, wire.Receipt{}, errNoRanges
+	}
+
+	if err := writeHeader(conn, header, common.Features); err != nil {
+		return 0, wire.Receipt{}, err
+	}
+	if header.Flags&wire.FLAG_SKIP_IDENTICAL != 0 {
+		status, err := readStatus(conn, "skip status")
+		if err != nil {
+			return 0, wire.Receipt{}, err
+		}
+		if status == STATUS_SKIP {
+			return STATUS_SKIP, wire.Receipt{}, nil
+		}
+	}
+
+	buffer := make([]byte, opts.bufferSize())
+	section, stopReading := wire.ReadAhead(ctx, io.NewSectionReader(r, int64(header.RangeOffset), int64(header.RangeLength)), len(buffer))
+	defer stopReading()
+	for done := int64(0); done < int64(header.RangeLength); {
+		n, err := section.Read(buffer)
+		if n > 0 {
+			if _, werr := conn.Write(buffer[:n]); werr != nil {
+				return 0, wire.Receipt{}, serverError(conn, conn, fmt.Errorf("error sending data: %w", werr))
+			}
+			done += int64(n)
+			sent(int64(n))
+		}
+		if err == io.EOF {
+			return 0, wire.Receipt{}, fmt.Errorf("file ended after %d of %d bytes", int64(header.RangeOffset)+done, header.Size)
+		}
+		if err != nil {
+			return 0, wire.Receipt{}, fmt.Errorf("error reading file: %w", err)
+		}
+	}
+
+	// Wait for the server to confirm the whole file is stored
+	status, err = awaitStored(conn, conn, "status", busy)
+	if err != nil {
+		return 0, wire.Receipt{}, err
+	}
+	receipt, err = readReceipt(conn, common.Features, int64(header.Size))
+	return status, receipt, err
+}
@@ -0,0 +1,103 @@
+package tcpft
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// cutConn closes its connection once it has written limit bytes, as a
+// dropped link would.
+type cutConn struct {
+	net.Conn
+	limit, written int
+}
+
+func (c *cutConn) Write(b []byte) (int, error) {
+	if c.written+len(b) > c.limit {
+		c.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	c.written += len(b)
+	return c.Conn.Write(b)
+}
+
+// A 100 MB file sent over 4 connections is stored whole.
+func TestStreams(t *testing.T) {
+	s := &Server{Options: quietOptions()}
+	addr := serve(t, s)
+	data := make([]byte, 100<<20)
+	rand.Read(data)
+
+	opts := quietOptions()
+	opts.Streams = 4
+	res, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "big.bin", data), opts)
+	if err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	checkStored(t, s.UploadDir, "big.bin", data)
+	if len(res.Streams) != 4 {
+		t.Fatalf("sent over %d streams, want 4", len(res.Streams))
+	}
+	var total int64
+	for i, st := range res.Streams {
+		if st.Offset != int64(i)*int64(len(data))/4 || st.Retries != 0 {
+			t.Errorf("stream %d: %+v", i, st)
+		}
+		total += st.Bytes
+	}
+	if total != int64(len(data)) || res.Bytes != total {
+		t.Errorf("streams sent %d bytes, result %d, want %d", total, res.Bytes, len(data))
+	}
+}
+
+// A stream whose connection drops sends its range again, alone.
+func TestStreamsRetry(t *testing.T) {
+	s := &Server{Options: quietOptions()}
+	addr := serve(t, s)
+	data := make([]byte, 8<<20)
+	rand.Read(data)
+
+	var dials atomic.Int32
+	c := &Client{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err == nil && dials.Add(1) == 2 {
+			return &cutConn{Conn: conn, limit: 1 << 20}, nil
+		}
+		return conn, err
+	}}
+	opts := quietOptions()
+	opts.Streams = 4
+	res, err := c.SendFile(context.Background(), addr, writeFile(t, "f.bin", data), opts)
+	if err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	checkStored(t, s.UploadDir, "f.bin", data)
+
+	retries := 0
+	for _, st := range res.Streams {
+		retries += st.Retries
+	}
+	if retries != 1 || dials.Load() != 5 {
+		t.Errorf("%d retries over %d connections, want 1 over 5", retries, dials.Load())
+	}
+}
+
+// A file too small to split goes over one connection.
+func TestStreamsSmallFile(t *testing.T) {
+	s := &Server{Options: quietOptions()}
+	addr := serve(t, s)
+	data := []byte("small")
+	opts := quietOptions()
+	opts.Streams = 4
+	res, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "f", data), opts)
+	if err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	checkStored(t, s.UploadDir, "f", data)
+	if len(res.Streams) != 0 {
+		t.Errorf("sent over %d streams, want a single connection", len(res.Streams))
+	}
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+
+package tcpft
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Symlinks planted in the upload directory, such as one to /etc, never
+// redirect an upload outside it.
+func TestSymlinkedUploadPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		plant func(uploads, etc string)
+		s     Server
+	}{
+		{"file", func(uploads, etc string) {
+			os.Symlink(filepath.Join(etc, "passwd"), filepath.Join(uploads, "passwd"))
+		}, Server{}},
+		{"dangling", func(uploads, etc string) {
+			os.Symlink(filepath.Join(etc, "shadow"), filepath.Join(uploads, "passwd"))
+		}, Server{}},
+		{"client directory", func(uploads, etc string) {
+			os.Symlink(etc, filepath.Join(uploads, "127.0.0.1"))
+		}, Server{PerClientDirs: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A stand-in for /etc, which the test mustn't risk writing
+			etc := t.TempDir()
+			if err := os.WriteFile(filepath.Join(etc, "passwd"), []byte("root:x:0:0"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s := &tt.s
+			s.UploadDir = t.TempDir()
+			tt.plant(s.UploadDir, etc)
+			addr := serve(t, s)
+
+			if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "passwd", []byte("pwned")), quietOptions()); err == nil {
+				t.Error("upload through a symlink succeeded")
+			}
+			entries, _ := os.ReadDir(etc)
+			if len(entries) != 1 {
+				t.Errorf("%d files in the symlinked directory, want just passwd", len(entries))
+			}
+			if got, _ := os.ReadFile(filepath.Join(etc, "passwd")); string(got) != "root:x:0:0" {
+				t.Errorf("passwd holds %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+// Package tcpft transfers files over TCP, one connection per file.
+//
+// A Server stores every file it receives under its upload directory:
+//
+//	srv := &tcpft.Server{Addr: ":8080", UploadDir: "uploads"}
+//	err := srv.ListenAndServe(ctx)
+//
+// A Client sends a single file and reports what was transferred:
+//
+//	var c tcpft.Client
+//	res, err := c.SendFile(ctx, "host:8080", "backup.tar", tcpft.Options{})
+//
+// For hand-offs on one host both sides can use a unix socket instead, with
+// Server.UnixSocket and Client.UnixSocket; the protocol is the same.
+//
+// A Session carries any number of requests over one connection: list,
+// describe, upload, download and delete stored files.
+//
+// Console output goes through Options.Logger and Options.Progress, so a
+// host application can silence or redirect it.
+//
+// When the server fails a transfer it tells the client why: the client
+// returns a *RemoteError that wraps ErrRejected, ErrTooLarge,
+// ErrChecksumMismatch, ErrTimeout, ErrProtocol, ErrNoSpace, ErrNotFound,
+// ErrExpansion for an archive the server won't unpack or, for a file the
+// server's scanner refused, ErrPolicy, for use with errors.Is. A client
+// whose context ends tells the server, which drops the partial file and
+// fails the transfer with ErrAborted.
+//
+// While the server stores a received file it tells the client what it is
+// doing, which the client reports through Options.Progress.
+//
+// Filenames no server accepts fail with ErrInvalidName before connecting.
+package tcpft
+
+import (
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"socket-file-transfer/internal/checksum"
+	"socket-file-transfer/internal/wire"
+)
+
+const (
+	DefaultBufferSize = 256 << 10
+
+	// Sizes Options.Autotune tries, doubling from the first
+	MIN_TUNED_BUFFER = 64 << 10
+	MAX_TUNED_BUFFER = 1 << 20
+
+	// How often an idle Session pings the server, see Options.KeepAlive
+	DefaultKeepAlive = 30 * time.Second
+
+	// How long a Session waits for the answer to a ping
+	PING_TIMEOUT = 10 * time.Second
+
+	// How often the kernel probes an idle connection, so either side
+	// notices a peer that vanished without closing it, e.g. while the
+	// server stores a file
+	TCP_KEEPALIVE = 15 * time.Second
+
+	// Server reply to a skip-identical negotiation
+	STATUS_SEND = 0x00
+	STATUS_SKIP = 0x01
+
+	// Server reply once the file has been stored
+	STATUS_OK = 0x00
+
+	// Sent in its place once the file has been stored as a link to
+	// identical content the server already held, see Server.Dedupe
+	STATUS_DEDUPED = 0x03
+
+	// Sent ahead of that reply while the server is still storing the file,
+	// with FEATURE_HEARTBEAT: a one-byte length and what it is doing
+	STATUS_BUSY = 0x02
+
+	// Sent in place of any server reply when the transfer fails, followed
+	// by an error frame. A delta signature never starts with this byte.
+	STATUS_ERROR = 0xFF
+
+	// How long a failing server keeps reading, so the data the client still
+	// has in flight doesn't reset the connection and lose the error frame
+	ERROR_LINGER = 5 * time.Second
+
+	// Frames each data extent of a sparse file body: the 64-bit offset
+	// and length of the data that follows
+	EXTENT_HEADER_LEN = 8 + 8
+
+	// How long the server watches for data past a file's announced size
+	// before storing it
+	TRAILING_WAIT = 20 * time.Millisecond
+
+	// How long a connection that sent its range of a file waits for the
+	// others, including their retries, see Options.Streams
+	RANGE_WAIT = time.Minute
+
+	// Smallest range worth a connection of its own
+	MIN_STREAM_RANGE = 1 << 20
+
+	// How often a range whose connection failed is sent again
+	RANGE_RETRIES = 3
+
+	// How long the server waits for a new connection's hello and file
+	// header
+	HANDSHAKE_TIMEOUT = 30 * time.Second
+
+	// How long the client waits for the server's hello. A server that
+	// predates version negotiation never sends one.
+	HELLO_TIMEOUT = 10 * time.Second
+
+	// Permissions of a Server's unix socket: its user and group may connect
+	DEFAULT_SOCKET_MODE = 0660
+)
+
+// What this side of the protocol speaks
+var hello = wire.Hello{
+	Version:  wire.PROTOCOL_VERSION,
+	Features: wire.FEATURE_SKIP_IDENTICAL | wire.FEATURE_DELTA | wire.FEATURE_SESSION | wire.FEATURE_SPARSE | wire.FEATURE_RANGE | wire.FEATURE_PING | wire.FEATURE_PAUSE | wire.FEATURE_ABORT | wire.FEATURE_HEARTBEAT | wire.FEATURE_METADATA | wire.FEATURE_RECEIPT | wire.FEATURE_TOKEN | wire.FEATURE_CODES | checksum.FEATURES,
+}
+
+// Options tunes a transfer. The zero value uses the defaults.
+type Options struct {
+	// BufferSize is the size of each read and write, DefaultBufferSize if 0
+	BufferSize int
+
+	// Autotune sizes the reads and writes of a send from its throughput
+	// instead of BufferSize, trying MIN_TUNED_BUFFER up to
+	// MAX_TUNED_BUFFER over its first seconds, see wire.Tuner (client
+	// only). Files sent over several streams, with holes or as deltas use
+	// BufferSize.
+	Autotune bool
+
+	// Timeout aborts a transfer when a single read or write takes longer.
+	// Zero means no timeout.
+	Timeout time.Duration
+
+	// Logger receives status and error messages, wire.DefaultLogger if nil
+	Logger *slog.Logger
+
+	// Progress receives the events of each transfer: started, bytes
+	// transferred, retransmissions, completed or failed. Events of one
+	// transfer are delivered in order from a single goroutine; while the
+	// function is busy, byte-progress events are coalesced so a slow
+	// consumer never stalls the transfer. A console progress line is drawn
+	// if nil.
+	Progress ProgressFunc
+
+	// SkipIdentical asks the server to skip the body if it already holds
+	// an identical copy (client only)
+	SkipIdentical bool
+
+	// Delta sends only the blocks that differ from the server's copy
+	// (client only)
+	Delta bool
+
+	// Hash is what the server checks the file against once received,
+	// SHA-256 if zero; a server without it falls back to SHA-256 (client
+	// only). Delta transfers, files sent over several streams and session
+	// puts are checked with SHA-256 as before.
+	Hash checksum.Algorithm
+
+	// KeepAlive is how often an idle Session pings the server, so NAT
+	// mappings along the way don't expire: DefaultKeepAlive if 0, never
+	// if negative (client only)
+	KeepAlive time.Duration
+
+	// Streams splits the file into this many ranges sent over as many
+	// connections at once, for links whose latency keeps one connection
+	// from filling them; 0 or 1 uses one (client only). Files with holes,
+	// delta transfers and servers that predate it use one too.
+	Streams int
+
+	// Pause holds back the upload while paused, telling servers that
+	// support it so they wait up to their MaxPause (client only). Files
+	// sent over several streams and session puts don't pause.
+	Pause *Pause
+
+	// Name is what SendFile asks the server to store the file as, the
+	// file's base name if empty (client only)
+	Name string
+
+	// AuthToken tells a server split among tenants which one the client
+	// is, see Server.Tenants (client only)
+	AuthToken string
+
+	// Legacy interoperates with peers that predate version negotiation:
+	// the client skips the hello, the server accepts connections without
+	// one instead of refusing them
+	Legacy bool
+
+	// NoPreallocate grows received files as data arrives instead of
+	// reserving their full size up front (server only)
+	NoPreallocate bool
+
+	// HookCommand runs through the shell after each file is stored, with
+	// the upload described in its environment (server only)
+	HookCommand string
+
+	// HookURL receives a JSON POST describing each stored file (server
+	// only)
+	HookURL string
+
+	// HookStrict waits for the hooks before confirming a transfer and
+	// fails it if one fails, moving the file to .quarantine in the upload
+	// directory (server only). Otherwise hooks run in the background and
+	// failures are only logged.
+	HookStrict bool
+}
+
+func (o *Options) bufferSize() int {
+	if o.BufferSize > 0 {
+		return o.BufferSize
+	}
+	return DefaultBufferSize
+}
+
+func (o *Options) remoteName(path string) string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return filepath.Base(path)
+}
+
+func (o *Options) logger() *slog.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return wire.DefaultLogger
+}
+
+func (o *Options) reporter(remote string) *wire.Reporter {
+	return wire.NewReporter(o.Progress, remote)
+}
+
+// Progress events, see Options.Progress.
+type (
+	Event        = wire.Event
+	EventKind    = wire.EventKind
+	ProgressFunc = wire.ProgressFunc
+)
+
+const (
+	EventStarted    = wire.EventStarted
+	EventProgress   = wire.EventProgress
+	EventRetransmit = wire.EventRetransmit
+	EventCompleted  = wire.EventCompleted
+	EventFailed     = wire.EventFailed
+	EventBusy       = wire.EventBusy
+)
+
+// Pause pauses and resumes transfers, see Options.Pause.
+type Pause = wire.Pause
+
+// RemoteError is a failure reported by the other side of a transfer.
+type RemoteError = wire.RemoteError
+
+// Transfer failures, wrapped by the errors transfers return.
+var (
+	ErrChecksumMismatch = wire.ErrChecksumMismatch
+	ErrRejected         = wire.ErrRejected
+	ErrTooLarge         = wire.ErrTooLarge
+	ErrExpansion        = wire.ErrExpansion
+	ErrTimeout          = wire.ErrTimeout
+	ErrProtocol         = wire.ErrProtocol
+	ErrInvalidName      = wire.ErrInvalidName
+	ErrNoSpace          = wire.ErrNoSpace
+	ErrAborted          = wire.ErrAborted
+	ErrPolicy           = wire.ErrPolicy
+	ErrNotFound         = wire.ErrNotFound
+)
+
+// Result describes a completed send.
+type Result struct {
+	Bytes    int64              // File bytes put on the wire
+	Duration time.Duration      // Time spent transferring data
+	Checksum []byte             // Digest of the file in Hash
+	Hash     checksum.Algorithm // SHA-256 unless the server checked the file with Options.Hash
+	Skipped  bool               // Server already held an identical copy
+	Deduped  bool               // Server stored the file as a link to identical content it held, see Server.Dedupe
+	StoredAs string             // Where the server stored the file, relative to its upload directory; empty if it doesn't say
+	Token    string             // Fetches the file from the server's HTTP at /t/<token>, if it issued one
+	Streams  []StreamStats      // Each connection of a file sent over several, see Options.Streams
+	Buffer   int                // Size Options.Autotune settled on, 0 if the send ended first or wasn't tuned
+}
+
+// StreamStats describes one connection of a file sent in ranges.
+type StreamStats struct {
+	Offset   int64         // Where its range starts
+	Bytes    int64         // File bytes it put on the wire, including retries
+	Duration time.Duration // Time until its range was sent
+	Retries  int           // How often its range was sent again
+}
@@ -0,0 +1,92 @@
+package tcpft
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Tests share these helpers for running a Server on loopback and checking
+// what it stored.
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// quietOptions returns Options that neither log nor draw progress.
+func quietOptions() Options {
+	return Options{Logger: quiet, Progress: func(Event) {}}
+}
+
+// serve runs s on a loopback port, storing under a temporary directory
+// unless s.UploadDir is set, until the test ends. It returns the address.
+func serve(t testing.TB, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveOn(t, s, ln)
+	return ln.Addr().String()
+}
+
+// serveOn runs s on ln until the test ends.
+func serveOn(t testing.TB, s *Server, ln net.Listener) {
+	t.Helper()
+	if s.UploadDir == "" {
+		s.UploadDir = t.TempDir()
+	}
+	if s.Logger == nil {
+		s.Logger = quiet
+	}
+	if s.Progress == nil {
+		s.Progress = func(Event) {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(ctx, ln)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// writeFile writes data to name in a temporary directory and returns its
+// path.
+func writeFile(t testing.TB, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkStored fails the test unless the file stored as name under dir
+// holds data.
+func checkStored(t testing.TB, dir, name string, data []byte) {
+	t.Helper()
+	got, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("stored file: %v", err)
+	}
+	if sha256.Sum256(got) != sha256.Sum256(data) {
+		t.Fatalf("stored %s has %d bytes with a different SHA-256 than the %d sent", name, len(got), len(data))
+	}
+}
+
+// readDirNames returns the names of the entries of dir.
+func readDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, err
+}
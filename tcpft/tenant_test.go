@@ -0,0 +1,166 @@
+package tcpft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"socket-file-transfer/internal/tenant"
+)
+
+// tenantServer serves two tenants: a, with token-a, 80 byte files at most
+// and a quota of 100 bytes, and b, with token-b, the directory team-b and
+// a quota of 250. It returns the address and the upload directory.
+func tenantServer(t *testing.T) (string, string) {
+	t.Helper()
+	set, err := tenant.New([]tenant.Tenant{
+		{Name: "a", Token: "token-a", MaxFileSize: 80, Quota: 100},
+		{Name: "b", Token: "token-b", Dir: "team-b", Quota: 250},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Tenants: set}
+	addr := serve(t, s)
+	return addr, s.UploadDir
+}
+
+// tenantOptions are quietOptions with the auth token given.
+func tenantOptions(token string) Options {
+	opts := quietOptions()
+	opts.AuthToken = token
+	return opts
+}
+
+// sendAs sends n bytes as name with token.
+func sendAs(t *testing.T, addr, token, name string, n int) error {
+	t.Helper()
+	_, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, name, make([]byte, n)), tenantOptions(token))
+	return err
+}
+
+// Two tenants filling their quotas each hit their own, whatever the other
+// stored.
+func TestTenantQuotas(t *testing.T) {
+	addr, root := tenantServer(t)
+	steps := []struct {
+		token, name string
+		size        int
+		want        error
+	}{
+		{"token-a", "a1", 60, nil},
+		{"token-b", "b1", 60, nil},
+		{"token-a", "a2", 60, ErrNoSpace}, // 120 of a's 100
+		{"token-b", "b2", 60, nil},
+		{"token-b", "b3", 60, nil},
+		{"token-b", "b4", 60, nil},
+		{"token-a", "a3", 40, nil},        // Exactly a's 100
+		{"token-b", "b5", 60, ErrNoSpace}, // 300 of b's 250
+		{"token-a", "a4", 1, ErrNoSpace},
+		{"token-b", "b6", 10, nil},
+	}
+	for _, st := range steps {
+		if err := sendAs(t, addr, st.token, st.name, st.size); !errors.Is(err, st.want) {
+			t.Fatalf("%s with %s: got %v, want %v", st.name, st.token, err, st.want)
+		}
+	}
+
+	for dir, want := range map[string][]string{"a": {"a1", "a3"}, "team-b": {"b1", "b2", "b3", "b4", "b6"}} {
+		names, err := readDirNames(filepath.Join(root, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, name := range names {
+			if name[0] != '.' {
+				got = append(got, name)
+			}
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s holds %v, want %v", dir, got, want)
+		}
+	}
+}
+
+// Clients without a tenant's token are refused, and a tenant's own file
+// size limit replaces the server's.
+func TestTenantAuth(t *testing.T) {
+	addr, root := tenantServer(t)
+	tests := []struct {
+		name, token string
+		size        int
+		want        error
+	}{
+		{"no token", "", 1, ErrRejected},
+		{"unknown token", "token-c", 1, ErrRejected},
+		{"token prefix", "token-", 1, ErrRejected},
+		{"over the tenant's limit", "token-a", 81, ErrTooLarge},
+		{"within the tenant's limit", "token-a", 80, nil},
+		{"other tenant without a limit", "token-b", 81, nil},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := sendAs(t, addr, tt.token, fmt.Sprint("f", i), tt.size); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+	names, err := readDirNames(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if name[0] != '.' && name != "a" && name != "team-b" {
+			t.Errorf("%s stored outside the tenants' directories", name)
+		}
+	}
+}
+
+// A tenant's sessions list, stat, fetch and remove its own files only.
+func TestTenantScope(t *testing.T) {
+	addr, _ := tenantServer(t)
+	ctx := context.Background()
+	if err := sendAs(t, addr, "token-a", "mine", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendAs(t, addr, "token-b", "theirs", 6); err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := (&Client{}).OpenSession(ctx, addr, tenantOptions("token-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	files, err := sess.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(files) != 1 || files[0].Name != "mine" {
+		t.Errorf("a lists %+v, want mine only", files)
+	}
+	for _, name := range []string{"theirs", "team-b/theirs", "../team-b/theirs"} {
+		if _, err := sess.Stat(ctx, name); err == nil {
+			t.Errorf("a stats %s", name)
+		}
+		if _, err := sess.Get(ctx, name, filepath.Join(t.TempDir(), "got")); err == nil {
+			t.Errorf("a fetches %s", name)
+		}
+		if err := sess.Remove(ctx, name); err == nil {
+			t.Errorf("a removes %s", name)
+		}
+	}
+
+	other, err := (&Client{}).OpenSession(ctx, addr, tenantOptions("token-c"))
+	if err == nil {
+		defer other.Close()
+		_, err = other.List(ctx)
+	}
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("session with an unknown token: got %v, want ErrRejected", err)
+	}
+}
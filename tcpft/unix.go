@@ -0,0 +1,27 @@
+package tcpft
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"socket-file-transfer/internal/unixsock"
+	"socket-file-transfer/internal/wire"
+)
+
+// How long a server on a unix socket waits for a server already on it to
+// answer, see internal/unixsock
+const SOCKET_PROBE_TIMEOUT = unixsock.PROBE_TIMEOUT
+
+// Numbers unix socket connections in the logs
+var unixConns atomic.Uint64
+
+// remoteName names the client of conn in the logs. Unix socket clients
+// have no address, so they are numbered.
+func remoteName(conn net.Conn) string {
+	name := wire.ClientName(conn.RemoteAddr())
+	if name != wire.LOCAL_CLIENT {
+		return name
+	}
+	return fmt.Sprintf("%s#%d", wire.LOCAL_CLIENT, unixConns.Add(1))
+}
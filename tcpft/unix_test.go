@@ -0,0 +1,164 @@
+//go:build !windows
+
+package tcpft
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveUnix runs s on a unix socket in a temporary directory until stop
+// is called or the test ends, returning the socket's path.
+func serveUnix(t *testing.T, s *Server) (path string, stop func() error) {
+	t.Helper()
+	if s.UnixSocket == "" {
+		s.UnixSocket = filepath.Join(t.TempDir(), "transfer.sock")
+	}
+	if s.UploadDir == "" {
+		s.UploadDir = t.TempDir()
+	}
+	s.Logger, s.Progress = quiet, func(Event) {}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe(ctx) }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if conn, err := net.Dial("unix", s.UnixSocket); err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("server stopped: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server never answered on the socket")
+		}
+	}
+	var err error
+	stopped := false
+	stop = func() error {
+		if !stopped {
+			stopped = true
+			cancel()
+			err = <-done
+		}
+		return err
+	}
+	t.Cleanup(func() { stop() })
+	return s.UnixSocket, stop
+}
+
+func TestUnixSocket(t *testing.T) {
+	s := &Server{PerClientDirs: true, SocketMode: 0600}
+	path, stop := serveUnix(t, s)
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	data := []byte(strings.Repeat("over a unix socket ", 10000))
+	c := Client{UnixSocket: path}
+	if _, err := c.SendFile(context.Background(), "server", writeFile(t, "unix.txt", data), quietOptions()); err != nil {
+		t.Fatal(err)
+	}
+	// Unix clients have no address, their directory is "local"
+	checkStored(t, filepath.Join(s.UploadDir, "local"), "unix.txt", data)
+
+	stop()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after shutdown: %v", err)
+	}
+}
+
+func TestUnixSocketDefaultMode(t *testing.T) {
+	path, _ := serveUnix(t, &Server{})
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != DEFAULT_SOCKET_MODE {
+		t.Errorf("socket mode %v, %v, want %v", info.Mode().Perm(), err, DEFAULT_SOCKET_MODE)
+	}
+}
+
+// A socket file a crashed server left behind is replaced.
+func TestUnixSocketStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stale.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	serveUnix(t, &Server{UnixSocket: path})
+	c := Client{UnixSocket: path}
+	if _, err := c.SendFile(context.Background(), "server", writeFile(t, "f", []byte("x")), quietOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The server refuses a socket another server answers on, or a path that
+// isn't a socket, leaving either alone.
+func TestUnixSocketRefused(t *testing.T) {
+	live := filepath.Join(t.TempDir(), "live.sock")
+	ln, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, []byte("keep"), 0644)
+
+	for path, want := range map[string]string{live: "in use", file: "not a socket"} {
+		s := &Server{UnixSocket: path, UploadDir: t.TempDir()}
+		s.Logger = quiet
+		err := s.ListenAndServe(context.Background())
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", path, err, want)
+		}
+		if _, err := os.Lstat(path); err != nil {
+			t.Errorf("%s removed", path)
+		}
+	}
+}
+
+// Unix clients are numbered in the logs.
+func TestRemoteName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var names []string
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, remoteName(conn))
+		conn.Close()
+	}
+	if !strings.HasPrefix(names[0], "local#") || names[0] == names[1] {
+		t.Errorf("unix clients named %v", names)
+	}
+
+	tcp, _ := net.ResolveTCPAddr("tcp", "192.0.2.7:1234")
+	if got := remoteName(fakeAddrConn{addr: tcp}); got != "192.0.2.7:1234" {
+		t.Errorf("TCP client named %q", got)
+	}
+}
+
+type fakeAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c fakeAddrConn) RemoteAddr() net.Addr { return c.addr }
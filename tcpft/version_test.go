@@ -0,0 +1,284 @@
+package tcpft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// fakeServer accepts one connection on a loopback port and hands it to
+// handle, returning the address.
+func fakeServer(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		handle(conn)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+	})
+	return ln.Addr().String()
+}
+
+// oldServer handles a connection as a server that predates version
+// negotiation: a bare file header, the file, then STATUS_OK. It gives up
+// on anything else, as a versioned client's hello.
+func oldServer(got *bytes.Buffer) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		header, err := wire.ReadFileHeader(conn, wire.MAX_NAME_BYTES)
+		if err != nil || header.Flags != 0 {
+			return
+		}
+		if _, err := io.CopyN(got, conn, int64(header.Size)); err != nil {
+			return
+		}
+		conn.Write([]byte{STATUS_OK})
+	}
+}
+
+func legacyOptions() Options {
+	opts := quietOptions()
+	opts.Legacy = true
+	return opts
+}
+
+func TestVersionCombinations(t *testing.T) {
+	data := []byte(strings.Repeat("interop ", 1000))
+
+	t.Run("new client, new server", func(t *testing.T) {
+		s := &Server{}
+		addr := serve(t, s)
+		var c Client
+		if _, err := c.SendFile(context.Background(), addr, writeFile(t, "f.txt", data), quietOptions()); err != nil {
+			t.Fatal(err)
+		}
+		checkStored(t, s.UploadDir, "f.txt", data)
+	})
+
+	t.Run("legacy client, new server", func(t *testing.T) {
+		s := &Server{}
+		addr := serve(t, s)
+		var c Client
+		_, err := c.SendFile(context.Background(), addr, writeFile(t, "f.txt", data), legacyOptions())
+		if !errors.Is(err, ErrProtocol) || !strings.Contains(err.Error(), "-legacy") {
+			t.Errorf("got %v, want ErrProtocol suggesting -legacy", err)
+		}
+	})
+
+	t.Run("legacy client, new server with -legacy", func(t *testing.T) {
+		s := &Server{}
+		s.Legacy = true
+		addr := serve(t, s)
+		var c Client
+		if _, err := c.SendFile(context.Background(), addr, writeFile(t, "f.txt", data), legacyOptions()); err != nil {
+			t.Fatal(err)
+		}
+		checkStored(t, s.UploadDir, "f.txt", data)
+	})
+
+	t.Run("new client with -legacy, old server", func(t *testing.T) {
+		var got bytes.Buffer
+		addr := fakeServer(t, oldServer(&got))
+		var c Client
+		if _, err := c.SendFile(context.Background(), addr, writeFile(t, "f.txt", data), legacyOptions()); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), data) {
+			t.Error("old server received different data")
+		}
+	})
+
+	t.Run("new client, old server", func(t *testing.T) {
+		var got bytes.Buffer
+		addr := fakeServer(t, oldServer(&got))
+		var c Client
+		start := time.Now()
+		_, err := c.SendFile(context.Background(), addr, writeFile(t, "f.txt", data), quietOptions())
+		if !errors.Is(err, ErrProtocol) || !strings.Contains(err.Error(), "-legacy") {
+			t.Errorf("got %v, want ErrProtocol suggesting -legacy", err)
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("took %v to notice the old server", time.Since(start))
+		}
+	})
+}
+
+// A client meeting a server of an older version downgrades to it and
+// uses only the features both have: here the fixed header layout, no
+// digest trailer and no receipt.
+func TestClientDowngrades(t *testing.T) {
+	data := []byte("downgraded")
+	var offered wire.Hello
+	var got bytes.Buffer
+	addr := fakeServer(t, func(conn net.Conn) {
+		peer, err := wire.ReadHello(conn)
+		if err != nil {
+			return
+		}
+		offered = *peer
+		b, _ := (&wire.Hello{Version: 1, Features: wire.FEATURE_SKIP_IDENTICAL | 1<<30}).MarshalBinary()
+		conn.Write(b)
+		oldServer(&got)(conn)
+	})
+
+	var c Client
+	if _, err := c.SendFile(context.Background(), addr, writeFile(t, "f.txt", data), quietOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if offered.Version != wire.PROTOCOL_VERSION {
+		t.Errorf("client offered version %d, want %d", offered.Version, wire.PROTOCOL_VERSION)
+	}
+	if offered.Features&(1<<30) != 0 {
+		t.Errorf("client offered unknown feature bits %#x", offered.Features)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("server received %q, want %q", got.Bytes(), data)
+	}
+}
+
+// A server meeting a client of an older version downgrades to it, and
+// refuses header flags for features the client didn't negotiate.
+func TestServerDowngrades(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags byte
+		ok    bool
+	}{
+		{"negotiated flags", 0, true},
+		{"flag not negotiated", wire.FLAG_DELTA, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			addr := serve(t, s)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			b, _ := (&wire.Hello{Version: 1, Features: wire.FEATURE_SKIP_IDENTICAL}).MarshalBinary()
+			conn.Write(b)
+			server, err := wire.ReadHello(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if server.Version != wire.PROTOCOL_VERSION {
+				t.Errorf("server announced version %d, want %d", server.Version, wire.PROTOCOL_VERSION)
+			}
+
+			data := []byte("v1 body")
+			header := &wire.FileHeader{Name: "v1.txt", Size: uint64(len(data)), Flags: tt.flags}
+			hb, _ := header.MarshalBinary()
+			conn.Write(append(hb, data...))
+
+			// Without FEATURE_RECEIPT the reply is the status alone
+			reply, _ := io.ReadAll(conn)
+			if tt.ok {
+				if !bytes.Equal(reply, []byte{STATUS_OK}) {
+					t.Fatalf("reply %x, want STATUS_OK alone", reply)
+				}
+				checkStored(t, s.UploadDir, "v1.txt", data)
+				return
+			}
+			if len(reply) == 0 || reply[0] != STATUS_ERROR {
+				t.Fatalf("reply %x, want STATUS_ERROR", reply)
+			}
+			remote, err := wire.ReadRemoteError(bytes.NewReader(reply[1:]))
+			if err != nil || remote.Code != wire.CODE_PROTOCOL {
+				t.Errorf("error frame %+v (%v), want a protocol error", remote, err)
+			}
+		})
+	}
+}
+
+// Peers that negotiated FEATURE_METADATA send the file header as a
+// metadata frame, others in the fixed layout, whichever side is newer.
+func TestMetadataPeers(t *testing.T) {
+	data := []byte("metadata or not")
+	for _, features := range []uint32{0, wire.FEATURE_METADATA} {
+		name := "fixed layout"
+		if features != 0 {
+			name = "metadata"
+		}
+		t.Run("client to a server taking the "+name, func(t *testing.T) {
+			var got bytes.Buffer
+			var header *wire.FileHeader
+			addr := fakeServer(t, func(conn net.Conn) {
+				if _, err := wire.ReadHello(conn); err != nil {
+					return
+				}
+				b, _ := (&wire.Hello{Version: wire.PROTOCOL_VERSION, Features: features}).MarshalBinary()
+				conn.Write(b)
+				var err error
+				if features != 0 {
+					header, err = wire.ReadMetadata(conn, wire.MAX_NAME_BYTES)
+				} else {
+					header, err = wire.ReadFileHeader(conn, wire.MAX_NAME_BYTES)
+				}
+				if err != nil {
+					return
+				}
+				io.CopyN(&got, conn, int64(header.Size))
+				conn.Write([]byte{STATUS_OK})
+			})
+			if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "m.txt", data), quietOptions()); err != nil {
+				t.Fatal(err)
+			}
+			if header == nil || header.Name != "m.txt" || !bytes.Equal(got.Bytes(), data) {
+				t.Errorf("server read header %+v and %q", header, got.Bytes())
+			}
+		})
+
+		t.Run("server to a client sending the "+name, func(t *testing.T) {
+			s := &Server{}
+			addr := serve(t, s)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			b, _ := (&wire.Hello{Version: wire.PROTOCOL_VERSION, Features: features}).MarshalBinary()
+			conn.Write(b)
+			if _, err := wire.ReadHello(conn); err != nil {
+				t.Fatal(err)
+			}
+			header := &wire.FileHeader{Name: "m.txt", Size: uint64(len(data))}
+			if features != 0 {
+				b, _ = header.MarshalMetadata()
+				// A field from a newer client, which the server skips
+				binary.BigEndian.PutUint32(b, binary.BigEndian.Uint32(b)+wire.METADATA_FIELD_LEN+3)
+				b = append(b, 0, 99, 0, 3, 'n', 'e', 'w')
+			} else {
+				b, _ = header.MarshalBinary()
+			}
+			conn.Write(append(b, data...))
+			if reply, _ := io.ReadAll(conn); !bytes.Equal(reply, []byte{STATUS_OK}) {
+				t.Fatalf("reply %x, want STATUS_OK", reply)
+			}
+			checkStored(t, s.UploadDir, "m.txt", data)
+		})
+	}
+}
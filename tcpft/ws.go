@@ -0,0 +1,203 @@
+package tcpft
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketListener accepts connections tunnelled over WebSocket, for
+// clients behind proxies that only pass HTTP. It is an http.Handler to
+// mount on an HTTP server, at /ws say, and a net.Listener to pass to
+// Server.Serve: each WebSocket connection, carrying binary messages,
+// speaks the same protocol as a TCP connection.
+//
+// Browsers may only connect from a page of the same host, so other sites
+// can't make a visitor's browser upload to the server.
+type WebSocketListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewWebSocketListener returns a WebSocketListener ready to accept.
+func NewWebSocketListener() *WebSocketListener {
+	return &WebSocketListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and hands it to
+// Accept, returning once the connection is closed.
+func (l *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	websocket.Server{Handshake: checkOrigin, Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		conn := &wsConn{Conn: ws, remote: wsRemote(r), closed: make(chan struct{})}
+		select {
+		case l.conns <- conn:
+		case <-l.done:
+			return
+		}
+		<-conn.closed
+	}}.ServeHTTP(w, r)
+}
+
+// checkOrigin accepts clients that send no Origin, which browsers always
+// send, and those from the host they connect to, as a reverse proxy in
+// front may have told us with X-Forwarded-Host.
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin != nil && origin.Host != r.Host && origin.Host != r.Header.Get("X-Forwarded-Host") {
+		return fmt.Errorf("origin %s not allowed", origin)
+	}
+	return nil
+}
+
+// wsRemote returns the address of the client of r, or of the last proxy
+// in front of it.
+func wsRemote(r *http.Request) net.Addr {
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		return addr
+	}
+	return &websocket.Addr{URL: &url.URL{Host: r.RemoteAddr}}
+}
+
+func (l *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting; connections already accepted stay open.
+func (l *WebSocketListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *WebSocketListener) Addr() net.Addr {
+	return wsAddr{}
+}
+
+type wsAddr struct{}
+
+func (wsAddr) Network() string { return "websocket" }
+func (wsAddr) String() string  { return "websocket" }
+
+// wsConn is an accepted WebSocket connection, reporting the client's
+// address rather than the WebSocket origin.
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.closed) })
+	return err
+}
+
+// dialWebSocket opens a WebSocket connection to rawURL, ws:// or wss://,
+// through the proxy the environment names, if any. User info in the URL
+// is sent as basic auth.
+func (c *Client) dialWebSocket(ctx context.Context, rawURL string) (net.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebSocket URL: %w", err)
+	}
+	secure := u.Scheme == "wss"
+	if !secure && u.Scheme != "ws" {
+		return nil, fmt.Errorf("invalid WebSocket URL %q: want ws:// or wss://", rawURL)
+	}
+	origin := &url.URL{Scheme: "http", Host: u.Host} // The server itself, which it accepts
+	port := "80"
+	if secure {
+		origin.Scheme, port = "https", "443"
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	location := *u
+	location.User = nil
+	config, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		config.Header = http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass))}}
+	}
+
+	conn, err := c.dialProxied(ctx, u, host)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		tlsConfig := c.TLSConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// The handshake has no context of its own
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	ws, err := websocket.NewClient(config, conn)
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket handshake failed: %w", err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// dialProxied connects to host, the server of u, through the proxy
+// HTTPS_PROXY or HTTP_PROXY names, or directly.
+func (c *Client) dialProxied(ctx context.Context, u *url.URL, host string) (net.Conn, error) {
+	target := &url.URL{Scheme: "http", Host: host}
+	if u.Scheme == "wss" {
+		target.Scheme = "https"
+	}
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: target})
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return c.dialNetwork(ctx, "tcp", host)
+	}
+
+	// SOCKS5 proxies work too; the rest take CONNECT requests
+	if proxy.Scheme != "socks5" && proxy.Scheme != "socks5h" {
+		proxy.Scheme = "http"
+	}
+	if proxy, err = parseProxy(proxy.String()); err != nil {
+		return nil, err
+	}
+	return c.dialThrough(ctx, proxy, host)
+}
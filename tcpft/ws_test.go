@@ -0,0 +1,117 @@
+package tcpft
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// serveWebSocket runs s behind a WebSocketListener on an httptest server,
+// over TLS if secure, wrapping the handler in wrap if not nil. It returns
+// the server's ws:// or wss:// URL and a Client trusting its certificate.
+func serveWebSocket(t *testing.T, s *Server, secure bool, wrap func(http.Handler) http.Handler) (string, *Client) {
+	t.Helper()
+	l := NewWebSocketListener()
+	var h http.Handler = l
+	if wrap != nil {
+		h = wrap(h)
+	}
+	srv := httptest.NewUnstartedServer(h)
+	scheme := "ws"
+	if secure {
+		srv.StartTLS()
+		scheme = "wss"
+	} else {
+		srv.Start()
+	}
+	t.Cleanup(srv.Close)
+	serveOn(t, s, l)
+
+	c := &Client{WebSocket: scheme + "://" + srv.Listener.Addr().String() + "/ws"}
+	if secure {
+		roots := x509.NewCertPool()
+		roots.AddCert(srv.Certificate())
+		c.TLSConfig = &tls.Config{RootCAs: roots}
+	}
+	return c.WebSocket, c
+}
+
+func TestWebSocket(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		s := &Server{}
+		_, c := serveWebSocket(t, s, secure, nil)
+		data := []byte(strings.Repeat("tunnelled ", 200000))
+		if _, err := c.SendFile(context.Background(), "server", writeFile(t, "ws.txt", data), quietOptions()); err != nil {
+			t.Fatalf("secure %v: %v", secure, err)
+		}
+		checkStored(t, s.UploadDir, "ws.txt", data)
+
+		// Sessions go through too
+		sess, err := c.OpenSession(context.Background(), "server", quietOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos, err := sess.List(context.Background())
+		sess.Close()
+		if err != nil || len(infos) != 1 {
+			t.Errorf("secure %v: List = %v, %v", secure, infos, err)
+		}
+	}
+}
+
+// Credentials in the URL reach the HTTP server as basic auth.
+func TestWebSocketAuth(t *testing.T) {
+	auth := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	s := &Server{}
+	url, c := serveWebSocket(t, s, true, auth)
+	path := writeFile(t, "f", []byte("x"))
+	if _, err := c.SendFile(context.Background(), "server", path, quietOptions()); err == nil {
+		t.Error("sent without credentials")
+	}
+	c.WebSocket = strings.Replace(url, "wss://", "wss://user:pass@", 1)
+	if _, err := c.SendFile(context.Background(), "server", path, quietOptions()); err != nil {
+		t.Errorf("with credentials: %v", err)
+	}
+}
+
+// Browsers on another site are refused.
+func TestWebSocketOrigin(t *testing.T) {
+	url, _ := serveWebSocket(t, &Server{}, false, nil)
+	host := strings.TrimSuffix(strings.TrimPrefix(url, "ws://"), "/ws")
+	for origin, ok := range map[string]bool{
+		"http://" + host:         true,
+		"http://evil.example":    false,
+		"https://" + host + ".x": false,
+	} {
+		ws, err := websocket.Dial(url, "", origin)
+		if (err == nil) != ok {
+			t.Errorf("origin %s: got %v, want allowed %v", origin, err, ok)
+		}
+		if ws != nil {
+			ws.Close()
+		}
+	}
+}
+
+func TestWebSocketBadURL(t *testing.T) {
+	for _, url := range []string{"http://host/ws", "://", "ftp://host"} {
+		c := Client{WebSocket: url}
+		if _, err := c.SendFile(context.Background(), "server", writeFile(t, "f", nil), quietOptions()); err == nil {
+			t.Errorf("%s accepted", url)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package udpft
+
+import (
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// ackPolicy delays ACKs to clients that understand cumulative ones: packets
+// arriving in order are acknowledged together every few packets or after a
+// delay, whichever comes first. Anything out of the ordinary is answered
+// right away so the client never stalls on it: a packet past a gap is
+// acknowledged alone, which tells the client the gap's packet was
+// overtaken, and a retransmission or duplicate gets a cumulative ACK.
+// Packets held back are acknowledged before any packet past a gap, so the
+// client never takes them for overtaken.
+//
+// A client whose window is smaller than every would wait out the delay
+// for each window, so every time the delay expires the policy halves
+// every for the rest of the transfer.
+type ackPolicy struct {
+	every    int // In-order packets per ACK
+	delay    time.Duration
+	unacked  int       // In-order packets not acknowledged yet
+	due      time.Time // When they must be, zero if none are owed
+	received uint32    // Next sequence number past the highest data packet
+}
+
+func newAckPolicy(every int, delay time.Duration) *ackPolicy {
+	return &ackPolicy{every: every, delay: delay}
+}
+
+// onData returns the ACKs owed once data packet seq is stored, given the
+// next packet expected before and after storing it.
+func (a *ackPolicy) onData(seq, before, after uint32, now time.Time) []wire.Ack {
+	switch {
+	case seq >= after:
+		a.received = max(a.received, seq+1)
+		var acks []wire.Ack
+		if a.unacked > 0 {
+			acks = a.flush(after)
+		}
+		return append(acks, wire.Ack{Seq: seq})
+	case seq == before && seq+1 >= a.received:
+		a.received = seq + 1
+		a.unacked++
+		if a.unacked < a.every {
+			if a.due.IsZero() {
+				a.due = now.Add(a.delay)
+			}
+			return nil
+		}
+	}
+	return a.flush(after)
+}
+
+// expire returns the ACKs owed once their delay has passed.
+func (a *ackPolicy) expire(expected uint32) []wire.Ack {
+	a.every = max(1, a.every/2)
+	return a.flush(expected)
+}
+
+// flush acknowledges every packet before expected.
+func (a *ackPolicy) flush(expected uint32) []wire.Ack {
+	a.unacked, a.due = 0, time.Time{}
+	if expected == 0 {
+		return nil
+	}
+	return []wire.Ack{{Seq: expected - 1, Cumulative: true}}
+}
@@ -0,0 +1,198 @@
+package udpft
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+func TestAckPolicy(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cum := func(seq uint32) []wire.Ack { return []wire.Ack{{Seq: seq, Cumulative: true}} }
+
+	type step struct {
+		seq, before, after uint32
+		want               []wire.Ack
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"every 4 in order", []step{
+			{0, 0, 1, nil},
+			{1, 1, 2, nil},
+			{2, 2, 3, nil},
+			{3, 3, 4, cum(3)},
+			{4, 4, 5, nil},
+		}},
+		{"gap flushes, then acks alone", []step{
+			{0, 0, 1, nil},
+			{1, 1, 2, nil},
+			{3, 2, 2, append(cum(1), wire.Ack{Seq: 3})},
+			{4, 2, 2, []wire.Ack{{Seq: 4}}},
+		}},
+		{"retransmission filling the gap", []step{
+			{0, 0, 1, nil},
+			{2, 1, 1, append(cum(0), wire.Ack{Seq: 2})},
+			{1, 1, 3, cum(2)},
+		}},
+		{"duplicate", []step{
+			{0, 0, 1, nil},
+			{1, 1, 2, nil},
+			{0, 2, 2, cum(1)},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAckPolicy(4, 20*time.Millisecond)
+			for i, s := range tt.steps {
+				if got := a.onData(s.seq, s.before, s.after, now); !reflect.DeepEqual(got, s.want) {
+					t.Fatalf("step %d, packet %d: got %+v, want %+v", i, s.seq, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+// Held-back ACKs are owed after the delay, which halves how many packets
+// an ACK waits for.
+func TestAckPolicyDelay(t *testing.T) {
+	now := time.Unix(1000, 0)
+	a := newAckPolicy(8, 20*time.Millisecond)
+	a.onData(0, 0, 1, now)
+	a.onData(1, 1, 2, now.Add(5*time.Millisecond))
+	if want := now.Add(20 * time.Millisecond); !a.due.Equal(want) {
+		t.Fatalf("due %v after the first packet, want %v", a.due.Sub(now), want.Sub(now))
+	}
+	if got := a.expire(2); !reflect.DeepEqual(got, []wire.Ack{{Seq: 1, Cumulative: true}}) {
+		t.Errorf("expire = %+v, want a cumulative ACK of 1", got)
+	}
+	if a.every != 4 || !a.due.IsZero() {
+		t.Errorf("every %d, due %v after expiry, want 4 and nothing due", a.every, a.due)
+	}
+	for i := 0; i < 5; i++ {
+		a.expire(2)
+	}
+	if a.every != 1 {
+		t.Errorf("every %d after repeated expiry, want the floor of 1", a.every)
+	}
+}
+
+// countingConn counts the packets written through it.
+type countingConn struct {
+	net.PacketConn
+	writes atomic.Int64
+}
+
+func (c *countingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.writes.Add(1)
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// Cumulative ACKs cut the packets the server sends back, and the client
+// takes each for every packet up to it.
+func TestCumulativeAcks(t *testing.T) {
+	data := make([]byte, 1<<20)
+	sent := map[int]int64{}
+	for _, every := range []int{1, 8} {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counted := &countingConn{PacketConn: conn}
+		s := &Server{}
+		s.AckEvery = every
+		serveOn(t, s, counted)
+
+		var c Client
+		opts := quietOptions()
+		opts.Window = 64
+		res, err := c.SendFile(context.Background(), conn.LocalAddr().String(), writeFile(t, "acks.bin", data), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStored(t, s.UploadDir, "acks.bin", data)
+		if res.Retransmits != 0 {
+			t.Errorf("every %d: %d packets resent on loopback", every, res.Retransmits)
+		}
+		sent[every] = counted.writes.Load()
+	}
+	if sent[8] > sent[1]/3 {
+		t.Errorf("server sent %d packets acknowledging every 8th, %d acknowledging each", sent[8], sent[1])
+	}
+}
+
+// dupAcks precedes every ACK the client reads with the ACK before it
+// again and a short read, as a server re-acknowledging retransmissions
+// and a noisy network would.
+type dupAcks struct {
+	net.Conn
+	queue    [][]byte
+	last     []byte
+	injected int
+}
+
+func (c *dupAcks) Read(b []byte) (int, error) {
+	if len(c.queue) > 0 {
+		p := c.queue[0]
+		c.queue = c.queue[1:]
+		return copy(b, p), nil
+	}
+	n, err := c.Conn.Read(b)
+	var ack wire.Ack
+	if err != nil || ack.UnmarshalBinary(b[:n]) != nil {
+		return n, err
+	}
+	last := c.last
+	c.last = append([]byte(nil), b[:n]...)
+	if last == nil {
+		return n, err
+	}
+	c.queue = append(c.queue, []byte{0xff, 0xff}, c.last)
+	c.injected++
+	return copy(b, last), nil
+}
+
+// Duplicate ACKs cost the client neither a retry nor a
+// retransmission.
+func TestDuplicateAcks(t *testing.T) {
+	s := &Server{}
+	addr := serve(t, s)
+
+	var conn *dupAcks
+	c := &Client{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		raw, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn = &dupAcks{Conn: raw}
+		return conn, nil
+	}}
+	data := make([]byte, 100*DefaultPacketSize)
+	opts := quietOptions()
+	opts.Timeout = 10 * time.Second // A burned timeout slot would show
+	start := time.Now()
+	res, err := c.SendFile(context.Background(), addr, writeFile(t, "dup.bin", data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, s.UploadDir, "dup.bin", data)
+	if conn.injected == 0 {
+		t.Fatal("no duplicate ACKs injected")
+	}
+	if res.Retransmits != 0 || res.Timeouts != 0 {
+		t.Errorf("%d retransmits and %d timeouts with %d duplicate ACKs", res.Retransmits, res.Timeouts, conn.injected)
+	}
+	if res.DuplicateAcks == 0 {
+		t.Error("duplicate ACKs not counted")
+	}
+	if elapsed := time.Since(start); elapsed > opts.Timeout/2 {
+		t.Errorf("transfer took %v, waiting out a timeout", elapsed)
+	}
+}
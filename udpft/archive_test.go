@@ -0,0 +1,36 @@
+package udpft
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"socket-file-transfer/internal/archive"
+	"socket-file-transfer/internal/wire"
+)
+
+// An archive expanding past the limits, or misstating its entries' sizes,
+// fails with ErrExpansion and is removed with whatever was unpacked of it.
+func TestAutoExtractExpansion(t *testing.T) {
+	for _, name := range []string{"bomb.tar.gz", "lying-size.tar"} {
+		t.Run(name, func(t *testing.T) {
+			s := &Server{AutoExtract: true, MaxFileSize: 1 << 20}
+			addr := serve(t, s)
+			path := filepath.Join("..", "internal", "archive", "testdata", name)
+			_, err := (&Client{}).SendFile(context.Background(), addr, path, quietOptions())
+			if !errors.Is(err, wire.ErrExpansion) {
+				t.Fatalf("got %v, want ErrExpansion", err)
+			}
+			stem, _, _ := archive.Split(name)
+			entries, _ := os.ReadDir(s.UploadDir)
+			for _, e := range entries {
+				if strings.Contains(e.Name(), stem) {
+					t.Errorf("refused archive left %s behind", e.Name())
+				}
+			}
+		})
+	}
+}
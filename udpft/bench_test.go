@@ -0,0 +1,83 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// benchmarkSend sends size bytes over loopback to s b.N times, storing
+// each copy under the same name, and reports the packets per second the
+// server received.
+func benchmarkSend(b *testing.B, s *Server, size int, opts Options) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	addr := serve(b, s)
+	var c Client
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	var packets uint32
+	for i := 0; i < b.N; i++ {
+		res, err := c.Send(context.Background(), addr, "bench.bin", bytes.NewReader(data), int64(size), opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		packets += res.Packets
+	}
+	b.ReportMetric(float64(packets)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+func BenchmarkSend1MB(b *testing.B)  { benchmarkSend(b, &Server{}, 1<<20, quietOptions()) }
+func BenchmarkSend16MB(b *testing.B) { benchmarkSend(b, &Server{}, 16<<20, quietOptions()) }
+
+func BenchmarkSendFEC16MB(b *testing.B) {
+	opts := quietOptions()
+	opts.FECData, opts.FECParity = 16, 2
+	benchmarkSend(b, &Server{}, 16<<20, opts)
+}
+
+// Against BenchmarkSend16MB, the server reading and acknowledging packets
+// in batches, see Server.BatchIO.
+func BenchmarkSendBatchIO16MB(b *testing.B) {
+	s := &Server{}
+	s.BatchIO = true
+	benchmarkSend(b, s, 16<<20, quietOptions())
+}
+
+// Sends of 300 MiB over loopback with each window cap Options.Autotune may
+// settle on, then autotuned: of-best-% is the tuned sends' throughput as a
+// share of the fastest fixed cap's over all of them, as single sends vary
+// by 10-20% here.
+func BenchmarkAutotune(b *testing.B) {
+	const size = 300 << 20
+	addr := serve(b, &Server{})
+	var c Client
+	send := func(opts Options) time.Duration {
+		start := time.Now()
+		if _, err := c.Send(context.Background(), addr, "bench.bin", rand.New(rand.NewSource(1)), size, opts); err != nil {
+			b.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	steps := wire.NewTuner(MIN_TUNED_WINDOW, RECEIVE_WINDOW).Steps()
+	fixed := make([]time.Duration, len(steps))
+	var tuned time.Duration
+	for i := 0; i < b.N; i++ {
+		for j, v := range steps {
+			opts := quietOptions()
+			opts.MaxWindow = v
+			fixed[j] += send(opts)
+		}
+		opts := quietOptions()
+		opts.Autotune = true
+		tuned += send(opts)
+	}
+	b.ReportMetric(100*slices.Min(fixed).Seconds()/tuned.Seconds(), "of-best-%")
+}
@@ -0,0 +1,894 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"syscall"
+	"time"
+
+	"socket-file-transfer/internal/fec"
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/sparse"
+	"socket-file-transfer/internal/wire"
+)
+
+// Client sends files to a Server. The zero value is ready to use.
+type Client struct {
+	// Dial opens the datagram connection to the server. A net.Dialer is
+	// used if nil.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (c *Client) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if c.Dial != nil {
+		return c.Dial(ctx, "udp", addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "udp", addr)
+}
+
+// peerConn drops the datagrams that don't come from the server, counting
+// them, on connections that tell where datagrams come from. Connected
+// sockets already get none from elsewhere.
+type peerConn struct {
+	net.Conn
+	pc     net.PacketConn // Nil if the connection can't tell
+	strays int
+}
+
+func newPeerConn(conn net.Conn) *peerConn {
+	pc, _ := conn.(net.PacketConn)
+	return &peerConn{Conn: conn, pc: pc}
+}
+
+func (c *peerConn) Read(b []byte) (int, error) {
+	if c.pc == nil {
+		return c.Conn.Read(b)
+	}
+	for {
+		n, addr, err := c.pc.ReadFrom(b)
+		if err != nil || addr == nil || addr.String() == c.RemoteAddr().String() {
+			return n, err
+		}
+		c.strays++
+	}
+}
+
+// SendFile sends the file at path to the server at addr. Ending ctx stops
+// retransmissions and aborts the transfer; the returned error then wraps
+// ctx's error.
+func (c *Client) SendFile(ctx context.Context, addr, path string, opts Options) (*Result, error) {
+	rep := opts.reporter(addr)
+	defer rep.Close()
+
+	res, err := c.sendFile(ctx, addr, path, &opts, rep)
+	if err != nil {
+		err = wire.ContextError(ctx, err)
+		rep.Fail(err)
+		return nil, err
+	}
+
+	rep.CompleteStats(res.Bytes, &res.Stats)
+	return res, nil
+}
+
+// Send streams size bytes read from r to the server at addr, which stores
+// them as name. SkipIdentical is ignored since a stream can't be hashed up
+// front. Ending ctx aborts the transfer like it does for SendFile.
+func (c *Client) Send(ctx context.Context, addr, name string, r io.Reader, size int64, opts Options) (*Result, error) {
+	rep := opts.reporter(addr)
+	defer rep.Close()
+
+	res, err := c.send(ctx, addr, name, io.LimitReader(r, size), uint64(size), nil, nil, &opts, rep)
+	if err != nil {
+		err = wire.ContextError(ctx, err)
+		rep.Fail(err)
+		return nil, err
+	}
+
+	rep.CompleteStats(res.Bytes, &res.Stats)
+	return res, nil
+}
+
+func (c *Client) sendFile(ctx context.Context, addr, path string, opts *Options, rep *wire.Reporter) (*Result, error) {
+	// Make sure the file can be read before contacting the server
+	file, err := wire.OpenSource(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Hash the file up front so the server can tell us to skip it
+	var sum []byte
+	if opts.SkipIdentical {
+		sum, err = hashcache.File(path)
+		if err != nil {
+			return nil, fmt.Errorf("error hashing file: %w", err)
+		}
+	}
+
+	// Leave out the holes of a sparse file. FEC parity covers packets by
+	// their sequence number alone, so it can't place rebuilt sparse data.
+	var extents []sparse.Extent
+	if !opts.Legacy && opts.FECData == 0 {
+		extents, err = sparse.Extents(file.File, file.Size)
+		if err != nil {
+			return nil, fmt.Errorf("error finding holes in file: %w", err)
+		}
+		if !sparse.HasHoles(extents, file.Size) {
+			extents = nil
+		}
+	}
+
+	res, err := c.send(ctx, addr, opts.remoteName(path), file, uint64(file.Size), sum, extents, opts, rep)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Check(opts.logger()); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// send transfers fileSize bytes from r as filename, asking the server to
+// skip it if sum is non-nil and matches its copy. With extents, the data
+// extents of a file with holes, only those are sent if the server can take
+// them; r must then be an io.ReadSeeker.
+func (c *Client) send(ctx context.Context, addr, filename string, r io.Reader, fileSize uint64, sum []byte, extents []sparse.Extent, opts *Options, rep *wire.Reporter) (*Result, error) {
+	if err := wire.CheckName(filename); err != nil {
+		return nil, err
+	}
+	if size := opts.packetSize(); size < MIN_PACKET_SIZE || size > MAX_PACKET_SIZE {
+		return nil, fmt.Errorf("packet size %d is outside %d..%d", size, MIN_PACKET_SIZE, MAX_PACKET_SIZE)
+	}
+	if opts.FECData != 0 || opts.FECParity != 0 {
+		if opts.FECData < 1 || opts.FECParity < 1 || opts.FECData+opts.FECParity > MAX_FEC_GROUP {
+			return nil, fmt.Errorf("FEC group %d/%d needs at least one data and one parity packet, at most %d in all", opts.FECData, opts.FECData+opts.FECParity, MAX_FEC_GROUP)
+		}
+		// Legacy servers predate FEC
+		if opts.Legacy {
+			opts.FECData, opts.FECParity = 0, 0
+		}
+	}
+
+	// Create UDP connection
+	conn, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to server: %w", err)
+	}
+	defer conn.Close()
+	setDontFragment(conn)
+	peer := newPeerConn(conn)
+	conn = peer
+
+	// Closing the socket unblocks whatever ACK wait is pending. The server
+	// is told first, so it drops the partial file instead of waiting out
+	// its timeouts; returning waits until it was.
+	aborted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(aborted)
+		conn.Write(abortPacket(context.Cause(ctx)))
+		conn.Close()
+	})
+	defer func() {
+		if !stop() {
+			<-aborted
+		}
+	}()
+
+	log := opts.logger()
+	log.Info("Connected to UDP server", "addr", addr)
+
+	log.Info("Sending file", "name", filename, "size", fileSize)
+	rep.Start(filename, int64(fileSize))
+
+	// Send file header
+	ack, err := sendFileHeader(ctx, conn, filename, fileSize, sum, extents != nil, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error sending file header: %w", err)
+	}
+	common := wire.Hello{Version: ack.Version, Features: ack.Features}
+	// Sparse data goes at the offsets version 2 packets carry
+	if extents != nil && (common.Version < 2 || common.Features&wire.FEATURE_SPARSE == 0) {
+		log.Info("Server does not support sparse files, sending the holes as zeros")
+		extents = nil
+	}
+	// The server counts the file done once data reaches its end, so its
+	// last byte is sent even if it lies in a hole
+	if n := len(extents); extents != nil && (n == 0 || extents[n-1].End() < int64(fileSize)) {
+		extents = append(extents, sparse.Extent{Offset: int64(fileSize) - 1, Length: 1})
+	}
+
+	if ack.Status == wire.HEADER_STATUS_SKIP {
+		return &Result{Checksum: sum, Skipped: true, Session: ack.Session}, nil
+	}
+
+	// The server may already hold the start of the file. Packets carry
+	// where the rest goes only since version 2, and FEC groups count from
+	// the file's first packet.
+	if ack.Offset > 0 && (common.Version < 2 || opts.FECData > 0 || ack.Offset >= fileSize) {
+		return nil, fmt.Errorf("%w: server asked for the file from byte %d of %d", wire.ErrProtocol, ack.Offset, fileSize)
+	}
+
+	// Large packets may not fit the path to the server
+	if !opts.Legacy && opts.packetSize() > DefaultPacketSize {
+		opts.PacketSize, err = probePacketSize(ctx, conn, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error probing packet size: %w", err)
+		}
+		log.Debug("Probed packet size", "size", opts.PacketSize)
+	}
+
+	// Send file data
+	res, err := sendFileData(ctx, conn, r, fileSize, ack.Offset, common.Version >= 2, common.Features&wire.FEATURE_PAUSE != 0, extents, opts, rep)
+	if err != nil {
+		return nil, fmt.Errorf("error sending file data: %w", err)
+	}
+	res.Session = ack.Session
+	res.Strays += peer.strays
+	if res.Strays > 0 {
+		log.Info("Ignored stray packets", "packets", res.Strays)
+	}
+	return res, nil
+}
+
+// sendFileHeader announces the file and waits for the server's ACK,
+// returning what the server decided: the protocol version and features
+// agreed on, whether to send the data, and how. A legacy server's ACK reads
+// as version 1 without features. When sum is non-nil the server is asked to
+// skip the transfer if it already holds an identical copy. With sparse the
+// header says only the file's data will follow. opts.PacketSize and the FEC
+// group are lowered to what the server accepts.
+func sendFileHeader(ctx context.Context, conn net.Conn, filename string, fileSize uint64, sum []byte, sparse bool, opts *Options) (*wire.HeaderAck, error) {
+	// Create header packet
+	fh := &wire.FileHeader{Name: filename, Size: fileSize, Checksum: sum}
+	if sum != nil {
+		fh.Flags |= wire.FLAG_SKIP_IDENTICAL
+	}
+	// Servers that predate the field expect the default size and can't
+	// parse it, so only announce a different one
+	if !opts.Legacy && opts.packetSize() != DefaultPacketSize {
+		fh.Flags |= wire.FLAG_PACKET_SIZE
+		fh.PacketSize = uint16(opts.packetSize())
+	}
+	// Waiting for a delayed ACK would stall stop-and-wait
+	if !opts.Legacy && opts.Window != 1 {
+		fh.Flags |= wire.FLAG_CUMULATIVE_ACK
+	}
+	if opts.FECData > 0 {
+		fh.Flags |= wire.FLAG_FEC
+		fh.FECData, fh.FECParity = byte(opts.FECData), byte(opts.FECParity)
+	}
+	if sparse {
+		fh.Flags |= wire.FLAG_SPARSE
+	}
+	header, err := fh.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	// Versioned servers expect our hello in front of the header
+	if !opts.Legacy {
+		b, _ := hello.MarshalBinary()
+		header = append(b, header...)
+	}
+
+	log := opts.logger()
+	maxRetries := opts.maxRetries()
+
+	// Send header with retries
+	for retry := 0; retry < maxRetries && ctx.Err() == nil; retry++ {
+		_, err := conn.Write(header)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send header: %w", err)
+		}
+
+		// Wait for ACK; anything else before the deadline, such as a stray
+		// or late packet, doesn't cost a retry
+		conn.SetReadDeadline(time.Now().Add(opts.timeout()))
+		reply, err := readHeaderAck(conn)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Warn("Header ACK timeout", "retry", retry+1, "max", maxRetries)
+				continue
+			}
+			return nil, err
+		}
+
+		var ack *wire.HeaderAck
+		if opts.Legacy {
+			ack = &wire.HeaderAck{Version: 1, PacketSize: DefaultPacketSize}
+			if bytes.HasPrefix(reply, []byte(HEADER_SKIP)) {
+				ack.Status = wire.HEADER_STATUS_SKIP
+			}
+		} else {
+			ack, err = parseHeaderAck(reply, fh, opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if ack.Status == wire.HEADER_STATUS_SKIP {
+			return ack, nil
+		}
+		if opts.Legacy {
+			log.Info("Header acknowledged by server")
+		} else {
+			log.Info("Header acknowledged by server", "session", ack.Session)
+		}
+		return ack, nil
+	}
+
+	return nil, fmt.Errorf("%w: no header ACK after %d retries", wire.ErrTimeout, maxRetries)
+}
+
+// parseHeaderAck decodes a versioned server's reply to the header fh and
+// adapts opts to it.
+func parseHeaderAck(reply []byte, fh *wire.FileHeader, opts *Options) (*wire.HeaderAck, error) {
+	log := opts.logger()
+
+	// Before version 3 the ACK was the bare prefix and the server's hello
+	if !wire.HasMagic(reply) {
+		var peer wire.Hello
+		reply = bytes.TrimPrefix(bytes.TrimPrefix(reply, []byte(HEADER_SKIP)), []byte(HEADER_ACK))
+		if err := peer.UnmarshalBinary(reply); err != nil {
+			return nil, fmt.Errorf("invalid header ACK: %w", err)
+		}
+		return nil, fmt.Errorf("%w: server too old, it speaks protocol version %d and UDP clients need %d; upgrade it or send over TCP", wire.ErrProtocol, peer.Version, hello.Version)
+	}
+
+	var ack wire.HeaderAck
+	if err := ack.UnmarshalBinary(reply); err != nil {
+		return nil, fmt.Errorf("invalid header ACK: %w", err)
+	}
+	// The server answers with what we have in common, so it must be no
+	// more than we offered
+	common, err := wire.Negotiate(hello, wire.Hello{Version: ack.Version, Features: ack.Features})
+	if err != nil {
+		return nil, err
+	}
+	if common.Version != ack.Version || common.Features != ack.Features || ack.Version < 3 {
+		return nil, fmt.Errorf("%w: header ACK for protocol version %d, features %#x", wire.ErrProtocol, ack.Version, ack.Features)
+	}
+	log.Debug("Negotiated protocol", "version", ack.Version, "features", ack.Features)
+
+	if fh.Flags&wire.FLAG_PACKET_SIZE != 0 && ack.Features&wire.FEATURE_PACKET_SIZE == 0 {
+		log.Warn("Server does not support other packet sizes, using the default")
+	} else if size := int(ack.PacketSize); size != opts.packetSize() {
+		log.Warn("Server lowered the packet size", "size", size)
+	}
+	if size := int(ack.PacketSize); size < MIN_PACKET_SIZE || size > opts.packetSize() {
+		return nil, fmt.Errorf("%w: server chose packet size %d, %d was asked for", wire.ErrProtocol, size, opts.packetSize())
+	}
+	opts.PacketSize = int(ack.PacketSize)
+
+	if fh.Flags&wire.FLAG_FEC != 0 && ack.Features&wire.FEATURE_FEC == 0 {
+		log.Warn("Server does not support FEC, relying on retransmission")
+		opts.FECData, opts.FECParity = 0, 0
+	}
+	return &ack, nil
+}
+
+// readHeaderAck reads until a header ACK of either format arrives,
+// returning it, or the read deadline passes. A remote error ends the wait.
+func readHeaderAck(conn net.Conn) ([]byte, error) {
+	ackBuf := make([]byte, len(ERROR_PREFIX)+wire.MAX_ERROR_FRAME_LEN)
+	for {
+		n, err := conn.Read(ackBuf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil, err
+			}
+			return nil, fmt.Errorf("error reading header ACK: %w", err)
+		}
+		reply := ackBuf[:n]
+		if rerr := remoteError(reply); rerr != nil {
+			return nil, rerr
+		}
+		if wire.HasMagic(reply) || bytes.HasPrefix(reply, []byte(HEADER_SKIP)) || bytes.HasPrefix(reply, []byte(HEADER_ACK)) {
+			return reply, nil
+		}
+	}
+}
+
+// probePacketSize finds the largest payload, up to the configured one, whose
+// packets reach the server. It halves the size while probes go unanswered
+// or the kernel refuses them as too large for the path, but never goes below
+// DefaultPacketSize.
+func probePacketSize(ctx context.Context, conn net.Conn, opts *Options) (int, error) {
+	log := opts.logger()
+	reply := make([]byte, len(ERROR_PREFIX)+wire.MAX_ERROR_FRAME_LEN)
+
+	for size := opts.packetSize(); size > DefaultPacketSize; size = max(size/2, DefaultPacketSize) {
+		probe := make([]byte, wire.DATA_HEADER_LEN+wire.DATA_OFFSET_LEN+size)
+		copy(probe, PROBE)
+		want := binary.BigEndian.AppendUint16([]byte(PROBE), uint16(len(probe)))
+
+		for attempt := 0; attempt < PROBE_ATTEMPTS; attempt++ {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			_, err := conn.Write(probe)
+			if errors.Is(err, syscall.EMSGSIZE) {
+				break
+			}
+			if err != nil {
+				return 0, fmt.Errorf("error sending probe: %w", err)
+			}
+
+			// Replies to larger probes sent earlier don't match
+			conn.SetReadDeadline(time.Now().Add(opts.timeout()))
+			for {
+				n, err := conn.Read(reply)
+				if err != nil {
+					if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+						break
+					}
+					return 0, fmt.Errorf("error reading probe reply: %w", err)
+				}
+				if rerr := remoteError(reply[:n]); rerr != nil {
+					return 0, rerr
+				}
+				if bytes.Equal(reply[:n], want) {
+					return size, nil
+				}
+			}
+		}
+		log.Warn("Packets too large for the path to the server", "size", size)
+	}
+	return DefaultPacketSize, nil
+}
+
+// pause holds the transfer back until opts.Pause resumes it, telling the
+// server if it supports pauses.
+func pause(ctx context.Context, conn net.Conn, pauses bool, opts *Options, rep *wire.Reporter) error {
+	log := opts.logger()
+	if pauses {
+		if err := control(ctx, conn, PAUSE, opts); err != nil {
+			return err
+		}
+	} else {
+		log.Warn("Server does not support pauses, it may give up on the transfer")
+	}
+	log.Info("Transfer paused")
+	rep.Paused()
+	started := time.Now()
+	if err := opts.Pause.Wait(ctx); err != nil {
+		return err
+	}
+	if pauses {
+		if err := control(ctx, conn, RESUME, opts); err != nil {
+			return err
+		}
+	}
+	log.Info("Transfer resumed", "paused", time.Since(started))
+	rep.Resumed()
+	return nil
+}
+
+// control sends msg until the server echoes it, passing over ACKs.
+func control(ctx context.Context, conn net.Conn, msg string, opts *Options) error {
+	reply := make([]byte, len(ERROR_PREFIX)+wire.MAX_ERROR_FRAME_LEN)
+	maxRetries := opts.maxRetries()
+	for retry := 0; retry < maxRetries; retry++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return fmt.Errorf("error sending %s: %w", msg, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(opts.timeout()))
+		for {
+			n, err := conn.Read(reply)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return fmt.Errorf("error reading %s reply: %w", msg, err)
+			}
+			if rerr := remoteError(reply[:n]); rerr != nil {
+				return rerr
+			}
+			if bytes.Equal(reply[:n], []byte(msg)) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: server did not answer %s after %d retries", wire.ErrTimeout, msg, maxRetries)
+}
+
+// inflight is a data packet sent but not yet acknowledged.
+type inflight struct {
+	packet  []byte
+	payload int
+	hole    uint64 // Bytes of the hole skipped before the payload
+	sentAt  time.Time
+	sends   int
+	expired int // Timeouts waiting for its ACK; fast retransmits don't count
+}
+
+// sendFileData streams the file in data packets, keeping as many of them
+// unacknowledged as the congestion controller allows. New packets are paced
+// across the measured round-trip time so a full window doesn't leave in one
+// burst.
+//
+// With offsets each data packet also carries the byte offset of its payload,
+// and sending may begin at start, the end of what the server already holds.
+// With extents as well, only those are read and sent, from r, which must be
+// an io.ReadSeeker; the last must end with the file. With pauses the server
+// is told when opts.Pause holds the transfer back.
+func sendFileData(ctx context.Context, conn net.Conn, r io.Reader, fileSize, start uint64, offsets, pauses bool, extents []sparse.Extent, opts *Options, rep *wire.Reporter) (*Result, error) {
+	startTime := time.Now()
+	var totalRead, totalAcked, holesAcked uint64
+	var nextSeq uint32
+	var stats Stats
+	lastSent := fileSize == 0
+	size := opts.packetSize()
+	if (fileSize+uint64(size)-1)/uint64(size) > math.MaxUint32+1 {
+		return nil, fmt.Errorf("%d bytes need more than 2^32 packets of %d bytes", fileSize, size)
+	}
+	headerLen := wire.DATA_HEADER_LEN
+	if offsets {
+		headerLen += wire.DATA_OFFSET_LEN
+	}
+	cc := opts.congestionController()
+
+	// Tuning caps the adaptive window low and raises the cap while that
+	// makes the transfer faster
+	var tuner *wire.Tuner
+	adaptive, _ := cc.(*aimd)
+	if opts.Autotune && adaptive != nil {
+		tuner = wire.NewTuner(min(MIN_TUNED_WINDOW, opts.maxWindow()), opts.maxWindow())
+		adaptive.setMax(tuner.Value())
+	}
+	pending := make(map[uint32]*inflight, cc.window())
+	var free [][]byte // Packet buffers of acknowledged packets
+	var busy string   // What the server last said it is doing
+	ackBuf := make([]byte, len(ERROR_PREFIX)+wire.MAX_ERROR_FRAME_LEN)
+	hasher := sha256.New()
+	log := opts.logger()
+	timeout := opts.timeout()
+	maxRetries := opts.maxRetries()
+	pace := newPacer(opts.paceBurst())
+	var rtt rttEstimator
+
+	// A read stuck on the file mustn't outlast ctx's deadline; a sparse
+	// file is read around its holes, seeking, so it is read directly
+	if extents == nil {
+		var stopReading func()
+		r, stopReading = wire.ReadAhead(ctx, r, size)
+		defer stopReading()
+	}
+
+	// The server holds the file up to start, which is only hashed and
+	// counts as delivered like a hole
+	if start > 0 {
+		if _, err := io.CopyN(hasher, r, int64(start)); err != nil {
+			return nil, fmt.Errorf("error reading file: %w", err)
+		}
+		totalRead, holesAcked = start, start
+	}
+
+	// Packets below recoverSeq were sent before the last loss was detected;
+	// losing them too belongs to the same congestion event
+	var recoverSeq uint32
+	window := cc.window()
+	peakWindow := window
+	trace := opts.WindowTrace
+	if trace != nil {
+		trace(WindowSample{Window: window})
+	}
+	lost := func(seq uint32) {
+		if seq < recoverSeq {
+			return
+		}
+		recoverSeq = nextSeq
+		cc.onLoss()
+		window = cc.window()
+		if trace != nil {
+			trace(WindowSample{Elapsed: time.Since(startTime), Window: window, RTT: rtt.srtt, Loss: true})
+		}
+	}
+	// With FEC each group of data packets is followed by its parity
+	var code *fec.Code
+	var parity [][]byte
+	var parityBuf []byte
+	if opts.FECData > 0 {
+		code, _ = fec.New(opts.FECData, opts.FECParity)
+		parity = make([][]byte, opts.FECParity)
+		for i := range parity {
+			parity[i] = make([]byte, size)
+		}
+		parityBuf = make([]byte, 0, wire.DATA_HEADER_LEN+size)
+	}
+	sendParity := func(group uint32, now time.Time) error {
+		for i, p := range parity {
+			dp := wire.DataPacket{Seq: group, Parity: true, Index: byte(i), Payload: p}
+			packet, err := dp.AppendBinary(parityBuf[:0])
+			if err != nil {
+				return err
+			}
+			_, err = conn.Write(packet)
+			if err != nil {
+				return fmt.Errorf("error sending parity of group %d: %w", group, err)
+			}
+			clear(p)
+			pace.spend(now)
+			stats.PacketsSent++
+			stats.WireBytes += int64(len(packet))
+		}
+		return nil
+	}
+
+	// A packet is overtaken once DUP_THRESHOLD later packets were
+	// acknowledged, counting only those past its FEC group, which the
+	// server may still rebuild it from
+	overtaken := func(seq, acked uint32) bool {
+		if code != nil {
+			k := uint32(code.DataShards())
+			seq = seq/k*k + k - 1
+		}
+		return seq+DUP_THRESHOLD <= acked
+	}
+
+	resend := func(seq uint32, p *inflight, now time.Time) error {
+		stats.Retransmits++
+		rep.Retransmit(seq)
+		_, err := conn.Write(p.packet)
+		if err != nil {
+			return fmt.Errorf("error sending packet %d: %w", seq, err)
+		}
+		p.sentAt = now
+		p.sends++
+		stats.PacketsSent++
+		stats.WireBytes += int64(len(p.packet))
+		return nil
+	}
+
+	for !lastSent || len(pending) > 0 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// ACKs that arrived during a pause went unread, so the packets
+		// still pending go out again rather than time out
+		if opts.Pause.Paused() {
+			if err := pause(ctx, conn, pauses, opts, rep); err != nil {
+				return nil, err
+			}
+			now := time.Now()
+			for seq, p := range pending {
+				if err := resend(seq, p, now); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		// Fill the window as fast as the pacer allows
+		now := time.Now()
+		for !lastSent && len(pending) < window {
+			if t := pace.next(now); t.IsZero() || t.After(now) {
+				break
+			}
+
+			var buffer []byte
+			if len(free) > 0 {
+				buffer, free = free[len(free)-1], free[:len(free)-1]
+			} else {
+				buffer = make([]byte, headerLen+size)
+			}
+
+			// Read data from file, skipping to the next extent of a sparse
+			// one, whose holes are hashed as the zeros they read as
+			end := fileSize
+			var hole uint64
+			if extents != nil {
+				for uint64(extents[0].End()) <= totalRead {
+					extents = extents[1:]
+				}
+				if next := uint64(extents[0].Offset); next > totalRead {
+					if _, err := r.(io.Seeker).Seek(int64(next), io.SeekStart); err != nil {
+						err = fmt.Errorf("error seeking in file: %w", err)
+						conn.Write(errorPacket(err))
+						return nil, err
+					}
+					sparse.WriteZeros(hasher, int64(next-totalRead))
+					hole, totalRead = next-totalRead, next
+				}
+				end = uint64(extents[0].End())
+			}
+			n := int(min(uint64(size), end-totalRead))
+			payload := buffer[headerLen : headerLen+n]
+			offset := totalRead
+			if _, err := io.ReadFull(r, payload); err != nil {
+				err = fmt.Errorf("error reading file after %d of %d bytes: %w", totalRead, fileSize, err)
+				conn.Write(errorPacket(err)) // So the server doesn't wait out its timeouts
+				return nil, err
+			}
+			hasher.Write(payload)
+			totalRead += uint64(n)
+			lastSent = totalRead >= fileSize
+
+			// Create data packet
+			dp := wire.DataPacket{Seq: nextSeq, Last: lastSent, HasOffset: offsets, Offset: offset, Payload: payload}
+			packet, err := dp.AppendBinary(buffer[:0])
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = conn.Write(packet)
+			if err != nil {
+				return nil, fmt.Errorf("error sending packet %d: %w", nextSeq, err)
+			}
+			pending[nextSeq] = &inflight{packet: packet, payload: n, hole: hole, sentAt: now, sends: 1}
+			pace.spend(now)
+			stats.PacketsSent++
+			stats.WireBytes += int64(len(packet))
+
+			if code != nil {
+				k := uint32(code.DataShards())
+				code.Accumulate(int(nextSeq%k), payload, parity)
+				if nextSeq%k == k-1 || lastSent {
+					if err := sendParity(nextSeq/k, now); err != nil {
+						return nil, err
+					}
+				}
+			}
+			nextSeq++
+		}
+
+		// Wait for ACKs until a packet is overdue or the pacer lets the
+		// next one go
+		deadline := time.Time{}
+		for _, p := range pending {
+			if due := p.sentAt.Add(timeout); deadline.IsZero() || due.Before(deadline) {
+				deadline = due
+			}
+		}
+		if !lastSent && len(pending) < window {
+			if t := pace.next(now); !t.IsZero() && (deadline.IsZero() || t.Before(deadline)) {
+				deadline = t
+			}
+		}
+		conn.SetReadDeadline(deadline)
+
+		ackN, err := conn.Read(ackBuf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				return nil, fmt.Errorf("error reading ACK: %w", err)
+			}
+
+			// Resend the packets whose ACK is overdue
+			now := time.Now()
+			for seq, p := range pending {
+				if now.Before(p.sentAt.Add(timeout)) {
+					continue
+				}
+				p.expired++
+				stats.Timeouts++
+				if p.expired >= maxRetries {
+					return nil, fmt.Errorf("%w: no ACK for packet %d after %d retries", wire.ErrTimeout, seq, maxRetries)
+				}
+				log.Warn("Packet ACK timeout", "seq", seq, "retry", p.expired, "max", maxRetries)
+				lost(seq)
+				if err := resend(seq, p, now); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		if rerr := remoteError(ackBuf[:ackN]); rerr != nil {
+			return nil, rerr
+		}
+
+		// A server storing the file holds back the last ACKs, which aren't
+		// overdue while it keeps saying so
+		if status, ok := busyStatus(ackBuf[:ackN]); ok {
+			if status != "" && status != busy {
+				busy = status
+				rep.Busy(status)
+			}
+			now := time.Now()
+			for _, p := range pending {
+				p.sentAt, p.expired = now, 0
+			}
+			continue
+		}
+
+		// Stale or duplicated ACKs for earlier packets don't matter. A
+		// cumulative ACK covers every pending packet up to its sequence
+		// number; the newest of them stands in for it below.
+		var ack wire.Ack
+		if ack.UnmarshalBinary(ackBuf[:ackN]) != nil {
+			stats.Strays++
+			continue
+		}
+		var newest *inflight
+		var newestSeq uint32
+		var count int
+		for seq, q := range pending {
+			if seq == ack.Seq || ack.Cumulative && seq < ack.Seq {
+				if newest == nil || seq > newestSeq {
+					newest, newestSeq = q, seq
+				}
+				delete(pending, seq)
+				free = append(free, q.packet[:cap(q.packet)])
+				totalAcked += uint64(q.payload)
+				holesAcked += q.hole
+				count++
+			}
+		}
+		if newest == nil {
+			stats.DuplicateAcks++
+			continue
+		}
+		p := newest
+
+		if ack.Repaired {
+			stats.Repaired++
+		}
+
+		// Packets sent before this one and overtaken by others are taken
+		// as lost without waiting for their timeout
+		now = time.Now()
+		for seq, q := range pending {
+			if overtaken(seq, newestSeq) && q.sentAt.Before(p.sentAt) {
+				log.Debug("Packet overtaken, resending", "seq", seq, "acked", newestSeq)
+				lost(seq)
+				if err := resend(seq, q, now); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for i := 0; i < count; i++ {
+			cc.onAck()
+		}
+		if tuner != nil && tuner.Observe(now, int64(totalAcked+holesAcked)) {
+			log.Debug("Tuning the window cap", "max", tuner.Value(), "settled", tuner.Done())
+			adaptive.setMax(tuner.Value())
+		}
+		if w := cc.window(); w != window {
+			window = w
+			peakWindow = max(peakWindow, w)
+			if trace != nil {
+				trace(WindowSample{Elapsed: time.Since(startTime), Window: window, RTT: rtt.srtt})
+			}
+		}
+
+		// Only packets sent once time the round trip unambiguously, and
+		// rebuilt ones waited for their group's parity
+		if p.sends == 1 && !ack.Repaired {
+			rtt.sample(now.Sub(p.sentAt))
+		}
+		if rtt.srtt > 0 {
+			pace.setRate(float64(window)/rtt.srtt.Seconds(), now)
+		}
+
+		rep.Progress(int64(totalAcked + holesAcked))
+	}
+
+	duration := time.Since(startTime)
+	rtt.record(&stats)
+	res := &Result{
+		Bytes:      int64(totalAcked),
+		Duration:   duration,
+		Checksum:   hasher.Sum(nil),
+		Packets:    nextSeq,
+		SendRate:   float64(stats.PacketsSent) / duration.Seconds(),
+		PeakWindow: peakWindow,
+		Stats:      stats,
+	}
+	if tuner != nil && tuner.Done() {
+		res.MaxWindow = tuner.Value()
+	}
+	return res, nil
+}
@@ -0,0 +1,59 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSendFile(t *testing.T) {
+	s := &Server{}
+	addr := serve(t, s)
+	data := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	var c Client
+	res, err := c.SendFile(context.Background(), addr, writeFile(t, "api.bin", data), quietOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, s.UploadDir, "api.bin", data)
+	sum := sha256.Sum256(data)
+	if res.Bytes != int64(len(data)) || !bytes.Equal(res.Checksum, sum[:]) {
+		t.Errorf("result reports %d bytes with checksum %x, want %d and %x", res.Bytes, res.Checksum, len(data), sum)
+	}
+}
+
+func TestSendReader(t *testing.T) {
+	s := &Server{}
+	addr := serve(t, s)
+	data := []byte(strings.Repeat("streamed ", 5000))
+
+	var c Client
+	_, err := c.Send(context.Background(), addr, "stream.txt", bytes.NewReader(data), int64(len(data)), quietOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, s.UploadDir, "stream.txt", data)
+}
+
+func TestSendErrors(t *testing.T) {
+	s := &Server{MaxFileSize: 10}
+	addr := serve(t, s)
+	var c Client
+
+	_, err := c.SendFile(context.Background(), addr, writeFile(t, "big.txt", make([]byte, 11)), quietOptions())
+	var remote *RemoteError
+	if !errors.Is(err, ErrTooLarge) || !errors.As(err, &remote) {
+		t.Errorf("oversized file: got %v, want a *RemoteError wrapping ErrTooLarge", err)
+	}
+
+	_, err = c.Send(context.Background(), addr, "../escape", strings.NewReader("x"), 1, quietOptions())
+	if !errors.Is(err, ErrInvalidName) {
+		t.Errorf("invalid name: got %v, want ErrInvalidName", err)
+	}
+}
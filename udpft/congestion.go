@@ -0,0 +1,49 @@
+package udpft
+
+// congestionController decides how many data packets the client keeps in
+// flight.
+type congestionController interface {
+	// window returns how many packets may be unacknowledged, at least one
+	window() int
+
+	// onAck is called for every packet acknowledged
+	onAck()
+
+	// onLoss is called once per loss event: a retransmission timeout or a
+	// packet overtaken by DUP_THRESHOLD later ones
+	onLoss()
+}
+
+// fixedWindow keeps the same number of packets in flight whatever happens.
+type fixedWindow int
+
+func (w fixedWindow) window() int { return int(w) }
+func (fixedWindow) onAck()        {}
+func (fixedWindow) onLoss()       {}
+
+// aimd grows the window by one packet per window of ACKs, about one per
+// round trip, and halves it on loss.
+type aimd struct {
+	cwnd float64
+	max  float64
+}
+
+func newAIMD(max int) *aimd {
+	return &aimd{cwnd: float64(min(INITIAL_WINDOW, max)), max: float64(max)}
+}
+
+func (a *aimd) window() int { return int(a.cwnd) }
+
+func (a *aimd) onAck() {
+	a.cwnd = min(a.max, a.cwnd+1/a.cwnd)
+}
+
+func (a *aimd) onLoss() {
+	a.cwnd = max(1, a.cwnd/2)
+}
+
+// setMax caps the window at max packets from now on.
+func (a *aimd) setMax(max int) {
+	a.max = float64(max)
+	a.cwnd = min(a.cwnd, a.max)
+}
@@ -0,0 +1,121 @@
+package udpft
+
+import (
+	"context"
+	"testing"
+
+	"socket-file-transfer/internal/netsim"
+)
+
+// ackRound acknowledges one window's worth of packets, a round trip.
+func ackRound(cc congestionController) {
+	for n := cc.window(); n > 0; n-- {
+		cc.onAck()
+	}
+}
+
+func TestAIMD(t *testing.T) {
+	cc := newAIMD(64)
+	if w := cc.window(); w != INITIAL_WINDOW {
+		t.Fatalf("starts at %d packets, want %d", w, INITIAL_WINDOW)
+	}
+
+	// Additive increase: one packet per round trip
+	for round := 1; round <= 10; round++ {
+		before := cc.window()
+		ackRound(cc)
+		if got := cc.window(); got != before+1 && got != before {
+			t.Fatalf("round %d grew the window from %d to %d, want at most one packet", round, before, got)
+		}
+	}
+	if w := cc.window(); w < INITIAL_WINDOW+8 {
+		t.Fatalf("window %d after 10 clean rounds, want about %d", w, INITIAL_WINDOW+10)
+	}
+
+	// Multiplicative decrease
+	before := cc.window()
+	cc.onLoss()
+	if got := cc.window(); got != before/2 {
+		t.Errorf("loss took the window from %d to %d, want %d", before, got, before/2)
+	}
+
+	// Floor of one packet
+	for i := 0; i < 20; i++ {
+		cc.onLoss()
+	}
+	if w := cc.window(); w != 1 {
+		t.Errorf("window %d after repeated loss, want 1", w)
+	}
+
+	// Cap
+	for i := 0; i < 200; i++ {
+		ackRound(cc)
+	}
+	if w := cc.window(); w != 64 {
+		t.Errorf("window %d after many clean rounds, want the cap of 64", w)
+	}
+	cc.setMax(10)
+	if w := cc.window(); w != 10 {
+		t.Errorf("window %d after lowering the cap, want 10", w)
+	}
+}
+
+func TestAIMDSmallCap(t *testing.T) {
+	if w := newAIMD(2).window(); w != 2 {
+		t.Errorf("starts at %d packets under a cap of 2", w)
+	}
+}
+
+func TestFixedWindow(t *testing.T) {
+	cc := fixedWindow(16)
+	ackRound(cc)
+	cc.onLoss()
+	if w := cc.window(); w != 16 {
+		t.Errorf("fixed window moved to %d", w)
+	}
+}
+
+func TestCongestionControllerChoice(t *testing.T) {
+	if _, ok := (&Options{Window: 8}).congestionController().(fixedWindow); !ok {
+		t.Error("Options.Window doesn't fix the window")
+	}
+	if w := (&Options{Window: RECEIVE_WINDOW + 1}).congestionController().window(); w != RECEIVE_WINDOW {
+		t.Errorf("fixed window of %d, above RECEIVE_WINDOW", w)
+	}
+	cc, ok := (&Options{MaxWindow: 32}).congestionController().(*aimd)
+	if !ok || cc.max != 32 {
+		t.Errorf("got %#v, want AIMD capped at 32", cc)
+	}
+}
+
+// The window trace shows the window halving at each loss on a lossy link.
+func TestWindowTrace(t *testing.T) {
+	s := &Server{}
+	addr, c, _ := impaired(t, s, netsim.Config{Loss: 0.05, Seed: 5})
+	opts := quietOptions()
+	var samples []WindowSample
+	opts.WindowTrace = func(w WindowSample) { samples = append(samples, w) }
+
+	data := make([]byte, 2<<20)
+	if _, err := c.SendFile(context.Background(), addr, writeFile(t, "trace.bin", data), opts); err != nil {
+		t.Fatal(err)
+	}
+	losses := 0
+	for i, w := range samples {
+		if w.Window < 1 {
+			t.Fatalf("sample %d has a window of %d", i, w.Window)
+		}
+		if i > 0 && w.Elapsed < samples[i-1].Elapsed {
+			t.Fatalf("sample %d goes back in time", i)
+		}
+		if w.Loss {
+			losses++
+			if i > 0 && w.Window > max(1, samples[i-1].Window/2) {
+				t.Errorf("loss at sample %d left the window at %d, down from %d", i, w.Window, samples[i-1].Window)
+			}
+		}
+	}
+	if losses == 0 {
+		t.Error("no loss traced on a lossy link")
+	}
+}
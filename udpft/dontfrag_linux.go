@@ -0,0 +1,27 @@
+package udpft
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment stops the kernel from fragmenting our packets, so one too
+// large for the path is refused with EMSGSIZE or dropped rather than split.
+func setDontFragment(conn net.Conn) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	addr, _ := conn.LocalAddr().(*net.UDPAddr)
+	raw.Control(func(fd uintptr) {
+		if addr != nil && addr.IP.To4() == nil {
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+		} else {
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		}
+	})
+}
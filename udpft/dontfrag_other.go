@@ -0,0 +1,9 @@
+//go:build !linux
+
+package udpft
+
+import "net"
+
+// setDontFragment is a no-op: packets too large for the path are left to
+// the probe timing out.
+func setDontFragment(conn net.Conn) {}
@@ -0,0 +1,56 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Empty and one-byte files are stored at once, with the server reporting
+// the transfer complete rather than waiting for data that never comes.
+func TestTinyFiles(t *testing.T) {
+	for _, size := range []int{0, 1} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			completed := make(chan Event, 1)
+			s := &Server{}
+			s.Progress = func(e Event) {
+				if e.Kind == EventCompleted || e.Kind == EventFailed {
+					completed <- e
+				}
+			}
+			addr := serve(t, s)
+			data := []byte("x")[:size]
+
+			var c Client
+			start := time.Now()
+			res, err := c.SendFile(context.Background(), addr, writeFile(t, "tiny", data), quietOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if took := time.Since(start); took > time.Second {
+				t.Errorf("took %v", took)
+			}
+			if res.Bytes != int64(size) {
+				t.Errorf("sent %d bytes, want %d", res.Bytes, size)
+			}
+			checkStored(t, s.UploadDir, "tiny", data)
+
+			select {
+			case e := <-completed:
+				if e.Kind != EventCompleted || e.Bytes != int64(size) || e.Total != int64(size) {
+					t.Errorf("server reported %v with %d of %d bytes", e.Kind, e.Bytes, e.Total)
+				}
+			case <-time.After(time.Second):
+				t.Error("server never reported the transfer complete")
+			}
+
+			// Streamed with its size known up front as well
+			if _, err := c.Send(context.Background(), addr, "tiny-stream", bytes.NewReader(data), int64(size), quietOptions()); err != nil {
+				t.Fatal(err)
+			}
+			checkStored(t, s.UploadDir, "tiny-stream", data)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package udpft
+
+import (
+	"socket-file-transfer/internal/fec"
+	"socket-file-transfer/internal/wire"
+)
+
+// fecReceiver collects the data and parity packets of FEC groups on the
+// server and rebuilds lost data packets once a group has enough of them.
+// Group g holds data packets g*k to g*k+k-1 and follows them with its parity
+// packets. All data packets carry a full shard except the file's last one;
+// the shard size is learned from the first parity packet, which always
+// carries a full one.
+type fecReceiver struct {
+	code      *fec.Code
+	fileSize  uint64
+	shardSize int
+	groups    map[uint32][][]byte // Shards received, data then parity
+}
+
+func newFECReceiver(code *fec.Code, fileSize uint64) *fecReceiver {
+	return &fecReceiver{code: code, fileSize: fileSize, groups: make(map[uint32][][]byte)}
+}
+
+// dataPackets returns how many data packets group g holds.
+func (f *fecReceiver) dataPackets(g uint32) int {
+	k := f.code.DataShards()
+	if f.shardSize == 0 {
+		return k
+	}
+	total := (f.fileSize + uint64(f.shardSize) - 1) / uint64(f.shardSize)
+	return int(min(uint64(k), total-min(total, uint64(g)*uint64(k))))
+}
+
+func (f *fecReceiver) group(g uint32) [][]byte {
+	shards := f.groups[g]
+	if shards == nil {
+		shards = make([][]byte, f.code.DataShards()+f.code.ParityShards())
+		f.groups[g] = shards
+	}
+	return shards
+}
+
+// addData records data packet seq, which the caller has stored. have
+// reports whether a data packet is stored, so groups are dropped once
+// complete.
+func (f *fecReceiver) addData(seq uint32, payload []byte, have func(uint32) bool) []wire.DataPacket {
+	k := uint32(f.code.DataShards())
+	if f.complete(seq/k, have) {
+		delete(f.groups, seq/k)
+		return nil
+	}
+	shards := f.group(seq / k)
+	shards[seq%k] = payload
+	return f.repair(seq/k, have)
+}
+
+// addParity records parity packet p, ignoring it if its group is complete.
+func (f *fecReceiver) addParity(p *wire.DataPacket, have func(uint32) bool) []wire.DataPacket {
+	if int(p.Index) >= f.code.ParityShards() || len(p.Payload) == 0 {
+		return nil
+	}
+	if f.shardSize == 0 {
+		f.shardSize = len(p.Payload)
+	}
+	if len(p.Payload) != f.shardSize || f.complete(p.Seq, have) {
+		return nil
+	}
+	shards := f.group(p.Seq)
+	shards[f.code.DataShards()+int(p.Index)] = append([]byte(nil), p.Payload...)
+	return f.repair(p.Seq, have)
+}
+
+func (f *fecReceiver) complete(g uint32, have func(uint32) bool) bool {
+	first := g * uint32(f.code.DataShards())
+	for i := 0; i < f.dataPackets(g); i++ {
+		if !have(first + uint32(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// repair rebuilds the missing data packets of group g if enough of its
+// shards arrived, and forgets the group once all its data is stored.
+func (f *fecReceiver) repair(g uint32, have func(uint32) bool) []wire.DataPacket {
+	shards := f.groups[g]
+	k := f.code.DataShards()
+	n := f.dataPackets(g)
+	present, missing := 0, 0
+	for i, s := range shards {
+		switch {
+		case s != nil:
+			present++
+		case i < k && i >= n:
+			present++ // Past the end of the file, known to be zero
+		case i < k:
+			missing++
+		}
+	}
+	if missing == 0 {
+		delete(f.groups, g)
+		return nil
+	}
+	if present < k || f.shardSize == 0 {
+		return nil
+	}
+
+	// Shorter shards count as zero-padded
+	padded := make([][]byte, len(shards))
+	for i, s := range shards {
+		switch {
+		case s != nil:
+			padded[i] = make([]byte, f.shardSize)
+			copy(padded[i], s)
+		case i < k && i >= n:
+			padded[i] = make([]byte, f.shardSize)
+		}
+	}
+	if f.code.Reconstruct(padded) != nil {
+		return nil
+	}
+
+	var rebuilt []wire.DataPacket
+	first := g * uint32(k)
+	for i := 0; i < n; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		seq := first + uint32(i)
+		size := min(uint64(f.shardSize), f.fileSize-uint64(seq)*uint64(f.shardSize))
+		last := (uint64(seq)+1)*uint64(f.shardSize) >= f.fileSize
+		offset := uint64(seq) * uint64(f.shardSize)
+		rebuilt = append(rebuilt, wire.DataPacket{Seq: seq, Last: last, Offset: offset, Payload: padded[i][:size]})
+	}
+	delete(f.groups, g)
+	return rebuilt
+}
@@ -0,0 +1,102 @@
+package udpft
+
+import (
+	"bytes"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"socket-file-transfer/internal/fec"
+	"socket-file-transfer/internal/wire"
+)
+
+// The receiver rebuilds lost data packets from parity, including those of
+// the file's last, shorter group with its short last packet, and gives up
+// on groups that lost more than their parity covers.
+func TestFECReceiver(t *testing.T) {
+	const k, m, shard = 4, 2, 10
+	file := make([]byte, 9*shard+3) // Groups of 4, 4 and 2 packets
+	rand.New(rand.NewSource(6)).Read(file)
+	code, _ := fec.New(k, m)
+
+	packets := func(g int) (data [][]byte, parity []*wire.DataPacket) {
+		par := [][]byte{make([]byte, shard), make([]byte, shard)}
+		for i := 0; i < k; i++ {
+			start := (g*k + i) * shard
+			if start >= len(file) {
+				break
+			}
+			d := file[start:min(start+shard, len(file))]
+			data = append(data, d)
+			code.Accumulate(i, d, par)
+		}
+		for i, p := range par {
+			parity = append(parity, &wire.DataPacket{Seq: uint32(g), Parity: true, Index: byte(i), Payload: p})
+		}
+		return data, parity
+	}
+
+	tests := []struct {
+		name    string
+		group   int
+		lost    []int // Data packets of the group lost
+		rebuilt bool
+	}{
+		{"one lost", 0, []int{2}, true},
+		{"two lost", 1, []int{0, 3}, true},
+		{"three lost", 1, []int{0, 1, 3}, false},
+		{"last group", 2, []int{1}, true},
+		{"last group, both lost", 2, []int{0, 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFECReceiver(code, uint64(len(file)))
+			stored := map[uint32]bool{}
+			have := func(seq uint32) bool { return stored[seq] }
+			data, parity := packets(tt.group)
+
+			// The server stores what is rebuilt, as it does what arrives
+			var rebuilt []wire.DataPacket
+			keep := func(ps []wire.DataPacket) {
+				for _, p := range ps {
+					stored[p.Seq] = true
+				}
+				rebuilt = append(rebuilt, ps...)
+			}
+			for i, d := range data {
+				if slices.Contains(tt.lost, i) {
+					continue
+				}
+				seq := uint32(tt.group*k + i)
+				stored[seq] = true
+				keep(f.addData(seq, d, have))
+			}
+			for _, p := range parity {
+				keep(f.addParity(p, have))
+			}
+
+			if !tt.rebuilt {
+				if len(rebuilt) != 0 {
+					t.Errorf("rebuilt %d packets from too few shards", len(rebuilt))
+				}
+				return
+			}
+			if len(rebuilt) != len(tt.lost) {
+				t.Fatalf("rebuilt %d packets, lost %d", len(rebuilt), len(tt.lost))
+			}
+			for _, p := range rebuilt {
+				start := int(p.Seq) * shard
+				want := file[start:min(start+shard, len(file))]
+				if !bytes.Equal(p.Payload, want) || p.Offset != uint64(start) {
+					t.Errorf("packet %d rebuilt as %d bytes at %d, want %d at %d", p.Seq, len(p.Payload), p.Offset, len(want), start)
+				}
+				if p.Last != (start+shard >= len(file)) {
+					t.Errorf("packet %d rebuilt with Last %v", p.Seq, p.Last)
+				}
+			}
+			if len(f.groups) != 0 {
+				t.Errorf("%d groups kept after repair", len(f.groups))
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A file past 4 GiB arrives with every byte where it belongs. The file is
+// sparse, so only its few data regions travel and neither end needs the
+// disk space.
+func TestLargeSparseFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("hashes 4 GiB")
+	}
+	const size = 4<<30 + 1<<20
+	regions := []struct {
+		off  int64
+		data []byte
+	}{
+		{0, []byte("start of the file")},
+		{4<<30 - 7, []byte("across the 4 GiB mark")},
+		{size - 3, []byte("end")},
+	}
+	path := filepath.Join(t.TempDir(), "large.bin")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range regions {
+		if _, err := f.WriteAt(r.data, r.off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	s := &Server{}
+	addr := serve(t, s)
+	var c Client
+	res, err := c.SendFile(context.Background(), addr, path, quietOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.WireBytes > 1<<20 {
+		t.Errorf("sent %d bytes for a file of three short regions", res.WireBytes)
+	}
+
+	stored, err := os.Open(filepath.Join(s.UploadDir, "large.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stored.Close()
+	if info, _ := stored.Stat(); info.Size() != size {
+		t.Fatalf("stored %d bytes, want %d", info.Size(), size)
+	}
+	for _, r := range regions {
+		got := make([]byte, len(r.data))
+		if _, err := stored.ReadAt(got, r.off); err != nil || !bytes.Equal(got, r.data) {
+			t.Errorf("at %d: stored %q (%v), want %q", r.off, got, err, r.data)
+		}
+	}
+	hole := make([]byte, 64)
+	if _, err := stored.ReadAt(hole, 1<<30); err != nil || !bytes.Equal(hole, make([]byte, 64)) {
+		t.Errorf("hole stored as %x (%v)", hole, err)
+	}
+}
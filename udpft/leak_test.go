@@ -0,0 +1,125 @@
+package udpft
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+// openFiles returns the number of file descriptors the process has open,
+// or -1 where /proc/self/fd doesn't list them.
+func openFiles() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+// settle waits until the goroutines and open files of the process are
+// back to at most the baseline given, failing the test if they aren't
+// within a few seconds.
+func settle(t *testing.T, goroutines, files int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		g, f := runtime.NumGoroutine(), openFiles()
+		if g <= goroutines && (files < 0 || f <= files) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines and %d open files, want the baseline of %d and %d", g, f, goroutines, files)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Hundreds of transfers that succeed, are abandoned half way or are just
+// garbage leave no goroutine, file descriptor or partial file of the
+// server's behind once they end.
+func TestNoLeaks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("hundreds of transfers")
+	}
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	s := &Server{Options: quietOptions()}
+	s.Timeout = 50 * time.Millisecond
+	s.UploadDir = t.TempDir()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		s.Serve(ctx, conn)
+	}()
+	defer func() {
+		cancel()
+		<-served
+	}()
+
+	data := make([]byte, 32*DefaultPacketSize+5)
+	rand.Read(data)
+	// One upload first, so what the server sets up once is in the baseline
+	if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "first.bin", data), quietOptions()); err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	goroutines, files := runtime.NumGoroutine(), openFiles()
+
+	t.Run("completed", func(t *testing.T) {
+		for i := 0; i < 200; i++ {
+			if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, fmt.Sprint(i, ".bin"), data), quietOptions()); err != nil {
+				t.Fatalf("SendFile: %v", err)
+			}
+		}
+	})
+
+	t.Run("abandoned", func(t *testing.T) {
+		for i := 0; i < 30; i++ {
+			ctx, stop := context.WithCancel(context.Background())
+			opts := quietOptions()
+			opts.Progress = func(ev Event) {
+				if ev.Kind == EventProgress && ev.Bytes > 0 {
+					stop()
+				}
+			}
+			if _, err := (&Client{}).SendFile(ctx, addr, writeFile(t, fmt.Sprint("abandoned", i, ".bin"), data), opts); err == nil {
+				t.Error("abandoned upload succeeded")
+			}
+			stop()
+		}
+	})
+
+	t.Run("garbage", func(t *testing.T) {
+		inject(t, conn.LocalAddr(), 300, func(i int) []byte {
+			return []byte(strings.Repeat("garbage", i%50))
+		})
+	})
+
+	// The last upload goes through after what came before
+	if _, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "last.bin", data), quietOptions()); err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	settle(t, goroutines, files)
+	entries, err := os.ReadDir(s.UploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if name := e.Name(); strings.HasSuffix(name, ".part") || strings.HasPrefix(name, "abandoned") {
+			t.Errorf("%s left in the upload directory", name)
+		}
+	}
+}
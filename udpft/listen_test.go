@@ -0,0 +1,51 @@
+package udpft
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// A listen address whose port is taken moves up to the next free port.
+func TestListenPortRetry(t *testing.T) {
+	blocker, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+	port := blocker.LocalAddr().(*net.UDPAddr).Port
+	next := net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1))
+	if probe, err := net.ListenPacket("udp", next); err != nil {
+		t.Skipf("port above the blocker taken too: %v", err)
+	} else {
+		probe.Close()
+	}
+
+	s := &Server{Options: quietOptions(), Addr: blocker.LocalAddr().String(), PortRetry: 3}
+	s.UploadDir = t.TempDir()
+	listening := make(chan net.Addr, 1)
+	s.Listening = func(addr net.Addr) { listening <- addr }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case addr := <-listening:
+		if addr.String() != next {
+			t.Fatalf("listening on %s, want %s", addr, next)
+		}
+	case err := <-done:
+		t.Fatalf("ListenAndServe: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server neither listening nor failed")
+	}
+	if _, err := (&Client{}).SendFile(context.Background(), next, writeFile(t, "moved.txt", []byte("on the next port")), quietOptions()); err != nil {
+		t.Fatalf("SendFile to the port printed: %v", err)
+	}
+}
@@ -0,0 +1,480 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/wire"
+)
+
+// Multicast distribution sends one file to many receivers at once: the
+// sender announces it to a group, receivers register over unicast, and
+// the data goes to the group once. The sender then runs repair rounds,
+// in which receivers report the packets they miss, and sends those to the
+// group again until every receiver has the file.
+//
+// Packets start with MCAST_MAGIC, a kind and the 32-bit session ID the
+// sender picked:
+//
+//	ANNOUNCE  group    wire.FileHeader with checksum and packet size
+//	DATA      group    wire.DataPacket with its offset
+//	ROUND     group    round (32 bits)
+//	END       group    nothing
+//	REGISTER  unicast  nothing
+//	NACK      unicast  round, then missing packets as (first, count) pairs of 32 bits
+//	DONE      unicast  round, then an error frame if the receiver failed
+//
+// Receivers send their unicast packets to the address the group packets
+// come from.
+const (
+	MCAST_MAGIC = "\xC7SFM"
+
+	MCAST_ANNOUNCE = 1
+	MCAST_DATA     = 2
+	MCAST_ROUND    = 3
+	MCAST_END      = 4
+	MCAST_REGISTER = 5
+	MCAST_NACK     = 6
+	MCAST_DONE     = 7
+
+	MCAST_HEADER_LEN = len(MCAST_MAGIC) + 1 + 4
+
+	// Most missing ranges in one NACK; the rest wait for a later round
+	MAX_NACK_RANGES = 128
+
+	// How long the sender collects answers to a repair round
+	MCAST_ROUND_WAIT = 300 * time.Millisecond
+
+	// How often the sender announces the file while receivers may join
+	MCAST_ANNOUNCE_EVERY = 250 * time.Millisecond
+
+	// Receivers give up on a sender silent this long
+	MCAST_IDLE_TIMEOUT = 30 * time.Second
+
+	DefaultMulticastRate     = 10 << 20 // Bytes per second
+	DefaultMulticastRegister = 3 * time.Second
+)
+
+func mcastPacket(kind byte, session uint32, body []byte) []byte {
+	b := make([]byte, 0, MCAST_HEADER_LEN+len(body))
+	b = append(b, MCAST_MAGIC...)
+	b = append(b, kind)
+	b = binary.BigEndian.AppendUint32(b, session)
+	return append(b, body...)
+}
+
+// parseMcast splits a multicast distribution packet, reporting false for
+// anything else.
+func parseMcast(b []byte) (kind byte, session uint32, body []byte, ok bool) {
+	if len(b) < MCAST_HEADER_LEN || !bytes.HasPrefix(b, []byte(MCAST_MAGIC)) {
+		return 0, 0, nil, false
+	}
+	return b[len(MCAST_MAGIC)], binary.BigEndian.Uint32(b[len(MCAST_MAGIC)+1:]), b[MCAST_HEADER_LEN:], true
+}
+
+// MulticastOptions tunes a multicast distribution. The zero value uses
+// the defaults; of the embedded Options only PacketSize, Name, Logger and
+// Progress apply.
+type MulticastOptions struct {
+	Rate      int64         // Bytes per second sent to the group, DefaultMulticastRate if 0
+	Receivers int           // Start as soon as this many receivers registered
+	Register  time.Duration // How long to wait for receivers to register, DefaultMulticastRegister if 0
+	Deadline  time.Duration // Give up on receivers still missing packets after this, no limit if 0
+	Interface string        // Network interface to send on, the system's choice if empty
+	TTL       int           // Routers the packets may cross, 1 (this LAN) if 0
+	Options
+}
+
+// MulticastResult describes a multicast distribution.
+type MulticastResult struct {
+	Bytes       int64            // File size
+	Duration    time.Duration    // From the first data packet to the last receiver done
+	Checksum    []byte           // SHA-256 of the file
+	Complete    []string         // Addresses of the receivers that stored the file
+	Failed      map[string]error // Receivers that didn't, and why
+	Rounds      int              // Repair rounds run
+	Retransmits int              // Data packets sent again
+}
+
+// mcastReceiver is a registered receiver, as the sender sees it.
+type mcastReceiver struct {
+	addr  *net.UDPAddr
+	done  bool
+	err   error
+	heard time.Time // Last packet from it
+}
+
+// mcastControl is a unicast packet from a receiver.
+type mcastControl struct {
+	kind byte
+	addr *net.UDPAddr
+	body []byte
+}
+
+// Multicast sends the file at path to every receiver listening on group,
+// an IPv4 multicast address and port, at once. It waits for receivers to
+// register, sends the file at opts.Rate and repairs what receivers
+// missed until all of them stored it, failed, went silent or
+// opts.Deadline passed. Receivers that didn't store the file are listed
+// in the result and fail the distribution; the result is returned with
+// that error.
+func (c *Client) Multicast(ctx context.Context, group, path string, opts MulticastOptions) (*MulticastResult, error) {
+	rep := opts.reporter(group)
+	defer rep.Close()
+
+	res, err := c.multicast(ctx, group, path, &opts, rep)
+	if err != nil {
+		err = wire.ContextError(ctx, err)
+		rep.Fail(err)
+		return res, err
+	}
+	rep.Complete(res.Bytes)
+	return res, nil
+}
+
+func (c *Client) multicast(ctx context.Context, group, path string, opts *MulticastOptions, rep *wire.Reporter) (*MulticastResult, error) {
+	log := opts.logger()
+	groupAddr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+	if !groupAddr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast group", group)
+	}
+	name := opts.remoteName(path)
+	if err := wire.CheckName(name); err != nil {
+		return nil, err
+	}
+	packetSize := opts.packetSize()
+	if packetSize < MIN_PACKET_SIZE || packetSize > MAX_PACKET_SIZE {
+		return nil, fmt.Errorf("packet size %d is outside %d..%d", packetSize, MIN_PACKET_SIZE, MAX_PACKET_SIZE)
+	}
+
+	file, err := wire.OpenSource(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	size := file.Size
+	sum, err := hashcache.File(path)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing file: %w", err)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("error creating UDP socket: %w", err)
+	}
+	defer conn.Close()
+	pc := ipv4.NewPacketConn(conn)
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = 1
+	}
+	pc.SetMulticastTTL(ttl)
+	pc.SetMulticastLoopback(true)
+	if opts.Interface != "" {
+		ifi, err := net.InterfaceByName(opts.Interface)
+		if err != nil {
+			return nil, err
+		}
+		if err := pc.SetMulticastInterface(ifi); err != nil {
+			return nil, fmt.Errorf("error sending on %s: %w", opts.Interface, err)
+		}
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var id [4]byte
+	rand.Read(id[:])
+	session := binary.BigEndian.Uint32(id[:])
+	header := wire.FileHeader{
+		Flags:      wire.FLAG_SKIP_IDENTICAL | wire.FLAG_PACKET_SIZE,
+		Name:       name,
+		Size:       uint64(size),
+		Checksum:   sum,
+		PacketSize: uint16(packetSize),
+	}
+	headerBytes, err := header.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	announce := mcastPacket(MCAST_ANNOUNCE, session, headerBytes)
+
+	// Receivers answer on the socket we send from
+	control := make(chan mcastControl, 256)
+	go func() {
+		defer close(control)
+		buffer := make([]byte, MCAST_HEADER_LEN+4+MAX_NACK_RANGES*8+wire.MAX_ERROR_FRAME_LEN)
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			kind, id, body, ok := parseMcast(buffer[:n])
+			if !ok || id != session {
+				continue
+			}
+			control <- mcastControl{kind: kind, addr: addr, body: append([]byte(nil), body...)}
+		}
+	}()
+
+	receivers := make(map[string]*mcastReceiver)
+	round := uint32(0)
+	need := make(map[uint32]bool) // Packets receivers miss this round
+	answered := make(map[string]bool)
+	handle := func(m mcastControl) {
+		key := m.addr.String()
+		r := receivers[key]
+		if r == nil {
+			if m.kind != MCAST_REGISTER {
+				return
+			}
+			r = &mcastReceiver{addr: m.addr}
+			receivers[key] = r
+			log.Info("Receiver registered", "remote", key)
+		}
+		r.heard = time.Now()
+		switch m.kind {
+		case MCAST_NACK:
+			if len(m.body) < 4 || binary.BigEndian.Uint32(m.body) != round {
+				return
+			}
+			answered[key] = true
+			for b := m.body[4:]; len(b) >= 8; b = b[8:] {
+				first, count := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+				for seq := first; seq-first < count && seq < packetCount(size, packetSize); seq++ {
+					need[seq] = true
+				}
+			}
+		case MCAST_DONE:
+			if r.done || len(m.body) < 4 {
+				return
+			}
+			answered[key] = true
+			r.done = true
+			if len(m.body) > 4 {
+				var rerr wire.RemoteError
+				if rerr.UnmarshalBinary(m.body[4:]) == nil {
+					r.err = &rerr
+				} else {
+					r.err = wire.ErrProtocol
+				}
+				log.Warn("Receiver failed", "remote", key, "err", r.err)
+			} else {
+				log.Info("Receiver complete", "remote", key)
+			}
+		}
+	}
+	// drain handles the answers that arrived, returning false once the
+	// socket is gone
+	drain := func() bool {
+		for {
+			select {
+			case m, ok := <-control:
+				if !ok {
+					return false
+				}
+				handle(m)
+			default:
+				return true
+			}
+		}
+	}
+	// wait handles answers until d passes or done says to stop
+	wait := func(d time.Duration, done func() bool) error {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		for !done() {
+			select {
+			case m, ok := <-control:
+				if !ok {
+					return net.ErrClosed
+				}
+				handle(m)
+			case <-timer.C:
+				return nil
+			}
+		}
+		return nil
+	}
+	send := func(b []byte) error {
+		if _, err := conn.WriteToUDP(b, groupAddr); err != nil {
+			return fmt.Errorf("error sending to the group: %w", err)
+		}
+		return nil
+	}
+
+	// Let receivers register
+	log.Info("Waiting for receivers", "group", group, "name", name, "size", size)
+	registerFor := opts.Register
+	if registerFor <= 0 {
+		registerFor = DefaultMulticastRegister
+	}
+	registerUntil := time.Now().Add(registerFor)
+	for time.Now().Before(registerUntil) && (opts.Receivers == 0 || len(receivers) < opts.Receivers) {
+		if err := send(announce); err != nil {
+			return nil, err
+		}
+		enough := func() bool { return opts.Receivers > 0 && len(receivers) >= opts.Receivers }
+		if err := wait(min(MCAST_ANNOUNCE_EVERY, time.Until(registerUntil)), enough); err != nil {
+			return nil, err
+		}
+	}
+	if len(receivers) == 0 {
+		return nil, fmt.Errorf("%w: no receivers registered", wire.ErrTimeout)
+	}
+
+	// Send the file, then what receivers missed, at the configured rate
+	rate := opts.Rate
+	if rate <= 0 {
+		rate = DefaultMulticastRate
+	}
+	pace := newPacer(opts.paceBurst())
+	pace.setRate(float64(rate)/float64(packetSize), time.Now())
+	buffer := make([]byte, packetSize)
+	lastAnnounce := time.Now()
+	sendData := func(seq uint32) error {
+		now := time.Now()
+		if next := pace.next(now); next.After(now) {
+			time.Sleep(next.Sub(now))
+		}
+		pace.spend(time.Now())
+
+		offset := int64(seq) * int64(packetSize)
+		n, err := file.ReadAt(buffer[:min(int64(packetSize), size-offset)], offset)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading file: %w", err)
+		}
+		packet := wire.DataPacket{Seq: seq, Last: seq == packetCount(size, packetSize)-1, HasOffset: true, Offset: uint64(offset), Payload: buffer[:n]}
+		b, err := packet.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := send(mcastPacket(MCAST_DATA, session, b)); err != nil {
+			return err
+		}
+		// Late receivers learn of the file too
+		if time.Since(lastAnnounce) >= time.Second {
+			lastAnnounce = time.Now()
+			send(announce)
+		}
+		if !drain() {
+			return net.ErrClosed
+		}
+		return nil
+	}
+
+	res := &MulticastResult{Bytes: size, Checksum: sum, Failed: make(map[string]error)}
+	start := time.Now()
+	rep.Start(name, size)
+	total := packetCount(size, packetSize)
+	for seq := uint32(0); seq < total; seq++ {
+		if err := sendData(seq); err != nil {
+			return nil, err
+		}
+		rep.Progress(min(int64(seq+1)*int64(packetSize), size))
+	}
+
+	// Repair rounds, until every receiver is done or gone
+	silentFor := opts.timeout() * time.Duration(opts.maxRetries())
+	pending := func() []*mcastReceiver {
+		var left []*mcastReceiver
+		for _, r := range receivers {
+			if r.done {
+				continue
+			}
+			if time.Since(r.heard) > silentFor {
+				r.done, r.err = true, fmt.Errorf("%w: receiver went silent", wire.ErrTimeout)
+				log.Warn("Receiver failed", "remote", r.addr, "err", r.err)
+				continue
+			}
+			left = append(left, r)
+		}
+		return left
+	}
+	for {
+		left := pending()
+		if len(left) == 0 {
+			break
+		}
+		if opts.Deadline > 0 && time.Since(start) > opts.Deadline {
+			for _, r := range left {
+				r.done, r.err = true, fmt.Errorf("%w: deadline passed", wire.ErrTimeout)
+			}
+			break
+		}
+
+		round++
+		res.Rounds++
+		clear(need)
+		clear(answered)
+		if err := send(mcastPacket(MCAST_ROUND, session, binary.BigEndian.AppendUint32(nil, round))); err != nil {
+			return nil, err
+		}
+		allAnswered := func() bool {
+			for _, r := range left {
+				if !answered[r.addr.String()] {
+					return false
+				}
+			}
+			return true
+		}
+		if err := wait(MCAST_ROUND_WAIT, allAnswered); err != nil {
+			return nil, err
+		}
+
+		missing := make([]uint32, 0, len(need))
+		for seq := range need {
+			missing = append(missing, seq)
+		}
+		sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+		if len(missing) > 0 {
+			log.Info("Repair round", "round", round, "packets", len(missing))
+		}
+		for _, seq := range missing {
+			if err := sendData(seq); err != nil {
+				return nil, err
+			}
+			res.Retransmits++
+		}
+	}
+	res.Duration = time.Since(start)
+
+	// Tell receivers we are done, in case one END is lost
+	end := mcastPacket(MCAST_END, session, nil)
+	for i := 0; i < 3; i++ {
+		send(end)
+	}
+
+	var errs []error
+	for key, r := range receivers {
+		if r.err != nil {
+			res.Failed[key] = r.err
+			errs = append(errs, fmt.Errorf("%s: %w", key, r.err))
+		} else {
+			res.Complete = append(res.Complete, key)
+		}
+	}
+	sort.Strings(res.Complete)
+	if len(errs) > 0 {
+		return res, fmt.Errorf("%d of %d receivers didn't store the file: %w", len(errs), len(receivers), errors.Join(errs...))
+	}
+	return res, nil
+}
+
+// packetCount returns how many packets of packetSize carry size bytes.
+func packetCount(size int64, packetSize int) uint32 {
+	return uint32((size + int64(packetSize) - 1) / int64(packetSize))
+}
@@ -0,0 +1,344 @@
+package udpft
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"socket-file-transfer/internal/prealloc"
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/wire"
+)
+
+// mcastSession is a file being received from a multicast sender.
+type mcastSession struct {
+	id      uint32
+	sender  *net.UDPAddr // Where to send REGISTER, NACK and DONE
+	size    int64
+	packet  int // Packet size
+	sum     []byte
+	in      *store.Incoming
+	out     io.WriterAt
+	src     io.ReaderAt // The file as written, to hash packets written out of order
+	have    []bool
+	missing int
+	hashed  uint32 // Packets hashed, in order
+	done    bool
+	err     error // Why the file wasn't stored, once done
+	heard   time.Time
+	rep     *wire.Reporter
+	log     *slog.Logger
+}
+
+// ListenAndServeMulticast joins s.MulticastGroup and receives the files
+// multicast to it until ctx ends.
+func (s *Server) ListenAndServeMulticast(ctx context.Context) error {
+	group, err := net.ResolveUDPAddr("udp4", s.MulticastGroup)
+	if err != nil {
+		return fmt.Errorf("invalid multicast group: %w", err)
+	}
+	if !group.IP.IsMulticast() {
+		return fmt.Errorf("%s is not a multicast group", s.MulticastGroup)
+	}
+	var ifi *net.Interface
+	if s.MulticastInterface != "" {
+		if ifi, err = net.InterfaceByName(s.MulticastInterface); err != nil {
+			return err
+		}
+	}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		return fmt.Errorf("error joining multicast group: %w", err)
+	}
+	return s.ServeMulticast(ctx, conn)
+}
+
+// ServeMulticast receives the files multicast to the group conn listens
+// on until ctx ends, one at a time, storing them like Serve. Packets are
+// written at their offsets as they arrive; those missing are requested in
+// the sender's repair rounds. The storage must take writes in any order.
+// The connection is closed on return.
+func (s *Server) ServeMulticast(ctx context.Context, conn net.PacketConn) error {
+	defer conn.Close()
+
+	st, err := store.Open(s.storeConfig(), s.logger())
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	// Answers go out from a socket of their own, so several receivers on
+	// one host are told apart
+	ctl, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return fmt.Errorf("error creating UDP socket: %w", err)
+	}
+	defer ctl.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	log := s.logger()
+	log.Info("Receiving multicast", "group", conn.LocalAddr())
+
+	var cur *mcastSession
+	// Sessions not to join again, by when they were last heard of; those
+	// silent for MCAST_IDLE_TIMEOUT are forgotten, so the map doesn't grow
+	// for as long as the server runs
+	ended := make(map[uint32]time.Time)
+	swept := time.Now()
+	defer func() {
+		if cur != nil && !cur.done {
+			cur.fail(wire.ContextError(ctx, net.ErrClosed))
+		}
+	}()
+
+	buffer := make([]byte, MCAST_HEADER_LEN+wire.DATA_HEADER_LEN+wire.DATA_OFFSET_LEN+MAX_PACKET_SIZE+HEADER_ROOM)
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := conn.ReadFrom(buffer)
+		if cur != nil && time.Since(cur.heard) > MCAST_IDLE_TIMEOUT {
+			if !cur.done {
+				cur.fail(fmt.Errorf("%w: sender went silent", wire.ErrTimeout))
+			}
+			ended[cur.id] = cur.heard
+			cur = nil
+		}
+		if time.Since(swept) > MCAST_IDLE_TIMEOUT {
+			for id, heard := range ended {
+				if time.Since(heard) > MCAST_IDLE_TIMEOUT {
+					delete(ended, id)
+				}
+			}
+			swept = time.Now()
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		kind, id, body, ok := parseMcast(buffer[:n])
+		if !ok {
+			continue
+		}
+		if _, ok := ended[id]; ok {
+			ended[id] = time.Now()
+			continue
+		}
+		from, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		if cur == nil || cur.id != id {
+			// One file at a time; other senders wait for their next
+			// announcement
+			if kind != MCAST_ANNOUNCE || cur != nil {
+				continue
+			}
+			cur = s.joinMulticast(st, id, from, body, log)
+			if cur.done {
+				// Refused, or an empty file already stored; either way the
+				// sender learns the outcome
+				ctl.WriteTo(mcastPacket(MCAST_REGISTER, cur.id, nil), cur.sender)
+				ctl.WriteTo(cur.reply(0), cur.sender)
+				continue
+			}
+		}
+		cur.heard = time.Now()
+
+		switch kind {
+		case MCAST_ANNOUNCE:
+			if !cur.done {
+				ctl.WriteTo(mcastPacket(MCAST_REGISTER, cur.id, nil), cur.sender)
+			}
+		case MCAST_DATA:
+			if cur.done {
+				continue
+			}
+			var packet wire.DataPacket
+			if err := packet.UnmarshalBinary(body); err != nil {
+				cur.log.Warn("Invalid data packet", "err", err)
+				continue
+			}
+			if err := cur.write(&packet); err != nil {
+				cur.fail(err)
+			} else if cur.missing == 0 {
+				cur.commit()
+			}
+			if cur.done {
+				ctl.WriteTo(cur.reply(0), cur.sender)
+			}
+		case MCAST_ROUND:
+			if len(body) < 4 {
+				continue
+			}
+			ctl.WriteTo(cur.reply(binary.BigEndian.Uint32(body)), cur.sender)
+		case MCAST_END:
+			if !cur.done {
+				cur.fail(fmt.Errorf("%w: sender ended with %d packets missing", wire.ErrProtocol, cur.missing))
+			}
+			ended[cur.id] = time.Now()
+			cur = nil
+		}
+	}
+}
+
+// joinMulticast starts receiving the file announced in body, returning a
+// session that is already done if it is refused.
+func (s *Server) joinMulticast(st *store.Store, id uint32, sender *net.UDPAddr, body []byte, log *slog.Logger) *mcastSession {
+	log = log.With("remote", sender.String())
+	m := &mcastSession{id: id, sender: sender, heard: time.Now(), rep: s.reporter(sender.String()), log: log}
+	log.Info("New multicast transfer")
+
+	var header wire.FileHeader
+	err := header.UnmarshalBinary(body)
+	if err == nil && (header.Checksum == nil || header.PacketSize == 0 || int(header.PacketSize) > MAX_PACKET_SIZE || header.Size > 1<<62) {
+		err = fmt.Errorf("%w: incomplete announcement", wire.ErrProtocol)
+	}
+	if err == nil {
+		err = wire.CheckName(header.Name)
+	}
+	if err != nil {
+		m.fail(err)
+		return m
+	}
+	m.size, m.packet, m.sum = int64(header.Size), int(header.PacketSize), header.Checksum
+	log.Info("Receiving file", "name", header.Name, "size", m.size)
+	m.rep.Start(header.Name, m.size)
+
+	in, err := st.Place(sender, header.Name, m.size, header.Checksum, log)
+	if err == nil {
+		err = in.Create()
+	}
+	if err != nil {
+		m.fail(err)
+		return m
+	}
+	m.in = in
+	out, anyOrder := in.WriterAt()
+	src, readable := out.(io.ReaderAt)
+	if !anyOrder || !readable {
+		m.fail(fmt.Errorf("%w: multicast needs storage that takes writes in any order", wire.ErrRejected))
+		return m
+	}
+	m.out, m.src = out, src
+	m.have = make([]bool, packetCount(m.size, m.packet))
+	m.missing = len(m.have)
+	if m.missing == 0 {
+		m.commit()
+	}
+	return m
+}
+
+// write stores a data packet at its offset and hashes what is now in
+// order.
+func (m *mcastSession) write(p *wire.DataPacket) error {
+	if !p.HasOffset || p.Parity || int(p.Seq) >= len(m.have) ||
+		p.Offset != uint64(p.Seq)*uint64(m.packet) || uint64(len(p.Payload)) != uint64(m.packetLen(p.Seq)) {
+		m.log.Warn("Invalid data packet", "seq", p.Seq, "offset", p.Offset)
+		return nil
+	}
+	if m.have[p.Seq] {
+		return nil
+	}
+	if _, err := m.out.WriteAt(p.Payload, int64(p.Offset)); err != nil {
+		return prealloc.NoSpace(fmt.Errorf("error writing to file: %w", err))
+	}
+	m.have[p.Seq] = true
+	m.missing--
+
+	var buffer []byte
+	for int(m.hashed) < len(m.have) && m.have[m.hashed] {
+		data := p.Payload
+		if m.hashed != p.Seq {
+			if buffer == nil {
+				buffer = make([]byte, m.packet)
+			}
+			data = buffer[:m.packetLen(m.hashed)]
+			if _, err := m.src.ReadAt(data, int64(m.hashed)*int64(m.packet)); err != nil {
+				return fmt.Errorf("error reading back file: %w", err)
+			}
+		}
+		if err := m.in.Add(data); err != nil {
+			return err
+		}
+		m.hashed++
+	}
+	m.rep.Progress(m.size - int64(m.missing)*int64(m.packet))
+	return nil
+}
+
+// packetLen returns the payload length of packet seq.
+func (m *mcastSession) packetLen(seq uint32) int {
+	return int(min(int64(m.packet), m.size-int64(seq)*int64(m.packet)))
+}
+
+// commit stores the complete file once it matches the sender's checksum.
+func (m *mcastSession) commit() {
+	if sum := m.in.Sum(); string(sum) != string(m.sum) {
+		m.fail(fmt.Errorf("%w: %x, the sender's is %x", wire.ErrChecksumMismatch, sum, m.sum))
+		return
+	}
+	if err := m.in.Sync(); err != nil {
+		m.fail(err)
+		return
+	}
+	upload, err := m.in.Commit()
+	if err != nil {
+		m.fail(err)
+		return
+	}
+	m.done = true
+	m.in.Close()
+	m.log.Info("File saved", "path", upload.Path, "bytes", m.size, "duration", time.Since(m.in.Started()))
+	m.rep.Complete(m.size)
+	m.rep.Close()
+}
+
+// fail ends the session, discarding what was received.
+func (m *mcastSession) fail(err error) {
+	m.done, m.err = true, err
+	if m.in != nil {
+		m.in.Close()
+	}
+	m.log.Error("Transfer failed", "err", err)
+	m.rep.Fail(err)
+	m.rep.Close()
+}
+
+// reply answers repair round round: DONE once the session is, otherwise
+// a NACK of the first missing packets.
+func (m *mcastSession) reply(round uint32) []byte {
+	body := binary.BigEndian.AppendUint32(nil, round)
+	if m.done {
+		if m.err != nil {
+			frame, _ := wire.NewRemoteError(m.err).MarshalBinary()
+			body = append(body, frame...)
+		}
+		return mcastPacket(MCAST_DONE, m.id, body)
+	}
+	ranges := 0
+	for seq := 0; seq < len(m.have) && ranges < MAX_NACK_RANGES; {
+		if m.have[seq] {
+			seq++
+			continue
+		}
+		first := seq
+		for seq < len(m.have) && !m.have[seq] {
+			seq++
+		}
+		body = binary.BigEndian.AppendUint32(body, uint32(first))
+		body = binary.BigEndian.AppendUint32(body, uint32(seq-first))
+		ranges++
+	}
+	return mcastPacket(MCAST_NACK, m.id, body)
+}
@@ -0,0 +1,176 @@
+package udpft
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// Group the tests multicast to, on a port of its own per test
+const testGroup = "239.255.77.1"
+
+// dropReads drops every nth data packet read from the group, as a busy
+// receiver would, so the repair rounds have work to do.
+type dropReads struct {
+	net.PacketConn
+	nth, count int
+}
+
+func (d *dropReads) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := d.PacketConn.ReadFrom(p)
+		if err != nil || d.nth == 0 {
+			return n, addr, err
+		}
+		if kind, _, _, ok := parseMcast(p[:n]); ok && kind == MCAST_DATA {
+			d.count++
+			if d.count%d.nth == 0 {
+				continue
+			}
+		}
+		return n, addr, err
+	}
+}
+
+// joinGroup joins the test group on a free port, skipping the test where
+// the host can't loop multicast back.
+func joinGroup(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	group := &net.UDPAddr{IP: net.ParseIP(testGroup), Port: port}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		t.Skipf("no multicast here: %v", err)
+	}
+	defer conn.Close()
+	send, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		t.Skipf("no multicast here: %v", err)
+	}
+	defer send.Close()
+	if _, err := send.Write([]byte("ping")); err != nil {
+		t.Skipf("no multicast here: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadFrom(make([]byte, 16)); err != nil {
+		t.Skipf("multicast doesn't loop back here: %v", err)
+	}
+	return group
+}
+
+// receive runs a multicast receiver on group until the test ends, dropping
+// every dropEvery-th data packet if not 0, and returns its upload
+// directory.
+func receive(t *testing.T, group *net.UDPAddr, dropEvery int) string {
+	t.Helper()
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Options: quietOptions()}
+	s.UploadDir = t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeMulticast(ctx, &dropReads{PacketConn: conn, nth: dropEvery})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s.UploadDir
+}
+
+// Three receivers store the same file, one of them after repairing the
+// packets it missed.
+func TestMulticast(t *testing.T) {
+	group := joinGroup(t)
+	dirs := []string{receive(t, group, 0), receive(t, group, 0), receive(t, group, 7)}
+
+	data := make([]byte, 300<<10+11)
+	rand.Read(data)
+	path := writeFile(t, "image.bin", data)
+
+	res, err := (&Client{}).Multicast(context.Background(), group.String(), path, MulticastOptions{
+		Rate:      50 << 20,
+		Receivers: len(dirs),
+		Register:  5 * time.Second,
+		Deadline:  20 * time.Second,
+		Options:   quietOptions(),
+	})
+	if err != nil {
+		t.Fatalf("Multicast: %v", err)
+	}
+	if len(res.Complete) != len(dirs) || len(res.Failed) != 0 {
+		t.Errorf("complete %v, failed %v, want %d receivers complete", res.Complete, res.Failed, len(dirs))
+	}
+	if res.Rounds == 0 || res.Retransmits == 0 {
+		t.Errorf("%d repair rounds and %d retransmits for a lossy receiver", res.Rounds, res.Retransmits)
+	}
+	for i, dir := range dirs {
+		t.Run(fmt.Sprint("receiver ", i), func(t *testing.T) {
+			checkStored(t, dir, "image.bin", data)
+		})
+	}
+}
+
+// With no receiver registered the sender gives up once registration ends.
+func TestMulticastNoReceivers(t *testing.T) {
+	group := joinGroup(t)
+	path := writeFile(t, "f", []byte("data"))
+	_, err := (&Client{}).Multicast(context.Background(), group.String(), path, MulticastOptions{
+		Register: 200 * time.Millisecond,
+		Options:  quietOptions(),
+	})
+	if err == nil {
+		t.Error("distribution to nobody succeeded")
+	}
+}
+
+func TestMulticastNotAGroup(t *testing.T) {
+	path := writeFile(t, "f", []byte("data"))
+	if _, err := (&Client{}).Multicast(context.Background(), "127.0.0.1:9", path, MulticastOptions{Options: quietOptions()}); err == nil {
+		t.Error("unicast address accepted as a group")
+	}
+}
+
+func TestParseMcast(t *testing.T) {
+	b := mcastPacket(MCAST_NACK, 0xdeadbeef, []byte{1, 2})
+	kind, session, body, ok := parseMcast(b)
+	if !ok || kind != MCAST_NACK || session != 0xdeadbeef || string(body) != "\x01\x02" {
+		t.Errorf("got %d %x %x %v", kind, session, body, ok)
+	}
+	for _, b := range [][]byte{nil, []byte(MCAST_MAGIC), []byte("XXXX\x01\x00\x00\x00\x01")} {
+		if _, _, _, ok := parseMcast(b); ok {
+			t.Errorf("%q parsed", b)
+		}
+	}
+}
+
+func TestPacketCount(t *testing.T) {
+	tests := []struct {
+		size       int64
+		packetSize int
+		want       uint32
+	}{
+		{0, 1000, 0},
+		{1, 1000, 1},
+		{1000, 1000, 1},
+		{1001, 1000, 2},
+	}
+	for _, tt := range tests {
+		if got := packetCount(tt.size, tt.packetSize); got != tt.want {
+			t.Errorf("packetCount(%d, %d) = %d, want %d", tt.size, tt.packetSize, got, tt.want)
+		}
+	}
+}
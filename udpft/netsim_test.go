@@ -0,0 +1,129 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/netsim"
+)
+
+// impaired runs s behind a link that impairs the packets of both
+// directions per cfg, returning its address and a Client whose packets
+// suffer the same. The two ends draw from different seeds.
+func impaired(t *testing.T, s *Server, cfg netsim.Config) (string, *Client, *netsim.PacketConn) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := netsim.WrapPacketConn(conn, cfg)
+	serveOn(t, s, server)
+
+	client := &Client{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c := cfg
+		c.Seed++
+		return netsim.WrapConn(conn, c), nil
+	}}
+	return conn.LocalAddr().String(), client, server
+}
+
+func TestImpairedTransfer(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	sum := sha256.Sum256(data)
+
+	tests := []struct {
+		name string
+		cfg  netsim.Config
+		fec  bool
+	}{
+		{"loss", netsim.Config{Loss: 0.1}, false},
+		{"drop every 7th", netsim.Config{DropEvery: 7}, false},
+		{"duplicates", netsim.Config{Duplicate: 0.3}, false},
+		{"reordering", netsim.Config{Reorder: 0.3, Delay: 5 * time.Millisecond}, false},
+		{"all at once", netsim.Config{Loss: 0.05, Duplicate: 0.1, Reorder: 0.1, Delay: 5 * time.Millisecond, Latency: time.Millisecond}, false},
+		{"loss with FEC", netsim.Config{Loss: 0.05}, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Seed = int64(i + 1)
+			s := &Server{}
+			addr, c, server := impaired(t, s, tt.cfg)
+
+			opts := quietOptions()
+			opts.Timeout = 100 * time.Millisecond
+			opts.MaxRetries = 20
+			if tt.fec {
+				opts.FECData, opts.FECParity = 8, 2
+			}
+			res, err := c.SendFile(context.Background(), addr, writeFile(t, "impaired.bin", data), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(res.Checksum, sum[:]) {
+				t.Errorf("client reports checksum %x, want %x", res.Checksum, sum)
+			}
+			checkStored(t, s.UploadDir, "impaired.bin", data)
+
+			// Make sure the link did what was asked of it
+			stats := server.Stats()
+			switch {
+			case tt.cfg.Loss > 0 || tt.cfg.DropEvery > 0:
+				if res.Retransmits == 0 && res.Repaired == 0 {
+					t.Error("no packet resent or repaired despite loss")
+				}
+			case tt.cfg.Duplicate > 0 && stats.Duplicated == 0:
+				t.Error("no ACK duplicated")
+			case tt.cfg.Reorder > 0 && stats.Reordered == 0:
+				t.Error("no ACK reordered")
+			}
+			if tt.fec && res.Repaired == 0 {
+				t.Error("no packet rebuilt from FEC parity")
+			}
+		})
+	}
+}
+
+// Too much loss fails the transfer partway with ErrTimeout, leaving
+// neither the file nor a partial one behind. The client's abort may be
+// lost too, so the server gives up on its own after Timeout*MaxRetries.
+func TestImpairedTransferFails(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	started := make(chan struct{}, 1)
+	s := &Server{}
+	s.Timeout = 100 * time.Millisecond
+	s.Progress = func(e Event) {
+		if e.Kind == EventStarted {
+			started <- struct{}{}
+		}
+	}
+	addr, c, _ := impaired(t, s, netsim.Config{Loss: 0.4, Seed: 1})
+	opts := quietOptions()
+	opts.Timeout = 50 * time.Millisecond
+	opts.MaxRetries = 8
+	_, err := c.SendFile(context.Background(), addr, writeFile(t, "lost.bin", data), opts)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+	select {
+	case <-started:
+	default:
+		t.Fatal("transfer failed before it started")
+	}
+	if !waitEmpty(t, s.UploadDir) {
+		t.Error("failed transfer left a file behind")
+	}
+}
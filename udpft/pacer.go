@@ -0,0 +1,84 @@
+package udpft
+
+import "time"
+
+// pacer spreads packet sends over time with a token bucket: tokens accrue at
+// rate packets per second up to burst, and each send spends one. Until a
+// rate is set only the initial burst may go out. Callers pass the current
+// time in, so the sender can wait for the next token on the same deadline
+// it uses for ACKs.
+type pacer struct {
+	rate   float64 // Packets per second, 0 until the first RTT sample
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newPacer(burst int) *pacer {
+	return &pacer{burst: float64(burst), tokens: float64(burst)}
+}
+
+// setRate changes how fast tokens accrue from now on.
+func (p *pacer) setRate(rate float64, now time.Time) {
+	p.refill(now)
+	p.rate = rate
+}
+
+func (p *pacer) refill(now time.Time) {
+	if !p.last.IsZero() && now.After(p.last) {
+		p.tokens = min(p.burst, p.tokens+p.rate*now.Sub(p.last).Seconds())
+	}
+	p.last = now
+}
+
+// next returns when the next packet may be sent, which is now if a token is
+// available and the zero time if none will accrue.
+func (p *pacer) next(now time.Time) time.Time {
+	p.refill(now)
+	if p.tokens >= 1 {
+		return now
+	}
+	if p.rate <= 0 {
+		return time.Time{}
+	}
+	wait := (1 - p.tokens) / p.rate
+	return now.Add(time.Duration(wait * float64(time.Second)))
+}
+
+// spend takes the token for a packet sent at now.
+func (p *pacer) spend(now time.Time) {
+	p.refill(now)
+	p.tokens--
+}
+
+// rttEstimator smooths round-trip time samples the way TCP does, keeping
+// their range and sum for the transfer's Stats.
+type rttEstimator struct {
+	srtt     time.Duration
+	min, max time.Duration
+	sum      time.Duration
+	samples  int
+}
+
+func (e *rttEstimator) sample(d time.Duration) {
+	if e.samples == 0 || d < e.min {
+		e.min = d
+	}
+	e.max = max(e.max, d)
+	e.sum += d
+	e.samples++
+	if e.srtt == 0 {
+		e.srtt = d
+		return
+	}
+	e.srtt = (7*e.srtt + d) / 8
+}
+
+// record sets the round-trip times of stats.
+func (e *rttEstimator) record(stats *Stats) {
+	if e.samples == 0 {
+		return
+	}
+	stats.RTTMin, stats.RTTMax = e.min, e.max
+	stats.RTTAvg = e.sum / time.Duration(e.samples)
+}
@@ -0,0 +1,81 @@
+package udpft
+
+import (
+	"testing"
+	"time"
+)
+
+// The pacer lets the burst go out at once, then spaces packets 1/rate
+// apart, following rate changes. Time is simulated, not waited for.
+func TestPacerGaps(t *testing.T) {
+	now := time.Unix(1000, 0)
+	p := newPacer(4)
+
+	// Before a rate is known only the burst goes out
+	for i := 0; i < 4; i++ {
+		if next := p.next(now); !next.Equal(now) {
+			t.Fatalf("packet %d of the burst held until %v", i, next.Sub(now))
+		}
+		p.spend(now)
+	}
+	if next := p.next(now); !next.IsZero() {
+		t.Fatalf("without a rate the next packet may go after %v, want never", next.Sub(now))
+	}
+
+	// Sending whenever allowed, packets go out at the rate
+	for _, rate := range []float64{1000, 250, 10000} {
+		p.setRate(rate, now)
+		want := time.Duration(float64(time.Second) / rate)
+		var sent []time.Time
+		for len(sent) < 50 {
+			next := p.next(now)
+			if next.After(now) {
+				now = next
+				continue
+			}
+			p.spend(now)
+			sent = append(sent, now)
+		}
+		for i := 1; i < len(sent); i++ {
+			gap := sent[i].Sub(sent[i-1])
+			if gap < want-want/20 || gap > want+want/20 {
+				t.Fatalf("rate %v: gap %d is %v, want about %v", rate, i, gap, want)
+			}
+		}
+	}
+}
+
+// Tokens saved up while idle never exceed the burst.
+func TestPacerBurstCap(t *testing.T) {
+	now := time.Unix(1000, 0)
+	p := newPacer(3)
+	p.setRate(100, now)
+	now = now.Add(time.Minute)
+
+	n := 0
+	for p.next(now).Equal(now) {
+		p.spend(now)
+		n++
+		if n > 10 {
+			break
+		}
+	}
+	if n != 3 {
+		t.Errorf("%d packets back-to-back after idling, want the burst of 3", n)
+	}
+}
+
+func TestRTTEstimator(t *testing.T) {
+	var e rttEstimator
+	for _, d := range []time.Duration{80, 100, 120, 100} {
+		e.sample(d * time.Millisecond)
+	}
+	var stats Stats
+	e.record(&stats)
+	if stats.RTTMin != 80*time.Millisecond || stats.RTTMax != 120*time.Millisecond || stats.RTTAvg != 100*time.Millisecond {
+		t.Errorf("min %v max %v avg %v, want 80ms 120ms 100ms", stats.RTTMin, stats.RTTMax, stats.RTTAvg)
+	}
+	if e.srtt < 80*time.Millisecond || e.srtt > 120*time.Millisecond {
+		t.Errorf("smoothed RTT %v outside the samples", e.srtt)
+	}
+}
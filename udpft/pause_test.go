@@ -0,0 +1,88 @@
+package udpft
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// pauseOnce returns options that pause the transfer once it is under way,
+// resuming it after d.
+func pauseOnce(d time.Duration) Options {
+	opts := quietOptions()
+	opts.Pause = new(Pause)
+	var once sync.Once
+	opts.Progress = func(ev Event) {
+		if ev.Kind == EventProgress && ev.Bytes > 0 {
+			once.Do(func() {
+				opts.Pause.Pause()
+				time.AfterFunc(d, opts.Pause.Resume)
+			})
+		}
+	}
+	return opts
+}
+
+// A pause far longer than the server's timeouts allow leaves the transfer
+// intact, counting no timeouts, while one longer than its MaxPause fails
+// it.
+func TestPause(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxPause time.Duration
+		fails    bool
+	}{
+		{"within MaxPause", time.Minute, false},
+		{"past MaxPause", 100 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var kinds []wire.EventKind
+			completed := make(chan *Stats, 1)
+			s := &Server{MaxPause: tt.maxPause}
+			s.Logger = quiet
+			s.Timeout = 50 * time.Millisecond
+			s.Progress = func(ev Event) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch ev.Kind {
+				case wire.EventPaused, wire.EventResumed:
+					kinds = append(kinds, ev.Kind)
+				case EventCompleted:
+					completed <- ev.Stats
+				}
+			}
+			addr := serve(t, s)
+
+			data := make([]byte, 2<<20)
+			rand.Read(data)
+			_, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "f.bin", data), pauseOnce(600*time.Millisecond))
+			if tt.fails {
+				if err == nil {
+					t.Fatal("transfer paused past MaxPause succeeded")
+				}
+				if !waitEmpty(t, s.UploadDir) {
+					t.Error("transfer paused for too long left files behind")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SendFile: %v", err)
+			}
+			checkStored(t, s.UploadDir, "f.bin", data)
+			if stats := <-completed; stats.Timeouts != 0 {
+				t.Errorf("%d timeouts counted while paused", stats.Timeouts)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(kinds) != 2 || kinds[0] != wire.EventPaused || kinds[1] != wire.EventResumed {
+				t.Errorf("server reported %v, want paused then resumed", kinds)
+			}
+		})
+	}
+}
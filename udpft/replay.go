@@ -0,0 +1,141 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"socket-file-transfer/internal/trace"
+	"socket-file-transfer/internal/wire"
+)
+
+// How long a replay waits for the server's last packets once the trace is
+// played out
+const REPLAY_GRACE = time.Second
+
+// Divergence is the first packet a replayed server sent differently from
+// the traced one.
+type Divergence struct {
+	Index    int           // Of the packet among those the server sent
+	At       time.Duration // Into the trace
+	Recorded string        // What the traced server sent, "" if nothing
+	Replayed string        // What the replayed server sent, "" if nothing
+}
+
+// ReplayResult compares a replay with the trace it replayed.
+type ReplayResult struct {
+	Received   int         // Datagrams fed to the server
+	Recorded   int         // Packets the traced server sent
+	Replayed   int         // Packets the replayed server sent
+	Divergence *Divergence // nil if the server sent the same packets
+}
+
+// Replay feeds the datagrams a server received in t to s, without a
+// network, and compares the packets it sends with those the traced server
+// sent, to find where a transfer's receive side went differently. The
+// server should store into a scratch directory. The replay ends once the
+// trace is played out, see trace.Player, and the server had REPLAY_GRACE
+// to answer, or when ctx ends.
+func Replay(ctx context.Context, s *Server, t *trace.Trace, fast bool) (*ReplayResult, error) {
+	if t.Side != trace.SERVER {
+		return nil, fmt.Errorf("a %s's trace can't be replayed, only a server's", t.Side)
+	}
+	if len(t.Records) == 0 {
+		return nil, fmt.Errorf("the trace is empty")
+	}
+	player := trace.NewPlayer(t, fast)
+	s.BatchIO = false
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ctx, player) }()
+
+	select {
+	case <-player.Idle():
+		end := time.Now()
+		if e := player.End(); e.After(end) {
+			end = e
+		}
+		timer := time.NewTimer(time.Until(end.Add(REPLAY_GRACE)))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	case err := <-served:
+		if ctx.Err() == nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+	}
+	cancel()
+	<-served
+
+	var recorded []trace.Record
+	for _, rec := range t.Records {
+		if rec.Dir == trace.SENT {
+			recorded = append(recorded, rec)
+		}
+	}
+	replayed := player.Sent()
+	res := &ReplayResult{Received: player.Received(), Recorded: len(recorded), Replayed: len(replayed)}
+	origin := t.Records[0].Time
+	for i := 0; i < max(len(recorded), len(replayed)); i++ {
+		d := Divergence{Index: i}
+		if i < len(recorded) {
+			d.Recorded = Describe(recorded[i].Data)
+			d.At = recorded[i].Time.Sub(origin)
+		}
+		if i < len(replayed) {
+			d.Replayed = Describe(replayed[i].Data)
+			if i >= len(recorded) {
+				d.At = replayed[i].Time.Sub(origin)
+			}
+		}
+		if d.Recorded != d.Replayed {
+			res.Divergence = &d
+			break
+		}
+	}
+	return res, nil
+}
+
+// Describe returns what a packet a server sent says, leaving out the
+// session ID, which the server draws at random.
+func Describe(b []byte) string {
+	switch {
+	case wire.HasMagic(b):
+		var ha wire.HeaderAck
+		if err := ha.UnmarshalBinary(b); err != nil {
+			return fmt.Sprintf("invalid header ACK: %v", err)
+		}
+		return fmt.Sprintf("header ACK: version %d, status %d, packet size %d, features %#x, offset %d", ha.Version, ha.Status, ha.PacketSize, ha.Features, ha.Offset)
+	case bytes.HasPrefix(b, []byte(HEADER_ACK)), bytes.HasPrefix(b, []byte(HEADER_SKIP)):
+		return fmt.Sprintf("legacy header ACK: %q", b)
+	case bytes.HasPrefix(b, []byte(PROBE)) && len(b) == len(PROBE)+2:
+		return fmt.Sprintf("probe reply: %d bytes", binary.BigEndian.Uint16(b[len(PROBE):]))
+	case bytes.Equal(b, []byte(PAUSE)), bytes.Equal(b, []byte(RESUME)):
+		return string(b)
+	}
+	if status, ok := busyStatus(b); ok {
+		return "busy: " + status
+	}
+	if err := remoteError(b); err != nil {
+		return "error: " + err.Error()
+	}
+	var ack wire.Ack
+	if err := ack.UnmarshalBinary(b); err != nil {
+		return fmt.Sprintf("unknown %d byte packet", len(b))
+	}
+	s := fmt.Sprintf("ACK %d", ack.Seq)
+	if ack.Cumulative {
+		s += ", cumulative"
+	}
+	if ack.Repaired {
+		s += ", repaired"
+	}
+	return s
+}
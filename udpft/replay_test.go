@@ -0,0 +1,164 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"socket-file-transfer/internal/trace"
+)
+
+// The fixture, an upload of the numbers 1 to 6000 through a lossy network,
+// replays to the same file. Up to its ninth packet the server answers as
+// traced; there the traced server's delayed ACK fired a fraction of a
+// millisecond before the next packet came, which a fast replay doesn't
+// reproduce.
+func TestReplayFixture(t *testing.T) {
+	tr, err := trace.ReadFile(filepath.Join("..", "internal", "trace", "testdata", "upload.trace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Options: quietOptions()}
+	s.UploadDir = t.TempDir()
+	res, err := Replay(context.Background(), s, tr, true)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if res.Received != 30 || res.Recorded != 21 {
+		t.Errorf("received %d, recorded %d, want 30 and 21", res.Received, res.Recorded)
+	}
+	if d := res.Divergence; d != nil && d.Index < 8 {
+		t.Errorf("diverged at packet %d: traced %q, replayed %q", d.Index, d.Recorded, d.Replayed)
+	}
+	var numbers strings.Builder
+	for i := 1; i <= 6000; i++ {
+		fmt.Fprintln(&numbers, i)
+	}
+	checkStored(t, s.UploadDir, "numbers.txt", []byte(numbers.String()))
+}
+
+// record traces the server side of an upload of data, acknowledging every
+// packet so that no timer decides what the server sends.
+func record(t *testing.T, data []byte) *trace.Trace {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upload.trace")
+	w, err := trace.Create(path, trace.SERVER, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Options: quietOptions()}
+	s.AckEvery = 1
+	serveOn(t, s, trace.WrapPacketConn(conn, w))
+
+	var c Client
+	if _, err := c.Send(context.Background(), conn.LocalAddr().String(), "traced.bin", bytes.NewReader(data), int64(len(data)), quietOptions()); err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, s.UploadDir, "traced.bin", data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := trace.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+// A recorded upload replays without divergence, in real time or fast, and
+// a server acknowledging differently diverges at its first ACK.
+func TestReplayRecorded(t *testing.T) {
+	data := make([]byte, 100<<10)
+	rand.Read(data)
+	tr := record(t, data)
+
+	tests := []struct {
+		name     string
+		fast     bool
+		ackEvery int
+		diverge  bool
+	}{
+		{"real time", false, 1, false},
+		{"fast", true, 1, false},
+		{"other ACKs", true, 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{Options: quietOptions()}
+			s.UploadDir = t.TempDir()
+			s.AckEvery = tt.ackEvery
+			res, err := Replay(context.Background(), s, tr, tt.fast)
+			if err != nil {
+				t.Fatalf("Replay: %v", err)
+			}
+			if d := res.Divergence; (d != nil) != tt.diverge {
+				t.Fatalf("divergence %+v, want one: %v", d, tt.diverge)
+			}
+			checkStored(t, s.UploadDir, "traced.bin", data)
+			if !tt.diverge {
+				if res.Replayed != res.Recorded {
+					t.Errorf("replayed %d packets, recorded %d", res.Replayed, res.Recorded)
+				}
+				return
+			}
+			// The header ACK is the same, the first data ACK not
+			if d := res.Divergence; d.Index != 1 || !strings.HasPrefix(d.Recorded, "ACK 0") {
+				t.Errorf("diverged at packet %d: traced %q, replayed %q, want the first data ACK", d.Index, d.Recorded, d.Replayed)
+			}
+		})
+	}
+}
+
+// Only a server's trace with records replays, and a replay ends with its
+// context.
+func TestReplayRefused(t *testing.T) {
+	s := &Server{Options: quietOptions()}
+	s.UploadDir = t.TempDir()
+	rec := trace.Record{Time: time.Now(), Dir: trace.RECEIVED, Addr: "127.0.0.1:1", Data: []byte("x")}
+	if _, err := Replay(context.Background(), s, &trace.Trace{Side: trace.CLIENT, Records: []trace.Record{rec}}, true); err == nil || !strings.Contains(err.Error(), "client") {
+		t.Errorf("client's trace: got %v, want it refused", err)
+	}
+	if _, err := Replay(context.Background(), s, &trace.Trace{Side: trace.SERVER}, true); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("empty trace: got %v, want it refused", err)
+	}
+
+	// A datagram due in an hour
+	late := rec
+	late.Time = rec.Time.Add(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	res, err := Replay(ctx, s, &trace.Trace{Side: trace.SERVER, Records: []trace.Record{rec, late}}, false)
+	if err != nil || res.Received != 1 {
+		t.Errorf("got %+v, %v, want the first datagram replayed", res, err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("replay ended %v after its context", took)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		want   string
+	}{
+		{[]byte(PAUSE), PAUSE},
+		{[]byte(HEADER_ACK), fmt.Sprintf("legacy header ACK: %q", HEADER_ACK)},
+		{[]byte{1, 2, 3}, "unknown 3 byte packet"},
+	}
+	for _, tt := range tests {
+		if got := Describe(tt.packet); got != tt.want {
+			t.Errorf("Describe(%q) = %q, want %q", tt.packet, got, tt.want)
+		}
+	}
+}
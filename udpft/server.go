@@ -0,0 +1,820 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/bits"
+	"math/rand"
+	"net"
+	"time"
+
+	"socket-file-transfer/internal/batch"
+	"socket-file-transfer/internal/fec"
+	"socket-file-transfer/internal/hashcache"
+	"socket-file-transfer/internal/ports"
+	"socket-file-transfer/internal/prealloc"
+	"socket-file-transfer/internal/retention"
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/wire"
+)
+
+// Server receives files over UDP, one transfer at a time, and stores them
+// in UploadDir.
+type Server struct {
+	Addr               string        // Listen address, wire.UDP_PORT if empty
+	TFTPAddr           string        // TFTP listen address of ListenAndServeTFTP, wire.TFTP_PORT if empty
+	MulticastGroup     string        // Group and port ListenAndServeMulticast joins, e.g. "239.255.0.1:9000"
+	MulticastInterface string        // Network interface to join it on, the system's choice if empty
+	UploadDir          string        // Where received files are stored, "uploads" if empty
+	Storage            string        // Store files elsewhere, e.g. "s3://bucket/prefix", see internal/storage.Open; UploadDir if empty
+	StagingDir         string        // Receive files here and move them into UploadDir once complete, next to where they go if empty
+	Marker             bool          // Write .<name>.done next to each file once stored, its hooks run and recorded, see store.Completion
+	CompletedDir       string        // Move each file here, outside UploadDir, once stored, its hooks run and recorded
+	MaxFileSize        int64         // Larger files are refused with ErrTooLarge, no limit if 0
+	PerClientDirs      bool          // Store each client's files in UploadDir/<client IP>, see wire.ClientDir
+	Layout             string        // Where files go under UploadDir, see internal/layout; just the name if empty
+	RetainAge          time.Duration // Delete stored files older than this, see internal/retention; kept forever if 0
+	RetainBytes        int64         // Delete the oldest stored files while they total more, no budget if 0
+	RetainDryRun       bool          // Only log what retention would delete
+	ReserveSpace       int64         // Free bytes to keep on the upload filesystem; files that would use them are refused with ErrNoSpace
+	AcceptExt          []string      // Extensions of the files to accept, e.g. ".zip", see internal/filter; any if empty
+	RejectExt          []string      // Extensions of files to refuse with ErrRejected
+	SniffTypes         []string      // Content types to accept, as net/http.DetectContentType names them; any if empty
+	LivePolicy         *store.Live   // Replaces MaxFileSize, ReserveSpace, the filters above and retention if set, so they can change while serving
+	AutoExtract        bool          // Unpack stored .tar, .tar.gz and .tgz files into a directory of their name, see internal/archive
+	ExtractSize        int64         // What the files unpacked from one archive may total, MaxFileSize if 0, which bounds each file too, or archive.DefaultMaxTotal
+	ExtractCount       int           // Entries one archive may hold, archive.DefaultMaxEntries if 0
+	Dedupe             bool          // Store files whose content is already stored as hard links to it, see internal/dedupe
+	ScanCommand        string        // Check each file before storing it, quarantining those failing with ErrPolicy, see internal/scan
+	ScanTimeout        time.Duration // Longest a scan may take, scan.DefaultTimeout if 0
+	ScanPromote        bool          // Store files whose scan timed out instead of quarantining them
+	MaxPause           time.Duration // Abort a transfer its client paused for longer, wire.DefaultMaxPause if 0
+
+	Conn      net.PacketConn // Serve this, such as a socket systemd passed, instead of listening on Addr
+	PortRetry int            // Listen on one of this many ports above Addr's port if it is in use
+	Listening func(net.Addr) // Called with the address Serve receives transfers on once it does, e.g. to tell systemd the server is ready
+	Options
+
+	store *store.Store
+}
+
+func (s *Server) maxPause() time.Duration {
+	if s.MaxPause > 0 {
+		return s.MaxPause
+	}
+	return wire.DefaultMaxPause
+}
+
+func (s *Server) uploadDir() string {
+	if s.UploadDir != "" {
+		return s.UploadDir
+	}
+	return "uploads"
+}
+
+func (s *Server) storeConfig() store.Config {
+	return store.Config{
+		Root:          s.uploadDir(),
+		PerClientDirs: s.PerClientDirs,
+		Layout:        s.Layout,
+		Policy: store.Policy{
+			MaxFileSize:  s.MaxFileSize,
+			ReserveSpace: s.ReserveSpace,
+			AcceptExt:    s.AcceptExt,
+			RejectExt:    s.RejectExt,
+			SniffTypes:   s.SniffTypes,
+			Retention:    retention.Policy{MaxAge: s.RetainAge, MaxBytes: s.RetainBytes, DryRun: s.RetainDryRun},
+		},
+		Live:          s.LivePolicy,
+		NoPreallocate: s.NoPreallocate,
+		HookCommand:   s.HookCommand,
+		HookURL:       s.HookURL,
+		HookStrict:    s.HookStrict,
+		Storage:       s.Storage,
+		AutoExtract:   s.AutoExtract,
+		Dedupe:        s.Dedupe,
+		StagingDir:    s.StagingDir,
+
+		MaxExtractSize:    s.ExtractSize,
+		MaxExtractEntries: s.ExtractCount,
+
+		CompletionMarker: s.Marker,
+		CompletedDir:     s.CompletedDir,
+
+		ScanCommand:          s.ScanCommand,
+		ScanTimeout:          s.ScanTimeout,
+		ScanPromoteOnTimeout: s.ScanPromote,
+	}
+}
+
+// bufferSize fits the largest packet a client may send.
+func (s *Server) bufferSize() int {
+	return max(s.packetSize(), MAX_HEADER_PACKET) + HEADER_ROOM
+}
+
+// ListenAndServe listens on s.Addr, or takes s.Conn, and serves transfers
+// until ctx ends.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	if s.Conn != nil {
+		return s.Serve(ctx, s.Conn)
+	}
+	addr := s.Addr
+	if addr == "" {
+		addr = wire.UDP_PORT
+	}
+
+	conn, err := ports.Listen(addr, s.PortRetry, func(addr string) (net.PacketConn, error) {
+		return net.ListenPacket("udp", addr)
+	})
+	if err != nil {
+		return fmt.Errorf("error starting UDP server: %w", err)
+	}
+	return s.Serve(ctx, conn)
+}
+
+// Serve handles transfers arriving on conn until ctx ends, which also
+// aborts the transfer in progress. The connection is closed on return.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	defer conn.Close()
+	if s.BatchIO {
+		conn = batch.NewConn(conn, wire.DATA_HEADER_LEN+MAX_PACKET_SIZE+HEADER_ROOM)
+	}
+
+	// Hooks started in the background finish after the transfer
+	st, err := store.Open(s.storeConfig(), s.logger())
+	if err != nil {
+		return err
+	}
+	s.store = st
+	defer st.Close()
+
+	// Unblock pending reads once ctx ends
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	log := s.logger()
+	log.Info("UDP Server listening", "addr", conn.LocalAddr())
+	if s.Listening != nil {
+		s.Listening(conn.LocalAddr())
+	}
+
+	var next *datagram
+	for {
+		var err error
+		next, err = s.handleFileTransfer(ctx, conn, next)
+		if err == net.ErrClosed {
+			// Closed while idle, between transfers
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err != nil {
+			log.Error("Transfer failed", "err", wire.ContextError(ctx, err))
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// datagram is a packet read ahead of the transfer it belongs to.
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// handleFileTransfer receives one file, starting from first if a previous
+// transfer already read its header packet. A partially received file is
+// removed. The first packet of the next transfer is returned if it
+// arrived while this one was winding down. Once the client is known its
+// failures are logged here, with its address, and not returned.
+func (s *Server) handleFileTransfer(ctx context.Context, conn net.PacketConn, first *datagram) (next *datagram, err error) {
+	buffer := make([]byte, s.bufferSize())
+	log := s.logger()
+
+	var n int
+	var clientAddr net.Addr
+	if first != nil {
+		n, clientAddr = copy(buffer, first.data), first.addr
+	} else {
+		// Set initial timeout for header
+		conn.SetReadDeadline(time.Now().Add(HEADER_TIMEOUT))
+
+		// Read first packet (should contain file header)
+		n, clientAddr, err = conn.ReadFrom(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Debug("Timeout waiting for client connection")
+				return nil, nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil, net.ErrClosed
+			}
+			return nil, fmt.Errorf("error reading from UDP: %w", err)
+		}
+	}
+	// A client paused past MaxPause resumes a transfer already given up on
+	if bytes.Equal(buffer[:n], []byte(PAUSE)) || bytes.Equal(buffer[:n], []byte(RESUME)) {
+		log.Debug("Ignoring pause of a transfer no longer in progress", "remote", clientAddr)
+		conn.WriteTo(errorPacket(fmt.Errorf("%w: transfer no longer in progress, it may have been paused too long", wire.ErrTimeout)), clientAddr)
+		return nil, nil
+	}
+	// So does one aborting a transfer that never started or already ended
+	if remoteError(buffer[:n]) != nil {
+		log.Debug("Ignoring error packet outside a transfer", "remote", clientAddr)
+		return nil, nil
+	}
+	headerPacket := append([]byte(nil), buffer[:n]...)
+
+	log = log.With("remote", clientAddr.String())
+	log.Info("New file transfer")
+
+	rep := s.reporter(clientAddr.String())
+	defer rep.Close()
+	// A kill wakes the data loop from its wait for the next packet
+	killed, kill := context.WithCancelCause(ctx)
+	defer kill(nil)
+	rep.SetCancel(func(err error) {
+		kill(err)
+		conn.SetReadDeadline(time.Now())
+	})
+	defer func() {
+		if err == nil {
+			return
+		}
+		rep.Fail(err)
+		// Tell the client why, unless the socket is gone, the client
+		// gave up or it was told already
+		if !errors.Is(err, wire.ErrAborted) && !errors.Is(err, wire.ErrKilled) {
+			conn.WriteTo(errorPacket(err), clientAddr)
+		}
+		switch {
+		case errors.Is(err, wire.ErrPolicy):
+			log.Warn("Transfer rejected by policy", "err", err)
+		case errors.Is(err, wire.ErrKilled):
+			log.Warn("Transfer killed", "err", err)
+		case !errors.Is(err, wire.ErrAborted):
+			log.Error("Transfer failed", "err", wire.ContextError(ctx, err))
+		}
+		err = nil
+	}()
+
+	// Versioned clients put a hello in front of the file header
+	packet := buffer[:n]
+	legacy := !wire.HasMagic(packet)
+	features := hello.Features
+	version := byte(1)
+	if !legacy {
+		var peer wire.Hello
+		if err := peer.UnmarshalBinary(packet); err != nil {
+			return nil, fmt.Errorf("invalid header packet: %w", err)
+		}
+		common, err := wire.Negotiate(hello, peer)
+		if err != nil {
+			return nil, err
+		}
+		log.Debug("Negotiated protocol", "version", common.Version, "features", common.Features)
+		features, version = common.Features, common.Version
+		packet = packet[wire.HELLO_LEN:]
+	} else if !s.Legacy {
+		return nil, fmt.Errorf("%w: client predates version negotiation, serve with -legacy to accept it", wire.ErrProtocol)
+	}
+
+	// Parse file header from first packet
+	var header wire.FileHeader
+	if err := header.UnmarshalBinary(packet); err != nil {
+		return nil, fmt.Errorf("invalid header packet: %w", err)
+	}
+
+	// The client can't know our features before sending the header, so
+	// ignore requests for ones we lack rather than failing
+	header.Flags &= byte(features)
+	if err := wire.CheckName(header.Name); err != nil {
+		return nil, fmt.Errorf("%w: %w", wire.ErrProtocol, err)
+	}
+	if header.Size > math.MaxInt64 {
+		return nil, fmt.Errorf("%w: file size %d", wire.ErrProtocol, header.Size)
+	}
+
+	// Make room for the packets the client announced
+	if header.Flags&wire.FLAG_PACKET_SIZE != 0 {
+		if header.PacketSize == 0 || header.PacketSize > MAX_PACKET_SIZE {
+			return nil, fmt.Errorf("%w: packet size %d", wire.ErrProtocol, header.PacketSize)
+		}
+		if need := wire.DATA_HEADER_LEN + wire.DATA_OFFSET_LEN + int(header.PacketSize) + HEADER_ROOM; need > len(buffer) {
+			buffer = make([]byte, need)
+		}
+	}
+
+	// Holes in a sparse file show as gaps between the offsets version 2
+	// packets carry. Rebuilt packets have none, so FEC can't be used.
+	sparse := header.Flags&wire.FLAG_SPARSE != 0 && version >= 2
+	if sparse && header.Flags&wire.FLAG_FEC != 0 {
+		return nil, fmt.Errorf("%w: a sparse transfer can't use FEC", wire.ErrProtocol)
+	}
+
+	// Rebuild lost packets from the parity the client announced
+	var fecRx *fecReceiver
+	if header.Flags&wire.FLAG_FEC != 0 {
+		code, err := fec.New(int(header.FECData), int(header.FECParity))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", wire.ErrProtocol, err)
+		}
+		fecRx = newFECReceiver(code, header.Size)
+	}
+
+	filename := header.Name
+	fileSize := header.Size
+
+	// Clients since version 3 learn it from the ACK, so both logs can be
+	// matched up
+	session := rand.Uint32()
+	if version >= 3 {
+		log = log.With("session", session)
+	}
+
+	log.Info("Receiving file", "name", filename, "size", fileSize)
+	rep.Start(filename, int64(fileSize))
+
+	in, err := s.store.Place(clientAddr, filename, int64(fileSize), header.Checksum, log)
+	if err != nil {
+		return nil, err
+	}
+	// Let the client skip the body if we already hold an identical copy
+	skip := header.Flags&wire.FLAG_SKIP_IDENTICAL != 0 && s.store.Local() &&
+		hashcache.Matches(in.Path, int64(fileSize), header.Checksum)
+
+	// Create output file, reserving its space before the client commits
+	// to sending it
+	in.Sparse = sparse
+	if !skip {
+		if err := in.Create(); err != nil {
+			return nil, err
+		}
+		defer in.Close()
+	}
+
+	// Versioned clients learn our version and features from the ACK, and
+	// since version 3 everything else we decided for the transfer
+	var ack []byte
+	if version >= 3 {
+		ha := wire.HeaderAck{Version: version, Session: session, PacketSize: DefaultPacketSize, Features: features}
+		if skip {
+			ha.Status = wire.HEADER_STATUS_SKIP
+		}
+		if header.Flags&wire.FLAG_PACKET_SIZE != 0 {
+			ha.PacketSize = header.PacketSize
+		}
+		ack, _ = ha.MarshalBinary()
+	} else {
+		ack = []byte(HEADER_ACK)
+		if skip {
+			ack = []byte(HEADER_SKIP)
+		}
+		if !legacy {
+			b, _ := hello.MarshalBinary()
+			ack = append(ack, b...)
+		}
+	}
+
+	// An empty file has no data packet whose ACK could confirm it is
+	// stored, so it is stored before the header is acknowledged
+	empty := fileSize == 0 && !skip
+	if empty {
+		if err := in.Sync(); err != nil {
+			return nil, prealloc.NoSpace(fmt.Errorf("error writing to file: %w", err))
+		}
+		upload, err := in.Commit()
+		if err != nil {
+			return nil, err
+		}
+		log.Info("File saved", "path", upload.Path, "bytes", 0)
+	}
+
+	// Send ACK for header
+	_, err = conn.WriteTo(ack, clientAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error sending header ACK: %w", err)
+	}
+
+	if skip {
+		log.Info("Skipped, identical copy already stored", "path", in.Path)
+		rep.Complete(0)
+		return nil, nil
+	}
+	if empty {
+		rep.CompleteStats(0, &Stats{})
+		return s.linger(conn, clientAddr, buffer, headerPacket, ack), nil
+	}
+
+	// Receive file data packets
+	startTime := time.Now()
+	var totalReceived uint64
+	expectedSeqNum := uint32(0)
+	receivedPackets := make(map[uint32]received)
+
+	// Since version 2 packets say where their data goes, so they are
+	// written as they arrive unless the storage only appends; before that
+	// only in order
+	offsets := version >= 2
+	output, anyOrder := in.WriterAt()
+	writeNow := offsets && anyOrder
+	var sawLast bool
+	var lastSeq uint32
+	var stats Stats
+	have := func(seq uint32) bool {
+		_, ok := receivedPackets[seq]
+		return seq < expectedSeqNum || ok
+	}
+	consecutiveTimeouts := 0
+	maxConsecutiveTimeouts := s.maxRetries()
+
+	// Probes the path drops cost the client a timeout each before data
+	// flows, at every size it tries
+	probeTimeouts := 0
+	if header.PacketSize > DefaultPacketSize {
+		probeTimeouts = PROBE_ATTEMPTS * bits.Len(uint(header.PacketSize/DefaultPacketSize))
+	}
+	writer := newDiskWriter(output)
+	defer writer.Close()
+	store := func(seq uint32, data []byte, offset uint64) error {
+		receivedPackets[seq] = received{data: data, offset: offset}
+		if !writeNow {
+			return nil
+		}
+		if err := writer.Write(data, int64(offset)); err != nil {
+			return prealloc.NoSpace(fmt.Errorf("error writing to file: %w", err))
+		}
+		return nil
+	}
+	var final []wire.Ack
+
+	// Clients that understand cumulative ACKs get fewer of them
+	var acker *ackPolicy
+	if header.Flags&wire.FLAG_CUMULATIVE_ACK != 0 && s.ackEvery() > 1 {
+		acker = newAckPolicy(s.ackEvery(), s.ackDelay())
+	}
+	var acksSent int
+
+	// While the client is paused only MaxPause bounds the wait
+	var pausedAt time.Time
+	resumed := func() {
+		if !pausedAt.IsZero() {
+			log.Info("Client resumed", "paused", time.Since(pausedAt))
+			rep.Resumed()
+			pausedAt = time.Time{}
+		}
+	}
+
+	readDeadline := time.Now().Add(s.timeout())
+	for totalReceived < fileSize {
+		// A kill ends the transfer as a client abort does, dropping
+		// what the client still has in flight
+		if cause := context.Cause(killed); errors.Is(cause, wire.ErrKilled) {
+			conn.WriteTo(errorPacket(cause), clientAddr)
+			return s.drain(conn, clientAddr, buffer), cause
+		}
+
+		// Wait for the next packet, or until delayed ACKs are due
+		deadline := readDeadline
+		if acker != nil && !acker.due.IsZero() && acker.due.Before(deadline) {
+			deadline = acker.due
+		}
+		conn.SetReadDeadline(deadline)
+
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if acker != nil && !acker.due.IsZero() && !time.Now().Before(acker.due) {
+					acks := acker.expire(expectedSeqNum)
+					acksSent += len(acks)
+					sendAcks(conn, clientAddr, acks, log)
+					continue
+				}
+				if !pausedAt.IsZero() {
+					return nil, fmt.Errorf("%w: client paused for longer than %s", wire.ErrTimeout, s.maxPause())
+				}
+				readDeadline = time.Now().Add(s.timeout())
+				limit := maxConsecutiveTimeouts
+				if expectedSeqNum == 0 && len(receivedPackets) == 0 {
+					limit += probeTimeouts
+				}
+				consecutiveTimeouts++
+				stats.Timeouts++
+				log.Warn("Timeout waiting for data packet", "attempt", consecutiveTimeouts, "max", limit)
+				if consecutiveTimeouts >= limit {
+					return nil, fmt.Errorf("%w: too many consecutive timeouts after %d of %d bytes", wire.ErrTimeout, totalReceived, fileSize)
+				}
+				continue
+			}
+			return nil, fmt.Errorf("error reading data packet: %w", err)
+		}
+
+		// Only the client may add to its file
+		if addr.String() != clientAddr.String() {
+			log.Debug("Ignoring packet from another address", "from", addr)
+			stats.Strays++
+			continue
+		}
+
+		// Reset timeout counter on successful read
+		consecutiveTimeouts = 0
+		readDeadline = time.Now().Add(s.timeout())
+
+		// The client resends the header if our ACK for it was lost
+		if bytes.Equal(buffer[:n], headerPacket) {
+			conn.WriteTo(ack, clientAddr)
+			continue
+		}
+
+		// Before data flows the client may probe how large a packet gets
+		// through. Data packet 0 starts with zero bytes, never the prefix.
+		if expectedSeqNum == 0 && len(receivedPackets) == 0 && bytes.HasPrefix(buffer[:n], []byte(PROBE)) {
+			conn.WriteTo(binary.BigEndian.AppendUint16([]byte(PROBE), uint16(n)), clientAddr)
+			continue
+		}
+
+		// The client pauses or resumes the transfer; a lost echo has it
+		// send the packet again
+		if bytes.Equal(buffer[:n], []byte(PAUSE)) {
+			conn.WriteTo([]byte(PAUSE), clientAddr)
+			if pausedAt.IsZero() {
+				log.Info("Client paused")
+				rep.Paused()
+				pausedAt = time.Now()
+			}
+			readDeadline = pausedAt.Add(s.maxPause())
+			continue
+		}
+		if bytes.Equal(buffer[:n], []byte(RESUME)) {
+			conn.WriteTo([]byte(RESUME), clientAddr)
+			resumed()
+			continue
+		}
+
+		// The client gives up, e.g. when it can't read its file or was
+		// cancelled; the packets it still had in flight are dropped
+		if rerr := remoteError(buffer[:n]); rerr != nil {
+			if aborted := wire.Aborted(rerr); aborted != nil {
+				log.Warn("Transfer aborted", "err", aborted)
+				return s.drain(conn, clientAddr, buffer), aborted
+			}
+			return nil, fmt.Errorf("client aborted: %w", rerr)
+		}
+
+		var packet wire.DataPacket
+		if err := packet.UnmarshalBinary(buffer[:n]); err != nil {
+			log.Warn("Invalid data packet", "err", err)
+			stats.Strays++
+			continue
+		}
+		stats.PacketsReceived++
+		resumed() // In case its RESUME was lost
+		seqNum := packet.Seq
+		if packet.Parity && fecRx == nil {
+			log.Warn("Invalid data packet", "err", "parity without FEC")
+			continue
+		}
+		if !packet.Parity && packet.HasOffset != offsets {
+			log.Warn("Invalid data packet", "err", "byte offset does not match the protocol version")
+			continue
+		}
+		if packet.HasOffset && (packet.Offset > fileSize || uint64(len(packet.Payload)) > fileSize-packet.Offset) {
+			log.Warn("Invalid data packet", "err", "data past the end of the file", "offset", packet.Offset)
+			continue
+		}
+
+		// Packets too far ahead would let a peer make us buffer without
+		// bound; the client resends them once it gets that far
+		first := uint64(seqNum)
+		if packet.Parity {
+			first *= uint64(fecRx.code.DataShards())
+		}
+		if first >= uint64(expectedSeqNum)+RECEIVE_WINDOW {
+			log.Warn("Dropping packet beyond the receive window", "seq", seqNum, "expected", expectedSeqNum)
+			continue
+		}
+
+		// Store packet data, unless it is a late duplicate of one written,
+		// along with any packets its FEC group lets us rebuild
+		var acks []wire.Ack
+		var rebuilt []wire.DataPacket
+		before := expectedSeqNum
+		if packet.Parity {
+			rebuilt = fecRx.addParity(&packet, have)
+		} else {
+			if have(seqNum) {
+				stats.Duplicates++
+			} else {
+				data := append([]byte(nil), packet.Payload...)
+				if err := store(seqNum, data, packet.Offset); err != nil {
+					return nil, err
+				}
+				if fecRx != nil {
+					rebuilt = fecRx.addData(seqNum, data, have)
+				}
+			}
+			if packet.Last {
+				sawLast, lastSeq = true, seqNum
+			}
+			if acker == nil {
+				acks = append(acks, wire.Ack{Seq: seqNum})
+			}
+		}
+		for _, p := range rebuilt {
+			if have(p.Seq) {
+				continue
+			}
+			if err := store(p.Seq, p.Payload, p.Offset); err != nil {
+				return nil, err
+			}
+			if p.Last {
+				sawLast, lastSeq = true, p.Seq
+			}
+			stats.Repaired++
+			acks = append(acks, wire.Ack{Seq: p.Seq, Repaired: true})
+		}
+
+		// Hash packets in order, writing them now if they weren't as they
+		// arrived
+		for {
+			if r, exists := receivedPackets[expectedSeqNum]; exists {
+				data := r.data
+				if offsets && r.offset != totalReceived {
+					if !sparse || r.offset < totalReceived {
+						return nil, fmt.Errorf("%w: packet %d at offset %d, expected %d", wire.ErrProtocol, expectedSeqNum, r.offset, totalReceived)
+					}
+					// A hole, left unwritten unless the storage only appends
+					hole := int64(r.offset - totalReceived)
+					if !writeNow {
+						if err := writer.WriteZeros(hole, int64(totalReceived)); err != nil {
+							return nil, prealloc.NoSpace(fmt.Errorf("error writing to file: %w", err))
+						}
+					}
+					if err := in.AddHole(hole); err != nil {
+						return nil, err
+					}
+					totalReceived = r.offset
+				}
+				if !writeNow {
+					err = writer.Write(data, int64(totalReceived))
+					if err != nil {
+						return nil, prealloc.NoSpace(fmt.Errorf("error writing to file: %w", err))
+					}
+				}
+				if err := in.Add(data); err != nil {
+					return nil, err
+				}
+				totalReceived += uint64(len(data))
+				delete(receivedPackets, expectedSeqNum)
+				expectedSeqNum++
+
+				rep.Progress(int64(totalReceived))
+			} else {
+				break
+			}
+		}
+
+		// The client has nothing more to send. The packets that completed
+		// the file are acknowledged once it is safely on disk.
+		done := sawLast && expectedSeqNum > lastSeq || totalReceived >= fileSize
+		if acker != nil {
+			switch {
+			case done:
+				acks = append(acks, acker.flush(expectedSeqNum)...)
+			case !packet.Parity:
+				acks = append(acks, acker.onData(seqNum, before, expectedSeqNum, time.Now())...)
+			}
+		}
+		acksSent += len(acks)
+		if done {
+			final = acks
+			break
+		}
+
+		// Send ACKs
+		sendAcks(conn, clientAddr, acks, log)
+	}
+
+	if totalReceived != fileSize {
+		return nil, fmt.Errorf("%w: transfer ended after %d of %d bytes", wire.ErrProtocol, totalReceived, fileSize)
+	}
+	stop := heartbeat(conn, clientAddr, features, in.Status)
+	err = writer.Close()
+	if err == nil {
+		err = in.Sync()
+	}
+	if err != nil {
+		stop()
+		return nil, prealloc.NoSpace(fmt.Errorf("error writing to file: %w", err))
+	}
+	upload, err := in.Commit()
+	stop()
+	if err != nil {
+		return nil, err
+	}
+	sendAcks(conn, clientAddr, final, log)
+
+	log.Info("File saved", "path", upload.Path, "bytes", totalReceived, "duration", time.Since(startTime), "acks", acksSent)
+	if fecRx != nil {
+		log.Info("Lost packets rebuilt from parity", "packets", stats.Repaired)
+	}
+	log.Info("Packet stats", "received", stats.PacketsReceived, "duplicates", stats.Duplicates, "timeouts", stats.Timeouts, "strays", stats.Strays)
+
+	rep.CompleteStats(int64(totalReceived), &stats)
+	return s.linger(conn, clientAddr, buffer, headerPacket, ack), nil
+}
+
+// received is a data packet stored until it can be hashed in order.
+type received struct {
+	data   []byte
+	offset uint64 // In the file, if the packet carried it
+}
+
+// linger re-acknowledges data packets, and the header, the client resends
+// for as long as it may keep retrying, in case our last ACK was lost and
+// the client is still waiting for it. A packet from another address ends
+// it early and is returned as the start of the next transfer.
+func (s *Server) linger(conn net.PacketConn, clientAddr net.Addr, buffer, header, headerAck []byte) *datagram {
+	conn.SetReadDeadline(time.Now().Add(s.timeout() * time.Duration(s.maxRetries())))
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return nil
+		}
+		if addr.String() != clientAddr.String() {
+			return &datagram{data: append([]byte(nil), buffer[:n]...), addr: addr}
+		}
+		if bytes.Equal(buffer[:n], header) {
+			conn.WriteTo(headerAck, clientAddr)
+			continue
+		}
+
+		var packet wire.DataPacket
+		if packet.UnmarshalBinary(buffer[:n]) == nil && !packet.Parity {
+			ackMsg, _ := (&wire.Ack{Seq: packet.Seq}).MarshalBinary()
+			conn.WriteTo(ackMsg, clientAddr)
+		}
+	}
+}
+
+// drain discards what an aborted client still had in flight, for one
+// packet timeout. A packet from another address ends it early and is
+// returned as the start of the next transfer.
+func (s *Server) drain(conn net.PacketConn, clientAddr net.Addr, buffer []byte) *datagram {
+	conn.SetReadDeadline(time.Now().Add(s.timeout()))
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return nil
+		}
+		if addr.String() != clientAddr.String() {
+			return &datagram{data: append([]byte(nil), buffer[:n]...), addr: addr}
+		}
+	}
+}
+
+// heartbeat sends the client a BUSY_PREFIX packet with status() every
+// wire.HEARTBEAT_INTERVAL, if features include FEATURE_HEARTBEAT, until the
+// returned function is called, so it keeps waiting for the ACKs held back
+// while the file is stored.
+func heartbeat(conn net.PacketConn, clientAddr net.Addr, features uint32, status func() string) (stop func()) {
+	if features&wire.FEATURE_HEARTBEAT == 0 {
+		return func() {}
+	}
+	stopc, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(wire.HEARTBEAT_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopc:
+				return
+			case <-ticker.C:
+			}
+			conn.WriteTo(append([]byte(BUSY_PREFIX), wire.BusyStatus(status())...), clientAddr)
+		}
+	}()
+	return func() {
+		close(stopc)
+		<-done
+	}
+}
+
+// sendAcks acknowledges data packets to the client.
+func sendAcks(conn net.PacketConn, clientAddr net.Addr, acks []wire.Ack, log *slog.Logger) {
+	for _, ack := range acks {
+		ackMsg, _ := ack.MarshalBinary()
+		_, err := conn.WriteTo(ackMsg, clientAddr)
+		if err != nil {
+			log.Warn("Error sending ACK", "seq", ack.Seq, "err", err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"socket-file-transfer/internal/wire"
+)
+
+// inject sends count packets made by packet from a socket of its own to
+// addr.
+func inject(t *testing.T, addr net.Addr, count int, packet func(i int) []byte) {
+	t.Helper()
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer stranger.Close()
+	for i := 0; i < count; i++ {
+		stranger.WriteTo(packet(i), addr)
+	}
+}
+
+// injectOnRead injects strays into the connection it wraps once the
+// transfer is under way, on its nth read.
+type injectOnRead struct {
+	net.PacketConn
+	nth    int
+	reads  int
+	inject func()
+}
+
+func (c *injectOnRead) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.reads++
+	if c.reads == c.nth {
+		c.inject()
+	}
+	return c.PacketConn.ReadFrom(b)
+}
+
+// Data packets from another host in the middle of a transfer are dropped
+// and counted, leaving the file as the client sent it.
+func TestServerIgnoresStrays(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	completed := make(chan *Stats, 1)
+	s := &Server{}
+	s.Progress = func(ev Event) {
+		if ev.Kind == EventCompleted {
+			completed <- ev.Stats
+		}
+	}
+	serveOn(t, s, &injectOnRead{PacketConn: conn, nth: 5, inject: func() {
+		inject(t, conn.LocalAddr(), 50, func(i int) []byte {
+			p := wire.DataPacket{Seq: uint32(150 + i), Payload: bytes.Repeat([]byte{'X'}, DefaultPacketSize)}
+			b, _ := p.MarshalBinary()
+			return b
+		})
+	}})
+
+	data := make([]byte, 200*DefaultPacketSize+3)
+	rand.Read(data)
+	if _, err := (&Client{}).SendFile(context.Background(), conn.LocalAddr().String(), writeFile(t, "f", data), quietOptions()); err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	checkStored(t, s.UploadDir, "f", data)
+
+	if stats := <-completed; stats == nil || stats.Strays == 0 {
+		t.Errorf("stats %+v count no stray packets", stats)
+	}
+}
+
+// unconnected is a client socket that isn't connected to the server, so
+// it receives from anyone.
+type unconnected struct {
+	*net.UDPConn
+	server net.Addr
+	writes atomic.Int32
+	nth    int32
+	inject func(local net.Addr)
+}
+
+func (c *unconnected) Write(b []byte) (int, error) {
+	if c.writes.Add(1) == c.nth {
+		c.inject(c.LocalAddr())
+	}
+	return c.WriteTo(b, c.server)
+}
+
+func (c *unconnected) RemoteAddr() net.Addr { return c.server }
+
+// ACKs from another host can't make the client skip packets the server
+// never got.
+func TestClientIgnoresStrays(t *testing.T) {
+	s := &Server{}
+	addr := serve(t, s)
+
+	client := &Client{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		server, err := net.ResolveUDPAddr(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP(network, &net.UDPAddr{IP: server.IP})
+		if err != nil {
+			return nil, err
+		}
+		return &unconnected{UDPConn: conn, server: server, nth: 5, inject: func(local net.Addr) {
+			inject(t, local, 200, func(i int) []byte {
+				ack := wire.Ack{Seq: uint32(i), Cumulative: true}
+				b, _ := ack.MarshalBinary()
+				return b
+			})
+		}}, nil
+	}}
+
+	data := make([]byte, 200*DefaultPacketSize+3)
+	rand.Read(data)
+	res, err := client.SendFile(context.Background(), addr, writeFile(t, "f", data), quietOptions())
+	if err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	checkStored(t, s.UploadDir, "f", data)
+	if res.Strays == 0 {
+		t.Error("no stray packets counted")
+	}
+}
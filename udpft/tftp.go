@@ -0,0 +1,393 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"socket-file-transfer/internal/store"
+	"socket-file-transfer/internal/wire"
+)
+
+const (
+	// Data bytes per TFTP block unless the client negotiates blksize, and
+	// the bounds it may ask for (RFC 2348)
+	TFTP_BLOCK_SIZE     = 512
+	TFTP_MIN_BLOCK_SIZE = 8
+	TFTP_MAX_BLOCK_SIZE = 65464
+
+	// Most TFTP transfers received at once
+	TFTP_MAX_TRANSFERS = 64
+)
+
+// TFTP opcodes
+const (
+	tftpRRQ   = 1
+	tftpWRQ   = 2
+	tftpDATA  = 3
+	tftpACK   = 4
+	tftpERROR = 5
+	tftpOACK  = 6
+)
+
+// TFTP error codes
+const (
+	tftpErrUndefined  = 0
+	tftpErrAccess     = 2
+	tftpErrDiskFull   = 3
+	tftpErrIllegal    = 4
+	tftpErrUnknownTID = 5
+)
+
+// errTFTPAborted is a transfer the client ended with an error packet,
+// which gets no reply.
+var errTFTPAborted = errors.New("client aborted the transfer")
+
+// tftpRequest is a read or write request.
+type tftpRequest struct {
+	op      uint16
+	name    string
+	mode    string
+	options map[string]string // Names lowercased
+}
+
+func parseTFTPRequest(b []byte) (*tftpRequest, error) {
+	if len(b) < 2 {
+		return nil, wire.ErrTruncated
+	}
+	req := &tftpRequest{op: binary.BigEndian.Uint16(b), options: make(map[string]string)}
+	if req.op != tftpRRQ && req.op != tftpWRQ {
+		return nil, fmt.Errorf("%w: opcode %d instead of a request", wire.ErrProtocol, req.op)
+	}
+	// Strings each end with a zero byte
+	if len(b) == 2 || b[len(b)-1] != 0 {
+		return nil, wire.ErrMalformed
+	}
+	fields := strings.Split(string(b[2:len(b)-1]), "\x00")
+	if len(fields) < 2 || len(fields)%2 != 0 {
+		return nil, wire.ErrMalformed
+	}
+	req.name, req.mode = fields[0], fields[1]
+	for i := 2; i < len(fields); i += 2 {
+		req.options[strings.ToLower(fields[i])] = fields[i+1]
+	}
+	return req, nil
+}
+
+func tftpAck(block uint16) []byte {
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, tftpACK), block)
+}
+
+// tftpOptionAck accepts the options in pairs of name and value.
+func tftpOptionAck(pairs []string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, tftpOACK)
+	for _, s := range pairs {
+		b = append(append(b, s...), 0)
+	}
+	return b
+}
+
+func tftpError(code uint16, msg string) []byte {
+	b := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, tftpERROR), code)
+	return append(append(b, msg...), 0)
+}
+
+// tftpErrorPacket tells the client why its transfer failed.
+func tftpErrorPacket(err error) []byte {
+	code := uint16(tftpErrUndefined)
+	switch {
+	case errors.Is(err, wire.ErrTooLarge), errors.Is(err, wire.ErrExpansion), errors.Is(err, wire.ErrNoSpace):
+		code = tftpErrDiskFull
+	case errors.Is(err, wire.ErrRejected), errors.Is(err, wire.ErrInvalidName):
+		code = tftpErrAccess
+	case errors.Is(err, wire.ErrProtocol):
+		code = tftpErrIllegal
+	}
+	return tftpError(code, err.Error())
+}
+
+// ListenAndServeTFTP listens on s.TFTPAddr and serves TFTP uploads until
+// ctx ends.
+func (s *Server) ListenAndServeTFTP(ctx context.Context) error {
+	addr := s.TFTPAddr
+	if addr == "" {
+		addr = wire.TFTP_PORT
+	}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("error starting TFTP server: %w", err)
+	}
+	return s.ServeTFTP(ctx, conn)
+}
+
+// ServeTFTP accepts TFTP (RFC 1350) write requests arriving on conn until
+// ctx ends, for clients such as network boot firmware that speak nothing
+// else, and stores the files like Serve. Only octet mode is supported,
+// with the blksize and tsize options. Each transfer runs on a port of its
+// own, as the protocol has it, so several run at once. The connection is
+// closed on return.
+func (s *Server) ServeTFTP(ctx context.Context, conn net.PacketConn) error {
+	defer conn.Close()
+
+	st, err := store.Open(s.storeConfig(), s.logger())
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	// Unblock pending reads once ctx ends
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	log := s.logger()
+	log.Info("TFTP Server listening", "addr", conn.LocalAddr())
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var mu sync.Mutex
+	active := make(map[string]bool) // Clients with a transfer running
+
+	buffer := make([]byte, 2048)
+	for {
+		n, clientAddr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			return fmt.Errorf("error reading from UDP: %w", err)
+		}
+		req, err := parseTFTPRequest(buffer[:n])
+		if err != nil {
+			log.Warn("Invalid TFTP request", "remote", clientAddr, "err", err)
+			conn.WriteTo(tftpErrorPacket(err), clientAddr)
+			continue
+		}
+
+		// A client resends its request until the transfer answers it
+		key := clientAddr.String()
+		mu.Lock()
+		busy, full := active[key], len(active) >= TFTP_MAX_TRANSFERS
+		if !busy && !full {
+			active[key] = true
+		}
+		mu.Unlock()
+		if busy {
+			continue
+		}
+		if full {
+			conn.WriteTo(tftpError(tftpErrUndefined, "server busy"), clientAddr)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				mu.Lock()
+				delete(active, key)
+				mu.Unlock()
+			}()
+			s.receiveTFTP(ctx, st, conn.LocalAddr(), clientAddr, req)
+		}()
+	}
+}
+
+// receiveTFTP handles req from clientAddr on a new port of the address
+// local, telling the client why if it fails.
+func (s *Server) receiveTFTP(ctx context.Context, st *store.Store, local, clientAddr net.Addr, req *tftpRequest) {
+	log := s.logger().With("remote", clientAddr.String())
+	log.Info("New TFTP transfer")
+
+	rep := s.reporter(clientAddr.String())
+	defer rep.Close()
+
+	host := ""
+	if addr, ok := local.(*net.UDPAddr); ok && !addr.IP.IsUnspecified() {
+		host = addr.IP.String()
+	}
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		log.Error("Transfer failed", "err", fmt.Errorf("error opening transfer port: %w", err))
+		return
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err = s.handleTFTP(conn, st, clientAddr, req, rep, log)
+	if err != nil {
+		rep.Fail(err)
+		if !errors.Is(err, errTFTPAborted) {
+			conn.WriteTo(tftpErrorPacket(err), clientAddr)
+		}
+		log.Error("Transfer failed", "err", wire.ContextError(ctx, err))
+	}
+}
+
+// handleTFTP receives the file of a write request, acknowledging each
+// block once written. A block shorter than the block size ends the file.
+func (s *Server) handleTFTP(conn net.PacketConn, st *store.Store, clientAddr net.Addr, req *tftpRequest, rep *wire.Reporter, log *slog.Logger) error {
+	if req.op != tftpWRQ {
+		return fmt.Errorf("%w: only uploads are accepted", wire.ErrProtocol)
+	}
+	if !strings.EqualFold(req.mode, "octet") {
+		return fmt.Errorf("%w: %s mode, only octet is supported", wire.ErrProtocol, req.mode)
+	}
+
+	// Clients often name a path on their own side; only the file name
+	// counts here
+	name := path.Base(strings.ReplaceAll(req.name, "\\", "/"))
+	if err := wire.CheckName(name); err != nil {
+		return err
+	}
+
+	// Accept the options we understand, ignoring the rest
+	blockSize := TFTP_BLOCK_SIZE
+	size := int64(-1)
+	var accepted []string
+	if v, ok := req.options["blksize"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= TFTP_MIN_BLOCK_SIZE {
+			blockSize = min(n, TFTP_MAX_BLOCK_SIZE)
+			accepted = append(accepted, "blksize", strconv.Itoa(blockSize))
+		}
+	}
+	if v, ok := req.options["tsize"]; ok {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			size = n
+			accepted = append(accepted, "tsize", v)
+		}
+	}
+
+	log.Info("Receiving file", "name", name, "size", size, "block_size", blockSize)
+	rep.Start(name, max(size, 0))
+
+	in, err := st.Place(clientAddr, name, size, nil, log)
+	if err != nil {
+		return err
+	}
+	if err := in.Create(); err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Data flows once the client sees our answer, resent whenever it is
+	// overdue
+	reply := tftpAck(0)
+	if len(accepted) > 0 {
+		reply = tftpOptionAck(accepted)
+	}
+	if _, err := conn.WriteTo(reply, clientAddr); err != nil {
+		return fmt.Errorf("error sending ACK: %w", err)
+	}
+
+	buffer := make([]byte, 4+blockSize+1)
+	block := uint16(1) // Expected next; numbers wrap around in large files
+	timeouts := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.timeout()))
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				timeouts++
+				log.Warn("Timeout waiting for data packet", "attempt", timeouts, "max", s.maxRetries())
+				if timeouts >= s.maxRetries() {
+					return fmt.Errorf("%w: too many consecutive timeouts after %d bytes", wire.ErrTimeout, in.Written())
+				}
+				conn.WriteTo(reply, clientAddr)
+				continue
+			}
+			return fmt.Errorf("error reading data packet: %w", err)
+		}
+		if addr.String() != clientAddr.String() {
+			conn.WriteTo(tftpError(tftpErrUnknownTID, "unknown transfer ID"), addr)
+			continue
+		}
+		packet := buffer[:n]
+		if len(packet) < 4 {
+			log.Warn("Invalid data packet", "err", wire.ErrTruncated)
+			continue
+		}
+
+		switch binary.BigEndian.Uint16(packet) {
+		case tftpDATA:
+		case tftpERROR:
+			msg, _, _ := bytes.Cut(packet[4:], []byte{0})
+			return fmt.Errorf("%w: %s (code %d)", errTFTPAborted, msg, binary.BigEndian.Uint16(packet[2:]))
+		default:
+			log.Warn("Invalid data packet", "err", "not a DATA packet")
+			continue
+		}
+		seq, data := binary.BigEndian.Uint16(packet[2:]), packet[4:]
+		if seq == block-1 {
+			// Our ACK was lost
+			conn.WriteTo(reply, clientAddr)
+			continue
+		}
+		if seq != block {
+			log.Debug("Ignoring unexpected block", "block", seq, "expected", block)
+			continue
+		}
+		if len(data) > blockSize {
+			return fmt.Errorf("%w: %d-byte block, the block size is %d", wire.ErrProtocol, len(data), blockSize)
+		}
+
+		timeouts = 0
+		if _, err := in.Write(data); err != nil {
+			return err
+		}
+		if size >= 0 {
+			rep.Progress(in.Written())
+		}
+		reply = tftpAck(block)
+		block++
+		if len(data) < blockSize {
+			break
+		}
+		conn.WriteTo(reply, clientAddr)
+	}
+
+	// The last block is acknowledged once the file is safely stored
+	if err := in.Sync(); err != nil {
+		return err
+	}
+	upload, err := in.Commit()
+	if err != nil {
+		return err
+	}
+	conn.WriteTo(reply, clientAddr)
+
+	log.Info("File saved", "path", upload.Path, "bytes", in.Written(), "duration", time.Since(in.Started()))
+	rep.Complete(in.Written())
+	s.dallyTFTP(conn, clientAddr, block-1, reply, buffer)
+	return nil
+}
+
+// dallyTFTP re-acknowledges the last block for as long as the client may
+// keep resending it, in case our final ACK was lost.
+func (s *Server) dallyTFTP(conn net.PacketConn, clientAddr net.Addr, last uint16, ack, buffer []byte) {
+	conn.SetReadDeadline(time.Now().Add(s.timeout() * time.Duration(s.maxRetries())))
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		packet := buffer[:n]
+		if addr.String() == clientAddr.String() && len(packet) >= 4 &&
+			binary.BigEndian.Uint16(packet) == tftpDATA && binary.BigEndian.Uint16(packet[2:]) == last {
+			conn.WriteTo(ack, clientAddr)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package udpft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveTFTP runs s as a TFTP server on a loopback port until the test ends
+// and returns the address.
+func serveTFTP(t *testing.T, s *Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.UploadDir == "" {
+		s.UploadDir = t.TempDir()
+	}
+	s.Logger = quiet
+	s.Progress = func(Event) {}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeTFTP(ctx, conn)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return conn.LocalAddr().String()
+}
+
+// tftpClient is a hand-driven TFTP client.
+type tftpClient struct {
+	t    *testing.T
+	conn net.PacketConn
+	peer net.Addr // The transfer port once the server answers
+}
+
+func dialTFTP(t *testing.T) *tftpClient {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &tftpClient{t: t, conn: conn}
+}
+
+// request sends a request with opcode op and options in name, value
+// pairs to the server at addr.
+func (c *tftpClient) request(addr string, op uint16, name, mode string, options ...string) {
+	c.t.Helper()
+	b := binary.BigEndian.AppendUint16(nil, op)
+	for _, s := range append([]string{name, mode}, options...) {
+		b = append(append(b, s...), 0)
+	}
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.conn.WriteTo(b, to); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// data sends block seq holding p to the transfer port.
+func (c *tftpClient) data(seq uint16, p []byte) {
+	c.t.Helper()
+	b := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, tftpDATA), seq)
+	if _, err := c.conn.WriteTo(append(b, p...), c.peer); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// recv returns the next packet, remembering where it came from.
+func (c *tftpClient) recv() []byte {
+	c.t.Helper()
+	buf := make([]byte, 2048)
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, addr, err := c.conn.ReadFrom(buf)
+	if err != nil {
+		c.t.Fatalf("waiting for a reply: %v", err)
+	}
+	c.peer = addr
+	return buf[:n]
+}
+
+// expectAck fails the test unless the next packet acknowledges block.
+func (c *tftpClient) expectAck(block uint16) {
+	c.t.Helper()
+	if got := c.recv(); !bytes.Equal(got, tftpAck(block)) {
+		c.t.Fatalf("got %x, want ACK %d", got, block)
+	}
+}
+
+// expectError fails the test unless the next packet is an error with code.
+func (c *tftpClient) expectError(code uint16) {
+	c.t.Helper()
+	got := c.recv()
+	if len(got) < 4 || binary.BigEndian.Uint16(got) != tftpERROR {
+		c.t.Fatalf("got %x, want an error packet", got)
+	}
+	if got := binary.BigEndian.Uint16(got[2:]); got != code {
+		c.t.Errorf("got error code %d, want %d", got, code)
+	}
+}
+
+// send uploads data in blocks of blockSize, starting after the server's
+// first answer, and waits for each ACK.
+func (c *tftpClient) send(data []byte, blockSize int) {
+	c.t.Helper()
+	seq := uint16(1)
+	for {
+		n := min(blockSize, len(data))
+		c.data(seq, data[:n])
+		c.expectAck(seq)
+		data = data[n:]
+		if n < blockSize {
+			return
+		}
+		seq++
+	}
+}
+
+func TestTFTPUpload(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"short", 100},
+		{"one full block", TFTP_BLOCK_SIZE},
+		{"several blocks", 3*TFTP_BLOCK_SIZE + 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			addr := serveTFTP(t, s)
+			data := bytes.Repeat([]byte{'x'}, tt.size)
+
+			c := dialTFTP(t)
+			c.request(addr, tftpWRQ, "f.bin", "octet")
+			c.expectAck(0)
+			c.send(data, TFTP_BLOCK_SIZE)
+			checkStored(t, s.UploadDir, "f.bin", data)
+		})
+	}
+}
+
+// The client may name a path on its side and ask for another block size,
+// which the server confirms in an OACK.
+func TestTFTPOptions(t *testing.T) {
+	s := &Server{}
+	addr := serveTFTP(t, s)
+	data := bytes.Repeat([]byte("0123456789"), 300)
+
+	c := dialTFTP(t)
+	c.request(addr, tftpWRQ, `C:\boot\f.bin`, "OCTET", "blksize", "1024", "tsize", "3000", "windowsize", "4")
+	if got, want := c.recv(), tftpOptionAck([]string{"blksize", "1024", "tsize", "3000"}); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want OACK %q", got, want)
+	}
+	c.send(data, 1024)
+	checkStored(t, s.UploadDir, "f.bin", data)
+}
+
+// A block of exactly the block size never ends the file: it takes a
+// following empty block.
+func TestTFTPFullFinalBlock(t *testing.T) {
+	s := &Server{}
+	addr := serveTFTP(t, s)
+	data := bytes.Repeat([]byte{'y'}, TFTP_BLOCK_SIZE)
+
+	c := dialTFTP(t)
+	c.request(addr, tftpWRQ, "f", "octet")
+	c.expectAck(0)
+	c.data(1, data)
+	c.expectAck(1)
+	if _, err := os.Stat(filepath.Join(s.UploadDir, "f")); !os.IsNotExist(err) {
+		t.Fatalf("file stored after a full block: %v", err)
+	}
+	c.data(2, nil)
+	c.expectAck(2)
+	checkStored(t, s.UploadDir, "f", data)
+}
+
+// A client that resends a block because our ACK went missing gets the ACK
+// again, and its data is written once, including for the last block.
+func TestTFTPRetransmittedAck(t *testing.T) {
+	s := &Server{}
+	addr := serveTFTP(t, s)
+	first := bytes.Repeat([]byte{'a'}, TFTP_BLOCK_SIZE)
+
+	c := dialTFTP(t)
+	c.request(addr, tftpWRQ, "f", "octet")
+	c.expectAck(0)
+	c.data(1, first)
+	c.expectAck(1)
+	c.data(1, first)
+	c.expectAck(1)
+	c.data(2, []byte("end"))
+	c.expectAck(2)
+	c.data(2, []byte("end"))
+	c.expectAck(2)
+	checkStored(t, s.UploadDir, "f", append(first, "end"...))
+}
+
+func TestTFTPRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		op   uint16
+		file string
+		mode string
+		code uint16
+	}{
+		{"read request", tftpRRQ, "f", "octet", tftpErrIllegal},
+		{"netascii", tftpWRQ, "f", "netascii", tftpErrIllegal},
+		{"bad name", tftpWRQ, "/x/..", "octet", tftpErrAccess},
+		{"not a request", tftpACK, "f", "octet", tftpErrIllegal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			addr := serveTFTP(t, s)
+			c := dialTFTP(t)
+			c.request(addr, tt.op, tt.file, tt.mode)
+			c.expectError(tt.code)
+		})
+	}
+}
+
+// Packets from a port other than the client's get an unknown transfer ID
+// error and leave the transfer alone; an error packet from the client
+// ends it with nothing stored.
+func TestTFTPForeignAndAbort(t *testing.T) {
+	s := &Server{}
+	addr := serveTFTP(t, s)
+
+	c := dialTFTP(t)
+	c.request(addr, tftpWRQ, "f", "octet")
+	c.expectAck(0)
+
+	other := dialTFTP(t)
+	other.peer = c.peer
+	other.data(1, []byte("intruder"))
+	other.expectError(tftpErrUnknownTID)
+
+	c.conn.WriteTo(tftpError(tftpErrUndefined, "stop"), c.peer)
+	if !waitEmpty(t, s.UploadDir) {
+		t.Error("aborted transfer left files behind")
+	}
+}
+
+func TestParseTFTPRequest(t *testing.T) {
+	good := append(binary.BigEndian.AppendUint16(nil, tftpWRQ), "f\x00octet\x00BlkSize\x001024\x00"...)
+	req, err := parseTFTPRequest(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.name != "f" || req.mode != "octet" || req.options["blksize"] != "1024" {
+		t.Errorf("got %+v", req)
+	}
+
+	for _, b := range [][]byte{
+		nil,
+		{0, tftpWRQ},
+		append([]byte{0, tftpWRQ}, "f\x00octet"...),
+		append([]byte{0, tftpWRQ}, "f\x00"...),
+		append([]byte{0, tftpWRQ}, "f\x00octet\x00blksize\x00"...),
+	} {
+		if _, err := parseTFTPRequest(b); err == nil {
+			t.Errorf("%q accepted", b)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+// Package udpft transfers files over UDP using a selective-repeat ARQ: the
+// server acknowledges every data packet, and the client keeps a window of
+// them in flight, resending those whose ACK is overdue or that later packets
+// overtook. The window adapts to congestion unless Options.Window fixes it.
+//
+// A Server handles one transfer at a time and stores files under its upload
+// directory:
+//
+//	srv := &udpft.Server{Addr: ":8081", UploadDir: "uploads"}
+//	err := srv.ListenAndServe(ctx)
+//
+// A Client sends a single file and reports what was transferred:
+//
+//	var c udpft.Client
+//	res, err := c.SendFile(ctx, "host:8081", "backup.tar", udpft.Options{})
+//
+// Console output goes through Options.Logger and Options.Progress, so a
+// host application can silence or redirect it.
+//
+// When the server fails a transfer it tells the client why: the client
+// returns a *RemoteError that wraps ErrRejected, ErrTooLarge,
+// ErrChecksumMismatch, ErrTimeout, ErrProtocol, ErrNoSpace, ErrExpansion
+// for an archive the server won't unpack or, for a file the server's
+// scanner refused, ErrPolicy, for use with errors.Is.
+//
+// While the server stores a received file it tells the client what it is
+// doing, which the client reports through Options.Progress.
+//
+// Filenames no server accepts fail with ErrInvalidName before connecting.
+package udpft
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"socket-file-transfer/internal/wire"
+)
+
+const (
+	DefaultPacketSize = 1024
+	DefaultMaxRetries = 3
+	DefaultTimeout    = 2 * time.Second
+	DefaultPaceBurst  = 4
+	DefaultAckEvery   = 4
+	DefaultAckDelay   = 20 * time.Millisecond
+
+	// Bounds of Options.PacketSize. A data packet must fit the largest
+	// UDP payload, 65507 bytes.
+	MIN_PACKET_SIZE = 512
+	MAX_PACKET_SIZE = 65507 - wire.DATA_HEADER_LEN - wire.DATA_OFFSET_LEN
+
+	// How long the server waits for the first packet of a transfer
+	HEADER_TIMEOUT = 10 * time.Second
+
+	// Extra room in receive buffers for packet headers
+	HEADER_ROOM = 20
+
+	// Largest header packet a server accepts
+	MAX_HEADER_PACKET = wire.HELLO_LEN + wire.FILE_HEADER_LEN + wire.MAX_NAME_BYTES + wire.CHECKSUM_LEN + wire.PACKET_SIZE_LEN
+
+	// How many packets past the next expected one the server buffers, and
+	// so the most a client keeps in flight
+	RECEIVE_WINDOW = 256
+
+	// Packets in flight when a congestion-controlled transfer starts
+	INITIAL_WINDOW = 4
+
+	// Smallest cap of the window Options.Autotune tries
+	MIN_TUNED_WINDOW = 16
+
+	// A packet is taken as lost once this many later packets were
+	// acknowledged before it
+	DUP_THRESHOLD = 3
+
+	// Most data and parity packets in an FEC group
+	MAX_FEC_GROUP = 255
+
+	HEADER_ACK  = "HEADER_ACK"
+	HEADER_SKIP = "HEADER_SKIP" // Server already holds an identical copy
+
+	// Opens the padded packets a client sends before its data to find the
+	// largest packet that reaches the server. The server answers with the
+	// prefix and the 16-bit length it received.
+	PROBE = "PROBE"
+
+	// Probes sent at each packet size before trying half of it
+	PROBE_ATTEMPTS = 2
+
+	// Tell the server the client paused or resumed its transfer, see
+	// Options.Pause. The server echoes each.
+	PAUSE  = "PAUSE"
+	RESUME = "RESUME"
+
+	// Prefix of the packet a server storing a received file sends every
+	// wire.HEARTBEAT_INTERVAL instead of acknowledging the last data
+	// packets, followed by what it is doing, see FEATURE_HEARTBEAT
+	BUSY_PREFIX = "BUSY"
+
+	// Prefix of the packet that tells the client why the server failed its
+	// transfer, or the server that the client gave up, followed by an
+	// error frame
+	ERROR_PREFIX = "ERROR"
+)
+
+// What this side of the protocol speaks
+var hello = wire.Hello{
+	Version:  wire.PROTOCOL_VERSION,
+	Features: wire.FEATURE_SKIP_IDENTICAL | wire.FEATURE_PACKET_SIZE | wire.FEATURE_FEC | wire.FEATURE_CUMULATIVE_ACK | wire.FEATURE_SPARSE | wire.FEATURE_PAUSE | wire.FEATURE_HEARTBEAT,
+}
+
+// Options tunes a transfer. The zero value uses the defaults.
+type Options struct {
+	// PacketSize is the data payload of each packet, DefaultPacketSize if
+	// 0, at most MAX_PACKET_SIZE. The client announces it to the server;
+	// above the default it first probes whether packets that large get
+	// through and halves the size until they do. The server uses it only
+	// for legacy clients, which don't announce theirs.
+	PacketSize int
+
+	// Timeout is how long to wait for an ACK (client) or the next packet
+	// (server), DefaultTimeout if 0
+	Timeout time.Duration
+
+	// MaxRetries is how often the client resends an unacknowledged packet,
+	// and how many consecutive timeouts the server tolerates,
+	// DefaultMaxRetries if 0
+	MaxRetries int
+
+	// Logger receives status and error messages, wire.DefaultLogger if nil
+	Logger *slog.Logger
+
+	// Progress receives the events of each transfer: started, bytes
+	// transferred, retransmissions, completed or failed. Events of one
+	// transfer are delivered in order from a single goroutine; while the
+	// function is busy, byte-progress events are coalesced so a slow
+	// consumer never stalls the transfer. A console progress line is drawn
+	// if nil.
+	Progress ProgressFunc
+
+	// Window fixes how many data packets the client keeps unacknowledged,
+	// at most RECEIVE_WINDOW. If 0 the client adapts it instead: starting
+	// from INITIAL_WINDOW it grows by one packet per round trip and halves
+	// on loss (AIMD).
+	Window int
+
+	// MaxWindow caps the adaptive window, RECEIVE_WINDOW if 0
+	MaxWindow int
+
+	// Autotune caps the adaptive window from the transfer's throughput
+	// instead, trying MIN_TUNED_WINDOW up to MaxWindow over its first
+	// seconds, see wire.Tuner (client only). A fixed Window isn't tuned,
+	// and neither is PacketSize, which stays as negotiated.
+	Autotune bool
+
+	// WindowTrace, if set, is called whenever the window changes or a
+	// packet is taken as lost
+	WindowTrace func(WindowSample)
+
+	// PaceBurst is how many packets the client may send back-to-back;
+	// beyond that new packets are spread across the round-trip time,
+	// DefaultPaceBurst if 0
+	PaceBurst int
+
+	// FECData and FECParity turn on forward error correction (client
+	// only): after every FECData data packets the client sends FECParity
+	// Reed-Solomon parity packets, from which the server rebuilds up to
+	// FECParity lost packets of the group without waiting for them to be
+	// resent. Both 0 disables it.
+	FECData   int
+	FECParity int
+
+	// SkipIdentical asks the server to skip the body if it already holds
+	// an identical copy (client only)
+	SkipIdentical bool
+
+	// Pause holds back the transfer while paused (client only): no new
+	// packets go out and overdue ACKs aren't counted against it. Servers
+	// that support it are told, so they wait up to their MaxPause.
+	Pause *Pause
+
+	// Name is what SendFile asks the server to store the file as, the
+	// file's base name if empty (client only)
+	Name string
+
+	// Legacy interoperates with peers that predate version negotiation:
+	// the client sends a bare file header, the server accepts one instead
+	// of refusing it
+	Legacy bool
+
+	// NoPreallocate grows received files as data arrives instead of
+	// reserving their full size up front (server only)
+	NoPreallocate bool
+
+	// HookCommand runs through the shell after each file is stored, with
+	// the upload described in its environment (server only)
+	HookCommand string
+
+	// HookURL receives a JSON POST describing each stored file (server
+	// only)
+	HookURL string
+
+	// HookStrict waits for the hooks before confirming a transfer and
+	// fails it if one fails, moving the file to .quarantine in the upload
+	// directory (server only). Otherwise hooks run in the background and
+	// failures are only logged.
+	HookStrict bool
+
+	// AckEvery is how many in-order packets the server acknowledges with
+	// one cumulative ACK, for clients that understand them (server only),
+	// DefaultAckEvery if 0. 1 acknowledges every packet.
+	AckEvery int
+
+	// AckDelay is the longest the server holds back an ACK waiting for
+	// AckEvery packets (server only), DefaultAckDelay if 0
+	AckDelay time.Duration
+
+	// BatchIO reads and acknowledges packets in batches using recvmmsg and
+	// sendmmsg on Linux (server only). It only pays off with many packets
+	// in flight; over loopback it costs more than it saves.
+	BatchIO bool
+}
+
+func (o *Options) packetSize() int {
+	if o.PacketSize > 0 {
+		return o.PacketSize
+	}
+	return DefaultPacketSize
+}
+
+func (o *Options) congestionController() congestionController {
+	if o.Window > 0 {
+		return fixedWindow(min(o.Window, RECEIVE_WINDOW))
+	}
+	return newAIMD(o.maxWindow())
+}
+
+func (o *Options) maxWindow() int {
+	if o.MaxWindow > 0 {
+		return min(o.MaxWindow, RECEIVE_WINDOW)
+	}
+	return RECEIVE_WINDOW
+}
+
+func (o *Options) paceBurst() int {
+	if o.PaceBurst > 0 {
+		return o.PaceBurst
+	}
+	return DefaultPaceBurst
+}
+
+func (o *Options) ackEvery() int {
+	if o.AckEvery > 0 {
+		return o.AckEvery
+	}
+	return DefaultAckEvery
+}
+
+func (o *Options) ackDelay() time.Duration {
+	if o.AckDelay > 0 {
+		return o.AckDelay
+	}
+	return DefaultAckDelay
+}
+
+func (o *Options) timeout() time.Duration {
+	if o.Timeout > 0 {
+		return o.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (o *Options) maxRetries() int {
+	if o.MaxRetries > 0 {
+		return o.MaxRetries
+	}
+	return DefaultMaxRetries
+}
+
+func (o *Options) remoteName(path string) string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return filepath.Base(path)
+}
+
+func (o *Options) logger() *slog.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return wire.DefaultLogger
+}
+
+func (o *Options) reporter(remote string) *wire.Reporter {
+	return wire.NewReporter(o.Progress, remote)
+}
+
+// Progress events, see Options.Progress.
+type (
+	Event        = wire.Event
+	EventKind    = wire.EventKind
+	ProgressFunc = wire.ProgressFunc
+)
+
+const (
+	EventStarted    = wire.EventStarted
+	EventProgress   = wire.EventProgress
+	EventRetransmit = wire.EventRetransmit
+	EventCompleted  = wire.EventCompleted
+	EventFailed     = wire.EventFailed
+	EventBusy       = wire.EventBusy
+)
+
+// Pause pauses and resumes transfers, see Options.Pause.
+type Pause = wire.Pause
+
+// RemoteError is a failure reported by the other side of a transfer.
+type RemoteError = wire.RemoteError
+
+// Stats counts the packets of a transfer. The client returns them in its
+// Result, the server in its EventCompleted.
+type Stats = wire.Stats
+
+// Transfer failures, wrapped by the errors transfers return.
+var (
+	ErrChecksumMismatch = wire.ErrChecksumMismatch
+	ErrRejected         = wire.ErrRejected
+	ErrTooLarge         = wire.ErrTooLarge
+	ErrExpansion        = wire.ErrExpansion
+	ErrTimeout          = wire.ErrTimeout
+	ErrProtocol         = wire.ErrProtocol
+	ErrInvalidName      = wire.ErrInvalidName
+	ErrNoSpace          = wire.ErrNoSpace
+	ErrAborted          = wire.ErrAborted
+	ErrPolicy           = wire.ErrPolicy
+)
+
+// errorPacket encodes err for sending to the other side.
+func errorPacket(err error) []byte {
+	frame, _ := wire.NewRemoteError(err).MarshalBinary()
+	return append([]byte(ERROR_PREFIX), frame...)
+}
+
+// abortPacket tells the server the client gave up because of reason.
+func abortPacket(reason error) []byte {
+	frame, _ := wire.NewAbort(reason).MarshalBinary()
+	return append([]byte(ERROR_PREFIX), frame...)
+}
+
+// busyStatus decodes a heartbeat, reporting whether b is one.
+func busyStatus(b []byte) (string, bool) {
+	if !bytes.HasPrefix(b, []byte(BUSY_PREFIX)) {
+		return "", false
+	}
+	return string(b[len(BUSY_PREFIX):]), true
+}
+
+// remoteError decodes an error packet, returning nil for anything else.
+func remoteError(b []byte) error {
+	if !bytes.HasPrefix(b, []byte(ERROR_PREFIX)) {
+		return nil
+	}
+	var rerr wire.RemoteError
+	if rerr.UnmarshalBinary(b[len(ERROR_PREFIX):]) != nil {
+		return nil
+	}
+	return &rerr
+}
+
+// Result describes a completed send.
+type Result struct {
+	Bytes      int64         // File bytes put on the wire
+	Duration   time.Duration // Time spent transferring data
+	Checksum   []byte        // SHA-256 of the file
+	Skipped    bool          // Server already held an identical copy
+	Packets    uint32        // Data packets acknowledged
+	SendRate   float64       // Packets sent per second, retransmissions included
+	PeakWindow int           // Most packets the client allowed in flight
+	MaxWindow  int           // Cap Options.Autotune settled the window on, 0 if the transfer ended first or wasn't tuned
+	Session    uint32        // The server's ID of the transfer, 0 before protocol version 3
+	Stats                    // Packet counters of the transfer
+}
+
+// Goodput is the file bytes delivered per second.
+func (r *Result) Goodput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+// WireRate is the bytes put on the wire per second, packet headers,
+// retransmissions and FEC parity included.
+func (r *Result) WireRate() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.WireBytes) / r.Duration.Seconds()
+}
+
+// WindowSample is a point in the congestion window's history.
+type WindowSample struct {
+	Elapsed time.Duration // Since the first data packet
+	Window  int           // Packets allowed in flight
+	RTT     time.Duration // Smoothed round-trip time, 0 before the first ACK
+	Loss    bool          // A packet was lost; an adaptive window halves
+}
@@ -0,0 +1,121 @@
+package udpft
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"socket-file-transfer/internal/wire"
+)
+
+func TestVersionCombinations(t *testing.T) {
+	data := []byte(strings.Repeat("interop ", 4000))
+	tests := []struct {
+		name          string
+		client        bool // Client with -legacy
+		server        bool // Server with -legacy
+		wantRejection bool
+	}{
+		{"new client, new server", false, false, false},
+		{"new client, server with -legacy", false, true, false},
+		{"legacy client, new server", true, false, true},
+		{"legacy client, server with -legacy", true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			s.Legacy = tt.server
+			addr := serve(t, s)
+
+			opts := quietOptions()
+			opts.Legacy = tt.client
+			var c Client
+			_, err := c.SendFile(context.Background(), addr, writeFile(t, "f.txt", data), opts)
+			if tt.wantRejection {
+				if err == nil {
+					t.Fatal("legacy client accepted by a server without -legacy")
+				}
+				if !errors.Is(err, wire.ErrProtocol) || !strings.Contains(err.Error(), "-legacy") {
+					t.Errorf("got %v, want a protocol error suggesting -legacy", err)
+				}
+				dirEmpty(t, s.UploadDir)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkStored(t, s.UploadDir, "f.txt", data)
+		})
+	}
+}
+
+// A versioned client takes what the server's header ACK decided, and
+// refuses an old-format ACK or one granting more than it offered.
+func TestParseHeaderAck(t *testing.T) {
+	ack := func(a wire.HeaderAck) []byte {
+		b, _ := a.MarshalBinary()
+		return b
+	}
+	old, _ := (&wire.Hello{Version: 2, Features: hello.Features}).MarshalBinary()
+	fec := &wire.FileHeader{Name: "f", Flags: wire.FLAG_FEC | wire.FLAG_PACKET_SIZE, PacketSize: 1400, FECData: 8, FECParity: 2}
+	tests := []struct {
+		name      string
+		reply     []byte
+		fh        *wire.FileHeader
+		opts      Options
+		want      error  // Wrapped by the error, nil to succeed
+		wantText  string // In the error
+		wantSize  int
+		wantNoFEC bool
+	}{
+		{"default", ack(wire.HeaderAck{Version: 3, Session: 4, PacketSize: DefaultPacketSize, Features: hello.Features}), &wire.FileHeader{Name: "f"}, Options{}, nil, "", DefaultPacketSize, false},
+		{"lowered packet size", ack(wire.HeaderAck{Version: 3, PacketSize: 1200, Features: hello.Features}), fec, Options{PacketSize: 1400, FECData: 8, FECParity: 2}, nil, "", 1200, false},
+		{"no FEC", ack(wire.HeaderAck{Version: 3, PacketSize: 1400, Features: hello.Features &^ wire.FEATURE_FEC}), fec, Options{PacketSize: 1400, FECData: 8, FECParity: 2}, nil, "", 1400, true},
+		{"server too old", append([]byte(HEADER_ACK), old...), &wire.FileHeader{Name: "f"}, Options{}, wire.ErrProtocol, "server too old", 0, false},
+		{"old skip", append([]byte(HEADER_SKIP), old...), &wire.FileHeader{Name: "f"}, Options{}, wire.ErrProtocol, "server too old", 0, false},
+		{"larger packets than asked", ack(wire.HeaderAck{Version: 3, PacketSize: 2048, Features: hello.Features}), &wire.FileHeader{Name: "f"}, Options{}, wire.ErrProtocol, "packet size", 0, false},
+		{"tiny packets", ack(wire.HeaderAck{Version: 3, PacketSize: MIN_PACKET_SIZE - 1, Features: hello.Features}), &wire.FileHeader{Name: "f"}, Options{}, wire.ErrProtocol, "packet size", 0, false},
+		{"features not offered", ack(wire.HeaderAck{Version: 3, PacketSize: DefaultPacketSize, Features: hello.Features | wire.FEATURE_DELTA}), &wire.FileHeader{Name: "f"}, Options{}, wire.ErrProtocol, "features", 0, false},
+		{"version 2", ack(wire.HeaderAck{Version: 2, PacketSize: DefaultPacketSize, Features: hello.Features}), &wire.FileHeader{Name: "f"}, Options{}, wire.ErrProtocol, "version 2", 0, false},
+		{"truncated", ack(wire.HeaderAck{Version: 3})[:10], &wire.FileHeader{Name: "f"}, Options{}, wire.ErrTruncated, "invalid header ACK", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Logger = quiet
+			a, err := parseHeaderAck(tt.reply, tt.fh, &opts)
+			if tt.want != nil {
+				if !errors.Is(err, tt.want) || !strings.Contains(err.Error(), tt.wantText) {
+					t.Fatalf("got %v, want %v mentioning %q", err, tt.want, tt.wantText)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.PacketSize != tt.wantSize || int(a.PacketSize) != tt.wantSize {
+				t.Errorf("packet size %d, ACK %d, want %d", opts.PacketSize, a.PacketSize, tt.wantSize)
+			}
+			if noFEC := opts.FECData == 0 && opts.FECParity == 0; tt.opts.FECData > 0 && noFEC != tt.wantNoFEC {
+				t.Errorf("FEC %d+%d, want it dropped: %v", opts.FECData, opts.FECParity, tt.wantNoFEC)
+			}
+		})
+	}
+}
+
+// Each transfer gets a session ID of its own from the server.
+func TestHeaderAckSession(t *testing.T) {
+	addr := serve(t, &Server{})
+	seen := map[uint32]bool{}
+	for i := 0; i < 3; i++ {
+		res, err := (&Client{}).SendFile(context.Background(), addr, writeFile(t, "f", []byte("session")), quietOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Session == 0 || seen[res.Session] {
+			t.Errorf("transfer %d got session %d, want a new non-zero one", i, res.Session)
+		}
+		seen[res.Session] = true
+	}
+}
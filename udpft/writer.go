@@ -0,0 +1,133 @@
+package udpft
+
+import (
+	"io"
+
+	"socket-file-transfer/internal/buffers"
+)
+
+// Buffers of received data that may wait for the disk before the server
+// stops acknowledging new packets
+const WRITE_QUEUE_LEN = 64
+
+// Size of the buffers received data is gathered into for the disk, from
+// the pool the TCP server and checksum.Pipe take theirs from
+const WRITE_BUFFER_SIZE = 64 << 10
+
+// diskWriter writes received data from its own goroutine, so a slow disk
+// doesn't stall reading and acknowledging packets. While the disk is
+// behind, data for consecutive offsets is gathered into a buffer to be
+// written at once. Once its queue is full, Write blocks until the disk
+// catches up.
+type diskWriter struct {
+	chunks  chan chunk
+	failed  chan struct{} // Closed once a write has failed
+	done    chan struct{}
+	closed  bool
+	err     error
+	pending chunk // Being gathered, not queued yet; buf is nil if none
+}
+
+// chunk is data gathered in a pooled buffer, to be written at an offset
+// in the file.
+type chunk struct {
+	buf    *[]byte
+	n      int
+	offset int64
+}
+
+func newDiskWriter(w io.WriterAt) *diskWriter {
+	d := &diskWriter{
+		chunks: make(chan chunk, WRITE_QUEUE_LEN),
+		failed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go d.run(w)
+	return d
+}
+
+func (d *diskWriter) run(w io.WriterAt) {
+	defer close(d.done)
+	for c := range d.chunks {
+		// After a failure only drain, so Write never blocks on a dead
+		// writer
+		if d.err == nil {
+			if _, err := w.WriteAt((*c.buf)[:c.n], c.offset); err != nil {
+				d.err = err
+				close(d.failed)
+			}
+		}
+		buffers.Put(c.buf)
+	}
+}
+
+// Write copies p to be written at offset off, so p may be reused once it
+// returns. It returns the error of an earlier write that failed.
+func (d *diskWriter) Write(p []byte, off int64) error {
+	for len(p) > 0 {
+		c := &d.pending
+		if c.buf != nil && (off != c.offset+int64(c.n) || c.n == len(*c.buf)) {
+			if err := d.flush(); err != nil {
+				return err
+			}
+		}
+		if c.buf == nil {
+			*c = chunk{buf: buffers.Get(WRITE_BUFFER_SIZE), offset: off}
+		}
+		k := copy((*c.buf)[c.n:], p)
+		c.n += k
+		p, off = p[k:], off+int64(k)
+	}
+	// Gathering only pays while the disk is busy with what was queued
+	if len(d.chunks) == 0 {
+		return d.flush()
+	}
+	return nil
+}
+
+// flush queues the data gathered, if any.
+func (d *diskWriter) flush() error {
+	if d.pending.buf == nil {
+		return nil
+	}
+	select {
+	case d.chunks <- d.pending:
+		d.pending = chunk{}
+		return nil
+	case <-d.failed:
+		return d.err
+	}
+}
+
+// Zeros filling in holes on storage that only appends
+var zeros = make([]byte, 64<<10)
+
+// WriteZeros queues n zero bytes for writing at offset off.
+func (d *diskWriter) WriteZeros(n, off int64) error {
+	for n > 0 {
+		k := min(n, int64(len(zeros)))
+		if err := d.Write(zeros[:k], off); err != nil {
+			return err
+		}
+		n -= k
+		off += k
+	}
+	return nil
+}
+
+// Close writes what is gathered and queued and returns the first error.
+// It may be called more than once.
+func (d *diskWriter) Close() error {
+	if !d.closed {
+		d.flush()
+		close(d.chunks)
+		d.closed = true
+	}
+	<-d.done
+	if d.pending.buf != nil {
+		// Not queued, after a failure
+		buffers.Put(d.pending.buf)
+		d.pending = chunk{}
+	}
+	return d.err
+}
@@ -0,0 +1,157 @@
+package udpft
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fileAt is an io.WriterAt into memory, as slow as delay for each write,
+// failing them once fail is set.
+type fileAt struct {
+	mu     sync.Mutex
+	data   []byte
+	writes int
+	delay  time.Duration
+	fail   error
+}
+
+func (f *fileAt) WriteAt(p []byte, off int64) (int, error) {
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail != nil {
+		return 0, f.fail
+	}
+	if end := int(off) + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	copy(f.data[off:], p)
+	f.writes++
+	return len(p), nil
+}
+
+// Data arriving in any order lands at its offsets, gathered into fewer
+// writes while the disk is behind, and the packets written may be reused
+// at once.
+func TestDiskWriter(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(5)).Read(data)
+	const packet = 1000
+	var offsets []int
+	for off := 0; off < len(data); off += packet {
+		offsets = append(offsets, off)
+	}
+	// Some out of order, as a lossy network delivers them
+	r := rand.New(rand.NewSource(6))
+	for i := 0; i < len(offsets)/20; i++ {
+		a, b := r.Intn(len(offsets)), r.Intn(len(offsets))
+		offsets[a], offsets[b] = offsets[b], offsets[a]
+	}
+
+	f := &fileAt{delay: 100 * time.Microsecond}
+	d := newDiskWriter(f)
+	p := make([]byte, packet)
+	for _, off := range offsets {
+		n := copy(p, data[off:])
+		if err := d.Write(p[:n], int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		clear(p)
+	}
+	if err := d.WriteZeros(100<<10, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := append(data, make([]byte, 100<<10)...)
+	if !bytes.Equal(f.data, want) {
+		t.Fatalf("wrote %d bytes, not the %d queued", len(f.data), len(want))
+	}
+	if f.writes >= len(offsets)/2 {
+		t.Errorf("%d writes for %d packets, want them gathered", f.writes, len(offsets))
+	}
+}
+
+// A failed write is returned by a later Write, which doesn't block, and by
+// Close.
+func TestDiskWriterFailure(t *testing.T) {
+	errFull := errors.New("disk full")
+	f := &fileAt{fail: errFull}
+	d := newDiskWriter(f)
+	var err error
+	p := make([]byte, 1000)
+	deadline := time.Now().Add(5 * time.Second)
+	for off := int64(0); err == nil && time.Now().Before(deadline); off += int64(len(p)) {
+		err = d.Write(p, off)
+	}
+	if !errors.Is(err, errFull) {
+		t.Errorf("Write: got %v, want %v", err, errFull)
+	}
+	if err := d.Close(); !errors.Is(err, errFull) {
+		t.Errorf("Close: got %v, want %v", err, errFull)
+	}
+}
+
+// Against a disk as slow as 2ms a write, a receive loop writing through
+// the diskWriter keeps up with packets arriving at 10 MB/s, while one
+// writing each packet itself falls behind and loses them. The socket
+// buffer is a queue of 64 packets, dropping what arrives once it is full.
+func TestDiskWriterSlowDisk(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes a quarter of a second per receive loop")
+	}
+	const packets, packet, burst = 2000, 1000, 10
+	receive := func(write func(p []byte, off int64) error) (dropped int, longest time.Duration) {
+		socket := make(chan int64, 64)
+		go func() {
+			defer close(socket)
+			for i := 0; i < packets; i += burst {
+				for j := i; j < i+burst; j++ {
+					select {
+					case socket <- int64(j) * packet:
+					default:
+						dropped++
+					}
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		p := make([]byte, packet)
+		for off := range socket {
+			start := time.Now()
+			if err := write(p, off); err != nil {
+				t.Fatal(err)
+			}
+			longest = max(longest, time.Since(start))
+		}
+		return dropped, longest
+	}
+
+	inline := &fileAt{delay: 2 * time.Millisecond}
+	syncDropped, syncLongest := receive(func(p []byte, off int64) error {
+		_, err := inline.WriteAt(p, off)
+		return err
+	})
+	f := &fileAt{delay: 2 * time.Millisecond}
+	d := newDiskWriter(f)
+	dropped, longest := receive(d.Write)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("writing in line: %d of %d packets dropped, longest write %v", syncDropped, packets, syncLongest)
+	t.Logf("diskWriter: %d dropped, longest write %v, %d writes", dropped, longest, f.writes)
+	if syncDropped == 0 {
+		t.Fatal("writing in line kept up, the disk isn't slow enough to tell")
+	}
+	if dropped != 0 {
+		t.Errorf("diskWriter: %d of %d packets dropped", dropped, packets)
+	}
+	if want := (packets - dropped) * packet; len(f.data) != want {
+		t.Errorf("diskWriter wrote %d bytes, want %d", len(f.data), want)
+	}
+}